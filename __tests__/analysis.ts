@@ -0,0 +1,110 @@
+import { EventNames, analyze } from "../src/analysis";
+
+// This mock is used for steps that forward the events they receive.
+const forward = (names: EventNames): EventNames => names;
+
+test("@standalone Analysis of a proper pipeline finds nothing", () => {
+  // Arrange
+  const steps = [
+    {
+      name: "a",
+      after: [],
+      pattern: "sensor.#",
+      patternMode: "drop" as const,
+      emits: forward,
+    },
+    {
+      name: "b",
+      after: ["a"],
+      pattern: "sensor.temperature",
+      patternMode: "pass" as const,
+      emits: (names: EventNames) => names?.map((n) => `${n}.checked`) ?? null,
+    },
+  ];
+  // Act
+  const report = analyze(["sensor.temperature", "sensor.humidity"], steps);
+  // Assert
+  expect(report).toEqual({ errors: [], warnings: [] });
+});
+
+test("@standalone Analysis reports unreachable steps", () => {
+  // Arrange
+  const steps = [
+    {
+      name: "alerts",
+      after: [],
+      pattern: "alert.#",
+      patternMode: "drop" as const,
+      emits: forward,
+    },
+    {
+      name: "notify",
+      after: ["alerts"],
+      patternMode: "pass" as const,
+      emits: forward,
+    },
+  ];
+  // Act
+  const report = analyze(["sensor.temperature"], steps);
+  // Assert
+  expect(report.errors).toEqual([
+    "step 'notify' is unreachable: no events can reach it",
+  ]);
+  expect(report.warnings).toEqual([
+    "step 'alerts' has a pattern that doesn't match any of the events " +
+      "that can reach it ('sensor.temperature')",
+    "the input emits events that every step after it drops " +
+      "('sensor.temperature')",
+  ]);
+});
+
+test("@standalone Analysis reports events dropped by every following step", () => {
+  // Arrange
+  const steps = [
+    {
+      name: "rename",
+      after: [],
+      patternMode: "pass" as const,
+      emits: (): EventNames => ["renamed", "renamed.error"],
+    },
+    {
+      name: "store",
+      after: ["rename"],
+      pattern: "renamed",
+      patternMode: "drop" as const,
+      emits: forward,
+    },
+  ];
+  // Act
+  const report = analyze(["original"], steps);
+  // Assert
+  expect(report.errors).toEqual([]);
+  expect(report.warnings).toEqual([
+    "step 'rename' emits events that every step after it drops " +
+      "('renamed.error')",
+  ]);
+});
+
+test("@standalone Analysis doesn't report anything about unknown names", () => {
+  // Arrange
+  const steps = [
+    {
+      name: "a",
+      after: [],
+      pattern: "never.#",
+      patternMode: "drop" as const,
+      emits: forward,
+    },
+    {
+      name: "b",
+      after: ["a"],
+      pattern: "{x,y}.*",
+      patternMode: "drop" as const,
+      emits: forward,
+    },
+  ];
+  // Act
+  const report = analyze(null, steps);
+  // Assert
+  expect(report).toEqual({ errors: [], warnings: [] });
+});
@@ -1,3 +1,5 @@
+import { createServer } from "http";
+import { AddressInfo } from "net";
 import { PassThrough, Readable } from "stream";
 // Mock the stdio wrapper module.
 const stdoutMock = {
@@ -20,7 +22,18 @@ jest.mock("../src/io/stdio", () => {
 });
 afterEach(() => mockSTDOUTGetter.mockClear());
 
-import { makePipelineTemplate, runPipeline } from "../src/api";
+import {
+  analyzePipeline,
+  makePipelineTemplate,
+  probePipeline,
+  registerInput,
+  registerStepFunction,
+  reloadOnSignals,
+  runPipeline,
+  stopOnSignals,
+} from "../src/api";
+import { AsyncQueue, flatMap } from "../src/async-queue";
+import { Event, make as makeEvent, makeFrom } from "../src/event";
 import { resolveAfter } from "../src/utils";
 
 test("@standalone Pipeline template construction works normally", () => {
@@ -104,6 +117,81 @@ test("@standalone Functions must use exactly one of flatmap or reduce", () => {
   expect(() => makePipelineTemplate(correct)).not.toThrow();
 });
 
+test("@standalone Timeouts are only allowed for functions that honor them", () => {
+  // Arrange
+  const unsupported = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: { timeout: 5, flatmap: { keep: 1 } },
+    },
+  };
+  const invalid = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: { timeout: "0", flatmap: { "send-receive-http": "http://nothing" } },
+    },
+  };
+  const correct = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: { timeout: "2.5", flatmap: { "send-receive-http": "http://nothing" } },
+    },
+  };
+  // Act & assert
+  expect(() => makePipelineTemplate(unsupported)).toThrow();
+  expect(() => makePipelineTemplate(invalid)).toThrow();
+  expect(() => makePipelineTemplate(correct)).not.toThrow();
+});
+
+test("@standalone Concurrency is only allowed for stateless functions", () => {
+  // Arrange
+  const stateful = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: { concurrency: { instances: 4 }, reduce: { deduplicate: {} } },
+    },
+  };
+  const partitioned = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: {
+        concurrency: { instances: 4 },
+        partition: { lanes: 2, "key-jq-expr": ".d.tenant" },
+        flatmap: { keep: 1 },
+      },
+    },
+  };
+  const single = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: { concurrency: { instances: "1" }, reduce: { deduplicate: {} } },
+    },
+  };
+  const correct = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: {
+        concurrency: { instances: "4", ordered: false },
+        flatmap: { rename: { append: ".renamed" } },
+      },
+    },
+  };
+  // Act & assert
+  expect(() => makePipelineTemplate(stateful)).toThrow(
+    "step 'a' can't run concurrent instances of the deduplicate function"
+  );
+  expect(() => makePipelineTemplate(partitioned)).toThrow();
+  expect(() => makePipelineTemplate(single)).not.toThrow();
+  expect(() => makePipelineTemplate(correct)).not.toThrow();
+});
+
 test("@standalone The function keep-when must hold a valid schema", () => {
   // Arrange
   const invalidRaw = {
@@ -125,6 +213,196 @@ test("@standalone The function keep-when must hold a valid schema", () => {
   expect(() => makePipelineTemplate(validRaw)).not.toThrow();
 });
 
+test("@standalone Invalid jq expressions are rejected along with the step using them", () => {
+  // Arrange
+  const invalidRaw = {
+    name: "Test",
+    input: { stdin: {} },
+    steps: {
+      a: { flatmap: { keep: 1 } },
+      b: {
+        flatmap: {
+          switch: { cases: [{ "jq-expr": ".d >", name: "lorem.ipsum" }] },
+        },
+      },
+    },
+  };
+  const invalidPrelude = {
+    name: "Test",
+    "jq-prelude": "def f: ;",
+    input: { stdin: {} },
+  };
+  // Act & assert
+  expect(() => makePipelineTemplate(invalidRaw)).toThrow(
+    /^step 'b' has an invalid jq expression under flatmap\.switch\.cases\.0\.jq-expr: \.d >\n.*syntax error/
+  );
+  expect(() => makePipelineTemplate(invalidPrelude)).toThrow(
+    /^the pipeline's jq-prelude is invalid/
+  );
+});
+
+test("@standalone Registered inputs and step functions are resolved by name", async () => {
+  // Arrange
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const collected: unknown[] = [];
+  registerInput<{ values: number[] }>("fixed", {
+    optionsSchema: {
+      type: "object",
+      properties: { values: { type: "array", items: { type: "number" } } },
+      additionalProperties: false,
+      required: ["values"],
+    },
+    validate: () => {
+      // Nothing needs to be validated.
+    },
+    emits: () => ["fixed"],
+    make: (params, options) => {
+      const queue = new AsyncQueue<number>("input.fixed");
+      options.values.forEach((value) => queue.push(value));
+      queue.close();
+      const channel = flatMap(
+        async (value: number) => [await makeEvent("fixed", value, trace)],
+        queue.asChannel()
+      );
+      return [{ ...channel, send: () => false }, queue.drain];
+    },
+  });
+  registerStepFunction<{ amount: number }>("add", {
+    optionsSchema: {
+      type: "object",
+      properties: { amount: { type: "number" } },
+      additionalProperties: false,
+      required: ["amount"],
+    },
+    validate: (name, options) => {
+      if (!Number.isFinite(options.amount)) {
+        throw new Error(`step '${name}' must add a finite amount`);
+      }
+    },
+    make: async (params, options) =>
+      flatMap(
+        (events: Event[]) =>
+          Promise.all(
+            events.map((event) =>
+              makeFrom(event, { data: (event.data as number) + options.amount })
+            )
+          ),
+        new AsyncQueue<Event[]>(`step.${params.stepName}.add`).asChannel()
+      ),
+  });
+  registerStepFunction("collect", {
+    optionsSchema: { type: "null" },
+    validate: () => {
+      // Nothing needs to be validated.
+    },
+    make: async (params) =>
+      flatMap(
+        async (events: Event[]) => {
+          collected.push(...events.map((event) => event.data));
+          return events;
+        },
+        new AsyncQueue<Event[]>(`step.${params.stepName}.collect`).asChannel()
+      ),
+  });
+  const rawTemplate = {
+    name: "Test",
+    input: { fixed: { values: [1, 2, 3] } },
+    steps: {
+      a: { flatmap: { add: { amount: 10 } } },
+      b: { after: ["a"], flatmap: { collect: null } },
+    },
+  };
+  // Act
+  const template = makePipelineTemplate(rawTemplate);
+  const [promise] = await runPipeline(template);
+  await promise;
+  // Assert
+  expect(collected).toEqual([11, 12, 13]);
+  expect(analyzePipeline(template).errors).toEqual([]);
+  expect(() =>
+    makePipelineTemplate({
+      ...rawTemplate,
+      steps: { a: { flatmap: { add: { amount: "ten" } } } },
+    })
+  ).toThrow();
+  expect(() =>
+    registerInput("stdin", {
+      optionsSchema: {},
+      validate: jest.fn(),
+      make: jest.fn(),
+    })
+  ).toThrow("the input name 'stdin' is already registered");
+  expect(() =>
+    registerStepFunction("add", {
+      optionsSchema: {},
+      validate: jest.fn(),
+      make: jest.fn(),
+    })
+  ).toThrow("the step function name 'add' is already registered");
+});
+
+test("@standalone Pipeline analysis accepts a proper pipeline", () => {
+  // Arrange
+  const template = makePipelineTemplate({
+    name: "Test",
+    input: { generator: "sensor.reading" },
+    steps: {
+      classify: {
+        flatmap: {
+          switch: {
+            cases: [{ "jq-expr": ".d > 30", name: "sensor.alert" }],
+          },
+        },
+      },
+      alerts: {
+        after: ["classify"],
+        "match/drop": "sensor.alert",
+        flatmap: { "send-stdout": {} },
+      },
+      readings: {
+        after: ["classify"],
+        "match/drop": "sensor.reading",
+        window: { events: 10, seconds: 5 },
+        reduce: { "send-stdout": {} },
+      },
+    },
+  });
+  // Act
+  const report = analyzePipeline(template);
+  // Assert
+  expect(report).toEqual({ errors: [], warnings: [] });
+});
+
+test("@standalone Pipeline analysis reports an unreachable step", () => {
+  // Arrange
+  const template = makePipelineTemplate({
+    name: "Test",
+    input: { generator: "sensor.reading" },
+    steps: {
+      tag: { flatmap: { rename: { append: ".tagged" } } },
+      alerts: {
+        after: ["tag"],
+        "match/drop": "sensor.alert.#",
+        flatmap: { "send-stdout": {} },
+      },
+      notify: {
+        after: ["alerts"],
+        flatmap: { "send-stdout": {} },
+      },
+    },
+  });
+  // Act
+  const report = analyzePipeline(template);
+  // Assert
+  expect(report.errors).toEqual([
+    "step 'notify' is unreachable: no events can reach it",
+  ]);
+  expect(report.warnings).toContain(
+    "step 'alerts' has a pattern that doesn't match any of the events " +
+      "that can reach it ('sensor.reading.tagged')"
+  );
+});
+
 test("@standalone Stopping a pipeline drains the events", async () => {
   // Arrange
   const rawTemplate = {
@@ -150,3 +428,222 @@ test("@standalone Stopping a pipeline drains the events", async () => {
     ).join("\n") + "\n"
   );
 });
+
+test("@standalone A shutdown signal drains the accepted events", async () => {
+  // Arrange
+  const rawTemplate = {
+    name: "Test",
+    input: { generator: { seconds: 0.1 } },
+    steps: {
+      a: {
+        window: { events: 999, seconds: 999 },
+        flatmap: { "send-stdout": { "jq-expr": "{count: length}" } },
+      },
+    },
+  };
+  // Act
+  const template = makePipelineTemplate(rawTemplate);
+  const [drained] = await Promise.all([
+    stopOnSignals(await runPipeline(template), 5),
+    resolveAfter(1000).then(() => process.emit("SIGTERM")),
+  ]);
+  // Assert
+  // The only window is flushed when the pipeline stops, with every
+  // event generated in about 1 second.
+  expect(drained).toBe(true);
+  const output = JSON.parse(stdoutMock.current?.read());
+  expect(output.count).toBeGreaterThanOrEqual(9);
+  expect(output.count).toBeLessThanOrEqual(11);
+});
+
+test("@standalone A shutdown signal gives up draining after the timeout", async () => {
+  // Arrange
+  const stop = jest.fn();
+  const neverEnding = new Promise<void>(() => undefined);
+  // Act
+  const [drained] = await Promise.all([
+    stopOnSignals([neverEnding, stop], 0.1),
+    resolveAfter(10).then(() => process.emit("SIGINT")),
+  ]);
+  // Assert
+  expect(drained).toBe(false);
+  expect(stop).toHaveBeenCalledTimes(1);
+});
+
+test("@standalone A reload signal reloads the pipeline with the loaded template", async () => {
+  // Arrange
+  const reload = jest.fn(() => Promise.resolve());
+  const template = makePipelineTemplate({
+    name: "Test",
+    input: { generator: "lorem.ipsum" },
+  });
+  const load = jest
+    .fn()
+    .mockImplementationOnce(() => {
+      throw new Error("invalid pipeline");
+    })
+    .mockImplementationOnce(() => template);
+  const unsubscribe = reloadOnSignals(
+    [new Promise<void>(() => undefined), jest.fn(), reload],
+    load
+  );
+  // Act
+  process.emit("SIGHUP");
+  await resolveAfter(10);
+  process.emit("SIGHUP");
+  await resolveAfter(10);
+  unsubscribe();
+  process.emit("SIGHUP");
+  await resolveAfter(10);
+  // Assert
+  // The first configuration couldn't be loaded, so only the second
+  // one was applied.
+  expect(load).toHaveBeenCalledTimes(2);
+  expect(reload).toHaveBeenCalledTimes(1);
+  expect(reload).toHaveBeenCalledWith(template);
+});
+
+/**
+ * Make the steps of a pipeline that writes the given word to stdout
+ * for each event.
+ */
+const makeWordSteps = (word: string) => ({
+  a: { flatmap: { "send-stdout": { "jq-expr": `"${word}"` } } },
+});
+
+test("@standalone A reload that can't start the new input keeps the previous pipeline", async () => {
+  // Arrange
+  registerInput("unstartable", {
+    optionsSchema: { type: "object" },
+    validate: () => {
+      // Nothing needs to be validated.
+    },
+    make: () => {
+      throw new Error("can't start");
+    },
+  });
+  const template = makePipelineTemplate({
+    name: "Test",
+    input: { generator: { seconds: 0.1 } },
+    steps: makeWordSteps("previous"),
+  });
+  const unstartable = makePipelineTemplate({
+    name: "Test",
+    input: { unstartable: {} },
+    steps: makeWordSteps("next"),
+  });
+  const [promise, stopper, reload] = await runPipeline(template);
+  // Act
+  await expect(reload(unstartable)).rejects.toThrow("can't start");
+  stdoutMock.current?.read();
+  await resolveAfter(500);
+  const output: string = stdoutMock.current?.read() ?? "";
+  stopper();
+  await promise;
+  // Assert
+  // The generator kept running after the failed reload, through the
+  // previous steps.
+  const lines = output.split("\n").filter((line) => line.length > 0);
+  expect(lines.length).toBeGreaterThan(0);
+  expect(lines.every((line) => line === '"previous"')).toBe(true);
+});
+
+test("@standalone A reload that can't start the new steps restores the previous input", async () => {
+  // Arrange
+  registerStepFunction("unbuildable", {
+    optionsSchema: { type: "null" },
+    validate: () => {
+      // Nothing needs to be validated.
+    },
+    make: async () => {
+      throw new Error("can't build");
+    },
+  });
+  const template = makePipelineTemplate({
+    name: "Test",
+    input: { generator: { seconds: 0.1 } },
+    steps: makeWordSteps("previous"),
+  });
+  const unbuildable = makePipelineTemplate({
+    name: "Test",
+    input: { generator: { seconds: 0.05 } },
+    steps: { b: { flatmap: { unbuildable: null } } },
+  });
+  const [promise, stopper, reload] = await runPipeline(template);
+  // Act
+  await expect(reload(unbuildable)).rejects.toThrow("can't build");
+  stdoutMock.current?.read();
+  await resolveAfter(500);
+  const output: string = stdoutMock.current?.read() ?? "";
+  stopper();
+  await promise;
+  // Assert
+  // The previous input was started again, at its own pace, and its
+  // events went through the previous steps.
+  const lines = output.split("\n").filter((line) => line.length > 0);
+  expect(lines.length).toBeGreaterThanOrEqual(3);
+  expect(lines.length).toBeLessThanOrEqual(7);
+  expect(lines.every((line) => line === '"previous"')).toBe(true);
+});
+
+test("@standalone Preflight checks report reachable and unreachable endpoints", async () => {
+  // Arrange
+  // The server asks for credentials, and doesn't support HEAD
+  // requests otherwise. Connections aren't kept alive, so that the
+  // server closes right away.
+  const server = createServer((req, res) => {
+    res.writeHead(req.headers.authorization === "Bearer ok" ? 405 : 401, {
+      Connection: "close",
+    });
+    res.end();
+  });
+  await new Promise<void>((resolve) => server.listen(0, "127.0.0.1", resolve));
+  const { port } = server.address() as AddressInfo;
+  const reachable = `http://127.0.0.1:${port}`;
+  const closed = createServer();
+  await new Promise<void>((resolve) => closed.listen(0, "127.0.0.1", resolve));
+  const { port: closedPort } = closed.address() as AddressInfo;
+  const unreachable = `http://127.0.0.1:${closedPort}`;
+  await new Promise((resolve) => closed.close(resolve));
+  registerStepFunction<{ hang: boolean }>("probed", {
+    optionsSchema: {
+      type: "object",
+      properties: { hang: { type: "boolean" } },
+      additionalProperties: false,
+      required: ["hang"],
+    },
+    validate: () => {
+      // Nothing needs to be validated.
+    },
+    probe: (options) =>
+      options.hang ? new Promise<void>(() => undefined) : null,
+    make: jest.fn(),
+  });
+  const template = makePipelineTemplate({
+    name: "Test",
+    input: {
+      poll: { target: reachable, headers: { Authorization: "Bearer ok" } },
+    },
+    steps: {
+      a: { flatmap: { "send-http": unreachable } },
+      b: { flatmap: { "send-http": reachable } },
+      c: { flatmap: { "send-stdout": {} } },
+      d: { flatmap: { probed: { hang: false } } },
+      e: { flatmap: { probed: { hang: true } } },
+    },
+  });
+  // Act
+  const results = await probePipeline(template, 0.5);
+  await new Promise((resolve) => server.close(resolve));
+  // Assert
+  expect(results.map(({ target, status }) => [target, status])).toEqual([
+    ["input poll", "ok"],
+    ["step a (send-http)", "failed"],
+    ["step b (send-http)", "failed"],
+    ["step d (probed)", "skipped"],
+    ["step e (probed)", "failed"],
+  ]);
+  expect(results[1].error).toContain("ECONNREFUSED");
+  expect(results[2].error).toContain("401");
+  expect(results[4].error).toContain("no answer after 0.5 seconds");
+});
@@ -1,5 +1,10 @@
 import { consume } from "./test-utils";
-import { AsyncQueue, flatMap, compose } from "../src/async-queue";
+import {
+  AsyncQueue,
+  flatMap,
+  compose,
+  isCongested,
+} from "../src/async-queue";
 
 test("@standalone Shifting from an empty queue blocks", async () => {
   // Arrange
@@ -145,3 +150,54 @@ test("@standalone Channels can be composed with the compose combinator", async (
   // Assert
   expect(firstSecondValues).toEqual([4, 0, 9, 1, 16, 4]);
 });
+
+test("@standalone A bounded queue with the drop-newest policy discards pushes once full", async () => {
+  // Arrange
+  const dropped: number[] = [];
+  const queue = new AsyncQueue<number>("test", {
+    size: 2,
+    policy: "drop-newest",
+    onDrop: (value) => dropped.push(value),
+  });
+  // Act
+  [1, 2, 3, 4].forEach((value) => queue.push(value));
+  queue.close();
+  const values = await consume(queue.iterator());
+  // Assert
+  expect(values).toEqual([1, 2]);
+  expect(dropped).toEqual([3, 4]);
+});
+
+test("@standalone A bounded queue with the drop-oldest policy discards the first values once full", async () => {
+  // Arrange
+  const dropped: number[] = [];
+  const queue = new AsyncQueue<number>("test", {
+    size: 2,
+    policy: "drop-oldest",
+    onDrop: (value) => dropped.push(value),
+  });
+  // Act
+  [1, 2, 3, 4].forEach((value) => queue.push(value));
+  queue.close();
+  const values = await consume(queue.iterator());
+  // Assert
+  expect(values).toEqual([3, 4]);
+  expect(dropped).toEqual([1, 2]);
+});
+
+test("@standalone A bounded queue with the block policy signals congestion once full", async () => {
+  // Arrange
+  const queue = new AsyncQueue<number>("test", { size: 2, policy: "block" });
+  // Act & assert
+  queue.push(1);
+  expect(isCongested()).toBe(false);
+  queue.push(2);
+  queue.push(3);
+  expect(queue.full).toBe(true);
+  expect(isCongested()).toBe(true);
+  await queue.shift();
+  await queue.shift();
+  expect(isCongested()).toBe(false);
+  queue.close();
+  expect(await consume(queue.iterator())).toEqual([3]);
+});
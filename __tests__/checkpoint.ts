@@ -0,0 +1,100 @@
+import fs from "fs";
+import path from "path";
+import Redis from "ioredis";
+import {
+  makeFileCheckpointer,
+  makeRedisCheckpointer,
+} from "../src/checkpoint";
+import { resolveAfter } from "../src/utils";
+
+const redisUrl = "redis://localhost:6379/0";
+
+let tmpDir = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  tmpDir = fs.mkdtempSync("/tmp/cdp-tests-");
+});
+
+afterEach(() => {
+  fs.rmSync(tmpDir, { recursive: true, force: true });
+});
+
+test("@standalone The file checkpointer loads nothing from a missing file", async () => {
+  // Arrange
+  const checkpointer = makeFileCheckpointer(path.join(tmpDir, "missing"));
+  // Act
+  const loaded = await checkpointer.load("foo");
+  await checkpointer.close();
+  // Assert
+  expect(loaded).toBeUndefined();
+});
+
+test("@standalone The file checkpointer persists positions across instances", async () => {
+  // Arrange
+  const file = path.join(tmpDir, "positions");
+  const first = makeFileCheckpointer(file);
+  // Act
+  await Promise.all([
+    first.save("foo", { pos: 1 }),
+    first.save("bar", { pos: 2 }),
+    first.save("foo", { pos: 3 }),
+  ]);
+  await first.close();
+  const second = makeFileCheckpointer(file);
+  const [foo, bar] = await Promise.all([
+    second.load("foo"),
+    second.load("bar"),
+  ]);
+  await second.close();
+  // Assert
+  expect(foo).toEqual({ pos: 3 });
+  expect(bar).toEqual({ pos: 2 });
+  expect(JSON.parse(fs.readFileSync(file, "utf8"))).toEqual({
+    foo: { pos: 3 },
+    bar: { pos: 2 },
+  });
+});
+
+test("@standalone The file checkpointer forgets positions after their TTL", async () => {
+  // Arrange
+  const file = path.join(tmpDir, "positions");
+  const first = makeFileCheckpointer(file);
+  // Act
+  await Promise.all([
+    first.save("foo", { pos: 1 }),
+    first.save("bar", { pos: 2 }, 0.05),
+  ]);
+  const beforeExpiry = await first.load("bar");
+  await resolveAfter(100);
+  const afterExpiry = await first.load("bar");
+  await first.save("baz", { pos: 3 });
+  await first.close();
+  // Assert
+  expect(beforeExpiry).toEqual({ pos: 2 });
+  expect(afterExpiry).toBeUndefined();
+  expect(JSON.parse(fs.readFileSync(file, "utf8"))).toEqual({
+    foo: { pos: 1 },
+    baz: { pos: 3 },
+  });
+});
+
+test("@redis The redis checkpointer persists positions across instances", async () => {
+  // Arrange
+  const client = new Redis(redisUrl);
+  await client.flushall();
+  const first = makeRedisCheckpointer({ instance: redisUrl }, "test:");
+  // Act
+  const missing = await first.load("foo");
+  await first.save("foo", { pos: 1 });
+  await first.save("foo", { pos: 3 });
+  await first.close();
+  const second = makeRedisCheckpointer({ instance: redisUrl }, "test:");
+  const foo = await second.load("foo");
+  await second.close();
+  const stored = await client.get("test:foo");
+  await client.quit();
+  // Assert
+  expect(missing).toBeUndefined();
+  expect(foo).toEqual({ pos: 3 });
+  expect(JSON.parse(stored as string)).toEqual({ pos: 3 });
+});
@@ -0,0 +1,119 @@
+import { makeCircuitBreaker, OpenCircuitError } from "../src/circuit-breaker";
+import { make as makeEvent, Event } from "../src/event";
+import { makeRetrier } from "../src/retry";
+import { resolveAfter } from "../src/utils";
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * A fake output that fails while it's down, counting the attempts
+ * that reach it.
+ */
+const makeOutput = () => {
+  const output = {
+    down: true,
+    reached: 0,
+    attempt: async () => {
+      output.reached++;
+      if (output.down) {
+        throw new Error("unavailable");
+      }
+    },
+  };
+  return output;
+};
+
+/**
+ * Make an attempt through a circuit breaker, returning how it ended.
+ */
+const settle = (promise: Promise<void>): Promise<string> =>
+  promise.then(
+    () => "ok",
+    (err) => (err instanceof OpenCircuitError ? "rejected" : "failed")
+  );
+
+test("@standalone A circuit breaker goes through its closed, open and half-open states", async () => {
+  // Arrange
+  const output = makeOutput();
+  const breaker = makeCircuitBreaker("irrelevant", {
+    failures: 3,
+    cooldown: 0.1,
+    probes: "2",
+  });
+  const states = [breaker.state()];
+  // Act
+  const whileClosed = [];
+  for (let i = 0; i < 3; i++) {
+    whileClosed.push(await settle(breaker.call(output.attempt)));
+  }
+  states.push(breaker.state());
+  const whileOpen = await settle(breaker.call(output.attempt));
+  await resolveAfter(150);
+  states.push(breaker.state());
+  output.down = false;
+  const whileHalfOpen = [];
+  for (let i = 0; i < 2; i++) {
+    whileHalfOpen.push(await settle(breaker.call(output.attempt)));
+  }
+  states.push(breaker.state());
+  // Assert
+  expect(whileClosed).toEqual(["failed", "failed", "failed"]);
+  expect(whileOpen).toEqual("rejected");
+  expect(whileHalfOpen).toEqual(["ok", "ok"]);
+  expect(states).toEqual(["closed", "open", "half-open", "closed"]);
+  expect(output.reached).toEqual(5);
+});
+
+test("@standalone A half-open circuit breaker limits its probes and reopens if they fail", async () => {
+  // Arrange
+  const output = makeOutput();
+  const breaker = makeCircuitBreaker("irrelevant", {
+    failures: 1,
+    cooldown: 0.1,
+  });
+  await settle(breaker.call(output.attempt));
+  await resolveAfter(150);
+  // Act
+  const probes = await Promise.all([
+    settle(breaker.call(output.attempt)),
+    settle(breaker.call(output.attempt)),
+  ]);
+  const reopened = breaker.state();
+  await resolveAfter(150);
+  output.down = false;
+  const recovered = await settle(breaker.call(output.attempt));
+  // Assert
+  expect(probes).toEqual(["failed", "rejected"]);
+  expect(reopened).toEqual("open");
+  expect(recovered).toEqual("ok");
+  expect(breaker.state()).toEqual("closed");
+  expect(output.reached).toEqual(3);
+});
+
+test("@standalone Retrier short-circuits deliveries to the dead-letter path while the circuit is open", async () => {
+  // Arrange
+  const output = makeOutput();
+  const failures: [Event[], unknown][] = [];
+  const retrier = makeRetrier(
+    "irrelevant",
+    { attempts: 3, delay: 0.01 },
+    async (events, reason) => {
+      failures.push([events, reason]);
+    },
+    "best-effort",
+    { failures: 2, cooldown: 10 }
+  );
+  const events = await Promise.all([1, 2].map((n) => makeEvent("a", n, trace)));
+  // Act
+  await retrier.run([events[0]], output.attempt);
+  await retrier.run([events[1]], output.attempt);
+  // Assert
+  expect(output.reached).toEqual(2);
+  expect(failures.map(([failed]) => failed.map((e) => e.data))).toEqual([
+    [1],
+    [2],
+  ]);
+  expect(
+    failures.every(([, reason]) => reason instanceof OpenCircuitError)
+  ).toBe(true);
+});
@@ -0,0 +1,83 @@
+// Emit warnings as JSON lines, to check the logs of step failures.
+jest.mock("../src/conf", () => ({
+  ...jest.requireActual("../src/conf"),
+  LOG_LEVEL: "warn",
+  LOG_FORMAT: "json",
+}));
+
+import { make as makeEvent, Event } from "../src/event";
+import { makeFailureRouting } from "../src/dead-letter";
+
+// Mock for console.error.
+let mockedConsoleError: jest.SpyInstance<void>;
+
+beforeEach(() => {
+  mockedConsoleError = jest.spyOn(console, "error").mockImplementation(() => {
+    // Prevent error messages during these tests.
+  });
+});
+
+afterEach(() => {
+  mockedConsoleError.mockRestore();
+});
+
+test("@standalone Failure routing wraps failed events in an envelope", async () => {
+  // Arrange
+  const routing = makeFailureRouting("step-a", "failed");
+  const forwarded: Event[] = [];
+  routing.connect((...events) => forwarded.push(...events));
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const event = await makeEvent("a", { id: 1 }, trace);
+  // Act
+  await routing.report([event], new Error("something broke"));
+  // Assert
+  expect(forwarded).toHaveLength(1);
+  expect(forwarded[0].name).toEqual("failed");
+  expect(forwarded[0].data).toEqual({
+    name: "a",
+    data: { id: 1 },
+    error: {
+      step: "step-a",
+      message: "something broke",
+      timestamp: expect.any(Number),
+    },
+  });
+  expect(forwarded[0].trace).toEqual(event.trace);
+});
+
+test("@standalone Failure routing drops events reported before connecting", async () => {
+  // Arrange
+  const routing = makeFailureRouting("step-a", "failed");
+  const forwarded: Event[] = [];
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const event = await makeEvent("a", { id: 1 }, trace);
+  // Act
+  await routing.report([event], "too early");
+  routing.connect((...events) => forwarded.push(...events));
+  // Assert
+  expect(forwarded).toEqual([]);
+});
+
+test("@standalone Failure routing logs failures as JSON lines", async () => {
+  // Arrange
+  const routing = makeFailureRouting("step-a", "failed");
+  routing.connect(() => undefined);
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const event = await makeEvent("a", { text: "x".repeat(1000) }, trace);
+  // Act
+  await routing.report([event], new Error("something broke"));
+  // Assert
+  expect(mockedConsoleError.mock.calls).toHaveLength(1);
+  const line = JSON.parse(mockedConsoleError.mock.calls[0][0]);
+  expect(line).toEqual({
+    time: expect.any(String),
+    level: "warn",
+    ns: "dead-letter",
+    msg: "Step failed to process an event",
+    step: "step-a",
+    event: "a",
+    reason: "something broke",
+    payload: expect.stringMatching(/^\{"text":"x+\.\.\.$/),
+  });
+  expect(line.payload.length).toBeLessThan(300);
+});
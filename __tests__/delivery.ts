@@ -0,0 +1,256 @@
+import { AsyncQueue, flatMap } from "../src/async-queue";
+import {
+  attachReceipt,
+  combineIn,
+  failDelivery,
+  hold,
+  holdIn,
+  release,
+  releaseIn,
+  requireAcknowledgements,
+  track,
+} from "../src/delivery";
+import {
+  Event,
+  make as makeEvent,
+  makeNewEventParser,
+  parseVector,
+} from "../src/event";
+import { run } from "../src/pipeline";
+import { makeRetrier } from "../src/retry";
+import { StepFactory, makeStreamlined } from "../src/step";
+import { resolveAfter } from "../src/utils";
+import { consume } from "./test-utils";
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * A fake message that records its acknowledgements.
+ */
+const makeMessage = () => {
+  const settled: string[] = [];
+  return {
+    settled,
+    ack: () => settled.push("ack"),
+    nack: () => settled.push("nack"),
+  };
+};
+
+/**
+ * Parse the values of a fake message like an input form would.
+ */
+const receive = async (
+  message: ReturnType<typeof makeMessage>,
+  things: unknown[]
+): Promise<Event[]> => {
+  const receipt = track(message.ack, message.nack);
+  things.forEach((thing) => attachReceipt(thing, receipt));
+  release(receipt);
+  return (
+    await Promise.all(
+      things.map((thing) =>
+        parseVector(
+          thing,
+          makeNewEventParser("irrelevant", "irrelevant"),
+          "irrelevant"
+        )
+      )
+    )
+  ).flat();
+};
+
+test("@standalone Messages are acknowledged immediately in best-effort mode", () => {
+  // Arrange
+  const message = makeMessage();
+  // Act
+  const receipt = track(message.ack, message.nack);
+  // Assert
+  expect(receipt).toBeUndefined();
+  expect(message.settled).toEqual(["ack"]);
+});
+
+test("@standalone Messages are acknowledged once the events derived from them are done", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  const message = makeMessage();
+  const empty = makeMessage();
+  // Act
+  const [first, second] = await receive(message, [
+    { n: "a", d: 1 },
+    [{ n: "a", d: 2 }, "not an event"],
+  ]);
+  await receive(empty, []);
+  holdIn("irrelevant", first);
+  release(first.receipt);
+  release(second.receipt);
+  const settledWhileHeld = message.settled.slice();
+  releaseIn("irrelevant");
+  withdraw();
+  // Assert
+  expect(settledWhileHeld).toEqual([]);
+  expect(message.settled).toEqual(["ack"]);
+  expect(empty.settled).toEqual(["ack"]);
+});
+
+test("@standalone Messages are acknowledged once the steps are done with their events", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  const slow = makeMessage();
+  const fast = makeMessage();
+  const factory: StepFactory = (send) =>
+    makeStreamlined(
+      {
+        name: "slow",
+        windowMaxSize: 1,
+        patternMode: "pass",
+        functionMode: "flatmap",
+      },
+      flatMap(async (event: Event) => {
+        await resolveAfter(event.name === "slow" ? 200 : 0);
+        return [event];
+      }, new AsyncQueue<Event>("step.slow.fn").asChannel())
+    )(send);
+  const pipeline = await run({
+    name: "irrelevant",
+    steps: [{ name: "slow", after: [], factory }],
+  });
+  // An unrelated queue that never empties doesn't hold back
+  // acknowledgements.
+  const unrelated = new AsyncQueue<number>("irrelevant");
+  unrelated.push(1);
+  const output = consume(pipeline.receive);
+  // Act
+  pipeline.send(...(await receive(slow, [{ n: "slow", d: null }])));
+  await resolveAfter(100);
+  const settledWhileProcessing = [...slow.settled, ...fast.settled];
+  await resolveAfter(200);
+  pipeline.send(...(await receive(fast, [{ n: "fast", d: null }])));
+  await resolveAfter(50);
+  const settledAfterProcessing = [...slow.settled, ...fast.settled];
+  await pipeline.close();
+  await output;
+  unrelated.close();
+  withdraw();
+  // Assert
+  expect(settledWhileProcessing).toEqual([]);
+  expect(settledAfterProcessing).toEqual(["ack", "ack"]);
+});
+
+test("@standalone Events rebuilt by a step reference every message the step is working on", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  const first = makeMessage();
+  const second = makeMessage();
+  const [firstEvent] = await receive(first, [{ n: "a", d: 1 }]);
+  const [secondEvent] = await receive(second, [{ n: "a", d: 2 }]);
+  holdIn("rebuild", firstEvent);
+  holdIn("rebuild", secondEvent);
+  release(firstEvent.receipt);
+  release(secondEvent.receipt);
+  // Act
+  const rebuilt = await makeEvent("b", 3, trace);
+  const combined = combineIn("rebuild");
+  rebuilt.receipt = combined;
+  hold(combined);
+  release(combined);
+  releaseIn("rebuild");
+  const settledWhileRebuilt = [...first.settled, ...second.settled];
+  failDelivery([rebuilt]);
+  release(rebuilt.receipt);
+  withdraw();
+  // Assert
+  expect(settledWhileRebuilt).toEqual([]);
+  expect(first.settled).toEqual(["nack"]);
+  expect(second.settled).toEqual(["nack"]);
+});
+
+test("@standalone Messages are acknowledged once the events rebuilt from them are done", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  const message = makeMessage();
+  const makeStep =
+    (name: string, fn: (event: Event) => Promise<Event[]>): StepFactory =>
+    (send) =>
+      makeStreamlined(
+        {
+          name,
+          windowMaxSize: 1,
+          patternMode: "pass",
+          functionMode: "flatmap",
+        },
+        flatMap(fn, new AsyncQueue<Event>(`step.${name}.fn`).asChannel())
+      )(send);
+  const pipeline = await run({
+    name: "irrelevant",
+    steps: [
+      {
+        name: "rebuild",
+        after: [],
+        // The emitted events don't come from the received ones.
+        factory: makeStep("rebuild", async (event) => [
+          await makeEvent(event.name, event.data, event.trace),
+        ]),
+      },
+      {
+        name: "slow",
+        after: ["rebuild"],
+        factory: makeStep("slow", async (event) => {
+          await resolveAfter(200);
+          return [event];
+        }),
+      },
+    ],
+  });
+  const output = consume(pipeline.receive);
+  // Act
+  pipeline.send(...(await receive(message, [{ n: "a", d: null }])));
+  await resolveAfter(100);
+  const settledWhileProcessing = message.settled.slice();
+  await resolveAfter(200);
+  const settledAfterProcessing = message.settled.slice();
+  await pipeline.close();
+  await output;
+  withdraw();
+  // Assert
+  expect(settledWhileProcessing).toEqual([]);
+  expect(settledAfterProcessing).toEqual(["ack"]);
+});
+
+test("@standalone Messages of failed deliveries are negatively acknowledged", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  const delivered = makeMessage();
+  const undelivered = makeMessage();
+  const [deliveredEvent] = await receive(delivered, [{ n: "a", d: 1 }]);
+  const [undeliveredEvent] = await receive(undelivered, [{ n: "a", d: 2 }]);
+  const untracedEvent = await makeEvent("a", 3, trace);
+  // Act
+  failDelivery([undeliveredEvent, untracedEvent]);
+  release(deliveredEvent.receipt);
+  release(undeliveredEvent.receipt);
+  withdraw();
+  // Assert
+  expect(delivered.settled).toEqual(["ack"]);
+  expect(undelivered.settled).toEqual(["nack"]);
+});
+
+test("@standalone Deliveries given up in at-least-once mode fail their messages", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  const message = makeMessage();
+  const [event] = await receive(message, [{ n: "a", d: 1 }]);
+  const retrier = makeRetrier(
+    "irrelevant",
+    { attempts: 2, delay: 0.01 },
+    undefined,
+    "at-least-once"
+  );
+  // Act
+  await retrier.run([event], async () => {
+    throw new Error("unavailable");
+  });
+  release(event.receipt);
+  withdraw();
+  // Assert
+  expect(message.settled).toEqual(["nack"]);
+});
@@ -0,0 +1,131 @@
+"""Write geoip.mmdb, a tiny MaxMind DB database used by the tests.
+
+It maps 81.2.69.0/24 and 2a02:ff00::/32 to made-up geo records.
+Run it with `python3 geoip.py` from this directory.
+"""
+
+import ipaddress
+import struct
+
+
+def control(type_, size):
+    head = bytes([type_ << 5]) if type_ <= 7 else bytes([0, type_ - 7])
+    if size < 29:
+        extra = b""
+    elif size < 285:
+        size, extra = 29, bytes([size - 29])
+    elif size < 65821:
+        size, extra = 30, (size - 285).to_bytes(2, "big")
+    else:
+        size, extra = 31, (size - 65821).to_bytes(3, "big")
+    return bytes([head[0] | size]) + head[1:] + extra
+
+
+def uint(type_, value):
+    raw = value.to_bytes((value.bit_length() + 7) // 8, "big")
+    return control(type_, len(raw)) + raw
+
+
+def encode(value):
+    if isinstance(value, Pointer):
+        return bytes([0x20 | (value.offset >> 8), value.offset & 0xFF])
+    if isinstance(value, bool):
+        return control(14, int(value))
+    if isinstance(value, str):
+        raw = value.encode("utf-8")
+        return control(2, len(raw)) + raw
+    if isinstance(value, float):
+        return control(3, 8) + struct.pack(">d", value)
+    if isinstance(value, int):
+        return uint(6, value)
+    if isinstance(value, dict):
+        return control(7, len(value)) + b"".join(
+            encode(k) + encode(v) for k, v in value.items()
+        )
+    if isinstance(value, list):
+        return control(11, len(value)) + b"".join(map(encode, value))
+    raise TypeError(value)
+
+
+class Pointer:
+    def __init__(self, offset):
+        self.offset = offset
+
+
+data = bytearray()
+
+
+def store(value):
+    offset = len(data)
+    data.extend(encode(value))
+    return offset
+
+
+europe = store({"code": "EU", "names": {"en": "Europe"}})
+networks = {
+    ipaddress.ip_network("::5102:4500/120"): store(
+        {
+            "city": {"names": {"en": "London"}},
+            "continent": Pointer(europe),
+            "country": {"iso_code": "GB", "names": {"en": "United Kingdom"}},
+            "location": {"latitude": 51.5142, "longitude": -0.0931},
+            "autonomous_system_number": 20712,
+            "autonomous_system_organization": "Andrews & Arnold Ltd",
+        }
+    ),
+    ipaddress.ip_network("2a02:ff00::/32"): store(
+        {
+            "continent": Pointer(europe),
+            "country": {"iso_code": "IT", "names": {"en": "Italy"}},
+            "location": {"latitude": 42.8333, "longitude": 12.8333},
+        }
+    ),
+}
+
+# Build the search tree, with nodes numbered in breadth-first order.
+root = [None, None]
+for network, offset in networks.items():
+    node = root
+    bits = format(int(network.network_address), "0128b")[: network.prefixlen]
+    for position, bit in enumerate(bits):
+        branch = int(bit)
+        if position == len(bits) - 1:
+            node[branch] = ("data", offset)
+        else:
+            if node[branch] is None:
+                node[branch] = [None, None]
+            node = node[branch]
+nodes, queue = [], [root]
+while queue:
+    node = queue.pop(0)
+    nodes.append(node)
+    queue.extend(child for child in node if isinstance(child, list))
+index = {id(node): number for number, node in enumerate(nodes)}
+
+
+def record(child):
+    if child is None:
+        return len(nodes)
+    if isinstance(child, tuple):
+        return len(nodes) + 16 + child[1]
+    return index[id(child)]
+
+
+tree = b"".join(
+    record(left).to_bytes(3, "big") + record(right).to_bytes(3, "big")
+    for left, right in nodes
+)
+metadata = {
+    "binary_format_major_version": 2,
+    "binary_format_minor_version": 0,
+    "build_epoch": 1700000000,
+    "database_type": "CDP-Test-GeoIP",
+    "description": {"en": "A tiny database for the tests"},
+    "ip_version": 6,
+    "languages": ["en"],
+    "node_count": len(nodes),
+    "record_size": 24,
+}
+with open("geoip.mmdb", "wb") as f:
+    f.write(tree + bytes(16) + bytes(data))
+    f.write(bytes.fromhex("abcdef4d61784d696e642e636f6d") + encode(metadata))
@@ -0,0 +1,101 @@
+import fs from "fs";
+import path from "path";
+import { make as makeEvent } from "../src/event";
+import { makeIdempotencyGuard } from "../src/idempotency";
+import { resolveAfter } from "../src/utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+let tmpDir = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  tmpDir = fs.mkdtempSync("/tmp/cdp-tests-");
+});
+
+afterEach(() => {
+  fs.rmSync(tmpDir, { recursive: true, force: true });
+});
+
+test("@standalone The idempotency guard skips events delivered before", async () => {
+  // Arrange
+  const store = { file: path.join(tmpDir, "delivered") };
+  const first = await makeIdempotencyGuard(testParams, { store });
+  const delivered = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+  ];
+  await first.settle(await first.pending(delivered), true);
+  await first.close();
+  const second = await makeIdempotencyGuard(testParams, { store });
+  // Act
+  const pending = await second.pending([
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+    await makeEvent("a", 3, trace),
+    await makeEvent("a", 3, trace),
+  ]);
+  await second.close();
+  // Assert
+  expect(pending.map((event) => event.data)).toEqual([3]);
+});
+
+test("@standalone The idempotency guard doesn't record failed deliveries", async () => {
+  // Arrange
+  const store = { file: path.join(tmpDir, "delivered") };
+  const guard = await makeIdempotencyGuard(testParams, { store });
+  const events = [await makeEvent("a", 1, trace)];
+  // Act
+  const attempted = await guard.pending(events);
+  const whileAttempted = await guard.pending(events);
+  await guard.settle(attempted, false);
+  const retried = await guard.pending(events);
+  await guard.close();
+  // Assert
+  expect(attempted).toEqual(events);
+  expect(whileAttempted).toEqual([]);
+  expect(retried).toEqual(events);
+});
+
+test("@standalone The idempotency guard uses keys extracted with jq", async () => {
+  // Arrange
+  const guard = await makeIdempotencyGuard(testParams, {
+    store: { file: path.join(tmpDir, "delivered") },
+    "key-jq-expr": ".data.id",
+  });
+  await guard.settle(
+    await guard.pending([await makeEvent("a", { id: 1, v: "old" }, trace)]),
+    true
+  );
+  // Act
+  const pending = await guard.pending([
+    await makeEvent("b", { id: 1, v: "new" }, trace),
+    await makeEvent("a", { id: 2, v: "old" }, trace),
+  ]);
+  await guard.close();
+  // Assert
+  expect(pending.map((event) => event.data)).toEqual([{ id: 2, v: "old" }]);
+});
+
+test("@standalone The idempotency guard forgets keys after their TTL", async () => {
+  // Arrange
+  const guard = await makeIdempotencyGuard(testParams, {
+    store: { file: path.join(tmpDir, "delivered") },
+    ttl: 0.05,
+  });
+  const events = [await makeEvent("a", 1, trace)];
+  await guard.settle(await guard.pending(events), true);
+  // Act
+  const early = await guard.pending(events);
+  await resolveAfter(100);
+  const late = await guard.pending(events);
+  await guard.close();
+  // Assert
+  expect(early).toEqual([]);
+  expect(late).toEqual(events);
+});
@@ -1,8 +1,92 @@
+import { EventEmitter } from "events";
+// Mock the broker connection, when a fake one is given.
+const mockBroker = {
+  connection: null,
+} as {
+  connection: FakeConnection | null;
+};
+jest.mock("amqplib", () => {
+  const originalModule = jest.requireActual("amqplib");
+  return {
+    ...originalModule,
+    connect: (url: string) =>
+      mockBroker.connection === null
+        ? originalModule.connect(url)
+        : Promise.resolve(mockBroker.connection),
+  };
+});
+afterEach(() => {
+  mockBroker.connection = null;
+});
+
 import { connect } from "amqplib";
+import { release, requireAcknowledgements } from "../../src/delivery";
+import { Event } from "../../src/event";
 import { make } from "../../src/input/amqp";
+import {
+  amqpConnectionLosses,
+  amqpPrefetchUtilization,
+  amqpUnackedMessages,
+} from "../../src/metrics";
 import { resolveAfter } from "../../src/utils";
 import { consume } from "../test-utils";
 
+/**
+ * An in-memory channel with a single consumer, which counts the
+ * messages it's told to settle.
+ */
+class FakeChannel extends EventEmitter {
+  consumer: ((message: unknown) => void) | null = null;
+  acked = 0;
+  nacked = 0;
+  assertExchange = async (exchange: string) => ({ exchange });
+  assertQueue = async (queue: string) => ({ queue });
+  bindQueue = async () => ({});
+  prefetch = async () => ({});
+  consume = async (queue: string, consumer: (message: unknown) => void) => {
+    this.consumer = consumer;
+    return { consumerTag: "fake" };
+  };
+  ack = () => {
+    this.acked++;
+  };
+  nack = () => {
+    this.nacked++;
+  };
+  recover = async () => ({});
+  cancel = async () => ({});
+  close = async () => {
+    // Nothing to release.
+  };
+  deliver(content: unknown) {
+    this.consumer?.({
+      content: Buffer.from(JSON.stringify(content)),
+      properties: { headers: {} },
+    });
+  }
+}
+
+/**
+ * An in-memory connection to a fake broker.
+ */
+class FakeConnection extends EventEmitter {
+  channel = new FakeChannel();
+  createChannel = async () => this.channel;
+  close = async () => {
+    // Nothing to release.
+  };
+}
+
+/**
+ * Get the value of an amqp gauge for a queue.
+ */
+const gaugeValue = async (
+  gauge: typeof amqpUnackedMessages,
+  queue: string
+): Promise<number | undefined> =>
+  (await gauge.get()).values.find((value) => value.labels.queue === queue)
+    ?.value;
+
 const brokerUrl = "amqp://localhost:5672";
 
 const testEvents = [
@@ -144,3 +228,62 @@ test("@amqp The amqp input works as expected on topic exchanges", async () => {
     testEvents.concat(testEvents) // two successful publishes (out of three)
   );
 });
+
+test("@standalone The amqp input tracks its unacknowledged messages", async () => {
+  // Arrange
+  const connection = new FakeConnection();
+  mockBroker.connection = connection;
+  const withdraw = requireAcknowledgements();
+  const [channel] = make(testParams, {
+    url: "amqp://fake",
+    queue: { name: "test-unacked.input" },
+    prefetch: 4,
+  });
+  await resolveAfter(10); // Give time for the consumer to start
+  // Act
+  testEvents.forEach((event) => connection.channel.deliver(event));
+  const delivered = [
+    await gaugeValue(amqpUnackedMessages, "test-unacked.input"),
+    await gaugeValue(amqpPrefetchUtilization, "test-unacked.input"),
+  ];
+  const output: Event[] = [];
+  for (let i = 0; i < testEvents.length; i++) {
+    const result = await channel.receive.next();
+    if (!result.done) {
+      output.push(result.value);
+    }
+  }
+  const referenced = connection.channel.acked;
+  // Acknowledgements are given once the events are done with.
+  output.forEach((event) => release(event.receipt));
+  const settled = [
+    await gaugeValue(amqpUnackedMessages, "test-unacked.input"),
+    await gaugeValue(amqpPrefetchUtilization, "test-unacked.input"),
+  ];
+  await Promise.all([consume(channel.receive), channel.close()]);
+  withdraw();
+  // Assert
+  expect(output).toHaveLength(testEvents.length);
+  expect(delivered).toEqual([3, 0.75]);
+  expect(referenced).toEqual(0);
+  expect(settled).toEqual([0, 0]);
+  expect(connection.channel.acked).toEqual(3);
+  expect(connection.channel.nacked).toEqual(0);
+});
+
+test("@standalone The amqp input counts lost connections", async () => {
+  // Arrange
+  const connection = new FakeConnection();
+  mockBroker.connection = connection;
+  const before = (await amqpConnectionLosses.get()).values[0]?.value ?? 0;
+  const [channel, stopped] = make(testParams, "amqp://fake");
+  await resolveAfter(10); // Give time for the consumer to start
+  // Act
+  connection.emit("close", new Error("connection lost"));
+  await stopped;
+  await channel.close();
+  // Assert
+  expect((await amqpConnectionLosses.get()).values[0]?.value).toEqual(
+    before + 1
+  );
+});
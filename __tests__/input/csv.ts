@@ -0,0 +1,67 @@
+import fs from "fs";
+import path from "path";
+import { make } from "../../src/input/csv";
+import { consume } from "../test-utils";
+
+let tmpFilePath = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  const base = fs.mkdtempSync("/tmp/cdp-tests-");
+  tmpFilePath = path.join(base, "input.csv");
+});
+
+afterEach(() => {
+  fs.rmSync(path.dirname(tmpFilePath), { recursive: true, force: true });
+});
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+test("@standalone The csv input form maps columns after the header row", async () => {
+  // Arrange
+  fs.writeFileSync(
+    tmpFilePath,
+    "id,name,active,notes\r\n" +
+      '1,"Doe, Jane",true,"said ""hi""\r\nand left"\r\n' +
+      "2,John,false,\r\n" +
+      "3,too,many,fields,here\r\n" +
+      "x,Nobody,true,not a number\r\n" +
+      "\r\n" +
+      "4,Last,,no line break"
+  );
+  const [channel] = make(testParams, {
+    path: tmpFilePath,
+    name: "people",
+    types: { id: "number", active: "boolean" },
+  });
+  // Act
+  const output = await consume(channel.receive);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual(["people", "people", "people"]);
+  expect(output.map((e) => e.data)).toEqual([
+    { id: 1, name: "Doe, Jane", active: true, notes: 'said "hi"\r\nand left' },
+    { id: 2, name: "John", active: false, notes: "" },
+    { id: 4, name: "Last", active: null, notes: "no line break" },
+  ]);
+});
+
+test("@standalone The csv input form names columns by position without a header", async () => {
+  // Arrange
+  fs.writeFileSync(tmpFilePath, 'a;"b;c";{"n":1}\nd;e\n');
+  const [channel] = make(testParams, {
+    path: tmpFilePath,
+    name: "rows",
+    header: "false",
+    delimiter: ";",
+    types: { col2: "json" },
+  });
+  // Act
+  const output = await consume(channel.receive);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { col0: "a", col1: "b;c", col2: { n: 1 } },
+    { col0: "d", col1: "e" },
+  ]);
+});
@@ -45,3 +45,130 @@ test("@standalone The http input form works as expected", async () => {
     events
   );
 });
+
+test("@standalone The http input form can name events after request paths", async () => {
+  // Arrange
+  const [channel] = make(
+    {
+      pipelineName: "irrelevant",
+      pipelineSignature: "irrelevant",
+    },
+    {
+      endpoint: "/",
+      port: 30002,
+      "path-names": true,
+    }
+  );
+  // Act
+  const createdResponse = await axios.post(
+    "http://127.0.0.1:30002/orders/created",
+    [{ id: 1 }, { id: 2 }]
+  );
+  const cancelledResponse = await axios.post(
+    "http://127.0.0.1:30002/orders/cancelled",
+    JSON.stringify({ id: 3 }, null, 2),
+    { headers: { "Content-Type": "application/json" } }
+  );
+  const malformedResponse = await axios.post(
+    "http://127.0.0.1:30002/orders/created",
+    '{"id": 4}\n{"id":',
+    { headers: { "Content-Type": "application/json" }, validateStatus: null }
+  );
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close().then(() => resolveAfter(700)),
+  ]);
+  // Assert
+  expect(createdResponse.status).toEqual(204);
+  expect(cancelledResponse.status).toEqual(204);
+  expect(malformedResponse.status).toEqual(400);
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "orders.created", d: { id: 1 } },
+    { n: "orders.created", d: { id: 2 } },
+    { n: "orders.cancelled", d: { id: 3 } },
+  ]);
+});
+
+test("@standalone The http input form checks the shared secret", async () => {
+  // Arrange
+  const [channel] = make(
+    {
+      pipelineName: "irrelevant",
+      pipelineSignature: "irrelevant",
+    },
+    {
+      endpoint: "/events",
+      port: 30003,
+      secret: "lorem-ipsum",
+    }
+  );
+  const event = { n: "foo", d: "fooo" };
+  // Act
+  const missingResponse = await axios.post(
+    "http://127.0.0.1:30003/events",
+    event,
+    { validateStatus: null }
+  );
+  const invalidResponse = await axios.post(
+    "http://127.0.0.1:30003/events",
+    event,
+    { headers: { "X-CDP-Secret": "dolor-sit" }, validateStatus: null }
+  );
+  const validResponse = await axios.post(
+    "http://127.0.0.1:30003/events",
+    event,
+    { headers: { "X-CDP-Secret": "lorem-ipsum" } }
+  );
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close().then(() => resolveAfter(700)),
+  ]);
+  // Assert
+  expect(missingResponse.status).toEqual(401);
+  expect(invalidResponse.status).toEqual(401);
+  expect(validResponse.status).toEqual(204);
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    event,
+  ]);
+});
+
+test("@standalone The http input form rejects bodies exceeding the input limits", async () => {
+  // Arrange
+  const [channel] = make(
+    {
+      pipelineName: "irrelevant",
+      pipelineSignature: "irrelevant",
+    },
+    {
+      endpoint: "/events",
+      port: 30004,
+    }
+  );
+  const event = { n: "foo", d: "fooo" };
+  // Act
+  const oversizedResponse = await axios.post(
+    "http://127.0.0.1:30004/events",
+    { n: "foo", d: "x".repeat(5000) },
+    { validateStatus: null }
+  );
+  const nestedResponse = await axios.post(
+    "http://127.0.0.1:30004/events",
+    `{"n": "foo", "d": ${"[".repeat(600)}${"]".repeat(600)}}`,
+    { headers: { "Content-Type": "application/json" }, validateStatus: null }
+  );
+  const validResponse = await axios.post(
+    "http://127.0.0.1:30004/events",
+    event
+  );
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close().then(() => resolveAfter(700)),
+  ]);
+  // Assert
+  expect(oversizedResponse.status).toEqual(413);
+  expect(nestedResponse.status).toEqual(413);
+  expect(validResponse.status).toEqual(204);
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    event,
+  ]);
+});
@@ -0,0 +1,209 @@
+import { Kafka, logLevel } from "kafkajs";
+import {
+  failDelivery,
+  release,
+  requireAcknowledgements,
+} from "../../src/delivery";
+import { Event } from "../../src/event";
+import { make } from "../../src/input/kafka";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const brokers = ["localhost:9092"];
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+// Publish the given messages to a kafka topic.
+const publish = async (topic: string, messages: string[]) => {
+  const producer = new Kafka({
+    brokers,
+    logLevel: logLevel.NOTHING,
+  }).producer();
+  await producer.connect();
+  await producer.send({
+    topic,
+    messages: messages.map((value) => ({ value })),
+  });
+  await producer.disconnect();
+};
+
+test("@kafka The kafka input form builds a one-way channel", async () => {
+  // Arrange
+  const [channel, stopped] = make(testParams, {
+    brokers,
+    topics: "test1.input",
+  });
+  // Act
+  const sent = channel.send();
+  await Promise.race([channel.close(), stopped]);
+  // Assert
+  expect(sent).toEqual(false);
+});
+
+test("@kafka The kafka input names events after their topic", async () => {
+  // Arrange
+  await publish("test2.input", ['{"hello": "world"}', "[1, 2]"]);
+  const [channel, stopped] = make(testParams, {
+    brokers,
+    topics: "test2.input",
+    group: "test2",
+    "from-beginning": true,
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(5000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [
+      { n: "test2.input", d: { hello: "world" } },
+      { n: "test2.input", d: [1, 2] },
+    ]
+  );
+});
+
+test("@kafka The kafka input can wrap raw messages", async () => {
+  // Arrange
+  await publish("test3.input", ["not json"]);
+  const [channel, stopped] = make(testParams, {
+    brokers,
+    topics: ["test3.input"],
+    group: "test3",
+    "from-beginning": true,
+    raw: true,
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(5000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [{ n: "test3.input", d: "not json" }]
+  );
+});
+
+test("@kafka The kafka input commits offsets of consumed messages", async () => {
+  // Arrange
+  await publish("test4.input", ["1"]);
+  const [firstChannel, firstStopped] = make(testParams, {
+    brokers,
+    topics: "test4.input",
+    group: "test4",
+    "from-beginning": true,
+    wrap: "a",
+  });
+  await Promise.all([
+    consume(firstChannel.receive),
+    Promise.race([
+      resolveAfter(5000).then(() => firstChannel.close()),
+      firstStopped,
+    ]),
+  ]);
+  await publish("test4.input", ["2"]);
+  // Act
+  const [secondChannel, secondStopped] = make(testParams, {
+    brokers,
+    topics: "test4.input",
+    group: "test4",
+    "from-beginning": true,
+    wrap: "a",
+  });
+  const [output] = await Promise.all([
+    consume(secondChannel.receive),
+    Promise.race([
+      resolveAfter(5000).then(() => secondChannel.close()),
+      secondStopped,
+    ]),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [{ n: "a", d: 2 }]
+  );
+});
+
+test("@kafka The kafka input commits offsets only up to unacknowledged messages", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  await publish("test5.input", ["1", "2"]);
+  const [firstChannel, firstStopped] = make(testParams, {
+    brokers,
+    topics: "test5.input",
+    group: "test5",
+    "from-beginning": true,
+    wrap: "a",
+  });
+  const first: Event[] = [];
+  for (let i = 0; i < 2; i++) {
+    const result = await firstChannel.receive.next();
+    if (!result.done) {
+      first.push(result.value);
+    }
+  }
+  // Only the first message's event is done with.
+  release(first[0].receipt);
+  await Promise.race([
+    Promise.all([consume(firstChannel.receive), firstChannel.close()]),
+    firstStopped,
+  ]);
+  withdraw();
+  // Act
+  const [secondChannel, secondStopped] = make(testParams, {
+    brokers,
+    topics: "test5.input",
+    group: "test5",
+    "from-beginning": true,
+    wrap: "a",
+  });
+  const [output] = await Promise.all([
+    consume(secondChannel.receive),
+    Promise.race([
+      resolveAfter(5000).then(() => secondChannel.close()),
+      secondStopped,
+    ]),
+  ]);
+  // Assert
+  expect(first.map((e) => e.data)).toEqual([1, 2]);
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [{ n: "a", d: 2 }]
+  );
+});
+
+test("@kafka The kafka input consumes failed messages again", async () => {
+  // Arrange
+  const withdraw = requireAcknowledgements();
+  await publish("test6.input", ["1", "2"]);
+  const [channel, stopped] = make(testParams, {
+    brokers,
+    topics: "test6.input",
+    group: "test6",
+    "from-beginning": true,
+    wrap: "a",
+  });
+  const received: unknown[] = [];
+  // Act
+  while (received.filter((d) => d === 1).length < 2) {
+    const result = await channel.receive.next();
+    if (result.done) {
+      break;
+    }
+    // The first delivery of the first message fails.
+    if (received.length === 0) {
+      failDelivery([result.value]);
+    }
+    received.push(result.value.data);
+    release(result.value.receipt);
+  }
+  await Promise.race([
+    Promise.all([consume(channel.receive), channel.close()]),
+    stopped,
+  ]);
+  withdraw();
+  // Assert
+  expect(received[0]).toEqual(1);
+  expect(received.filter((d) => d === 1)).toEqual([1, 1]);
+});
@@ -49,3 +49,28 @@ test("@mqtt The mqtt input works as expected", async () => {
     testEvents
   );
 });
+
+test("@mqtt The mqtt input can name events after their topics", async () => {
+  // Arrange
+  const client = connect(brokerUrl, {});
+  const [channel, stopped] = make(testParams, {
+    url: brokerUrl,
+    topic: "test-input/3/#",
+    "topic-names": true,
+    raw: true,
+  });
+  // Act
+  await resolveAfter(1000); // Give time for the subscription to be established
+  client.publish("test-input/3/room1/temp", "21.5");
+  client.publish("test-input/3/room2/temp", "19.0");
+  client.end();
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(1000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "test-input.3.room1.temp", d: "21.5" },
+    { n: "test-input.3.room2.temp", d: "19.0" },
+  ]);
+});
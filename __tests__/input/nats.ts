@@ -0,0 +1,84 @@
+import { connect, StringCodec } from "nats";
+import { make } from "../../src/input/nats";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const natsUrl = "nats://localhost:4222";
+
+const codec = StringCodec();
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+test("@nats The nats input form builds a one-way channel", async () => {
+  // Arrange
+  const [channel, stopped] = make(testParams, {
+    url: natsUrl,
+    subject: "test1.input",
+  });
+  // Act
+  const sent = channel.send();
+  await Promise.race([channel.close(), stopped]);
+  // Assert
+  expect(sent).toEqual(false);
+});
+
+test("@nats The nats input names events after their subject", async () => {
+  // Arrange
+  const nc = await connect({ servers: natsUrl });
+  const [channel, stopped] = make(testParams, {
+    url: natsUrl,
+    subject: "test2.*.input",
+  });
+  // Act
+  await resolveAfter(1000); // Give time for the subscription to establish
+  nc.publish("test2.a.input", codec.encode('{"hello": "world"}'));
+  nc.publish("test2.b.input", codec.encode("[1, 2]"));
+  nc.publish("test2.ignored", codec.encode("3"));
+  await nc.drain();
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(1000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [
+      { n: "test2.a.input", d: { hello: "world" } },
+      { n: "test2.b.input", d: [1, 2] },
+    ]
+  );
+});
+
+test("@nats The nats input consumes from jetstream", async () => {
+  // Arrange
+  const nc = await connect({ servers: natsUrl });
+  const jsm = await nc.jetstreamManager();
+  await jsm.streams.add({ name: "test3", subjects: ["test3.>"] });
+  const js = nc.jetstream();
+  await js.publish("test3.first", codec.encode("first"));
+  await js.publish("test3.second", codec.encode("second"));
+  const [channel, stopped] = make(testParams, {
+    url: natsUrl,
+    subject: "test3.>",
+    jetstream: { durable: "test3-consumer" },
+    raw: true,
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(2000).then(() => channel.close()), stopped]),
+  ]);
+  const consumer = await jsm.consumers.info("test3", "test3-consumer");
+  await jsm.streams.delete("test3");
+  await nc.drain();
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [
+      { n: "test3.first", d: "first" },
+      { n: "test3.second", d: "second" },
+    ]
+  );
+  expect(consumer.num_ack_pending).toEqual(0);
+});
@@ -0,0 +1,138 @@
+import { Message } from "@google-cloud/pubsub";
+import { release } from "../../src/delivery";
+import { Event } from "../../src/event";
+import { makeClient } from "../../src/io/pubsub";
+import { make } from "../../src/input/pubsub";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const connection = { "project-id": "cdp-test", endpoint: "localhost:8085" };
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+const client = makeClient(connection);
+
+afterAll(() => client.close());
+
+/**
+ * Create a topic and a subscription to it in the emulator.
+ */
+const makeSubscription = async (name: string) => {
+  const [topic] = await client.createTopic(`${name}-topic`);
+  const [subscription] = await topic.createSubscription(`${name}-sub`, {
+    ackDeadlineSeconds: 10,
+  });
+  return { topic, subscription };
+};
+
+/**
+ * Consume the events of the input like a pipeline that's done with
+ * each event as soon as it's received.
+ */
+const consumeReleasing = async (
+  receive: AsyncGenerator<Event>
+): Promise<Event[]> => {
+  const events: Event[] = [];
+  for await (const event of receive) {
+    release(event.receipt);
+    events.push(event);
+  }
+  return events;
+};
+
+test("@pubsub The pubsub input acknowledges messages once their events are done with", async () => {
+  // Arrange
+  const { topic, subscription } = await makeSubscription("test1");
+  await topic.publishMessage({ json: { n: "foo", d: 1 } });
+  await topic.publishMessage({ json: { n: "bar", d: 2 } });
+  const [channel, stopped] = make(testParams, {
+    ...connection,
+    subscription: "test1-sub",
+  });
+  // Act
+  const [output] = await Promise.all([
+    consumeReleasing(channel.receive),
+    Promise.race([resolveAfter(2000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(
+    output
+      .map((e) => e.toJSON())
+      .map(({ n, d }) => ({ n, d }))
+      .sort((a, b) => a.d - b.d)
+  ).toEqual([
+    { n: "foo", d: 1 },
+    { n: "bar", d: 2 },
+  ]);
+  // Nothing is left to be delivered again.
+  const redelivered: Message[] = [];
+  subscription.on("message", (message: Message) => {
+    redelivered.push(message);
+    message.ack();
+  });
+  await resolveAfter(1000);
+  await subscription.close();
+  expect(redelivered).toHaveLength(0);
+  await subscription.delete();
+  await topic.delete();
+});
+
+test("@pubsub The pubsub input nacks messages that can't be parsed", async () => {
+  // Arrange
+  const { topic, subscription } = await makeSubscription("test2");
+  await topic.publishMessage({ data: Buffer.from("{not json") });
+  const [channel, stopped] = make(testParams, {
+    ...connection,
+    subscription: "test2-sub",
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(1000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(output).toHaveLength(0);
+  // The message is delivered again.
+  const redelivered: string[] = [];
+  subscription.on("message", (message: Message) => {
+    redelivered.push(message.data.toString());
+    message.ack();
+  });
+  await resolveAfter(1000);
+  await subscription.close();
+  expect(redelivered).toEqual(["{not json"]);
+  await subscription.delete();
+  await topic.delete();
+});
+
+test("@pubsub The pubsub input can wrap messages with their attributes", async () => {
+  // Arrange
+  const { topic, subscription } = await makeSubscription("test3");
+  await topic.publishMessage({
+    json: { temperature: 21.5 },
+    attributes: { room: "kitchen" },
+  });
+  const [channel, stopped] = make(testParams, {
+    ...connection,
+    subscription: "test3-sub",
+    attributes: true,
+    wrap: "readings",
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(2000).then(() => channel.close()), stopped]),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    {
+      n: "readings",
+      d: { body: { temperature: 21.5 }, attributes: { room: "kitchen" } },
+    },
+  ]);
+  await subscription.delete();
+  await topic.delete();
+});
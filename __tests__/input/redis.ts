@@ -124,3 +124,80 @@ test("@redis The redis input form works for single instance, brpop", async () =>
     testEvents
   );
 });
+
+test("@redis The redis input form works for single instance, xreadgroup", async () => {
+  // Arrange
+  const client = new Redis(redisUrl);
+  await client.flushall();
+  const [channel, stopped] = make(testParams, {
+    instance: redisUrl,
+    xreadgroup: {
+      stream: "test5",
+      group: "test5-group",
+      consumer: "test5-consumer",
+      block: 500,
+    },
+  });
+  // Act
+  await resolveAfter(1000); // Give time for the group to be created
+  for (const event of testEvents) {
+    await client.xadd("test5", "*", "name", event.n, "value", event.d);
+  }
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(1000).then(() => channel.close()), stopped]),
+  ]);
+  await resolveAfter(1000); // Give time for the last acknowledgements
+  const pending = await client.xpending("test5", "test5-group");
+  await client.quit();
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    testEvents.map(({ n, d }) => ({
+      n: "test5",
+      d: { name: n, value: d },
+    }))
+  );
+  expect(pending[0]).toEqual(0);
+});
+
+test("@redis The redis input form reads pending entries first, xreadgroup", async () => {
+  // Arrange
+  const client = new Redis(redisUrl);
+  await client.flushall();
+  await client.xgroup("CREATE", "test6", "test6-group", "$", "MKSTREAM");
+  await client.xadd("test6", "*", "value", "pending");
+  // Deliver the entry to the consumer without acknowledging it, as
+  // if it had crashed.
+  await client.xreadgroup(
+    "GROUP",
+    "test6-group",
+    "test6-consumer",
+    "STREAMS",
+    "test6",
+    ">"
+  );
+  await client.xadd("test6", "*", "value", "new");
+  const [channel, stopped] = make(testParams, {
+    instance: redisUrl,
+    xreadgroup: {
+      stream: "test6",
+      group: "test6-group",
+      consumer: "test6-consumer",
+      block: 500,
+    },
+    wrap: "test6.entry",
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    Promise.race([resolveAfter(1000).then(() => channel.close()), stopped]),
+  ]);
+  await client.quit();
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    [
+      { n: "test6.entry", d: { value: "pending" } },
+      { n: "test6.entry", d: { value: "new" } },
+    ]
+  );
+});
@@ -0,0 +1,93 @@
+import fs from "fs";
+import path from "path";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/input/replay";
+import { make as makeRecord } from "../../src/step-functions/record";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+let tmpFilePath = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  const base = fs.mkdtempSync("/tmp/cdp-tests-");
+  tmpFilePath = path.join(base, "recording.ndjson");
+});
+
+afterEach(() => {
+  fs.rmSync(path.dirname(tmpFilePath), { recursive: true, force: true });
+});
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+test("@standalone The replay input form replays a recorded stream in order", async () => {
+  // Arrange
+  const recorder = await makeRecord(
+    { ...testParams, stepName: "irrelevant" },
+    { path: tmpFilePath }
+  );
+  const trace = [{ i: 1, p: "recorded", h: "recorded" }];
+  const names = ["a", "b.c", "a", "d", "b.c"];
+  for (const [index, name] of names.entries()) {
+    recorder.send([await makeEvent(name, index, trace)]);
+  }
+  await Promise.all([
+    consume(recorder.receive),
+    resolveAfter(10).then(() => recorder.close()),
+  ]);
+  const [channel] = make(testParams, tmpFilePath);
+  // Act
+  const output = await consume(channel.receive);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual(
+    names.map((name, index) => [name, index])
+  );
+  expect(output[0].trace.map(({ p }) => p)).toEqual(["recorded", "irrelevant"]);
+});
+
+test("@standalone The replay input form paces events by their recorded offsets", async () => {
+  // Arrange
+  fs.writeFileSync(
+    tmpFilePath,
+    [0, 0.2, 0.4, 0.6]
+      .map((offset, index) =>
+        JSON.stringify({ offset, event: { n: "tick", d: index } })
+      )
+      .join("\n") + "\nnot a record\n{}\n"
+  );
+  const [channel] = make(testParams, { path: tmpFilePath, speed: 2 });
+  // Act
+  const start = new Date().getTime();
+  const arrivals: number[] = [];
+  for await (const event of channel.receive) {
+    arrivals.push((new Date().getTime() - start) / 1000);
+    expect(event.name).toEqual("tick");
+  }
+  // Assert
+  // At twice the recorded speed, events arrive 0.1 seconds apart.
+  expect(arrivals).toHaveLength(4);
+  expect(arrivals[0]).toBeLessThan(0.1);
+  expect(arrivals[3]).toBeGreaterThanOrEqual(0.28);
+  expect(arrivals[3]).toBeLessThan(0.6);
+});
+
+test("@standalone The replay input form can be closed while pacing events", async () => {
+  // Arrange
+  fs.writeFileSync(
+    tmpFilePath,
+    JSON.stringify({ offset: 0, event: { n: "first" } }) +
+      "\n" +
+      JSON.stringify({ offset: 3600, event: { n: "much-later" } }) +
+      "\n"
+  );
+  const [channel] = make(testParams, { path: tmpFilePath, speed: "1" });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual(["first"]);
+});
@@ -0,0 +1,186 @@
+import { release } from "../../src/delivery";
+import { Event } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make } from "../../src/input/sqs";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+// Messages held by the fake SQS server, and the calls it received.
+const messages: {
+  MessageId: string;
+  ReceiptHandle: string;
+  Body: string;
+  MessageAttributes?: unknown;
+}[] = [];
+const calls: { action: string; body: { [key: string]: unknown } }[] = [];
+
+const server = makeHTTPServer(30090, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  const action = (ctx.get("x-amz-target") ?? "").replace("AmazonSQS.", "");
+  const body = JSON.parse(Buffer.concat(chunks).toString());
+  calls.push({ action, body });
+  ctx.type = "application/x-amz-json-1.0";
+  if (action === "ReceiveMessage") {
+    const received = messages.splice(0, body.MaxNumberOfMessages);
+    if (received.length === 0) {
+      // Emulate a short long-poll.
+      await resolveAfter(50);
+    }
+    ctx.body = JSON.stringify({ Messages: received });
+  } else {
+    ctx.body = JSON.stringify({ Successful: [], Failed: [] });
+  }
+});
+
+afterEach(() => {
+  messages.length = 0;
+  calls.length = 0;
+});
+
+afterAll(() => server.close());
+
+const baseOptions = {
+  "queue-url": "http://127.0.0.1:30090/000000000000/test-queue",
+  "access-key-id": "test-key",
+  "secret-access-key": "test-secret",
+  "wait-time": 1,
+};
+
+/**
+ * The receipt handles of the messages deleted so far.
+ */
+const deletedHandles = (): unknown[] =>
+  calls
+    .filter(({ action }) => action === "DeleteMessageBatch")
+    .flatMap(({ body }) =>
+      (body.Entries as { ReceiptHandle: string }[]).map(
+        (entry) => entry.ReceiptHandle
+      )
+    );
+
+/**
+ * Consume the events of the input like a pipeline that's done with
+ * each event as soon as it's received.
+ */
+const consumeReleasing = async (
+  receive: AsyncGenerator<Event>
+): Promise<Event[]> => {
+  const events: Event[] = [];
+  for await (const event of receive) {
+    release(event.receipt);
+    events.push(event);
+  }
+  return events;
+};
+
+test("@standalone The sqs input deletes messages once their events are done with", async () => {
+  // Arrange
+  messages.push(
+    {
+      MessageId: "1",
+      ReceiptHandle: "handle-1",
+      Body: JSON.stringify({ n: "foo", d: 1 }),
+    },
+    {
+      MessageId: "2",
+      ReceiptHandle: "handle-2",
+      Body: JSON.stringify({ n: "bar", d: 2 }),
+    }
+  );
+  const [channel] = make(testParams, baseOptions);
+  // Act
+  await resolveAfter(300);
+  const deletedBeforeConsuming = deletedHandles();
+  const [output] = await Promise.all([
+    consumeReleasing(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(deletedBeforeConsuming).toEqual([]);
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "foo", d: 1 },
+    { n: "bar", d: 2 },
+  ]);
+  expect(deletedHandles()).toEqual(["handle-1", "handle-2"]);
+});
+
+test("@standalone The sqs input doesn't delete messages whose events aren't done with", async () => {
+  // Arrange
+  messages.push({
+    MessageId: "1",
+    ReceiptHandle: "handle-1",
+    Body: JSON.stringify({ n: "foo", d: 1 }),
+  });
+  const [channel] = make(testParams, baseOptions);
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output).toHaveLength(1);
+  expect(deletedHandles()).toEqual([]);
+});
+
+test("@standalone The sqs input respects the in-flight limit", async () => {
+  // Arrange
+  messages.push(
+    ...[1, 2, 3].map((i) => ({
+      MessageId: `${i}`,
+      ReceiptHandle: `handle-${i}`,
+      Body: JSON.stringify({ n: "foo", d: i }),
+    }))
+  );
+  const [channel] = make(testParams, { ...baseOptions, "max-in-flight": 2 });
+  // Act
+  await resolveAfter(300);
+  const receivedBeforeConsuming = calls.filter(
+    ({ action }) => action === "ReceiveMessage"
+  );
+  const [output] = await Promise.all([
+    consumeReleasing(channel.receive),
+    resolveAfter(500).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(receivedBeforeConsuming).toHaveLength(1);
+  expect(receivedBeforeConsuming[0].body.MaxNumberOfMessages).toEqual(2);
+  expect(output.map((e) => e.data)).toEqual([1, 2, 3]);
+  expect(deletedHandles()).toEqual(["handle-1", "handle-2", "handle-3"]);
+});
+
+test("@standalone The sqs input can wrap messages with their attributes", async () => {
+  // Arrange
+  messages.push({
+    MessageId: "1",
+    ReceiptHandle: "handle-1",
+    Body: JSON.stringify({ temperature: 21.5 }),
+    MessageAttributes: {
+      room: { DataType: "String", StringValue: "kitchen" },
+    },
+  });
+  const [channel] = make(testParams, {
+    ...baseOptions,
+    attributes: true,
+    wrap: "readings",
+  });
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    {
+      n: "readings",
+      d: { body: { temperature: 21.5 }, attributes: { room: "kitchen" } },
+    },
+  ]);
+});
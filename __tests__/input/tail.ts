@@ -14,8 +14,7 @@ beforeEach(() => {
 });
 
 afterEach(() => {
-  fs.unlinkSync(tmpFilePath);
-  fs.rmdirSync(path.dirname(tmpFilePath));
+  fs.rmSync(path.dirname(tmpFilePath), { recursive: true, force: true });
 });
 
 test("@standalone The tail input form works as expected", async () => {
@@ -38,6 +37,113 @@ test("@standalone The tail input form works as expected", async () => {
   ]);
   // Assert
   expect(sent).toEqual(false);
-  // tail-file removes the line breaks
+  // Line breaks are removed
   expect(output.map((e) => e.data)).toEqual(["Lorem ipsum", "Dolor sit amet"]);
 });
+
+test("@standalone The tail input form follows rotated and truncated files", async () => {
+  // Arrange
+  const [channel] = make(
+    { pipelineName: "irrelevant", pipelineSignature: "irrelevant" },
+    {
+      path: tmpFilePath,
+      "start-at": "start",
+      wrap: { name: "test", raw: true },
+    }
+  );
+  fs.appendFileSync(tmpFilePath, "one\ntwo\n");
+  await resolveAfter(500);
+  // Act
+  fs.renameSync(tmpFilePath, `${tmpFilePath}.1`);
+  fs.appendFileSync(`${tmpFilePath}.1`, "three\n");
+  fs.writeFileSync(tmpFilePath, "four\nfive\n");
+  await resolveAfter(500);
+  fs.truncateSync(tmpFilePath, 0);
+  fs.appendFileSync(tmpFilePath, "six\n");
+  await resolveAfter(500);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    "one",
+    "two",
+    "three",
+    "four",
+    "five",
+    "six",
+  ]);
+});
+
+test("@standalone The tail input form resumes from persisted offsets", async () => {
+  // Arrange
+  const offsetFile = path.join(path.dirname(tmpFilePath), "offsets");
+  const options = {
+    path: tmpFilePath,
+    "offset-file": offsetFile,
+    wrap: { name: "test", raw: true },
+  };
+  const testParams = {
+    pipelineName: "irrelevant",
+    pipelineSignature: "irrelevant",
+  };
+  const [firstChannel] = make(testParams, options);
+  await resolveAfter(100);
+  fs.appendFileSync(tmpFilePath, "one\ntwo\n");
+  await resolveAfter(500);
+  const [firstOutput] = await Promise.all([
+    consume(firstChannel.receive),
+    firstChannel.close(),
+  ]);
+  // Act
+  fs.appendFileSync(tmpFilePath, "three\nfour\n");
+  const [secondChannel] = make(testParams, options);
+  await resolveAfter(500);
+  const [secondOutput] = await Promise.all([
+    consume(secondChannel.receive),
+    secondChannel.close(),
+  ]);
+  // Assert
+  expect(firstOutput.map((e) => e.data)).toEqual(["one", "two"]);
+  expect(secondOutput.map((e) => e.data)).toEqual(["three", "four"]);
+});
+
+test("@standalone The tail input form replays lines read after the last saved offset", async () => {
+  // Arrange
+  const offsetFile = path.join(path.dirname(tmpFilePath), "offsets");
+  const options = {
+    path: tmpFilePath,
+    checkpoint: { file: offsetFile },
+    wrap: { name: "test", raw: true },
+  };
+  const testParams = {
+    pipelineName: "irrelevant",
+    pipelineSignature: "irrelevant",
+  };
+  const [firstChannel] = make(testParams, options);
+  await resolveAfter(100);
+  fs.appendFileSync(tmpFilePath, "one\ntwo\n");
+  await resolveAfter(500);
+  // The offsets saved at this point are the ones a crash would leave
+  // behind, since later ones are discarded.
+  const savedOffsets = fs.readFileSync(offsetFile);
+  fs.appendFileSync(tmpFilePath, "three\n");
+  await resolveAfter(500);
+  const [firstOutput] = await Promise.all([
+    consume(firstChannel.receive),
+    firstChannel.close(),
+  ]);
+  fs.writeFileSync(offsetFile, savedOffsets);
+  // Act
+  fs.appendFileSync(tmpFilePath, "four\n");
+  const [secondChannel] = make(testParams, options);
+  await resolveAfter(500);
+  const [secondOutput] = await Promise.all([
+    consume(secondChannel.receive),
+    secondChannel.close(),
+  ]);
+  // Assert
+  expect(firstOutput.map((e) => e.data)).toEqual(["one", "two", "three"]);
+  expect(secondOutput.map((e) => e.data)).toEqual(["three", "four"]);
+});
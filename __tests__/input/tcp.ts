@@ -0,0 +1,154 @@
+import { connect } from "net";
+import { make } from "../../src/input/tcp";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+/**
+ * Connect to the input, write the given chunks one by one and close
+ * the connection.
+ */
+const sendChunks = (port: number, chunks: Buffer[]): Promise<void> =>
+  new Promise((resolve, reject) => {
+    const socket = connect(port, "127.0.0.1", async () => {
+      for (const chunk of chunks) {
+        socket.write(chunk);
+        await resolveAfter(10);
+      }
+      socket.end();
+    });
+    socket.on("close", () => resolve());
+    socket.on("error", reject);
+  });
+
+/**
+ * Add a length prefix to some data.
+ */
+const lengthPrefixed = (data: string): Buffer => {
+  const header = Buffer.alloc(4);
+  header.writeUInt32BE(Buffer.byteLength(data));
+  return Buffer.concat([header, Buffer.from(data)]);
+};
+
+test("@standalone The tcp input splits newline-delimited frames", async () => {
+  // Arrange
+  const [channel] = make(testParams, { port: 30100, wrap: "lines" });
+  await resolveAfter(100);
+  // Act
+  await sendChunks(30100, [
+    Buffer.from('{"a": 1}\n{"a"'),
+    Buffer.from(': 2}\n\n"three"\n'),
+    Buffer.from("4"),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ a: 1 }, { a: 2 }, "three", 4]);
+});
+
+test("@standalone The tcp input splits length-prefixed frames", async () => {
+  // Arrange
+  const [channel] = make(testParams, {
+    port: 30101,
+    framing: "length-prefixed",
+    wrap: { name: "frames", raw: true },
+  });
+  await resolveAfter(100);
+  const data = Buffer.concat([
+    lengthPrefixed("first\nframe"),
+    lengthPrefixed("second"),
+  ]);
+  // Act
+  await sendChunks(30101, [
+    data.subarray(0, 2),
+    data.subarray(2, 9),
+    data.subarray(9),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["first\nframe", "second"]);
+});
+
+test("@standalone The tcp input splits frames with a custom delimiter", async () => {
+  // Arrange
+  const [channel] = make(testParams, {
+    port: 30102,
+    framing: { delimiter: "||" },
+    wrap: { name: "frames", raw: true },
+  });
+  await resolveAfter(100);
+  // Act
+  await sendChunks(30102, [
+    Buffer.from("one||tw"),
+    Buffer.from("o|"),
+    Buffer.from("|three||"),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["one", "two", "three"]);
+});
+
+test("@standalone The tcp input drops connections that exceed the frame size", async () => {
+  // Arrange
+  const [channel] = make(testParams, {
+    port: 30103,
+    framing: "length-prefixed",
+    "max-frame-bytes": 8,
+    wrap: { name: "frames", raw: true },
+  });
+  await resolveAfter(100);
+  // Act
+  await sendChunks(30103, [
+    Buffer.concat([lengthPrefixed("small"), lengthPrefixed("too large")]),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["small"]);
+});
+
+test("@standalone The tcp input handles concurrent connections", async () => {
+  // Arrange
+  const [channel] = make(testParams, { port: 30104, wrap: "lines" });
+  await resolveAfter(100);
+  // Act
+  await Promise.all(
+    Array.from({ length: 20 }, (_, connection) =>
+      sendChunks(
+        30104,
+        Array.from({ length: 5 }, (_, i) =>
+          Buffer.from(`${JSON.stringify({ connection, i })}\n`)
+        )
+      )
+    )
+  );
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output).toHaveLength(100);
+  for (let connection = 0; connection < 20; connection++) {
+    // Frames of each connection keep their order.
+    expect(
+      output
+        .map((e) => e.data as { connection: number; i: number })
+        .filter((d) => d.connection === connection)
+        .map((d) => d.i)
+    ).toEqual([0, 1, 2, 3, 4]);
+  }
+});
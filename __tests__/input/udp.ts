@@ -0,0 +1,72 @@
+import { createSocket } from "dgram";
+import { make } from "../../src/input/udp";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+/**
+ * Send each message as a datagram.
+ */
+const sendDatagrams = async (
+  port: number,
+  messages: string[]
+): Promise<void> => {
+  const socket = createSocket("udp4");
+  for (const message of messages) {
+    await new Promise((resolve, reject) =>
+      socket.send(message, port, "127.0.0.1", (err) =>
+        err ? reject(err) : resolve(null)
+      )
+    );
+  }
+  socket.close();
+};
+
+test("@standalone The udp input builds one event per datagram", async () => {
+  // Arrange
+  const [channel] = make(testParams, { port: 30105 });
+  await resolveAfter(100);
+  // Act
+  await sendDatagrams(30105, [
+    JSON.stringify({ n: "foo", d: 1 }),
+    "not json",
+    JSON.stringify({ n: "bar", d: { multi: "line" } }, null, 2),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "foo", d: 1 },
+    { n: "bar", d: { multi: "line" } },
+  ]);
+});
+
+test("@standalone The udp input can keep datagrams raw", async () => {
+  // Arrange
+  const [channel] = make(testParams, {
+    port: 30106,
+    "buffer-size": 65536,
+    wrap: { name: "syslog", raw: true },
+  });
+  await resolveAfter(100);
+  // Act
+  await sendDatagrams(30106, [
+    "<34>Oct 11 22:14:15 host app: first\n",
+    "<34>Oct 11 22:14:16 host app: second",
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "syslog", d: "<34>Oct 11 22:14:15 host app: first" },
+    { n: "syslog", d: "<34>Oct 11 22:14:16 host app: second" },
+  ]);
+});
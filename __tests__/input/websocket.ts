@@ -0,0 +1,107 @@
+import WebSocket, { WebSocketServer } from "ws";
+import { make } from "../../src/input/websocket";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testEvents = [
+  { n: "foo", d: "fooo" },
+  { n: "bar", d: "barr" },
+  { n: "baz", d: "bazz" },
+];
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+};
+
+/**
+ * Open a WebSocket connection to the given URL.
+ */
+const open = (url: string): Promise<WebSocket> =>
+  new Promise((resolve, reject) => {
+    const socket = new WebSocket(url);
+    socket.once("open", () => resolve(socket));
+    socket.once("error", reject);
+  });
+
+test("@standalone The websocket input form builds a one-way channel", async () => {
+  // Arrange
+  const [channel, stopped] = make(testParams, {
+    port: 30080,
+    endpoint: "/events",
+  });
+  // Act
+  const sent = channel.send();
+  await Promise.race([channel.close(), stopped]);
+  // Assert
+  expect(sent).toEqual(false);
+});
+
+test("@standalone The websocket input accepts frames from clients", async () => {
+  // Arrange
+  const [channel] = make(testParams, {
+    port: 30081,
+    endpoint: "/events",
+  });
+  const client = await open("ws://127.0.0.1:30081/events");
+  // Act
+  client.send(JSON.stringify(testEvents[0]));
+  client.send(
+    Buffer.from(testEvents.slice(1).map((e) => JSON.stringify(e)).join("\n"))
+  );
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    testEvents
+  );
+});
+
+test("@standalone The websocket input can wrap frames received", async () => {
+  // Arrange
+  const [channel] = make(testParams, {
+    port: 30082,
+    wrap: { name: "readings", raw: true },
+  });
+  const client = await open("ws://127.0.0.1:30082/");
+  // Act
+  client.send("21.5");
+  client.send("19.0");
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "readings", d: "21.5" },
+    { n: "readings", d: "19.0" },
+  ]);
+});
+
+test("@standalone The websocket input reconnects to the server", async () => {
+  // Arrange
+  const server = new WebSocketServer({ port: 30083 });
+  const connections: WebSocket[] = [];
+  server.on("connection", (socket) => {
+    connections.push(socket);
+    socket.send(JSON.stringify(testEvents[connections.length - 1]));
+    if (connections.length === 1) {
+      // Drop the first connection, to force a reconnection.
+      socket.terminate();
+    }
+  });
+  const [channel] = make(testParams, "ws://127.0.0.1:30083");
+  // Act
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1500).then(() => channel.close()),
+  ]);
+  await new Promise((resolve) => server.close(resolve));
+  // Assert
+  expect(connections).toHaveLength(2);
+  expect(output.map((e) => e.toJSON()).map(({ n, d }) => ({ n, d }))).toEqual(
+    testEvents.slice(0, 2)
+  );
+});
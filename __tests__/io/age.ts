@@ -0,0 +1,104 @@
+import { createCipheriv, hkdfSync } from "crypto";
+import {
+  decrypt,
+  encrypt,
+  generateIdentity,
+  parseIdentity,
+  parseRecipient,
+} from "../../src/io/age";
+
+// The identity, file key and header of the x25519 vector of the age
+// test kit (https://c2sp.org/CCTV/age).
+const identity =
+  "AGE-SECRET-KEY-1XMWWC06LY3EE5RYTXM9MFLAZ2U56JJJ36S0MYPDRWSVLUL66MV4QX3S7F6";
+const fileKey = Buffer.from("59454c4c4f57205355424d4152494e45", "hex");
+const header =
+  "age-encryption.org/v1\n" +
+  "-> X25519 TEiF0ypqr+bpvcqXNyCVJpL7OuwPdVwPL7KQEbFDOCc\n" +
+  "EmECAEcKN+n/Vs9SbWiV+Hu0r+E8R77DdWYyd83nw7U\n" +
+  "--- Vn+54jqiiUCE+WZcEVY3f1sqHjlu/z1LCQ/T7Xm7qI0\n";
+
+// Build a single-chunk payload for the file key, following the age
+// specification.
+const makePayload = (plaintext: Buffer): Buffer => {
+  const nonce = Buffer.alloc(16, 0x2a);
+  const key = Buffer.from(hkdfSync("sha256", fileKey, nonce, "payload", 32));
+  const chunkNonce = Buffer.alloc(12);
+  chunkNonce[11] = 1;
+  const cipher = createCipheriv("chacha20-poly1305", key, chunkNonce, {
+    authTagLength: 16,
+  });
+  return Buffer.concat([
+    nonce,
+    cipher.update(plaintext),
+    cipher.final(),
+    cipher.getAuthTag(),
+  ]);
+};
+
+test("@standalone Age decrypts files with the header of the age test kit", () => {
+  // Arrange
+  const file = Buffer.concat([
+    Buffer.from(header),
+    makePayload(Buffer.from("hello world")),
+  ]);
+  // Act
+  const plaintext = decrypt(file, [parseIdentity(identity) as Buffer]);
+  // Assert
+  expect(plaintext.toString()).toEqual("hello world");
+});
+
+test("@standalone Age rejects headers that were tampered with", () => {
+  // Arrange
+  const file = Buffer.concat([
+    Buffer.from(header.replace("Vn+54", "Vn+55")),
+    makePayload(Buffer.from("hello world")),
+  ]);
+  // Act & Assert
+  expect(() => decrypt(file, [parseIdentity(identity) as Buffer])).toThrow(
+    "the age header was tampered with"
+  );
+});
+
+test("@standalone Age round-trips data in several chunks", () => {
+  // Arrange
+  const { identity: generated, recipient } = generateIdentity();
+  const inputs = [
+    Buffer.alloc(0),
+    Buffer.from("hello world"),
+    Buffer.alloc(64 * 1024, "a"),
+    Buffer.alloc(200000, "b"),
+  ];
+  // Act
+  const outputs = inputs.map((input) =>
+    decrypt(encrypt(input, [parseRecipient(recipient) as Buffer]), [
+      parseIdentity(generated) as Buffer,
+    ])
+  );
+  // Assert
+  expect(outputs).toEqual(inputs);
+});
+
+test("@standalone Age rejects low-order recipients and shares", () => {
+  // Arrange
+  const lowOrder = Buffer.alloc(32);
+  const lowOrderRecipient =
+    "age1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq5cu47z";
+  const file = Buffer.concat([
+    Buffer.from(
+      "age-encryption.org/v1\n" +
+        `-> X25519 ${lowOrder.toString("base64").replace(/=+$/, "")}\n` +
+        "EmECAEcKN+n/Vs9SbWiV+Hu0r+E8R77DdWYyd83nw7U\n" +
+        "--- Vn+54jqiiUCE+WZcEVY3f1sqHjlu/z1LCQ/T7Xm7qI0\n"
+    ),
+    makePayload(Buffer.from("hello world")),
+  ]);
+  // Act & Assert
+  expect(parseRecipient(lowOrderRecipient)).toBeNull();
+  expect(() => encrypt(Buffer.from("hello world"), [lowOrder])).toThrow(
+    "invalid X25519 recipient (low-order point)"
+  );
+  expect(() => decrypt(file, [parseIdentity(identity) as Buffer])).toThrow(
+    "invalid X25519 share"
+  );
+});
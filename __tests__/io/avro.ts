@@ -0,0 +1,102 @@
+import {
+  parseSchema,
+  encodeAvro,
+  decodeAvro,
+  frame,
+  unframe,
+} from "../../src/io/avro";
+
+test("@standalone Avro encoding follows the specification", () => {
+  // Arrange
+  const type = parseSchema({
+    type: "record",
+    name: "test",
+    fields: [
+      { name: "a", type: "long" },
+      { name: "b", type: "string" },
+    ],
+  });
+  const long = parseSchema("long");
+  // Act
+  const encoded = encodeAvro(type, { a: 27, b: "foo" });
+  const longs = [0, -1, 1, -64, 64].map((n) =>
+    encodeAvro(long, n).toString("hex")
+  );
+  // Assert
+  expect(encoded.toString("hex")).toEqual("3606666f6f");
+  expect(decodeAvro(type, encoded)).toEqual({ a: 27, b: "foo" });
+  expect(longs).toEqual(["00", "01", "02", "7f", "8001"]);
+});
+
+test("@standalone Avro values of complex types survive a round trip", () => {
+  // Arrange
+  const type = parseSchema({
+    type: "record",
+    name: "Node",
+    namespace: "test",
+    fields: [
+      { name: "value", type: ["null", "int", "string"] },
+      {
+        name: "kind",
+        type: { type: "enum", name: "Kind", symbols: ["LEAF", "BRANCH"] },
+      },
+      { name: "tags", type: { type: "array", items: "string" } },
+      { name: "weights", type: { type: "map", values: "double" } },
+      { name: "id", type: { type: "fixed", name: "Id", size: 2 } },
+      { name: "blob", type: "bytes" },
+      { name: "active", type: "boolean", default: true },
+      { name: "next", type: ["null", "Node"], default: null },
+    ],
+  });
+  const value = {
+    value: "root",
+    kind: "BRANCH",
+    tags: ["a", "b"],
+    weights: { x: 1.5 },
+    id: "AAE=",
+    blob: "aGVsbG8=",
+    next: {
+      value: 3,
+      kind: "LEAF",
+      tags: [],
+      weights: {},
+      id: "AQI=",
+      blob: "",
+      active: false,
+      next: null,
+    },
+  };
+  // Act
+  const decoded = decodeAvro(type, encodeAvro(type, value));
+  // Assert
+  expect(decoded).toEqual({ ...value, active: true });
+});
+
+test("@standalone Avro encoding rejects values that don't match", () => {
+  const type = parseSchema({
+    type: "record",
+    name: "test",
+    fields: [{ name: "items", type: { type: "array", items: "int" } }],
+  });
+  expect(() => encodeAvro(type, { items: [1, "2"] })).toThrow("$.items[1]");
+  expect(() => encodeAvro(type, {})).toThrow("$.items");
+  expect(() => decodeAvro(type, Buffer.from("04", "hex"))).toThrow(
+    "truncated"
+  );
+  expect(() =>
+    parseSchema({
+      type: "record",
+      name: "test",
+      fields: [{ name: "y", type: "Unknown" }],
+    })
+  ).toThrow("undefined Avro type");
+});
+
+test("@standalone Avro data is framed for the schema registry", () => {
+  // Act
+  const framed = frame(258, Buffer.from("abc"));
+  // Assert
+  expect(framed.toString("hex")).toEqual("0000000102616263");
+  expect(unframe(framed)).toEqual([258, Buffer.from("abc")]);
+  expect(() => unframe(Buffer.from("abc"))).toThrow();
+});
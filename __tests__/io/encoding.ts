@@ -0,0 +1,127 @@
+// Keep exact numbers, as if configured through the environment.
+jest.mock("../../src/conf", () => ({
+  ...jest.requireActual("../../src/conf"),
+  JSON_NUMBERS: "exact",
+  INPUT_MAX_DEPTH: 4,
+}));
+
+import * as cbor from "../../src/io/cbor";
+import {
+  decodeMessage,
+  encodeMessage,
+  encodeMessages,
+} from "../../src/io/encoding";
+import { InputLimitError } from "../../src/io/limits";
+import * as msgpack from "../../src/io/msgpack";
+import { decodeJson, encodeJson, ExactNumber } from "../../src/json";
+
+const hex = (s: string) => Buffer.from(s.replace(/ /g, ""), "hex");
+
+// A value covering every JSON type, and integers and strings of each
+// size class of both encodings.
+const sample = {
+  nothing: null,
+  flags: [true, false],
+  integers: [0, -1, -33, 127, 128, 256, 65536, -129, -40000, 2 ** 40],
+  floats: [1.5, -0.25],
+  strings: ["", "é".repeat(40), "x".repeat(300)],
+  nested: { empty: [], object: {}, list: [1, { b: "c" }] },
+};
+
+test("@standalone MessagePack values are encoded as specified", () => {
+  // Act
+  const encoded = msgpack.encode({ compact: true, schema: 0 });
+  // Assert
+  expect(encoded).toEqual(hex("82 a7 636f6d70616374 c3 a6 736368656d61 00"));
+});
+
+test("@standalone CBOR data items are decoded as specified", () => {
+  // Act
+  const decoded = [
+    "1a000f4240",
+    "3903e7",
+    "8301820203820405",
+    "f93e00",
+    "7f657374726561646d696e67ff",
+    "bf61610161629f0203ffff",
+    "c074323031332d30332d32315432303a30343a30305a",
+  ].map((item) => cbor.decode(hex(item)));
+  // Assert
+  expect(decoded).toEqual([
+    [1000000],
+    [-1000],
+    [[1, [2, 3], [4, 5]]],
+    [1.5],
+    ["streaming"],
+    [{ a: 1, b: [2, 3] }],
+    ["2013-03-21T20:04:00Z"],
+  ]);
+});
+
+test("@standalone Binary encodings round-trip JSON values", () => {
+  for (const encoding of ["msgpack", "cbor"] as const) {
+    // Act
+    const decoded = decodeMessage(
+      encodeMessages([sample, "second"], encoding) as Buffer,
+      encoding
+    );
+    // Assert
+    expect(decoded).toEqual([sample, "second"]);
+  }
+});
+
+test("@standalone Binary encodings keep 64-bit exact integers", () => {
+  // Arrange
+  const raw =
+    '{"id":18446744073709551615,"n":-9223372036854775808,"d":0.5,"x":1}';
+  const value = decodeJson(raw);
+  for (const encoding of ["msgpack", "cbor"] as const) {
+    // Act
+    const [decoded] = decodeMessage(
+      encodeMessage(value, encoding) as Buffer,
+      encoding
+    ) as { id: unknown }[];
+    // Assert
+    expect(decoded.id).toBeInstanceOf(ExactNumber);
+    expect(encodeJson(decoded)).toEqual(raw);
+  }
+});
+
+test("@standalone CBOR bignums are decoded as exact integers", () => {
+  // Act
+  const [decoded] = cbor.decode(hex("c249010000000000000000"));
+  // Assert
+  expect(encodeJson(decoded)).toEqual("18446744073709551616");
+});
+
+test("@standalone Binary encodings skip values JSON can't represent", () => {
+  // Arrange
+  const value = {
+    kept: 1,
+    missing: undefined,
+    method: () => 0,
+    serialized: { toJSON: () => "as string" },
+  };
+  for (const encoding of ["msgpack", "cbor"] as const) {
+    // Act
+    const decoded = decodeMessage(
+      encodeMessage(value, encoding) as Buffer,
+      encoding
+    );
+    // Assert
+    expect(decoded).toEqual([{ kept: 1, serialized: "as string" }]);
+  }
+});
+
+test("@standalone Binary messages beyond the limits are rejected", () => {
+  // Act & Assert
+  expect(() => msgpack.decode(hex("91 91 91 91 91 01"))).toThrow(
+    InputLimitError
+  );
+  expect(() => cbor.decode(hex("81 81 81 81 81 01"))).toThrow(
+    InputLimitError
+  );
+  expect(() => msgpack.decode(hex("92 01"))).toThrow("truncated");
+  expect(() => msgpack.decode(hex("d4 01 00"))).toThrow("extension");
+  expect(() => cbor.decode(hex("ff"))).toThrow("break");
+});
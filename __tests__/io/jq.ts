@@ -1,6 +1,16 @@
+// Spy on the synchronous spawns used to check programs.
+jest.mock("child_process", () => {
+  const originalModule = jest.requireActual("child_process");
+  return {
+    ...originalModule,
+    spawnSync: jest.fn(originalModule.spawnSync),
+  };
+});
+
+import { spawnSync } from "child_process";
 import { consume } from "../test-utils";
 import { resolveAfter } from "../../src/utils";
-import { processor } from "../../src/io/jq";
+import { checkProgram, processor } from "../../src/io/jq";
 
 afterEach(() => {
   processor.closeInstances();
@@ -49,3 +59,34 @@ test("@standalone Closing a jq channel ends the stream", async () => {
   const valuesAfterClosing = await consume(receive);
   expect(valuesAfterClosing).toEqual([]);
 });
+
+test("@standalone Closing a jq channel doesn't wait for unread results", async () => {
+  // Arrange
+  const { send, receive, close } = await processor.makeChannel(".");
+  send(1, 2);
+  const { value: first } = await receive.next();
+  // Act
+  await close();
+  // Assert
+  expect(first).toEqual(1);
+});
+
+test("@standalone Valid jq programs are checked once", () => {
+  // Arrange
+  const spawned = spawnSync as jest.Mock;
+  spawned.mockClear();
+  // Act
+  checkProgram("map(.d) # with a trailing comment");
+  checkProgram("map(.d) # with a trailing comment");
+  // Assert
+  expect(spawned).toHaveBeenCalledTimes(1);
+});
+
+test("@standalone Invalid jq programs are reported with jq's errors", () => {
+  // Act & assert
+  expect(() => checkProgram("{key: }")).toThrow(/compile error/);
+  expect(() => checkProgram("undefined_function(.)")).toThrow(
+    /undefined_function\/1 is not defined/
+  );
+  expect(() => checkProgram("f", "def f: .;")).not.toThrow();
+});
@@ -0,0 +1,94 @@
+import { readFileSync } from "fs";
+import path from "path";
+import { loadDescriptorSet, makeProtobufDecoder } from "../../src/io/protobuf";
+
+// The descriptor set compiled from readings.proto.
+const pool = loadDescriptorSet(
+  readFileSync(path.join(__dirname, "..", "fixtures", "readings.pb"))
+);
+
+// A cdp.test.Reading message with every field set, a few of them more
+// than once, and an unknown field 99.
+const fullReading = Buffer.from(
+  "0a03732d31110000000000803540180120fbffffffffffffffff012a0c01feffff" +
+    "ffffffffffff01032804320200ff3a0f0a04726f6f6d12076b69746368656e3a07" +
+    "0a05666c6f6f72420b0880e2cfaa0610c096b1024a1608ffffffffffffffffff01" +
+    "1080b6ca91feffffffff01523a0a0f0a047369746512071a056e6f7274680a130a" +
+    "06666c6f6f727312091100000000000008400a120a0474616773120a32080a0220" +
+    "010a0208005a00620909000000000000f83f62091100000000000002c06a056465" +
+    "762d37700978008201320a25747970652e676f6f676c65617069732e636f6d2f63" +
+    "64702e746573742e4c6f636174696f6e12090900000000000010408a01150a0973" +
+    "656e736f725f69640a0874616b656e5f61749001059d01cdcccc3d980607",
+  "hex"
+);
+
+test("@standalone Protobuf messages are decoded into their JSON mapping", () => {
+  // Arrange
+  const decode = makeProtobufDecoder(pool, "cdp.test.Reading");
+  // Act
+  const decoded = decode(fullReading);
+  // Assert
+  expect(decoded).toEqual({
+    sensorId: "s-1",
+    value: 21.5,
+    unit: "CELSIUS",
+    sequence: "-5",
+    samples: [1, -2, 3, 4],
+    signature: "AP8=",
+    labels: { room: "kitchen", floor: "" },
+    takenAt: "2023-11-14T22:13:20.005Z",
+    interval: "-1.500s",
+    metadata: { site: "north", floors: 3, tags: [true, null] },
+    battery: 0,
+    location: { lat: 1.5, lon: -2.25 },
+    gateway: 9,
+    calibrated: false,
+    extra: { "@type": "type.googleapis.com/cdp.test.Location", lat: 4 },
+    mask: "sensorId,takenAt",
+    offset: "-3",
+    ratio: 0.1,
+  });
+});
+
+test("@standalone Protobuf fields holding default values are omitted", () => {
+  // Arrange
+  const decode = makeProtobufDecoder(pool, ".cdp.test.Reading");
+  // Act
+  const minimal = decode(
+    Buffer.from("0a03732d321800110000000000000000", "hex")
+  );
+  const empty = decode(Buffer.alloc(0));
+  // Assert
+  expect(minimal).toEqual({ sensorId: "s-2" });
+  expect(empty).toEqual({});
+});
+
+test("@standalone Protobuf Any values wrap well-known types", () => {
+  // Arrange
+  const decode = makeProtobufDecoder(pool, "cdp.test.Reading");
+  const reading = Buffer.from(
+    "8201320a2c747970652e676f6f676c65617069732e636f6d2f676f6f676c652e" +
+      "70726f746f6275662e4475726174696f6e1202085a",
+    "hex"
+  );
+  // Act
+  const decoded = decode(reading);
+  // Assert
+  expect(decoded).toEqual({
+    extra: {
+      "@type": "type.googleapis.com/google.protobuf.Duration",
+      value: "90s",
+    },
+  });
+});
+
+test("@standalone Protobuf decoding rejects invalid data", () => {
+  // Arrange
+  const decode = makeProtobufDecoder(pool, "cdp.test.Reading");
+  // Act & assert
+  expect(() => decode(Buffer.from("0a05732d31", "hex"))).toThrow("truncated");
+  expect(() => decode(Buffer.from("0801", "hex"))).toThrow("wire type");
+  expect(() => makeProtobufDecoder(pool, "cdp.test.Missing")).toThrow(
+    "unknown protobuf message type"
+  );
+});
@@ -1,10 +1,15 @@
 import { Readable } from "stream";
 import { consume } from "../test-utils";
-import { parseLines, parseJson } from "../../src/io/read-stream";
+import {
+  parseLines,
+  parseJson,
+  parseInputJson,
+} from "../../src/io/read-stream";
 
 // Some of these tests use the fact that the default value for
 // PARSE_BUFFER_SIZE is 32 when the test environment is
-// active. Changing that value explicitly will break them.
+// active. Changing that value explicitly will break them. The same
+// goes for INPUT_MAX_BYTES, which is 4096 in the test environment.
 
 test("@standalone Parsing lines is kindof equivalent to splitting on linebreaks", async () => {
   const stream = Readable.from([
@@ -105,3 +110,24 @@ test("@standalone Limited streams don't read past their limit", async () => {
     { goodbye: "world" },
   ]);
 });
+
+test("@standalone Input values exceeding the size limit are rejected", async () => {
+  const stream = Readable.from([
+    '{"hello": "world"}\n' + JSON.stringify({ big: "x".repeat(5000) }) + "\n",
+    '{"goodbye": "world"}\n',
+  ]);
+  expect(await consume(parseInputJson(stream))).toEqual([
+    { hello: "world" },
+    { goodbye: "world" },
+  ]);
+});
+
+test("@standalone Input values exceeding the nesting depth limit are rejected", async () => {
+  const stream = Readable.from([
+    "[[1]]\n" + "[".repeat(600) + "]".repeat(600) + "\n",
+    '{"deep": ' + "[".repeat(512) + "]".repeat(512) + "}\n",
+  ]);
+  const values = await consume(parseInputJson(stream));
+  expect(values).toHaveLength(1);
+  expect(values[0]).toEqual([[1]]);
+});
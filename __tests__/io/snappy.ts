@@ -0,0 +1,47 @@
+import { randomBytes } from "crypto";
+import { compress, decompress } from "../../src/io/snappy";
+
+const text =
+  "Wikipedia is a free, web-based, collaborative, multilingual " +
+  "encyclopedia project. Wikipedia is a free encyclopedia.";
+
+// The same text, as compressed by the reference implementation. It
+// uses copies with one-byte offsets, which compress doesn't produce.
+const reference = Buffer.from(
+  "73f04357696b697065646961206973206120667265652c207765622d626173" +
+    "65642c20636f6c6c61626f7261746976652c206d756c74696c696e6775616c" +
+    "20656e6379636c6f70053f2070726f6a6563742e204a52003420656e637963" +
+    "6c6f70656469612e",
+  "hex"
+);
+
+test("@standalone Snappy decompresses data from the reference implementation", () => {
+  expect(decompress(reference).toString()).toEqual(text);
+});
+
+test("@standalone Snappy compression round-trips and finds repetitions", () => {
+  // Arrange
+  const inputs = [
+    Buffer.alloc(0),
+    Buffer.from(text),
+    Buffer.alloc(200000, "a"),
+    randomBytes(100000),
+    Buffer.concat([randomBytes(70000), Buffer.from("xy".repeat(40000))]),
+  ];
+  // Act
+  const compressed = inputs.map(compress);
+  // Assert
+  expect(compressed.map(decompress)).toEqual(inputs);
+  expect(compressed[2].length).toBeLessThan(10000);
+  expect(compressed[3].length).toBeLessThan(100100);
+});
+
+test("@standalone Snappy rejects malformed data", () => {
+  // Act & assert
+  expect(() => decompress(reference.subarray(0, 60))).toThrow(
+    "invalid snappy literal"
+  );
+  expect(() => decompress(Buffer.from([0x08, 0x0a, 0x04, 0x00]))).toThrow(
+    "invalid snappy copy"
+  );
+});
@@ -0,0 +1,55 @@
+// Keep exact numbers, as if configured through the environment.
+jest.mock("../src/conf", () => ({
+  ...jest.requireActual("../src/conf"),
+  JSON_NUMBERS: "exact",
+}));
+
+import { Readable } from "stream";
+import { make as makeEvent } from "../src/event";
+import { parseJson } from "../src/io/read-stream";
+import { decodeJson, encodeJson, ExactNumber } from "../src/json";
+import { canonicalize } from "../src/utils";
+import { consume } from "./test-utils";
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone A 64-bit integer ID round-trips exactly", async () => {
+  // Arrange
+  const raw = '{"id":9223372036854775807,"count":3}';
+  // Act
+  const [parsed] = (await consume(
+    parseJson(Readable.from([`${raw}\n`]))
+  )) as { id: unknown; count: unknown }[];
+  const event = await makeEvent("test", parsed, trace);
+  // Assert
+  expect(parsed.id).toBeInstanceOf(ExactNumber);
+  expect(parsed.count).toEqual(3);
+  expect(encodeJson(parsed)).toEqual(raw);
+  expect(encodeJson(event)).toContain(`"d":${raw}`);
+  expect(canonicalize(parsed)).toEqual('{"count":3,"id":9223372036854775807}');
+});
+
+test("@standalone A high-precision decimal round-trips exactly", () => {
+  // Arrange
+  const raw = "[3.14159265358979323846264338327950288,0.1,1e+21,-0.0025]";
+  // Act
+  const parsed = decodeJson(raw) as unknown[];
+  // Assert
+  expect(parsed[0]).toBeInstanceOf(ExactNumber);
+  expect(Number(parsed[0])).toBeCloseTo(Math.PI);
+  expect(parsed.slice(1)).toEqual([0.1, 1e21, -0.0025]);
+  expect(encodeJson(parsed)).toEqual(raw);
+});
+
+test("@standalone Number literals inside strings are left alone", () => {
+  // Arrange
+  const raw = '{"note":"id 9223372036854775807 \\"quoted\\"","n":1.5}';
+  // Act
+  const parsed = decodeJson(raw);
+  // Assert
+  expect(parsed).toEqual({
+    note: 'id 9223372036854775807 "quoted"',
+    n: 1.5,
+  });
+  expect(encodeJson(parsed)).toEqual(raw);
+});
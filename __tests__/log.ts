@@ -1,4 +1,4 @@
-import { makeLogger } from "../src/log";
+import { makeLogger, truncatePayload } from "../src/log";
 
 // Mock for console.error.
 let mockedConsoleError: jest.SpyInstance<void>;
@@ -26,3 +26,37 @@ test("@standalone Loggers can be created according to the current log level", ()
     ["ERROR at test:", "this message is expected"],
   ]);
 });
+
+test("@standalone Loggers can emit JSON lines annotated with fields", () => {
+  // Arrange
+  const logger = makeLogger("test", "json").with({ step: "a" });
+  // Act
+  logger.with({ event: "e" }).error("something", "failed:", 42);
+  // Assert
+  expect(mockedConsoleError.mock.calls).toHaveLength(1);
+  expect(JSON.parse(mockedConsoleError.mock.calls[0][0])).toEqual({
+    time: expect.any(String),
+    level: "error",
+    ns: "test",
+    msg: "something failed: 42",
+    step: "a",
+    event: "e",
+  });
+});
+
+test("@standalone Loggers append fields to plain text messages", () => {
+  // Arrange
+  const logger = makeLogger("test", "text").with({ step: "a" });
+  // Act
+  logger.error("something failed");
+  // Assert
+  expect(mockedConsoleError.mock.calls).toEqual([
+    ["ERROR at test:", "something failed", 'step="a"'],
+  ]);
+});
+
+test("@standalone Payloads are truncated for logging", () => {
+  expect(truncatePayload({ a: 1 })).toEqual('{"a":1}');
+  expect(truncatePayload("abcdef", 4)).toEqual('"abc...');
+  expect(truncatePayload(undefined)).toEqual("undefined");
+});
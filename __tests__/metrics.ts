@@ -0,0 +1,63 @@
+import { AsyncQueue, flatMap } from "../src/async-queue";
+import { make as makeEvent, Event } from "../src/event";
+import { axiosInstance } from "../src/io/axios";
+import { startExposingMetrics } from "../src/metrics";
+import { run } from "../src/pipeline";
+import { makeWindowed } from "../src/step";
+import { resolveAfter } from "../src/utils";
+import { consume } from "./test-utils";
+
+test("@standalone Metrics are exposed and updated by the pipeline", async () => {
+  // Arrange
+  const stopExposingMetrics = startExposingMetrics(30031, "127.0.0.1");
+  const pipeline = await run({
+    name: "test",
+    steps: [
+      {
+        name: "metrics-test-step",
+        after: [],
+        factory: makeWindowed(
+          {
+            name: "metrics-test-step",
+            windowMaxSize: 1,
+            patternMode: "pass",
+            functionMode: "flatmap",
+          },
+          flatMap(
+            async (events: Event[]) => events,
+            new AsyncQueue<Event[]>("metrics-test").asChannel()
+          )
+        ),
+      },
+    ],
+  });
+  const trace = [{ i: 1, p: "test", h: "irrelevant" }];
+  const events = [
+    await makeEvent("metrics.a", 1, trace),
+    await makeEvent("metrics.b", 2, trace),
+    await makeEvent("other", 3, trace),
+  ];
+  // Act
+  pipeline.send(...events);
+  await Promise.all([
+    consume(pipeline.receive),
+    resolveAfter(10).then(() => pipeline.close()),
+  ]);
+  const response = await axiosInstance.get("http://127.0.0.1:30031/metrics");
+  await stopExposingMetrics();
+  // Assert
+  expect(response.status).toEqual(200);
+  const lines: string[] = response.data.split("\n");
+  expect(lines).toContain(
+    'cdp_step_events_total{step="metrics-test-step",flow="in"} 3'
+  );
+  expect(lines).toContain(
+    'cdp_step_events_total{step="metrics-test-step",flow="out"} 3'
+  );
+  expect(lines).toContain(
+    'cdp_step_latency_seconds_count{step="metrics-test-step",prefix="metrics"} 2'
+  );
+  expect(lines).toContain(
+    'cdp_step_latency_seconds_count{step="metrics-test-step",prefix="other"} 1'
+  );
+});
@@ -56,3 +56,133 @@ test("@standalone Complex composite patterns work properly", () => {
   ).toBe(true);
   expect(pattern.match("foo.bar.baz", { and: ["#.baz", "foo.#"] })).toBe(true);
 });
+
+test("@standalone Alternation patterns can be checked for validity", () => {
+  expect(pattern.isValidPattern("orders.{created,updated}.#")).toBe(true);
+  expect(pattern.isValidPattern("{orders}.*")).toBe(true);
+  expect(pattern.isValidPattern("orders.{}")).toBe(false);
+  expect(pattern.isValidPattern("orders.{created,}")).toBe(false);
+  expect(pattern.isValidPattern("orders.{created,*}")).toBe(false);
+  expect(pattern.isValidPattern("orders.x{created,updated}")).toBe(false);
+  expect(pattern.isValidPattern("orders.{created,updated")).toBe(false);
+  expect(pattern.isValidPattern("orders,created")).toBe(false);
+});
+
+test("@standalone Alternation pattern matches any alternative at the start", () => {
+  expect(pattern.match("orders.created", "{orders,payments}.created")).toBe(
+    true
+  );
+  expect(pattern.match("payments.created", "{orders,payments}.created")).toBe(
+    true
+  );
+  expect(pattern.match("refunds.created", "{orders,payments}.created")).toBe(
+    false
+  );
+});
+
+test("@standalone Alternation pattern matches any alternative in the middle", () => {
+  expect(
+    pattern.match("orders.created.eu", "orders.{created,updated}.eu")
+  ).toBe(true);
+  expect(
+    pattern.match("orders.updated.eu", "orders.{created,updated}.eu")
+  ).toBe(true);
+  expect(
+    pattern.match("orders.deleted.eu", "orders.{created,updated}.eu")
+  ).toBe(false);
+});
+
+test("@standalone Alternation pattern matches exactly one word", () => {
+  expect(pattern.match("orders", "orders.{created,updated}")).toBe(false);
+  expect(
+    pattern.match("orders.created.updated", "orders.{created,updated}")
+  ).toBe(false);
+});
+
+test("@standalone Alternation pattern composes with wildcards", () => {
+  expect(pattern.match("orders.created", "orders.{created,updated}.#")).toBe(
+    true
+  );
+  expect(
+    pattern.match("orders.updated.eu.big", "orders.{created,updated}.#")
+  ).toBe(true);
+  expect(pattern.match("orders.eu.updated", "#.{created,updated}")).toBe(true);
+  expect(pattern.match("orders.eu.deleted", "#.{created,updated}")).toBe(false);
+  expect(pattern.match("orders.eu.created", "*.{eu,us}.*")).toBe(true);
+  expect(pattern.match("orders.asia.created", "*.{eu,us}.*")).toBe(false);
+  expect(pattern.match("orders.created", "{orders,payments}.*")).toBe(true);
+});
+
+test("@standalone Include-exclude patterns can be checked for validity", () => {
+  expect(
+    pattern.isValidPattern({ include: "logs.#", exclude: "logs.debug.#" })
+  ).toBe(true);
+  expect(
+    pattern.isValidPattern({
+      include: ["logs.#", "audit.*"],
+      exclude: [{ or: ["logs.debug.#", "logs.trace.#"] }],
+    })
+  ).toBe(true);
+  expect(pattern.isValidPattern({ include: "logs.#" })).toBe(false);
+  expect(
+    pattern.isValidPattern({ include: "logs.#", exclude: ["logs..debug"] })
+  ).toBe(false);
+});
+
+test("@standalone Include-exclude patterns exclude after including", () => {
+  const p = { include: "logs.#", exclude: "logs.debug.#" };
+  expect(pattern.match("logs", p)).toBe(true);
+  expect(pattern.match("logs.info.api", p)).toBe(true);
+  expect(pattern.match("logs.debug", p)).toBe(false);
+  expect(pattern.match("logs.debug.api", p)).toBe(false);
+  expect(pattern.match("metrics.debug", p)).toBe(false);
+});
+
+test("@standalone Include-exclude patterns combine several wildcards", () => {
+  const p = {
+    include: ["logs.#", "*.audit"],
+    exclude: ["#.debug.*", "billing.*"],
+  };
+  expect(pattern.match("logs.api.error", p)).toBe(true);
+  expect(pattern.match("users.audit", p)).toBe(true);
+  expect(pattern.match("logs.api.debug.verbose", p)).toBe(false);
+  expect(pattern.match("billing.audit", p)).toBe(false);
+  expect(pattern.match("logs.api.debug", p)).toBe(true);
+  expect(pattern.match("users.audit.extra", p)).toBe(false);
+});
+
+test("@standalone Patterns are case-sensitive by default", () => {
+  expect(pattern.match("Orders.Created", "orders.created")).toBe(false);
+  expect(pattern.match("orders.created", "Orders.*")).toBe(false);
+});
+
+test("@standalone Ignore-case patterns match regardless of casing", () => {
+  expect(pattern.isValidPattern({ "ignore-case": "Orders.#" })).toBe(true);
+  expect(pattern.isValidPattern({ "ignore-case": "Orders..x" })).toBe(false);
+  expect(
+    pattern.match("Orders.Created", { "ignore-case": "orders.created" })
+  ).toBe(true);
+  expect(
+    pattern.match("orders.CREATED.eu", {
+      "ignore-case": "Orders.{Created,Updated}.#",
+    })
+  ).toBe(true);
+  expect(
+    pattern.match("ORDERS.Deleted", { "ignore-case": "orders.created" })
+  ).toBe(false);
+  expect(
+    pattern.match("Logs.Debug.Api", {
+      "ignore-case": { include: "logs.#", exclude: "logs.debug.#" },
+    })
+  ).toBe(false);
+  expect(
+    pattern.match("Orders.Created", {
+      and: [{ "ignore-case": "orders.*" }, "*.Created"],
+    })
+  ).toBe(true);
+  expect(
+    pattern.match("Orders.created", {
+      and: [{ "ignore-case": "orders.*" }, "*.Created"],
+    })
+  ).toBe(false);
+});
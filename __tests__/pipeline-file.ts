@@ -0,0 +1,113 @@
+import fs from "fs";
+import path from "path";
+import { readPipelineFile } from "../src/pipeline-file";
+
+let tmpDir = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  tmpDir = fs.mkdtempSync("/tmp/cdp-tests-");
+});
+
+afterEach(() => {
+  fs.rmSync(tmpDir, { recursive: true, force: true });
+});
+
+const write = (name: string, contents: string): string => {
+  const file = path.join(tmpDir, name);
+  fs.mkdirSync(path.dirname(file), { recursive: true });
+  fs.writeFileSync(file, contents);
+  return file;
+};
+
+test("@standalone Pipeline files merge their includes and documents", () => {
+  // Arrange
+  write(
+    "lib/common.yaml",
+    [
+      'jq-prelude: "def id: .;"',
+      "steps:",
+      "  normalize:",
+      "    flatmap:",
+      "      keep: 1",
+    ].join("\n")
+  );
+  write(
+    "lib/outputs.yaml",
+    [
+      "include: common.yaml",
+      "steps:",
+      "  print:",
+      "    after: [normalize]",
+      "    flatmap:",
+      "      send-stdout:",
+    ].join("\n")
+  );
+  const file = write(
+    "pipeline.yaml",
+    [
+      "name: pipe",
+      "include:",
+      "  - lib/outputs.yaml",
+      "  - lib/common.yaml",
+      "input:",
+      "  stdin:",
+      "---",
+      "steps:",
+      "  archive:",
+      "    after: [normalize]",
+      "    flatmap:",
+      "      send-file: ${env:ARCHIVE}",
+    ].join("\n")
+  );
+  // Act
+  const pipeline = readPipelineFile(file);
+  // Assert
+  expect(pipeline).toEqual({
+    "jq-prelude": "def id: .;",
+    name: "pipe",
+    input: { stdin: null },
+    steps: {
+      normalize: { flatmap: { keep: 1 } },
+      print: { after: ["normalize"], flatmap: { "send-stdout": null } },
+      archive: {
+        after: ["normalize"],
+        flatmap: { "send-file": "${env:ARCHIVE}" },
+      },
+    },
+  });
+  expect(Object.keys((pipeline as { steps: object }).steps)).toEqual([
+    "normalize",
+    "print",
+    "archive",
+  ]);
+});
+
+test("@standalone Pipeline files can't redefine steps or keys", () => {
+  // Arrange
+  write("steps.yaml", "steps:\n  print:\n    flatmap:\n      send-stdout:\n");
+  const redefinedStep = write(
+    "step.yaml",
+    "include: steps.yaml\nsteps:\n  print:\n    flatmap:\n      keep: 1\n"
+  );
+  const redefinedKey = write(
+    "key.yaml",
+    "name: pipe\ninput:\n  stdin:\n---\nname: other\n"
+  );
+  // Act & Assert
+  expect(() => readPipelineFile(redefinedStep)).toThrow(
+    `step 'print' is defined in both ${path.join(tmpDir, "steps.yaml")}`
+  );
+  expect(() => readPipelineFile(redefinedKey)).toThrow(
+    `'name' is defined more than once in ${redefinedKey}`
+  );
+});
+
+test("@standalone Pipeline files can't include each other in a cycle", () => {
+  // Arrange
+  const first = write("first.yaml", "include: second.yaml\nname: pipe\n");
+  const second = write("second.yaml", "include: [first.yaml]\n");
+  // Act & Assert
+  expect(() => readPipelineFile(first)).toThrow(
+    `include cycle: ${first} -> ${second} -> ${first}`
+  );
+});
@@ -1,11 +1,137 @@
-import { AsyncQueue, drain } from "../src/async-queue";
-import { Event } from "../src/event";
-import { INPUT_ALIAS, validate } from "../src/pipeline";
+import { AsyncQueue, drain, flatMap } from "../src/async-queue";
+import { make as makeEvent, makeFrom, Event } from "../src/event";
+import { INPUT_ALIAS, validate, run } from "../src/pipeline";
+import { StepFactory, makePartitioned, makeWindowed } from "../src/step";
+import { resolveAfter } from "../src/utils";
+import { consume } from "./test-utils";
 
 // This mock is used to prepare dummy pipelines.
 const dummyStepFactory = async () =>
   drain(new AsyncQueue<Event>().asChannel(), () => Promise.resolve());
 
+// This mock is used to prepare steps that append a suffix to the
+// name of each event, counting the times they're started.
+const suffixStep = (suffix: string, starts: string[]) => {
+  const factory = makeWindowed(
+    {
+      name: suffix,
+      windowMaxSize: 1,
+      patternMode: "pass",
+      functionMode: "flatmap",
+    },
+    flatMap(
+      async (events: Event[]) =>
+        Promise.all(
+          events.map((event) =>
+            makeFrom(event, { name: `${event.name}.${suffix}` })
+          )
+        ),
+      new AsyncQueue<Event[]>(`pipeline-test.${suffix}`).asChannel()
+    )
+  );
+  return (send: (...events: Event[]) => void) => {
+    starts.push(suffix);
+    return factory(send);
+  };
+};
+
+// This mock is used to prepare steps partitioned in lanes by the
+// `tenant` key of each event's data, which emit three parts for each
+// event named `order.placed`, taking a variable time to do so, and
+// forward the rest of the events.
+const fanOutStep =
+  (name: string, lanes: number): StepFactory =>
+  (send) => {
+    const keys = new AsyncQueue<unknown>(`pipeline-test.${name}.keys`);
+    const extractor = {
+      send: (...vectors: Event[][]) =>
+        vectors.every((events) =>
+          keys.push(
+            events.map((event) => [(event.data as { tenant: string }).tenant])
+          )
+        ),
+      receive: keys.iterator(),
+      close: async () => keys.close(),
+    };
+    return makePartitioned(name, { lanes, extractor }, async () =>
+      makeWindowed(
+        {
+          name,
+          windowMaxSize: 1,
+          pattern: "order.placed",
+          patternMode: "pass",
+          functionMode: "flatmap",
+        },
+        flatMap(async (events: Event[]) => {
+          await resolveAfter(Math.random() * 3);
+          return Promise.all(
+            events.flatMap((event) =>
+              [0, 1, 2].map((part) =>
+                makeFrom(event, {
+                  name: "order.part",
+                  data: { ...(event.data as object), part },
+                })
+              )
+            )
+          );
+        }, new AsyncQueue<Event[]>(`step.${name}.fn`).asChannel())
+      )
+    )(send);
+  };
+
+/**
+ * Send events through a pipeline made of a single fan-out step,
+ * interleaving events that the step forwards, and return the data of
+ * the events that leave the pipeline.
+ */
+const runFanOut = async (
+  lanes: number,
+  tenants: number,
+  count: number
+): Promise<{ tenant: number; index: number; part?: number }[]> => {
+  const trace = [{ i: new Date().getTime() / 1000, p: "test", h: "test" }];
+  const pipeline = await run({
+    name: "Test",
+    steps: [
+      { name: "fan-out", after: [], factory: fanOutStep("fan-out", lanes) },
+    ],
+  });
+  const output = consume(pipeline.receive);
+  for (let index = 0; index < count; index++) {
+    pipeline.send(
+      await makeEvent(
+        Math.random() < 0.5 ? "order.placed" : "note.added",
+        { tenant: index % tenants, index },
+        trace
+      )
+    );
+    if (index % 10 === 0) {
+      await resolveAfter(1);
+    }
+  }
+  await resolveAfter(10);
+  await pipeline.close();
+  return (await output).map(
+    (event) => event.data as { tenant: number; index: number; part?: number }
+  );
+};
+
+/**
+ * Get the order in which events should leave a fan-out step: the
+ * parts of each event in order, or the event itself if it was
+ * forwarded, in the order the events were received.
+ */
+const expectedOrder = (
+  data: { index: number; part?: number }[]
+): [number, number | null][] =>
+  Array.from(new Set(data.map(({ index }) => index)))
+    .sort((a, b) => a - b)
+    .flatMap((index) =>
+      data.some((d) => d.index === index && typeof d.part === "number")
+        ? [0, 1, 2].map((part): [number, number | null] => [index, part])
+        : [[index, null] as [number, number | null]]
+    );
+
 // Tests start here.
 
 test("@standalone Pipeline validation detects usage of the reserved step name", () => {
@@ -166,3 +292,177 @@ test("@standalone Pipeline validation accepts shared dependencies", () => {
   // Act & assert
   expect(() => validate(pipeline)).not.toThrow();
 });
+
+test("@standalone Pipeline reconfiguration keeps unchanged steps running", async () => {
+  // Arrange
+  const starts: string[] = [];
+  const trace = [{ i: new Date().getTime() / 1000, p: "test", h: "test" }];
+  const twoSteps = {
+    name: "Test",
+    steps: [
+      {
+        name: "a",
+        after: [],
+        factory: suffixStep("a", starts),
+        signature: "a",
+      },
+      {
+        name: "b",
+        after: ["a"],
+        factory: suffixStep("b", starts),
+        signature: "b",
+      },
+    ],
+  };
+  const threeSteps = {
+    name: "Test",
+    steps: [
+      ...twoSteps.steps,
+      {
+        name: "c",
+        after: ["b"],
+        factory: suffixStep("c", starts),
+        signature: "c",
+      },
+    ],
+  };
+  const pipeline = await run(twoSteps);
+  const output = consume(pipeline.receive);
+  // Act
+  for (let i = 0; i < 50; i++) {
+    pipeline.send(await makeEvent("e", i, trace));
+  }
+  await pipeline.reconfigure(threeSteps);
+  for (let i = 50; i < 100; i++) {
+    pipeline.send(await makeEvent("e", i, trace));
+  }
+  await resolveAfter(10);
+  await pipeline.close();
+  const events = await output;
+  // Assert
+  expect(starts).toEqual(["a", "b", "c"]);
+  expect(events).toHaveLength(100);
+  expect(
+    events.every((event) => /^e\.a\.b(\.c)?$/.test(event.name))
+  ).toBe(true);
+  expect(
+    events
+      .filter((event) => (event.data as number) >= 50)
+      .every((event) => event.name === "e.a.b.c")
+  ).toBe(true);
+});
+
+test("@standalone Pipeline reconfiguration replaces changed steps", async () => {
+  // Arrange
+  const starts: string[] = [];
+  const trace = [{ i: new Date().getTime() / 1000, p: "test", h: "test" }];
+  const pipeline = await run({
+    name: "Test",
+    steps: [
+      {
+        name: "a",
+        after: [],
+        factory: suffixStep("a", starts),
+        signature: "a",
+      },
+      {
+        name: "b",
+        after: ["a"],
+        factory: suffixStep("b", starts),
+        signature: "b",
+      },
+    ],
+  });
+  const output = consume(pipeline.receive);
+  // Act
+  await pipeline.reconfigure({
+    name: "Test",
+    steps: [
+      {
+        name: "a",
+        after: [],
+        factory: suffixStep("a", starts),
+        signature: "a",
+      },
+      {
+        name: "b",
+        after: ["a"],
+        factory: suffixStep("x", starts),
+        signature: "x",
+      },
+    ],
+  });
+  pipeline.send(await makeEvent("e", 1, trace));
+  await resolveAfter(10);
+  await pipeline.close();
+  const events = await output;
+  // Assert
+  expect(starts).toEqual(["a", "b", "x"]);
+  expect(events.map((event) => event.name)).toEqual(["e.a.x"]);
+});
+
+test("@standalone Pipeline reconfiguration keeps the running pipeline when the new one is improper", async () => {
+  // Arrange
+  const starts: string[] = [];
+  const trace = [{ i: new Date().getTime() / 1000, p: "test", h: "test" }];
+  const pipeline = await run({
+    name: "Test",
+    steps: [
+      {
+        name: "a",
+        after: [],
+        factory: suffixStep("a", starts),
+        signature: "a",
+      },
+    ],
+  });
+  const output = consume(pipeline.receive);
+  // Act
+  const reconfigured = pipeline.reconfigure({
+    name: "Test",
+    steps: [
+      {
+        name: "b",
+        after: ["c"],
+        factory: suffixStep("b", starts),
+        signature: "b",
+      },
+    ],
+  });
+  // Assert
+  await expect(reconfigured).rejects.toThrow("dangling dependency");
+  pipeline.send(await makeEvent("e", 1, trace));
+  await resolveAfter(10);
+  await pipeline.close();
+  expect(starts).toEqual(["a"]);
+  expect((await output).map((event) => event.name)).toEqual(["e.a"]);
+});
+
+test("@standalone A fan-out step keeps the order of the events it emits and forwards", async () => {
+  // Act
+  const data = await runFanOut(1, 1, 200);
+  // Assert
+  expect(
+    data.map(({ index, part }): [number, number | null] => [
+      index,
+      part ?? null,
+    ])
+  ).toEqual(expectedOrder(data));
+  expect(new Set(data.map(({ index }) => index)).size).toEqual(200);
+});
+
+test("@standalone A fan-out step partitioned in many lanes keeps the order of the events of each key", async () => {
+  // Act
+  const data = await runFanOut(16, 40, 1000);
+  // Assert
+  expect(new Set(data.map(({ index }) => index)).size).toEqual(1000);
+  for (let tenant = 0; tenant < 40; tenant++) {
+    const ofTenant = data.filter((d) => d.tenant === tenant);
+    expect(
+      ofTenant.map(({ index, part }): [number, number | null] => [
+        index,
+        part ?? null,
+      ])
+    ).toEqual(expectedOrder(ofTenant));
+  }
+});
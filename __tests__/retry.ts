@@ -0,0 +1,117 @@
+import { make as makeEvent, Event } from "../src/event";
+import { backoff, makeRetrier } from "../src/retry";
+import { resolveAfter } from "../src/utils";
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * A fake output that fails the given amount of times before
+ * succeeding, recording the time of each attempt.
+ */
+const makeFlakyOutput = (failures: number) => {
+  const attempts: number[] = [];
+  return {
+    attempts,
+    attempt: async () => {
+      attempts.push(new Date().getTime());
+      if (attempts.length <= failures) {
+        throw new Error(`failure #${attempts.length}`);
+      }
+    },
+  };
+};
+
+test("@standalone Backoff grows exponentially up to the maximum delay", () => {
+  expect([1, 2, 3, 4, 5].map((n) => backoff(n, 100, 2, 1000, 0))).toEqual([
+    100, 200, 400, 800, 1000,
+  ]);
+  for (let i = 0; i < 100; i++) {
+    const t = backoff(3, 100, 2, 1000, 0.5);
+    expect(t).toBeGreaterThanOrEqual(200);
+    expect(t).toBeLessThanOrEqual(400);
+  }
+});
+
+test("@standalone Retrier retries failed deliveries with backoff", async () => {
+  // Arrange
+  const output = makeFlakyOutput(2);
+  const retrier = makeRetrier("irrelevant", {
+    attempts: 5,
+    delay: 0.05,
+    multiplier: 2,
+  });
+  const start = new Date().getTime();
+  // Act
+  await retrier.run([], output.attempt);
+  // Assert
+  expect(output.attempts).toHaveLength(3);
+  // Timers may fire slightly early, so a millisecond of slack is
+  // given to the lower bounds.
+  expect(output.attempts[1] - output.attempts[0]).toBeGreaterThanOrEqual(49);
+  expect(output.attempts[2] - output.attempts[1]).toBeGreaterThanOrEqual(99);
+  expect(new Date().getTime() - start).toBeLessThan(1000);
+});
+
+test("@standalone Retrier dead-letters events after exhausting attempts", async () => {
+  // Arrange
+  const output = makeFlakyOutput(Infinity);
+  const failures: [Event[], unknown][] = [];
+  const retrier = makeRetrier(
+    "irrelevant",
+    { attempts: "3", delay: "0.01", "on-exhausted": "dead-letter" },
+    async (events, error) => {
+      failures.push([events, error]);
+    }
+  );
+  const events = [await makeEvent("a", 1, trace)];
+  // Act
+  await retrier.run(events, output.attempt);
+  // Assert
+  expect(output.attempts).toHaveLength(3);
+  expect(failures).toHaveLength(1);
+  expect(failures[0][0]).toEqual(events);
+  expect((failures[0][1] as Error).message).toEqual("failure #3");
+});
+
+test("@standalone Retrier drops events after exhausting attempts by default", async () => {
+  // Arrange
+  const output = makeFlakyOutput(Infinity);
+  const failures: Event[][] = [];
+  const retrier = makeRetrier(
+    "irrelevant",
+    { attempts: 2, delay: 0.01 },
+    async (events) => {
+      failures.push(events);
+    }
+  );
+  // Act
+  await retrier.run([await makeEvent("a", 1, trace)], output.attempt);
+  // Assert
+  expect(output.attempts).toHaveLength(2);
+  expect(failures).toEqual([]);
+});
+
+test("@standalone Retrier makes a single attempt without options", async () => {
+  // Arrange
+  const output = makeFlakyOutput(1);
+  const retrier = makeRetrier("irrelevant");
+  // Act
+  await retrier.run([], output.attempt);
+  // Assert
+  expect(output.attempts).toHaveLength(1);
+});
+
+test("@standalone Retrier delays are cut short when stopped", async () => {
+  // Arrange
+  const output = makeFlakyOutput(Infinity);
+  const retrier = makeRetrier("irrelevant", { attempts: 10, delay: 60 });
+  const start = new Date().getTime();
+  // Act
+  await Promise.all([
+    retrier.run([], output.attempt),
+    resolveAfter(50).then(() => retrier.stop()),
+  ]);
+  // Assert
+  expect(output.attempts).toHaveLength(1);
+  expect(new Date().getTime() - start).toBeLessThan(1000);
+});
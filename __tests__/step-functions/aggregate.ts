@@ -0,0 +1,82 @@
+import { make as makeEvent } from "../../src/event";
+import { resolveAfter } from "../../src/utils";
+import { make } from "../../src/step-functions/aggregate";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Aggregate counts and sums by key in tumbling intervals", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    interval: 0.3,
+    "key-jq-expr": ".d.k",
+    aggregations: { n: "count", total: { sum: ".d.v" } },
+  });
+  // Act
+  channel.send([
+    await makeEvent("a", { k: "x", v: 1 }, trace),
+    await makeEvent("a", { k: "y", v: 2 }, trace),
+    await makeEvent("a", { k: "x", v: 3 }, trace),
+  ]);
+  const outputPromise = consume(channel.receive);
+  await resolveAfter(450);
+  channel.send([
+    await makeEvent("a", { k: "x", v: 10 }, trace),
+    await makeEvent("a", { k: "x", v: "not a number" }, trace),
+  ]);
+  await resolveAfter(300);
+  await channel.close();
+  const output = await outputPromise;
+  // Assert
+  expect(
+    output.map((e) => {
+      const { key, aggregates } = e.data as Record<string, unknown>;
+      return [e.name, key, aggregates];
+    })
+  ).toEqual([
+    ["a.aggregate", "x", { n: 2, total: 4 }],
+    ["a.aggregate", "y", { n: 1, total: 2 }],
+    ["a.aggregate", "x", { n: 2, total: 10 }],
+  ]);
+});
+
+test("@standalone Aggregate keeps accumulating in cumulative mode", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    interval: 0.3,
+    mode: "cumulative",
+    "key-jq-expr": ".d.k",
+    aggregations: {
+      n: "count",
+      total: { sum: ".d.v" },
+      lowest: { min: ".d.v" },
+      average: { avg: ".d.v" },
+    },
+  });
+  // Act
+  channel.send([
+    await makeEvent("a", { k: "x", v: 1 }, trace),
+    await makeEvent("a", { k: "x", v: 3 }, trace),
+  ]);
+  const outputPromise = consume(channel.receive);
+  await resolveAfter(450);
+  channel.send([await makeEvent("a", { k: "x", v: 8 }, trace)]);
+  await resolveAfter(300);
+  await channel.close();
+  const output = await outputPromise;
+  // Assert
+  expect(
+    output.map((e) => (e.data as { aggregates: unknown }).aggregates)
+  ).toEqual([
+    { n: 2, total: 4, lowest: 1, average: 2 },
+    { n: 3, total: 12, lowest: 1, average: 4 },
+    // The close of the step flushes the groups once more.
+    { n: 3, total: 12, lowest: 1, average: 4 },
+  ]);
+});
@@ -0,0 +1,97 @@
+import { make as makeEvent } from "../../src/event";
+import { resolveAfter } from "../../src/utils";
+import { make } from "../../src/step-functions/batch";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Batch flushes batches when they reach their size", async () => {
+  // Arrange
+  const channel = await make(testParams, { size: 2, name: "bulk" });
+  const events = await Promise.all(
+    [1, 2, 3, 4].map((n) => makeEvent("a", n, trace))
+  );
+  // Act
+  channel.send(events);
+  const first = await channel.receive.next();
+  const second = await channel.receive.next();
+  const [rest] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(first.done).toEqual(false);
+  expect(second.done).toEqual(false);
+  expect([first.value, second.value].map((e) => [e.name, e.data])).toEqual([
+    ["bulk", [1, 2]],
+    ["bulk", [3, 4]],
+  ]);
+  expect(rest).toEqual([]);
+});
+
+test("@standalone Batch with a size of 1 passes events through", async () => {
+  // Arrange
+  const channel = await make(testParams, { size: 1 });
+  const events = await Promise.all(
+    [1, 2, 3].map((n) => makeEvent("a", n, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["batch", [1]],
+    ["batch", [2]],
+    ["batch", [3]],
+  ]);
+});
+
+test("@standalone Batch flushes batches when they reach their max age", async () => {
+  // Arrange
+  const channel = await make(testParams, { size: 100, "max-age": 0.1 });
+  // Act
+  channel.send([
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+  ]);
+  const first = await channel.receive.next();
+  channel.send([await makeEvent("a", 3, trace)]);
+  const start = new Date().getTime();
+  const second = await channel.receive.next();
+  const elapsed = new Date().getTime() - start;
+  const [rest] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(first.value.data).toEqual([1, 2]);
+  expect(second.value.data).toEqual([3]);
+  // The timer is reset after each flush.
+  expect(elapsed).toBeGreaterThanOrEqual(90);
+  expect(rest).toEqual([]);
+});
+
+test("@standalone Batch flushes the partial batch on shutdown", async () => {
+  // Arrange
+  const channel = await make(testParams, { size: 100, "max-age": 60 });
+  const events = await Promise.all(
+    [1, 2, 3].map((n) => makeEvent("a", n, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(50).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([[1, 2, 3]]);
+});
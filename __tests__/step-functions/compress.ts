@@ -0,0 +1,64 @@
+import { gunzipSync } from "zlib";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/compress";
+import { make as makeDecompress } from "../../src/step-functions/decompress";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Compress gzips event data as base64 by default", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  // Act
+  channel.send([await makeEvent("a", { key: "value" }, trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toHaveLength(1);
+  expect(output[0].name).toEqual("a");
+  expect(
+    JSON.parse(gunzipSync(Buffer.from(output[0].data, "base64")).toString())
+  ).toEqual({ key: "value" });
+});
+
+test("@standalone Compress and decompress round-trip event data", async () => {
+  for (const algorithm of ["gzip", "zstd"] as const) {
+    for (const encoding of ["base64", "raw"] as const) {
+      // Arrange
+      const compressChannel = await make(testParams, { algorithm, encoding });
+      const decompressChannel = await makeDecompress(testParams, {
+        encoding,
+      });
+      const data = [
+        { nested: { list: [1, 2, 3] }, text: "ünïcödé" },
+        "a string",
+        42,
+        null,
+      ];
+      // Act
+      compressChannel.send(
+        await Promise.all(data.map((d) => makeEvent("a", d, trace)))
+      );
+      const [compressed] = await Promise.all([
+        consume(compressChannel.receive),
+        compressChannel.close(),
+      ]);
+      decompressChannel.send(compressed);
+      const [output] = await Promise.all([
+        consume(decompressChannel.receive),
+        decompressChannel.close(),
+      ]);
+      // Assert
+      expect(compressed.every((e) => typeof e.data === "string")).toBe(true);
+      expect(output.map((e) => e.data)).toEqual(data);
+    }
+  }
+});
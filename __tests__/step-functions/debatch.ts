@@ -0,0 +1,97 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/debatch";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Debatch splits arrays in one event per element", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  // Act
+  channel.send([
+    await makeEvent("a", [1, null, { key: "value" }], trace),
+    await makeEvent("b", [[2]], trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a", 1],
+    ["a", null],
+    ["a", { key: "value" }],
+    ["b", [2]],
+  ]);
+  expect(output.every((e) => e.trace === trace)).toBe(true);
+});
+
+test("@standalone Debatch splits NDJSON strings and indexes records", async () => {
+  // Arrange
+  const channel = await make(testParams, { index: "true" });
+  // Act
+  channel.send([await makeEvent("a", '{"n":1}\n\n"two"\r\n3\n', trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a", { index: 0, value: { n: 1 } }],
+    ["a", { index: 1, value: "two" }],
+    ["a", { index: 2, value: 3 }],
+  ]);
+});
+
+test("@standalone Debatch emits nothing for empty batches", async () => {
+  // Arrange
+  const channel = await make(testParams, { index: true });
+  // Act
+  channel.send([
+    await makeEvent("a", [], trace),
+    await makeEvent("a", "", trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual([]);
+});
+
+test("@standalone Debatch reports events that can't be split as failures", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { "on-error": "dead-letter" }
+  );
+  const events = [
+    await makeEvent("a", { not: "a batch" }, trace),
+    await makeEvent("a", "1\nnot json\n", trace),
+    await makeEvent("a", "1\n2", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2]);
+  expect(failures.map(([failed]) => failed)).toEqual([
+    [events[0]],
+    [events[1]],
+  ]);
+});
@@ -0,0 +1,120 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make } from "../../src/step-functions/decode-avro";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const userSchema = {
+  type: "record",
+  name: "User",
+  namespace: "test",
+  fields: [
+    { name: "name", type: "string" },
+    { name: "age", type: "int" },
+    { name: "email", type: ["null", "string"], default: null },
+  ],
+};
+
+// Users encoded with the schema above, registered with id 1, and
+// framed for the registry.
+const ada = Buffer.from("0000000001064164614800", "hex");
+const bob = Buffer.from("000000000106426f620e020c6240782e696f", "hex");
+
+// Paths requested from the fake registry.
+const requests: string[] = [];
+
+const server = makeHTTPServer(30070, async (ctx) => {
+  requests.push(ctx.request.path);
+  if (ctx.request.path === "/schemas/ids/1") {
+    ctx.body = { schema: JSON.stringify(userSchema) };
+  } else {
+    ctx.status = 404;
+    ctx.body = { error_code: 40403, message: "Schema not found" };
+  }
+});
+
+afterEach(() => {
+  requests.length = 0;
+});
+
+afterAll(() => server.close());
+
+test("@standalone Decode-avro decodes framed payloads with cached schemas", async () => {
+  // Arrange
+  const channel = await make(testParams, "http://127.0.0.1:30070");
+  const events = [
+    await makeEvent("users", ada.toString("base64"), trace),
+    await makeEvent("users", bob.toString("base64"), trace),
+  ];
+  // Act
+  channel.send([events[0]]);
+  channel.send([events[1]]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["users", { name: "Ada", age: 36, email: null }],
+    ["users", { name: "Bob", age: 7, email: "b@x.io" }],
+  ]);
+  expect(requests).toEqual(["/schemas/ids/1"]);
+});
+
+test("@standalone Decode-avro dead-letters undecodable payloads", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      registry: "http://127.0.0.1:30070/",
+      encoding: "raw",
+      "on-error": "dead-letter",
+    }
+  );
+  const unknownSchema = Buffer.from(ada);
+  unknownSchema.writeUInt32BE(2, 1);
+  const events = [
+    await makeEvent("users", ada.toString("latin1"), trace),
+    await makeEvent("users", "not framed", trace),
+    await makeEvent("users", unknownSchema.toString("latin1"), trace),
+    await makeEvent("users", ada.subarray(0, 8).toString("latin1"), trace),
+    await makeEvent("users", { not: "a string" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { name: "Ada", age: 36, email: null },
+  ]);
+  // Events are decoded concurrently, so failures may be reported in
+  // any order.
+  expect(failures).toHaveLength(4);
+  expect(failures.map(([[event]]) => event)).toEqual(
+    expect.arrayContaining(events.slice(1))
+  );
+  expect(failures.map(([, error]) => error)).toEqual(
+    expect.arrayContaining([
+      expect.stringContaining("isn't framed"),
+      expect.stringContaining("404"),
+      expect.stringContaining("truncated"),
+      expect.stringContaining("not a string"),
+    ])
+  );
+});
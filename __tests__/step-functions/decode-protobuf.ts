@@ -0,0 +1,90 @@
+import path from "path";
+import { Event, make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/decode-protobuf";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+// The descriptor set compiled from readings.proto.
+const descriptorSet = path.join(__dirname, "..", "fixtures", "readings.pb");
+
+// A cdp.test.Reading message with a sensor id, a value and a unit.
+const reading = Buffer.from("0a03732d311100000000008035401801", "hex");
+
+test("@standalone Decode-protobuf decodes base64-encoded messages", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "descriptor-set": descriptorSet,
+    "message-type": "cdp.test.Reading",
+  });
+  const event = await makeEvent("readings", reading.toString("base64"), trace);
+  // Act
+  channel.send([event]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["readings", { sensorId: "s-1", value: 21.5, unit: "CELSIUS" }],
+  ]);
+});
+
+test("@standalone Decode-protobuf dead-letters undecodable payloads", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      "descriptor-set": descriptorSet,
+      "message-type": "cdp.test.Reading",
+      "raw-bytes-as-base64": "false",
+      "on-error": "dead-letter",
+    }
+  );
+  const events = [
+    await makeEvent("readings", reading.toString("latin1"), trace),
+    await makeEvent(
+      "readings",
+      reading.subarray(0, 8).toString("latin1"),
+      trace
+    ),
+    await makeEvent("readings", { not: "a string" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { sensorId: "s-1", value: 21.5, unit: "CELSIUS" },
+  ]);
+  expect(failures.map(([[event]]) => event)).toEqual(events.slice(1));
+  expect(failures.map(([, error]) => error)).toEqual([
+    expect.stringContaining("truncated"),
+    expect.stringContaining("not a string"),
+  ]);
+});
+
+test("@standalone Decode-protobuf requires a known message type", async () => {
+  // Act
+  const result = make(testParams, {
+    "descriptor-set": descriptorSet,
+    "message-type": "cdp.test.Missing",
+  });
+  // Assert
+  await expect(result).rejects.toThrow("unknown protobuf message type");
+});
@@ -0,0 +1,74 @@
+import { gzipSync } from "zlib";
+import { Event, make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/decompress";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Decompress detects gzip data", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  const compressed = gzipSync(JSON.stringify({ key: "value" }));
+  // Act
+  channel.send([await makeEvent("a", compressed.toString("base64"), trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a", { key: "value" }],
+  ]);
+});
+
+test("@standalone Decompress drops events that can't be decompressed", async () => {
+  // Arrange
+  const channel = await make(testParams, { algorithm: "gzip" });
+  // Act
+  channel.send([
+    await makeEvent("a", "bm90IGNvbXByZXNzZWQ=", trace),
+    await makeEvent("a", { not: "a string" }, trace),
+    await makeEvent("a", gzipSync("1").toString("base64"), trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1]);
+});
+
+test("@standalone Decompress reports corrupt events as failures", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { "on-error": "dead-letter" }
+  );
+  const corrupt = gzipSync("{}").subarray(0, 12).toString("base64");
+  const events = [
+    await makeEvent("a", corrupt, trace),
+    await makeEvent("a", gzipSync("{}").toString("base64"), trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{}]);
+  expect(failures).toHaveLength(1);
+  expect(failures[0][0]).toEqual([events[0]]);
+});
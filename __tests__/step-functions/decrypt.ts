@@ -0,0 +1,128 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { generateIdentity } from "../../src/io/age";
+import { make as makeEncrypt } from "../../src/step-functions/encrypt";
+import { make, validate } from "../../src/step-functions/decrypt";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const encrypt = async (
+  recipients: string[],
+  events: Event[]
+): Promise<Event[]> => {
+  const channel = await makeEncrypt(testParams, { recipients });
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  return output;
+};
+
+test("@standalone Decrypt recovers the data encrypted by encrypt", async () => {
+  // Arrange
+  const { identity, recipient } = generateIdentity();
+  const events = [
+    await makeEvent("a", { card: "4111 1111 1111 1111" }, trace),
+    await makeEvent("b", "x".repeat(200000), trace),
+    await makeEvent("c", null, trace),
+  ];
+  const encrypted = await encrypt([recipient], events);
+  const channel = await make(testParams, { identities: [identity] });
+  // Act
+  channel.send(encrypted);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(encrypted.map((e) => e.name)).toEqual(["a", "b", "c"]);
+  expect(encrypted[0].data).toEqual(expect.any(String));
+  expect(encrypted[0].data).not.toContain("4111");
+  expect(
+    Buffer.from(encrypted[0].data as string, "base64")
+      .toString("latin1")
+      .startsWith("age-encryption.org/v1\n-> X25519 ")
+  ).toBe(true);
+  expect(output.map((e) => [e.name, e.data])).toEqual(
+    events.map((e) => [e.name, e.data])
+  );
+});
+
+test("@standalone Decrypt accepts any of several identities", async () => {
+  // Arrange
+  const current = generateIdentity();
+  const previous = generateIdentity();
+  const encrypted = [
+    ...(await encrypt([previous.recipient], [await makeEvent("a", 1, trace)])),
+    ...(await encrypt(
+      [generateIdentity().recipient, current.recipient],
+      [await makeEvent("a", 2, trace)]
+    )),
+  ];
+  const channel = await make(testParams, {
+    identities: [current.identity, previous.identity],
+  });
+  // Act
+  channel.send(encrypted);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2]);
+});
+
+test("@standalone Decrypt reports events it can't decrypt as failures", async () => {
+  // Arrange
+  const { recipient } = generateIdentity();
+  const wrong = generateIdentity();
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { identities: [wrong.identity] }
+  );
+  const [encrypted] = await encrypt(
+    [recipient],
+    [await makeEvent("a", { secret: true }, trace)]
+  );
+  const [own] = await encrypt(
+    [wrong.recipient],
+    [await makeEvent("a", { secret: true }, trace)]
+  );
+  const ciphertext = Buffer.from(own.data as string, "base64");
+  ciphertext[ciphertext.length - 1] ^= 1;
+  const tampered = await makeEvent("a", ciphertext.toString("base64"), trace);
+  // Act
+  channel.send([encrypted, own, tampered]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ secret: true }]);
+  expect(failures.map(([events]) => events)).toEqual([[encrypted], [tampered]]);
+  expect(`${failures[0][1]}`).toContain("no identity matched");
+  expect(`${failures[1][1]}`).toContain("tampered with");
+});
+
+test("@standalone Decrypt validation rejects malformed identities", () => {
+  // Act & assert
+  expect(() =>
+    validate("test", { identities: [generateIdentity().identity] })
+  ).not.toThrow();
+  expect(() =>
+    validate("test", { identities: ["AGE-SECRET-KEY-1NOTAKEY"] })
+  ).toThrow("step 'test' uses an invalid identity in decrypt.identities");
+});
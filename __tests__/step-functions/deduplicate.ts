@@ -1,5 +1,6 @@
 import { make as makeEvent } from "../../src/event";
 import { make } from "../../src/step-functions/deduplicate";
+import { resolveAfter } from "../../src/utils";
 import { consume } from "../test-utils";
 
 const testParams = {
@@ -60,3 +61,58 @@ test("@standalone Deduplicate can consider specific parts of events", async () =
   expect(output.map((e) => e.data)).toEqual([3.14, 3.141, 3.1415]);
   expect(output.map((e) => e.name)).toEqual(["a", "c", "h"]);
 });
+
+test("@standalone Deduplicate drops duplicate keys across vectors within the TTL", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "key-jq-expr": ".d.id",
+    ttl: 0.2,
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  // Act
+  channel.send([
+    await makeEvent("a", { id: 1, v: "first" }, trace),
+    await makeEvent("b", { id: 2, v: "first" }, trace),
+  ]);
+  channel.send([
+    await makeEvent("c", { id: 1, v: "second" }, trace),
+    await makeEvent("a", { id: 3, v: "first" }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300)
+      .then(async () =>
+        channel.send([await makeEvent("a", { id: 1, v: "third" }, trace)])
+      )
+      .then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { id: 1, v: "first" },
+    { id: 2, v: "first" },
+    { id: 3, v: "first" },
+    { id: 1, v: "third" },
+  ]);
+});
+
+test("@standalone Deduplicate forgets the least recently seen keys when full", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "key-jq-expr": ".d",
+    ttl: 60,
+    "max-keys": 2,
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  // Act
+  for (const key of ["a", "b", "a", "c", "a", "b", "c"]) {
+    channel.send([await makeEvent("e", key, trace)]);
+  }
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  // 'b' is evicted when 'c' arrives, since 'a' was seen more
+  // recently; keys still remembered are never let through.
+  expect(output.map((e) => e.data)).toEqual(["a", "b", "c", "b", "c"]);
+});
@@ -0,0 +1,169 @@
+import fs from "fs";
+import path from "path";
+import { Event, make as makeEvent } from "../../src/event";
+import { resolveAfter } from "../../src/utils";
+import { make, validate } from "../../src/step-functions/delay";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+let tmpDir = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  tmpDir = fs.mkdtempSync("/tmp/cdp-tests-");
+});
+
+afterEach(() => {
+  fs.rmSync(tmpDir, { recursive: true, force: true });
+});
+
+test("@standalone Delay holds events for a fixed duration", async () => {
+  // Arrange
+  const channel = await make(testParams, { duration: 0.1 });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+  ];
+  const start = new Date().getTime();
+  const elapsed: number[] = [];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    (async () => {
+      const output: Event[] = [];
+      for await (const event of channel.receive) {
+        elapsed.push(new Date().getTime() - start);
+        output.push(event);
+      }
+      return output;
+    })(),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(Math.min(...elapsed)).toBeGreaterThanOrEqual(90);
+  expect(Math.max(...elapsed)).toBeLessThan(250);
+});
+
+test("@standalone Delay releases events in the order of their timestamps", async () => {
+  // Arrange
+  const channel = await make(testParams, { "time-jq-expr": ".d.at" });
+  const now = new Date().getTime() / 1000;
+  const events = await Promise.all(
+    [
+      { i: 1, at: now + 0.15 },
+      { i: 2, at: now + 0.05 },
+      { i: 3, at: now - 60 },
+      { i: 4, at: now + 0.1 },
+      { i: 5, at: now + 0.05 },
+      { i: 6 },
+    ].map((data) => makeEvent("a", data, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(250).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => (e.data as { i: number }).i)).toEqual([
+    6, 3, 2, 5, 4, 1,
+  ]);
+});
+
+test("@standalone Delay flushes held events on shutdown without a store", async () => {
+  // Arrange
+  const channel = await make(testParams, { duration: 60 });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(50).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+});
+
+test("@standalone Delay persists held events across restarts", async () => {
+  // Arrange
+  const options = {
+    "time-jq-expr": ".d.at",
+    store: { file: path.join(tmpDir, "held") },
+  };
+  const now = new Date().getTime() / 1000;
+  const events = await Promise.all(
+    [
+      { i: 1, at: now + 0.2 },
+      { i: 2, at: now + 0.1 },
+    ].map((data) => makeEvent("a", data, trace))
+  );
+  // Act
+  const first = await make(testParams, options);
+  first.send(events);
+  const [beforeRestart] = await Promise.all([
+    consume(first.receive),
+    resolveAfter(50).then(() => first.close()),
+  ]);
+  const second = await make(testParams, options);
+  const [afterRestart] = await Promise.all([
+    consume(second.receive),
+    resolveAfter(300).then(() => second.close()),
+  ]);
+  const third = await make(testParams, options);
+  const [afterRelease] = await Promise.all([
+    consume(third.receive),
+    third.close(),
+  ]);
+  // Assert
+  expect(beforeRestart).toEqual([]);
+  expect(afterRestart.map((e) => e.data)).toEqual([
+    events[1].data,
+    events[0].data,
+  ]);
+  expect(afterRelease).toEqual([]);
+});
+
+test("@standalone Delay reports events that exceed its maximum size", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { duration: 60, "max-size": 2, overflow: "error" }
+  );
+  const events = await Promise.all(
+    [1, 2, 3].map((data) => makeEvent("a", data, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(50).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output).toEqual(events.slice(0, 2));
+  expect(failures).toEqual([[[events[2]], "the step holds 2 events already"]]);
+});
+
+test("@standalone Delay requires exactly one way to compute due times", () => {
+  expect(() => validate("test", { duration: 1 })).not.toThrow();
+  expect(() => validate("test", { "time-jq-expr": ".d.at" })).not.toThrow();
+  expect(() => validate("test", {})).toThrow();
+  expect(() =>
+    validate("test", { duration: 1, "time-jq-expr": ".d.at" })
+  ).toThrow();
+});
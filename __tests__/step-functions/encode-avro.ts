@@ -0,0 +1,126 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make, validate } from "../../src/step-functions/encode-avro";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const userSchema = JSON.stringify({
+  type: "record",
+  name: "User",
+  namespace: "test",
+  fields: [
+    { name: "name", type: "string" },
+    { name: "age", type: "int" },
+    { name: "email", type: ["null", "string"], default: null },
+  ],
+});
+
+// The users below, encoded with the schema above and framed with the
+// schema's id.
+const ada = "0000000007064164614800";
+const bob = "000000000706426f620e020c6240782e696f";
+
+// Paths requested from the fake registry.
+const requests: string[] = [];
+
+const server = makeHTTPServer(30071, async (ctx) => {
+  requests.push(ctx.request.path);
+  if (ctx.request.path === "/subjects/users-value/versions/latest") {
+    ctx.body = {
+      subject: "users-value",
+      version: 3,
+      id: 7,
+      schema: userSchema,
+    };
+  } else if (ctx.request.path === "/schemas/ids/7") {
+    ctx.body = { schema: userSchema };
+  } else {
+    ctx.status = 404;
+  }
+});
+
+afterEach(() => {
+  requests.length = 0;
+});
+
+afterAll(() => server.close());
+
+test("@standalone Encode-avro encodes and frames events with the latest schema", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    registry: "http://127.0.0.1:30071",
+    subject: "users-value",
+  });
+  const events = [
+    await makeEvent("users", { name: "Ada", age: 36 }, trace),
+    await makeEvent("users", { name: "Bob", age: 7, email: "b@x.io" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(
+    output.map((e) => Buffer.from(e.data as string, "base64").toString("hex"))
+  ).toEqual([ada, bob]);
+  expect(requests).toEqual(["/subjects/users-value/versions/latest"]);
+});
+
+test("@standalone Encode-avro dead-letters events that don't match the schema", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      registry: "http://127.0.0.1:30071",
+      "schema-id": 7,
+      encoding: "raw",
+      "on-error": "dead-letter",
+    }
+  );
+  const events = [
+    await makeEvent("users", { name: "Ada", age: 36 }, trace),
+    await makeEvent("users", { name: "Eve", age: "unknown" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(
+    output.map((e) => Buffer.from(e.data as string, "latin1").toString("hex"))
+  ).toEqual([ada]);
+  expect(failures).toEqual([[[events[1]], expect.stringContaining("$.age")]]);
+});
+
+test("@standalone Encode-avro requires a single way to find the schema", () => {
+  const registry = "http://nothing";
+  expect(() => validate("test", { registry, "schema-id": 1 })).not.toThrow();
+  expect(() => validate("test", { registry, subject: "s" })).not.toThrow();
+  expect(() =>
+    validate("test", { registry, subject: "s", version: 2 })
+  ).not.toThrow();
+  expect(() => validate("test", { registry })).toThrow();
+  expect(() =>
+    validate("test", { registry, "schema-id": 1, subject: "s" })
+  ).toThrow();
+  expect(() =>
+    validate("test", { registry, "schema-id": 1, version: 2 })
+  ).toThrow();
+});
@@ -0,0 +1,44 @@
+import { make as makeEvent } from "../../src/event";
+import { generateIdentity } from "../../src/io/age";
+import { make, validate } from "../../src/step-functions/encrypt";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Encrypt replaces data with opaque age files", async () => {
+  // Arrange
+  const { recipient } = generateIdentity();
+  const channel = await make(testParams, { recipients: [recipient] });
+  // Act
+  channel.send([
+    await makeEvent("a", { ssn: "078-05-1120" }, trace),
+    await makeEvent("a", { ssn: "078-05-1120" }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  const files = output.map((e) => Buffer.from(e.data as string, "base64"));
+  const versions = files.map((file) => file.toString("latin1").split("\n")[0]);
+  expect(versions).toEqual(["age-encryption.org/v1", "age-encryption.org/v1"]);
+  expect(files[0].toString("latin1")).not.toContain("078-05-1120");
+  // Each event is encrypted with a fresh file key.
+  expect(files[0].equals(files[1])).toBe(false);
+});
+
+test("@standalone Encrypt validation rejects malformed recipients", () => {
+  // Act & assert
+  expect(() =>
+    validate("test", { recipients: [generateIdentity().recipient] })
+  ).not.toThrow();
+  expect(() => validate("test", { recipients: ["age1notakey"] })).toThrow(
+    "step 'test' uses an invalid recipient in encrypt.recipients: age1notakey"
+  );
+});
@@ -0,0 +1,133 @@
+import { make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make } from "../../src/step-functions/enrich-http";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const requestedPaths: string[] = [];
+
+const server = makeHTTPServer(30030, async (ctx) => {
+  requestedPaths.push(ctx.request.path);
+  if (ctx.request.path.startsWith("/users/")) {
+    ctx.body = { user: ctx.request.path.slice("/users/".length) };
+  } else if (ctx.request.path === "/slow") {
+    await resolveAfter(500);
+    ctx.body = { slow: true };
+  } else {
+    ctx.status = 404;
+    ctx.body = { error: "not found" };
+  }
+});
+
+afterEach(() => {
+  requestedPaths.length = 0;
+});
+
+afterAll(() => server.close());
+
+test("@standalone Enrich-http merges responses in order", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "url-jq-expr": '"http://127.0.0.1:30030/users/\\(.d.id)"',
+    field: "profile",
+    concurrency: 3,
+  });
+  const events = await Promise.all(
+    ["x", "y", "z", "w"].map((id) => makeEvent("a", { id }, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(200).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { id: "x", profile: { user: "x" } },
+    { id: "y", profile: { user: "y" } },
+    { id: "z", profile: { user: "z" } },
+    { id: "w", profile: { user: "w" } },
+  ]);
+});
+
+test("@standalone Enrich-http uses cached responses", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "url-jq-expr": '"http://127.0.0.1:30030/users/\\(.d.id)"',
+    "cache-ttl": 60,
+  });
+  const events = await Promise.all(
+    ["x", "y", "x", "x", "y"].map((id) => makeEvent("a", { id }, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(200).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data.enrichment.user)).toEqual([
+    "x",
+    "y",
+    "x",
+    "x",
+    "y",
+  ]);
+  expect(requestedPaths).toEqual(["/users/x", "/users/y"]);
+});
+
+test("@standalone Enrich-http handles timeouts and non-2xx responses", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "url-jq-expr": '"http://127.0.0.1:30030/\\(.d.path)"',
+    timeout: 0.1,
+    concurrency: 2,
+    "on-error": "rename",
+  });
+  const events = await Promise.all(
+    ["slow", "missing", "users/x"].map((path) =>
+      makeEvent("a", { path }, trace)
+    )
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a.error", { path: "slow" }],
+    ["a.error", { path: "missing" }],
+    ["a", { path: "users/x", enrichment: { user: "x" } }],
+  ]);
+});
+
+test("@standalone Enrich-http can drop events that couldn't be enriched", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "url-jq-expr": '"http://127.0.0.1:30030/\\(.d.path)"',
+    "on-error": "drop",
+  });
+  const events = await Promise.all(
+    ["missing", "users/x"].map((path) => makeEvent("a", { path }, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(200).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { path: "users/x", enrichment: { user: "x" } },
+  ]);
+});
@@ -0,0 +1,81 @@
+import http from "http";
+import axios from "axios";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/expose-sse";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+/**
+ * Subscribe to the given URL, collecting the received SSE frames
+ * until the connection is closed.
+ */
+const subscribe = (url: string): [Promise<void>, Promise<string[]>] => {
+  let notifyConnected: () => void;
+  const connected: Promise<void> = new Promise((resolve) => {
+    notifyConnected = resolve;
+  });
+  const frames: Promise<string[]> = new Promise((resolve, reject) => {
+    http
+      .get(url, (response) => {
+        notifyConnected();
+        let data = "";
+        response.setEncoding("utf8");
+        response.on("data", (chunk) => {
+          data += chunk;
+        });
+        response.on("end", () =>
+          resolve(data.split("\n\n").filter((frame) => frame !== ""))
+        );
+      })
+      .on("error", reject);
+  });
+  return [connected, frames];
+};
+
+test("@standalone Expose-sse works as expected", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    endpoint: "/events",
+    port: 30020,
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("orders.created", 1, trace),
+    await makeEvent("payments.received", 2, trace),
+    await makeEvent("orders.eu.cancelled", 3, trace),
+  ];
+  const [allConnected, allFrames] = subscribe(
+    "http://127.0.0.1:30020/events"
+  );
+  const [ordersConnected, ordersFrames] = subscribe(
+    "http://127.0.0.1:30020/events?match=orders.%23"
+  );
+  await Promise.all([allConnected, ordersConnected]);
+  // Act
+  const invalidResponse = await axios.get(
+    "http://127.0.0.1:30020/events?match=orders..",
+    { validateStatus: null }
+  );
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(invalidResponse.status).toEqual(400);
+  expect(output.map((e) => e.data)).toEqual([1, 2, 3]);
+  expect(await allFrames).toEqual(
+    events.map((e) => `event: ${e.name}\ndata: ${JSON.stringify(e)}`)
+  );
+  expect(await ordersFrames).toEqual(
+    [events[0], events[2]].map(
+      (e) => `event: ${e.name}\ndata: ${JSON.stringify(e)}`
+    )
+  );
+});
@@ -0,0 +1,69 @@
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/flatten";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Flatten joins nested keys", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  // Act
+  channel.send([
+    await makeEvent(
+      "a",
+      { a: { b: 1, c: { d: "x" } }, e: [1, { f: null }], g: {}, h: [] },
+      trace
+    ),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    {
+      "a.b": 1,
+      "a.c.d": "x",
+      "e.0": 1,
+      "e.1.f": null,
+      g: {},
+      h: [],
+    },
+  ]);
+});
+
+test("@standalone Flatten can use a custom separator and keep arrays", async () => {
+  // Arrange
+  const channel = await make(testParams, { separator: "_", arrays: "keep" });
+  // Act
+  channel.send([await makeEvent("a", { a: { b: [1, { c: 2 }] } }, trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ a_b: [1, { c: 2 }] }]);
+});
+
+test("@standalone Flatten drops events with colliding keys", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  // Act
+  channel.send([
+    await makeEvent("a", { "a.b": 1, a: { b: 2 } }, trace),
+    await makeEvent("a", "not an object", trace),
+    await makeEvent("a", { a: { b: 3 } }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ "a.b": 3 }]);
+});
@@ -0,0 +1,106 @@
+import path from "path";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/geoip";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+// The database generated by geoip.py, which holds 81.2.69.0/24 and
+// 2a02:ff00::/32.
+const database = path.join(__dirname, "..", "fixtures", "geoip.mmdb");
+
+test("@standalone Geoip merges the record found for an address", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    database,
+    "ip-jq-expr": ".d.ip",
+  });
+  // Act
+  channel.send([
+    await makeEvent("request", { ip: "81.2.69.160", path: "/" }, trace),
+    await makeEvent("request", { ip: "2a02:ff00::1" }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((event) => event.data)).toEqual([
+    {
+      ip: "81.2.69.160",
+      path: "/",
+      geo: {
+        country: "GB",
+        "country-name": "United Kingdom",
+        city: "London",
+        continent: "EU",
+        location: { latitude: 51.5142, longitude: -0.0931 },
+        asn: 20712,
+        organization: "Andrews & Arnold Ltd",
+      },
+    },
+    {
+      ip: "2a02:ff00::1",
+      geo: {
+        country: "IT",
+        "country-name": "Italy",
+        continent: "EU",
+        location: { latitude: 42.8333, longitude: 12.8333 },
+      },
+    },
+  ]);
+});
+
+test("@standalone Geoip flags private and malformed addresses", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    database,
+    "ip-jq-expr": ".d.ip",
+    target: "location",
+    "miss-key": "unlocated",
+  });
+  // Act
+  channel.send([
+    await makeEvent("request", { ip: "10.0.0.1" }, trace),
+    await makeEvent("request", { ip: "not-an-ip" }, trace),
+    await makeEvent("request", { ip: 42 }, trace),
+    await makeEvent("request", {}, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((event) => event.data)).toEqual([
+    { ip: "10.0.0.1", unlocated: "not-found" },
+    { ip: "not-an-ip", unlocated: "invalid" },
+    { ip: 42, unlocated: "invalid" },
+    { unlocated: "missing" },
+  ]);
+});
+
+test("@standalone Geoip forwards events it can't enrich unchanged", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    database,
+    "ip-jq-expr": ".d.ip",
+  });
+  const events = [
+    await makeEvent("request", { ip: "192.168.1.1" }, trace),
+    await makeEvent("request", "81.2.69.160", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+});
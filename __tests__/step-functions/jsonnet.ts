@@ -0,0 +1,74 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/jsonnet";
+import { consume } from "../test-utils";
+
+const pipelineName = "test";
+const pipelineSignature = "signature";
+const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+
+test("@standalone Jsonnet transforms the data of each event", async () => {
+  // Arrange
+  const channel = await make(
+    { pipelineName, pipelineSignature, stepName: "irrelevant" },
+    {
+      "jsonnet-expr": "function(data, tag) {value: data.value * 2, tag: tag}",
+      concurrency: 2,
+    }
+  );
+  const events = [
+    await makeEvent("a", { value: 1 }, trace),
+    await makeEvent("b", { value: 2 }, trace),
+    await makeEvent("c", { value: 3 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual(["a", "b", "c"]);
+  expect(output.map((e) => e.data)).toEqual([
+    { value: 2, tag: "a" },
+    { value: 4, tag: "b" },
+    { value: 6, tag: "c" },
+  ]);
+});
+
+test("@standalone Jsonnet reports events that fail evaluation", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      pipelineName,
+      pipelineSignature,
+      stepName: "irrelevant",
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    `function(data) if data > 0 then data else error "not positive"`
+  );
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", -1, trace),
+    await makeEvent("a", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2]);
+  expect(failures.map(([events]) => events)).toEqual([[events[1]]]);
+  expect(`${failures[0][1]}`).toContain("not positive");
+});
+
+test("@standalone Jsonnet rejects code that isn't a function", async () => {
+  // Act & assert
+  await expect(
+    make({ pipelineName, pipelineSignature, stepName: "irrelevant" }, "{}")
+  ).rejects.toThrow("not a function");
+});
@@ -0,0 +1,122 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { make, validate } from "../../src/step-functions/lua";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Lua transforms the data of each event", async () => {
+  // Arrange
+  const channel = await make(
+    testParams,
+    "data.fahrenheit = data.celsius * 9 / 5 + 32\n" +
+      "data.source = name\n" +
+      "return data"
+  );
+  // Act
+  channel.send([
+    await makeEvent("a", { celsius: 100 }, trace),
+    await makeEvent("b", { celsius: -40 }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a", { celsius: 100, fahrenheit: 212, source: "a" }],
+    ["b", { celsius: -40, fahrenheit: -40, source: "b" }],
+  ]);
+});
+
+test("@standalone Lua drops events when the script returns nil", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "lua-script": "if data.level == 'debug' then return nil end\nreturn data",
+    concurrency: 2,
+  });
+  // Act
+  channel.send([
+    await makeEvent("log", { level: "debug" }, trace),
+    await makeEvent("log", { level: "error" }, trace),
+    await makeEvent("log", { level: "debug" }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ level: "error" }]);
+});
+
+test("@standalone Lua emits an event for each element of a returned array", async () => {
+  // Arrange
+  const channel = await make(
+    testParams,
+    "local items = {}\n" +
+      "for i, item in ipairs(data.items) do\n" +
+      "  items[i] = {order = data.id, sku = item}\n" +
+      "end\n" +
+      "return items"
+  );
+  // Act
+  channel.send([
+    await makeEvent("order", { id: 1, items: ["x", "y"] }, trace),
+    await makeEvent("order", { id: 2, items: ["z"] }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["order", { order: 1, sku: "x" }],
+    ["order", { order: 1, sku: "y" }],
+    ["order", { order: 2, sku: "z" }],
+  ]);
+});
+
+test("@standalone Lua reports sandbox violations and timeouts as failures", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      "lua-script":
+        "if data == 'shell' then os.execute('touch /tmp/cdp-lua') end\n" +
+        "if data == 'loop' then while true do end end\n" +
+        "return data",
+      "time-limit": 0.1,
+    }
+  );
+  const shell = await makeEvent("a", "shell", trace);
+  const loop = await makeEvent("a", "loop", trace);
+  // Act
+  channel.send([shell, loop, await makeEvent("a", "fine", trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["fine"]);
+  expect(failures.map(([events]) => events)).toEqual([[shell], [loop]]);
+  expect(`${failures[1][1]}`).toContain("exceeded the time limit");
+});
+
+test("@standalone Lua validation rejects scripts with syntax errors", () => {
+  // Act & assert
+  expect(() => validate("test", "return data")).not.toThrow();
+  expect(() => validate("test", { "lua-script": "return (" })).toThrow(
+    "step 'test' uses an invalid lua script"
+  );
+});
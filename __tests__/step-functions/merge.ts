@@ -0,0 +1,68 @@
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/merge";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Merge interleaves two sources into one name", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    sources: ["orders.web", "orders.mobile.#"],
+    name: "orders",
+  });
+  // Act
+  channel.send([await makeEvent("orders.web", 1, trace)]);
+  channel.send([
+    await makeEvent("orders.mobile.ios", 2, trace),
+    await makeEvent("orders.web", 3, trace),
+  ]);
+  channel.send([await makeEvent("users.new", 4, trace)]);
+  channel.send([await makeEvent("orders.mobile.android", 5, trace)]);
+  channel.send([await makeEvent("orders.web", 6, trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["orders", 1],
+    ["orders", 2],
+    ["orders", 3],
+    ["users.new", 4],
+    ["orders", 5],
+    ["orders", 6],
+  ]);
+});
+
+test("@standalone Merge stamps the original name into object data", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    sources: ["a", "b"],
+    name: "merged",
+    "stamp-source": "true",
+  });
+  // Act
+  channel.send([
+    await makeEvent("a", { n: 1 }, trace),
+    await makeEvent("b", { n: 2 }, trace),
+    await makeEvent("a", "not an object", trace),
+    await makeEvent("c", { n: 3 }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["merged", { n: 1, __source_tag: "a" }],
+    ["merged", { n: 2, __source_tag: "b" }],
+    ["merged", "not an object"],
+    ["c", { n: 3 }],
+  ]);
+});
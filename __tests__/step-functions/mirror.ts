@@ -0,0 +1,135 @@
+import { make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make, validate } from "../../src/step-functions/mirror";
+import { makeRandom } from "../../src/step-functions/sample";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+// Events received by the fake canary endpoint, as parsed lines.
+const received: { n: string; d: unknown }[] = [];
+
+const server = makeHTTPServer(30111, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  Buffer.concat(chunks)
+    .toString()
+    .split("\n")
+    .filter((line) => line.length > 0)
+    .forEach((line) => received.push(JSON.parse(line)));
+  ctx.status = 204;
+});
+
+afterEach(() => {
+  received.length = 0;
+});
+
+afterAll(() => server.close());
+
+test("@standalone Mirror forwards events unmodified and sends renamed copies", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30111/events",
+    match: "orders.#",
+    remap: { "orders.#": "canary.orders.#" },
+  });
+  const events = [
+    await makeEvent("orders.created", { id: 1 }, trace),
+    await makeEvent("payments.created", { id: 2 }, trace),
+    await makeEvent("orders", { id: 3 }, trace),
+  ];
+  const serialized = events.map((event) => JSON.stringify(event));
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(output[0]).toBe(events[0]);
+  expect(output.map((event) => JSON.stringify(event))).toEqual(serialized);
+  expect(received.map(({ n, d }) => ({ n, d }))).toEqual([
+    { n: "canary.orders.created", d: { id: 1 } },
+    { n: "canary.orders", d: { id: 3 } },
+  ]);
+});
+
+test("@standalone Mirror sends a sample of the events", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30111/events",
+    sample: 0.3,
+    seed: 42,
+    remap: { "#": "canary.#" },
+  });
+  const events = await Promise.all(
+    Array.from({ length: 100 }, (_, i) => makeEvent("a", i, trace))
+  );
+  const random = makeRandom(42);
+  const expected = events.filter(() => random() < 0.3).map(({ data }) => data);
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(expected.length).toBeGreaterThan(0);
+  expect(expected.length).toBeLessThan(100);
+  expect(received.map(({ d }) => d)).toEqual(expected);
+  expect(received.every(({ n }) => n === "canary.a")).toBe(true);
+});
+
+test("@standalone Mirror doesn't affect the events forwarded when sends fail", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30112/nothing-listens-here",
+  });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("b", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+});
+
+test("@standalone Mirror validates its remapping rules", () => {
+  const validRemaps: { [from: string]: string }[] = [
+    { "orders.#": "canary.orders.#" },
+    { "#": "canary.#" },
+    { "orders.created": "canary.created" },
+    { "orders.#": "canary" },
+  ];
+  const invalidRemaps: { [from: string]: string }[] = [
+    { "orders.created": "canary.#" },
+    { "orders.#": "#" },
+    { "orders..#": "canary.#" },
+    { "orders.*": "canary.orders" },
+  ];
+  validRemaps.forEach((remap) =>
+    expect(() =>
+      validate("test", { target: "http://nothing", remap })
+    ).not.toThrow()
+  );
+  invalidRemaps.forEach((remap) =>
+    expect(() =>
+      validate("test", { target: "http://nothing", remap })
+    ).toThrow()
+  );
+});
@@ -0,0 +1,119 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { emits, make, validate } from "../../src/step-functions/parse-regex";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const pattern =
+  "^(?P<level>[A-Z]+) (?P<service>[a-z-]+) took (?P<millis>[0-9.]+)ms" +
+  "(?: \\((?<note>.*)\\))?$";
+
+test("@standalone Parse-regex maps named groups to captured values", async () => {
+  // Arrange
+  const channel = await make(testParams, { pattern });
+  // Act
+  channel.send([
+    await makeEvent("log", "INFO checkout took 12.5ms (cold start)", trace),
+    await makeEvent("log", "WARN search took 300ms\n", trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    [
+      "log",
+      {
+        level: "INFO",
+        service: "checkout",
+        millis: "12.5",
+        note: "cold start",
+      },
+    ],
+    ["log", { level: "WARN", service: "search", millis: "300", note: null }],
+  ]);
+});
+
+test("@standalone Parse-regex renames lines that don't match", async () => {
+  // Arrange
+  const channel = await make(testParams, { pattern });
+  const events = [
+    await makeEvent("log", "this is not a timing line", trace),
+    await makeEvent("log", { not: "a string" }, trace),
+    await makeEvent("log", "DEBUG cache took 1ms", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["log.unparsed", "this is not a timing line"],
+    ["log.unparsed", { not: "a string" }],
+    ["log", { level: "DEBUG", service: "cache", millis: "1", note: null }],
+  ]);
+  expect(emits({ pattern }, ["log"])).toEqual(["log", "log.unparsed"]);
+});
+
+test("@standalone Parse-regex coerces captures to their types", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      pattern: "(?i)^(?P<host>\\w+) up=(?P<up>\\w+) load=(?P<load>\\S+)$",
+      types: { up: "boolean", load: "number" },
+      "on-mismatch": "dead-letter",
+    }
+  );
+  const invalid = await makeEvent("status", "db1 up=true load=high", trace);
+  // Act
+  channel.send([
+    await makeEvent("status", "web1 UP=TRUE LOAD=0.75", trace),
+    invalid,
+    await makeEvent("status", "web2 up=false load=-2", trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { host: "web1", up: true, load: 0.75 },
+    { host: "web2", up: false, load: -2 },
+  ]);
+  expect(failures).toHaveLength(1);
+  expect(failures[0][0]).toEqual([invalid]);
+  expect(`${failures[0][1]}`).toContain('"high" is not a number');
+});
+
+test("@standalone Parse-regex validation rejects unusable patterns", () => {
+  // Act & assert
+  expect(() => validate("test", { pattern })).not.toThrow();
+  expect(() => validate("test", { pattern: "(?P<open" })).toThrow(
+    "step 'test' uses an invalid parse-regex.pattern value"
+  );
+  expect(() => validate("test", { pattern: "^[a-z]+$" })).toThrow(
+    "step 'test' uses a parse-regex.pattern value without named groups"
+  );
+  expect(() =>
+    validate("test", { pattern, types: { latency: "number" } })
+  ).toThrow(
+    "step 'test' gives a type to parse-regex group latency, " +
+      "which isn't in the pattern"
+  );
+});
@@ -0,0 +1,59 @@
+import fs from "fs";
+import path from "path";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/record";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+let tmpFilePath = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  const base = fs.mkdtempSync("/tmp/cdp-tests-");
+  tmpFilePath = path.join(base, "recording.ndjson");
+});
+
+afterEach(() => {
+  fs.rmSync(path.dirname(tmpFilePath), { recursive: true, force: true });
+});
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+test("@standalone Record appends events with their offsets and forwards them", async () => {
+  // Arrange
+  const channel = await make(testParams, tmpFilePath);
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  // Act
+  channel.send([await makeEvent("a", "hello", trace)]);
+  await resolveAfter(100);
+  channel.send([
+    await makeEvent("b", { lorem: 1 }, trace),
+    await makeEvent("a", "world", trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(10).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a", "hello"],
+    ["b", { lorem: 1 }],
+    ["a", "world"],
+  ]);
+  const records = fs
+    .readFileSync(tmpFilePath, "utf-8")
+    .trim()
+    .split("\n")
+    .map((line) => JSON.parse(line));
+  expect(records.map((r) => r.event)).toEqual([
+    { n: "a", d: "hello", t: trace },
+    { n: "b", d: { lorem: 1 }, t: trace },
+    { n: "a", d: "world", t: trace },
+  ]);
+  expect(records[0].offset).toEqual(0);
+  expect(records[1].offset).toBeGreaterThanOrEqual(0.09);
+  expect(records[2].offset).toEqual(records[1].offset);
+});
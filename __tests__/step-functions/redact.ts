@@ -0,0 +1,118 @@
+import { make as makeEvent } from "../../src/event";
+import { make, parsePath } from "../../src/step-functions/redact";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Redact parses jq paths", () => {
+  expect(parsePath(".")).toEqual([]);
+  expect(parsePath(".user.email")).toEqual([
+    { key: "user" },
+    { key: "email" },
+  ]);
+  expect(parsePath('.cards[].number[0].["the key"]')).toEqual([
+    { key: "cards" },
+    { each: true },
+    { key: "number" },
+    { index: 0 },
+    { key: "the key" },
+  ]);
+  expect(parsePath("user")).toEqual(null);
+  expect(parsePath(".user..email")).toEqual(null);
+  expect(parsePath(".cards[-1]")).toEqual(null);
+});
+
+test("@standalone Redact masks values at paths and under matching keys", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    paths: [".user.email", ".cards[].number", ".missing.path"],
+    "key-pattern": "^(password|ssn)$",
+  });
+  const data = {
+    user: { email: "jane@example.com", name: "Jane", password: "hunter2" },
+    cards: [{ number: "4111111111111111" }, { number: "5500000000000004" }],
+    nested: [{ ssn: 123456789 }],
+  };
+  const event = await makeEvent("a", data, trace);
+  // Act
+  channel.send([event]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    {
+      user: { email: "***", name: "Jane", password: "***" },
+      cards: [{ number: "***" }, { number: "***" }],
+      nested: [{ ssn: "***" }],
+    },
+  ]);
+  // The received event is shared with other steps, so it's left as
+  // it was.
+  expect(event.data).toEqual({
+    user: { email: "jane@example.com", name: "Jane", password: "hunter2" },
+    cards: [{ number: "4111111111111111" }, { number: "5500000000000004" }],
+    nested: [{ ssn: 123456789 }],
+  });
+});
+
+test("@standalone Redact hashes values consistently for each salt", async () => {
+  // Arrange
+  const hash = async (salt: string, email: string) => {
+    const channel = await make(testParams, {
+      paths: [".email"],
+      mode: "hash",
+      salt,
+    });
+    channel.send([await makeEvent("a", { email }, trace)]);
+    const [output] = await Promise.all([
+      consume(channel.receive),
+      channel.close(),
+    ]);
+    return (output[0].data as { email: string }).email;
+  };
+  // Act
+  const hashes = [
+    await hash("salt", "jane@example.com"),
+    await hash("salt", "john@example.com"),
+    await hash("salt", "jane@example.com"),
+    await hash("other salt", "jane@example.com"),
+  ];
+  // Assert
+  expect(hashes[0]).toMatch(/^[0-9a-f]{64}$/);
+  expect(hashes[0]).not.toEqual(hashes[1]);
+  expect(hashes[0]).toEqual(hashes[2]);
+  expect(hashes[0]).not.toEqual(hashes[3]);
+});
+
+test("@standalone Redact can reveal the end of values", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    paths: [".card", ".pin", ".phone"],
+    mode: "partial",
+    reveal: "4",
+  });
+  // Act
+  channel.send([
+    await makeEvent(
+      "a",
+      { card: "4111111111111111", pin: "1234", phone: 5551234567 },
+      trace
+    ),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { card: "************1111", pin: "****", phone: "******4567" },
+  ]);
+});
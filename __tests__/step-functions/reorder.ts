@@ -0,0 +1,89 @@
+import { make as makeEvent } from "../../src/event";
+import { resolveAfter } from "../../src/utils";
+import { make } from "../../src/step-functions/reorder";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Reorder sorts shuffled events by their timestamp", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "time-jq-expr": ".d.t",
+    delay: 0.1,
+  });
+  const times = [5, 2, 8, 1, 9, 3, 7, 4, 6, 0];
+  // Act
+  channel.send(
+    await Promise.all(times.map((t) => makeEvent("a", { t }, trace)))
+  );
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(200).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => (e.data as { t: number }).t)).toEqual([
+    0, 1, 2, 3, 4, 5, 6, 7, 8, 9,
+  ]);
+});
+
+test("@standalone Reorder keeps the arrival order of ties", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "time-jq-expr": ".d.t",
+    delay: 10,
+  });
+  const events = [
+    await makeEvent("a", { t: 2, i: 1 }, trace),
+    await makeEvent("a", { t: 1, i: 2 }, trace),
+    await makeEvent("a", { t: 2, i: 3 }, trace),
+    await makeEvent("a", { t: 1, i: 4 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  // The step is closed well before the delay elapses, so events are
+  // flushed in order.
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => (e.data as { i: number }).i)).toEqual([
+    2, 4, 1, 3,
+  ]);
+});
+
+test("@standalone Reorder emits late events right away", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "time-jq-expr": ".d.t",
+    delay: 0.05,
+    "late-suffix": "late",
+  });
+  // Act
+  channel.send([
+    await makeEvent("a", { t: 2 }, trace),
+    await makeEvent("a", { t: 1 }, trace),
+  ]);
+  await resolveAfter(150);
+  channel.send([
+    await makeEvent("a", { t: 0 }, trace),
+    await makeEvent("a", { t: 3 }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(150).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, (e.data as { t: number }).t])).toEqual([
+    ["a", 1],
+    ["a", 2],
+    ["a.late", 0],
+    ["a", 3],
+  ]);
+});
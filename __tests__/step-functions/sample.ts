@@ -0,0 +1,78 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/sample";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * Sends the given events through a sample channel, and collects the
+ * ones kept.
+ */
+const sample = async (
+  options: Parameters<typeof make>[1],
+  events: Event[]
+): Promise<Event[]> => {
+  const channel = await make(testParams, options);
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  return output;
+};
+
+test("@standalone Sample keeps a fraction of events close to the rate", async () => {
+  // Arrange
+  const events = await Promise.all(
+    Array.from({ length: 10000 }, (_, i) => makeEvent("a", i, trace))
+  );
+  // Act
+  const output = await sample({ rate: 0.3 }, events);
+  // Assert
+  expect(output.length / events.length).toBeGreaterThan(0.28);
+  expect(output.length / events.length).toBeLessThan(0.32);
+});
+
+test("@standalone Sample makes the same choices given the same seed", async () => {
+  // Arrange
+  const events = await Promise.all(
+    Array.from({ length: 100 }, (_, i) => makeEvent("a", i, trace))
+  );
+  // Act
+  const first = await sample({ rate: "0.5", seed: 42 }, events);
+  const second = await sample({ rate: "0.5", seed: "42" }, events);
+  const third = await sample({ rate: "0.5", seed: 43 }, events);
+  // Assert
+  expect(first.map((e) => e.data)).toEqual(second.map((e) => e.data));
+  expect(first.map((e) => e.data)).not.toEqual(third.map((e) => e.data));
+});
+
+test("@standalone Sample by key keeps or drops every event with the same key", async () => {
+  // Arrange
+  const events = await Promise.all(
+    Array.from({ length: 1000 }, (_, i) =>
+      makeEvent("a", { user: `user-${i % 100}`, i }, trace)
+    )
+  );
+  const keptUsers = (output: Event[]): string[] =>
+    Array.from(
+      new Set(output.map((e) => (e.data as { user: string }).user))
+    ).sort();
+  // Act
+  const first = await sample({ rate: 0.25, "key-jq-expr": ".d.user" }, events);
+  const second = await sample(
+    { rate: 0.25, "key-jq-expr": ".d.user" },
+    events.slice().reverse()
+  );
+  // Assert
+  expect(first).toHaveLength(keptUsers(first).length * 10);
+  expect(keptUsers(first)).toEqual(keptUsers(second));
+  expect(keptUsers(first).length).toBeGreaterThan(10);
+  expect(keptUsers(first).length).toBeLessThan(40);
+});
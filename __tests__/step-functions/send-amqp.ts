@@ -1,6 +1,10 @@
 import { connect } from "amqplib";
 import { make as makeEvent } from "../../src/event";
-import { make } from "../../src/step-functions/send-amqp";
+import {
+  make,
+  groupMessages,
+  renderTemplate,
+} from "../../src/step-functions/send-amqp";
 import { resolveAfter } from "../../src/utils";
 import { consume } from "../test-utils";
 
@@ -153,3 +157,156 @@ test("@amqp Send-amqp works as expected when using jq filters", async () => {
   expect(output.map((e) => e.data)).toEqual(["hello", "world"]);
   expect(receivedEvents).toEqual(events.map((e) => JSON.stringify([e])));
 });
+
+test("@amqp Send-amqp computes routing keys and headers from events", async () => {
+  // Arrange
+  const received: {
+    routingKey: string;
+    headers: unknown;
+    type: unknown;
+    content: string;
+  }[] = [];
+  const conn = await connect(brokerUrl);
+  const ch = await conn.createChannel();
+  const { exchange } = await ch.assertExchange("test5.output", "topic");
+  const { queue } = await ch.assertQueue("");
+  await ch.bindQueue(queue, exchange, "orders.#");
+  await ch.consume(queue, (message) => {
+    if (message !== null) {
+      received.push({
+        routingKey: message.fields.routingKey,
+        headers: message.properties.headers,
+        type: message.properties.type,
+        content: message.content.toString(),
+      });
+    }
+  });
+  const channel = await make(testParams, {
+    url: brokerUrl,
+    exchange: {
+      name: "test5.output",
+      type: "topic",
+    },
+    "routing-key": "{name}",
+    headers: { "x-event": "{name}", "x-source": "cdp" },
+    properties: { type: "{name}" },
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("orders.created", 1, trace),
+    await makeEvent("users.created", 2, trace),
+    await makeEvent("orders.shipped", 3, trace),
+    await makeEvent("orders.created", 4, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(500).then(() => channel.close()),
+  ]);
+  await resolveAfter(1000);
+  await conn.close();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2, 3, 4]);
+  expect(received).toEqual([
+    {
+      routingKey: "orders.created",
+      headers: { "x-event": "orders.created", "x-source": "cdp" },
+      type: "orders.created",
+      content: [events[0], events[3]]
+        .map((e) => JSON.stringify(e) + "\n")
+        .join(""),
+    },
+    {
+      routingKey: "orders.shipped",
+      headers: { "x-event": "orders.shipped", "x-source": "cdp" },
+      type: "orders.shipped",
+      content: JSON.stringify(events[2]) + "\n",
+    },
+  ]);
+});
+
+test("@amqp Send-amqp computes routing keys with jq", async () => {
+  // Arrange
+  const received: string[] = [];
+  const conn = await connect(brokerUrl);
+  const ch = await conn.createChannel();
+  const { exchange } = await ch.assertExchange("test6.output", "topic");
+  const { queue } = await ch.assertQueue("");
+  await ch.bindQueue(queue, exchange, "#");
+  await ch.consume(queue, (message) => {
+    if (message !== null) {
+      received.push(message.fields.routingKey);
+    }
+  });
+  const channel = await make(testParams, {
+    url: brokerUrl,
+    exchange: {
+      name: "test6.output",
+      type: "topic",
+    },
+    "routing-key": "fallback",
+    "routing-key-jq-expr": '"region." + .d.region',
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  // Act
+  channel.send([
+    await makeEvent("a", { region: "eu" }, trace),
+    await makeEvent("a", { region: "us" }, trace),
+    await makeEvent("a", { region: "*" }, trace),
+    await makeEvent("a", "no region", trace),
+  ]);
+  await Promise.all([
+    consume(channel.receive),
+    resolveAfter(500).then(() => channel.close()),
+  ]);
+  await resolveAfter(1000);
+  await conn.close();
+  // Assert
+  expect(received).toEqual(["region.eu", "region.us", "fallback"]);
+});
+
+test("@standalone Send-amqp groups events in messages by routing key and headers", async () => {
+  // Arrange
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("orders.created", 1, trace),
+    await makeEvent("orders.shipped", 2, trace),
+    await makeEvent("orders.created", 3, trace),
+  ];
+  // Act
+  const messages = groupMessages(
+    events,
+    events.map((event) => renderTemplate("cdp.{name}", event)),
+    { "x-event": "{name}", "x-static": 1 },
+    { "message-id": "{name}-{timestamp}", "app-id": "cdp" }
+  );
+  // Assert
+  expect(
+    messages.map(({ routingKey, headers, properties, events }) => ({
+      routingKey,
+      headers,
+      properties,
+      data: events.map((e) => e.data),
+    }))
+  ).toEqual([
+    {
+      routingKey: "cdp.orders.created",
+      headers: { "x-event": "orders.created", "x-static": 1 },
+      properties: {
+        messageId: `orders.created-${Math.trunc(events[0].timestamp)}`,
+        appId: "cdp",
+      },
+      data: [1, 3],
+    },
+    {
+      routingKey: "cdp.orders.shipped",
+      headers: { "x-event": "orders.shipped", "x-static": 1 },
+      properties: {
+        messageId: `orders.shipped-${Math.trunc(events[1].timestamp)}`,
+        appId: "cdp",
+      },
+      data: [2],
+    },
+  ]);
+});
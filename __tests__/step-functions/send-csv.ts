@@ -0,0 +1,72 @@
+import fs from "fs";
+import path from "path";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/send-csv";
+import { consume } from "../test-utils";
+
+let tmpFilePath = "/tmp/should-be-overwritten";
+
+beforeEach(() => {
+  const base = fs.mkdtempSync("/tmp/cdp-tests-");
+  tmpFilePath = path.join(base, "output.csv");
+});
+
+afterEach(() => {
+  fs.rmSync(path.dirname(tmpFilePath), { recursive: true, force: true });
+});
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Send-csv quotes fields and writes the header once", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    path: tmpFilePath,
+    columns: ["id", "name", "tags"],
+  });
+  const events = [
+    [
+      await makeEvent("a", { id: 1, name: "Doe, Jane", tags: ["x"] }, trace),
+      await makeEvent("a", { id: 2, name: 'The "Boss"' }, trace),
+    ],
+    [
+      await makeEvent("a", "not an object", trace),
+      await makeEvent("a", { name: "multi\nline", extra: true }, trace),
+    ],
+  ];
+  // Act
+  const output = consume(channel.receive);
+  channel.send(events[0]);
+  channel.send(events[1]);
+  await Promise.all([output, channel.close()]);
+  // Assert
+  expect(await output).toEqual(events.flat());
+  expect(fs.readFileSync(tmpFilePath, "utf-8")).toEqual(
+    "id,name,tags\r\n" +
+      '1,"Doe, Jane","[""x""]"\r\n' +
+      '2,"The ""Boss""",\r\n' +
+      ',"multi\nline",\r\n'
+  );
+});
+
+test("@standalone Send-csv doesn't repeat the header in non-empty files", async () => {
+  // Arrange
+  fs.writeFileSync(tmpFilePath, "id;name\r\n");
+  const channel = await make(testParams, {
+    path: tmpFilePath,
+    columns: ["id", "name"],
+    delimiter: ";",
+  });
+  // Act
+  channel.send([await makeEvent("a", { id: 3, name: "a;b" }, trace)]);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(fs.readFileSync(tmpFilePath, "utf-8")).toEqual(
+    'id;name\r\n3;"a;b"\r\n'
+  );
+});
@@ -0,0 +1,182 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import {
+  make,
+  makeIndexName,
+  validate,
+} from "../../src/step-functions/send-elasticsearch";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+// 2022-03-04T05:06:07Z, as a unix timestamp.
+const trace = [{ i: 1646370367, p: "irrelevant", h: "irrelevant" }];
+
+// Requests received by the fake bulk endpoint, as lists of parsed
+// lines.
+const requests: unknown[][] = [];
+
+// The ids of documents rejected once by the fake bulk endpoint.
+const rejectedOnce = new Set<string>();
+
+const server = makeHTTPServer(30040, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  const lines = Buffer.concat(chunks)
+    .toString()
+    .split("\n")
+    .filter((line) => line.length > 0)
+    .map((line) => JSON.parse(line));
+  requests.push(lines);
+  // Documents with a "reject" field are rejected the first time
+  // they're seen, and those with a "reject-always" field every time.
+  const items = [];
+  for (let i = 0; i < lines.length; i += 2) {
+    const id = lines[i].index._id;
+    const document = lines[i + 1];
+    const reject =
+      document["reject-always"] || (document.reject && !rejectedOnce.has(id));
+    if (document.reject) {
+      rejectedOnce.add(id);
+    }
+    items.push({
+      index: reject
+        ? { _id: id, status: 429, error: { type: "es_rejected_execution" } }
+        : { _id: id, status: 201 },
+    });
+  }
+  ctx.body = { errors: items.some((item) => item.index.status >= 300), items };
+});
+
+afterEach(() => {
+  requests.length = 0;
+  rejectedOnce.clear();
+});
+
+afterAll(() => server.close());
+
+test("@standalone Send-elasticsearch builds index names from templates", async () => {
+  // Arrange
+  const event = await makeEvent(
+    "logs.app",
+    { service: "billing", meta: { region: "eu" } },
+    trace
+  );
+  // Act
+  const names = [
+    "logs-{.service}-{date}",
+    "{name}-{.meta.region}",
+    "logs-{.missing}",
+  ].map((template) => makeIndexName(template, event));
+  // Assert
+  expect(names).toEqual([
+    "logs-billing-2022.03.04",
+    "logs.app-eu",
+    "logs-",
+  ]);
+});
+
+test("@standalone Send-elasticsearch sends action and document lines", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30040/",
+    index: "logs-{.service}-{date}",
+    "id-jq-expr": ".d.id",
+    "flush-size": 2,
+    "flush-interval": 60,
+  });
+  const events = [
+    await makeEvent("a", { id: "x", service: "web" }, trace),
+    await makeEvent("a", { id: 7, service: "db" }, trace),
+    await makeEvent("a", "not an object", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(requests).toEqual([
+    [
+      { index: { _index: "logs-web-2022.03.04", _id: "x" } },
+      { id: "x", service: "web" },
+      { index: { _index: "logs-db-2022.03.04", _id: "7" } },
+      { id: 7, service: "db" },
+    ],
+    [
+      { index: { _index: "logs--2022.03.04" } },
+      { data: "not an object" },
+    ],
+  ]);
+});
+
+test("@standalone Send-elasticsearch retries only the rejected documents", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30040",
+    index: "logs",
+    "id-jq-expr": ".d.id",
+    retry: { attempts: 3, delay: 0.01 },
+  });
+  const events = [
+    await makeEvent("a", { id: "1" }, trace),
+    await makeEvent("a", { id: "2", reject: true }, trace),
+    await makeEvent("a", { id: "3" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(
+    requests.map((lines) =>
+      lines.filter((_, index) => index % 2 === 0).map((line) => line.index._id)
+    )
+  ).toEqual([["1", "2", "3"], ["2"]]);
+});
+
+test("@standalone Send-elasticsearch dead-letters documents rejected every time", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      target: "http://127.0.0.1:30040",
+      index: "logs",
+      retry: { attempts: 2, delay: 0.01, "on-exhausted": "dead-letter" },
+    }
+  );
+  const events = [
+    await makeEvent("a", { n: 1 }, trace),
+    await makeEvent("a", { n: 2, "reject-always": true }, trace),
+  ];
+  // Act
+  channel.send(events);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(requests).toHaveLength(2);
+  expect(requests[1]).toHaveLength(2);
+  expect(failures).toHaveLength(1);
+  expect(failures[0][0]).toEqual([events[1]]);
+});
+
+test("@standalone Send-elasticsearch rejects unknown index placeholders", () => {
+  expect(() =>
+    validate("test", { target: "http://nothing", index: "logs-{.service}" })
+  ).not.toThrow();
+  expect(() =>
+    validate("test", { target: "http://nothing", index: "logs-{month}" })
+  ).toThrow();
+});
@@ -11,6 +11,9 @@ jest.mock("../../src/io/axios", () => {
 });
 afterEach(() => mockRequest.mockClear());
 
+import fs from "fs";
+import path from "path";
+import { release, track } from "../../src/delivery";
 import { make as makeEvent } from "../../src/event";
 import { make } from "../../src/step-functions/send-http";
 import { resolveAfter } from "../../src/utils";
@@ -120,3 +123,109 @@ test("@standalone Send-http works when specifying a jq expression and headers",
     "content-type": "text/plain",
   });
 });
+
+test("@standalone Send-http retries failed requests", async () => {
+  // Arrange
+  mockRequest
+    .mockRejectedValueOnce(new Error("unavailable"))
+    .mockRejectedValueOnce(new Error("unavailable"));
+  const channel = await make(testParams, {
+    target: "http://nothing",
+    retry: { attempts: 3, delay: 0.01 },
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [await makeEvent("a", "hello", trace)];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["hello"]);
+  expect(mockRequest.mock.calls).toHaveLength(3);
+  expect(mockRequest.mock.calls[2][0].data).toEqual(events);
+});
+
+test("@standalone Send-http doesn't acknowledge undelivered events in at-least-once mode", async () => {
+  // Arrange
+  mockRequest.mockRejectedValueOnce(new Error("unavailable"));
+  const channel = await make(testParams, {
+    target: "http://nothing",
+    delivery: "at-least-once",
+  });
+  const settled: string[] = [];
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const event = await makeEvent("a", "hello", trace);
+  event.receipt = track(() => settled.push("ack"), () => settled.push("nack"));
+  // Act
+  channel.send([event]);
+  await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  release(event.receipt);
+  // Assert
+  expect(mockRequest.mock.calls).toHaveLength(1);
+  expect(settled).toEqual(["nack"]);
+});
+
+test("@standalone Send-http acknowledges undelivered events in best-effort mode", async () => {
+  // Arrange
+  mockRequest.mockRejectedValueOnce(new Error("unavailable"));
+  const channel = await make(testParams, {
+    target: "http://nothing",
+    delivery: "best-effort",
+  });
+  const settled: string[] = [];
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const event = await makeEvent("a", "hello", trace);
+  event.receipt = track(() => settled.push("ack"), () => settled.push("nack"));
+  // Act
+  channel.send([event]);
+  await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  release(event.receipt);
+  // Assert
+  expect(mockRequest.mock.calls).toHaveLength(1);
+  expect(settled).toEqual(["ack"]);
+});
+
+test("@standalone Send-http skips events delivered already", async () => {
+  // Arrange
+  const tmpDir = fs.mkdtempSync("/tmp/cdp-tests-");
+  const options = {
+    target: "http://nothing",
+    idempotency: { store: { file: path.join(tmpDir, "delivered") } },
+  };
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const first = await make(testParams, options);
+  first.send([
+    await makeEvent("a", "hello", trace),
+    await makeEvent("a", "world", trace),
+  ]);
+  await Promise.all([
+    consume(first.receive),
+    resolveAfter(1).then(() => first.close()),
+  ]);
+  const second = await make(testParams, options);
+  // Act
+  second.send([
+    await makeEvent("a", "hello", trace),
+    await makeEvent("a", "world", trace),
+    await makeEvent("a", "again", trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(second.receive),
+    resolveAfter(1).then(() => second.close()),
+  ]);
+  fs.rmSync(tmpDir, { recursive: true, force: true });
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["hello", "world", "again"]);
+  expect(mockRequest.mock.calls).toHaveLength(2);
+  expect(
+    mockRequest.mock.calls[1][0].data.map((e: { data: unknown }) => e.data)
+  ).toEqual(["again"]);
+});
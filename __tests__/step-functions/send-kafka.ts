@@ -0,0 +1,93 @@
+import { Kafka, logLevel } from "kafkajs";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/send-kafka";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const brokers = ["localhost:9092"];
+
+// Initialize a kafka consumer for tests to use.
+const makeConsumer = async (
+  topic: string,
+  receivedMessages: { key: string | null; value: string }[]
+) => {
+  const consumer = new Kafka({ brokers, logLevel: logLevel.NOTHING }).consumer(
+    { groupId: `${topic}.consumer` }
+  );
+  await consumer.connect();
+  await consumer.subscribe({ topics: [topic], fromBeginning: true });
+  await consumer.run({
+    eachMessage: async ({ message }) => {
+      receivedMessages.push({
+        key: message.key?.toString() ?? null,
+        value: message.value?.toString() ?? "",
+      });
+    },
+  });
+  return consumer;
+};
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+test("@kafka Send-kafka works as expected", async () => {
+  // Arrange
+  const receivedMessages: { key: string | null; value: string }[] = [];
+  const consumer = await makeConsumer("test1.output", receivedMessages);
+  const channel = await make(testParams, {
+    brokers,
+    topic: "test1.output",
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("a", "hello", trace),
+    await makeEvent("b", "world", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  await resolveAfter(5000);
+  await consumer.disconnect();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["hello", "world"]);
+  expect(receivedMessages).toEqual(
+    events.map((e) => ({ key: e.name, value: JSON.stringify(e) }))
+  );
+});
+
+test("@kafka Send-kafka works with a key template and jq", async () => {
+  // Arrange
+  const receivedMessages: { key: string | null; value: string }[] = [];
+  const consumer = await makeConsumer("test2.output", receivedMessages);
+  const channel = await make(testParams, {
+    brokers,
+    topic: "test2.output",
+    key: "fixed",
+    "jq-expr": ".[] | .d",
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("a", "hello", trace),
+    await makeEvent("a", "world", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  await resolveAfter(5000);
+  await consumer.disconnect();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["hello", "world"]);
+  expect(receivedMessages).toEqual([
+    { key: "fixed", value: "hello" },
+    { key: "fixed", value: "world" },
+  ]);
+});
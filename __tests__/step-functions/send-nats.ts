@@ -0,0 +1,82 @@
+import { connect, StringCodec } from "nats";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/send-nats";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const natsUrl = "nats://localhost:4222";
+
+const codec = StringCodec();
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+test("@nats Send-nats publishes events to subjects matching their names", async () => {
+  // Arrange
+  const nc = await connect({ servers: natsUrl });
+  const received: { subject: string; data: string }[] = [];
+  const subscription = nc.subscribe("test1.output.>");
+  (async () => {
+    for await (const message of subscription) {
+      received.push({
+        subject: message.subject,
+        data: codec.decode(message.data),
+      });
+    }
+  })();
+  const channel = await make(testParams, { url: natsUrl });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("test1.output.a", "hello", trace),
+    await makeEvent("test1.output.b", "world", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  await resolveAfter(1000);
+  await nc.drain();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["hello", "world"]);
+  expect(received).toEqual(
+    events.map((e) => ({ subject: e.name, data: JSON.stringify(e) }))
+  );
+});
+
+test("@nats Send-nats publishes to a fixed subject with jq", async () => {
+  // Arrange
+  const nc = await connect({ servers: natsUrl });
+  const received: string[] = [];
+  const subscription = nc.subscribe("test2.output");
+  (async () => {
+    for await (const message of subscription) {
+      received.push(codec.decode(message.data));
+    }
+  })();
+  const channel = await make(testParams, {
+    url: natsUrl,
+    subject: "test2.output",
+    "jq-expr": ".[] | .d",
+  });
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [
+    await makeEvent("a", "hello", trace),
+    await makeEvent("a", "world", trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  await resolveAfter(1000);
+  await nc.drain();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["hello", "world"]);
+  expect(received).toEqual(["hello", "world"]);
+});
@@ -0,0 +1,242 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { decodeWriteRequest, TimeSeries } from "../../src/io/remote-write";
+import { make, validate } from "../../src/step-functions/send-prometheus";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+// 2022-03-04T05:06:07Z, as a unix timestamp.
+const trace = [{ i: 1646370367, p: "irrelevant", h: "irrelevant" }];
+
+// Requests received by the fake receiver, as decoded time series.
+const requests: TimeSeries[][] = [];
+
+// Whether the fake receiver failed once already for flaky samples.
+let failed = false;
+
+const server = makeHTTPServer(30110, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  const series = decodeWriteRequest(Buffer.concat(chunks));
+  requests.push(series);
+  // Samples labeled "reject" are always rejected, and those labeled
+  // "flaky" make the receiver fail the first time.
+  const labels = series.flatMap(({ labels }) => labels.map(([name]) => name));
+  if (labels.includes("reject")) {
+    ctx.status = 400;
+    ctx.body = "out of order sample";
+  } else if (labels.includes("flaky") && !failed) {
+    failed = true;
+    ctx.status = 503;
+  } else {
+    ctx.status = 204;
+  }
+});
+
+afterEach(() => {
+  requests.length = 0;
+  failed = false;
+});
+
+afterAll(() => server.close());
+
+test("@standalone Send-prometheus sends samples grouped in time series", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30110/api/v1/push",
+    "time-jq-expr": ".d.time",
+    "flush-size": 3,
+    "flush-interval": 60,
+  });
+  const events = [
+    await makeEvent(
+      "a",
+      { name: "up", labels: { job: "web", az: "b" }, value: 1, time: 10.5 },
+      trace
+    ),
+    await makeEvent(
+      "a",
+      { name: "up", labels: { az: "b", job: "web" }, value: "0", time: 9 },
+      trace
+    ),
+    await makeEvent(
+      "a",
+      { name: "load", labels: { empty: "" }, value: "+Inf", time: 11 },
+      trace
+    ),
+    await makeEvent("a", { name: "load", value: 0.25, time: 12 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(requests).toEqual([
+    [
+      {
+        labels: [
+          ["__name__", "up"],
+          ["az", "b"],
+          ["job", "web"],
+        ],
+        samples: [
+          { value: 0, timestamp: 9000 },
+          { value: 1, timestamp: 10500 },
+        ],
+      },
+      {
+        labels: [["__name__", "load"]],
+        samples: [{ value: Infinity, timestamp: 11000 }],
+      },
+    ],
+    [
+      {
+        labels: [["__name__", "load"]],
+        samples: [{ value: 0.25, timestamp: 12000 }],
+      },
+    ],
+  ]);
+});
+
+test("@standalone Send-prometheus uses the events' timestamps by default", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30110/api/v1/push",
+    "name-jq-expr": ".n",
+    "labels-jq-expr": "{service: .d.service}",
+    "value-jq-expr": ".d.latency",
+  });
+  const event = await makeEvent(
+    "latency",
+    { service: "db", latency: 3 },
+    trace
+  );
+  // Act
+  channel.send([event]);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(requests).toEqual([
+    [
+      {
+        labels: [
+          ["__name__", "latency"],
+          ["service", "db"],
+        ],
+        samples: [{ value: 3, timestamp: 1646370367000 }],
+      },
+    ],
+  ]);
+});
+
+test("@standalone Send-prometheus dead-letters malformed samples", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { target: "http://127.0.0.1:30110/api/v1/push" }
+  );
+  const events = [
+    await makeEvent("a", { name: "ok", value: 1 }, trace),
+    await makeEvent("a", { name: "not-valid", value: 1 }, trace),
+    await makeEvent("a", { name: "ok", labels: { __x: "y" }, value: 1 }, trace),
+    await makeEvent("a", { name: "ok", labels: { x: [] }, value: 1 }, trace),
+    await makeEvent("a", { name: "ok", value: "one" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(requests).toHaveLength(1);
+  expect(requests[0]).toHaveLength(1);
+  expect(failures.map(([events]) => events)).toEqual(
+    events.slice(1).map((event) => [event])
+  );
+  expect(failures.map(([, error]) => error)).toEqual([
+    'Error: invalid metric name "not-valid"',
+    'Error: invalid label name "__x"',
+    "Error: the value of label x is not a scalar",
+    'Error: invalid sample value "one"',
+  ]);
+});
+
+test("@standalone Send-prometheus dead-letters rejected samples without retrying", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    {
+      target: "http://127.0.0.1:30110/api/v1/push",
+      retry: { attempts: 3, delay: 0.01 },
+    }
+  );
+  const events = [
+    await makeEvent("a", { name: "ok", value: 1 }, trace),
+    await makeEvent(
+      "a",
+      { name: "ok", labels: { reject: 1 }, value: 2 },
+      trace
+    ),
+  ];
+  // Act
+  channel.send(events);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(requests).toHaveLength(1);
+  expect(failures).toEqual([
+    [
+      events,
+      "the receiver rejected 2 samples with status 400: out of order sample",
+    ],
+  ]);
+});
+
+test("@standalone Send-prometheus retries requests that fail with 5xx statuses", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    target: "http://127.0.0.1:30110/api/v1/push",
+  });
+  const event = await makeEvent(
+    "a",
+    { name: "ok", labels: { flaky: true }, value: 1 },
+    trace
+  );
+  // Act
+  channel.send([event]);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(requests).toHaveLength(2);
+  expect(requests[0]).toEqual(requests[1]);
+});
+
+test("@standalone Send-prometheus validates its flush interval", () => {
+  expect(() =>
+    validate("test", { target: "http://nothing", "flush-interval": "0.5" })
+  ).not.toThrow();
+  expect(() =>
+    validate("test", { target: "http://nothing", "flush-interval": "0" })
+  ).toThrow();
+});
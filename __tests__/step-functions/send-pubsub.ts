@@ -0,0 +1,80 @@
+import { Message } from "@google-cloud/pubsub";
+import { make as makeEvent } from "../../src/event";
+import { makeClient } from "../../src/io/pubsub";
+import { make } from "../../src/step-functions/send-pubsub";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const connection = { "project-id": "cdp-test", endpoint: "localhost:8085" };
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const client = makeClient(connection);
+
+afterAll(() => client.close());
+
+test("@pubsub Send-pubsub publishes events with attributes and ordering keys", async () => {
+  // Arrange
+  const [topic] = await client.createTopic("test4-topic");
+  const [subscription] = await topic.createSubscription("test4-sub", {
+    enableMessageOrdering: true,
+  });
+  const received: Message[] = [];
+  subscription.on("message", (message: Message) => {
+    received.push(message);
+    message.ack();
+  });
+  const channel = await make(testParams, {
+    ...connection,
+    topic: "test4-topic",
+    "ordering-key": "key-{name}",
+    attributes: { source: "cdp", event: "{name}" },
+  });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("b", 2, trace),
+    await makeEvent("a", 3, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1000).then(() => channel.close()),
+  ]);
+  await resolveAfter(1000);
+  await subscription.close();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2, 3]);
+  const messages = received
+    .map((message) => ({
+      data: JSON.parse(message.data.toString()).d,
+      attributes: message.attributes,
+      orderingKey: message.orderingKey,
+    }))
+    .sort((a, b) => a.data - b.data);
+  expect(messages).toEqual([
+    {
+      data: 1,
+      attributes: { source: "cdp", event: "a" },
+      orderingKey: "key-a",
+    },
+    {
+      data: 2,
+      attributes: { source: "cdp", event: "b" },
+      orderingKey: "key-b",
+    },
+    {
+      data: 3,
+      attributes: { source: "cdp", event: "a" },
+      orderingKey: "key-a",
+    },
+  ]);
+  await subscription.delete();
+  await topic.delete();
+});
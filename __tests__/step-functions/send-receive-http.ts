@@ -14,7 +14,7 @@ jest.mock("../../src/io/axios", () => {
 });
 afterEach(() => mockRequest.mockClear());
 
-import { make as makeEvent } from "../../src/event";
+import { Event, make as makeEvent } from "../../src/event";
 import { make } from "../../src/step-functions/send-receive-http";
 import { resolveAfter } from "../../src/utils";
 import { consume } from "../test-utils";
@@ -92,3 +92,42 @@ test("@standalone Send-receive-http works when using jq as intermediary", async
     "content-type": "application/json",
   });
 });
+
+test("@standalone Send-receive-http gives up on requests that time out", async () => {
+  // Arrange
+  mockRequest.mockImplementationOnce(
+    (options) =>
+      new Promise((resolve, reject) => {
+        // The slow request only finishes once it's aborted.
+        options.signal.addEventListener("abort", () =>
+          reject(new Error("canceled"))
+        );
+      })
+  );
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      timeout: 0.05,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    "http://nothing"
+  );
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const slow = [await makeEvent("a", "slow", trace)];
+  const fast = [await makeEvent("a", "fast", trace)];
+  // Act
+  channel.send(slow, fast);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(200).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ lorem: "ipsum" }]);
+  expect(failures.map(([events]) => events)).toEqual([slow]);
+  expect(`${failures[0][1]}`).toContain("timed out");
+  expect(mockRequest.mock.calls).toHaveLength(2);
+  expect(mockRequest.mock.calls[0][0].signal.aborted).toBe(true);
+});
@@ -51,3 +51,177 @@ test("@standalone Send-receive-jq will filter out events that are invalid", asyn
   // Assert
   expect(output.map((e) => e.data)).toEqual(["cruel", "world"]);
 });
+
+test("@standalone Send-receive-jq can expose the event name to the filter", async () => {
+  // Arrange
+  const pipelineName = "test";
+  const pipelineSignature = "signature";
+  const channel = await make(
+    { pipelineName, pipelineSignature, stepName: "irrelevant" },
+    {
+      "jq-expr": `{tag: $tag, data: .[0].d}`,
+      wrap: "tagged",
+      "tag-metadata": true,
+    }
+  );
+  const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+  // Act
+  channel.send([await makeEvent("orders.created", "hello", trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual(["tagged"]);
+  expect(output.map((e) => e.data)).toEqual([
+    { tag: "orders.created", data: "hello" },
+  ]);
+});
+
+test("@standalone Send-receive-jq can rename wrapped events from the filter", async () => {
+  // Arrange
+  const pipelineName = "test";
+  const pipelineSignature = "signature";
+  const channel = await make(
+    { pipelineName, pipelineSignature, stepName: "irrelevant" },
+    {
+      "jq-expr": `.[] | .d | if .amount > 100 then . + {__tag: "orders.large"} else . end`,
+      wrap: "orders.small",
+      "tag-metadata": true,
+    }
+  );
+  const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+  const events = [
+    await makeEvent("orders", { amount: 10 }, trace),
+    await makeEvent("orders", { amount: 1000 }, trace),
+    await makeEvent("orders", { amount: 50, __tag: "invalid name" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["orders.small", { amount: 10 }],
+    ["orders.large", { amount: 1000 }],
+  ]);
+});
+
+test("@standalone Send-receive-jq leaves tag fields alone without tag metadata", async () => {
+  // Arrange
+  const pipelineName = "test";
+  const pipelineSignature = "signature";
+  const channel = await make(
+    { pipelineName, pipelineSignature, stepName: "irrelevant" },
+    {
+      "jq-expr": `.[] | .d + {__tag: "other"}`,
+      wrap: "same",
+    }
+  );
+  const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+  // Act
+  channel.send([await makeEvent("a", { x: 1 }, trace)]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["same", { x: 1, __tag: "other" }],
+  ]);
+});
+
+test("@standalone Send-receive-jq emits an event for each output value", async () => {
+  // Arrange
+  const pipelineName = "test";
+  const pipelineSignature = "signature";
+  const channel = await make(
+    { pipelineName, pipelineSignature, stepName: "irrelevant" },
+    {
+      "jq-expr": `.[] | .d.items[]`,
+      wrap: "item",
+    }
+  );
+  const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+  const events = [
+    await makeEvent("order", { items: [1, 2, 3] }, trace),
+    await makeEvent("order", { items: [] }, trace),
+    await makeEvent("order", { items: [4, 5] }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["item", 1],
+    ["item", 2],
+    ["item", 3],
+    ["item", 4],
+    ["item", 5],
+  ]);
+});
+
+test("@standalone Send-receive-jq drops events for which the filter is empty", async () => {
+  // Arrange
+  const pipelineName = "test";
+  const pipelineSignature = "signature";
+  const channel = await make(
+    { pipelineName, pipelineSignature, stepName: "irrelevant" },
+    `.[] | if .d % 2 == 0 then empty else . end`
+  );
+  const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+  const events = await Promise.all(
+    [1, 2, 3, 4, 5].map((n) => makeEvent("a", n, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a", 1],
+    ["a", 3],
+    ["a", 5],
+  ]);
+});
+
+test("@standalone Send-receive-jq reports the inputs of failed filters", async () => {
+  // Arrange
+  const pipelineName = "test";
+  const pipelineSignature = "signature";
+  const failures: [string[], unknown][] = [];
+  const channel = await make(
+    {
+      pipelineName,
+      pipelineSignature,
+      stepName: "irrelevant",
+      reportFailure: async (events, error) => {
+        failures.push([events.map((e) => e.name), error]);
+      },
+    },
+    `map(if .d == "bad" then error("bad data") else . end)`
+  );
+  const trace = [{ i: 1, p: pipelineName, h: pipelineSignature }];
+  const good = [await makeEvent("a", "good", trace)];
+  const bad = [
+    await makeEvent("b", "good", trace),
+    await makeEvent("c", "bad", trace),
+  ];
+  // Act
+  channel.send(good);
+  channel.send(bad);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([["a", "good"]]);
+  expect(failures).toEqual([[["b", "c"], "bad data"]]);
+});
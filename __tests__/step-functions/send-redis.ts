@@ -1,5 +1,5 @@
 import Redis from "ioredis";
-import { make as makeEvent } from "../../src/event";
+import { Event, make as makeEvent } from "../../src/event";
 import { make } from "../../src/step-functions/send-redis";
 import { resolveAfter } from "../../src/utils";
 import { consume } from "../test-utils";
@@ -130,3 +130,37 @@ test("@redis Send-redis works in tandem with jq", async () => {
   expect(output.map((e) => e.data)).toEqual(["hello", "world"]);
   expect(brpopResults).toEqual(["hello", "world"]);
 });
+
+test("@redis Send-redis dead-letters events once retries are exhausted", async () => {
+  // Arrange
+  const client = new Redis(redisUrl);
+  await client.flushall();
+  // Pushing to a key that holds a string fails every attempt.
+  await client.set("send-test5", "not a list");
+  const failures: Event[][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events) => {
+        failures.push(events);
+      },
+    },
+    {
+      instance: redisUrl,
+      rpush: "send-test5",
+      retry: { attempts: 2, delay: 0.01, "on-exhausted": "dead-letter" },
+    }
+  );
+  const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+  const events = [await makeEvent("a", "hello", trace)];
+  // Act
+  const output = consume(channel.receive);
+  channel.send(events);
+  while (failures.length === 0) {
+    await resolveAfter(10);
+  }
+  await Promise.all([output, channel.close()]);
+  await client.quit();
+  // Assert
+  expect(failures).toEqual([events]);
+});
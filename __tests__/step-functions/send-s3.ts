@@ -0,0 +1,148 @@
+import { gunzipSync } from "zlib";
+import { make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make, makePartitionKey } from "../../src/step-functions/send-s3";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+// 2022-03-04T05:06:07Z, as a unix timestamp.
+const trace = [{ i: 1646370367, p: "irrelevant", h: "irrelevant" }];
+
+// Objects stored in the fake S3 server.
+const uploads: { path: string; headers: unknown; body: Buffer }[] = [];
+
+const server = makeHTTPServer(30050, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  uploads.push({
+    path: decodeURIComponent(ctx.request.path),
+    headers: ctx.request.headers,
+    body: Buffer.concat(chunks),
+  });
+  ctx.status = 200;
+});
+
+afterEach(() => {
+  uploads.length = 0;
+});
+
+afterAll(() => server.close());
+
+const baseOptions = {
+  endpoint: "http://127.0.0.1:30050",
+  bucket: "archive",
+  "access-key-id": "test-key",
+  "secret-access-key": "test-secret",
+};
+
+// Removes the unique part of an object's key.
+const stripPart = (path: string): string =>
+  path.replace(/-[0-9]+-[0-9a-f]{8}/, "");
+
+test("@standalone Send-s3 builds object keys from templates", async () => {
+  // Arrange
+  const event = await makeEvent("logs.app", null, trace);
+  // Act
+  const keys = [
+    "year={year}/month={month}/day={day}/hour={hour}/{name}.ndjson.gz",
+    "{name}/{minute}-{part}.json",
+    "{name}",
+    "archive.ndjson",
+  ].map((template) => makePartitionKey(template, event));
+  // Assert
+  expect(keys).toEqual([
+    "year=2022/month=03/day=04/hour=05/logs.app-{part}.ndjson.gz",
+    "logs.app/06-{part}.json",
+    "logs.app-{part}",
+    "archive-{part}.ndjson",
+  ]);
+});
+
+test("@standalone Send-s3 uploads partitioned objects on shutdown", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    ...baseOptions,
+    key: "year={year}/month={month}/day={day}/hour={hour}/{name}.ndjson.gz",
+    gzip: true,
+  });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("b", 2, trace),
+    await makeEvent("a", 3, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(uploads.map(({ path }) => stripPart(path)).sort()).toEqual([
+    "/archive/year=2022/month=03/day=04/hour=05/a.ndjson.gz",
+    "/archive/year=2022/month=03/day=04/hour=05/b.ndjson.gz",
+  ]);
+  const objectA = uploads.find(({ path }) => path.includes("/a-"));
+  expect(
+    gunzipSync(objectA?.body ?? Buffer.from(""))
+      .toString()
+      .split("\n")
+  ).toEqual([JSON.stringify(events[0]), JSON.stringify(events[2]), ""]);
+  expect(objectA?.headers).toMatchObject({
+    "content-type": "application/gzip",
+    authorization: expect.stringMatching(
+      /^AWS4-HMAC-SHA256 Credential=test-key\/20[0-9]{6}\/us-east-1\/s3\/aws4_request, /
+    ),
+  });
+});
+
+test("@standalone Send-s3 rotates objects once they're too large", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    ...baseOptions,
+    key: "{name}.ndjson",
+    "max-size": 200,
+  });
+  // Each event takes more than 100 bytes, so every object holds at
+  // most two of them.
+  const events = await Promise.all(
+    [1, 2, 3, 4, 5].map((n) => makeEvent("a", "x".repeat(40 + n), trace))
+  );
+  // Act
+  channel.send(events);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(uploads).toHaveLength(3);
+  expect(new Set(uploads.map(({ path }) => path)).size).toEqual(3);
+  expect(
+    uploads.map(({ body }) => body.toString().split("\n").length - 1)
+  ).toEqual([2, 2, 1]);
+});
+
+test("@standalone Send-s3 rotates objects once they're too old", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    ...baseOptions,
+    "max-age": 0.05,
+  });
+  // Act
+  const output = consume(channel.receive);
+  channel.send([await makeEvent("a", 1, trace)]);
+  await resolveAfter(300);
+  const uploadedBeforeClosing = uploads.length;
+  await Promise.all([output, channel.close()]);
+  // Assert
+  expect(uploadedBeforeClosing).toEqual(1);
+  expect(uploads).toHaveLength(1);
+  expect(stripPart(uploads[0].path)).toEqual(
+    "/archive/2022/03/04/05/a.ndjson"
+  );
+});
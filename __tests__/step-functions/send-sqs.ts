@@ -0,0 +1,140 @@
+import { make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make } from "../../src/step-functions/send-sqs";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+interface SentEntry {
+  Id: string;
+  MessageBody: string;
+  MessageGroupId?: string;
+  MessageDeduplicationId?: string;
+}
+
+// Batches received by the fake SQS server, and the amount of entries
+// it should fail.
+const batches: SentEntry[][] = [];
+let failures = 0;
+
+const server = makeHTTPServer(30091, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  const entries = JSON.parse(Buffer.concat(chunks).toString())
+    .Entries as SentEntry[];
+  batches.push(entries);
+  const failed = entries.slice(0, failures);
+  failures = Math.max(failures - failed.length, 0);
+  ctx.type = "application/x-amz-json-1.0";
+  ctx.body = JSON.stringify({
+    Successful: entries.slice(failed.length).map(({ Id }) => ({ Id })),
+    Failed: failed.map(({ Id }) => ({
+      Id,
+      Code: "InternalError",
+      SenderFault: false,
+    })),
+  });
+});
+
+afterEach(() => {
+  batches.length = 0;
+  failures = 0;
+});
+
+afterAll(() => server.close());
+
+const baseOptions = {
+  endpoint: "http://127.0.0.1:30091",
+  "access-key-id": "test-key",
+  "secret-access-key": "test-secret",
+};
+
+test("@standalone Send-sqs sends batches of messages to FIFO queues", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    ...baseOptions,
+    "queue-url": "https://sqs.eu-west-1.amazonaws.com/000000000000/test.fifo",
+    "group-id": "cdp-{name}",
+  });
+  const events = await Promise.all(
+    Array.from({ length: 12 }, (_, i) =>
+      makeEvent(i % 2 === 0 ? "a" : "b", i, trace)
+    )
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(events.map((e) => e.data));
+  expect(batches.map((batch) => batch.length)).toEqual([10, 2]);
+  const entries = batches.flat();
+  expect(entries.map((entry) => entry.MessageBody)).toEqual(
+    events.map((e) => JSON.stringify(e))
+  );
+  expect(entries.map((entry) => entry.MessageGroupId)).toEqual(
+    events.map((e) => `cdp-${e.name}`)
+  );
+  expect(
+    new Set(entries.map((entry) => entry.MessageDeduplicationId)).size
+  ).toEqual(12);
+});
+
+test("@standalone Send-sqs retries only the messages that failed", async () => {
+  // Arrange
+  failures = 1;
+  const channel = await make(testParams, {
+    ...baseOptions,
+    "queue-url": "https://sqs.eu-west-1.amazonaws.com/000000000000/test.fifo",
+    retry: { attempts: 2, delay: 0.05 },
+  });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2]);
+  expect(batches.map((batch) => batch.map((e) => e.MessageBody))).toEqual([
+    [JSON.stringify(events[0]), JSON.stringify(events[1])],
+    [JSON.stringify(events[0])],
+  ]);
+  // The retried message keeps its deduplication id.
+  expect(batches[1][0].MessageDeduplicationId).toEqual(
+    batches[0][0].MessageDeduplicationId
+  );
+});
+
+test("@standalone Send-sqs doesn't group messages sent to standard queues", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    ...baseOptions,
+    "queue-url": "https://sqs.eu-west-1.amazonaws.com/000000000000/test",
+  });
+  // Act
+  channel.send([await makeEvent("a", 1, trace)]);
+  await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(batches).toHaveLength(1);
+  expect(batches[0][0].MessageGroupId).toBeUndefined();
+  expect(batches[0][0].MessageDeduplicationId).toBeUndefined();
+});
@@ -0,0 +1,199 @@
+import { gunzipSync } from "zlib";
+import { HTTP_CLIENT_MAX_RETRIES } from "../../src/conf";
+import { Event, make as makeEvent } from "../../src/event";
+import { makeHTTPServer } from "../../src/io/http-server";
+import { make, validate } from "../../src/step-functions/send-webhook";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+// Requests received by the fake webhook.
+const requests: { path: string; headers: unknown; body: Buffer }[] = [];
+
+// The number of requests the fake webhook fails with a 500 status,
+// before accepting them.
+let failing = 0;
+
+const server = makeHTTPServer(30060, async (ctx) => {
+  const chunks: Buffer[] = [];
+  for await (const chunk of ctx.req) {
+    chunks.push(chunk);
+  }
+  requests.push({
+    path: ctx.request.path,
+    headers: ctx.request.headers,
+    body: Buffer.concat(chunks),
+  });
+  if (failing > 0) {
+    failing--;
+    ctx.status = 500;
+  } else {
+    ctx.status = 204;
+  }
+});
+
+afterEach(() => {
+  requests.length = 0;
+  failing = 0;
+});
+
+afterAll(() => server.close());
+
+// Parses the bodies of the received requests.
+const bodies = (): unknown[] =>
+  requests.map(({ body }) => JSON.parse(body.toString()));
+
+test("@standalone Send-webhook delivers one request per event", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    "url-jq-expr": '"http://127.0.0.1:30060/\\(.n)"',
+    "body-jq-expr": "{value: .d}",
+  });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("b", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(requests.map(({ path }) => path).sort()).toEqual(["/a", "/b"]);
+  expect(
+    requests.map(({ path, body }) => [path, JSON.parse(body.toString())])
+  ).toEqual(
+    expect.arrayContaining([
+      ["/a", { value: 1 }],
+      ["/b", { value: 2 }],
+    ])
+  );
+});
+
+test("@standalone Send-webhook batches events into a gzipped array", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    url: "http://127.0.0.1:30060/batch",
+    batch: true,
+    gzip: "true",
+  });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("b", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(requests).toHaveLength(1);
+  expect(requests[0].headers).toMatchObject({
+    "content-encoding": "gzip",
+    "content-type": "application/json",
+  });
+  expect(JSON.parse(gunzipSync(requests[0].body).toString())).toEqual(
+    JSON.parse(JSON.stringify(events))
+  );
+});
+
+test("@standalone Send-webhook groups batches by their rendered headers", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    url: "http://127.0.0.1:30060/batch",
+    headers: { "X-Static": "yes" },
+    "headers-jq-expr": '{authorization: "Bearer \\(.d.tenant)"}',
+    "body-jq-expr": ".d.n",
+    batch: "true",
+  });
+  const events = [
+    await makeEvent("a", { tenant: "t1", n: 1 }, trace),
+    await makeEvent("a", { tenant: "t2", n: 2 }, trace),
+    await makeEvent("a", { tenant: "t1", n: 3 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  await Promise.all([consume(channel.receive), channel.close()]);
+  // Assert
+  expect(requests).toHaveLength(2);
+  const byTenant = Object.fromEntries(
+    requests.map(({ headers, body }) => {
+      const { authorization, "x-static": header } = headers as {
+        [key: string]: string;
+      };
+      return [authorization, [header, JSON.parse(body.toString())]];
+    })
+  );
+  expect(byTenant).toEqual({
+    "Bearer t1": ["yes", [1, 3]],
+    "Bearer t2": ["yes", [2]],
+  });
+});
+
+test("@standalone Send-webhook retries requests that fail with 500", async () => {
+  // Arrange
+  // The HTTP client retries 5xx responses by itself, so the first
+  // attempt fails only after every one of those.
+  failing = HTTP_CLIENT_MAX_RETRIES + 1;
+  const channel = await make(testParams, {
+    url: "http://127.0.0.1:30060/",
+    retry: { attempts: 2, delay: 0.01 },
+  });
+  // Act
+  const output = consume(channel.receive);
+  channel.send([await makeEvent("a", 1, trace)]);
+  while (requests.length < HTTP_CLIENT_MAX_RETRIES + 2) {
+    await resolveAfter(10);
+  }
+  await Promise.all([output, channel.close()]);
+  // Assert
+  expect(requests).toHaveLength(HTTP_CLIENT_MAX_RETRIES + 2);
+  expect(bodies()[HTTP_CLIENT_MAX_RETRIES + 1]).toMatchObject({
+    n: "a",
+    d: 1,
+  });
+});
+
+test("@standalone Send-webhook dead-letters events once retries are exhausted", async () => {
+  // Arrange
+  failing = Infinity;
+  const failures: Event[][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events) => {
+        failures.push(events);
+      },
+    },
+    {
+      url: "http://127.0.0.1:30060/",
+      retry: { attempts: 1, "on-exhausted": "dead-letter" },
+    }
+  );
+  const events = [await makeEvent("a", 1, trace)];
+  // Act
+  const output = consume(channel.receive);
+  channel.send(events);
+  while (failures.length === 0) {
+    await resolveAfter(10);
+  }
+  await Promise.all([output, channel.close()]);
+  // Assert
+  expect(failures).toEqual([events]);
+});
+
+test("@standalone Send-webhook requires exactly one URL option", () => {
+  expect(() => validate("test", { url: "http://nothing" })).not.toThrow();
+  expect(() => validate("test", { "url-jq-expr": ".d.url" })).not.toThrow();
+  expect(() => validate("test", {})).toThrow();
+  expect(() =>
+    validate("test", { url: "http://nothing", "url-jq-expr": ".d.url" })
+  ).toThrow();
+});
@@ -0,0 +1,88 @@
+import WebSocket, { WebSocketServer } from "ws";
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/send-websocket";
+import { resolveAfter } from "../../src/utils";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * Connect to the given URL, collecting the received frames until the
+ * connection is closed.
+ */
+const subscribe = (url: string): [Promise<void>, Promise<string[]>] => {
+  const socket = new WebSocket(url);
+  const frames: string[] = [];
+  socket.on("message", (data) => frames.push(data.toString()));
+  return [
+    new Promise((resolve, reject) => {
+      socket.once("open", () => resolve());
+      socket.once("error", reject);
+    }),
+    new Promise((resolve) => socket.once("close", () => resolve(frames))),
+  ];
+};
+
+test("@standalone Send-websocket delivers events to connected clients", async () => {
+  // Arrange
+  const channel = await make(testParams, { port: 30084, endpoint: "/events" });
+  const events = [
+    await makeEvent("orders.created", 1, trace),
+    await makeEvent("payments.received", 2, trace),
+    await makeEvent("orders.eu.cancelled", 3, trace),
+  ];
+  const [allConnected, allFrames] = subscribe("ws://127.0.0.1:30084/events");
+  const [ordersConnected, ordersFrames] = subscribe(
+    "ws://127.0.0.1:30084/events?match=orders.%23"
+  );
+  await Promise.all([allConnected, ordersConnected]);
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(300).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2, 3]);
+  expect(await allFrames).toEqual(events.map((e) => JSON.stringify(e)));
+  expect(await ordersFrames).toEqual(
+    [events[0], events[2]].map((e) => JSON.stringify(e))
+  );
+});
+
+test("@standalone Send-websocket delivers events upstream across reconnections", async () => {
+  // Arrange
+  const server = new WebSocketServer({ port: 30085 });
+  const frames: string[] = [];
+  let connections = 0;
+  server.on("connection", (socket) => {
+    connections++;
+    socket.on("message", (data) => frames.push(data.toString()));
+  });
+  const channel = await make(testParams, "ws://127.0.0.1:30085");
+  const first = await makeEvent("a", 1, trace);
+  const second = await makeEvent("a", 2, trace);
+  // Act
+  await resolveAfter(200);
+  channel.send([first]);
+  await resolveAfter(200);
+  // Drop the connection, and send an event while it's re-established.
+  server.clients.forEach((socket) => socket.terminate());
+  await resolveAfter(50);
+  channel.send([second]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(1500).then(() => channel.close()),
+  ]);
+  await new Promise((resolve) => server.close(resolve));
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([1, 2]);
+  expect(connections).toEqual(2);
+  expect(frames).toEqual([JSON.stringify(first), JSON.stringify(second)]);
+});
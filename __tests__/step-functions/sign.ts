@@ -0,0 +1,48 @@
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/sign";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Sign produces signatures independent of key order", async () => {
+  // Arrange
+  const channel = await make(testParams, { key: "secret" });
+  // Act
+  channel.send([
+    await makeEvent("a", { x: 1, y: { b: 2, a: 1 } }, trace),
+    await makeEvent("a", { y: { a: 1, b: 2 }, x: 1 }, trace),
+    await makeEvent("a", { x: 2, y: { a: 1, b: 2 } }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  const signatures = output.map((e) => e.data.__signature);
+  expect(signatures[0]).toMatch(/^[0-9a-f]{64}$/);
+  expect(signatures[0]).toEqual(signatures[1]);
+  expect(signatures[0]).not.toEqual(signatures[2]);
+});
+
+test("@standalone Sign forwards events with non-object data unsigned", async () => {
+  // Arrange
+  const channel = await make(testParams, { key: "secret", field: "sig" });
+  // Act
+  channel.send([
+    await makeEvent("a", "text", trace),
+    await makeEvent("a", { x: 1 }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output[0].data).toEqual("text");
+  expect(Object.keys(output[1].data)).toEqual(["x", "sig"]);
+});
@@ -0,0 +1,110 @@
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/switch";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Switch renames events after the first matching case", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    cases: [
+      { match: "orders.refund", name: "route.refunds" },
+      { match: "orders.#", name: "route.orders" },
+      { match: "#", name: "route.anything" },
+    ],
+  });
+  const events = [
+    await makeEvent("orders.refund", 1, trace),
+    await makeEvent("orders.new", 2, trace),
+    await makeEvent("users.new", 3, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual([
+    "route.refunds",
+    "route.orders",
+    "route.anything",
+  ]);
+  expect(output.map((e) => e.data)).toEqual([1, 2, 3]);
+});
+
+test("@standalone Switch uses the default name, or forwards unmatched events unchanged", async () => {
+  // Arrange
+  const cases = [{ match: "orders.#", name: "route.orders" }];
+  const withDefault = await make(testParams, {
+    cases,
+    default: "route.other",
+  });
+  const withoutDefault = await make(testParams, { cases });
+  const events = [
+    await makeEvent("orders.new", 1, trace),
+    await makeEvent("users.new", 2, trace),
+  ];
+  // Act
+  withDefault.send(events);
+  withoutDefault.send(events);
+  const [defaultOutput, passOutput] = await Promise.all([
+    consume(withDefault.receive),
+    consume(withoutDefault.receive),
+    withDefault.close(),
+    withoutDefault.close(),
+  ]);
+  // Assert
+  expect(defaultOutput.map((e) => e.name)).toEqual([
+    "route.orders",
+    "route.other",
+  ]);
+  expect(passOutput.map((e) => e.name)).toEqual([
+    "route.orders",
+    "users.new",
+  ]);
+});
+
+test("@standalone Switch mixes pattern and jq predicate cases", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    cases: [
+      { match: "orders.refund", name: "route.refunds" },
+      { "jq-expr": ".d.total > 1000", name: "route.large" },
+      {
+        match: "orders.#",
+        "jq-expr": '.d.country != "CL"',
+        name: "route.international",
+      },
+      { "jq-expr": ".d.missing.field | error", name: "route.never" },
+    ],
+    default: "route.regular",
+  });
+  const events = [
+    await makeEvent("orders.refund", { total: 5000, country: "AR" }, trace),
+    await makeEvent("orders.new", { total: 5000, country: "CL" }, trace),
+    await makeEvent("orders.new", { total: 10, country: "AR" }, trace),
+    await makeEvent("users.new", { total: 10, country: "AR" }, trace),
+    await makeEvent("orders.new", { total: 10, country: "CL" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual([
+    "route.refunds",
+    "route.large",
+    "route.international",
+    "route.regular",
+    "route.regular",
+  ]);
+});
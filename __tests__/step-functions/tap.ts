@@ -0,0 +1,95 @@
+import { PassThrough, Readable } from "stream";
+// Mock the stdio wrapper module.
+const stderrMock = {
+  current: null,
+} as {
+  current: Readable | null;
+};
+const mockSTDERRGetter = jest.fn(() => {
+  const mock = new PassThrough();
+  mock.setEncoding("utf-8");
+  stderrMock.current = mock;
+  return mock;
+});
+jest.mock("../../src/io/stdio", () => {
+  const originalModule = jest.requireActual("../../src/io/stdio");
+  return {
+    ...originalModule,
+    getSTDERR: mockSTDERRGetter,
+  };
+});
+afterEach(() => mockSTDERRGetter.mockClear());
+
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/tap";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Tap forwards events unmodified and copies them", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  const events = [
+    await makeEvent("a", { nested: [1, 2] }, trace),
+    await makeEvent("b", "hello", trace),
+  ];
+  const serialized = events.map((event) => JSON.stringify(event));
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(events);
+  expect(output[0]).toBe(events[0]);
+  expect(output.map((event) => JSON.stringify(event))).toEqual(serialized);
+  expect(stderrMock.current?.read()).toEqual(
+    '{"n":"a","d":{"nested":[1,2]}}\n{"n":"b","d":"hello"}\n'
+  );
+});
+
+test("@standalone Tap only copies matching events", async () => {
+  // Arrange
+  const channel = await make(testParams, { match: "orders.*" });
+  // Act
+  channel.send([
+    await makeEvent("orders.created", 1, trace),
+    await makeEvent("users.created", 2, trace),
+    await makeEvent("orders.shipped", 3, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((event) => event.data)).toEqual([1, 2, 3]);
+  expect(stderrMock.current?.read()).toEqual(
+    '{"n":"orders.created","d":1}\n{"n":"orders.shipped","d":3}\n'
+  );
+});
+
+test("@standalone Tap sampling limits the copies, not the events", async () => {
+  // Arrange
+  const channel = await make(testParams, { sample: "0.1", seed: 7 });
+  const events = await Promise.all(
+    Array.from({ length: 1000 }, (_, index) => makeEvent("a", index, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toHaveLength(1000);
+  const copies = (stderrMock.current?.read() as string).trim().split("\n");
+  expect(copies.length).toBeGreaterThan(50);
+  expect(copies.length).toBeLessThan(150);
+});
@@ -0,0 +1,102 @@
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/throttle";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Throttle drops events exceeding the burst", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    rate: 1,
+    interval: 60,
+    burst: 3,
+    overflow: "drop",
+  });
+  const events = await Promise.all(
+    Array.from({ length: 10 }, (_, index) => makeEvent("a", index, trace))
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([0, 1, 2]);
+});
+
+test("@standalone Throttle keeps a separate bucket for each key", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    rate: 1,
+    interval: 60,
+    burst: 2,
+    "key-jq-expr": ".d.k",
+    overflow: "drop",
+  });
+  const events = await Promise.all(
+    ["x", "y", "x", "x", "y", "z", "y"].map((k, index) =>
+      makeEvent("a", { k, index }, trace)
+    )
+  );
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data.index)).toEqual([0, 1, 2, 4, 5]);
+});
+
+test("@standalone Throttle delays a flood to the configured rate", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    rate: 50,
+    burst: 1,
+    overflow: "delay",
+  });
+  const events = await Promise.all(
+    Array.from({ length: 26 }, (_, index) => makeEvent("a", index, trace))
+  );
+  // Act
+  channel.send(events);
+  const times = [];
+  const output = [];
+  for (let i = 0; i < events.length; i++) {
+    const result = await channel.receive.next();
+    times.push(new Date().getTime());
+    output.push(result.value);
+  }
+  await channel.close();
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(events.map((e) => e.data));
+  // 25 events after the first one, at 50 per second, take 500 ms.
+  const elapsed = times[times.length - 1] - times[0];
+  expect(elapsed).toBeGreaterThanOrEqual(480);
+  expect(elapsed).toBeLessThan(700);
+});
+
+test("@standalone Throttle doesn't delay the shutdown", async () => {
+  // Arrange
+  const channel = await make(testParams, { rate: 1, interval: 60 });
+  const events = await Promise.all(
+    Array.from({ length: 5 }, (_, index) => makeEvent("a", index, trace))
+  );
+  // Act
+  channel.send(events);
+  const start = new Date().getTime();
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(new Date().getTime() - start).toBeLessThan(1000);
+  expect(output.map((e) => e.data)).toEqual([0, 1, 2, 3, 4]);
+});
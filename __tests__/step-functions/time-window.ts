@@ -0,0 +1,148 @@
+import { make as makeEvent } from "../../src/event";
+import { resolveAfter } from "../../src/utils";
+import { make } from "../../src/step-functions/time-window";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+test("@standalone Time-window groups events in tumbling event-time windows", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    size: 10,
+    "time-jq-expr": ".d.t",
+  });
+  const events = [
+    await makeEvent("a", { t: 0 }, trace),
+    await makeEvent("a", { t: 9.9 }, trace),
+    await makeEvent("a", { t: 10 }, trace),
+    await makeEvent("a", { t: 25 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a.window", [{ t: 0 }, { t: 9.9 }]],
+    ["a.window", [{ t: 10 }]],
+    ["a.window", [{ t: 25 }]],
+  ]);
+});
+
+test("@standalone Time-window groups events by name and key", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    size: 10,
+    "time-jq-expr": ".d.t",
+    "key-jq-expr": ".d.k",
+    suffix: "grouped",
+  });
+  const events = [
+    await makeEvent("a", { t: 1, k: "x" }, trace),
+    await makeEvent("a", { t: 2, k: "y" }, trace),
+    await makeEvent("b", { t: 3, k: "x" }, trace),
+    await makeEvent("a", { t: 4, k: "x" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    [
+      "a.grouped",
+      [
+        { t: 1, k: "x" },
+        { t: 4, k: "x" },
+      ],
+    ],
+    ["a.grouped", [{ t: 2, k: "y" }]],
+    ["b.grouped", [{ t: 3, k: "x" }]],
+  ]);
+});
+
+test("@standalone Time-window accepts late events only within the grace period", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    size: 10,
+    "time-jq-expr": ".d.t",
+    grace: 5,
+  });
+  const events = [
+    await makeEvent("a", { t: 1 }, trace),
+    await makeEvent("a", { t: 12 }, trace),
+    // Late, but within the grace period.
+    await makeEvent("a", { t: 8 }, trace),
+    await makeEvent("a", { t: 16 }, trace),
+    // Late, beyond the grace period.
+    await makeEvent("a", { t: 3 }, trace),
+  ];
+  // Act
+  events.forEach((event) => channel.send([event]));
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    [{ t: 1 }, { t: 8 }],
+    [{ t: 12 }, { t: 16 }],
+  ]);
+});
+
+test("@standalone Time-window groups events in sliding windows", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    size: 10,
+    slide: 5,
+    "time-jq-expr": ".d.t",
+  });
+  const events = [
+    await makeEvent("a", { t: 7 }, trace),
+    await makeEvent("a", { t: 12 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(100).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    [{ t: 7 }],
+    [{ t: 7 }, { t: 12 }],
+    [{ t: 12 }],
+  ]);
+});
+
+test("@standalone Time-window closes processing-time windows on time", async () => {
+  // Arrange
+  const channel = await make(testParams, { size: 0.2 });
+  const events = [
+    await makeEvent("a", 1, trace),
+    await makeEvent("a", 2, trace),
+  ];
+  // Act
+  channel.send(events);
+  const output = [];
+  const first = await channel.receive.next();
+  output.push(first.value);
+  channel.send([await makeEvent("a", 3, trace)]);
+  const [rest] = await Promise.all([
+    consume(channel.receive),
+    resolveAfter(10).then(() => channel.close()),
+  ]);
+  // Assert
+  expect(first.done).toEqual(false);
+  expect([...output, ...rest].map((e) => e.data)).toEqual([[1, 2], [3]]);
+});
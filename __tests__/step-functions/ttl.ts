@@ -0,0 +1,104 @@
+import { make as makeEvent } from "../../src/event";
+import { make } from "../../src/step-functions/ttl";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+/**
+ * A trace for an event that arrived at the given time.
+ */
+const arrivedAt = (i: number) => [{ i, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * A fixed clock.
+ */
+const clock = () => 1000;
+
+test("@standalone TTL drops events that arrived too long ago", async () => {
+  // Arrange
+  const channel = await make(testParams, { "max-age": "60" }, clock);
+  // Act
+  channel.send([
+    await makeEvent("a", "fresh", arrivedAt(990)),
+    await makeEvent("a", "stale", arrivedAt(900)),
+    await makeEvent("a", "at the limit", arrivedAt(940)),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual(["fresh", "at the limit"]);
+});
+
+test("@standalone TTL measures age since an extracted timestamp", async () => {
+  // Arrange
+  const channel = await make(
+    testParams,
+    { "max-age": 60, "time-jq-expr": ".d.t" },
+    clock
+  );
+  // Act
+  channel.send([
+    // Arrival times are ignored when using extracted timestamps.
+    await makeEvent("a", { t: 995, n: 1 }, arrivedAt(100)),
+    await makeEvent("a", { t: 100, n: 2 }, arrivedAt(999)),
+    await makeEvent("a", { n: 3 }, arrivedAt(999)),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ t: 995, n: 1 }]);
+});
+
+test("@standalone TTL renames expired events when given a suffix", async () => {
+  // Arrange
+  const channel = await make(
+    testParams,
+    { "max-age": 60, "time-jq-expr": ".d.t", "expired-suffix": "expired" },
+    clock
+  );
+  // Act
+  channel.send([
+    await makeEvent("a", { t: 100 }, arrivedAt(999)),
+    await makeEvent("b", { t: 999 }, arrivedAt(999)),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a.expired", { t: 100 }],
+    ["b", { t: 999 }],
+  ]);
+});
+
+test("@standalone TTL renames expired events by arrival time", async () => {
+  // Arrange
+  const channel = await make(
+    testParams,
+    { "max-age": 60, "expired-suffix": "expired" },
+    clock
+  );
+  // Act
+  channel.send([
+    await makeEvent("a", 1, arrivedAt(100)),
+    await makeEvent("a", 2, arrivedAt(999)),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => [e.name, e.data])).toEqual([
+    ["a.expired", 1],
+    ["a", 2],
+  ]);
+});
@@ -0,0 +1,101 @@
+import { Event, make as makeEvent } from "../../src/event";
+import {
+  FlattenFunctionOptions,
+  make as makeFlatten,
+} from "../../src/step-functions/flatten";
+import { make } from "../../src/step-functions/unflatten";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+/**
+ * Values that survive a round trip through flatten and unflatten.
+ */
+const nested = [
+  { a: { b: 1, c: { d: "x" } } },
+  { list: [1, [2, 3], { b: true }], empty: {}, none: [], nil: null },
+  { "with space": { "": 0 }, deep: { er: { and: { deeper: "!" } } } },
+  {},
+];
+
+test("@standalone Unflatten reverts flatten", async () => {
+  const variants: FlattenFunctionOptions[] = [
+    null,
+    { separator: "/" },
+    { arrays: "keep" },
+  ];
+  for (const options of variants) {
+    // Arrange
+    const flatten = await makeFlatten(testParams, options);
+    const unflatten = await make(testParams, options);
+    // Act
+    flatten.send(
+      await Promise.all(nested.map((data) => makeEvent("a", data, trace)))
+    );
+    const [flattened] = await Promise.all([
+      consume(flatten.receive),
+      flatten.close(),
+    ]);
+    unflatten.send(flattened);
+    const [output] = await Promise.all([
+      consume(unflatten.receive),
+      unflatten.close(),
+    ]);
+    // Assert
+    expect(output.map((e) => e.data)).toEqual(nested);
+  }
+});
+
+test("@standalone Unflatten rebuilds arrays from indices", async () => {
+  // Arrange
+  const channel = await make(testParams, null);
+  // Act
+  channel.send([
+    await makeEvent("a", { "a.1": "y", "a.0": "x", "b.0": 1, "b.2": 2 }, trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { a: ["x", "y"], b: { "0": 1, "2": 2 } },
+  ]);
+});
+
+test("@standalone Unflatten reports conflicting keys as failures", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { "on-error": "dead-letter" }
+  );
+  const events = [
+    await makeEvent("a", { a: 1, "a.b": 2 }, trace),
+    await makeEvent("a", { "a.b": 2, a: 1 }, trace),
+    await makeEvent("a", { "a.b": 2 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([{ a: { b: 2 } }]);
+  expect(failures.map(([failed, error]) => [failed, `${error}`])).toEqual([
+    [[events[0]], "Error: the key 'a' conflicts with the key 'a.b'"],
+    [[events[1]], "Error: the key 'a' conflicts with the key 'a.b'"],
+  ]);
+});
@@ -0,0 +1,125 @@
+import { make as makeEvent, Event } from "../../src/event";
+import { make, validate } from "../../src/step-functions/validate-schema";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const schema = {
+  type: "object",
+  properties: {
+    id: { type: "integer" },
+    email: { type: "string" },
+  },
+  required: ["id", "email"],
+};
+
+test("@standalone Validate-schema forwards valid events and drops invalid ones", async () => {
+  // Arrange
+  const channel = await make(testParams, { schema });
+  const events = [
+    await makeEvent("a", { id: 1, email: "one@example.com" }, trace),
+    await makeEvent("a", { id: "2", email: "two@example.com" }, trace),
+    await makeEvent("a", { email: "three@example.com" }, trace),
+    await makeEvent("a", { id: 4, email: "four@example.com" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data.id)).toEqual([1, 4]);
+});
+
+test("@standalone Validate-schema renames invalid events with error details", async () => {
+  // Arrange
+  const channel = await make(testParams, {
+    schema,
+    "on-invalid": "rename",
+  });
+  const events = [
+    await makeEvent("a", { id: 1, email: "one@example.com" }, trace),
+    await makeEvent("a", { id: "2" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual(["a", "a.invalid"]);
+  expect(output[1].data.data).toEqual({ id: "2" });
+  expect(output[1].data.errors).toHaveLength(2);
+  expect(output[1].data.errors).toEqual(
+    expect.arrayContaining([
+      { path: "", message: "must have required property 'email'" },
+      { path: "/id", message: "must be integer" },
+    ])
+  );
+});
+
+test("@standalone Validate-schema reports invalid events as failures", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { schema, "on-invalid": "dead-letter" }
+  );
+  const events = [
+    await makeEvent("a", { id: 1, email: "one@example.com" }, trace),
+    await makeEvent("a", { id: 2 }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data.id)).toEqual([1]);
+  expect(failures).toHaveLength(1);
+  expect(failures[0][0]).toEqual([events[1]]);
+  expect(failures[0][1]).toMatch(/email/);
+});
+
+test("@standalone Validate-schema can coerce types", async () => {
+  // Arrange
+  const channel = await make(testParams, { schema, coerce: true });
+  const events = [
+    await makeEvent("a", { id: "2", email: "two@example.com" }, trace),
+  ];
+  // Act
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.data)).toEqual([
+    { id: 2, email: "two@example.com" },
+  ]);
+  expect(events[0].data).toEqual({ id: "2", email: "two@example.com" });
+});
+
+test("@standalone Validate-schema rejects invalid schemas at startup", () => {
+  expect(() =>
+    validate("irrelevant", { schema: { type: "not-a-type" } })
+  ).toThrow();
+  expect(() =>
+    validate("irrelevant", { schema: { $ref: "#/$defs/missing" } })
+  ).toThrow();
+  expect(() => validate("irrelevant", { schema })).not.toThrow();
+});
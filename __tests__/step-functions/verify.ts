@@ -0,0 +1,132 @@
+import { Event, make as makeEvent } from "../../src/event";
+import { make as makeSign } from "../../src/step-functions/sign";
+import { make, validate } from "../../src/step-functions/verify";
+import { consume } from "../test-utils";
+
+const testParams = {
+  pipelineName: "irrelevant",
+  pipelineSignature: "irrelevant",
+  stepName: "irrelevant",
+};
+
+const trace = [{ i: 1, p: "irrelevant", h: "irrelevant" }];
+
+const sign = async (key: string, events: Event[]): Promise<Event[]> => {
+  const channel = await makeSign(testParams, { key });
+  channel.send(events);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  return output;
+};
+
+test("@standalone Verify forwards events with valid signatures", async () => {
+  // Arrange
+  const signed = await sign("secret", [
+    await makeEvent("a", { x: 1 }, trace),
+    await makeEvent("b", { y: [1, 2] }, trace),
+  ]);
+  const channel = await make(testParams, { keys: ["secret"] });
+  // Act
+  channel.send(signed);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual(signed);
+});
+
+test("@standalone Verify renames tampered and unsigned events", async () => {
+  // Arrange
+  const [signed] = await sign("secret", [
+    await makeEvent("a", { x: 1 }, trace),
+  ]);
+  const tampered = await makeEvent(
+    "a",
+    { ...(signed.data as object), x: 2 },
+    trace
+  );
+  const channel = await make(testParams, { keys: ["secret"] });
+  // Act
+  channel.send([
+    signed,
+    tampered,
+    await makeEvent("a", { x: 1 }, trace),
+    await makeEvent("a", "not an object", trace),
+  ]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output.map((e) => e.name)).toEqual([
+    "a",
+    "a.invalid",
+    "a.invalid",
+    "a.invalid",
+  ]);
+});
+
+test("@standalone Verify accepts signatures of any of the rotated keys", async () => {
+  // Arrange
+  const [oldSigned] = await sign("old", [
+    await makeEvent("a", { x: 1 }, trace),
+  ]);
+  const [newSigned] = await sign("new", [
+    await makeEvent("a", { x: 2 }, trace),
+  ]);
+  const [otherSigned] = await sign("other", [
+    await makeEvent("a", { x: 3 }, trace),
+  ]);
+  const channel = await make(testParams, {
+    keys: ["new", "old"],
+    "on-invalid": "drop",
+  });
+  // Act
+  channel.send([oldSigned, newSigned, otherSigned]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual([oldSigned, newSigned]);
+});
+
+test("@standalone Verify reports tampered events as failures", async () => {
+  // Arrange
+  const failures: [Event[], unknown][] = [];
+  const channel = await make(
+    {
+      ...testParams,
+      reportFailure: async (events, error) => {
+        failures.push([events, error]);
+      },
+    },
+    { keys: ["secret"], "on-invalid": "dead-letter" }
+  );
+  const event = await makeEvent("a", { x: 1, __signature: "forged" }, trace);
+  // Act
+  channel.send([event]);
+  const [output] = await Promise.all([
+    consume(channel.receive),
+    channel.close(),
+  ]);
+  // Assert
+  expect(output).toEqual([]);
+  expect(failures).toEqual([[[event], "the event's signature doesn't match"]]);
+});
+
+test("@standalone Verify options are validated", () => {
+  expect(() =>
+    validate("test", {
+      keys: ["secret"],
+      "on-invalid": "drop",
+      "invalid-suffix": "bad",
+    })
+  ).toThrow();
+  expect(() =>
+    validate("test", { keys: ["secret"], "invalid-suffix": "tampered" })
+  ).not.toThrow();
+});
@@ -1,6 +1,20 @@
 import { consume } from "./test-utils";
-import { make as makeEvent } from "../src/event";
-import { makeWindowingChannel } from "../src/step";
+import {
+  AsyncQueue,
+  OverflowPolicy,
+  activeQueues,
+  flatMap,
+  isCongested,
+} from "../src/async-queue";
+import { Event, make as makeEvent } from "../src/event";
+import {
+  laneOf,
+  makeWindowingChannel,
+  makeWindowed,
+  makeBuffered,
+  makePartitioned,
+  makeConcurrent,
+} from "../src/step";
 import { resolveAfter } from "../src/utils";
 
 test("@standalone A size-1 windowed channel doesn't care about timeouts", async () => {
@@ -109,3 +123,306 @@ test("@standalone A windowed channel uses its timeout to produce partial groups"
   // Assert
   expect(values.map((x) => x.map((y) => y.data))).toEqual([[1, 2], [3], [4]]);
 });
+
+/**
+ * Run a step that takes 20 milliseconds to process each event, behind
+ * a buffer of size 2 with the given policy. Returns the data of the
+ * processed events, the largest count of events queued within the
+ * step, and whether the buffer signaled congestion.
+ */
+const runSlowStep = async (
+  policy: OverflowPolicy
+): Promise<[unknown[], number, boolean]> => {
+  const options = {
+    name: "slow",
+    windowMaxSize: 1,
+    patternMode: "pass" as const,
+    functionMode: "flatmap" as const,
+  };
+  const fn = flatMap(async (events: Event[]) => {
+    await resolveAfter(20);
+    return events;
+  }, new AsyncQueue<Event[]>("step.slow.fn").asChannel());
+  const processed: Event[] = [];
+  const step = await makeBuffered(
+    "slow",
+    { size: 2, policy },
+    makeWindowed(options, fn)
+  )((...events) => processed.push(...events));
+  let maxQueued = 0;
+  const sampling = setInterval(() => {
+    maxQueued = Math.max(
+      maxQueued,
+      Array.from(activeQueues)
+        .filter((queue) => queue.name.startsWith("step.slow."))
+        .map((queue) => queue.data.length)
+        .reduce((a, b) => a + b, 0)
+    );
+  }, 5);
+  const events = await Promise.all(
+    Array.from({ length: 10 }, (_, index) =>
+      makeEvent("test", index + 1, [{ i: 0, p: "test", h: "test" }])
+    )
+  );
+  // Events are sent all at once, faster than the step can handle.
+  step.send(...events);
+  const congested = isCongested();
+  await step.close();
+  clearInterval(sampling);
+  return [processed.map((event) => event.data), maxQueued, congested];
+};
+
+test("@standalone A buffered step with the block policy keeps every event and signals congestion", async () => {
+  // Act
+  const [processed, maxQueued, congested] = await runSlowStep("block");
+  // Assert
+  expect(processed).toEqual([1, 2, 3, 4, 5, 6, 7, 8, 9, 10]);
+  expect(maxQueued).toBeLessThanOrEqual(2);
+  expect(congested).toBe(true);
+  expect(isCongested()).toBe(false);
+});
+
+test("@standalone A buffered step with the drop-newest policy discards events received once full", async () => {
+  // Act
+  const [processed, maxQueued, congested] = await runSlowStep("drop-newest");
+  // Assert
+  expect(processed).toEqual([1, 2]);
+  expect(maxQueued).toBeLessThanOrEqual(2);
+  expect(congested).toBe(false);
+});
+
+test("@standalone A buffered step with the drop-oldest policy discards the oldest events once full", async () => {
+  // Act
+  const [processed, maxQueued, congested] = await runSlowStep("drop-oldest");
+  // Assert
+  expect(processed).toEqual([9, 10]);
+  expect(maxQueued).toBeLessThanOrEqual(2);
+  expect(congested).toBe(false);
+});
+
+/**
+ * Run a step partitioned in 4 lanes by the `tenant` key of each
+ * event's data, which takes a variable time to process each event.
+ * Returns the events processed, along with the lane of each one.
+ */
+const runPartitionedStep = async (
+  events: Event[]
+): Promise<[Event, number][]> => {
+  const options = {
+    name: "partitioned",
+    windowMaxSize: 1,
+    patternMode: "pass" as const,
+    functionMode: "flatmap" as const,
+  };
+  const keys = new AsyncQueue<unknown>("test.keys");
+  const extractor = {
+    send: (...vectors: Event[][]) =>
+      vectors.every((events) =>
+        keys.push(
+          events.map((event) => [(event.data as { tenant: string }).tenant])
+        )
+      ),
+    receive: keys.iterator(),
+    close: async () => keys.close(),
+  };
+  const processed: [Event, number][] = [];
+  const step = await makePartitioned(
+    "partitioned",
+    { lanes: 4, extractor },
+    async (lane) =>
+      makeWindowed(
+        options,
+        flatMap(async (events: Event[]) => {
+          await resolveAfter(Math.random() * 5);
+          events.forEach((event) => processed.push([event, lane]));
+          return events;
+        }, new AsyncQueue<Event[]>("step.partitioned.fn").asChannel())
+      )
+  )(() => {
+    // The forwarded events are ignored.
+  });
+  step.send(...events);
+  await step.close();
+  return processed;
+};
+
+test("@standalone A partitioned step keeps the order of the events with the same key", async () => {
+  // Arrange
+  const tenants = ["a", "b", "c", "d", "e", "f"];
+  const events = await Promise.all(
+    Array.from({ length: 60 }, (_, index) =>
+      makeEvent("test", { tenant: tenants[index % 6], index }, [
+        { i: 0, p: "test", h: "test" },
+      ])
+    )
+  );
+  // Act
+  const processed = await runPartitionedStep(events);
+  // Assert
+  expect(processed.length).toEqual(60);
+  for (const tenant of tenants) {
+    const indices = processed
+      .map(([event]) => event.data as { tenant: string; index: number })
+      .filter((data) => data.tenant === tenant)
+      .map((data) => data.index);
+    expect(indices).toEqual(indices.slice().sort((a, b) => a - b));
+    const lanes = new Set(
+      processed
+        .filter(
+          ([event]) => (event.data as { tenant: string }).tenant === tenant
+        )
+        .map(([, lane]) => lane)
+    );
+    expect(lanes.size).toEqual(1);
+  }
+});
+
+test("@standalone A partitioned step distributes the keys across lanes", async () => {
+  // Arrange
+  const events = await Promise.all(
+    Array.from({ length: 100 }, (_, index) => `tenant-${index}`).map((tenant) =>
+      makeEvent("test", { tenant }, [{ i: 0, p: "test", h: "test" }])
+    )
+  );
+  // Act
+  const processed = await runPartitionedStep(events);
+  // Assert
+  const counts = [0, 1, 2, 3].map(
+    (lane) =>
+      processed.filter(([, processedLane]) => processedLane === lane).length
+  );
+  counts.forEach((count) => expect(count).toBeGreaterThan(10));
+  processed.forEach(([event, lane]) =>
+    expect(lane).toEqual(laneOf((event.data as { tenant: string }).tenant, 4))
+  );
+});
+
+/**
+ * Run a step with concurrent instances of a function that takes the
+ * time given by each event's data to process it. Returns the data of
+ * the events emitted, in the order they were emitted, the
+ * milliseconds it took, and the mean milliseconds it took to emit
+ * each event.
+ */
+const runConcurrentStep = async (
+  delays: number[],
+  ordered: boolean,
+  instances = 4
+): Promise<[number[], number, number]> => {
+  const options = {
+    name: "concurrent",
+    windowMaxSize: 1,
+    patternMode: "pass" as const,
+    functionMode: "flatmap" as const,
+  };
+  const emitted: number[] = [];
+  let latency = 0;
+  let start = 0;
+  const step = await makeWindowed(
+    options,
+    await makeConcurrent("concurrent", { instances, ordered }, async () =>
+      flatMap(async (events: Event[]) => {
+        await resolveAfter(events[0].data as number);
+        return events;
+      }, new AsyncQueue<Event[]>("step.concurrent.fn").asChannel())
+    )
+  )((...events) => {
+    emitted.push(...events.map((e) => e.data as number));
+    latency += (Date.now() - start) * events.length;
+  });
+  const events = await Promise.all(
+    delays.map((delay) =>
+      makeEvent("test", delay, [{ i: 0, p: "test", h: "test" }])
+    )
+  );
+  start = Date.now();
+  step.send(...events);
+  await step.close();
+  return [emitted, Date.now() - start, latency / emitted.length];
+};
+
+test("@standalone A concurrent step resequences its output when ordered", async () => {
+  // Arrange
+  const delays = [50, 1, 2, 3, 40, 4, 5, 6, 30, 7];
+  // Act
+  const [emitted] = await runConcurrentStep(delays, true);
+  // Assert
+  expect(emitted).toEqual(delays);
+});
+
+test("@standalone A concurrent step emits as soon as possible when unordered", async () => {
+  // Arrange
+  const delays = [50, 1, 2, 3, 40, 4, 5, 6, 30, 7];
+  // Act
+  const [emitted] = await runConcurrentStep(delays, false);
+  // Assert
+  expect(emitted.slice().sort((a, b) => a - b)).toEqual(
+    delays.slice().sort((a, b) => a - b)
+  );
+  expect(emitted[0]).not.toEqual(50);
+  expect(emitted[emitted.length - 1]).toEqual(50);
+});
+
+test("@standalone A concurrent step processes vectors in parallel", async () => {
+  // Arrange
+  const delays = Array.from({ length: 20 }, () => 20);
+  // Act
+  const [emitted, elapsed] = await runConcurrentStep(delays, true);
+  // Assert
+  expect(emitted).toHaveLength(20);
+  // Processed one by one, the vectors would take at least 400 ms.
+  expect(elapsed).toBeLessThan(250);
+});
+
+test("@standalone Benchmark ordered and unordered concurrent steps", async () => {
+  // Arrange
+  // Vectors take between 1 and 40 ms, as calls to a remote service
+  // would, with a few slow ones holding back the ordered output.
+  const delays = Array.from({ length: 200 }, (_, i) =>
+    i % 20 === 0 ? 40 : 1 + ((i * 7) % 10)
+  );
+  const levels = [1, 2, 4, 8];
+  // Act
+  const results: {
+    instances: number;
+    ordered: boolean;
+    "events/s": number;
+    "mean latency (ms)": number;
+  }[] = [];
+  for (const instances of levels) {
+    for (const ordered of [true, false]) {
+      const [emitted, elapsed, latency] = await runConcurrentStep(
+        delays,
+        ordered,
+        instances
+      );
+      expect(emitted).toHaveLength(delays.length);
+      results.push({
+        instances,
+        ordered,
+        "events/s": Math.round((emitted.length * 1000) / elapsed),
+        "mean latency (ms)": Math.round(latency),
+      });
+    }
+  }
+  console.table(results);
+  // Assert
+  const rate = (instances: number, ordered: boolean) =>
+    results.find((r) => r.instances === instances && r.ordered === ordered)?.[
+      "events/s"
+    ] ?? 0;
+  const latency = (instances: number, ordered: boolean) =>
+    results.find((r) => r.instances === instances && r.ordered === ordered)?.[
+      "mean latency (ms)"
+    ] ?? Infinity;
+  for (const ordered of [true, false]) {
+    expect(rate(8, ordered)).toBeGreaterThan(rate(1, ordered) * 3);
+  }
+  // Holding events back to order them costs latency, not throughput.
+  for (const instances of levels) {
+    const ratio = rate(instances, false) / rate(instances, true);
+    expect(ratio).toBeGreaterThan(0.8);
+    expect(ratio).toBeLessThan(1.25);
+  }
+  expect(latency(8, false)).toBeLessThan(latency(8, true));
+}, 30000);
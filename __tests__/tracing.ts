@@ -0,0 +1,102 @@
+import {
+  InMemorySpanExporter,
+  SimpleSpanProcessor,
+} from "@opentelemetry/sdk-trace-base";
+import { AsyncQueue, flatMap } from "../src/async-queue";
+import { make as makeEvent, makeFrom, Event } from "../src/event";
+import { run, INPUT_ALIAS } from "../src/pipeline";
+import { makeWindowed } from "../src/step";
+import { startTracing } from "../src/tracing";
+import { resolveAfter } from "../src/utils";
+import { consume } from "./test-utils";
+
+const stepOptions = (name: string) => ({
+  name,
+  windowMaxSize: 1,
+  patternMode: "pass" as const,
+  functionMode: "flatmap" as const,
+});
+
+test("@standalone Tracing records a span tree across pipeline steps", async () => {
+  // Arrange
+  const exporter = new InMemorySpanExporter();
+  const stopTracing = startTracing(new SimpleSpanProcessor(exporter), 1);
+  const pipeline = await run({
+    name: "test",
+    steps: [
+      {
+        name: "split",
+        after: [],
+        // Each event is split in two.
+        factory: makeWindowed(
+          stepOptions("split"),
+          flatMap(
+            async ([event]: Event[]) => [
+              await makeFrom(event, { name: "half.a" }),
+              await makeFrom(event, { name: "half.b" }),
+            ],
+            new AsyncQueue<Event[]>("tracing-test.split").asChannel()
+          )
+        ),
+      },
+      {
+        name: "forward",
+        after: ["split"],
+        factory: makeWindowed(
+          stepOptions("forward"),
+          flatMap(
+            async (events: Event[]) => events,
+            new AsyncQueue<Event[]>("tracing-test.forward").asChannel()
+          )
+        ),
+      },
+    ],
+  });
+  const trace = [{ i: new Date().getTime() / 1000, p: "test", h: "test" }];
+  // Act
+  pipeline.send(await makeEvent("whole", 1, trace));
+  const [output] = await Promise.all([
+    consume(pipeline.receive),
+    resolveAfter(10).then(() => pipeline.close()),
+  ]);
+  const spans = exporter.getFinishedSpans();
+  await stopTracing();
+  // Assert
+  expect(output.map((e) => e.name).sort()).toEqual(["half.a", "half.b"]);
+  const [inputSpan] = spans.filter((span) => span.name === INPUT_ALIAS);
+  const splitSpans = spans.filter((span) => span.name === "split");
+  const forwardSpans = spans.filter((span) => span.name === "forward");
+  expect(spans).toHaveLength(5);
+  expect(inputSpan.parentSpanId).toBeUndefined();
+  expect(inputSpan.attributes["cdp.event.name"]).toEqual("whole");
+  // Both halves are children of the input's span.
+  expect(splitSpans).toHaveLength(2);
+  for (const span of splitSpans) {
+    expect(span.parentSpanId).toEqual(inputSpan.spanContext().spanId);
+  }
+  expect(
+    splitSpans.map((span) => span.attributes["cdp.event.name"]).sort()
+  ).toEqual(["half.a", "half.b"]);
+  // Each forwarded half is a child of the span that produced it.
+  expect(forwardSpans).toHaveLength(2);
+  for (const span of forwardSpans) {
+    const [parent] = splitSpans.filter(
+      (splitSpan) => splitSpan.spanContext().spanId === span.parentSpanId
+    );
+    expect(parent.attributes["cdp.event.name"]).toEqual(
+      span.attributes["cdp.event.name"]
+    );
+  }
+  // Every span belongs to the same trace.
+  expect(
+    new Set(spans.map((span) => span.spanContext().traceId)).size
+  ).toEqual(1);
+  // Emitted events carry the trace context of their latest span.
+  for (const event of output) {
+    expect(
+      forwardSpans.some(
+        (span) => span.spanContext().spanId === event.spanContext?.spanId
+      )
+    ).toBe(true);
+  }
+});
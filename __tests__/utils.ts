@@ -1,3 +1,4 @@
+import fs from "fs";
 import * as utils from "../src/utils";
 
 // Mock for console.error.
@@ -38,6 +39,16 @@ test("@standalone Signatures are distinct", async () => {
   expect(s2).not.toEqual(s3);
 });
 
+test("@standalone Canonical serializations don't depend on key order", () => {
+  const s1 = utils.canonicalize({ b: [1, { d: null, c: "x" }], a: true });
+  const s2 = utils.canonicalize({ a: true, b: [1, { c: "x", d: null }] });
+  expect(s1).toEqual(s2);
+  expect(s1).toEqual('{"a":true,"b":[1,{"c":"x","d":null}]}');
+  expect(utils.canonicalize({ a: undefined, b: [undefined] })).toEqual(
+    '{"b":[null]}'
+  );
+});
+
 test("@standalone Environment variables can be replaced in objects", () => {
   const obj = {
     foo: "bar ${NODE_ENV}",
@@ -55,6 +66,117 @@ test("@standalone Environment variables can be replaced in objects", () => {
   });
 });
 
+test("@standalone Placeholders are interpolated from the environment", () => {
+  // Arrange
+  process.env.CDP_TEST_URL = "amqp://broker";
+  process.env.CDP_TEST_EMPTY = "";
+  const pipeline = {
+    input: { amqp: { url: "${CDP_TEST_URL}/vhost" } },
+    steps: {
+      a: { flatmap: { "send-amqp": { url: "${env:CDP_TEST_URL}" } } },
+      b: { flatmap: { "send-http": "${env:CDP_TEST_MISSING:-http://x}" } },
+      c: { flatmap: { "send-http": "${env:CDP_TEST_EMPTY:-http://y}" } },
+      d: { flatmap: { "send-stdout": { "jq-expr": "\"${CDP_TEST_URL}\"" } } },
+      e: { reduce: { "send-receive-jq": "${CDP_TEST_URL}" } },
+    },
+    "jsonnet-prelude": "local x = '${CDP_TEST_URL}';",
+    escaped: ["$${CDP_TEST_URL}", 1, true, null],
+  };
+  // Act
+  const interpolated = utils.interpolate(pipeline);
+  delete process.env.CDP_TEST_URL;
+  delete process.env.CDP_TEST_EMPTY;
+  // Assert
+  expect(interpolated).toEqual({
+    input: { amqp: { url: "amqp://broker/vhost" } },
+    steps: {
+      a: { flatmap: { "send-amqp": { url: "amqp://broker" } } },
+      b: { flatmap: { "send-http": "http://x" } },
+      c: { flatmap: { "send-http": "http://y" } },
+      d: { flatmap: { "send-stdout": { "jq-expr": "\"${CDP_TEST_URL}\"" } } },
+      e: { reduce: { "send-receive-jq": "${CDP_TEST_URL}" } },
+    },
+    "jsonnet-prelude": "local x = '${CDP_TEST_URL}';",
+    escaped: ["${CDP_TEST_URL}", 1, true, null],
+  });
+});
+
+test("@standalone Placeholders are left untouched in code and regular expressions", () => {
+  // Arrange
+  process.env.CDP_TEST_URL = "amqp://broker";
+  const steps = {
+    a: { flatmap: { "send-stdout": { "jq-expr": "\"${CDP_TEST_URL}\"" } } },
+    b: { flatmap: { "send-amqp": { "key-jq-expr": "\"${CDP_TEST_URL}\"" } } },
+    c: { flatmap: { jsonnet: "'${CDP_TEST_URL}'" } },
+    d: { flatmap: { jsonnet: { "jsonnet-expr": "'${CDP_TEST_URL}'" } } },
+    e: { flatmap: { lua: "return '${CDP_TEST_URL}'" } },
+    f: { flatmap: { lua: { "lua-script": "return '${CDP_TEST_URL}'" } } },
+    g: { flatmap: { "parse-regex": { pattern: "^(?<a>.*)${CDP_TEST_URL}$" } } },
+    h: { pattern: "${CDP_TEST_URL}", flatmap: { keep: 1 } },
+  };
+  // Act
+  const interpolated = utils.interpolate({
+    steps,
+    url: "${CDP_TEST_URL}",
+    lua: { concurrency: "${env:CDP_TEST_CONCURRENCY:-2}" },
+  });
+  delete process.env.CDP_TEST_URL;
+  // Assert
+  expect(interpolated).toEqual({
+    steps,
+    url: "amqp://broker",
+    lua: { concurrency: "2" },
+  });
+});
+
+test("@standalone Placeholders are interpolated from files", () => {
+  // Arrange
+  const dir = fs.mkdtempSync("/tmp/cdp-tests-");
+  fs.writeFileSync(`${dir}/password`, "s3cr3t\n");
+  // Act
+  const interpolated = utils.interpolate({
+    password: `\${file:${dir}/password}`,
+  });
+  fs.rmSync(dir, { recursive: true });
+  // Assert
+  expect(interpolated).toEqual({ password: "s3cr3t" });
+});
+
+test("@standalone Interpolation fails on unset variables and missing files", () => {
+  // Act & assert
+  expect(() =>
+    utils.interpolate({ steps: { a: { url: ["${CDP_TEST_MISSING}"] } } })
+  ).toThrow(
+    "the pipeline's steps.a.url[0] references the environment variable " +
+      "CDP_TEST_MISSING, which is unset"
+  );
+  expect(() =>
+    utils.interpolate({ key: "${file:/nonexistent/cdp-secret}" })
+  ).toThrow("the pipeline's key references the file /nonexistent/cdp-secret");
+});
+
+test("@standalone Secret keys must be given through placeholders", () => {
+  // Arrange
+  const step = (identities: string[]) => ({
+    steps: { a: { flatmap: { decrypt: { identities } } } },
+  });
+  // Act & assert
+  expect(() =>
+    utils.checkSecretPlaceholders(
+      step(["${file:/run/secrets/key}", "${AGE_KEY}", "${env:OLD_KEY}"])
+    )
+  ).not.toThrow();
+  expect(() =>
+    utils.checkSecretPlaceholders(step(["${AGE_KEY}", "AGE-SECRET-KEY-1X"]))
+  ).toThrow(
+    "the pipeline's steps.a.flatmap.decrypt.identities[1] must be given " +
+      "through a placeholder"
+  );
+  expect(() =>
+    utils.checkSecretPlaceholders(step(["${env:AGE_KEY:-AGE-SECRET-KEY-1X}"]))
+  ).toThrow("must be given through a placeholder");
+});
+
 test("@standalone Fuses can guard a single executor at a time", async () => {
   // Arrange
   const openFuse = utils.makeFuse();
@@ -0,0 +1,135 @@
+import { Pattern, match } from "./pattern";
+import { INPUT_ALIAS } from "./pipeline";
+
+/**
+ * The names of the events that may flow somewhere in a pipeline, as
+ * far as they can be known without running it. A null value stands
+ * for names that can't be known (e.g. names given by a remote
+ * source, or by a jq program).
+ */
+export type EventNames = string[] | null;
+
+/**
+ * A step of a pipeline, reduced to what's needed to follow the names
+ * of events across the pipeline.
+ */
+export interface AnalysisStep {
+  name: string;
+  after: string[];
+  pattern?: Pattern;
+  patternMode: "pass" | "drop";
+  emits: (names: EventNames) => EventNames;
+}
+
+/**
+ * The findings of the analysis. Errors are certain mistakes in the
+ * pipeline, while warnings are likely ones.
+ */
+export interface AnalysisReport {
+  errors: string[];
+  warnings: string[];
+}
+
+/**
+ * Joins several sets of event names, keeping the first appearance of
+ * each name.
+ *
+ * @param sets The sets of event names to join.
+ * @returns The joined set of event names.
+ */
+export const union = (...sets: EventNames[]): EventNames =>
+  sets.some((names) => names === null)
+    ? null
+    : Array.from(new Set((sets as string[][]).flat()));
+
+/**
+ * Formats a list of event names for a finding's message.
+ *
+ * @param names The event names.
+ * @returns The formatted names.
+ */
+const quoted = (names: string[]): string =>
+  names.map((name) => `'${name}'`).join(", ");
+
+/**
+ * Follows the names of events across a pipeline, from the input to
+ * every step, and reports the steps that can't receive any event,
+ * the patterns that can't match any event they're given, and the
+ * events that are emitted only to be dropped by every step that
+ * follows. The steps are expected to form a proper DAG already.
+ *
+ * @param inputNames The names of the events the input may produce.
+ * @param steps The steps of the pipeline.
+ * @returns The report of the findings.
+ */
+export const analyze = (
+  inputNames: EventNames,
+  steps: AnalysisStep[]
+): AnalysisReport => {
+  const report: AnalysisReport = { errors: [], warnings: [] };
+  const stepMap = new Map(steps.map((step) => [step.name, step]));
+  const dependencies = (step: AnalysisStep): string[] =>
+    step.after.length === 0 ? [INPUT_ALIAS] : step.after;
+  // The names emitted by each node are computed after those of its
+  // dependencies.
+  const emitted: Map<string, EventNames> = new Map([
+    [INPUT_ALIAS, inputNames],
+  ]);
+  const resolve = (name: string): EventNames => {
+    if (emitted.has(name)) {
+      return emitted.get(name) as EventNames;
+    }
+    const step = stepMap.get(name) as AnalysisStep;
+    const received = union(...dependencies(step).map(resolve));
+    const matched =
+      received === null || typeof step.pattern === "undefined"
+        ? received
+        : received.filter((n) => match(n, step.pattern as Pattern));
+    const forwarded =
+      received === null || step.patternMode === "drop"
+        ? []
+        : received.filter((n) => !(matched as string[]).includes(n));
+    if (received !== null && received.length === 0) {
+      report.errors.push(
+        `step '${name}' is unreachable: no events can reach it`
+      );
+    } else if (matched !== null && matched.length === 0) {
+      report.warnings.push(
+        `step '${name}' has a pattern that doesn't match any of the ` +
+          `events that can reach it (${quoted(received as string[])})`
+      );
+    }
+    const names =
+      matched !== null && matched.length === 0
+        ? forwarded
+        : union(step.emits(matched), forwarded);
+    emitted.set(name, names);
+    return names;
+  };
+  steps.forEach(({ name }) => resolve(name));
+  // Check for events that are emitted towards steps that drop all
+  // of them.
+  for (const [name, names] of emitted.entries()) {
+    const followers = steps.filter((step) =>
+      dependencies(step).includes(name)
+    );
+    if (names === null || followers.length === 0) {
+      continue;
+    }
+    const dropped = names.filter((n) =>
+      followers.every(
+        (step) =>
+          step.patternMode === "drop" &&
+          typeof step.pattern !== "undefined" &&
+          !match(n, step.pattern)
+      )
+    );
+    if (dropped.length > 0) {
+      report.warnings.push(
+        `${name === INPUT_ALIAS ? "the input" : `step '${name}'`} emits ` +
+          `events that every step after it drops (${quoted(dropped)})`
+      );
+    }
+  }
+  return report;
+};
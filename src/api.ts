@@ -1,21 +1,46 @@
 import { match, P } from "ts-pattern";
-import { flatMap, compose } from "./async-queue";
-import { INPUT_DRAIN_TIMEOUT, HEALTH_CHECK_INTERVAL } from "./conf";
-import { Event } from "./event";
-import { processor as jqProcessor } from "./io/jq";
+import { AnalysisReport, EventNames, analyze, union } from "./analysis";
+import { Channel, OverflowPolicy, drain } from "./async-queue";
+import {
+  INPUT_DRAIN_TIMEOUT,
+  HEALTH_CHECK_INTERVAL,
+  PREFLIGHT_TIMEOUT,
+  SHUTDOWN_DRAIN_TIMEOUT,
+} from "./conf";
+import { makeFailureRouting } from "./dead-letter";
+import { Event, WrapDirective } from "./event";
+import {
+  checkProgram as checkJqProgram,
+  processor as jqProcessor,
+} from "./io/jq";
 import { processor as jsonnetProcessor } from "./io/jsonnet";
+import { processor as luaProcessor } from "./io/lua";
 import { makeLogger } from "./log";
 import {
   pipelineEvents,
   stepEvents,
   deadEvents,
+  inputEvents,
   startExposingMetrics,
 } from "./metrics";
-import { Pattern, patternSchema, isValidPattern } from "./pattern";
+import {
+  Pattern,
+  patternSchema,
+  isValidPattern,
+  isValidEventName,
+} from "./pattern";
 import { StepDefinition, Pipeline, validate, run } from "./pipeline";
-import { makeWindowed } from "./step";
+import {
+  makeWindowed,
+  makeBuffered,
+  makePartitioned,
+  makeConcurrent,
+} from "./step";
+import { makeExtractionProgram, StepFunctionModule } from "./step-functions";
+import { startTracing } from "./tracing";
 import { compileThrowing, check, getSignature, resolveAfter } from "./utils";
 // Input forms
+import { InputModule } from "./input";
 import * as generatorInputModule from "./input/generator";
 import { GeneratorInputOptions } from "./input/generator";
 import * as stdinInputModule from "./input/stdin";
@@ -32,23 +57,121 @@ import * as mqttInputModule from "./input/mqtt";
 import { MQTTInputOptions } from "./input/mqtt";
 import * as redisInputModule from "./input/redis";
 import { RedisInputOptions } from "./input/redis";
+import * as kafkaInputModule from "./input/kafka";
+import { KafkaInputOptions } from "./input/kafka";
+import * as natsInputModule from "./input/nats";
+import { NATSInputOptions } from "./input/nats";
+import * as postgresInputModule from "./input/postgres";
+import { PostgresInputOptions } from "./input/postgres";
+import * as csvInputModule from "./input/csv";
+import { CSVInputOptions } from "./input/csv";
+import * as replayInputModule from "./input/replay";
+import { ReplayInputOptions } from "./input/replay";
+import * as websocketInputModule from "./input/websocket";
+import { WebSocketInputOptions } from "./input/websocket";
+import * as sqsInputModule from "./input/sqs";
+import { SQSInputOptions } from "./input/sqs";
+import * as pubsubInputModule from "./input/pubsub";
+import { PubSubInputOptions } from "./input/pubsub";
+import * as tcpInputModule from "./input/tcp";
+import { TCPInputOptions } from "./input/tcp";
+import * as udpInputModule from "./input/udp";
+import { UDPInputOptions } from "./input/udp";
 // Step functions
 import * as deduplicateFunctionModule from "./step-functions/deduplicate";
 import { DeduplicateFunctionOptions } from "./step-functions/deduplicate";
+import * as sampleFunctionModule from "./step-functions/sample";
+import { SampleFunctionOptions } from "./step-functions/sample";
+import * as tapFunctionModule from "./step-functions/tap";
+import { TapFunctionOptions } from "./step-functions/tap";
+import * as mirrorFunctionModule from "./step-functions/mirror";
+import { MirrorFunctionOptions } from "./step-functions/mirror";
 import * as keepFunctionModule from "./step-functions/keep";
 import { KeepFunctionOptions } from "./step-functions/keep";
 import * as keepWhenFunctionModule from "./step-functions/keep-when";
 import { KeepWhenFunctionOptions } from "./step-functions/keep-when";
+import * as timeWindowFunctionModule from "./step-functions/time-window";
+import { TimeWindowFunctionOptions } from "./step-functions/time-window";
+import * as aggregateFunctionModule from "./step-functions/aggregate";
+import { AggregateFunctionOptions } from "./step-functions/aggregate";
+import * as reorderFunctionModule from "./step-functions/reorder";
+import { ReorderFunctionOptions } from "./step-functions/reorder";
+import * as ttlFunctionModule from "./step-functions/ttl";
+import { TTLFunctionOptions } from "./step-functions/ttl";
+import * as throttleFunctionModule from "./step-functions/throttle";
+import { ThrottleFunctionOptions } from "./step-functions/throttle";
+import * as delayFunctionModule from "./step-functions/delay";
+import { DelayFunctionOptions } from "./step-functions/delay";
+import * as batchFunctionModule from "./step-functions/batch";
+import { BatchFunctionOptions } from "./step-functions/batch";
+import * as debatchFunctionModule from "./step-functions/debatch";
+import { DebatchFunctionOptions } from "./step-functions/debatch";
+import * as enrichHTTPFunctionModule from "./step-functions/enrich-http";
+import { EnrichHTTPFunctionOptions } from "./step-functions/enrich-http";
+import * as geoIPFunctionModule from "./step-functions/geoip";
+import { GeoIPFunctionOptions } from "./step-functions/geoip";
+import * as switchFunctionModule from "./step-functions/switch";
+import { SwitchFunctionOptions } from "./step-functions/switch";
+import * as mergeFunctionModule from "./step-functions/merge";
+import { MergeFunctionOptions } from "./step-functions/merge";
+import * as compressFunctionModule from "./step-functions/compress";
+import { CompressFunctionOptions } from "./step-functions/compress";
+import * as decompressFunctionModule from "./step-functions/decompress";
+import { DecompressFunctionOptions } from "./step-functions/decompress";
+import * as decodeAvroFunctionModule from "./step-functions/decode-avro";
+import { DecodeAvroFunctionOptions } from "./step-functions/decode-avro";
+import * as encodeAvroFunctionModule from "./step-functions/encode-avro";
+import { EncodeAvroFunctionOptions } from "./step-functions/encode-avro";
+import * as decodeProtobufFunctionModule from "./step-functions/decode-protobuf";
+import { DecodeProtobufFunctionOptions } from "./step-functions/decode-protobuf";
+import * as signFunctionModule from "./step-functions/sign";
+import { SignFunctionOptions } from "./step-functions/sign";
+import * as verifyFunctionModule from "./step-functions/verify";
+import { VerifyFunctionOptions } from "./step-functions/verify";
+import * as encryptFunctionModule from "./step-functions/encrypt";
+import { EncryptFunctionOptions } from "./step-functions/encrypt";
+import * as decryptFunctionModule from "./step-functions/decrypt";
+import { DecryptFunctionOptions } from "./step-functions/decrypt";
+import * as flattenFunctionModule from "./step-functions/flatten";
+import { FlattenFunctionOptions } from "./step-functions/flatten";
+import * as unflattenFunctionModule from "./step-functions/unflatten";
+import { UnflattenFunctionOptions } from "./step-functions/unflatten";
+import * as redactFunctionModule from "./step-functions/redact";
+import { RedactFunctionOptions } from "./step-functions/redact";
+import * as parseRegexFunctionModule from "./step-functions/parse-regex";
+import { ParseRegexFunctionOptions } from "./step-functions/parse-regex";
+import * as validateSchemaFunctionModule from "./step-functions/validate-schema";
+import { ValidateSchemaFunctionOptions } from "./step-functions/validate-schema";
 import * as renameFunctionModule from "./step-functions/rename";
 import { RenameFunctionOptions } from "./step-functions/rename";
 import * as exposeHTTPFunctionModule from "./step-functions/expose-http";
 import { ExposeHTTPFunctionOptions } from "./step-functions/expose-http";
+import * as exposeSSEFunctionModule from "./step-functions/expose-sse";
+import { ExposeSSEFunctionOptions } from "./step-functions/expose-sse";
+import * as sendWebSocketFunctionModule from "./step-functions/send-websocket";
+import { SendWebSocketFunctionOptions } from "./step-functions/send-websocket";
 import * as sendAMQPFunctionModule from "./step-functions/send-amqp";
 import { SendAMQPFunctionOptions } from "./step-functions/send-amqp";
 import * as sendMQTTFunctionModule from "./step-functions/send-mqtt";
 import { SendMQTTFunctionOptions } from "./step-functions/send-mqtt";
 import * as sendRedisFunctionModule from "./step-functions/send-redis";
 import { SendRedisFunctionOptions } from "./step-functions/send-redis";
+import * as sendKafkaFunctionModule from "./step-functions/send-kafka";
+import { SendKafkaFunctionOptions } from "./step-functions/send-kafka";
+import * as sendNATSFunctionModule from "./step-functions/send-nats";
+import { SendNATSFunctionOptions } from "./step-functions/send-nats";
+import * as sendElasticsearchFunctionModule from "./step-functions/send-elasticsearch";
+import { SendElasticsearchFunctionOptions } from "./step-functions/send-elasticsearch";
+import * as sendPrometheusFunctionModule from "./step-functions/send-prometheus";
+import { SendPrometheusFunctionOptions } from "./step-functions/send-prometheus";
+import * as sendS3FunctionModule from "./step-functions/send-s3";
+import { SendS3FunctionOptions } from "./step-functions/send-s3";
+import * as sendSQSFunctionModule from "./step-functions/send-sqs";
+import { SendSQSFunctionOptions } from "./step-functions/send-sqs";
+import * as sendPubSubFunctionModule from "./step-functions/send-pubsub";
+import { SendPubSubFunctionOptions } from "./step-functions/send-pubsub";
+import * as sendWebhookFunctionModule from "./step-functions/send-webhook";
+import { SendWebhookFunctionOptions } from "./step-functions/send-webhook";
 import * as sendHTTPFunctionModule from "./step-functions/send-http";
 import { SendHTTPFunctionOptions } from "./step-functions/send-http";
 import * as sendReceiveHTTPFunctionModule from "./step-functions/send-receive-http";
@@ -57,8 +180,16 @@ import * as sendReceiveJqFunctionModule from "./step-functions/send-receive-jq";
 import { SendReceiveJqFunctionOptions } from "./step-functions/send-receive-jq";
 import * as sendReceiveJsonnetFunctionModule from "./step-functions/send-receive-jsonnet";
 import { SendReceiveJsonnetFunctionOptions } from "./step-functions/send-receive-jsonnet";
+import * as jsonnetFunctionModule from "./step-functions/jsonnet";
+import { JsonnetFunctionOptions } from "./step-functions/jsonnet";
+import * as luaFunctionModule from "./step-functions/lua";
+import { LuaFunctionOptions } from "./step-functions/lua";
 import * as sendFileFunctionModule from "./step-functions/send-file";
 import { SendFileFunctionOptions } from "./step-functions/send-file";
+import * as sendCSVFunctionModule from "./step-functions/send-csv";
+import { SendCSVFunctionOptions } from "./step-functions/send-csv";
+import * as recordFunctionModule from "./step-functions/record";
+import { RecordFunctionOptions } from "./step-functions/record";
 import * as sendSTDOUTFunctionModule from "./step-functions/send-stdout";
 import { SendSTDOUTFunctionOptions } from "./step-functions/send-stdout";
 
@@ -84,9 +215,11 @@ const makeWrapperSchema = (key: string, schema: object) => ({
 
 /**
  * Input modules available. Each provides an `optionsSchema` object,
- * and `validate` and `make` functions.
+ * and `validate` and `make` functions. Some also provide an `emits`
+ * function, used to analyze pipelines. Extensions are added with
+ * `registerInput`.
  */
-const inputModules = {
+const inputModules: { [name: string]: InputModule } = {
   generator: generatorInputModule,
   stdin: stdinInputModule,
   tail: tailInputModule,
@@ -95,6 +228,16 @@ const inputModules = {
   amqp: amqpInputModule,
   mqtt: mqttInputModule,
   redis: redisInputModule,
+  kafka: kafkaInputModule,
+  nats: natsInputModule,
+  postgres: postgresInputModule,
+  csv: csvInputModule,
+  replay: replayInputModule,
+  websocket: websocketInputModule,
+  sqs: sqsInputModule,
+  pubsub: pubsubInputModule,
+  tcp: tcpInputModule,
+  udp: udpInputModule,
 };
 
 /**
@@ -108,31 +251,89 @@ type InputTemplate =
   | { poll: PollInputOptions }
   | { amqp: AMQPInputOptions }
   | { mqtt: MQTTInputOptions }
-  | { redis: RedisInputOptions };
-const inputTemplateSchema = {
+  | { redis: RedisInputOptions }
+  | { kafka: KafkaInputOptions }
+  | { nats: NATSInputOptions }
+  | { postgres: PostgresInputOptions }
+  | { csv: CSVInputOptions }
+  | { replay: ReplayInputOptions }
+  | { websocket: WebSocketInputOptions }
+  | { sqs: SQSInputOptions }
+  | { pubsub: PubSubInputOptions }
+  | { tcp: TCPInputOptions }
+  | { udp: UDPInputOptions };
+const makeInputTemplateSchema = () => ({
   anyOf: Object.entries(inputModules).map(([key, mod]) =>
     makeWrapperSchema(key, mod.optionsSchema)
   ),
-};
+});
 
 /**
  * Step function modules available. Each provides an `optionsSchema`
  * object, a `validate` function, and a `make` asynchronous function.
+ * Those that rename events also provide an `emits` function, used to
+ * analyze pipelines, those that honor the step's timeout declare it
+ * with a `supportsTimeout` flag, and those that may run concurrent
+ * instances declare it with a `stateless` flag. Extensions are added
+ * with `registerStepFunction`.
  */
-const stepFunctionModules = {
+const stepFunctionModules: { [name: string]: StepFunctionModule } = {
   rename: renameFunctionModule,
   deduplicate: deduplicateFunctionModule,
+  sample: sampleFunctionModule,
+  tap: tapFunctionModule,
+  mirror: mirrorFunctionModule,
   keep: keepFunctionModule,
   "keep-when": keepWhenFunctionModule,
+  "validate-schema": validateSchemaFunctionModule,
+  "time-window": timeWindowFunctionModule,
+  aggregate: aggregateFunctionModule,
+  reorder: reorderFunctionModule,
+  ttl: ttlFunctionModule,
+  throttle: throttleFunctionModule,
+  delay: delayFunctionModule,
+  batch: batchFunctionModule,
+  debatch: debatchFunctionModule,
+  "enrich-http": enrichHTTPFunctionModule,
+  geoip: geoIPFunctionModule,
+  switch: switchFunctionModule,
+  merge: mergeFunctionModule,
+  compress: compressFunctionModule,
+  decompress: decompressFunctionModule,
+  "decode-avro": decodeAvroFunctionModule,
+  "encode-avro": encodeAvroFunctionModule,
+  "decode-protobuf": decodeProtobufFunctionModule,
+  sign: signFunctionModule,
+  verify: verifyFunctionModule,
+  encrypt: encryptFunctionModule,
+  decrypt: decryptFunctionModule,
+  flatten: flattenFunctionModule,
+  unflatten: unflattenFunctionModule,
+  redact: redactFunctionModule,
+  "parse-regex": parseRegexFunctionModule,
   "send-stdout": sendSTDOUTFunctionModule,
   "send-file": sendFileFunctionModule,
+  "send-csv": sendCSVFunctionModule,
+  record: recordFunctionModule,
   "send-http": sendHTTPFunctionModule,
   "send-amqp": sendAMQPFunctionModule,
   "send-mqtt": sendMQTTFunctionModule,
   "send-redis": sendRedisFunctionModule,
+  "send-kafka": sendKafkaFunctionModule,
+  "send-nats": sendNATSFunctionModule,
+  "send-elasticsearch": sendElasticsearchFunctionModule,
+  "send-prometheus": sendPrometheusFunctionModule,
+  "send-s3": sendS3FunctionModule,
+  "send-sqs": sendSQSFunctionModule,
+  "send-pubsub": sendPubSubFunctionModule,
+  "send-webhook": sendWebhookFunctionModule,
   "expose-http": exposeHTTPFunctionModule,
+  "expose-sse": exposeSSEFunctionModule,
+  "send-websocket": sendWebSocketFunctionModule,
   "send-receive-jq": sendReceiveJqFunctionModule,
   "send-receive-jsonnet": sendReceiveJsonnetFunctionModule,
+  jsonnet: jsonnetFunctionModule,
+  lua: luaFunctionModule,
   "send-receive-http": sendReceiveHTTPFunctionModule,
 };
 
@@ -142,22 +343,87 @@ const stepFunctionModules = {
 type StepFunctionTemplate =
   | { rename: RenameFunctionOptions }
   | { deduplicate: DeduplicateFunctionOptions }
+  | { sample: SampleFunctionOptions }
+  | { tap: TapFunctionOptions }
+  | { mirror: MirrorFunctionOptions }
   | { keep: KeepFunctionOptions }
   | { "keep-when": KeepWhenFunctionOptions }
+  | { "validate-schema": ValidateSchemaFunctionOptions }
+  | { "time-window": TimeWindowFunctionOptions }
+  | { aggregate: AggregateFunctionOptions }
+  | { reorder: ReorderFunctionOptions }
+  | { ttl: TTLFunctionOptions }
+  | { throttle: ThrottleFunctionOptions }
+  | { delay: DelayFunctionOptions }
+  | { batch: BatchFunctionOptions }
+  | { debatch: DebatchFunctionOptions }
+  | { "enrich-http": EnrichHTTPFunctionOptions }
+  | { geoip: GeoIPFunctionOptions }
+  | { switch: SwitchFunctionOptions }
+  | { merge: MergeFunctionOptions }
+  | { compress: CompressFunctionOptions }
+  | { decompress: DecompressFunctionOptions }
+  | { "decode-avro": DecodeAvroFunctionOptions }
+  | { "encode-avro": EncodeAvroFunctionOptions }
+  | { "decode-protobuf": DecodeProtobufFunctionOptions }
+  | { sign: SignFunctionOptions }
+  | { verify: VerifyFunctionOptions }
+  | { encrypt: EncryptFunctionOptions }
+  | { decrypt: DecryptFunctionOptions }
+  | { flatten: FlattenFunctionOptions }
+  | { unflatten: UnflattenFunctionOptions }
+  | { redact: RedactFunctionOptions }
+  | { "parse-regex": ParseRegexFunctionOptions }
   | { "send-stdout": SendSTDOUTFunctionOptions }
   | { "send-file": SendFileFunctionOptions }
+  | { "send-csv": SendCSVFunctionOptions }
+  | { record: RecordFunctionOptions }
   | { "send-http": SendHTTPFunctionOptions }
   | { "send-amqp": SendAMQPFunctionOptions }
   | { "send-mqtt": SendMQTTFunctionOptions }
   | { "send-redis": SendRedisFunctionOptions }
+  | { "send-kafka": SendKafkaFunctionOptions }
+  | { "send-nats": SendNATSFunctionOptions }
+  | { "send-elasticsearch": SendElasticsearchFunctionOptions }
+  | { "send-prometheus": SendPrometheusFunctionOptions }
+  | { "send-s3": SendS3FunctionOptions }
+  | { "send-sqs": SendSQSFunctionOptions }
+  | { "send-pubsub": SendPubSubFunctionOptions }
+  | { "send-webhook": SendWebhookFunctionOptions }
   | { "expose-http": ExposeHTTPFunctionOptions }
+  | { "expose-sse": ExposeSSEFunctionOptions }
+  | { "send-websocket": SendWebSocketFunctionOptions }
   | { "send-receive-jq": SendReceiveJqFunctionOptions }
   | { "send-receive-jsonnet": SendReceiveJsonnetFunctionOptions }
+  | { jsonnet: JsonnetFunctionOptions }
+  | { lua: LuaFunctionOptions }
   | { "send-receive-http": SendReceiveHTTPFunctionOptions };
-const stepFunctionTemplateSchema = {
+const makeStepFunctionTemplateSchema = () => ({
   anyOf: Object.entries(stepFunctionModules).map(([key, mod]) =>
     makeWrapperSchema(key, mod.optionsSchema)
   ),
+});
+
+/**
+ * The options of the buffer placed in front of a step.
+ */
+interface BufferTemplate {
+  size: number | string;
+  policy?: OverflowPolicy;
+}
+const bufferTemplateSchema = {
+  type: "object",
+  properties: {
+    size: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    policy: { enum: ["block", "drop-newest", "drop-oldest"] },
+  },
+  additionalProperties: false,
+  required: ["size"],
 };
 
 /**
@@ -169,9 +435,22 @@ interface PipelineTemplate {
   input: InputTemplate;
   "jq-prelude"?: string;
   "jsonnet-prelude"?: string;
+  "dead-letter"?: string;
+  buffer?: BufferTemplate;
   steps?: {
     [key: string]: {
       after?: string[];
+      "dead-letter"?: string;
+      buffer?: BufferTemplate;
+      timeout?: number | string;
+      partition?: {
+        lanes: number | string;
+        "key-jq-expr": string;
+      };
+      concurrency?: {
+        instances: number | string;
+        ordered?: boolean;
+      };
       ["match/drop"]?: Pattern;
       ["match/pass"]?: Pattern;
       window?: {
@@ -183,56 +462,194 @@ interface PipelineTemplate {
     };
   };
 }
-const pipelineTemplateSchema = {
-  type: "object",
-  properties: {
-    name: { type: "string", minLength: 1 },
-    input: inputTemplateSchema,
-    "jq-prelude": { type: "string", minLength: 1 },
-    "jsonnet-prelude": { type: "string", minLength: 1 },
-    steps: {
-      type: "object",
-      properties: {},
-      additionalProperties: {
+const makePipelineTemplateSchema = () => {
+  const stepFunctionTemplateSchema = makeStepFunctionTemplateSchema();
+  return {
+    type: "object",
+    properties: {
+      name: { type: "string", minLength: 1 },
+      input: makeInputTemplateSchema(),
+      "jq-prelude": { type: "string", minLength: 1 },
+      "jsonnet-prelude": { type: "string", minLength: 1 },
+      "dead-letter": { type: "string", minLength: 1 },
+      buffer: bufferTemplateSchema,
+      steps: {
         type: "object",
-        properties: {
-          after: { type: "array", items: { type: "string", minLength: 1 } },
-          "match/drop": patternSchema,
-          "match/pass": patternSchema,
-          window: {
-            type: "object",
-            properties: {
-              events: {
-                anyOf: [
-                  { type: "integer", minimum: 1 },
-                  { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
-                ],
+        properties: {},
+        additionalProperties: {
+          type: "object",
+          properties: {
+            after: { type: "array", items: { type: "string", minLength: 1 } },
+            "dead-letter": { type: "string", minLength: 1 },
+            buffer: bufferTemplateSchema,
+            timeout: {
+              anyOf: [
+                { type: "number", exclusiveMinimum: 0 },
+                { type: "string", pattern: "^[0-9]+\\.?[0-9]*$" },
+              ],
+            },
+            partition: {
+              type: "object",
+              properties: {
+                lanes: {
+                  anyOf: [
+                    { type: "integer", minimum: 1 },
+                    { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+                  ],
+                },
+                "key-jq-expr": { type: "string", minLength: 1 },
+              },
+              additionalProperties: false,
+              required: ["lanes", "key-jq-expr"],
+            },
+            concurrency: {
+              type: "object",
+              properties: {
+                instances: {
+                  anyOf: [
+                    { type: "integer", minimum: 1 },
+                    { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+                  ],
+                },
+                ordered: { type: "boolean" },
               },
-              seconds: {
-                anyOf: [
-                  { type: "number", exclusiveMinimum: 0 },
-                  { type: "string", pattern: "^[0-9]+\\.?[0-9]*$" },
-                ],
+              additionalProperties: false,
+              required: ["instances"],
+            },
+            "match/drop": patternSchema,
+            "match/pass": patternSchema,
+            window: {
+              type: "object",
+              properties: {
+                events: {
+                  anyOf: [
+                    { type: "integer", minimum: 1 },
+                    { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+                  ],
+                },
+                seconds: {
+                  anyOf: [
+                    { type: "number", exclusiveMinimum: 0 },
+                    { type: "string", pattern: "^[0-9]+\\.?[0-9]*$" },
+                  ],
+                },
               },
+              additionalProperties: false,
+              required: ["events", "seconds"],
             },
-            additionalProperties: false,
-            required: ["events", "seconds"],
+            flatmap: stepFunctionTemplateSchema,
+            reduce: stepFunctionTemplateSchema,
           },
-          flatmap: stepFunctionTemplateSchema,
-          reduce: stepFunctionTemplateSchema,
+          additionalProperties: false,
+          required: [],
         },
-        additionalProperties: false,
-        required: [],
       },
     },
-  },
-  required: ["name", "input"],
+    required: ["name", "input"],
+  };
 };
 
+/**
+ * The validation procedure of the schema, compiled when it's first
+ * needed and discarded whenever a module is registered.
+ */
+let pipelineTemplateValidator: ((value: unknown) => unknown) | null = null;
+
 /**
  * Validate a raw pipeline template using the schema.
+ *
+ * @param value The raw pipeline template.
+ * @returns The same value, if it's valid.
+ */
+const validatePipelineTemplate = (value: unknown): unknown => {
+  if (pipelineTemplateValidator === null) {
+    pipelineTemplateValidator = compileThrowing(makePipelineTemplateSchema());
+  }
+  return pipelineTemplateValidator(value);
+};
+
+/**
+ * Check that a module may be registered under a name, which must not
+ * be taken by a provided or previously registered module.
+ *
+ * @param kind The kind of module, for error messages.
+ * @param registry The modules of the same kind.
+ * @param name The name to register the module under.
+ */
+const checkRegistration = (
+  kind: string,
+  registry: { [name: string]: unknown },
+  name: string
+): void => {
+  if (typeof name !== "string" || name.length === 0) {
+    throw new Error(`${kind} names must be non-empty strings`);
+  }
+  if (Object.prototype.hasOwnProperty.call(registry, name)) {
+    throw new Error(`the ${kind} name '${name}' is already registered`);
+  }
+};
+
+/**
+ * Register an input form provided outside of CDP, so that pipeline
+ * templates may use it by name. Must be done before pipeline
+ * templates are loaded.
+ *
+ * @param name The name pipeline templates use for the input.
+ * @param inputModule The module implementing the input.
  */
-const validatePipelineTemplate = compileThrowing(pipelineTemplateSchema);
+export const registerInput = <Options>(
+  name: string,
+  inputModule: InputModule<Options>
+): void => {
+  checkRegistration("input", inputModules, name);
+  inputModules[name] = inputModule;
+  pipelineTemplateValidator = null;
+};
+
+/**
+ * Register a step function provided outside of CDP, so that pipeline
+ * templates may use it by name. Outputs are registered as step
+ * functions too. Must be done before pipeline templates are loaded.
+ *
+ * @param name The name pipeline templates use for the function.
+ * @param stepFunctionModule The module implementing the function.
+ */
+export const registerStepFunction = <Options>(
+  name: string,
+  stepFunctionModule: StepFunctionModule<Options>
+): void => {
+  checkRegistration("step function", stepFunctionModules, name);
+  stepFunctionModules[name] = stepFunctionModule;
+  pipelineTemplateValidator = null;
+};
+
+/**
+ * Finds the jq expressions given in a step's definition, which are
+ * the values of options named `jq-expr` or ending in `-jq-expr`, and
+ * the code given directly to the send-receive-jq function.
+ *
+ * @param value The step's definition, or a part of it.
+ * @param path The path to the part of the definition.
+ * @returns Pairs of paths and the jq expressions found in them.
+ */
+const findJqExpressions = (
+  value: unknown,
+  path: string[] = []
+): [string, string][] =>
+  Array.isArray(value)
+    ? value.flatMap((item, index) =>
+        findJqExpressions(item, [...path, `${index}`])
+      )
+    : typeof value === "object" && value !== null
+    ? Object.entries(value).flatMap(([key, item]) =>
+        typeof item === "string" &&
+        (key === "jq-expr" ||
+          key.endsWith("-jq-expr") ||
+          (key === "send-receive-jq" && path.length === 1))
+          ? [[[...path, key].join("."), item] as [string, string]]
+          : findJqExpressions(item, [...path, key])
+      )
+    : [];
 
 /**
  * Parses and creates a pipeline template from a raw structure. Throws
@@ -249,10 +666,29 @@ export const makePipelineTemplate = (rawThing: unknown): PipelineTemplate => {
   // restriction.
   // Check the input form.
   const [inputName, inputOptions] = Object.entries(thing.input)[0];
-  inputModules[inputName as keyof typeof inputModules].validate(inputOptions);
+  inputModules[inputName].validate(inputOptions);
+  // Check the dead-letter name.
+  check(
+    match(thing).with({ "dead-letter": P.select(P.string) }, isValidEventName),
+    "the pipeline's dead-letter name must be a valid event name"
+  );
+  // Check the jq prelude, which every jq expression depends on.
+  if (typeof thing["jq-prelude"] === "string") {
+    try {
+      checkJqProgram(".", thing["jq-prelude"]);
+    } catch (err) {
+      throw new Error(
+        `the pipeline's jq-prelude is invalid: ${(err as Error).message}`
+      );
+    }
+  }
   // Check each step.
   Object.entries(thing.steps ?? {}).forEach(([name, definition]) => {
     const matchStep = match(definition);
+    check(
+      matchStep.with({ "dead-letter": P.select(P.string) }, isValidEventName),
+      `step '${name}' has an invalid dead-letter name (must be a valid event name)`
+    );
     check(
       matchStep.with({ "match/drop": P._, "match/pass": P._ }, () => false),
       `step '${name}' can't use both match/drop and match/pass`
@@ -272,6 +708,13 @@ export const makePipelineTemplate = (rawThing: unknown): PipelineTemplate => {
       ),
       `step '${name}' has an invalid value for window.seconds (must be > 0)`
     );
+    check(
+      matchStep.with(
+        { timeout: P.select(P.string) },
+        (timeout) => parseFloat(timeout) > 0
+      ),
+      `step '${name}' has an invalid value for timeout (must be > 0)`
+    );
     check(
       matchStep.with({ flatmap: P._, reduce: P._ }, () => false),
       `step '${name}' can't use both flatmap and reduce`
@@ -287,9 +730,41 @@ export const makePipelineTemplate = (rawThing: unknown): PipelineTemplate => {
     const template = (definition.flatmap ??
       definition.reduce) as StepFunctionTemplate;
     const [stepFunctionName, stepFunctionOptions] = Object.entries(template)[0];
-    stepFunctionModules[
-      stepFunctionName as keyof typeof stepFunctionModules
-    ].validate(name, stepFunctionOptions);
+    const stepFunctionModule = stepFunctionModules[stepFunctionName];
+    stepFunctionModule.validate(name, stepFunctionOptions);
+    check(
+      matchStep.with(
+        { timeout: P._ },
+        () => stepFunctionModule.supportsTimeout === true
+      ),
+      `step '${name}' can't use a timeout with the ${stepFunctionName} function`
+    );
+    check(
+      matchStep.with({ concurrency: P._, partition: P._ }, () => false),
+      `step '${name}' can't use both concurrency and partition`
+    );
+    check(
+      matchStep.with(
+        { concurrency: { instances: P.select() } },
+        (instances) =>
+          parseInt(`${instances}`, 10) === 1 ||
+          stepFunctionModule.stateless === true
+      ),
+      `step '${name}' can't run concurrent instances of the ` +
+        `${stepFunctionName} function, which keeps state`
+    );
+    // Compile every jq expression, so that mistakes are found before
+    // the pipeline starts.
+    for (const [path, expr] of findJqExpressions(definition)) {
+      try {
+        checkJqProgram(expr, thing["jq-prelude"]);
+      } catch (err) {
+        throw new Error(
+          `step '${name}' has an invalid jq expression under ${path}: ` +
+            `${expr}\n${(err as Error).message}`
+        );
+      }
+    }
   });
   // 3. Check the pipeline's graph soundness.
   const dummyStepFactory = () => Promise.reject("not a real step factory");
@@ -306,41 +781,182 @@ export const makePipelineTemplate = (rawThing: unknown): PipelineTemplate => {
 };
 
 /**
- * Instantiates and runs a pipeline.
+ * Analyzes a pipeline template without running it, following the
+ * names of the events that the input may produce across the steps.
+ * Names that can't be known in advance (e.g. those given by remote
+ * sources) are assumed to match any pattern, so that they don't lead
+ * to findings.
  *
- * @param template The pipeline template that describes the pipeline.
- * @returns A promise that resolves to a pair: the first element is a
- * promise (another one) that resolves once the pipeline stops
- * processing; the second element is a thunk that schedules the
- * resolution of the previous promise, including the appropriate
- * cleanups.
+ * @param template The pipeline template to analyze.
+ * @returns The report of the findings.
  */
-export const runPipeline = async (
-  template: PipelineTemplate
-): Promise<[Promise<void>, () => void]> => {
-  // Setup initialization arguments.
-  const signature = await getSignature(template);
-  const inputParameters = {
-    pipelineName: template.name,
-    pipelineSignature: signature,
-    "jq-prelude": template["jq-prelude"],
-    "jsonnet-prelude": template["jsonnet-prelude"],
-  };
-  // Zero pipeline metrics.
-  pipelineEvents.inc({ flow: "in" }, 0);
-  pipelineEvents.inc({ flow: "out" }, 0);
-  deadEvents.set(0);
-  // Create the input channel.
+export const analyzePipeline = (template: PipelineTemplate): AnalysisReport => {
   const [inputName, inputOptions] = Object.entries(template.input)[0];
-  const [inputChannel, inputEnded] = inputModules[
-    inputName as keyof typeof inputModules
-  ].make(inputParameters, inputOptions);
-  // Create the pipeline channel.
+  const inputModule = inputModules[inputName];
+  // Inputs that wrap the data they receive give their events a known
+  // name.
+  const wrap =
+    typeof inputOptions === "object"
+      ? (inputOptions as { wrap?: WrapDirective } | null)?.wrap
+      : undefined;
+  const inputNames: EventNames =
+    typeof inputModule.emits !== "undefined"
+      ? inputModule.emits(inputOptions)
+      : typeof wrap === "string"
+      ? [wrap]
+      : typeof wrap === "object"
+      ? [wrap.name]
+      : null;
+  const steps = Object.entries(template.steps ?? {}).map(
+    ([name, definition]) => {
+      const functionMode: "flatmap" | "reduce" =
+        "reduce" in definition ? "reduce" : "flatmap";
+      const [stepFunctionName, stepFunctionOptions] = Object.entries(
+        definition[functionMode] as StepFunctionTemplate
+      )[0];
+      const stepFunctionModule = stepFunctionModules[stepFunctionName];
+      const deadLetterName =
+        definition["dead-letter"] ?? template["dead-letter"];
+      const patternMode: "pass" | "drop" =
+        "match/drop" in definition ? "drop" : "pass";
+      return {
+        name,
+        after: definition.after ?? [],
+        pattern:
+          "match/drop" in definition
+            ? definition["match/drop"]
+            : definition["match/pass"],
+        patternMode,
+        emits: (names: EventNames) =>
+          union(
+            typeof stepFunctionModule.emits !== "undefined"
+              ? stepFunctionModule.emits(stepFunctionOptions, names)
+              : names,
+            // Events that fail to be processed may be emitted as
+            // dead-letter events.
+            typeof deadLetterName === "string" ? [deadLetterName] : []
+          ),
+      };
+    }
+  );
+  return analyze(inputNames, steps);
+};
+
+/**
+ * The outcome of checking the endpoints of the input or of a step.
+ */
+export interface ProbeResult {
+  target: string;
+  status: "ok" | "failed" | "skipped";
+  error?: string;
+}
+
+/**
+ * Run a single connectivity check, giving up after the timeout.
+ *
+ * @param target The description of what's being checked.
+ * @param probe The check, which may decide there's nothing to check.
+ * @param timeout The time to wait for the check, in seconds.
+ * @returns A promise that resolves to the outcome of the check.
+ */
+const runProbe = async (
+  target: string,
+  probe: (signal: AbortSignal) => Promise<void> | null,
+  timeout: number
+): Promise<ProbeResult> => {
+  const controller = new AbortController();
+  let timer: ReturnType<typeof setTimeout> | undefined;
+  try {
+    const probing = probe(controller.signal);
+    if (probing === null) {
+      return { target, status: "skipped" };
+    }
+    await Promise.race([
+      probing,
+      new Promise<never>((_, reject) => {
+        timer = setTimeout(
+          () => reject(new Error(`no answer after ${timeout} seconds`)),
+          timeout * 1000
+        );
+      }),
+    ]);
+    return { target, status: "ok" };
+  } catch (err) {
+    controller.abort();
+    return { target, status: "failed", error: `${err}` };
+  } finally {
+    clearTimeout(timer);
+  }
+};
+
+/**
+ * Checks that the endpoints the pipeline connects to are reachable,
+ * without consuming or delivering anything. Only the input and the
+ * steps whose modules know how to check their endpoints are
+ * reported.
+ *
+ * @param template The pipeline template to check.
+ * @param timeout The time to wait for each endpoint, in seconds.
+ * @returns A promise that resolves to the outcome of each check.
+ */
+export const probePipeline = (
+  template: PipelineTemplate,
+  timeout: number = PREFLIGHT_TIMEOUT
+): Promise<ProbeResult[]> => {
+  const [inputName, inputOptions] = Object.entries(template.input)[0];
+  const inputModule = inputModules[inputName];
+  const probes: [string, (signal: AbortSignal) => Promise<void> | null][] =
+    [];
+  if (typeof inputModule.probe !== "undefined") {
+    const probe = inputModule.probe;
+    probes.push([
+      `input ${inputName}`,
+      (signal) => probe(inputOptions, signal),
+    ]);
+  }
+  Object.entries(template.steps ?? {}).forEach(([name, definition]) => {
+    const functionMode: "flatmap" | "reduce" =
+      "reduce" in definition ? "reduce" : "flatmap";
+    const [stepFunctionName, stepFunctionOptions] = Object.entries(
+      definition[functionMode] as StepFunctionTemplate
+    )[0];
+    const probe = stepFunctionModules[stepFunctionName].probe;
+    if (typeof probe !== "undefined") {
+      probes.push([
+        `step ${name} (${stepFunctionName})`,
+        (signal) => probe(stepFunctionOptions, signal),
+      ]);
+    }
+  });
+  return Promise.all(
+    probes.map(([target, probe]) => runProbe(target, probe, timeout))
+  );
+};
+
+/**
+ * Builds the definitions of the steps of a pipeline template. Step
+ * functions are only instantiated when steps are started. Each step
+ * is signed with everything that determines its behaviour except for
+ * its dependencies, so that unchanged steps keep running when the
+ * pipeline is reloaded.
+ *
+ * @param template The pipeline template that describes the steps.
+ * @param signature The pipeline's signature.
+ * @returns A promise yielding the step definitions.
+ */
+const makeStepDefinitions = async (
+  template: PipelineTemplate,
+  signature: string
+): Promise<StepDefinition[]> => {
   const steps: StepDefinition[] = [];
   for (const [name, definition] of Object.entries(template.steps ?? {})) {
     // Zero step metrics.
     stepEvents.inc({ step: name, flow: "in" }, 0);
     stepEvents.inc({ step: name, flow: "out" }, 0);
+    stepEvents.inc({ step: name, flow: "dead" }, 0);
+    stepEvents.inc({ step: name, flow: "failed" }, 0);
+    stepEvents.inc({ step: name, flow: "dropped" }, 0);
+    stepEvents.inc({ step: name, flow: "timed-out" }, 0);
     // Extract parameters.
     const window = definition.window ?? { events: 1, seconds: -1 };
     const patternMode: "pass" | "drop" =
@@ -368,74 +984,421 @@ export const runPipeline = async (
     const [stepFunctionName, stepFunctionOptions] = Object.entries(
       definition[functionMode] as StepFunctionTemplate
     )[0];
-    const parameters = {
-      pipelineName: template.name,
-      pipelineSignature: signature,
-      stepName: name,
-      "jq-prelude": template["jq-prelude"],
-      "jsonnet-prelude": template["jsonnet-prelude"],
-    };
-    const fn = await stepFunctionModules[
-      stepFunctionName as keyof typeof stepFunctionModules
-    ].make(parameters, stepFunctionOptions);
-    const factory = makeWindowed(options, fn);
+    const deadLetterName = definition["dead-letter"] ?? template["dead-letter"];
+    const buffer = definition.buffer ?? template.buffer;
+    const { after, ...behaviour } = definition;
     steps.push({
       name,
-      after: definition.after ?? [],
-      factory,
+      after: after ?? [],
+      signature: await getSignature(
+        behaviour,
+        deadLetterName,
+        buffer,
+        template["jq-prelude"],
+        template["jsonnet-prelude"]
+      ),
+      factory: async (send) => {
+        // Failures are routed as dead-letter events only if a name
+        // for them is configured.
+        const failureRouting =
+          typeof deadLetterName === "string"
+            ? makeFailureRouting(name, deadLetterName)
+            : null;
+        const parameters = {
+          pipelineName: template.name,
+          pipelineSignature: signature,
+          stepName: name,
+          "jq-prelude": template["jq-prelude"],
+          "jsonnet-prelude": template["jsonnet-prelude"],
+          reportFailure: failureRouting?.report,
+          timeout:
+            typeof definition.timeout === "string"
+              ? parseFloat(definition.timeout)
+              : definition.timeout,
+        };
+        const makeFunction = () =>
+          stepFunctionModules[stepFunctionName].make(
+            parameters,
+            stepFunctionOptions
+          );
+        // Steps with concurrency hand their vectors to several
+        // instances of the step function.
+        const concurrency = definition.concurrency;
+        const instances =
+          typeof concurrency?.instances === "string"
+            ? parseInt(concurrency.instances, 10)
+            : concurrency?.instances ?? 1;
+        const makeLane = async () =>
+          makeWindowed(
+            options,
+            instances > 1
+              ? await makeConcurrent(
+                  name,
+                  { instances, ordered: concurrency?.ordered ?? true },
+                  makeFunction
+                )
+              : await makeFunction()
+          );
+        // Partitioned steps run an instance of the step function for
+        // each lane.
+        const partition = definition.partition;
+        const windowed =
+          typeof partition === "undefined"
+            ? await makeLane()
+            : makePartitioned(
+                name,
+                {
+                  lanes:
+                    typeof partition.lanes === "string"
+                      ? parseInt(partition.lanes, 10)
+                      : partition.lanes,
+                  extractor: await jqProcessor.makeChannel<Event[]>(
+                    makeExtractionProgram(partition["key-jq-expr"]),
+                    { prelude: template["jq-prelude"] }
+                  ),
+                },
+                makeLane
+              );
+        // Steps are buffered only if a buffer is configured, and are
+        // otherwise left to queue as many events as they receive.
+        const factory =
+          typeof buffer === "undefined"
+            ? windowed
+            : makeBuffered(
+                name,
+                {
+                  size:
+                    typeof buffer.size === "string"
+                      ? parseInt(buffer.size, 10)
+                      : buffer.size,
+                  policy: buffer.policy ?? "block",
+                },
+                windowed
+              );
+        failureRouting?.connect(send);
+        return factory(send);
+      },
     });
   }
-  const pipelineChannel = await run({ name: template.name, steps });
-  // Connect the input's data to the pipeline.
-  const connectedChannel = compose(
-    pipelineChannel,
-    flatMap(async (e: Event) => {
-      pipelineEvents.inc({ flow: "in" }, 1);
-      return [e];
-    }, inputChannel)
+  return steps;
+};
+
+/**
+ * Signs the input of a pipeline template, along with the preludes
+ * available to it.
+ *
+ * @param template The pipeline template.
+ * @returns A promise yielding the input's signature.
+ */
+const getInputSignature = (template: PipelineTemplate): Promise<string> =>
+  getSignature(
+    template.input,
+    template["jq-prelude"],
+    template["jsonnet-prelude"]
   );
+
+/**
+ * A procedure that reloads a running pipeline, given the template
+ * that describes its new configuration.
+ */
+export type PipelineReloader = (template: PipelineTemplate) => Promise<void>;
+
+/**
+ * Instantiates and runs a pipeline.
+ *
+ * @param template The pipeline template that describes the pipeline.
+ * @returns A promise that resolves to a triple: the first element is
+ * a promise (another one) that resolves once the pipeline stops
+ * processing; the second element is a thunk that schedules the
+ * resolution of the previous promise, including the appropriate
+ * cleanups; the third element is a procedure that reloads the
+ * pipeline with a new template, keeping the unchanged input and
+ * steps running.
+ */
+export const runPipeline = async (
+  template: PipelineTemplate
+): Promise<[Promise<void>, () => void, PipelineReloader]> => {
+  // Setup initialization arguments.
+  const signature = await getSignature(template);
+  // Zero pipeline metrics.
+  pipelineEvents.inc({ flow: "in" }, 0);
+  pipelineEvents.inc({ flow: "out" }, 0);
+  deadEvents.set(0);
+  // Create the pipeline channel.
+  const pipelineChannel = await run({
+    name: template.name,
+    steps: await makeStepDefinitions(template, signature),
+  });
+  // Create the input channel, and connect its data to the pipeline.
+  // The input may be replaced when the pipeline is reloaded.
+  const replaced: WeakSet<Channel<never, never>> = new WeakSet();
+  const startInput = async (
+    inputTemplate: PipelineTemplate,
+    inputSignature: string
+  ) => {
+    const [inputName, inputOptions] = Object.entries(inputTemplate.input)[0];
+    inputEvents.inc({ input: inputName }, 0);
+    const [inputChannel, inputEnded] = inputModules[inputName].make(
+      {
+        pipelineName: inputTemplate.name,
+        pipelineSignature: inputSignature,
+        "jq-prelude": inputTemplate["jq-prelude"],
+        "jsonnet-prelude": inputTemplate["jsonnet-prelude"],
+      },
+      inputOptions
+    );
+    const connected: Channel<never, never> = drain(
+      inputChannel,
+      async (e: Event) => {
+        pipelineEvents.inc({ flow: "in" }, 1);
+        inputEvents.inc({ input: inputName }, 1);
+        pipelineChannel.send(e);
+      },
+      async () => {
+        // An input that ends closes the pipeline, unless it was
+        // replaced.
+        if (!replaced.has(connected)) {
+          await pipelineChannel.close();
+        }
+      }
+    );
+    // Schedule the pipeline's close when the input ends by external
+    // causes.
+    inputEnded
+      .then(() => resolveAfter(INPUT_DRAIN_TIMEOUT * 1000))
+      .then(() => {
+        if (!replaced.has(connected)) {
+          return close();
+        }
+      });
+    return {
+      name: inputName,
+      signature: await getInputSignature(inputTemplate),
+      connected,
+      template: inputTemplate,
+      pipelineSignature: inputSignature,
+    };
+  };
+  let input = await startInput(template, signature);
   // Expose metrics in openmetrics format.
   const stopExposingMetrics = startExposingMetrics();
+  // Record trace spans, if an exporter is configured.
+  const stopTracing = startTracing();
   // Start it up.
   const operate = async (): Promise<void> => {
-    for await (const event of connectedChannel.receive) {
+    for await (const event of pipelineChannel.receive) {
       // `event` already went through the whole pipeline.
       pipelineEvents.inc({ flow: "out" }, 1);
       logger.debug("Event", event.id, "reached the end of the pipeline");
     }
     logger.debug("Finished pipeline operation");
     await stopExposingMetrics();
+    await stopTracing();
+  };
+  // Closing the pipeline closes the input first, which then drains
+  // the events already accepted through the steps. Reloads in course
+  // are allowed to finish, so that the input closed is the current
+  // one.
+  let interval: ReturnType<typeof setInterval> | null = null;
+  let reloading: Promise<void> = Promise.resolve();
+  let closed: Promise<void> | null = null;
+  const close = (): Promise<void> => {
+    if (interval !== null) {
+      clearInterval(interval as ReturnType<typeof setInterval>);
+    }
+    if (closed === null) {
+      closed = reloading.then(() => input.connected.close());
+    }
+    return closed;
   };
   // Monitor the health of the multi-process system and shut
   // everything off if any piece is unhealthy.
-  let interval: ReturnType<typeof setInterval> | null = null;
   if (HEALTH_CHECK_INTERVAL > 0) {
     interval = setInterval(() => {
-      if (!jqProcessor.isHealthy() || !jsonnetProcessor.isHealthy()) {
+      if (
+        !jqProcessor.isHealthy() ||
+        !jsonnetProcessor.isHealthy() ||
+        !luaProcessor.isHealthy()
+      ) {
         logger.error(
           "Pipeline isn't healthy; draining queues and shutting down"
         );
-        clearInterval(interval as ReturnType<typeof setInterval>);
-        connectedChannel.close();
+        close();
       }
     }, HEALTH_CHECK_INTERVAL * 1000);
   }
-  // Schedule the pipeline's close when the input ends by external causes.
-  inputEnded
-    .then(() => resolveAfter(INPUT_DRAIN_TIMEOUT * 1000))
-    .then(() => {
-      if (interval !== null) {
-        clearInterval(interval as ReturnType<typeof setInterval>);
+  // Replace the running input with the one of the given template.
+  // The new input is started before the previous one is closed, so
+  // that the previous one keeps running if the new one can't start.
+  // Inputs of the same form may compete for the same resources
+  // (e.g. a port), so in that case the previous one is closed
+  // first, and started again if the new one can't start. Closed
+  // inputs drain their pending events into the pipeline.
+  const replaceInput = async (
+    next: PipelineTemplate,
+    nextSignature: string
+  ): Promise<void> => {
+    const previous = input;
+    const competing = Object.keys(next.input)[0] === previous.name;
+    const detachPrevious = async () => {
+      replaced.add(previous.connected);
+      await previous.connected.close();
+    };
+    if (competing) {
+      await detachPrevious();
+    }
+    try {
+      input = await startInput(next, nextSignature);
+    } catch (err) {
+      if (!competing) {
+        logger.error("Couldn't start the new input; keeping the previous one");
+        throw err;
       }
-      return connectedChannel.close();
-    });
+      logger.error(
+        "Couldn't start the new input; restarting the previous one"
+      );
+      try {
+        input = await startInput(previous.template, previous.pipelineSignature);
+      } catch (restartErr) {
+        logger.error(
+          `Couldn't restart the previous input; shutting down: ${restartErr}`
+        );
+        await pipelineChannel.close();
+      }
+      throw err;
+    }
+    if (!competing) {
+      await detachPrevious();
+    }
+  };
+  // Reloads are applied one at a time. The new steps are built first,
+  // and the new input is started before the steps are reconfigured,
+  // so that neither is changed if the other can't be. If the steps
+  // can't be reconfigured, the previous input is restored.
+  const reload = async (next: PipelineTemplate): Promise<void> => {
+    if (closed !== null) {
+      throw new Error("the pipeline is shutting down");
+    }
+    const nextSignature = await getSignature(next);
+    const nextPipeline = {
+      name: next.name,
+      steps: await makeStepDefinitions(next, nextSignature),
+    };
+    if ((await getInputSignature(next)) === input.signature) {
+      await pipelineChannel.reconfigure(nextPipeline);
+      return;
+    }
+    const previous = input;
+    await replaceInput(next, nextSignature);
+    try {
+      await pipelineChannel.reconfigure(nextPipeline);
+    } catch (err) {
+      logger.error(
+        "Couldn't apply the new steps; restoring the previous input"
+      );
+      try {
+        await replaceInput(previous.template, previous.pipelineSignature);
+      } catch (restoreErr) {
+        logger.error(
+          `Couldn't restore the previous input; shutting down: ${restoreErr}`
+        );
+        await pipelineChannel.close();
+      }
+      throw err;
+    }
+    logger.info(
+      `Replaced the pipeline's input '${previous.name}' with '${input.name}'`
+    );
+  };
   return [
     operate(),
     () => {
-      if (interval !== null) {
-        clearInterval(interval as ReturnType<typeof setInterval>);
-      }
-      connectedChannel.close();
+      close();
+    },
+    (next) => {
+      const applied = reloading.then(() => reload(next));
+      reloading = applied.catch(() => undefined);
+      return applied;
     },
   ];
 };
+
+/**
+ * Stop a running pipeline when the process receives any of the given
+ * signals. Stopping closes the input, so that it doesn't accept new
+ * events, and drains the events already accepted through the steps,
+ * flushing any pending windows.
+ *
+ * @param running The triple of [promise, stopper, reloader] given by
+ * runPipeline.
+ * @param timeout The amount of seconds to wait for the pipeline to
+ * drain after a signal is received.
+ * @param signals The signals that stop the pipeline.
+ * @returns A promise that resolves to whether the pipeline finished
+ * draining. It resolves to false if the timeout expired first.
+ */
+export const stopOnSignals = (
+  [promise, stop]: [Promise<void>, () => void, ...unknown[]],
+  timeout: number = SHUTDOWN_DRAIN_TIMEOUT,
+  signals: NodeJS.Signals[] = ["SIGINT", "SIGTERM", "SIGQUIT"]
+): Promise<boolean> => {
+  let timer: ReturnType<typeof setTimeout> | null = null;
+  let onSignal: (signal: NodeJS.Signals) => void = () => undefined;
+  const expired = new Promise<boolean>((resolve) => {
+    onSignal = (signal) => {
+      if (timer !== null) {
+        logger.warn(`Received ${signal} again; already draining`);
+        return;
+      }
+      logger.info(`Received ${signal}; draining the pipeline`);
+      timer = setTimeout(() => {
+        logger.error(
+          `The pipeline didn't drain within ${timeout} seconds; exiting`
+        );
+        resolve(false);
+      }, timeout * 1000);
+      stop();
+    };
+  });
+  signals.forEach((signal) => process.on(signal, onSignal));
+  return Promise.race([promise.then(() => true), expired]).finally(() => {
+    if (timer !== null) {
+      clearTimeout(timer);
+    }
+    signals.forEach((signal) => process.off(signal, onSignal));
+  });
+};
+
+/**
+ * Reload a running pipeline when the process receives any of the
+ * given signals. The pipeline's configuration is loaded again, and the
+ * input and the steps that didn't change keep running. If the new
+ * configuration can't be loaded or applied, the running pipeline is
+ * left untouched.
+ *
+ * @param running The triple of [promise, stopper, reloader] given by
+ * runPipeline.
+ * @param load A procedure that loads the pipeline's configuration.
+ * @param signals The signals that reload the pipeline.
+ * @returns A thunk that stops listening to the signals.
+ */
+export const reloadOnSignals = (
+  [, , reload]: [Promise<void>, () => void, PipelineReloader],
+  load: () => PipelineTemplate,
+  signals: NodeJS.Signals[] = ["SIGHUP"]
+): (() => void) => {
+  let reloading: Promise<void> = Promise.resolve();
+  const onSignal = (signal: NodeJS.Signals) => {
+    logger.info(`Received ${signal}; reloading the pipeline`);
+    reloading = reloading
+      .then(() => reload(load()))
+      .then(() => logger.info("Reloaded the pipeline"))
+      .catch((err) =>
+        logger.error(
+          `Couldn't reload the pipeline; keeping the running one: ${err}`
+        )
+      );
+  };
+  signals.forEach((signal) => process.on(signal, onSignal));
+  return () => signals.forEach((signal) => process.off(signal, onSignal));
+};
@@ -1,3 +1,4 @@
+import { AsyncLocalStorage } from "async_hooks";
 import { makeLogger } from "./log";
 
 /**
@@ -22,6 +23,60 @@ export interface Channel<SendType, ReceiveType> {
 export const activeQueues: Set<AsyncQueue<any>> = new Set();
 /* eslint-enable @typescript-eslint/no-explicit-any */
 
+/**
+ * The lane of a partitioned step, which owns the queues created while
+ * building it.
+ */
+export interface Lane {
+  step: string;
+  lane: number;
+}
+
+/**
+ * The lane being built in the current asynchronous context, if any.
+ */
+const laneScope: AsyncLocalStorage<Lane> = new AsyncLocalStorage();
+
+/**
+ * Run a procedure such that every queue it creates, even after
+ * awaiting, is owned by the given lane.
+ *
+ * @param lane The lane that owns the queues.
+ * @param procedure The procedure to run.
+ * @returns The procedure's result.
+ */
+export const inLane = <T>(
+  lane: Lane,
+  procedure: () => Promise<T>
+): Promise<T> => laneScope.run(lane, procedure);
+
+/**
+ * The step being built in the current asynchronous context, if any.
+ */
+const stepScope: AsyncLocalStorage<string> = new AsyncLocalStorage();
+
+/**
+ * Run a procedure such that every queue it creates, and the work done
+ * by every channel it builds, even after awaiting, is owned by the
+ * given step.
+ *
+ * @param step The name of the step that owns the queues and work.
+ * @param procedure The procedure to run.
+ * @returns The procedure's result.
+ */
+export const inStep = <T>(
+  step: string,
+  procedure: () => Promise<T>
+): Promise<T> => stepScope.run(step, procedure);
+
+/**
+ * Get the step being built in the current asynchronous context, if
+ * any, so that work done later on can be accounted to it.
+ *
+ * @returns The name of the step.
+ */
+export const currentStep = (): string | undefined => stepScope.getStore();
+
 /**
  * An alternative to plain arrays as queues, with better shift()
  * performance. Credit to: https://github.com/sanori/queue-js
@@ -63,6 +118,100 @@ export class Queue<Type> {
   }
 }
 
+/**
+ * The ways a bounded queue handles pushes once it's full: `block`
+ * accepts them anyway but signals the queue as congested, so that the
+ * slowness propagates upstream through backpressure; `drop-newest`
+ * discards the pushed value; and `drop-oldest` discards the value at
+ * the start of the queue to make room for the pushed one.
+ */
+export type OverflowPolicy = "block" | "drop-newest" | "drop-oldest";
+
+/**
+ * The capacity of a bounded queue and its overflow policy.
+ */
+export interface QueueBound<Type> {
+  size: number;
+  policy: OverflowPolicy;
+  /**
+   * A procedure called with each value discarded because of the
+   * policy.
+   */
+  onDrop?: (value: Type) => void;
+}
+
+/**
+ * A predicate that selects a group of queues.
+ */
+/* eslint-disable @typescript-eslint/no-explicit-any */
+export type QueuePredicate = (queue: AsyncQueue<any>) => boolean;
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * The amount of values held by a group of queues (e.g. those owned
+ * by a step), kept up to date as values are pushed and shifted so
+ * that it can be waited on.
+ */
+export class QueueLoad {
+  /**
+   * The predicate that selects the queues in the group.
+   */
+  includes: QueuePredicate;
+
+  /**
+   * The amount of values currently held by the queues.
+   */
+  count = 0;
+
+  /**
+   * The amount of values pushed to the queues so far, and that
+   * amount when the group was last found settled.
+   */
+  pushed = 0;
+  verified = -1;
+
+  /**
+   * The procedures waiting for the load to decrease.
+   */
+  waiters: (() => void)[] = [];
+
+  constructor(includes: QueuePredicate) {
+    this.includes = includes;
+  }
+
+  /**
+   * Account for a value pushed to a queue of the group.
+   */
+  add(): void {
+    this.count++;
+    this.pushed++;
+  }
+
+  /**
+   * Account for a value taken from a queue of the group.
+   */
+  remove(): void {
+    this.count--;
+    const waiters = this.waiters;
+    this.waiters = [];
+    waiters.forEach((notify) => notify());
+  }
+
+  /**
+   * Wait until a value is taken from a queue of the group.
+   */
+  decreased(): Promise<void> {
+    return new Promise((resolve) => {
+      this.waiters.push(resolve);
+    });
+  }
+}
+
+/**
+ * The loads being kept up to date.
+ */
+const watchedLoads: Set<QueueLoad> = new Set();
+
 /**
  * A queue class that resolves a shift() call only when there's
  * elements in the queue.
@@ -78,6 +227,27 @@ export class AsyncQueue<Type> {
    */
   data: Queue<Type> = new Queue();
 
+  /**
+   * The capacity and overflow policy of the queue, or null if it's
+   * unbounded.
+   */
+  bound: QueueBound<Type> | null;
+
+  /**
+   * The lane of a partitioned step that owns the queue, if any.
+   */
+  lane: Lane | undefined;
+
+  /**
+   * The step that owns the queue, if any.
+   */
+  step: string | undefined;
+
+  /**
+   * The loads that account for the values held by the queue.
+   */
+  loads: QueueLoad[];
+
   /**
    * The queue's closed status.
    */
@@ -112,8 +282,14 @@ export class AsyncQueue<Type> {
    */
   iterator: () => AsyncGenerator<Type>;
 
-  constructor(name = "anonymous queue") {
+  constructor(name = "anonymous queue", bound: QueueBound<Type> | null = null) {
     this.name = name;
+    this.bound = bound;
+    this.lane = laneScope.getStore();
+    this.step = stepScope.getStore();
+    this.loads = Array.from(watchedLoads).filter((load) =>
+      load.includes(this)
+    );
     this.lock = new Promise((resolve) => {
       this.releaseLock = resolve;
     });
@@ -141,11 +317,30 @@ export class AsyncQueue<Type> {
       logger.warn(`push() attempted on a closed queue: ${this.name}`);
       return false;
     }
+    if (this.bound !== null && this.data.length >= this.bound.size) {
+      if (this.bound.policy === "drop-newest") {
+        this.bound.onDrop?.(value);
+        return true;
+      }
+      if (this.bound.policy === "drop-oldest") {
+        this.loads.forEach((load) => load.remove());
+        this.bound.onDrop?.(this.data.shift() as Type);
+      }
+    }
     this.data.push(value);
+    this.loads.forEach((load) => load.add());
     this.releaseLock();
     return true;
   }
 
+  /**
+   * Whether the queue is bounded and holds as many values as its
+   * capacity allows.
+   */
+  get full(): boolean {
+    return this.bound !== null && this.data.length >= this.bound.size;
+  }
+
   /**
    * A queue can be closed to prevent it from blocking, or receiving
    * additional pushes. A closed queue will keep yielding elements if
@@ -171,6 +366,7 @@ export class AsyncQueue<Type> {
       return [true, null];
     }
     const value = this.data.shift() as Type;
+    this.loads.forEach((load) => load.remove());
     if (this.data.length === 0 && !this.closed) {
       this.lock = new Promise((resolve) => {
         this.releaseLock = resolve;
@@ -219,6 +415,161 @@ export class AsyncQueue<Type> {
   }
 }
 
+/**
+ * Check whether any bounded queue with the block policy is full,
+ * which means its slowness should propagate upstream.
+ *
+ * @returns Whether a blocking queue is congested.
+ */
+export const isCongested = (): boolean =>
+  Array.from(activeQueues).some(
+    (queue) => queue.bound?.policy === "block" && queue.full
+  );
+
+/**
+ * The amount of values currently being worked on by each step, and
+ * the procedures waiting for each step's work to finish.
+ */
+const stepWork: Map<string, number> = new Map();
+const stepWorkWaiters: Map<string, (() => void)[]> = new Map();
+
+/**
+ * Account for a value being worked on outside of any queue (e.g. a
+ * value being transformed, or held in a window that's not complete
+ * yet).
+ *
+ * @param step The step doing the work, if it's to be accounted to
+ * one.
+ * @returns A procedure that marks the end of the work, which may be
+ * called more than once.
+ */
+export const startWork = (step?: string): (() => void) => {
+  if (typeof step !== "undefined") {
+    stepWork.set(step, (stepWork.get(step) ?? 0) + 1);
+  }
+  let finished = false;
+  return () => {
+    if (!finished) {
+      finished = true;
+      if (typeof step !== "undefined") {
+        const remaining = (stepWork.get(step) ?? 1) - 1;
+        if (remaining > 0) {
+          stepWork.set(step, remaining);
+        } else {
+          stepWork.delete(step);
+          const waiters = stepWorkWaiters.get(step) ?? [];
+          stepWorkWaiters.delete(step);
+          waiters.forEach((notify) => notify());
+        }
+      }
+    }
+  };
+};
+
+/**
+ * Check whether a step is working on any value.
+ *
+ * @param step The name of the step.
+ * @returns Whether the step has work in progress.
+ */
+export const hasWork = (step: string): boolean => stepWork.has(step);
+
+/**
+ * Wait until a step isn't working on any value.
+ *
+ * @param step The name of the step.
+ * @returns A promise that resolves once the step's work is finished.
+ */
+export const workFinished = (step: string): Promise<void> =>
+  stepWork.has(step)
+    ? new Promise((resolve) => {
+        stepWorkWaiters.set(step, [
+          ...(stepWorkWaiters.get(step) ?? []),
+          resolve,
+        ]);
+      })
+    : Promise.resolve();
+
+/**
+ * Start keeping the load of a group of queues up to date, including
+ * queues created afterwards.
+ *
+ * @param includes The predicate that selects the queues in the group.
+ * @returns The load of the group.
+ */
+export const watchQueues = (includes: QueuePredicate): QueueLoad => {
+  const load = new QueueLoad(includes);
+  watchedLoads.add(load);
+  activeQueues.forEach((queue) => {
+    if (includes(queue)) {
+      queue.loads.push(load);
+      load.count += queue.data.length;
+      load.pushed += queue.data.length;
+    }
+  });
+  return load;
+};
+
+/**
+ * Stop keeping the load of a group of queues up to date.
+ *
+ * @param load The load of the group.
+ */
+export const unwatchQueues = (load: QueueLoad): void => {
+  watchedLoads.delete(load);
+  activeQueues.forEach((queue) => {
+    queue.loads = queue.loads.filter((other) => other !== load);
+  });
+};
+
+/**
+ * Check whether a group of queues is empty and none of the given
+ * owners is working on any value.
+ *
+ * @param load The load of the group.
+ * @param owners The owners of the work done on the group's values.
+ * @returns Whether the group is settled.
+ */
+export const isSettled = (load: QueueLoad, owners: string[]): boolean =>
+  load.count === 0 && !owners.some(hasWork);
+
+/**
+ * Wait until a group of queues is empty and none of the given owners
+ * is working on any value. Values that are in transit between a queue
+ * and the work that takes them aren't accounted anywhere, so if
+ * values were pushed since the group was last found settled, the
+ * group is checked again after pending callbacks had a chance to run.
+ *
+ * @param load The load of the group.
+ * @param owners The owners of the work done on the group's values.
+ * @returns A promise that resolves once the group is settled.
+ */
+export const untilSettled = async (
+  load: QueueLoad,
+  owners: string[]
+): Promise<void> => {
+  while (true) {
+    if (load.count > 0) {
+      await load.decreased();
+      continue;
+    }
+    const busy = owners.find(hasWork);
+    if (typeof busy !== "undefined") {
+      await workFinished(busy);
+      continue;
+    }
+    if (load.pushed === load.verified) {
+      return;
+    }
+    const pushed = load.pushed;
+    await new Promise((resolve) => setImmediate(resolve));
+    if (load.pushed === pushed && isSettled(load, owners)) {
+      load.verified = pushed;
+      return;
+    }
+  }
+};
+
 /**
  * Transforms a channel into another channel through a mapping
  * function.
@@ -236,11 +587,18 @@ export const flatMap = <A, B, C>(
     notifyFinished = resolve;
   });
   let started = false;
+  // Work is accounted to the step building the channel, if any.
+  const step = currentStep();
   async function* receiver() {
     started = true;
     for await (const b of channel.receive) {
-      for (const c of await fn(b)) {
-        yield c;
+      const finishWork = startWork(step);
+      try {
+        for (const c of await fn(b)) {
+          yield c;
+        }
+      } finally {
+        finishWork();
       }
     }
     notifyFinished();
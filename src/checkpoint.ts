@@ -0,0 +1,231 @@
+import { promises as fs } from "fs";
+import {
+  connect,
+  RedisConnectionOptions,
+  instanceSchema,
+  clusterSchema,
+} from "./io/redis";
+import { makeLogger } from "./log";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("checkpoint");
+
+/**
+ * A store of the positions reached by inputs, which survives
+ * restarts of the pipeline.
+ */
+export interface Checkpointer {
+  /**
+   * Load the position saved under the given key.
+   *
+   * @param key The key of the position.
+   * @returns A promise yielding the position, or undefined if none
+   * was saved.
+   */
+  load: (key: string) => Promise<unknown>;
+  /**
+   * Save a position under the given key, replacing the previous one.
+   *
+   * @param key The key of the position.
+   * @param value The position, which must be serializable as JSON.
+   * @param ttl The seconds after which the store forgets the
+   * position, if given.
+   */
+  save: (key: string, value: unknown, ttl?: number) => Promise<void>;
+  /**
+   * Release the resources held by the store.
+   */
+  close: () => Promise<void>;
+}
+
+/**
+ * Options for the checkpoint stores.
+ */
+export type CheckpointOptions =
+  | { file: string }
+  | { redis: RedisConnectionOptions; prefix?: string };
+
+/**
+ * An ajv schema for the checkpoint options.
+ */
+export const checkpointOptionsSchema = {
+  anyOf: [
+    {
+      type: "object",
+      properties: { file: { type: "string", minLength: 1 } },
+      additionalProperties: false,
+      required: ["file"],
+    },
+    {
+      type: "object",
+      properties: {
+        redis: {
+          anyOf: [
+            {
+              type: "object",
+              properties: { instance: instanceSchema },
+              additionalProperties: false,
+              required: ["instance"],
+            },
+            {
+              type: "object",
+              properties: { cluster: clusterSchema },
+              additionalProperties: false,
+              required: ["cluster"],
+            },
+          ],
+        },
+        prefix: { type: "string", minLength: 1 },
+      },
+      additionalProperties: false,
+      required: ["redis"],
+    },
+  ],
+};
+
+/**
+ * The key of the file checkpointer's object that holds the expiry
+ * times of positions saved with a TTL, in milliseconds since the
+ * epoch.
+ */
+const EXPIRIES_KEY = "cdp:expiries";
+
+/**
+ * Build a checkpoint store that keeps every position in a single
+ * local file, as a JSON object indexed by key. The file is replaced
+ * atomically, so that a crash doesn't leave it half-written, and
+ * saves made while the file is being replaced are written together
+ * afterwards. Positions saved with a TTL are forgotten once it
+ * elapses, and removed from the file when it's next written.
+ *
+ * @param path The path to the file.
+ * @returns The checkpoint store.
+ */
+export const makeFileCheckpointer = (path: string): Checkpointer => {
+  let positions: Promise<Record<string, unknown>> | null = null;
+  const read = (): Promise<Record<string, unknown>> => {
+    if (positions === null) {
+      positions = fs
+        .readFile(path, "utf8")
+        .then((contents) => JSON.parse(contents))
+        .catch((err) => {
+          if ((err as NodeJS.ErrnoException).code !== "ENOENT") {
+            logger.warn(`Couldn't read positions from '${path}': ${err}`);
+          }
+          return {};
+        });
+    }
+    return positions;
+  };
+  // The expiries are only kept in the file while there are any.
+  const expiriesOf = (
+    current: Record<string, unknown>
+  ): Record<string, number> => {
+    const expiries = current[EXPIRIES_KEY];
+    return typeof expiries === "object" && expiries !== null
+      ? (expiries as Record<string, number>)
+      : {};
+  };
+  const write = async () => {
+    scheduled = null;
+    const current = await read();
+    const expiries = expiriesOf(current);
+    const now = new Date().getTime();
+    for (const [key, expiry] of Object.entries(expiries)) {
+      if (expiry <= now) {
+        delete current[key];
+        delete expiries[key];
+      }
+    }
+    if (Object.keys(expiries).length === 0) {
+      delete current[EXPIRIES_KEY];
+    }
+    const tmpFile = `${path}.tmp`;
+    await fs.writeFile(tmpFile, JSON.stringify(current));
+    await fs.rename(tmpFile, path);
+  };
+  // Writes are chained, so that concurrent ones don't race to replace
+  // the file.
+  let saving: Promise<void> = Promise.resolve();
+  let scheduled: Promise<void> | null = null;
+  return {
+    load: async (key) => {
+      const current = await read();
+      const expiry = expiriesOf(current)[key];
+      return typeof expiry === "number" && expiry <= new Date().getTime()
+        ? undefined
+        : current[key];
+    },
+    save: async (key, value, ttl) => {
+      const current = await read();
+      current[key] = value;
+      const expiries = expiriesOf(current);
+      if (typeof ttl === "undefined") {
+        delete expiries[key];
+      } else {
+        expiries[key] = new Date().getTime() + ttl * 1000;
+        current[EXPIRIES_KEY] = expiries;
+      }
+      if (scheduled === null) {
+        scheduled = saving.then(write);
+        saving = scheduled.catch(() => undefined);
+      }
+      return scheduled;
+    },
+    close: () => saving,
+  };
+};
+
+/**
+ * Build a checkpoint store that keeps each position in a redis key,
+ * named after the position's key with the given prefix.
+ *
+ * @param options The redis connection options.
+ * @param prefix The prefix prepended to keys.
+ * @returns The checkpoint store.
+ */
+export const makeRedisCheckpointer = (
+  options: RedisConnectionOptions,
+  prefix: string
+): Checkpointer => {
+  const client = connect(options);
+  return {
+    load: async (key) => {
+      const value = await client.get(`${prefix}${key}`);
+      return value === null ? undefined : JSON.parse(value);
+    },
+    save: async (key, value, ttl) => {
+      if (typeof ttl === "undefined") {
+        await client.set(`${prefix}${key}`, JSON.stringify(value));
+      } else {
+        await client.set(
+          `${prefix}${key}`,
+          JSON.stringify(value),
+          "PX",
+          Math.ceil(ttl * 1000)
+        );
+      }
+    },
+    close: async () => {
+      await client.quit();
+    },
+  };
+};
+
+/**
+ * Build the checkpoint store indicated by the given options.
+ *
+ * @param options The checkpoint options.
+ * @param defaultPrefix The prefix of redis keys, used if the options
+ * don't give one.
+ * @returns The checkpoint store.
+ */
+export const makeCheckpointer = (
+  options: CheckpointOptions,
+  defaultPrefix: string
+): Checkpointer =>
+  "file" in options
+    ? makeFileCheckpointer(options.file)
+    : makeRedisCheckpointer(options.redis, options.prefix ?? defaultPrefix);
@@ -0,0 +1,203 @@
+import { makeLogger } from "./log";
+import { circuitBreakerState } from "./metrics";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("circuit-breaker");
+
+/**
+ * Options for the circuit breaker of deliveries to external systems.
+ */
+export type CircuitBreakerOptions = {
+  failures?: number | string;
+  cooldown?: number | string;
+  probes?: number | string;
+};
+
+/**
+ * An ajv schema for the circuit breaker options.
+ */
+export const circuitBreakerOptionsSchema = {
+  type: "object",
+  properties: {
+    failures: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    cooldown: {
+      anyOf: [
+        { type: "number", minimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    probes: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+  },
+  additionalProperties: false,
+};
+
+/**
+ * Default amount of consecutive failed attempts that open the
+ * circuit.
+ */
+const DEFAULT_FAILURES = 5;
+
+/**
+ * Default amount of seconds the circuit stays open before testing
+ * the recovery of the external system.
+ */
+const DEFAULT_COOLDOWN = 30;
+
+/**
+ * Default amount of successful attempts that close a half-open
+ * circuit.
+ */
+const DEFAULT_PROBES = 1;
+
+/**
+ * The states of a circuit breaker: `closed` lets every attempt
+ * through, `open` rejects every attempt, and `half-open` lets a
+ * limited amount of probe attempts through.
+ */
+export type CircuitState = "closed" | "open" | "half-open";
+
+/**
+ * The error given to attempts rejected by a circuit breaker.
+ */
+export class OpenCircuitError extends Error {
+  constructor(stepName: string) {
+    super(`the circuit breaker of step '${stepName}' is open`);
+    this.name = "OpenCircuitError";
+  }
+}
+
+/**
+ * A guard over the attempts made by a step to reach an external
+ * system, which stops making them after too many consecutive
+ * failures.
+ */
+export interface CircuitBreaker {
+  /**
+   * Make an attempt if the circuit lets it through, or reject it with
+   * an OpenCircuitError otherwise.
+   *
+   * @param attempt The procedure that makes a single attempt.
+   */
+  call: <T>(attempt: () => Promise<T>) => Promise<T>;
+  /**
+   * Get the current state of the circuit.
+   */
+  state: () => CircuitState;
+}
+
+/**
+ * Parse an amount given as an option.
+ *
+ * @param value The option's value.
+ * @returns The amount.
+ */
+const parseAmount = (value: number | string): number =>
+  typeof value === "string" ? parseFloat(value) : value;
+
+/**
+ * Build a circuit breaker for the deliveries of a step. The circuit
+ * opens after the configured amount of consecutive failed attempts,
+ * stays open during the cooldown, and then half-opens to let probe
+ * attempts through. The circuit closes once enough probes succeed,
+ * and opens again if any of them fails.
+ *
+ * @param stepName The name of the step making deliveries.
+ * @param options The options of the circuit breaker.
+ * @returns The circuit breaker.
+ */
+export const makeCircuitBreaker = (
+  stepName: string,
+  options: CircuitBreakerOptions
+): CircuitBreaker => {
+  const failures = parseAmount(options.failures ?? DEFAULT_FAILURES);
+  const cooldown = parseAmount(options.cooldown ?? DEFAULT_COOLDOWN) * 1000;
+  const probes = parseAmount(options.probes ?? DEFAULT_PROBES);
+  const stepLogger = logger.with({ step: stepName });
+  let state: CircuitState = "closed";
+  // Consecutive failures while closed.
+  let failed = 0;
+  // Probes in flight, and probes that succeeded, during the current
+  // half-open period.
+  let halfOpenPeriod = 0;
+  let probing = 0;
+  let probed = 0;
+
+  const transition = (next: CircuitState) => {
+    if (next !== state) {
+      stepLogger.info(`Circuit breaker switched from ${state} to ${next}`);
+    }
+    state = next;
+    for (const label of ["closed", "open", "half-open"]) {
+      circuitBreakerState.set(
+        { step: stepName, state: label },
+        label === next ? 1 : 0
+      );
+    }
+  };
+  const open = () => {
+    transition("open");
+    failed = 0;
+    setTimeout(() => {
+      halfOpenPeriod++;
+      probing = 0;
+      probed = 0;
+      transition("half-open");
+    }, cooldown).unref();
+  };
+  transition("closed");
+
+  return {
+    call: async <T>(attempt: () => Promise<T>): Promise<T> => {
+      if (state === "open" || (state === "half-open" && probing >= probes)) {
+        throw new OpenCircuitError(stepName);
+      }
+      // Probes are accounted only within the period they belong to.
+      const period = state === "half-open" ? halfOpenPeriod : null;
+      const isProbe = () => period === halfOpenPeriod && state === "half-open";
+      if (period !== null) {
+        probing++;
+      }
+      try {
+        const result = await attempt();
+        if (isProbe()) {
+          probed++;
+          if (probed >= probes) {
+            transition("closed");
+          }
+        } else if (state === "closed") {
+          failed = 0;
+        }
+        return result;
+      } catch (err) {
+        if (isProbe()) {
+          stepLogger.warn(`Circuit breaker probe failed: ${err}`);
+          open();
+        } else if (state === "closed" && ++failed >= failures) {
+          stepLogger.warn(
+            `Circuit breaker opened after ${failed} consecutive failures: ` +
+              `${err}`
+          );
+          open();
+        }
+        throw err;
+      } finally {
+        if (period === halfOpenPeriod) {
+          probing--;
+        }
+      }
+    },
+    state: () => state,
+  };
+};
@@ -62,6 +62,27 @@ export const LOG_LEVEL = (fromEnv(
   | "warn"
   | "error";
 
+/**
+ * The format of log messages: plain text for local development, and
+ * JSON lines for log aggregators.
+ */
+export const LOG_FORMAT = (fromEnv(
+  "LOG_FORMAT",
+  (s) => s.toLowerCase(),
+  compileThrowing({ enum: ["text", "json"] })
+) ?? "text") as "text" | "json";
+
+/**
+ * The maximum length of payloads included in log messages, beyond
+ * which they're truncated.
+ */
+export const LOG_PAYLOAD_MAX_LENGTH: number =
+  fromEnv(
+    "LOG_PAYLOAD_MAX_LENGTH",
+    JSON.parse,
+    compileThrowing({ type: "integer", minimum: 0 })
+  ) ?? 256;
+
 /**
  * The maximum size of a serialized data message, in bytes.
  */
@@ -72,13 +93,48 @@ export const PARSE_BUFFER_SIZE: number =
     compileThrowing({ type: "integer", minimum: 32 })
   ) ?? (NODE_ENV === "test" ? 32 : 1048576); // 32 bytes or 1 Mib
 
+/**
+ * The maximum size of a single value received by an input form (e.g.
+ * a line, a message or a request body), in bytes. Larger values are
+ * rejected without being parsed.
+ */
+export const INPUT_MAX_BYTES: number =
+  fromEnv(
+    "INPUT_MAX_BYTES",
+    JSON.parse,
+    compileThrowing({ type: "integer", minimum: 1 })
+  ) ?? (NODE_ENV === "test" ? 4096 : 16777216); // 4 Kib or 16 Mib
+
+/**
+ * The maximum nesting depth of the JSON values received by an input
+ * form. Deeper values are rejected without being parsed.
+ */
+export const INPUT_MAX_DEPTH: number =
+  fromEnv(
+    "INPUT_MAX_DEPTH",
+    JSON.parse,
+    compileThrowing({ type: "integer", minimum: 1 })
+  ) ?? 512;
+
+/**
+ * How JSON numbers are handled: `double` parses every number as a
+ * javascript number, and `exact` keeps the numbers that can't be
+ * represented exactly (e.g. integers beyond 2^53) as they were
+ * written, so that they're serialized back without changes.
+ */
+export const JSON_NUMBERS = (fromEnv(
+  "JSON_NUMBERS",
+  (s) => s.toLowerCase(),
+  compileThrowing({ enum: ["double", "exact"] })
+) ?? "double") as "double" | "exact";
+
 /**
  * The standard PATH variable, split on ':'.
  */
 export const PATH: string[] = (process.env.PATH ?? "")
   .split(":")
   .filter((p) => p.length > 0)
-  .concat(NODE_ENV === "test" ? ["./stream-jsonnet"] : []);
+  .concat(NODE_ENV === "test" ? ["./stream-jsonnet", "./stream-lua"] : []);
 
 /**
  * The time to wait after the input drains before closing the
@@ -91,6 +147,28 @@ export const INPUT_DRAIN_TIMEOUT: number =
     compileThrowing({ type: "number", exclusiveMinimum: 0 })
   ) ?? 1; // 1 second
 
+/**
+ * The time to wait for the pipeline to drain after a shutdown signal,
+ * before forcing the process to exit.
+ */
+export const SHUTDOWN_DRAIN_TIMEOUT: number =
+  fromEnv(
+    "SHUTDOWN_DRAIN_TIMEOUT",
+    JSON.parse,
+    compileThrowing({ type: "number", exclusiveMinimum: 0 })
+  ) ?? 30; // 30 seconds
+
+/**
+ * The time to wait for each endpoint to answer when checking the
+ * pipeline's connectivity before going live.
+ */
+export const PREFLIGHT_TIMEOUT: number =
+  fromEnv(
+    "PREFLIGHT_TIMEOUT",
+    JSON.parse,
+    compileThrowing({ type: "number", exclusiveMinimum: 0 })
+  ) ?? 10; // 10 seconds
+
 /**
  * The time to wait between each self health check. Set to 0 to
  * disable self health checks.
@@ -188,6 +266,15 @@ export const POLL_INPUT_DEFAULT_INTERVAL: number =
     compileThrowing({ type: "number", exclusiveMinimum: 0 })
   ) ?? 5; // 5 seconds
 
+/**
+ * The address the prometheus metrics server binds to.
+ */
+export const METRICS_EXPOSITION_LISTEN_ADDRESS: string =
+  fromEnv(
+    "METRICS_EXPOSITION_LISTEN_ADDRESS",
+    compileThrowing({ type: "string", minLength: 1 })
+  ) ?? "0.0.0.0";
+
 /**
  * The port used to expose prometheus metric.
  */
@@ -217,6 +304,34 @@ export const METRICS_NAME_PREFIX: string =
     compileThrowing({ type: "string", pattern: "[A-Za-z]\\w*" })
   ) ?? "cdp_";
 
+/**
+ * The OTLP/HTTP endpoint that receives trace spans. Tracing is
+ * disabled unless it's set.
+ */
+export const TRACING_OTLP_ENDPOINT: string | null = fromEnv(
+  "TRACING_OTLP_ENDPOINT",
+  compileThrowing({ type: "string", pattern: "^https?://\\S+$" })
+);
+
+/**
+ * The ratio of traces sampled, for traces started by the pipeline.
+ */
+export const TRACING_SAMPLE_RATIO: number =
+  fromEnv(
+    "TRACING_SAMPLE_RATIO",
+    JSON.parse,
+    compileThrowing({ type: "number", minimum: 0, maximum: 1 })
+  ) ?? 1;
+
+/**
+ * The service name reported along with trace spans.
+ */
+export const TRACING_SERVICE_NAME: string =
+  fromEnv(
+    "TRACING_SERVICE_NAME",
+    compileThrowing({ type: "string", minLength: 1 })
+  ) ?? "cdp";
+
 /**
  * The timeout used for emitted HTTP requests.
  */
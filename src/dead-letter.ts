@@ -3,9 +3,11 @@ import {
   DEAD_LETTER_TARGET_METHOD,
   DEAD_LETTER_TARGET_HEADERS,
 } from "./conf";
-import { Event } from "./event";
+import { Event, makeFrom } from "./event";
 import { sendEvents } from "./io/http-client";
-import { makeLogger } from "./log";
+import { encodeJson } from "./json";
+import { makeLogger, truncatePayload } from "./log";
+import { stepEvents } from "./metrics";
 
 /**
  * A logger instance namespaced to this module.
@@ -19,7 +21,7 @@ const logger = makeLogger("dead-letter");
 export const handler = async (events: Event[]): Promise<void> => {
   logger.error("Events that couldn't reach the end of the pipeline:");
   for (const event of events) {
-    console.error(JSON.stringify(event));
+    console.error(encodeJson(event));
   }
   if ((DEAD_LETTER_TARGET?.length ?? 0) > 0) {
     await sendEvents(
@@ -30,3 +32,77 @@ export const handler = async (events: Event[]): Promise<void> => {
     );
   }
 };
+
+/**
+ * A procedure that reports events that a step failed to process, so
+ * that they're re-emitted as dead-letter events.
+ */
+export type FailureReporter = (
+  events: Event[],
+  error: unknown
+) => Promise<void>;
+
+/**
+ * Routing of the events a step failed to process. The reporter is
+ * given to the step's function, and the sending procedure is
+ * connected once the step is started.
+ */
+export interface FailureRouting {
+  report: FailureReporter;
+  connect: (send: (...events: Event[]) => void) => void;
+}
+
+/**
+ * Builds the routing for events a step failed to process, which
+ * re-emits them under the given name, wrapped in an envelope with
+ * the original name and data, and details of the failure.
+ *
+ * @param stepName The name of the step that fails.
+ * @param name The name given to dead-letter events.
+ * @returns The failure routing for the step.
+ */
+export const makeFailureRouting = (
+  stepName: string,
+  name: string
+): FailureRouting => {
+  let forward: ((...events: Event[]) => void) | null = null;
+  const stepLogger = logger.with({ step: stepName });
+  return {
+    report: async (events, error) => {
+      stepEvents.inc({ step: stepName, flow: "failed" }, events.length);
+      const timestamp = new Date().getTime() / 1000;
+      const message = error instanceof Error ? error.message : `${error}`;
+      for (const event of events) {
+        stepLogger
+          .with({
+            event: event.name,
+            reason: message,
+            payload: truncatePayload(event.data),
+          })
+          .warn("Step failed to process an event");
+      }
+      const deadLetters = await Promise.all(
+        events.map((event) =>
+          makeFrom(event, {
+            name,
+            data: {
+              name: event.name,
+              data: event.data,
+              error: { step: stepName, message, timestamp },
+            },
+          })
+        )
+      );
+      if (forward === null) {
+        stepLogger.warn(
+          `Step failed before being started; dropping ${events.length} events`
+        );
+        return;
+      }
+      forward(...deadLetters);
+    },
+    connect: (send) => {
+      forward = send;
+    },
+  };
+};
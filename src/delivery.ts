@@ -0,0 +1,275 @@
+import { Event } from "./event";
+import { makeLogger } from "./log";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("delivery");
+
+/**
+ * The delivery modes of output step functions. Best-effort outputs
+ * write events without waiting for confirmation, while at-least-once
+ * outputs wait for the write to be confirmed before the input
+ * acknowledges the messages the events came from.
+ */
+export type DeliveryMode = "best-effort" | "at-least-once";
+
+/**
+ * An ajv schema for the delivery option.
+ */
+export const deliveryModeSchema = { enum: ["best-effort", "at-least-once"] };
+
+/**
+ * The pending acknowledgement of a message received by an input form.
+ * The receipt is referenced by the input until the message's values
+ * are handed to the pipeline, and then by each event derived from the
+ * message, for as long as it's in transit or held by a step. It's
+ * settled once the last reference is released.
+ */
+export interface Receipt {
+  ack: () => void;
+  nack: () => void;
+  failed: boolean;
+  references: number;
+}
+
+/**
+ * The amount of outputs that currently require acknowledgements to
+ * be deferred.
+ */
+let acknowledgingOutputs = 0;
+
+/**
+ * Receipts associated with raw values received by input forms.
+ */
+const receipts: WeakMap<object, Receipt> = new WeakMap();
+
+/**
+ * The receipts referenced by each step, on behalf of the events it
+ * received and hasn't finished processing yet.
+ */
+const stepReferences: Map<string, Receipt[]> = new Map();
+
+/**
+ * Settle a receipt, guarding against errors of the source (e.g. a
+ * closed connection).
+ *
+ * @param receipt The receipt to settle.
+ */
+const settle = (receipt: Receipt): void => {
+  try {
+    if (receipt.failed) {
+      receipt.nack();
+    } else {
+      receipt.ack();
+    }
+  } catch (err) {
+    logger.warn(`Couldn't settle a message's acknowledgement: ${err}`);
+  }
+};
+
+/**
+ * Declare that an output requires acknowledgements to wait for
+ * confirmed writes. Until this is called, input forms acknowledge
+ * messages as soon as they're received.
+ *
+ * @returns A procedure that withdraws the requirement, to be called
+ * when the output is closed.
+ */
+export const requireAcknowledgements = (): (() => void) => {
+  acknowledgingOutputs++;
+  let withdrawn = false;
+  return () => {
+    if (!withdrawn) {
+      withdrawn = true;
+      acknowledgingOutputs--;
+    }
+  };
+};
+
+/**
+ * Track the acknowledgement of a message received by an input form.
+ * Unless no output requires acknowledgements and the input doesn't
+ * defer them regardless, the message is acknowledged once every
+ * event derived from it went through the pipeline, or negatively
+ * acknowledged if the delivery of any of them failed. The receipt
+ * starts with a reference held by the input, which must be released
+ * once the message's values were attached to it.
+ *
+ * @param ack The procedure that acknowledges the message.
+ * @param nack The procedure that negatively acknowledges the message.
+ * @param deferred Whether to defer the acknowledgement even if no
+ * output requires it.
+ * @returns The receipt of the message, or nothing if the message was
+ * acknowledged immediately.
+ */
+export const track = (
+  ack: () => void,
+  nack: () => void,
+  deferred = false
+): Receipt | undefined => {
+  if (acknowledgingOutputs === 0 && !deferred) {
+    ack();
+    return undefined;
+  }
+  return { ack, nack, failed: false, references: 1 };
+};
+
+/**
+ * Take a reference to a receipt, for an event or value derived from
+ * its message. Settled receipts can't be referenced again.
+ *
+ * @param receipt The receipt, if any.
+ */
+export const hold = (receipt: Receipt | undefined): void => {
+  if (typeof receipt !== "undefined" && receipt.references > 0) {
+    receipt.references++;
+  }
+};
+
+/**
+ * Release a reference to a receipt, settling it if it was the last
+ * one.
+ *
+ * @param receipt The receipt, if any.
+ */
+export const release = (receipt: Receipt | undefined): void => {
+  if (typeof receipt === "undefined" || receipt.references <= 0) {
+    return;
+  }
+  receipt.references--;
+  if (receipt.references === 0) {
+    settle(receipt);
+  }
+};
+
+/**
+ * Take a reference to the receipt of an event sent to a step, which
+ * the step keeps until it's done with every event it received.
+ *
+ * @param step The name of the step.
+ * @param event The event sent to the step.
+ * @returns Whether the reference is the first one the step holds.
+ */
+export const holdIn = (step: string, event: Event): boolean => {
+  const receipt = event.receipt;
+  if (typeof receipt === "undefined" || receipt.references <= 0) {
+    return false;
+  }
+  hold(receipt);
+  const held = stepReferences.get(step);
+  if (typeof held === "undefined") {
+    stepReferences.set(step, [receipt]);
+    return true;
+  }
+  held.push(receipt);
+  return false;
+};
+
+/**
+ * Release every reference held by a step, once it's done with every
+ * event it received.
+ *
+ * @param step The name of the step.
+ */
+export const releaseIn = (step: string): void => {
+  const held = stepReferences.get(step) ?? [];
+  stepReferences.delete(step);
+  held.forEach(release);
+};
+
+/**
+ * Combine the receipts referenced by a step into a single receipt,
+ * for the events it emits that have none of their own (e.g. they
+ * were rebuilt by a jq program). Those events can't be traced back
+ * to the events they came from, so they stand for every message the
+ * step is still working on: the combined receipt references each of
+ * them, releases them once it's settled, and fails them all if the
+ * delivery of any of its events failed. The combined receipt starts
+ * with a reference held by the caller, which must be released once
+ * the receipt was given to the events.
+ *
+ * @param step The name of the step.
+ * @returns The combined receipt, or nothing if the step doesn't
+ * reference any receipt.
+ */
+export const combineIn = (step: string): Receipt | undefined => {
+  const parts = Array.from(new Set(stepReferences.get(step) ?? [])).filter(
+    (receipt) => receipt.references > 0
+  );
+  if (parts.length === 0) {
+    return undefined;
+  }
+  parts.forEach(hold);
+  return {
+    ack: () => parts.forEach(release),
+    nack: () =>
+      parts.forEach((receipt) => {
+        receipt.failed = true;
+        release(receipt);
+      }),
+    failed: false,
+    references: 1,
+  };
+};
+
+/**
+ * Associate a raw value received by an input form with the receipt
+ * of the message it came in, taking a reference to it. The receipt,
+ * and the reference, are given to the event parsed from the value.
+ *
+ * @param thing The raw value received.
+ * @param receipt The receipt of the message, if any.
+ */
+export const attachReceipt = (
+  thing: unknown,
+  receipt: Receipt | undefined
+): void => {
+  if (
+    typeof thing === "object" &&
+    thing !== null &&
+    typeof receipt !== "undefined"
+  ) {
+    receipts.set(thing, receipt);
+    hold(receipt);
+  }
+};
+
+/**
+ * Get the receipt associated with a raw value received by an input
+ * form.
+ *
+ * @param thing The raw value received.
+ * @returns The receipt, if any.
+ */
+export const receiptOf = (thing: unknown): Receipt | undefined =>
+  typeof thing === "object" && thing !== null
+    ? receipts.get(thing)
+    : undefined;
+
+/**
+ * Mark the delivery of some events as failed, so that the messages
+ * they came from are negatively acknowledged. Events rebuilt by a
+ * step fail every message the step was working on when it emitted
+ * them (see combineIn). Events that don't have a receipt at all
+ * (e.g. they were acknowledged on arrival) don't fail any message.
+ *
+ * @param events The events that couldn't be delivered.
+ */
+export const failDelivery = (events: Event[]): void => {
+  let untraced = 0;
+  events.forEach((event) => {
+    if (typeof event.receipt === "undefined") {
+      untraced++;
+    } else {
+      event.receipt.failed = true;
+    }
+  });
+  if (untraced > 0) {
+    logger.debug(
+      "Couldn't trace",
+      untraced,
+      "failed events back to their messages"
+    );
+  }
+};
@@ -1,8 +1,13 @@
+import { SpanContext } from "@opentelemetry/api";
 import { Readable } from "stream";
 import { Channel, flatMap } from "./async-queue";
-import { parseLines, parseJson } from "./io/read-stream";
+import { Receipt, attachReceipt, receiptOf, release } from "./delivery";
+import { Encoding, decodeMessage } from "./io/encoding";
+import { checkSize, parseLimitedJson } from "./io/limits";
+import { parseInputLines, parseInputJson } from "./io/read-stream";
 import { makeLogger } from "./log";
 import { isValidEventName } from "./pattern";
+import { remoteContextOf } from "./tracing";
 import { ajv, compileThrowing } from "./utils";
 
 /**
@@ -105,6 +110,21 @@ export class Event {
    */
   id: number;
 
+  /**
+   * The context of the latest trace span recorded for the event, if
+   * tracing is enabled. It's not serialized, and derived events
+   * inherit it from their parents.
+   */
+  spanContext?: SpanContext;
+
+  /**
+   * The receipt of the message the event was received in, if its
+   * input form acknowledges messages only after they're delivered.
+   * It's not serialized, and derived events inherit it from their
+   * parents.
+   */
+  receipt?: Receipt;
+
   constructor(
     name: string,
     data: unknown,
@@ -167,15 +187,20 @@ export interface PartialEvent {
  * @param updates The changes to apply over the template.
  * @returns A newly created event.
  */
-export const makeFrom = (
+export const makeFrom = async (
   event: Event,
   updates?: PartialEvent
-): Promise<Event> =>
-  make(
+): Promise<Event> => {
+  const derived = await make(
     updates?.name ?? event.name,
-    updates?.data ?? event.data,
+    // A null value is still an update of the data.
+    typeof updates?.data === "undefined" ? event.data : updates.data,
     updates?.trace ?? event.trace
   );
+  derived.spanContext = event.spanContext;
+  derived.receipt = event.receipt;
+  return derived;
+};
 
 /**
  * Validate a raw (i.e. serialized) event. Throws an error if the
@@ -220,13 +245,16 @@ export const makeNewEventParser =
     pipelineName: string,
     pipelineSignature: string
   ): ((raw: unknown) => Promise<Event>) =>
-  (raw: unknown): Promise<Event> => {
+  async (raw: unknown): Promise<Event> => {
     validateRawEvent(raw);
     const rawValid = raw as SerializedEvent;
-    return make(rawValid.n, rawValid.d, [
+    const event = await make(rawValid.n, rawValid.d, [
       ...(rawValid.t ?? []),
       { i: arrivalTimestamp.value, p: pipelineName, h: pipelineSignature },
     ]);
+    event.spanContext = remoteContextOf(raw);
+    event.receipt = receiptOf(raw);
+    return event;
   };
 
 /**
@@ -284,9 +312,15 @@ export const parseVector = async (
       return [event];
     } catch (err) {
       logger.warn(`Event dropped after ${context}; ${err}`);
+      // The dropped value doesn't reference its message anymore.
+      release(receiptOf(rawVector));
       return [];
     }
   }
+  // The entries of a vector came in the same message as the vector.
+  const receipt = receiptOf(rawVector);
+  rawVector.forEach((entry) => attachReceipt(entry, receipt));
+  release(receipt);
   const events = [];
   for (const entry of rawVector) {
     for (const event of await parseVector(entry, parser, context)) {
@@ -379,7 +413,8 @@ export const validateWrap = (wrap: unknown, errorPrefix = "wrap"): boolean => {
 };
 
 /**
- * Choose a stream parser based on the wrapping directive.
+ * Choose a stream parser based on the wrapping directive. Values that
+ * exceed the limits of input values are rejected.
  *
  * @param wrap The wrapping directive. May be absent.
  * @return A procedure that parses a stream.
@@ -388,10 +423,60 @@ export const chooseParser = (
   wrap?: WrapDirective
 ): ((stream: Readable, limit?: number) => AsyncGenerator<unknown>) =>
   typeof wrap === "string"
-    ? parseJson
+    ? parseInputJson
     : typeof wrap !== "undefined" && wrap.raw
-    ? parseLines
-    : parseJson;
+    ? parseInputLines
+    : parseInputJson;
+
+/**
+ * Choose a parser for messages that hold a single value each (such
+ * as datagrams), based on the wrapping directive. Raw messages lose
+ * only their trailing line break, if any. Messages that exceed the
+ * limits of input values are rejected.
+ *
+ * @param wrap The wrapping directive. May be absent.
+ * @return A procedure that parses a message, throwing if it's
+ * malformed.
+ */
+export const chooseSingleValueParser = (
+  wrap?: WrapDirective
+): ((message: string) => unknown) =>
+  typeof wrap !== "undefined" && typeof wrap !== "string" && wrap.raw
+    ? (message: string) => {
+        checkSize(Buffer.byteLength(message));
+        return message.replace(/\r?\n?$/, "");
+      }
+    : parseLimitedJson;
+
+/**
+ * Choose a parser for messages received by message-oriented input
+ * forms, based on the wrapping directive and the encoding of the
+ * messages. JSON messages may hold several values, one per line, and
+ * messages in binary encodings may hold several values, one after
+ * the other. Messages that can't be decoded, or that exceed the
+ * limits of input values, produce no values.
+ *
+ * @param wrap The wrapping directive. May be absent.
+ * @param encoding The encoding of the messages.
+ * @return A procedure that parses a message.
+ */
+export const chooseMessageParser = (
+  wrap?: WrapDirective,
+  encoding: Encoding = "json"
+): ((message: Buffer) => AsyncIterable<unknown> | unknown[]) => {
+  if (encoding === "json") {
+    const parse = chooseParser(wrap);
+    return (message: Buffer) => parse(Readable.from([message]));
+  }
+  return (message: Buffer) => {
+    try {
+      return decodeMessage(message, encoding);
+    } catch (err) {
+      logger.warn(`Couldn't decode ${encoding} message: ${err}`);
+      return [];
+    }
+  };
+};
 
 /**
  * Make en event wrapper: a function that takes any value and envelops
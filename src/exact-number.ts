@@ -0,0 +1,28 @@
+/**
+ * A JSON number that can't be represented exactly as a javascript
+ * number (e.g. a 64-bit integer identifier, or a decimal with many
+ * digits), kept as it was written.
+ */
+export class ExactNumber {
+  constructor(readonly source: string) {}
+
+  /**
+   * The closest javascript number, used by arithmetic and
+   * comparisons.
+   */
+  valueOf(): number {
+    return Number(this.source);
+  }
+
+  toString(): string {
+    return this.source;
+  }
+
+  /**
+   * The closest javascript number, used by serializations that don't
+   * preserve exact numbers.
+   */
+  toJSON(): number {
+    return Number(this.source);
+  }
+}
@@ -0,0 +1,219 @@
+import { match, P } from "ts-pattern";
+import {
+  Checkpointer,
+  CheckpointOptions,
+  checkpointOptionsSchema,
+  makeCheckpointer,
+} from "./checkpoint";
+import { Event } from "./event";
+import { processor as jqProcessor } from "./io/jq";
+import { encodeJson } from "./json";
+import { makeLogger } from "./log";
+import { idempotentSkippedEvents } from "./metrics";
+import {
+  PipelineStepFunctionParameters,
+  makeExtractionProgram,
+} from "./step-functions";
+import { check, getSignature } from "./utils";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("idempotency");
+
+/**
+ * Options for skipping the deliveries of events already delivered.
+ */
+export type IdempotencyOptions = {
+  store: CheckpointOptions;
+  "key-jq-expr"?: string;
+  ttl?: number | string;
+};
+
+/**
+ * An ajv schema for the idempotency options.
+ */
+export const idempotencyOptionsSchema = {
+  type: "object",
+  properties: {
+    store: checkpointOptionsSchema,
+    "key-jq-expr": { type: "string", minLength: 1 },
+    ttl: {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+  },
+  additionalProperties: false,
+  required: ["store"],
+};
+
+/**
+ * Validate idempotency options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step the options belong to.
+ * @param prefix The path of the options, used in error messages.
+ * @param options The options to validate.
+ */
+export const validateIdempotencyOptions = (
+  name: string,
+  prefix: string,
+  options: IdempotencyOptions
+): void => {
+  check(
+    match(options).with(
+      { ttl: P.select(P.string) },
+      (ttl) => parseFloat(ttl) > 0
+    ),
+    `step '${name}' uses an invalid ${prefix}.ttl value (must be > 0)`
+  );
+};
+
+/**
+ * A guard that keeps outputs from delivering the same events twice,
+ * by remembering the keys of the events delivered in a store shared
+ * across restarts (and across instances, if the store is).
+ */
+export interface IdempotencyGuard {
+  /**
+   * Keep the events that weren't delivered yet, dropping those whose
+   * keys are in the store or are being delivered already. The keys of
+   * the events kept are held until they're settled.
+   *
+   * @param events The events about to be delivered.
+   * @returns A promise yielding the events to deliver.
+   */
+  pending: (events: Event[]) => Promise<Event[]>;
+  /**
+   * Settle the delivery of events given by `pending`. The keys of
+   * delivered events are recorded in the store, while those of
+   * events that couldn't be delivered are released, so that the
+   * events may be delivered later.
+   *
+   * @param events The events whose delivery ended.
+   * @param delivered Whether the delivery was confirmed.
+   */
+  settle: (events: Event[], delivered: boolean) => Promise<void>;
+  /**
+   * Release the resources held by the guard.
+   */
+  close: () => Promise<void>;
+}
+
+/**
+ * Build a guard that skips the deliveries of events already
+ * delivered. Each event is identified by the result of a jq
+ * expression, or by the hash of its name and data, and keys are
+ * remembered for the given TTL, or forever. If the store can't be
+ * consulted, events are delivered anyway.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The idempotency options.
+ * @param store The store of delivered keys, built from the options
+ * if not given.
+ * @returns The idempotency guard.
+ */
+export const makeIdempotencyGuard = async (
+  params: PipelineStepFunctionParameters,
+  options: IdempotencyOptions,
+  store: Checkpointer = makeCheckpointer(
+    options.store,
+    `cdp:${params.pipelineName}:${params.stepName}:delivered:`
+  )
+): Promise<IdempotencyGuard> => {
+  const ttl =
+    typeof options.ttl === "undefined"
+      ? null
+      : (typeof options.ttl === "string"
+          ? parseFloat(options.ttl)
+          : options.ttl) * 1000;
+  // Keys may be extracted with jq, for each vector at once.
+  const extractor =
+    typeof options["key-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["key-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const keysOf = async (events: Event[]): Promise<string[]> => {
+    if (extractor === null) {
+      return Promise.all(events.map((e) => getSignature(e.name, e.data)));
+    }
+    extractor.send(events);
+    const result = await extractor.receive.next();
+    const extracted: unknown[][] =
+      !result.done && Array.isArray(result.value) ? result.value : [];
+    // Extracted keys are hashed, so that they're valid store keys of
+    // a bounded length.
+    return Promise.all(
+      events.map((_, index) =>
+        getSignature(encodeJson((extracted[index] ?? [null])[0] ?? null))
+      )
+    );
+  };
+  const stepLogger = logger.with({ step: params.stepName });
+  const keys: WeakMap<Event, string> = new WeakMap();
+  // Keys being delivered, which aren't in the store yet.
+  const inFlight: Set<string> = new Set();
+  const wasDelivered = async (key: string, now: number): Promise<boolean> => {
+    try {
+      const expiry = await store.load(key);
+      return expiry === true || (typeof expiry === "number" && expiry > now);
+    } catch (err) {
+      stepLogger.warn(`Couldn't consult the store of delivered keys: ${err}`);
+      return false;
+    }
+  };
+  idempotentSkippedEvents.inc({ step: params.stepName }, 0);
+  return {
+    pending: async (events) => {
+      const now = new Date().getTime();
+      const eventKeys = await keysOf(events);
+      const delivered = await Promise.all(
+        eventKeys.map((key) => wasDelivered(key, now))
+      );
+      const kept = events.filter((event, index) => {
+        const key = eventKeys[index];
+        // Copies of an event being delivered are dropped for good,
+        // even if that delivery fails afterwards.
+        if (delivered[index] || inFlight.has(key)) {
+          return false;
+        }
+        inFlight.add(key);
+        keys.set(event, key);
+        return true;
+      });
+      idempotentSkippedEvents.inc(
+        { step: params.stepName },
+        events.length - kept.length
+      );
+      return kept;
+    },
+    settle: async (events, delivered) => {
+      const settled = events
+        .map((event) => keys.get(event))
+        .filter((key): key is string => typeof key === "string");
+      if (delivered) {
+        const now = new Date().getTime();
+        try {
+          await Promise.all(
+            settled.map((key) =>
+              ttl === null
+                ? store.save(key, true)
+                : store.save(key, now + ttl, ttl / 1000)
+            )
+          );
+        } catch (err) {
+          stepLogger.warn(`Couldn't record delivered keys: ${err}`);
+        }
+      }
+      settled.forEach((key) => inFlight.delete(key));
+    },
+    close: async () => {
+      await extractor?.close();
+      await store.close();
+    },
+  };
+};
@@ -1,14 +1,47 @@
-import fs from "fs";
 import { program } from "commander";
-import YAML from "yaml";
 import * as pkg from "../package.json";
-import { makePipelineTemplate, runPipeline } from "./api";
-import { envsubst } from "./utils";
+import {
+  analyzePipeline,
+  makePipelineTemplate,
+  probePipeline,
+  reloadOnSignals,
+  runPipeline,
+  stopOnSignals,
+} from "./api";
+import { readPipelineFile } from "./pipeline-file";
+import { checkSecretPlaceholders, envsubst, interpolate } from "./utils";
+
+export {
+  analyzePipeline,
+  makePipelineTemplate,
+  probePipeline,
+  registerInput,
+  registerStepFunction,
+  reloadOnSignals,
+  runPipeline,
+  stopOnSignals,
+} from "./api";
+export type { ProbeResult } from "./api";
+export { readPipelineFile } from "./pipeline-file";
+export type { InputModule, PipelineInputParameters } from "./input";
+export type {
+  StepFunctionModule,
+  PipelineStepFunctionParameters,
+} from "./step-functions";
 
 export const VERSION = pkg.version;
 
-if (require.main === module) {
-  program
+/**
+ * Run the command-line program, which loads a pipeline file and runs
+ * it. Programs that register their own modules call it afterwards,
+ * so that pipeline files may use them.
+ *
+ * @param argv The command-line arguments, including the executable
+ * and the script.
+ * @returns A promise that resolves once the program is done.
+ */
+export const main = async (argv: string[] = process.argv): Promise<void> => {
+  await program
     .name("cdp")
     .description(
       "Start a Composable Data Pipelines program using PIPELINEFILE as specification."
@@ -24,6 +57,16 @@ if (require.main === module) {
       "-t, --test",
       "don't start a program, but instead simply check PIPELINEFILE for correctness"
     )
+    .option(
+      "--validate",
+      "don't start a program, but instead check PIPELINEFILE for correctness " +
+        "and analyze the flow of events across its steps"
+    )
+    .option(
+      "--preflight",
+      "don't start a program, but instead check that the endpoints used by " +
+        "the input and outputs of PIPELINEFILE are reachable"
+    )
     .argument("<PIPELINEFILE>")
     .addHelpText(
       "after",
@@ -32,25 +75,63 @@ if (require.main === module) {
         `<${pkg.homepage}>`
     )
     .action(async (pipelinefile, options) => {
+      // Placeholders are always interpolated once included files are
+      // merged, after the legacy envsubst-like replacement if
+      // requested. Secret keys are checked to be given through
+      // placeholders before anything is replaced.
+      const loadPipeline = () => {
+        const rawPipeline = readPipelineFile(pipelinefile);
+        checkSecretPlaceholders(rawPipeline);
+        return makePipelineTemplate(
+          interpolate(options.environment ? envsubst(rawPipeline) : rawPipeline)
+        );
+      };
       try {
-        const rawPipeline = YAML.parse(fs.readFileSync(pipelinefile, "utf-8"));
-        const subbedPipeline = options.environment
-          ? envsubst(rawPipeline)
-          : rawPipeline;
-        const template = makePipelineTemplate(subbedPipeline);
-        if (options.test) {
+        const template = loadPipeline();
+        if (options.validate) {
+          const { errors, warnings } = analyzePipeline(template);
+          errors.forEach((error) => console.error(`Error: ${error}`));
+          warnings.forEach((warning) => console.warn(`Warning: ${warning}`));
+          if (errors.length > 0) {
+            process.exitCode = 1;
+          } else {
+            console.log("Pipeline configuration looks OK!");
+          }
+        } else if (options.preflight) {
+          const results = await probePipeline(template);
+          results.forEach(({ target, status, error }) =>
+            (status === "failed" ? console.error : console.log)(
+              `${status.toUpperCase()}: ${target}` +
+                (typeof error === "undefined" ? "" : ` (${error})`)
+            )
+          );
+          if (results.some(({ status }) => status === "failed")) {
+            process.exitCode = 1;
+          } else {
+            console.log("Pipeline endpoints look reachable!");
+          }
+        } else if (options.test) {
           console.log("Pipeline configuration looks OK!");
         } else {
-          const [promise, finish] = await runPipeline(template);
-          ["SIGINT", "SIGTERM", "SIGQUIT"].forEach((signal) =>
-            process.on(signal, finish)
-          );
-          await promise;
+          const running = await runPipeline(template);
+          // The pipeline file is read again on SIGHUP.
+          const stopReloading = reloadOnSignals(running, loadPipeline);
+          const drained = await stopOnSignals(running);
+          stopReloading();
+          if (!drained) {
+            // Pending events are lost, so the exit is forced and
+            // signalled as a failure.
+            process.exit(1);
+          }
         }
       } catch (err) {
         console.error(err);
         process.exitCode = 1;
       }
     })
-    .parse();
+    .parseAsync(argv);
+};
+
+if (require.main === module) {
+  main();
 }
@@ -1,7 +1,7 @@
 import { connect } from "amqplib";
-import { Readable } from "stream";
 import { match, P } from "ts-pattern";
 import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Receipt, attachReceipt, release, track } from "../delivery";
 import {
   Event,
   arrivalTimestamp,
@@ -9,12 +9,20 @@ import {
   parseChannel,
   WrapDirective,
   wrapDirectiveSchema,
-  chooseParser,
+  chooseMessageParser,
   makeWrapper,
   validateWrap,
 } from "../event";
+import { Encoding, encodingSchema } from "../io/encoding";
 import { makeLogger } from "../log";
-import { backpressure } from "../metrics";
+import {
+  amqpConnectionLosses,
+  amqpPrefetchUtilization,
+  amqpRequeuedMessages,
+  amqpUnackedMessages,
+  backpressure,
+} from "../metrics";
+import { attachRemoteContext } from "../tracing";
 import { check, makeFuse } from "../utils";
 import { PipelineInputParameters } from ".";
 
@@ -45,7 +53,9 @@ interface ExtendedAMQPInputOptions {
     "max-length"?: number | string;
     "max-priority"?: number | string;
   };
+  prefetch?: number | string;
   wrap?: WrapDirective;
+  encoding?: Encoding;
 }
 
 /**
@@ -118,7 +128,14 @@ export const optionsSchema = {
           additionalProperties: false,
           required: [],
         },
+        prefetch: {
+          anyOf: [
+            { type: "integer", minimum: 1, maximum: 65535 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
         wrap: wrapDirectiveSchema,
+        encoding: encodingSchema,
       },
       additionalProperties: false,
       required: ["url"],
@@ -154,11 +171,23 @@ export const validate = (options: AMQPInputOptions): void => {
     ),
     "the input has an invalid value for amqp.queue.max-priority (must be >= 0 and < 256)"
   );
+  check(
+    matchOptions.with({ prefetch: P.select(P.string) }, (prefetch) =>
+      ((n) => n >= 1 && n <= 65535)(parseInt(prefetch, 10))
+    ),
+    "the input has an invalid value for amqp.prefetch (must be > 0 and < 2^16)"
+  );
   check(
     matchOptions.with({ wrap: P.select() }, (wrap) =>
       validateWrap(wrap, "the input's wrap option")
     )
   );
+  check(
+    matchOptions
+      .with({ encoding: "json" }, () => true)
+      .with({ encoding: P._, wrap: { raw: true } }, () => false),
+    "the input can't use raw messages along with a binary amqp.encoding"
+  );
 };
 
 /**
@@ -167,6 +196,29 @@ export const validate = (options: AMQPInputOptions): void => {
 const DEFAULT_EXCHANGE_NAME = "cdp";
 const DEFAULT_EXCHANGE_TYPE = "topic";
 
+/**
+ * A message received from the amqp broker.
+ */
+interface AMQPMessage {
+  content: Buffer;
+  headers?: { [key: string]: unknown };
+  receipt?: Receipt;
+}
+
+/**
+ * Check that the AMQP broker is reachable and accepts the
+ * credentials, by connecting to it.
+ *
+ * @param options The AMQP connection options.
+ * @returns A promise that resolves if the broker is reachable.
+ */
+export const probe = async (options: AMQPInputOptions): Promise<void> => {
+  const conn = await connect(
+    typeof options === "string" ? options : options.url
+  );
+  await conn.close();
+};
+
 /**
  * Creates an input channel based on data received from an AMQP
  * broker, dispatched to a queue bound to a channel.
@@ -186,8 +238,9 @@ export const make = (
     typeof variantOptions === "string"
       ? { url: variantOptions }
       : variantOptions;
-  const parse = chooseParser(
-    (typeof options === "string" ? {} : options)?.wrap
+  const parse = chooseMessageParser(
+    (typeof options === "string" ? {} : options)?.wrap,
+    options.encoding
   );
   const wrapper = makeWrapper(
     (typeof options === "string" ? {} : options)?.wrap
@@ -197,25 +250,45 @@ export const make = (
     params.pipelineSignature
   );
 
-  const channel = flatMap(async (message: string) => {
+  const channel = flatMap(async (message: AMQPMessage) => {
     arrivalTimestamp.update();
     const things = [];
-    for await (const thing of parse(Readable.from([message]))) {
-      things.push(wrapper(thing));
+    for await (const thing of parse(message.content)) {
+      const wrapped = wrapper(thing);
+      attachRemoteContext(wrapped, message.headers);
+      attachReceipt(wrapped, message.receipt);
+      things.push(wrapped);
     }
+    // The message is settled once the events parsed from it are done
+    // with, or right away if it had none.
+    release(message.receipt);
     return things;
-  }, new AsyncQueue<string>("input.amqp").asChannel());
+  }, new AsyncQueue<AMQPMessage>("input.amqp").asChannel());
   const done = makeFuse();
+  const prefetch =
+    typeof options.prefetch === "string"
+      ? parseInt(options.prefetch, 10)
+      : options.prefetch ?? 0;
+  // Closings that happen before the input is stopped are losses of
+  // the connection or the channel.
+  let stopping = false;
+  const lose = () => {
+    if (!stopping) {
+      stopping = true;
+      amqpConnectionLosses.inc();
+    }
+    done.trigger();
+  };
 
   // Initialize endless amqp consumption
   const consuming = (async () => {
     const conn = await connect(options.url);
-    conn.on("close", () => done.trigger());
-    conn.on("error", () => done.trigger());
+    conn.on("close", lose);
+    conn.on("error", lose);
     try {
       const ch = await conn.createChannel();
-      ch.on("close", () => done.trigger());
-      ch.on("error", () => done.trigger());
+      ch.on("close", lose);
+      ch.on("error", lose);
       const { exchange } = await ch.assertExchange(
         options.exchange?.name ?? DEFAULT_EXCHANGE_NAME,
         options.exchange?.type ?? DEFAULT_EXCHANGE_TYPE,
@@ -283,34 +356,83 @@ export const make = (
             options.exchange?.type ?? DEFAULT_EXCHANGE_TYPE
           ]
       );
+      if (prefetch > 0) {
+        await ch.prefetch(prefetch);
+      }
+
+      // Messages are unacknowledged from their delivery until they're
+      // settled, or recovered if they were ignored.
+      let unacked = 0;
+      let ignored = 0;
+      const countUnacked = (delta: number) => {
+        unacked += delta;
+        amqpUnackedMessages.set({ queue }, unacked);
+        if (prefetch > 0) {
+          amqpPrefetchUtilization.set({ queue }, unacked / prefetch);
+        }
+      };
+      countUnacked(0);
+      amqpRequeuedMessages.inc({ queue, reason: "nack" }, 0);
+      amqpRequeuedMessages.inc({ queue, reason: "backpressure" }, 0);
 
       const { consumerTag } = await ch.consume(queue, (message) => {
         if (message === null) {
           return;
         }
+        countUnacked(1);
         if (!backpressure.status()) {
           logger.debug("Got message from amqp broker", message);
-          channel.send(message.content.toString());
-          ch.ack(message);
+          let settled = false;
+          const settle = (procedure: () => void) => () => {
+            if (!settled) {
+              settled = true;
+              countUnacked(-1);
+            }
+            procedure();
+          };
+          // Messages are acknowledged right away, unless an output
+          // requires confirmed writes. Negatively acknowledged
+          // messages are requeued.
+          channel.send({
+            content: message.content,
+            headers: message.properties.headers,
+            receipt: track(
+              settle(() => ch.ack(message)),
+              settle(() => {
+                amqpRequeuedMessages.inc({ queue, reason: "nack" });
+                ch.nack(message);
+              })
+            ),
+          });
+        } else {
+          ignored++;
         }
       });
       let recoveryChain = Promise.resolve();
       backpressure.on("off", () => {
-        recoveryChain = recoveryChain.then(() =>
-          ch.recover().then(
+        recoveryChain = recoveryChain.then(() => {
+          const recovered = ignored;
+          return ch.recover().then(
             () => {
-              // Disregard the return value of ch.recover().
+              ignored -= recovered;
+              countUnacked(-recovered);
+              amqpRequeuedMessages.inc(
+                { queue, reason: "backpressure" },
+                recovered
+              );
             },
             (err) =>
               logger.warn(`Couldn't recover messages from broker: ${err}`)
-          )
-        );
+          );
+        });
       });
       await done.promise;
       await recoveryChain;
       await await ch.cancel(consumerTag);
 
       await ch.close();
+      // The broker requeues every message left unacknowledged.
+      countUnacked(-unacked);
     } finally {
       await conn.close();
     }
@@ -329,6 +451,7 @@ export const make = (
           return false;
         },
         close: async () => {
+          stopping = true;
           done.trigger();
           await consuming;
           await channel.close();
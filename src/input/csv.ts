@@ -0,0 +1,199 @@
+import { createReadStream } from "fs";
+import { Readable } from "stream";
+import { match, P } from "ts-pattern";
+import { Channel } from "../async-queue";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+} from "../event";
+import { parseCSV } from "../io/csv";
+import { getSTDIN } from "../io/stdio";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/csv");
+
+/**
+ * The types CSV values may be converted to.
+ */
+type ColumnType = "string" | "number" | "boolean" | "json";
+
+/**
+ * Options for this input form.
+ */
+export type CSVInputOptions = {
+  name: string;
+  path?: string;
+  header?: boolean | "true" | "false";
+  delimiter?: string;
+  types?: { [column: string]: ColumnType };
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    name: { type: "string", minLength: 1 },
+    path: { type: "string", minLength: 1 },
+    header: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    delimiter: { type: "string", minLength: 1, maxLength: 1 },
+    types: {
+      type: "object",
+      properties: {},
+      additionalProperties: { enum: ["string", "number", "boolean", "json"] },
+    },
+  },
+  additionalProperties: false,
+  required: ["name"],
+};
+
+/**
+ * Validate csv input options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: CSVInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ name: P.select(P.string) }, isValidEventName),
+    "the input has an invalid value for csv.name: " +
+      "it must be a proper event name"
+  );
+  check(
+    matchOptions.with(
+      { delimiter: P.select(P.string) },
+      (delimiter) => !['"', "\r", "\n"].includes(delimiter)
+    ),
+    "the input has an invalid value for csv.delimiter: " +
+      "it can't be a quote or a line break"
+  );
+};
+
+/**
+ * Convert a CSV value to the given type. Empty values are converted
+ * to null, unless they're kept as strings.
+ *
+ * @param value The value, as read from the input.
+ * @param type The type to convert it to.
+ * @returns The converted value.
+ */
+const convert = (value: string, type: ColumnType): unknown => {
+  if (type === "string") {
+    return value;
+  }
+  if (value.length === 0) {
+    return null;
+  }
+  switch (type) {
+    case "number": {
+      const number = Number(value);
+      if (!isFinite(number)) {
+        throw new Error(`'${value}' is not a number`);
+      }
+      return number;
+    }
+    case "boolean":
+      if (value !== "true" && value !== "false") {
+        throw new Error(`'${value}' is not a boolean`);
+      }
+      return value === "true";
+    case "json":
+      return JSON.parse(value);
+  }
+};
+
+/**
+ * Creates an input channel based on CSV data, coming from a file or
+ * STDIN. Each row is read as an event holding an object, with fields
+ * named after the header row, or after their position. Returns a pair
+ * of [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The CSV options to configure the input channel.
+ * @returns A channel that implicitly receives rows of CSV data and
+ * forwards parsed events, and a promise that resolves when the input
+ * ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: CSVInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const header =
+    typeof options.header === "string"
+      ? options.header === "true"
+      : options.header ?? true;
+  const types = options.types ?? {};
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+  const stream: Readable =
+    typeof options.path === "string"
+      ? createReadStream(options.path)
+      : getSTDIN();
+  const records = parseCSV(stream, options.delimiter ?? ",");
+  let notifyDrained: () => void;
+  const drained: Promise<void> = new Promise((resolve) => {
+    notifyDrained = resolve;
+  });
+  async function* receive() {
+    let columns: string[] | null = null;
+    let count = 0;
+    for await (const record of records) {
+      count++;
+      if (header && columns === null) {
+        columns = record;
+        continue;
+      }
+      if (columns !== null && record.length !== columns.length) {
+        logger.warn(
+          `Skipped CSV record ${count}: it has ${record.length} fields, ` +
+            `but the header has ${columns.length}`
+        );
+        continue;
+      }
+      try {
+        const data = Object.fromEntries(
+          record.map((value, index) => {
+            const column = columns?.[index] ?? `col${index}`;
+            return [column, convert(value, types[column] ?? "string")];
+          })
+        );
+        arrivalTimestamp.update();
+        yield { n: options.name, d: data };
+      } catch (err) {
+        logger.warn(`Skipped CSV record ${count}: ${err}`);
+      }
+    }
+    notifyDrained();
+  }
+  return [
+    parseChannel(
+      {
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        receive: receive(),
+        close: async () => {
+          stream.destroy();
+          await drained;
+          logger.debug("Drained CSV input");
+        },
+      },
+      eventParser,
+      "parsing CSV input"
+    ),
+    drained,
+  ];
+};
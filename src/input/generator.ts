@@ -1,4 +1,5 @@
 import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
 import { Channel, AsyncQueue, flatMap } from "../async-queue";
 import { Event, arrivalTimestamp, makeNewEventParser } from "../event";
 import { makeLogger } from "../log";
@@ -68,6 +69,20 @@ export const validate = (options: GeneratorInputOptions): void => {
   );
 };
 
+/**
+ * The names of the events the generator input may produce.
+ *
+ * @param options The generator options.
+ * @returns The names of the events produced.
+ */
+export const emits = (options: GeneratorInputOptions): EventNames => [
+  options === null
+    ? "_"
+    : typeof options === "string"
+    ? options
+    : options.name ?? "_",
+];
+
 /**
  * Creates an input channel that produces events at a fixed rate. It
  * is mainly intended to help with testing pipelines.
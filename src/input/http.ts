@@ -1,3 +1,5 @@
+import { timingSafeEqual } from "crypto";
+import { Readable } from "stream";
 import { match, P } from "ts-pattern";
 import { Channel, AsyncQueue } from "../async-queue";
 import { HTTP_SERVER_DEFAULT_PORT, HTTP_SERVER_HEALTH_ENDPOINT } from "../conf";
@@ -8,15 +10,17 @@ import {
   parseChannel,
   WrapDirective,
   wrapDirectiveSchema,
-  chooseParser,
   makeWrapper,
   validateWrap,
 } from "../event";
 import { makeHTTPServer } from "../io/http-server";
+import { InputLimitError, checkSize, parseLimitedJson } from "../io/limits";
 import { processor as jqProcessor } from "../io/jq";
 import { processor as jsonnetProcessor } from "../io/jsonnet";
 import { makeLogger } from "../log";
 import { backpressure } from "../metrics";
+import { isValidEventName } from "../pattern";
+import { attachRemoteContext } from "../tracing";
 import { check } from "../utils";
 import { PipelineInputParameters } from ".";
 
@@ -30,7 +34,16 @@ const logger = makeLogger("input/http");
  */
 export type HTTPInputOptions =
   | string
-  | { endpoint: string; port?: number | string; wrap?: WrapDirective };
+  | {
+      endpoint: string;
+      port?: number | string;
+      host?: string;
+      "path-names"?: boolean | "true" | "false";
+      raw?: boolean | "true" | "false";
+      secret?: string;
+      "secret-header"?: string;
+      wrap?: WrapDirective;
+    };
 
 /**
  * An ajv schema for the options.
@@ -48,6 +61,17 @@ export const optionsSchema = {
             { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
           ],
         },
+        host: { type: "string", minLength: 1 },
+        "path-names": {
+          anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+        },
+        raw: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+        secret: { type: "string", minLength: 1 },
+        "secret-header": {
+          type: "string",
+          minLength: 1,
+          pattern: "^[!#$%&'*+.^_`|~0-9A-Za-z-]+$",
+        },
         wrap: wrapDirectiveSchema,
       },
       additionalProperties: false,
@@ -75,6 +99,128 @@ export const validate = (options: HTTPInputOptions): void => {
       validateWrap(wrap, "the input's wrap option")
     )
   );
+  check(
+    matchOptions.with(
+      { "path-names": P.union(true, "true"), wrap: P._ },
+      () => false
+    ),
+    "the input can't use both http.path-names and http.wrap"
+  );
+  check(
+    matchOptions
+      .with({ raw: P._, "path-names": P.union(true, "true") }, () => true)
+      .with({ raw: P._ }, () => false),
+    "the input can use http.raw only along with http.path-names (use http.wrap.raw instead)"
+  );
+  check(
+    matchOptions
+      .with({ "secret-header": P._, secret: P._ }, () => true)
+      .with({ "secret-header": P._ }, () => false),
+    "the input can't use http.secret-header without http.secret"
+  );
+};
+
+/**
+ * Default header used to carry the shared secret.
+ */
+const DEFAULT_SECRET_HEADER = "x-cdp-secret";
+
+/**
+ * Convert the part of a request path following the endpoint into an
+ * event name, mapping path separators to the event name's word
+ * separator.
+ *
+ * @param endpoint The endpoint configured for the input.
+ * @param path The request path.
+ * @returns The corresponding event name, or null if the path doesn't
+ * map to a valid one.
+ */
+export const pathToEventName = (
+  endpoint: string,
+  path: string
+): string | null => {
+  const prefix = endpoint.endsWith("/") ? endpoint : `${endpoint}/`;
+  if (!path.startsWith(prefix)) {
+    return null;
+  }
+  const name = path
+    .slice(prefix.length)
+    .split("/")
+    .filter((word) => word.length > 0)
+    .join(".");
+  return isValidEventName(name) ? name : null;
+};
+
+/**
+ * Compare a received secret with the expected one in constant time.
+ *
+ * @param received The secret received, if any.
+ * @param expected The secret expected.
+ * @returns Whether both secrets match.
+ */
+const secretMatches = (
+  received: string | undefined,
+  expected: Buffer
+): boolean => {
+  if (typeof received === "undefined") {
+    return false;
+  }
+  const receivedBuffer = Buffer.from(received);
+  return (
+    receivedBuffer.length === expected.length &&
+    timingSafeEqual(receivedBuffer, expected)
+  );
+};
+
+/**
+ * Read a request body completely, giving up as soon as it exceeds the
+ * size limit of input values.
+ *
+ * @param stream The request stream.
+ * @returns A promise yielding the body's contents.
+ * @throws InputLimitError if the body is too large.
+ */
+const readBody = async (stream: Readable): Promise<string> => {
+  const chunks: Buffer[] = [];
+  let size = 0;
+  for await (const chunk of stream) {
+    const data = Buffer.isBuffer(chunk) ? chunk : Buffer.from(chunk);
+    size += data.length;
+    checkSize(size);
+    chunks.push(data);
+  }
+  return Buffer.concat(chunks).toString();
+};
+
+/**
+ * Parse a request body into the values it contains. A body is either
+ * a single JSON value, which may be an array, or a sequence of JSON
+ * values separated by line breaks. Raw bodies are taken as lines of
+ * text.
+ *
+ * @param body The request body.
+ * @param raw Whether the body is to be taken as plain text.
+ * @returns The values found in the body.
+ * @throws SyntaxError if the body isn't valid JSON.
+ * @throws InputLimitError if a value is nested too deeply.
+ */
+const parseBody = (body: string, raw: boolean): unknown[] => {
+  const lines = body.split(/\r?\n/).filter((line) => line.trim().length > 0);
+  if (raw) {
+    return lines;
+  }
+  if (lines.length === 0) {
+    return [];
+  }
+  try {
+    return [parseLimitedJson(body)];
+  } catch (err) {
+    if (err instanceof InputLimitError) {
+      throw err;
+    }
+    // Not a single JSON value, so it should be NDJSON.
+    return lines.map((line) => parseLimitedJson(line));
+  }
 };
 
 /**
@@ -91,57 +237,123 @@ export const make = (
   params: PipelineInputParameters,
   options: HTTPInputOptions
 ): [Channel<never, Event>, Promise<void>] => {
-  const parse = chooseParser(
-    (typeof options === "string" ? {} : options)?.wrap
-  );
-  const wrapper = makeWrapper(
-    (typeof options === "string" ? {} : options)?.wrap
-  );
-  const endpoint = typeof options === "string" ? options : options.endpoint;
+  const extendedOptions =
+    typeof options === "string" ? { endpoint: options } : options;
+  const endpoint = extendedOptions.endpoint;
   const rawPort: number | string =
-    typeof options === "string"
-      ? HTTP_SERVER_DEFAULT_PORT
-      : options.port ?? HTTP_SERVER_DEFAULT_PORT;
+    extendedOptions.port ?? HTTP_SERVER_DEFAULT_PORT;
   const port = typeof rawPort === "string" ? parseInt(rawPort) : rawPort;
+  const pathNames =
+    typeof extendedOptions["path-names"] === "string"
+      ? extendedOptions["path-names"] === "true"
+      : extendedOptions["path-names"] ?? false;
+  const raw =
+    typeof extendedOptions.raw === "string"
+      ? extendedOptions.raw === "true"
+      : extendedOptions.raw ?? false;
+  const secret =
+    typeof extendedOptions.secret === "string"
+      ? Buffer.from(extendedOptions.secret)
+      : null;
+  const secretHeader = (
+    extendedOptions["secret-header"] ?? DEFAULT_SECRET_HEADER
+  ).toLowerCase();
+  // Requests are either sent to the endpoint itself, or to a path
+  // under it naming the events, as indicated by the options.
+  const wrapFor = (path: string): WrapDirective | null | undefined => {
+    if (!pathNames) {
+      return path === endpoint ? extendedOptions.wrap : null;
+    }
+    const name = pathToEventName(endpoint, path);
+    return name === null ? null : { name, raw };
+  };
   const eventParser = makeNewEventParser(
     params.pipelineName,
     params.pipelineSignature
   );
   const queue = new AsyncQueue<unknown>("input.http");
-  const server = makeHTTPServer(port, async (ctx) => {
-    logger.debug("Received request:", ctx.request.method, ctx.request.path);
-    if (ctx.request.method === "POST" && ctx.request.path === endpoint) {
-      if (backpressure.status()) {
-        ctx.status = 503;
-      } else {
-        logger.debug("Received events payload:", ctx.request.length, "bytes");
-        arrivalTimestamp.update();
-        for await (const thing of parse(ctx.req, ctx.request.length)) {
-          queue.push(wrapper(thing));
+  let closing = false;
+  const server = makeHTTPServer(
+    port,
+    async (ctx) => {
+      logger.debug("Received request:", ctx.request.method, ctx.request.path);
+      const wrap =
+        ctx.request.method === "POST" ? wrapFor(ctx.request.path) : null;
+      if (wrap !== null) {
+        if (
+          secret !== null &&
+          !secretMatches(ctx.get(secretHeader) || undefined, secret)
+        ) {
+          logger.info("Rejected request with a missing or invalid secret");
+          ctx.status = 401;
+        } else if (closing || backpressure.status()) {
+          // Clients are expected to retry later.
+          ctx.set("Retry-After", "1");
+          if (closing) {
+            ctx.set("Connection", "close");
+          }
+          ctx.status = 503;
+        } else {
+          logger.debug(
+            "Received events payload:",
+            ctx.request.length,
+            "bytes"
+          );
+          arrivalTimestamp.update();
+          let values;
+          try {
+            // Bodies declared too large aren't read at all.
+            checkSize(ctx.request.length ?? 0);
+            values = parseBody(
+              await readBody(ctx.req),
+              typeof wrap === "object" && (wrap.raw ?? false)
+            );
+          } catch (err) {
+            if (err instanceof InputLimitError) {
+              logger.info(`Rejected request exceeding a limit: ${err}`);
+              // The rest of the body is left unread.
+              ctx.set("Connection", "close");
+              ctx.status = 413;
+              ctx.body = { error: err.message };
+              return;
+            }
+            logger.info(`Rejected request with malformed body: ${err}`);
+            ctx.status = 400;
+            ctx.body = { error: "malformed JSON body" };
+            return;
+          }
+          const wrapper = makeWrapper(wrap);
+          for (const value of values) {
+            const thing = wrapper(value);
+            attachRemoteContext(thing, ctx.headers);
+            queue.push(thing);
+          }
+          // The events were accepted into the pipeline.
+          ctx.body = null;
+        }
+      } else if (
+        ctx.request.method === "GET" &&
+        ctx.request.path === HTTP_SERVER_HEALTH_ENDPOINT
+      ) {
+        ctx.type = "application/health+json";
+        if (jqProcessor.isHealthy() && jsonnetProcessor.isHealthy()) {
+          ctx.body = JSON.stringify({ status: "pass" });
+        } else {
+          logger.warn("Notified unhealthy status");
+          ctx.body = JSON.stringify({ status: "fail" });
+          ctx.status = 500;
         }
-        ctx.body = null;
-      }
-    } else if (
-      ctx.request.method === "GET" &&
-      ctx.request.path === HTTP_SERVER_HEALTH_ENDPOINT
-    ) {
-      ctx.type = "application/health+json";
-      if (jqProcessor.isHealthy() && jsonnetProcessor.isHealthy()) {
-        ctx.body = JSON.stringify({ status: "pass" });
       } else {
-        logger.warn("Notified unhealthy status");
-        ctx.body = JSON.stringify({ status: "fail" });
-        ctx.status = 500;
+        logger.info(
+          "Received unrecognized request:",
+          ctx.request.method,
+          ctx.request.path
+        );
+        ctx.status = 404;
       }
-    } else {
-      logger.info(
-        "Received unrecognized request:",
-        ctx.request.method,
-        ctx.request.path
-      );
-      ctx.status = 404;
-    }
-  });
+    },
+    extendedOptions.host
+  );
   const channel = queue.asChannel();
   return [
     parseChannel(
@@ -152,6 +364,9 @@ export const make = (
           return false;
         },
         close: async () => {
+          // New requests are rejected, while in-flight ones are
+          // allowed to finish before closing the channel.
+          closing = true;
           await server.close();
           await channel.close();
           logger.debug("Drained HTTP input");
@@ -1,3 +1,7 @@
+import { Channel } from "../async-queue";
+import { EventNames } from "../analysis";
+import { Event } from "../event";
+
 /**
  * Parameters given to each input form initializer.
  */
@@ -7,3 +11,54 @@ export interface PipelineInputParameters {
   "jq-prelude"?: string;
   "jsonnet-prelude"?: string;
 }
+
+/**
+ * The contract an input form fulfills, either provided or registered
+ * as an extension.
+ */
+/* eslint-disable-next-line @typescript-eslint/no-explicit-any */
+export interface InputModule<Options = any> {
+  /**
+   * An ajv schema for the input's options.
+   */
+  optionsSchema: object;
+  /**
+   * Validate the input's options, after they've been checked by the
+   * ajv schema. Throws an error if they're invalid.
+   *
+   * @param options The options to validate.
+   */
+  validate(options: Options): void;
+  /**
+   * Analyze the names of the events the input may produce. Inputs
+   * that don't know them in advance may omit it.
+   *
+   * @param options The input's options.
+   * @returns The names of the events, or null if they're unknown.
+   */
+  emits?(options: Options): EventNames;
+  /**
+   * Check that the endpoints the input connects to are reachable,
+   * without consuming anything. Inputs that don't connect to
+   * anything may omit it.
+   *
+   * @param options The input's options.
+   * @param signal A signal that's aborted once the check times out.
+   * @returns A promise that resolves if the endpoints are reachable,
+   * or rejects with the reason they aren't, or null if the options
+   * leave nothing to check.
+   */
+  probe?(options: Options, signal: AbortSignal): Promise<void> | null;
+  /**
+   * Start the input.
+   *
+   * @param params Configuration parameters acquired from the pipeline.
+   * @param options The input's options.
+   * @returns The channel that produces the input's events, and a
+   * promise that resolves once the input has ended.
+   */
+  make(
+    params: PipelineInputParameters,
+    options: Options
+  ): [Channel<never, Event>, Promise<void>];
+}
@@ -0,0 +1,410 @@
+import { Kafka, logLevel } from "kafkajs";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import { Receipt, attachReceipt, release, track } from "../delivery";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseMessageParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import { Encoding } from "../io/encoding";
+import { makeLogger } from "../log";
+import { backpressure } from "../metrics";
+import { isValidEventName } from "../pattern";
+import { attachRemoteContext } from "../tracing";
+import { check, makeFuse } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/kafka");
+
+/**
+ * Options for this input form.
+ */
+export type KafkaInputOptions = {
+  brokers: string | string[];
+  topics: string | string[];
+  group?: string;
+  "client-id"?: string;
+  "from-beginning"?: boolean | "true" | "false";
+  raw?: boolean | "true" | "false";
+  encoding?: "utf8" | "base64" | "msgpack" | "cbor";
+  wrap?: WrapDirective;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    brokers: {
+      anyOf: [
+        { type: "string", minLength: 1 },
+        {
+          type: "array",
+          items: { type: "string", minLength: 1 },
+          minItems: 1,
+        },
+      ],
+    },
+    topics: {
+      anyOf: [
+        { type: "string", minLength: 1 },
+        {
+          type: "array",
+          items: { type: "string", minLength: 1 },
+          minItems: 1,
+        },
+      ],
+    },
+    group: { type: "string", minLength: 1 },
+    "client-id": { type: "string", minLength: 1 },
+    "from-beginning": {
+      anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+    },
+    raw: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    encoding: { enum: ["utf8", "base64", "msgpack", "cbor"] },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: ["brokers", "topics"],
+};
+
+/**
+ * Validate kafka input options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: KafkaInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ wrap: P._, raw: P._ }, () => false),
+    "the input can't use both kafka.wrap and kafka.raw (use kafka.wrap.raw instead)"
+  );
+  check(
+    matchOptions.with({ encoding: "base64", raw: P._ }, () => false),
+    "the input can't use kafka.raw with base64-encoded messages, " +
+      "which are always wrapped as strings"
+  );
+  check(
+    matchOptions
+      .with(
+        { encoding: P.union("msgpack", "cbor"), raw: P.union(true, "true") },
+        () => false
+      )
+      .with(
+        { encoding: P.union("msgpack", "cbor"), wrap: { raw: true } },
+        () => false
+      ),
+    "the input can't use raw messages along with a binary kafka.encoding"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+  check(
+    matchOptions
+      .with({ wrap: P._ }, () => true)
+      .with({ topics: P.select(P.string) }, isValidEventName)
+      .with({ topics: P.select(P.array(P.string)) }, (topics) =>
+        topics.every(isValidEventName)
+      ),
+    "the input's kafka topics must be valid event names, " +
+      "unless the kafka.wrap option is used"
+  );
+};
+
+/**
+ * Default values for the kafka consumer.
+ */
+const DEFAULT_GROUP = "cdp";
+const DEFAULT_CLIENT_ID = "cdp";
+
+/**
+ * The milliseconds waited to commit acknowledged offsets, so that
+ * the offsets of many messages are committed at once.
+ */
+const COMMIT_INTERVAL = 1000;
+
+/**
+ * A message received from a kafka topic.
+ */
+interface KafkaMessage {
+  topic: string;
+  value: Buffer;
+  headers?: { [key: string]: unknown };
+  receipt?: Receipt;
+}
+
+/**
+ * A consumed message of a partition, and whether it was acknowledged.
+ */
+type ConsumedOffset = { offset: string; acked: boolean };
+
+/**
+ * Check that the kafka brokers are reachable and hold the topics, by
+ * fetching the topics' metadata.
+ *
+ * @param options The kafka connection options.
+ * @returns A promise that resolves if the brokers are reachable.
+ */
+export const probe = async (options: KafkaInputOptions): Promise<void> => {
+  const admin = new Kafka({
+    clientId: options["client-id"] ?? DEFAULT_CLIENT_ID,
+    brokers:
+      typeof options.brokers === "string" ? [options.brokers] : options.brokers,
+    logLevel: logLevel.NOTHING,
+    retry: { retries: 0 },
+  }).admin();
+  await admin.connect();
+  try {
+    await admin.fetchTopicMetadata({
+      topics:
+        typeof options.topics === "string" ? [options.topics] : options.topics,
+    });
+  } finally {
+    await admin.disconnect();
+  }
+};
+
+/**
+ * Creates an input channel based on data received from one or more
+ * kafka topics, consumed as part of a consumer group.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The kafka connection options to configure the input
+ * channel.
+ * @returns A channel that receives data from kafka topics and
+ * forwards parsed events, and a promise that resolves when the input
+ * ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: KafkaInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const brokers =
+    typeof options.brokers === "string" ? [options.brokers] : options.brokers;
+  const topics =
+    typeof options.topics === "string" ? [options.topics] : options.topics;
+  const raw =
+    typeof options.raw === "string" ? options.raw === "true" : options.raw;
+  const base64 = options.encoding === "base64";
+  const encoding: Encoding =
+    options.encoding === "msgpack" || options.encoding === "cbor"
+      ? options.encoding
+      : "json";
+  const fromBeginning =
+    typeof options["from-beginning"] === "string"
+      ? options["from-beginning"] === "true"
+      : options["from-beginning"] ?? false;
+  // Messages are wrapped in events named after their topic, unless
+  // told otherwise.
+  const wrapFor = (topic: string): WrapDirective =>
+    options.wrap ?? { name: topic, raw: raw ?? false };
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+
+  const channel = flatMap(async (message: KafkaMessage) => {
+    arrivalTimestamp.update();
+    const wrap = wrapFor(message.topic);
+    const wrapper = makeWrapper(wrap);
+    if (base64) {
+      // Binary messages are wrapped whole, as the base64 string of
+      // their bytes.
+      const wrapped = wrapper(message.value.toString("base64"));
+      attachRemoteContext(wrapped, message.headers);
+      attachReceipt(wrapped, message.receipt);
+      release(message.receipt);
+      return [wrapped];
+    }
+    const parse = chooseMessageParser(wrap, encoding);
+    const things = [];
+    for await (const thing of parse(message.value)) {
+      const wrapped = wrapper(thing);
+      attachRemoteContext(wrapped, message.headers);
+      attachReceipt(wrapped, message.receipt);
+      things.push(wrapped);
+    }
+    release(message.receipt);
+    return things;
+  }, new AsyncQueue<KafkaMessage>("input.kafka").asChannel());
+  const done = makeFuse();
+
+  const kafka = new Kafka({
+    clientId: options["client-id"] ?? DEFAULT_CLIENT_ID,
+    brokers,
+    logLevel: logLevel.ERROR,
+  });
+  const consumer = kafka.consumer({ groupId: options.group ?? DEFAULT_GROUP });
+  consumer.on(consumer.events.CRASH, ({ payload }) => {
+    logger.error(`Kafka consumer crashed: ${payload.error}`);
+    if (!payload.restart) {
+      done.trigger();
+    }
+  });
+
+  // Offsets are committed in the order messages were consumed from
+  // each partition, up to the first message that's not acknowledged
+  // yet, since a commit covers every message before it. Commits are
+  // batched: the latest offset of each partition is committed once
+  // the commit interval elapses, or when the consumer stops.
+  const consumedOffsets: Map<string, ConsumedOffset[]> = new Map();
+  const pendingCommits: Map<
+    string,
+    { topic: string; partition: number; offset: string }
+  > = new Map();
+  let commitTimer: ReturnType<typeof setTimeout> | null = null;
+  let committing: Promise<void> = Promise.resolve();
+  const commitPending = () => {
+    if (commitTimer !== null) {
+      clearTimeout(commitTimer);
+      commitTimer = null;
+    }
+    if (pendingCommits.size === 0) {
+      return;
+    }
+    const offsets = Array.from(pendingCommits.values());
+    pendingCommits.clear();
+    committing = committing
+      .then(() => consumer.commitOffsets(offsets))
+      .catch((err) => {
+        logger.warn(`Couldn't commit kafka offsets: ${err}`);
+      });
+  };
+  const commitAcknowledged = (topic: string, partition: number) => {
+    const key = `${topic}:${partition}`;
+    const consumed = consumedOffsets.get(key) ?? [];
+    let committed: ConsumedOffset | undefined;
+    while (consumed.length > 0 && consumed[0].acked) {
+      committed = consumed.shift();
+    }
+    if (typeof committed === "undefined") {
+      return;
+    }
+    const offset = (BigInt(committed.offset) + BigInt(1)).toString();
+    pendingCommits.set(key, { topic, partition, offset });
+    if (commitTimer === null) {
+      commitTimer = setTimeout(commitPending, COMMIT_INTERVAL);
+    }
+  };
+  // Messages that fail make the consumer seek back to them, so that
+  // they and the messages consumed after them in their partition are
+  // consumed again. Those are tracked anew once they're consumed
+  // again, which also keeps the partition's commits from being held
+  // back by the failed message.
+  const rewind = (
+    topic: string,
+    partition: number,
+    failed: ConsumedOffset
+  ) => {
+    const consumed = consumedOffsets.get(`${topic}:${partition}`) ?? [];
+    const index = consumed.indexOf(failed);
+    if (index < 0 || done.value()) {
+      // The partition was already rewound past the message, or the
+      // consumer is stopping and the message will be consumed again
+      // when it restarts.
+      return;
+    }
+    consumed.splice(index);
+    try {
+      consumer.seek({ topic, partition, offset: failed.offset });
+    } catch (err) {
+      logger.warn(`Couldn't seek back to a failed kafka message: ${err}`);
+    }
+  };
+
+  // Initialize endless kafka consumption
+  const consuming = (async () => {
+    await consumer.connect();
+    try {
+      await consumer.subscribe({ topics, fromBeginning });
+      await consumer.run({
+        autoCommit: false,
+        eachMessage: async ({ topic, partition, message }) => {
+          if (backpressure.status()) {
+            await done.guard((resolve) => backpressure.once("off", resolve));
+          }
+          if (done.value()) {
+            // The offset isn't committed, so the message will be
+            // delivered again once consumption resumes.
+            return;
+          }
+          logger.debug("Got message from kafka topic", topic, ":", message);
+          const key = `${topic}:${partition}`;
+          const consumed: ConsumedOffset = {
+            offset: message.offset,
+            acked: false,
+          };
+          consumedOffsets.set(key, consumedOffsets.get(key) ?? []);
+          (consumedOffsets.get(key) as ConsumedOffset[]).push(consumed);
+          // Offsets are committed right away, unless an output
+          // requires confirmed writes.
+          channel.send({
+            topic,
+            value: message.value ?? Buffer.alloc(0),
+            headers: message.headers,
+            receipt: track(
+              () => {
+                consumed.acked = true;
+                commitAcknowledged(topic, partition);
+              },
+              () => {
+                logger.warn(
+                  "Couldn't deliver the events of kafka message",
+                  message.offset,
+                  "of",
+                  key,
+                  "; consuming its partition again from it"
+                );
+                rewind(topic, partition, consumed);
+              }
+            ),
+          });
+        },
+      });
+      await done.promise;
+    } finally {
+      commitPending();
+      await committing;
+      await consumer.disconnect();
+    }
+  })().catch((err) => {
+    logger.error(`Error during kafka consumption: ${err}`);
+    done.trigger();
+  });
+
+  // Assemble the event channel.
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          done.trigger();
+          await consuming;
+          await channel.close();
+          logger.debug("Drained kafka input");
+        },
+      },
+      eventParser,
+      "parsing kafka message"
+    ),
+    consuming,
+  ];
+};
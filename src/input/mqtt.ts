@@ -1,4 +1,3 @@
-import { Readable } from "stream";
 import { IClientOptions, connect } from "mqtt";
 import { match, P } from "ts-pattern";
 import { AsyncQueue, Channel, flatMap } from "../async-queue";
@@ -9,10 +8,11 @@ import {
   parseChannel,
   WrapDirective,
   wrapDirectiveSchema,
-  chooseParser,
+  chooseMessageParser,
   makeWrapper,
   validateWrap,
 } from "../event";
+import { Encoding, encodingSchema } from "../io/encoding";
 import { makeLogger } from "../log";
 import { backpressure } from "../metrics";
 import { check, makeFuse } from "../utils";
@@ -32,7 +32,13 @@ export type MQTTInputOptions =
       url: string;
       options?: IClientOptions;
       topic?: string | string[] | Record<string, { qos: 0 | 1 | 2 }>;
+      qos?: 0 | 1 | 2;
+      clean?: boolean | "true" | "false";
+      "client-id"?: string;
+      "topic-names"?: boolean | "true" | "false";
+      raw?: boolean | "true" | "false";
       wrap?: WrapDirective;
+      encoding?: Encoding;
     };
 
 /**
@@ -68,7 +74,15 @@ export const optionsSchema = {
             },
           ],
         },
+        qos: { enum: [0, 1, 2] },
+        clean: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+        "client-id": { type: "string", minLength: 1 },
+        "topic-names": {
+          anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+        },
+        raw: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
         wrap: wrapDirectiveSchema,
+        encoding: encodingSchema,
       },
       additionalProperties: false,
       required: ["url"],
@@ -84,18 +98,82 @@ export const optionsSchema = {
  */
 export const validate = (options: MQTTInputOptions): void => {
   // TODO: validate mqtt connection options
+  const matchOptions = match(options);
   check(
-    match(options).with({ wrap: P.select() }, (wrap) =>
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
       validateWrap(wrap, "the input's wrap option")
     )
   );
+  check(
+    matchOptions.with(
+      { "topic-names": P.union(true, "true"), wrap: P._ },
+      () => false
+    ),
+    "the input can't use both mqtt.topic-names and mqtt.wrap"
+  );
+  check(
+    matchOptions
+      .with({ raw: P._, "topic-names": P.union(true, "true") }, () => true)
+      .with({ raw: P._ }, () => false),
+    "the input can use mqtt.raw only along with mqtt.topic-names (use mqtt.wrap.raw instead)"
+  );
+  check(
+    matchOptions
+      .with({ encoding: "json" }, () => true)
+      .with({ encoding: P._, raw: P.union(true, "true") }, () => false)
+      .with({ encoding: P._, wrap: { raw: true } }, () => false),
+    "the input can't use raw messages along with a binary mqtt.encoding"
+  );
+  check(
+    matchOptions
+      .with({ clean: P.union(false, "false"), "client-id": P._ }, () => true)
+      .with({ clean: P.union(false, "false") }, () => false),
+    "the input must specify mqtt.client-id to use a persistent session"
+  );
+  check(
+    matchOptions.with(
+      {
+        qos: P._,
+        topic: P.when(
+          (topic) => typeof topic === "object" && !Array.isArray(topic)
+        ),
+      },
+      () => false
+    ),
+    "the input can't use mqtt.qos when giving QoS specifications in mqtt.topic"
+  );
 };
 
+/**
+ * Convert an MQTT topic into an event name, mapping the topic's level
+ * separator to the event name's word separator.
+ *
+ * @param topic The MQTT topic.
+ * @returns The corresponding event name.
+ */
+export const topicToEventName = (topic: string): string =>
+  topic.split("/").join(".");
+
 /**
  * Default topic to subscribe to, when no topic is specified.
  */
 const DEFAULT_TOPIC = "cdp/#";
 
+/**
+ * Bounds for the delay between reconnection attempts, in
+ * milliseconds. The delay doubles after each failed attempt.
+ */
+const MIN_RECONNECT_PERIOD = 1000;
+const MAX_RECONNECT_PERIOD = 60000;
+
+/**
+ * A message received from a MQTT topic.
+ */
+interface MQTTMessage {
+  topic: string;
+  value: Buffer;
+}
+
 /**
  * Creates an input channel based on data received from a MQTT broker.
  *
@@ -110,36 +188,57 @@ export const make = (
   params: PipelineInputParameters,
   options: MQTTInputOptions
 ): [Channel<never, Event>, Promise<void>] => {
-  const url = typeof options === "string" ? options : options.url;
-  const topic =
-    typeof options === "string"
-      ? DEFAULT_TOPIC
-      : options.topic ?? DEFAULT_TOPIC;
-  const parse = chooseParser(
-    (typeof options === "string" ? {} : options)?.wrap
-  );
-  const wrapper = makeWrapper(
-    (typeof options === "string" ? {} : options)?.wrap
-  );
+  const extendedOptions =
+    typeof options === "string" ? { url: options } : options;
+  const url = extendedOptions.url;
+  const topic = extendedOptions.topic ?? DEFAULT_TOPIC;
+  const qos = extendedOptions.qos ?? 0;
+  const clean =
+    typeof extendedOptions.clean === "string"
+      ? extendedOptions.clean === "true"
+      : extendedOptions.clean;
+  const topicNames =
+    typeof extendedOptions["topic-names"] === "string"
+      ? extendedOptions["topic-names"] === "true"
+      : extendedOptions["topic-names"] ?? false;
+  const raw =
+    typeof extendedOptions.raw === "string"
+      ? extendedOptions.raw === "true"
+      : extendedOptions.raw ?? false;
+  // Messages may be wrapped in events named after their topic.
+  const wrapFor = (fromTopic: string): WrapDirective | undefined =>
+    topicNames
+      ? { name: topicToEventName(fromTopic), raw }
+      : extendedOptions.wrap;
+  const encoding = extendedOptions.encoding ?? "json";
   const eventParser = makeNewEventParser(
     params.pipelineName,
     params.pipelineSignature
   );
 
-  const channel = flatMap(async (message: string) => {
+  const channel = flatMap(async (message: MQTTMessage) => {
     arrivalTimestamp.update();
+    const wrap = wrapFor(message.topic);
+    const parse = chooseMessageParser(wrap, encoding);
+    const wrapper = makeWrapper(wrap);
     const things = [];
-    for await (const thing of parse(Readable.from([message]))) {
+    for await (const thing of parse(message.value)) {
       things.push(wrapper(thing));
     }
     return things;
-  }, new AsyncQueue<string>("input.mqtt").asChannel());
+  }, new AsyncQueue<MQTTMessage>("input.mqtt").asChannel());
   const done = makeFuse();
 
-  const client =
-    typeof options === "string" || typeof options.options === "undefined"
-      ? connect(url, {})
-      : connect(url, options.options);
+  const initialReconnectPeriod =
+    extendedOptions.options?.reconnectPeriod ?? MIN_RECONNECT_PERIOD;
+  const client = connect(url, {
+    ...(extendedOptions.options ?? {}),
+    ...(typeof clean !== "undefined" ? { clean } : {}),
+    ...(typeof extendedOptions["client-id"] !== "undefined"
+      ? { clientId: extendedOptions["client-id"] }
+      : {}),
+    reconnectPeriod: initialReconnectPeriod,
+  });
   // Emit backpressure as documented here:
   // https://github.com/mqttjs/MQTT.js#mqttclienthandlemessagepacket-callback
   client.handleMessage = (_, callback) => {
@@ -149,13 +248,35 @@ export const make = (
       callback();
     }
   };
+  // The client reconnects on its own, so errors don't end the
+  // input. The delay between attempts grows exponentially.
   client.on("error", (err) => {
     logger.error(`MQTT client notified an error: ${err}`);
-    done.trigger();
   });
-  client.on("connect", () => {
+  client.on("reconnect", () => {
+    logger.info(
+      `MQTT client attempting to reconnect after ${client.options.reconnectPeriod} ms`
+    );
+    if (initialReconnectPeriod > 0) {
+      client.options.reconnectPeriod = Math.min(
+        (client.options.reconnectPeriod ?? initialReconnectPeriod) * 2,
+        MAX_RECONNECT_PERIOD
+      );
+    }
+  });
+  client.on("connect", (connack) => {
     logger.debug("MQTT client connected successfully");
-    client.subscribe(topic, (err) => {
+    client.options.reconnectPeriod = initialReconnectPeriod;
+    if (connack.sessionPresent) {
+      // Subscriptions are kept by the broker in persistent sessions.
+      logger.debug("MQTT client resumed a persistent session");
+      return;
+    }
+    const subscription =
+      typeof topic === "string" || Array.isArray(topic)
+        ? { topic, options: { qos } }
+        : { topic, options: {} };
+    client.subscribe(subscription.topic, subscription.options, (err) => {
       if (err) {
         logger.error(`Error when subscribing to MQTT topic(s): ${err}`);
         done.trigger();
@@ -166,7 +287,7 @@ export const make = (
   });
   client.on("message", (fromTopic, message) => {
     logger.debug("Got message from MQTT topic", fromTopic, ":", message);
-    channel.send(message.toString());
+    channel.send({ topic: fromTopic, value: message });
   });
 
   const consuming = done.promise
@@ -0,0 +1,270 @@
+import { connect, consumerOpts } from "nats";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import { Receipt, attachReceipt, release, track } from "../delivery";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseMessageParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import { Encoding, encodingSchema } from "../io/encoding";
+import { makeLogger } from "../log";
+import { backpressure } from "../metrics";
+import { check, makeFuse } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/nats");
+
+/**
+ * Options for this input form.
+ */
+export type NATSInputOptions = {
+  url: string | string[];
+  subject: string;
+  queue?: string;
+  jetstream?: {
+    durable: string;
+    batch?: number | string;
+  };
+  raw?: boolean | "true" | "false";
+  wrap?: WrapDirective;
+  encoding?: Encoding;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    url: {
+      anyOf: [
+        { type: "string", minLength: 1 },
+        {
+          type: "array",
+          items: { type: "string", minLength: 1 },
+          minItems: 1,
+        },
+      ],
+    },
+    subject: { type: "string", minLength: 1 },
+    queue: { type: "string", minLength: 1 },
+    jetstream: {
+      type: "object",
+      properties: {
+        durable: { type: "string", minLength: 1 },
+        batch: {
+          anyOf: [
+            { type: "integer", minimum: 1 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+      },
+      additionalProperties: false,
+      required: ["durable"],
+    },
+    raw: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    wrap: wrapDirectiveSchema,
+    encoding: encodingSchema,
+  },
+  additionalProperties: false,
+  required: ["url", "subject"],
+};
+
+/**
+ * Validate nats input options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: NATSInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ wrap: P._, raw: P._ }, () => false),
+    "the input can't use both nats.wrap and nats.raw (use nats.wrap.raw instead)"
+  );
+  check(
+    matchOptions
+      .with({ encoding: "json" }, () => true)
+      .with({ encoding: P._, raw: P.union(true, "true") }, () => false)
+      .with({ encoding: P._, wrap: { raw: true } }, () => false),
+    "the input can't use raw messages along with a binary nats.encoding"
+  );
+  check(
+    matchOptions.with({ jetstream: P._, queue: P._ }, () => false),
+    "the input can't use both nats.jetstream and nats.queue"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+};
+
+/**
+ * Default amount of messages pulled at once from JetStream.
+ */
+const DEFAULT_JETSTREAM_BATCH = 100;
+
+/**
+ * Time in milliseconds a JetStream pull request waits for messages.
+ */
+const JETSTREAM_PULL_EXPIRES = 5000;
+
+/**
+ * A message received from a NATS subject.
+ */
+interface NATSMessage {
+  subject: string;
+  data: Uint8Array;
+  receipt?: Receipt;
+}
+
+/**
+ * Check that the NATS server is reachable, by connecting to it.
+ *
+ * @param options The options that indicate the server's URL.
+ * @returns A promise that resolves if the server is reachable.
+ */
+export const probe = async (options: NATSInputOptions): Promise<void> => {
+  const nc = await connect({ servers: options.url });
+  await nc.close();
+};
+
+/**
+ * Creates an input channel based on data received from a NATS
+ * subject, either from a plain subscription or from a JetStream pull
+ * consumer.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The NATS connection options to configure the input
+ * channel.
+ * @returns A channel that receives data from a NATS server and
+ * forwards parsed events, and a promise that resolves when the input
+ * ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: NATSInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const raw =
+    typeof options.raw === "string" ? options.raw === "true" : options.raw;
+  // Messages are wrapped in events named after their subject, unless
+  // told otherwise.
+  const wrapFor = (subject: string): WrapDirective =>
+    options.wrap ?? { name: subject, raw: raw ?? false };
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+  const encoding = options.encoding ?? "json";
+
+  const channel = flatMap(async (message: NATSMessage) => {
+    arrivalTimestamp.update();
+    const wrap = wrapFor(message.subject);
+    const parse = chooseMessageParser(wrap, encoding);
+    const wrapper = makeWrapper(wrap);
+    const things = [];
+    for await (const thing of parse(Buffer.from(message.data))) {
+      const wrapped = wrapper(thing);
+      attachReceipt(wrapped, message.receipt);
+      things.push(wrapped);
+    }
+    release(message.receipt);
+    return things;
+  }, new AsyncQueue<NATSMessage>("input.nats").asChannel());
+  const done = makeFuse();
+
+  // Initialize endless NATS consumption
+  const consuming = (async () => {
+    const nc = await connect({ servers: options.url });
+    nc.closed().then(() => done.trigger());
+    try {
+      if (typeof options.jetstream === "undefined") {
+        const subscription = nc.subscribe(options.subject, {
+          ...(typeof options.queue !== "undefined"
+            ? { queue: options.queue }
+            : {}),
+        });
+        done.promise.then(() => subscription.unsubscribe());
+        for await (const message of subscription) {
+          logger.debug("Got message from NATS subject", message.subject);
+          channel.send({ subject: message.subject, data: message.data });
+        }
+      } else {
+        const batch =
+          typeof options.jetstream.batch === "string"
+            ? parseInt(options.jetstream.batch, 10)
+            : options.jetstream.batch ?? DEFAULT_JETSTREAM_BATCH;
+        const consumerOptions = consumerOpts();
+        consumerOptions.durable(options.jetstream.durable);
+        consumerOptions.ackExplicit();
+        consumerOptions.manualAck();
+        const subscription = await nc
+          .jetstream()
+          .pullSubscribe(options.subject, consumerOptions);
+        // Messages are pulled only while there's no backpressure.
+        const pull = () => {
+          if (!done.value() && !backpressure.status()) {
+            subscription.pull({ batch, expires: JETSTREAM_PULL_EXPIRES });
+          }
+        };
+        const interval = setInterval(pull, JETSTREAM_PULL_EXPIRES);
+        pull();
+        done.promise.then(() => {
+          clearInterval(interval);
+          subscription.unsubscribe();
+        });
+        for await (const message of subscription) {
+          logger.debug("Got message from JetStream subject", message.subject);
+          // Messages are acknowledged right away, unless an output
+          // requires confirmed writes. Negatively acknowledged
+          // messages are redelivered.
+          channel.send({
+            subject: message.subject,
+            data: message.data,
+            receipt: track(() => message.ack(), () => message.nak()),
+          });
+        }
+      }
+    } finally {
+      if (!nc.isClosed()) {
+        await nc.drain();
+      }
+    }
+  })().catch((err) => {
+    logger.error(`Error during NATS consumption: ${err}`);
+    done.trigger();
+  });
+
+  // Assemble the event channel.
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          done.trigger();
+          await consuming;
+          await channel.close();
+          logger.debug("Drained nats input");
+        },
+      },
+      eventParser,
+      "parsing nats message"
+    ),
+    consuming,
+  ];
+};
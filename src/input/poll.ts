@@ -13,6 +13,7 @@ import {
   validateWrap,
 } from "../event";
 import { axiosInstance } from "../io/axios";
+import { probeTarget } from "../io/http-client";
 import { makeLogger } from "../log";
 import { backpressure } from "../metrics";
 import { check } from "../utils";
@@ -92,6 +93,21 @@ export const validate = (options: PollInputOptions): void => {
   );
 };
 
+/**
+ * Check that the remote endpoint is reachable.
+ *
+ * @param options The polling options that indicate the endpoint.
+ * @param signal A signal that aborts the check.
+ * @returns A promise that resolves if the endpoint is reachable.
+ */
+export const probe = (
+  options: PollInputOptions,
+  signal: AbortSignal
+): Promise<void> =>
+  typeof options === "string"
+    ? probeTarget(options, {}, signal)
+    : probeTarget(options.target, options.headers ?? {}, signal);
+
 /**
  * Creates an input channel based on data fetched periodically from
  * HTTP requests to a remote endpoint. Returns a pair of [channel,
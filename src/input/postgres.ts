@@ -0,0 +1,256 @@
+import { Readable } from "stream";
+import { Client } from "pg";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check, makeFuse } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/postgres");
+
+/**
+ * Options for this input form.
+ */
+export type PostgresInputOptions = {
+  url: string;
+  channels: string | string[];
+  "ping-interval"?: number | string;
+  raw?: boolean | "true" | "false";
+  wrap?: WrapDirective;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    url: { type: "string", minLength: 1 },
+    channels: {
+      anyOf: [
+        { type: "string", minLength: 1 },
+        {
+          type: "array",
+          items: { type: "string", minLength: 1 },
+          minItems: 1,
+        },
+      ],
+    },
+    "ping-interval": {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    raw: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: ["url", "channels"],
+};
+
+/**
+ * Validate postgres input options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: PostgresInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { "ping-interval": P.select(P.string) },
+      (interval) => parseFloat(interval) > 0
+    ),
+    "the input has an invalid value for postgres.ping-interval (must be > 0)"
+  );
+  check(
+    matchOptions.with({ wrap: P._, raw: P._ }, () => false),
+    "the input can't use both postgres.wrap and postgres.raw (use postgres.wrap.raw instead)"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+  check(
+    matchOptions
+      .with({ wrap: P._ }, () => true)
+      .with({ channels: P.select(P.string) }, isValidEventName)
+      .with({ channels: P.select(P.array(P.string)) }, (channels) =>
+        channels.every(isValidEventName)
+      ),
+    "the input's postgres channels must be valid event names, " +
+      "unless the postgres.wrap option is used"
+  );
+};
+
+/**
+ * Default time in seconds between queries used to check the
+ * connection's health.
+ */
+const DEFAULT_PING_INTERVAL = 30;
+
+/**
+ * Bounds for the delay between reconnection attempts, in
+ * milliseconds. The delay doubles after each failed attempt.
+ */
+const MIN_RECONNECT_DELAY = 1000;
+const MAX_RECONNECT_DELAY = 60000;
+
+/**
+ * A notification received from a postgres channel.
+ */
+interface PostgresNotification {
+  channel: string;
+  value: string;
+}
+
+/**
+ * Creates an input channel based on notifications received from one
+ * or more postgres channels, using LISTEN/NOTIFY.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The postgres connection options to configure the
+ * input channel.
+ * @returns A channel that receives notifications from postgres and
+ * forwards parsed events, and a promise that resolves when the input
+ * ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: PostgresInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const channels =
+    typeof options.channels === "string"
+      ? [options.channels]
+      : options.channels;
+  const pingInterval =
+    (typeof options["ping-interval"] === "string"
+      ? parseFloat(options["ping-interval"])
+      : options["ping-interval"] ?? DEFAULT_PING_INTERVAL) * 1000;
+  const raw =
+    typeof options.raw === "string" ? options.raw === "true" : options.raw;
+  // Notifications are wrapped in events named after their channel,
+  // unless told otherwise.
+  const wrapFor = (channel: string): WrapDirective =>
+    options.wrap ?? { name: channel, raw: raw ?? false };
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+
+  const channel = flatMap(async (notification: PostgresNotification) => {
+    arrivalTimestamp.update();
+    const wrap = wrapFor(notification.channel);
+    const parse = chooseParser(wrap);
+    const wrapper = makeWrapper(wrap);
+    const things = [];
+    for await (const thing of parse(Readable.from([notification.value]))) {
+      things.push(wrapper(thing));
+    }
+    return things;
+  }, new AsyncQueue<PostgresNotification>("input.postgres").asChannel());
+  const done = makeFuse();
+
+  // Listen on a single connection until it's lost, or the input is
+  // closed.
+  const listen = async (client: Client): Promise<void> => {
+    const lost: Promise<void> = new Promise((resolve) => {
+      client.on("error", (err) => {
+        logger.error(`Postgres client notified an error: ${err}`);
+        resolve();
+      });
+      client.on("end", () => resolve());
+    });
+    client.on("notification", (notification) => {
+      logger.debug("Got notification from postgres channel", notification);
+      channel.send({
+        channel: notification.channel,
+        value: notification.payload ?? "",
+      });
+    });
+    await client.connect();
+    for (const name of channels) {
+      await client.query(`LISTEN ${client.escapeIdentifier(name)}`);
+    }
+    logger.debug("Postgres client listening on channels", channels);
+    // Notifications alone don't reveal a dead connection, so it's
+    // checked periodically.
+    const ping = setInterval(
+      () =>
+        client.query("SELECT 1").catch((err) => {
+          logger.warn(`Postgres connection check failed: ${err}`);
+          client.end().catch(() => undefined);
+        }),
+      pingInterval
+    );
+    try {
+      await Promise.race([lost, done.promise]);
+    } finally {
+      clearInterval(ping);
+    }
+  };
+
+  // Initialize endless listening, reconnecting when the connection is
+  // lost.
+  const consuming = (async () => {
+    let delay = MIN_RECONNECT_DELAY;
+    while (!done.value()) {
+      const client = new Client({
+        connectionString: options.url,
+        query_timeout: pingInterval,
+      });
+      try {
+        await listen(client);
+        delay = MIN_RECONNECT_DELAY;
+      } catch (err) {
+        logger.error(`Error during postgres listening: ${err}`);
+      } finally {
+        await client.end().catch(() => undefined);
+      }
+      if (!done.value()) {
+        logger.info(`Reconnecting to postgres after ${delay} ms`);
+        await done.guard((resolve) => setTimeout(resolve, delay));
+        delay = Math.min(delay * 2, MAX_RECONNECT_DELAY);
+      }
+    }
+  })();
+
+  // Assemble the event channel.
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          done.trigger();
+          await consuming;
+          await channel.close();
+          logger.debug("Drained postgres input");
+        },
+      },
+      eventParser,
+      "parsing postgres notification"
+    ),
+    consuming,
+  ];
+};
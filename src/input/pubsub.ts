@@ -0,0 +1,228 @@
+import { Readable } from "stream";
+import { Message } from "@google-cloud/pubsub";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import { attachReceipt, release, track } from "../delivery";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import {
+  PubSubConnectionOptions,
+  connectionOptionsSchema,
+  makeClient,
+} from "../io/pubsub";
+import { makeLogger } from "../log";
+import { backpressure } from "../metrics";
+import { attachRemoteContext } from "../tracing";
+import { check, makeFuse } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/pubsub");
+
+/**
+ * Options for this input form.
+ */
+export type PubSubInputOptions = PubSubConnectionOptions & {
+  subscription: string;
+  "max-messages"?: number | string;
+  "max-bytes"?: number | string;
+  attributes?: boolean | "true" | "false";
+  wrap?: WrapDirective;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    subscription: { type: "string", minLength: 1 },
+    ...connectionOptionsSchema,
+    "max-messages": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "max-bytes": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    attributes: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: ["subscription"],
+};
+
+/**
+ * Validate pubsub input options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: PubSubInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+  check(
+    matchOptions
+      .with({ attributes: P.union(true, "true"), wrap: P._ }, () => true)
+      .with({ attributes: P.union(true, "true") }, () => false),
+    "the input can use pubsub.attributes only along with pubsub.wrap"
+  );
+};
+
+/**
+ * Default flow control limits, which bound the messages held by the
+ * input before they're acknowledged.
+ */
+const DEFAULT_MAX_MESSAGES = 1000;
+const DEFAULT_MAX_BYTES = 100 * 1024 * 1024;
+
+/**
+ * Creates an input channel based on messages received from a Pub/Sub
+ * subscription. Returns a pair of [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The Pub/Sub options to configure the input channel.
+ * @returns A channel that receives messages from a Pub/Sub
+ * subscription and forwards parsed events, and a promise that
+ * resolves when the input ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: PubSubInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const maxMessages =
+    typeof options["max-messages"] === "string"
+      ? parseInt(options["max-messages"], 10)
+      : options["max-messages"] ?? DEFAULT_MAX_MESSAGES;
+  const maxBytes =
+    typeof options["max-bytes"] === "string"
+      ? parseInt(options["max-bytes"], 10)
+      : options["max-bytes"] ?? DEFAULT_MAX_BYTES;
+  const withAttributes =
+    typeof options.attributes === "string"
+      ? options.attributes === "true"
+      : options.attributes ?? false;
+  const parse = chooseParser(options.wrap);
+  const wrapper = makeWrapper(options.wrap);
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+  const done = makeFuse();
+
+  const channel = flatMap(async (message: Message) => {
+    arrivalTimestamp.update();
+    const data = message.data.toString();
+    const things = [];
+    for await (const thing of parse(Readable.from([data]))) {
+      const wrapped = wrapper(
+        withAttributes
+          ? { body: thing, attributes: message.attributes ?? {} }
+          : thing
+      );
+      attachRemoteContext(wrapped, message.attributes);
+      things.push(wrapped);
+    }
+    if (things.length === 0 && data.trim().length > 0) {
+      // Pub/Sub redelivers nacked messages, possibly to a dead-letter
+      // topic after too many attempts.
+      logger.warn("Couldn't parse Pub/Sub message", message.id);
+      message.nack();
+      return [];
+    }
+    // Messages are acknowledged only after their events went through
+    // the pipeline, or were delivered if an output requires confirmed
+    // writes, even if no output does.
+    const receipt = track(
+      () => message.ack(),
+      () => message.nack(),
+      true
+    );
+    things.forEach((thing) => attachReceipt(thing, receipt));
+    release(receipt);
+    return things;
+  }, new AsyncQueue<Message>("input.pubsub").asChannel());
+
+  // Flow control bounds the messages held by the client, since they
+  // stay outstanding until acknowledged.
+  const client = makeClient(options);
+  const subscription = client.subscription(options.subscription, {
+    flowControl: {
+      maxMessages,
+      maxBytes,
+      allowExcessMessages: false,
+    },
+  });
+  let waiting: Promise<void> = Promise.resolve();
+  subscription.on("message", (message: Message) => {
+    logger.debug("Got message from Pub/Sub subscription", message.id);
+    // Messages are held while the pipeline signals backpressure,
+    // which eventually stops the delivery of new ones once the flow
+    // control limits are reached.
+    waiting = waiting.then(async () => {
+      if (backpressure.status()) {
+        await done.guard((resolve) => backpressure.once("off", resolve));
+      }
+      if (done.value()) {
+        message.nack();
+      } else {
+        channel.send(message);
+      }
+    });
+  });
+  subscription.on("error", (err) => {
+    logger.error(`Pub/Sub subscription notified an error: ${err}`);
+    done.trigger();
+  });
+
+  // Messages delivered after the input is closed are nacked, so that
+  // they're delivered again.
+  const consuming = done.promise.then(() => waiting);
+
+  // Assemble the event channel.
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          done.trigger();
+          await consuming;
+          // Messages already received are handed to the pipeline
+          // before the subscription is closed. Those whose events
+          // aren't done with by then are delivered again.
+          await channel.close();
+          await subscription.close();
+          await client.close();
+          logger.debug("Drained pubsub input");
+        },
+      },
+      eventParser,
+      "parsing pubsub message"
+    ),
+    consuming,
+  ];
+};
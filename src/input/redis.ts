@@ -1,6 +1,7 @@
 import { match, P } from "ts-pattern";
 import { Readable } from "stream";
 import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Receipt, attachReceipt, release, track } from "../delivery";
 import {
   Event,
   arrivalTimestamp,
@@ -19,8 +20,10 @@ import {
   clusterSchema,
   RedisConnection,
 } from "../io/redis";
+import { encodeJson } from "../json";
 import { makeLogger } from "../log";
 import { backpressure } from "../metrics";
+import { isValidEventName } from "../pattern";
 import { check, resolveAfter, makeFuse } from "../utils";
 import { PipelineInputParameters } from ".";
 
@@ -37,6 +40,13 @@ export interface RedisInputOptions extends RedisConnectionOptions {
   psubscribe?: string | string[];
   blpop?: string | string[];
   brpop?: string | string[];
+  xreadgroup?: {
+    stream: string;
+    group: string;
+    consumer: string;
+    block?: number | string;
+    count?: number | string;
+  };
   wrap?: WrapDirective;
 }
 
@@ -67,6 +77,45 @@ const buildSchema = (
   required: [baseKey, key],
 });
 
+/**
+ * Build a schema variation for consuming redis streams.
+ *
+ * @param baseKey The connection key.
+ * @param baseSchema The schema for the connection key.
+ * @returns A partial schema.
+ */
+const buildStreamSchema = (baseKey: string, baseSchema: object): object => ({
+  type: "object",
+  properties: {
+    [baseKey]: baseSchema,
+    xreadgroup: {
+      type: "object",
+      properties: {
+        stream: { type: "string", minLength: 1 },
+        group: { type: "string", minLength: 1 },
+        consumer: { type: "string", minLength: 1 },
+        block: {
+          anyOf: [
+            { type: "integer", minimum: 0 },
+            { type: "string", pattern: "^[0-9]+$" },
+          ],
+        },
+        count: {
+          anyOf: [
+            { type: "integer", minimum: 1 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+      },
+      additionalProperties: false,
+      required: ["stream", "group", "consumer"],
+    },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: [baseKey, "xreadgroup"],
+});
+
 /**
  * An ajv schema for the options.
  */
@@ -80,6 +129,8 @@ export const optionsSchema = {
     buildSchema("cluster", clusterSchema, "blpop"),
     buildSchema("instance", instanceSchema, "brpop"),
     buildSchema("cluster", clusterSchema, "brpop"),
+    buildStreamSchema("instance", instanceSchema),
+    buildStreamSchema("cluster", clusterSchema),
   ],
 };
 
@@ -90,11 +141,24 @@ export const optionsSchema = {
  * @param options The options to validate.
  */
 export const validate = (options: RedisInputOptions): void => {
+  const matchOptions = match(options);
   check(
-    match(options).with({ wrap: P.select() }, (wrap) =>
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
       validateWrap(wrap, "the input's wrap option")
     )
   );
+  check(
+    matchOptions.with({ xreadgroup: P._, wrap: { raw: true } }, () => false),
+    "the input can't use a raw wrap option with redis.xreadgroup"
+  );
+  check(
+    matchOptions.with(
+      { xreadgroup: { stream: P.select() } },
+      (stream) => typeof options.wrap !== "undefined" || isValidEventName(stream)
+    ),
+    "the input's redis.xreadgroup.stream must be a valid event name, " +
+      "unless the wrap option is used"
+  );
 };
 
 /**
@@ -102,6 +166,29 @@ export const validate = (options: RedisInputOptions): void => {
  */
 const POP_TIMEOUT = 5;
 
+/**
+ * Default values for XREADGROUP operations: the block timeout in
+ * milliseconds, and the maximum amount of entries read at once.
+ */
+const DEFAULT_XREADGROUP_BLOCK = 5000;
+const DEFAULT_XREADGROUP_COUNT = 100;
+
+/**
+ * The shape of XREADGROUP replies: a list of streams, each with a
+ * list of entries, each entry with an ID and a flat list of fields
+ * and values.
+ */
+type StreamsReply = [string, [string, string[] | null][]][] | null;
+
+/**
+ * A message received from redis, with the receipt of the stream
+ * entry it came from, if any.
+ */
+interface RedisMessage {
+  content: string;
+  receipt?: Receipt;
+}
+
 /**
  * Normalize a variant argument. Useful for redis commands. Always
  * returns an array of strings.
@@ -123,30 +210,39 @@ const toargs = (option: string[] | string | undefined): string[] =>
  * @param params Configuration parameters acquired from the pipeline.
  * @param options The redis options to configure the input channel.
  * @returns A pair of a channel that connects to a redis instance or
- * cluster and produces events from SUBSCRIBE, PSUBSCRIBE, BLPOP or
- * BRPOP, and a promise indicating the channel got closed from
- * external causes.
+ * cluster and produces events from SUBSCRIBE, PSUBSCRIBE, BLPOP,
+ * BRPOP or XREADGROUP, and a promise indicating the channel got
+ * closed from external causes.
  */
 export const make = (
   params: PipelineInputParameters,
   options: RedisInputOptions
 ): [Channel<never, Event>, Promise<void>] => {
-  const parse = chooseParser(options.wrap);
-  const wrapper = makeWrapper(options.wrap);
+  // Stream entries are always wrapped, by default in events named
+  // after the stream.
+  const wrap =
+    typeof options.xreadgroup !== "undefined"
+      ? options.wrap ?? options.xreadgroup.stream
+      : options.wrap;
+  const parse = chooseParser(wrap);
+  const wrapper = makeWrapper(wrap);
   const eventParser = makeNewEventParser(
     params.pipelineName,
     params.pipelineSignature
   );
   const client: RedisConnection = connect(options);
 
-  const channel = flatMap(async (message: string) => {
+  const channel = flatMap(async (message: RedisMessage) => {
     arrivalTimestamp.update();
     const things = [];
-    for await (const thing of parse(Readable.from([message]))) {
-      things.push(wrapper(thing));
+    for await (const thing of parse(Readable.from([message.content]))) {
+      const wrapped = wrapper(thing);
+      attachReceipt(wrapped, message.receipt);
+      things.push(wrapped);
     }
+    release(message.receipt);
     return things;
-  }, new AsyncQueue<string>("input.redis").asChannel());
+  }, new AsyncQueue<RedisMessage>("input.redis").asChannel());
   const done = makeFuse();
 
   // Initialize endless redis consumption
@@ -155,7 +251,7 @@ export const make = (
       try {
         client.on("message", (redisChannel: string, message: string) => {
           logger.debug("Got message from redis channel", redisChannel, message);
-          channel.send(message);
+          channel.send({ content: message });
         });
         await client.subscribe(...toargs(options.subscribe));
         await done.promise;
@@ -169,7 +265,7 @@ export const make = (
       try {
         client.on("pmessage", (_, redisChannel: string, message: string) => {
           logger.debug("Got message from redis channel", redisChannel, message);
-          channel.send(message);
+          channel.send({ content: message });
         });
         await client.psubscribe(...toargs(options.psubscribe));
         await done.promise;
@@ -187,7 +283,7 @@ export const make = (
             : client.blpop(toargs(options.blpop), POP_TIMEOUT));
           if (result !== null) {
             logger.debug("Got message from redis list", result[0], result[1]);
-            channel.send(result[1]);
+            channel.send({ content: result[1] });
           }
         }
       } catch (err) {
@@ -203,7 +299,7 @@ export const make = (
             : client.brpop(toargs(options.brpop), POP_TIMEOUT));
           if (result !== null) {
             logger.debug("Got message from redis list", result[0], result[1]);
-            channel.send(result[1]);
+            channel.send({ content: result[1] });
           }
         }
       } catch (err) {
@@ -211,6 +307,95 @@ export const make = (
       } finally {
         await client.quit();
       }
+    } else if (typeof options.xreadgroup !== "undefined") {
+      const { stream, group, consumer } = options.xreadgroup;
+      const block =
+        typeof options.xreadgroup.block === "string"
+          ? parseInt(options.xreadgroup.block, 10)
+          : options.xreadgroup.block ?? DEFAULT_XREADGROUP_BLOCK;
+      const count =
+        typeof options.xreadgroup.count === "string"
+          ? parseInt(options.xreadgroup.count, 10)
+          : options.xreadgroup.count ?? DEFAULT_XREADGROUP_COUNT;
+      let acking: Promise<unknown> = Promise.resolve();
+      const acknowledge = (id: string) => {
+        acking = acking
+          .then(() => client.xack(stream, group, id))
+          .catch((err) => {
+            logger.warn(`Couldn't acknowledge redis stream entry: ${err}`);
+          });
+      };
+      try {
+        try {
+          await client.xgroup("CREATE", stream, group, "$", "MKSTREAM");
+        } catch (err) {
+          if (!`${err}`.includes("BUSYGROUP")) {
+            throw err;
+          }
+        }
+        // Entries delivered before a restart but never acknowledged
+        // are read first, starting from ID 0, and new entries are
+        // read once the pending entries list is exhausted.
+        let lastID = "0";
+        while (!done.value()) {
+          if (backpressure.status()) {
+            await resolveAfter(POP_TIMEOUT * 1000);
+            continue;
+          }
+          const reply = (await client.xreadgroup(
+            "GROUP",
+            group,
+            consumer,
+            "COUNT",
+            count,
+            "BLOCK",
+            block,
+            "STREAMS",
+            stream,
+            lastID
+          )) as StreamsReply;
+          const entries = reply?.[0]?.[1] ?? [];
+          if (lastID !== ">" && entries.length === 0) {
+            lastID = ">";
+          }
+          for (const [id, fields] of entries) {
+            if (lastID !== ">") {
+              lastID = id;
+            }
+            if (fields === null) {
+              // The entry was deleted while pending.
+              await client.xack(stream, group, id);
+              continue;
+            }
+            const data: Record<string, string> = {};
+            for (let i = 0; i + 1 < fields.length; i += 2) {
+              data[fields[i]] = fields[i + 1];
+            }
+            logger.debug("Got entry from redis stream", stream, id, data);
+            // Entries are acknowledged right away, unless an output
+            // requires confirmed writes. Entries that aren't
+            // acknowledged stay pending, and are read again when the
+            // consumer restarts.
+            channel.send({
+              content: encodeJson(data),
+              receipt: track(
+                () => acknowledge(id),
+                () =>
+                  logger.warn(
+                    "Couldn't deliver the events of redis stream entry",
+                    id,
+                    "; it's left pending"
+                  )
+              ),
+            });
+          }
+        }
+      } catch (err) {
+        logger.error(`Couldn't xreadgroup from stream: ${err}`);
+      } finally {
+        await acking;
+        await client.quit();
+      }
     }
   })();
 
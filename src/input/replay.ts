@@ -0,0 +1,163 @@
+import { createReadStream } from "fs";
+import { performance } from "perf_hooks";
+import { match, P } from "ts-pattern";
+import { Channel } from "../async-queue";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+} from "../event";
+import { parseJson } from "../io/read-stream";
+import { makeLogger } from "../log";
+import { check, makeFuse } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/replay");
+
+/**
+ * Options for this input form.
+ */
+export type ReplayInputOptions =
+  | string
+  | {
+      path: string;
+      speed?: number | string;
+    };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        path: { type: "string", minLength: 1 },
+        speed: {
+          anyOf: [
+            { type: "number", exclusiveMinimum: 0 },
+            { type: "string", pattern: "^[0-9]+\\.?[0-9]*$" },
+          ],
+        },
+      },
+      additionalProperties: false,
+      required: ["path"],
+    },
+  ],
+};
+
+/**
+ * Validate replay input options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: ReplayInputOptions): void => {
+  check(
+    match(options).with(
+      { speed: P.select(P.string) },
+      (speed) => parseFloat(speed) > 0
+    ),
+    "the input has an invalid value for replay.speed (must be > 0)"
+  );
+};
+
+/**
+ * Creates an input channel that replays events recorded by the record
+ * step function. Events are replayed as fast as possible, or paced
+ * according to the moments they were recorded at, sped up by the
+ * given factor. Returns a pair of [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The replay options to configure the input channel.
+ * @returns A channel that implicitly receives recorded events and
+ * forwards them, and a promise that resolves when the input ends for
+ * any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: ReplayInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const path = typeof options === "string" ? options : options.path;
+  const speed =
+    typeof options === "string"
+      ? null
+      : typeof options.speed === "string"
+      ? parseFloat(options.speed)
+      : options.speed ?? null;
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+  const stream = createReadStream(path);
+  const records = parseJson(stream);
+  const done = makeFuse();
+  let timer: ReturnType<typeof setTimeout> | null = null;
+  let notifyDrained: () => void;
+  const drained: Promise<void> = new Promise((resolve) => {
+    notifyDrained = resolve;
+  });
+  async function* receive() {
+    let start: number | null = null;
+    let count = 0;
+    for await (const record of records) {
+      count++;
+      const { offset, event } = (record ?? {}) as {
+        offset?: unknown;
+        event?: unknown;
+      };
+      if (typeof offset !== "number" || typeof event === "undefined") {
+        logger.warn(`Skipped record ${count}: it isn't a recorded event`);
+        continue;
+      }
+      if (speed !== null) {
+        // The first record is replayed right away, and the rest are
+        // replayed relative to it.
+        const now = performance.now();
+        if (start === null) {
+          start = now - (offset * 1000) / speed;
+        }
+        const wait = start + (offset * 1000) / speed - now;
+        if (wait > 0) {
+          await done.guard((resolve) => {
+            timer = setTimeout(resolve, wait);
+          });
+        }
+      }
+      if (done.value()) {
+        break;
+      }
+      arrivalTimestamp.update();
+      yield event;
+    }
+    notifyDrained();
+  }
+  return [
+    parseChannel(
+      {
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        receive: receive(),
+        close: async () => {
+          done.trigger();
+          if (timer !== null) {
+            clearTimeout(timer);
+          }
+          stream.destroy();
+          await drained;
+          logger.debug("Drained replay input");
+        },
+      },
+      eventParser,
+      "parsing replayed events"
+    ),
+    drained,
+  ];
+};
@@ -0,0 +1,405 @@
+import { Readable } from "stream";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import { attachReceipt, release, track } from "../delivery";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import {
+  SQSConnectionOptions,
+  SQSMessage,
+  SQSBatchFailure,
+  callSQS,
+  describeFailures,
+  regionFromURL,
+} from "../io/sqs";
+import { makeLogger } from "../log";
+import { backpressure } from "../metrics";
+import { attachRemoteContext } from "../tracing";
+import { check, makeFuse, resolveAfter } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/sqs");
+
+/**
+ * Options for this input form.
+ */
+export type SQSInputOptions = {
+  "queue-url": string;
+  endpoint?: string;
+  region?: string;
+  "access-key-id": string;
+  "secret-access-key": string;
+  "session-token"?: string;
+  "wait-time"?: number | string;
+  "visibility-timeout"?: number | string;
+  "max-in-flight"?: number | string;
+  attributes?: boolean | "true" | "false";
+  wrap?: WrapDirective;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    "queue-url": { type: "string", minLength: 1 },
+    endpoint: { type: "string", minLength: 1 },
+    region: { type: "string", minLength: 1 },
+    "access-key-id": { type: "string", minLength: 1 },
+    "secret-access-key": { type: "string", minLength: 1 },
+    "session-token": { type: "string", minLength: 1 },
+    "wait-time": {
+      anyOf: [
+        { type: "integer", minimum: 0, maximum: 20 },
+        { type: "string", pattern: "^[0-9]+$" },
+      ],
+    },
+    "visibility-timeout": {
+      anyOf: [
+        { type: "integer", minimum: 1, maximum: 43200 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "max-in-flight": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    attributes: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: ["queue-url", "access-key-id", "secret-access-key"],
+};
+
+/**
+ * Validate sqs input options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: SQSInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { "wait-time": P.select(P.string) },
+      (waitTime) => parseInt(waitTime, 10) <= 20
+    ),
+    "the input's sqs.wait-time is invalid (must be between 0 and 20, inclusive)"
+  );
+  check(
+    matchOptions.with(
+      { "visibility-timeout": P.select(P.string) },
+      (timeout) => parseInt(timeout, 10) <= 43200
+    ),
+    "the input's sqs.visibility-timeout is invalid " +
+      "(must be between 1 and 43200, inclusive)"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+  check(
+    matchOptions
+      .with({ attributes: P.union(true, "true"), wrap: P._ }, () => true)
+      .with({ attributes: P.union(true, "true") }, () => false),
+    "the input can use sqs.attributes only along with sqs.wrap"
+  );
+};
+
+/**
+ * Default values for the consumption of messages.
+ */
+const DEFAULT_REGION = "us-east-1";
+const DEFAULT_WAIT_TIME = 20;
+const DEFAULT_VISIBILITY_TIMEOUT = 30;
+const DEFAULT_MAX_IN_FLIGHT = 10;
+
+/**
+ * The maximum amount of entries in a single batch request.
+ */
+const MAX_BATCH_SIZE = 10;
+
+/**
+ * Time in milliseconds to wait after a failed or empty receive (when
+ * short-polling), before attempting another one.
+ */
+const RECEIVE_PAUSE = 1000;
+
+/**
+ * Time in milliseconds that deletions are held for, so that they can
+ * be grouped in batch requests.
+ */
+const DELETE_DELAY = 100;
+
+/**
+ * Split an array in chunks of at most the given size.
+ *
+ * @param items The array to split.
+ * @param size The maximum size of each chunk.
+ * @returns The chunks.
+ */
+const chunk = <T>(items: T[], size: number): T[][] =>
+  Array.from({ length: Math.ceil(items.length / size) }, (_, index) =>
+    items.slice(index * size, (index + 1) * size)
+  );
+
+/**
+ * Creates an input channel based on messages received from an SQS
+ * queue. Returns a pair of [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The SQS options to configure the input channel.
+ * @returns A channel that receives messages from an SQS queue and
+ * forwards parsed events, and a promise that resolves when the input
+ * ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: SQSInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const connection: SQSConnectionOptions = {
+    queueUrl: options["queue-url"],
+    endpoint: options.endpoint,
+    region:
+      options.region ?? regionFromURL(options["queue-url"]) ?? DEFAULT_REGION,
+    accessKeyId: options["access-key-id"],
+    secretAccessKey: options["secret-access-key"],
+    sessionToken: options["session-token"],
+  };
+  const waitTime =
+    typeof options["wait-time"] === "string"
+      ? parseInt(options["wait-time"], 10)
+      : options["wait-time"] ?? DEFAULT_WAIT_TIME;
+  const visibilityTimeout =
+    typeof options["visibility-timeout"] === "string"
+      ? parseInt(options["visibility-timeout"], 10)
+      : options["visibility-timeout"] ?? DEFAULT_VISIBILITY_TIMEOUT;
+  const maxInFlight =
+    typeof options["max-in-flight"] === "string"
+      ? parseInt(options["max-in-flight"], 10)
+      : options["max-in-flight"] ?? DEFAULT_MAX_IN_FLIGHT;
+  const withAttributes =
+    typeof options.attributes === "string"
+      ? options.attributes === "true"
+      : options.attributes ?? false;
+  const parse = chooseParser(options.wrap);
+  const wrapper = makeWrapper(options.wrap);
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+  const done = makeFuse();
+  const aborter = new AbortController();
+  done.promise.then(() => aborter.abort());
+
+  // Messages received and not yet deleted, along with the last time
+  // their visibility timeout was set.
+  const inFlight = new Map<SQSMessage, number>();
+  let notifyCapacity: (() => void) | null = null;
+  const settle = (messages: SQSMessage[]) => {
+    messages.forEach((message) => inFlight.delete(message));
+    if (notifyCapacity !== null && inFlight.size < maxInFlight) {
+      notifyCapacity();
+      notifyCapacity = null;
+    }
+  };
+
+  // Deletions are grouped in batches, and sent one batch at a time.
+  const pendingDeletions: SQSMessage[] = [];
+  let deletionTimer: ReturnType<typeof setTimeout> | null = null;
+  let deleting: Promise<void> = Promise.resolve();
+  const flushDeletions = (): Promise<void> => {
+    if (deletionTimer !== null) {
+      clearTimeout(deletionTimer);
+      deletionTimer = null;
+    }
+    for (const batch of chunk(pendingDeletions.splice(0), MAX_BATCH_SIZE)) {
+      deleting = deleting.then(async () => {
+        try {
+          const result = await callSQS<{ Failed?: SQSBatchFailure[] }>(
+            connection,
+            "DeleteMessageBatch",
+            {
+              Entries: batch.map((message, index) => ({
+                Id: `${index}`,
+                ReceiptHandle: message.ReceiptHandle,
+              })),
+            }
+          );
+          if ((result.Failed ?? []).length > 0) {
+            logger.warn(
+              `Couldn't delete ${result.Failed?.length} SQS messages, ` +
+                `which will be delivered again: ${describeFailures(
+                  result.Failed ?? []
+                )}`
+            );
+          }
+        } catch (err) {
+          logger.warn(
+            `Couldn't delete ${batch.length} SQS messages, ` +
+              `which will be delivered again: ${err}`
+          );
+        }
+        settle(batch);
+      });
+    }
+    return deleting;
+  };
+  const scheduleDeletion = (message: SQSMessage) => {
+    pendingDeletions.push(message);
+    if (pendingDeletions.length >= MAX_BATCH_SIZE) {
+      flushDeletions();
+    } else if (deletionTimer === null) {
+      deletionTimer = setTimeout(flushDeletions, DELETE_DELAY);
+    }
+  };
+
+  // Messages that take long to be handed to the pipeline get their
+  // visibility timeout extended, so that they aren't delivered again
+  // meanwhile.
+  const extensionInterval = setInterval(async () => {
+    const now = Date.now();
+    const stale = Array.from(inFlight.entries())
+      .filter(([, setAt]) => now - setAt >= (visibilityTimeout * 1000) / 2)
+      .map(([message]) => message);
+    for (const batch of chunk(stale, MAX_BATCH_SIZE)) {
+      try {
+        await callSQS(connection, "ChangeMessageVisibilityBatch", {
+          Entries: batch.map((message, index) => ({
+            Id: `${index}`,
+            ReceiptHandle: message.ReceiptHandle,
+            VisibilityTimeout: visibilityTimeout,
+          })),
+        });
+        batch
+          .filter((message) => inFlight.has(message))
+          .forEach((message) => inFlight.set(message, now));
+      } catch (err) {
+        logger.warn(`Couldn't extend the visibility of SQS messages: ${err}`);
+      }
+    }
+  }, (visibilityTimeout * 1000) / 2);
+
+  const channel = flatMap(async (message: SQSMessage) => {
+    arrivalTimestamp.update();
+    const attributes = Object.fromEntries(
+      Object.entries(message.MessageAttributes ?? {}).map(([key, value]) => [
+        key,
+        value.StringValue ?? value.BinaryValue ?? null,
+      ])
+    );
+    const things = [];
+    for await (const thing of parse(Readable.from([message.Body]))) {
+      const wrapped = wrapper(
+        withAttributes ? { body: thing, attributes } : thing
+      );
+      attachRemoteContext(wrapped, attributes);
+      things.push(wrapped);
+    }
+    // Messages are deleted only after their events went through the
+    // pipeline, or were delivered if an output requires confirmed
+    // writes, even if no output does. Until then, they count towards
+    // the in-flight limit. Messages that aren't deleted are delivered
+    // again once their visibility timeout expires.
+    const receipt = track(
+      () => scheduleDeletion(message),
+      () => settle([message]),
+      true
+    );
+    things.forEach((thing) => attachReceipt(thing, receipt));
+    release(receipt);
+    return things;
+  }, new AsyncQueue<SQSMessage>("input.sqs").asChannel());
+
+  const consuming = (async () => {
+    while (!done.value()) {
+      if (backpressure.status()) {
+        await done.guard((resolve) => backpressure.once("off", resolve));
+        continue;
+      }
+      if (inFlight.size >= maxInFlight) {
+        await done.guard((resolve) => {
+          notifyCapacity = resolve;
+        });
+        continue;
+      }
+      let messages: SQSMessage[];
+      try {
+        messages =
+          (
+            await callSQS<{ Messages?: SQSMessage[] }>(
+              connection,
+              "ReceiveMessage",
+              {
+                MaxNumberOfMessages: Math.min(
+                  MAX_BATCH_SIZE,
+                  maxInFlight - inFlight.size
+                ),
+                WaitTimeSeconds: waitTime,
+                VisibilityTimeout: visibilityTimeout,
+                MessageAttributeNames: ["All"],
+              },
+              aborter.signal
+            )
+          ).Messages ?? [];
+      } catch (err) {
+        if (!done.value()) {
+          logger.error(`Couldn't receive messages from SQS queue: ${err}`);
+          await Promise.race([resolveAfter(RECEIVE_PAUSE), done.promise]);
+        }
+        continue;
+      }
+      const now = Date.now();
+      for (const message of messages) {
+        logger.debug("Got message from SQS queue", message.MessageId);
+        inFlight.set(message, now);
+        channel.send(message);
+      }
+      if (messages.length === 0 && waitTime === 0) {
+        await Promise.race([resolveAfter(RECEIVE_PAUSE), done.promise]);
+      }
+    }
+  })();
+
+  // Assemble the event channel.
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          done.trigger();
+          await consuming;
+          // Messages already received are handed to the pipeline, and
+          // those whose events are done with already are deleted.
+          await channel.close();
+          await flushDeletions();
+          clearInterval(extensionInterval);
+          logger.debug("Drained sqs input");
+        },
+      },
+      eventParser,
+      "parsing sqs message"
+    ),
+    consuming,
+  ];
+};
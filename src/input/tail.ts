@@ -1,8 +1,18 @@
 import { match, P } from "ts-pattern";
-import { openSync as openFile, closeSync as closeFile } from "fs";
+import {
+  openSync as openFile,
+  closeSync as closeFile,
+  promises as fs,
+} from "fs";
+import { resolve as resolvePath } from "path";
 import { Readable } from "stream";
-import Tail = require("tail-file");
 import { Channel, AsyncQueue } from "../async-queue";
+import {
+  Checkpointer,
+  CheckpointOptions,
+  checkpointOptionsSchema,
+  makeCheckpointer,
+} from "../checkpoint";
 import {
   Event,
   arrivalTimestamp,
@@ -15,7 +25,7 @@ import {
   validateWrap,
 } from "../event";
 import { makeLogger } from "../log";
-import { check } from "../utils";
+import { check, makeFuse } from "../utils";
 import { PipelineInputParameters } from ".";
 
 /**
@@ -28,7 +38,13 @@ const logger = makeLogger("input/tail");
  */
 export type TailInputOptions =
   | string
-  | { path: string; ["start-at"]?: "start" | "end"; wrap?: WrapDirective };
+  | {
+      path: string | string[];
+      ["start-at"]?: "start" | "end";
+      ["offset-file"]?: string;
+      checkpoint?: CheckpointOptions;
+      wrap?: WrapDirective;
+    };
 
 /**
  * An ajv schema for the options.
@@ -39,8 +55,19 @@ export const optionsSchema = {
     {
       type: "object",
       properties: {
-        path: { type: "string", minLength: 1 },
+        path: {
+          anyOf: [
+            { type: "string", minLength: 1 },
+            {
+              type: "array",
+              items: { type: "string", minLength: 1 },
+              minItems: 1,
+            },
+          ],
+        },
         "start-at": { enum: ["start", "end"] },
+        "offset-file": { type: "string", minLength: 1 },
+        checkpoint: checkpointOptionsSchema,
         wrap: wrapDirectiveSchema,
       },
       additionalProperties: false,
@@ -56,20 +83,219 @@ export const optionsSchema = {
  * @param options The options to validate.
  */
 export const validate = (options: TailInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ "offset-file": P._, checkpoint: P._ }, () => false),
+    "the input can't use both tail.offset-file and tail.checkpoint " +
+      "(use tail.checkpoint.file instead)"
+  );
   check(
-    match(options).with({ wrap: P.select() }, (wrap) =>
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
       validateWrap(wrap, "the input's wrap option")
     )
   );
 };
 
 /**
- * Creates an input channel based on data coming from a file. Returns
- * a pair of [channel, endPromise].
+ * Time in milliseconds between checks for new data in the tailed
+ * files.
+ */
+const POLL_INTERVAL = 250;
+
+/**
+ * Size in bytes of the chunks read from the tailed files.
+ */
+const READ_CHUNK_SIZE = 64 * 1024;
+
+/**
+ * The position reached in a tailed file, identified by its inode so
+ * that a rotated file isn't mistaken for the original one.
+ */
+interface FileOffset {
+  ino: number;
+  pos: number;
+}
+
+/**
+ * Load the offset saved for a tailed file, if any. Offsets that can't
+ * be loaded are ignored, so that the file is read following the
+ * `start-at` mode.
+ *
+ * @param checkpointer The store of saved offsets.
+ * @param path The path to the tailed file.
+ * @returns A promise yielding the offset, if any.
+ */
+const loadOffset = async (
+  checkpointer: Checkpointer,
+  path: string
+): Promise<FileOffset | undefined> => {
+  try {
+    const saved = await checkpointer.load(path);
+    return typeof saved === "object" &&
+      saved !== null &&
+      typeof (saved as FileOffset).ino === "number" &&
+      typeof (saved as FileOffset).pos === "number"
+      ? (saved as FileOffset)
+      : undefined;
+  } catch (err) {
+    logger.warn(`Couldn't load the offset of '${path}': ${err}`);
+    return undefined;
+  }
+};
+
+/**
+ * The state of a single tailed file.
+ */
+class FileTail {
+  /**
+   * The handle of the file currently being read, or null if it
+   * couldn't be opened yet.
+   */
+  handle: fs.FileHandle | null = null;
+
+  /**
+   * The inode of the file currently being read.
+   */
+  ino = -1;
+
+  /**
+   * The position up to which the current file has been read.
+   */
+  pos = 0;
+
+  /**
+   * Bytes read after the last line break, which belong to a line not
+   * yet complete.
+   */
+  remainder: Buffer = Buffer.alloc(0);
+
+  constructor(
+    readonly path: string,
+    readonly emit: (line: string) => Promise<void>
+  ) {}
+
+  /**
+   * The offset of the first byte not yet emitted as part of a line.
+   */
+  get offset(): FileOffset {
+    return { ino: this.ino, pos: this.pos - this.remainder.length };
+  }
+
+  /**
+   * Open the file, starting at the given position, or at the end if
+   * none is given.
+   *
+   * @param pos The starting position.
+   */
+  async open(pos?: number): Promise<void> {
+    const handle = await fs.open(this.path, "r");
+    const stats = await handle.stat();
+    this.handle = handle;
+    this.ino = stats.ino;
+    this.pos = pos ?? stats.size;
+    this.remainder = Buffer.alloc(0);
+  }
+
+  /**
+   * Close the file currently being read, if any.
+   */
+  async close(): Promise<void> {
+    if (this.handle !== null) {
+      await this.handle.close();
+      this.handle = null;
+    }
+  }
+
+  /**
+   * Read everything available after the current position, emitting
+   * every complete line found.
+   */
+  async readAvailable(): Promise<void> {
+    if (this.handle === null) {
+      return;
+    }
+    const buffer = Buffer.alloc(READ_CHUNK_SIZE);
+    for (;;) {
+      const { bytesRead } = await this.handle.read(
+        buffer,
+        0,
+        READ_CHUNK_SIZE,
+        this.pos
+      );
+      if (bytesRead === 0) {
+        return;
+      }
+      this.pos += bytesRead;
+      let data = Buffer.concat([
+        this.remainder,
+        buffer.subarray(0, bytesRead),
+      ]);
+      let lineBreak = data.indexOf("\n");
+      while (lineBreak !== -1) {
+        const line = data.subarray(0, lineBreak).toString();
+        data = data.subarray(lineBreak + 1);
+        await this.emit(line.endsWith("\r") ? line.slice(0, -1) : line);
+        lineBreak = data.indexOf("\n");
+      }
+      this.remainder = Buffer.from(data);
+    }
+  }
+
+  /**
+   * Check the file for new data, following it through truncation and
+   * rotation.
+   */
+  async poll(): Promise<void> {
+    if (this.handle === null) {
+      // The file didn't exist the last time it was checked, so it's
+      // read from the start once it appears.
+      try {
+        await this.open(0);
+      } catch (err) {
+        return;
+      }
+    }
+    // Whatever was written to the current file is read first, even if
+    // it was renamed or removed in the meantime.
+    await this.readAvailable();
+    let stats;
+    try {
+      stats = await fs.stat(this.path);
+    } catch (err) {
+      // Rotated and not yet re-created.
+      return;
+    }
+    if (stats.ino !== this.ino) {
+      logger.info(`Tailed file '${this.path}' was rotated; reopening it`);
+      if (this.remainder.length > 0) {
+        // The last line of a rotated file won't ever be completed.
+        const line = this.remainder.toString();
+        this.remainder = Buffer.alloc(0);
+        await this.emit(line);
+      }
+      await this.close();
+      try {
+        await this.open(0);
+      } catch (err) {
+        return;
+      }
+      await this.readAvailable();
+    } else if (stats.size < this.pos) {
+      logger.info(`Tailed file '${this.path}' was truncated; reading it anew`);
+      this.pos = 0;
+      this.remainder = Buffer.alloc(0);
+      await this.readAvailable();
+    }
+  }
+}
+
+/**
+ * Creates an input channel based on data coming from one or more
+ * files. Returns a pair of [channel, endPromise].
  *
  * @param params Configuration parameters acquired from the pipeline.
  * @param options The tailing options to configure the input channel.
- * @returns A channel that receives data from a file and forwards
+ * @returns A channel that receives data from files and forwards
  * parsed events, and a promise that resolves when the input ends for
  * any reason.
  */
@@ -83,46 +309,129 @@ export const make = (
   const wrapper = makeWrapper(
     (typeof options === "string" ? {} : options)?.wrap
   );
-  const path = typeof options === "string" ? options : options.path;
+  const paths = (
+    typeof options === "string"
+      ? [options]
+      : typeof options.path === "string"
+      ? [options.path]
+      : options.path
+  ).map((path) => resolvePath(path));
   const startPos =
     typeof options === "string" ? "end" : options["start-at"] ?? "end";
+  const offsetFile =
+    typeof options === "string" ? undefined : options["offset-file"];
+  const checkpoint =
+    typeof options === "string"
+      ? undefined
+      : options.checkpoint ??
+        (typeof offsetFile === "undefined" ? undefined : { file: offsetFile });
+  const checkpointer =
+    typeof checkpoint === "undefined"
+      ? null
+      : makeCheckpointer(checkpoint, `cdp:${params.pipelineName}:tail:`);
   const eventParser = makeNewEventParser(
     params.pipelineName,
     params.pipelineSignature
   );
   const queue = new AsyncQueue<unknown>("input.tail");
+  const channel = queue.asChannel();
+  const done = makeFuse();
+  const emit = async (line: string) => {
+    arrivalTimestamp.update();
+    for await (const value of parse(Readable.from([line]))) {
+      queue.push(wrapper(value));
+    }
+  };
+  const tails = paths.map((path) => new FileTail(path, emit));
+
+  // Initialize endless tailing.
+  const tailing = (async () => {
+    // The offsets last saved, so that unchanged ones aren't saved
+    // again.
+    const savedOffsets = new Map<string, string>();
+    for (const tail of tails) {
+      // Reduce the chance of the file not existing before tailing.
+      try {
+        const fd = openFile(tail.path, "a");
+        closeFile(fd);
+      } catch (err) {
+        logger.warn("Failed to touch file", tail.path);
+      }
+      try {
+        const saved =
+          checkpointer === null
+            ? undefined
+            : await loadOffset(checkpointer, tail.path);
+        await tail.open(startPos === "start" ? 0 : undefined);
+        if (typeof saved !== "undefined") {
+          // A file that was rotated or truncated while the pipeline was
+          // stopped is read from the start.
+          const stats = await fs.stat(tail.path);
+          tail.pos =
+            saved.ino === stats.ino && saved.pos <= stats.size ? saved.pos : 0;
+        }
+      } catch (err) {
+        logger.warn(`Couldn't open '${tail.path}' yet: ${err}`);
+      }
+    }
+    try {
+      // The files are checked one last time after the input is
+      // closed, so that nothing written before that is missed.
+      for (;;) {
+        const closing = done.value();
+        for (const tail of tails) {
+          await tail.poll();
+        }
+        // Offsets are saved only after the lines before them were
+        // handed to the pipeline.
+        if (checkpointer !== null) {
+          for (const tail of tails) {
+            const offset = tail.offset;
+            const serialized = JSON.stringify(offset);
+            if (savedOffsets.get(tail.path) === serialized) {
+              continue;
+            }
+            try {
+              await checkpointer.save(tail.path, offset);
+              savedOffsets.set(tail.path, serialized);
+            } catch (err) {
+              logger.warn(`Couldn't save the offset of '${tail.path}': ${err}`);
+            }
+          }
+        }
+        if (closing) {
+          break;
+        }
+        await done.guard((resolve) => setTimeout(resolve, POLL_INTERVAL));
+      }
+    } finally {
+      for (const tail of tails) {
+        await tail.close();
+      }
+      await checkpointer?.close();
+    }
+  })().catch((err) => {
+    logger.error(`Encountered error while tailing: ${err}`);
+  });
+
   // Wrap the queue's channel to make it look like an input channel.
   let notifyDrained: () => void;
   const drained: Promise<void> = new Promise((resolve) => {
     notifyDrained = resolve;
   });
-  const channel = queue.asChannel();
-  // Reduce the chance of the file not existing before tailing.
-  try {
-    const fd = openFile(path, "a");
-    closeFile(fd);
-  } catch (err) {
-    logger.warn("Failed to touch file", path);
-  }
-  // Tail the target file.
-  const tail = new Tail(path, { startPos, sep: /\r?\n/ });
   const close = async () => {
-    await tail.stop();
+    done.trigger();
+    await tailing;
     await channel.close();
     notifyDrained();
     logger.debug("Drained tail input");
   };
-  tail.on("error", async (err: unknown) => {
-    logger.error(`Encountered error while tailing '${path}': ${err}`);
-    await close();
-  });
-  tail.on("line", async (line: string) => {
-    arrivalTimestamp.update();
-    for await (const value of parse(Readable.from([line]))) {
-      queue.push(wrapper(value));
+  tailing.then(() => {
+    if (!done.value()) {
+      // Tailing stopped because of an error.
+      close();
     }
   });
-  tail.start();
   return [
     parseChannel(
       {
@@ -0,0 +1,292 @@
+import { createServer, Socket } from "net";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseSingleValueParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import { makeLogger } from "../log";
+import { backpressure } from "../metrics";
+import { check } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/tcp");
+
+/**
+ * The ways frames are delimited in a connection's stream.
+ */
+type Framing = "newline" | "length-prefixed" | { delimiter: string };
+
+/**
+ * Options for this input form.
+ */
+export type TCPInputOptions = {
+  port: number | string;
+  host?: string;
+  framing?: Framing;
+  "max-frame-bytes"?: number | string;
+  wrap?: WrapDirective;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    port: {
+      anyOf: [
+        { type: "integer", minimum: 1, maximum: 65535 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    host: { type: "string", minLength: 1 },
+    framing: {
+      anyOf: [
+        { enum: ["newline", "length-prefixed"] },
+        {
+          type: "object",
+          properties: { delimiter: { type: "string", minLength: 1 } },
+          additionalProperties: false,
+          required: ["delimiter"],
+        },
+      ],
+    },
+    "max-frame-bytes": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: ["port"],
+};
+
+/**
+ * Validate tcp input options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: TCPInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ port: P.select(P.string) }, (rawPort) =>
+      ((port) => port >= 1 && port <= 65535)(parseInt(rawPort, 10))
+    ),
+    "the input's tcp port is invalid " +
+      "(must be between 1 and 65535, inclusive)"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+};
+
+/**
+ * Default maximum size of a single frame.
+ */
+const DEFAULT_MAX_FRAME_BYTES = 1024 * 1024;
+
+/**
+ * The size of the header of length-prefixed frames, which holds the
+ * frame's length as an unsigned, big-endian 32-bit integer.
+ */
+const LENGTH_PREFIX_BYTES = 4;
+
+/**
+ * Build a procedure that splits a connection's stream in frames. The
+ * procedure receives each chunk read from the connection and hands
+ * over the frames completed by it, or throws if a frame exceeds the
+ * maximum size. When the connection ends, the procedure is called
+ * without a chunk to hand over the last, undelimited frame.
+ *
+ * @param framing The way frames are delimited.
+ * @param maxFrameBytes The maximum size of a single frame.
+ * @param onFrame The procedure that receives each frame.
+ * @returns A stateful framing procedure.
+ */
+const makeFramer = (
+  framing: Framing,
+  maxFrameBytes: number,
+  onFrame: (frame: Buffer) => void
+): ((chunk?: Buffer) => void) => {
+  let pending = Buffer.alloc(0);
+  if (framing === "length-prefixed") {
+    return (chunk?: Buffer) => {
+      if (typeof chunk === "undefined") {
+        if (pending.length > 0) {
+          logger.warn("Connection ended in the middle of a frame");
+        }
+        return;
+      }
+      pending = Buffer.concat([pending, chunk]);
+      while (pending.length >= LENGTH_PREFIX_BYTES) {
+        const length = pending.readUInt32BE(0);
+        if (length > maxFrameBytes) {
+          throw new Error(`frame of ${length} bytes exceeds the maximum size`);
+        }
+        if (pending.length < LENGTH_PREFIX_BYTES + length) {
+          break;
+        }
+        onFrame(
+          pending.subarray(LENGTH_PREFIX_BYTES, LENGTH_PREFIX_BYTES + length)
+        );
+        pending = pending.subarray(LENGTH_PREFIX_BYTES + length);
+      }
+    };
+  }
+  const delimiter = Buffer.from(
+    framing === "newline" ? "\n" : framing.delimiter
+  );
+  return (chunk?: Buffer) => {
+    if (typeof chunk === "undefined") {
+      if (pending.length > 0) {
+        onFrame(pending);
+      }
+      pending = Buffer.alloc(0);
+      return;
+    }
+    // The search resumes where a delimiter may have been cut short.
+    let from = Math.max(pending.length - delimiter.length + 1, 0);
+    pending = Buffer.concat([pending, chunk]);
+    let index = pending.indexOf(delimiter, from);
+    while (index !== -1) {
+      onFrame(pending.subarray(0, index));
+      pending = pending.subarray(index + delimiter.length);
+      from = 0;
+      index = pending.indexOf(delimiter, from);
+    }
+    if (pending.length > maxFrameBytes) {
+      throw new Error(
+        `frame of more than ${maxFrameBytes} bytes exceeds the maximum size`
+      );
+    }
+  };
+};
+
+/**
+ * Creates an input channel based on frames received through TCP
+ * connections. Returns a pair of [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The TCP options to configure the input channel.
+ * @returns A channel that receives frames through TCP connections and
+ * forwards parsed events, and a promise that resolves when the input
+ * ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: TCPInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const port =
+    typeof options.port === "string"
+      ? parseInt(options.port, 10)
+      : options.port;
+  const framing = options.framing ?? "newline";
+  const maxFrameBytes =
+    typeof options["max-frame-bytes"] === "string"
+      ? parseInt(options["max-frame-bytes"], 10)
+      : options["max-frame-bytes"] ?? DEFAULT_MAX_FRAME_BYTES;
+  const parse = chooseSingleValueParser(options.wrap);
+  const wrapper = makeWrapper(options.wrap);
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+
+  const channel = flatMap(async (frame: string) => {
+    arrivalTimestamp.update();
+    // Each frame holds a single value.
+    try {
+      return [wrapper(parse(frame))];
+    } catch (err) {
+      logger.warn(`Couldn't parse TCP frame: ${err}`);
+      return [];
+    }
+  }, new AsyncQueue<string>("input.tcp").asChannel());
+
+  // Connections stop being read from while the pipeline signals
+  // backpressure, which lets TCP flow control slow down each sender.
+  const sockets = new Set<Socket>();
+  const pause = () => sockets.forEach((socket) => socket.pause());
+  const resume = () => sockets.forEach((socket) => socket.resume());
+  backpressure.on("on", pause);
+  backpressure.on("off", resume);
+  const server = createServer((socket) => {
+    const peer = `${socket.remoteAddress}:${socket.remotePort}`;
+    logger.debug("Accepted TCP connection from", peer);
+    sockets.add(socket);
+    if (backpressure.status()) {
+      socket.pause();
+    }
+    const framer = makeFramer(framing, maxFrameBytes, (frame) => {
+      if (frame.length > 0) {
+        channel.send(frame.toString());
+      }
+    });
+    const forward = (chunk?: Buffer) => {
+      try {
+        framer(chunk);
+      } catch (err) {
+        logger.warn(`Closing TCP connection from ${peer}: ${err}`);
+        socket.destroy();
+      }
+    };
+    socket.on("data", forward);
+    socket.on("end", () => forward());
+    socket.on("error", (err) =>
+      logger.warn(`TCP connection from ${peer} failed: ${err}`)
+    );
+    socket.on("close", () => sockets.delete(socket));
+  });
+  const closed = new Promise<void>((resolve) => {
+    server.on("close", resolve);
+    server.on("error", (err) => {
+      logger.error(`TCP server failed: ${err}`);
+      resolve();
+    });
+  });
+  server.listen(port, options.host, () =>
+    logger.info(`Listening for TCP connections on port ${port}`)
+  );
+
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          // Frames already received are kept, but open connections are
+          // dropped so that they don't hold back the shutdown.
+          const serverClosed = new Promise((resolve) => server.close(resolve));
+          sockets.forEach((socket) => socket.destroy());
+          await serverClosed;
+          backpressure.off("on", pause);
+          backpressure.off("off", resume);
+          await channel.close();
+          logger.debug("Drained tcp input");
+        },
+      },
+      eventParser,
+      "parsing tcp frame"
+    ),
+    closed,
+  ];
+};
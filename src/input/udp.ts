@@ -0,0 +1,173 @@
+import { createSocket } from "dgram";
+import { isIPv6 } from "net";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseSingleValueParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import { makeLogger } from "../log";
+import { backpressure, udpDroppedDatagrams } from "../metrics";
+import { check } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/udp");
+
+/**
+ * Options for this input form.
+ */
+export type UDPInputOptions = {
+  port: number | string;
+  host?: string;
+  "buffer-size"?: number | string;
+  wrap?: WrapDirective;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    port: {
+      anyOf: [
+        { type: "integer", minimum: 1, maximum: 65535 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    host: { type: "string", minLength: 1 },
+    "buffer-size": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    wrap: wrapDirectiveSchema,
+  },
+  additionalProperties: false,
+  required: ["port"],
+};
+
+/**
+ * Validate udp input options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: UDPInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ port: P.select(P.string) }, (rawPort) =>
+      ((port) => port >= 1 && port <= 65535)(parseInt(rawPort, 10))
+    ),
+    "the input's udp port is invalid " +
+      "(must be between 1 and 65535, inclusive)"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+};
+
+/**
+ * Creates an input channel based on UDP datagrams, each one holding
+ * a single event. Returns a pair of [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The UDP options to configure the input channel.
+ * @returns A channel that receives UDP datagrams and forwards parsed
+ * events, and a promise that resolves when the input ends for any
+ * reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: UDPInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const port =
+    typeof options.port === "string"
+      ? parseInt(options.port, 10)
+      : options.port;
+  const bufferSize =
+    typeof options["buffer-size"] === "string"
+      ? parseInt(options["buffer-size"], 10)
+      : options["buffer-size"];
+  const parse = chooseSingleValueParser(options.wrap);
+  const wrapper = makeWrapper(options.wrap);
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+
+  const channel = flatMap(async (datagram: string) => {
+    arrivalTimestamp.update();
+    // Each datagram holds a single value.
+    try {
+      return [wrapper(parse(datagram))];
+    } catch (err) {
+      logger.warn(`Couldn't parse UDP datagram: ${err}`);
+      return [];
+    }
+  }, new AsyncQueue<string>("input.udp").asChannel());
+
+  const socket = createSocket({
+    type: isIPv6(options.host ?? "") ? "udp6" : "udp4",
+    ...(typeof bufferSize === "number" ? { recvBufferSize: bufferSize } : {}),
+  });
+  // Senders can't be slowed down, so datagrams that arrive while the
+  // pipeline signals backpressure are dropped.
+  socket.on("message", (message) => {
+    if (backpressure.status()) {
+      udpDroppedDatagrams.inc();
+      return;
+    }
+    channel.send(message.toString());
+  });
+  const closed = new Promise<void>((resolve) => {
+    socket.on("close", resolve);
+    socket.on("error", (err) => {
+      logger.error(`UDP socket failed: ${err}`);
+      socket.close();
+    });
+  });
+  socket.bind(port, options.host, () =>
+    logger.info(`Listening for UDP datagrams on port ${port}`)
+  );
+
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          await new Promise<void>((resolve) => {
+            try {
+              socket.close(resolve);
+            } catch (err) {
+              // The socket was already closed.
+              resolve();
+            }
+          });
+          await channel.close();
+          logger.debug("Drained udp input");
+        },
+      },
+      eventParser,
+      "parsing udp datagram"
+    ),
+    closed,
+  ];
+};
@@ -0,0 +1,212 @@
+import { Readable } from "stream";
+import { match, P } from "ts-pattern";
+import WebSocket, { RawData } from "ws";
+import { AsyncQueue, Channel, flatMap } from "../async-queue";
+import {
+  Event,
+  arrivalTimestamp,
+  makeNewEventParser,
+  parseChannel,
+  WrapDirective,
+  wrapDirectiveSchema,
+  chooseParser,
+  makeWrapper,
+  validateWrap,
+} from "../event";
+import { connectWithBackoff, makeWebSocketServer } from "../io/websocket";
+import { makeLogger } from "../log";
+import { backpressure } from "../metrics";
+import { check } from "../utils";
+import { PipelineInputParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("input/websocket");
+
+/**
+ * Options for this input form.
+ */
+export type WebSocketInputOptions =
+  | string
+  | {
+      url?: string;
+      port?: number | string;
+      endpoint?: string;
+      host?: string;
+      wrap?: WrapDirective;
+    };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        url: { type: "string", minLength: 1 },
+        port: {
+          anyOf: [
+            { type: "integer", minimum: 1, maximum: 65535 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+        endpoint: { type: "string", minLength: 1, pattern: "^/.*$" },
+        host: { type: "string", minLength: 1 },
+        wrap: wrapDirectiveSchema,
+      },
+      additionalProperties: false,
+    },
+  ],
+};
+
+/**
+ * Validate websocket input options, after they've been checked by
+ * the ajv schema.
+ *
+ * @param options The options to validate.
+ */
+export const validate = (options: WebSocketInputOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions
+      .with(P.string, () => true)
+      .with({ url: P._, port: P._ }, () => false)
+      .with({ url: P._ }, () => true)
+      .with({ port: P._ }, () => true)
+      .with(P._, () => false),
+    "the input must use exactly one of websocket.url or websocket.port"
+  );
+  check(
+    matchOptions
+      .with({ url: P._, endpoint: P._ }, () => false)
+      .with({ url: P._, host: P._ }, () => false),
+    "the input can use websocket.endpoint and websocket.host only " +
+      "along with websocket.port"
+  );
+  check(
+    matchOptions.with({ port: P.select(P.string) }, (rawPort) =>
+      ((port) => port >= 1 && port <= 65535)(parseInt(rawPort, 10))
+    ),
+    "the input's websocket port is invalid " +
+      "(must be between 1 and 65535, inclusive)"
+  );
+  check(
+    matchOptions.with({ wrap: P.select() }, (wrap) =>
+      validateWrap(wrap, "the input's wrap option")
+    )
+  );
+};
+
+/**
+ * Default path clients connect to, in server mode.
+ */
+const DEFAULT_ENDPOINT = "/";
+
+/**
+ * Convert the data of a WebSocket frame to text, regardless of
+ * whether it was sent as a text or a binary frame.
+ *
+ * @param data The frame's data.
+ * @returns The frame's data as text.
+ */
+const frameToString = (data: RawData): string =>
+  (Array.isArray(data)
+    ? Buffer.concat(data)
+    : Buffer.isBuffer(data)
+    ? data
+    : Buffer.from(data)
+  ).toString();
+
+/**
+ * Creates an input channel based on frames received through
+ * WebSocket connections, either established with a server (client
+ * mode) or accepted from clients (server mode). Returns a pair of
+ * [channel, endPromise].
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The WebSocket options to configure the input
+ * channel.
+ * @returns A channel that receives frames through WebSocket
+ * connections and forwards parsed events, and a promise that resolves
+ * when the input ends for any reason.
+ */
+export const make = (
+  params: PipelineInputParameters,
+  options: WebSocketInputOptions
+): [Channel<never, Event>, Promise<void>] => {
+  const extendedOptions =
+    typeof options === "string" ? { url: options } : options;
+  const wrap = extendedOptions.wrap;
+  const parse = chooseParser(wrap);
+  const wrapper = makeWrapper(wrap);
+  const eventParser = makeNewEventParser(
+    params.pipelineName,
+    params.pipelineSignature
+  );
+
+  const channel = flatMap(async (frame: string) => {
+    arrivalTimestamp.update();
+    const things = [];
+    for await (const thing of parse(Readable.from([frame]))) {
+      things.push(wrapper(thing));
+    }
+    return things;
+  }, new AsyncQueue<string>("input.websocket").asChannel());
+
+  // Connections stop being read from while the pipeline signals
+  // backpressure.
+  const sockets = new Set<WebSocket>();
+  const pause = () => sockets.forEach((socket) => socket.pause());
+  const resume = () => sockets.forEach((socket) => socket.resume());
+  backpressure.on("on", pause);
+  backpressure.on("off", resume);
+  const accept = (socket: WebSocket) => {
+    sockets.add(socket);
+    if (backpressure.status()) {
+      socket.pause();
+    }
+    socket.on("message", (data) => {
+      logger.debug("Got WebSocket frame");
+      channel.send(frameToString(data));
+    });
+    socket.on("close", () => sockets.delete(socket));
+  };
+
+  let connection: { close: () => Promise<void>; closed: Promise<void> };
+  if (typeof extendedOptions.url === "string") {
+    connection = connectWithBackoff(extendedOptions.url, accept);
+  } else {
+    const rawPort = extendedOptions.port as number | string;
+    connection = makeWebSocketServer(
+      typeof rawPort === "string" ? parseInt(rawPort, 10) : rawPort,
+      extendedOptions.endpoint ?? DEFAULT_ENDPOINT,
+      accept,
+      extendedOptions.host
+    );
+  }
+
+  return [
+    parseChannel(
+      {
+        ...channel,
+        send: () => {
+          logger.warn("Can't send events to an input channel");
+          return false;
+        },
+        close: async () => {
+          await connection.close();
+          backpressure.off("on", pause);
+          backpressure.off("off", resume);
+          await channel.close();
+          logger.debug("Drained websocket input");
+        },
+      },
+      eventParser,
+      "parsing websocket frame"
+    ),
+    connection.closed,
+  ];
+};
@@ -0,0 +1,545 @@
+import {
+  KeyObject,
+  createCipheriv,
+  createDecipheriv,
+  createHmac,
+  createPrivateKey,
+  createPublicKey,
+  diffieHellman,
+  generateKeyPairSync,
+  hkdfSync,
+  randomBytes,
+  timingSafeEqual,
+} from "crypto";
+
+/**
+ * The first line of every age file.
+ */
+const VERSION_LINE = "age-encryption.org/v1";
+
+/**
+ * The label of X25519 recipient stanzas, and the info given to the
+ * key derivation that wraps file keys for them.
+ */
+const X25519_LABEL = "age-encryption.org/v1/X25519";
+
+/**
+ * The size of each chunk of the payload, before encryption.
+ */
+const CHUNK_SIZE = 64 * 1024;
+
+/**
+ * The size of the authentication tag appended to each chunk.
+ */
+const TAG_SIZE = 16;
+
+/**
+ * The DER prefixes of X25519 private (PKCS#8) and public (SPKI) keys,
+ * which precede the raw 32 bytes of each key.
+ */
+const PRIVATE_KEY_PREFIX = Buffer.from(
+  "302e020100300506032b656e04220420",
+  "hex"
+);
+const PUBLIC_KEY_PREFIX = Buffer.from("302a300506032b656e032100", "hex");
+
+/**
+ * The alphabet of bech32 strings.
+ */
+const BECH32_ALPHABET = "qpzry9x8gf2tvdw0s3jn54khce6mua7l";
+
+/**
+ * Compute the bech32 checksum polynomial of the given values.
+ *
+ * @param values The 5-bit values to checksum.
+ * @returns The remainder of the polynomial.
+ */
+const polymod = (values: number[]): number => {
+  const generator = [
+    0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3,
+  ];
+  let checksum = 1;
+  for (const value of values) {
+    const top = checksum >>> 25;
+    checksum = ((checksum & 0x1ffffff) << 5) ^ value;
+    generator.forEach((g, index) => {
+      if ((top >>> index) & 1) {
+        checksum ^= g;
+      }
+    });
+  }
+  return checksum;
+};
+
+/**
+ * Expand the human-readable part of a bech32 string for checksums.
+ *
+ * @param prefix The lowercase human-readable part.
+ * @returns The values it contributes to the checksum.
+ */
+const expandPrefix = (prefix: string): number[] => [
+  ...Array.from(prefix, (c) => c.charCodeAt(0) >> 5),
+  0,
+  ...Array.from(prefix, (c) => c.charCodeAt(0) & 31),
+];
+
+/**
+ * Regroup bits, e.g. from bytes into the 5-bit values of bech32.
+ *
+ * @param data The values to regroup.
+ * @param from The amount of bits of each given value.
+ * @param to The amount of bits of each resulting value.
+ * @param pad Whether the last bits are padded with zeros.
+ * @returns The regrouped values, or null if padding is invalid.
+ */
+const regroup = (
+  data: Iterable<number>,
+  from: number,
+  to: number,
+  pad: boolean
+): number[] | null => {
+  let accumulator = 0;
+  let bits = 0;
+  const result: number[] = [];
+  for (const value of data) {
+    accumulator = (accumulator << from) | value;
+    bits += from;
+    while (bits >= to) {
+      bits -= to;
+      result.push((accumulator >> bits) & ((1 << to) - 1));
+    }
+  }
+  if (pad && bits > 0) {
+    result.push((accumulator << (to - bits)) & ((1 << to) - 1));
+  } else if (!pad && (bits >= from || (accumulator << (to - bits)) & 0xff)) {
+    return null;
+  }
+  return result;
+};
+
+/**
+ * Encode bytes as a bech32 string.
+ *
+ * @param prefix The lowercase human-readable part.
+ * @param bytes The bytes to encode.
+ * @returns The bech32 string.
+ */
+const encodeBech32 = (prefix: string, bytes: Buffer): string => {
+  const values = regroup(bytes, 8, 5, true) as number[];
+  const checksum =
+    polymod([...expandPrefix(prefix), ...values, 0, 0, 0, 0, 0, 0]) ^ 1;
+  const checksumValues = Array.from(
+    { length: 6 },
+    (_, index) => (checksum >>> (5 * (5 - index))) & 31
+  );
+  return (
+    prefix +
+    "1" +
+    [...values, ...checksumValues].map((v) => BECH32_ALPHABET[v]).join("")
+  );
+};
+
+/**
+ * Decode a bech32 string with the given human-readable part.
+ *
+ * @param prefix The expected lowercase human-readable part.
+ * @param encoded The bech32 string, either all lowercase or all
+ * uppercase.
+ * @returns The decoded bytes, or null if the string is invalid.
+ */
+const decodeBech32 = (prefix: string, encoded: string): Buffer | null => {
+  if (encoded !== encoded.toLowerCase() && encoded !== encoded.toUpperCase()) {
+    return null;
+  }
+  const lower = encoded.toLowerCase();
+  const separator = lower.lastIndexOf("1");
+  if (lower.slice(0, separator) !== prefix || lower.length - separator < 7) {
+    return null;
+  }
+  const values = Array.from(lower.slice(separator + 1), (c) =>
+    BECH32_ALPHABET.indexOf(c)
+  );
+  if (
+    values.some((value) => value < 0) ||
+    polymod([...expandPrefix(prefix), ...values]) !== 1
+  ) {
+    return null;
+  }
+  const bytes = regroup(values.slice(0, -6), 5, 8, false);
+  return bytes === null ? null : Buffer.from(bytes);
+};
+
+/**
+ * Parse an age X25519 recipient, as written by age-keygen.
+ *
+ * @param recipient The recipient, starting with `age1`.
+ * @returns The raw public key, or null if the recipient is invalid,
+ * including when it's a low-order point that no file could be
+ * encrypted to.
+ */
+export const parseRecipient = (recipient: string): Buffer | null => {
+  const key = decodeBech32("age", recipient.trim());
+  return key !== null &&
+    key.length === 32 &&
+    sharedSecret(generateKeyPairSync("x25519").privateKey, key) !== null
+    ? key
+    : null;
+};
+
+/**
+ * Parse an age X25519 identity, as written by age-keygen.
+ *
+ * @param identity The identity, starting with `AGE-SECRET-KEY-1`.
+ * @returns The raw private key, or null if the identity is invalid.
+ */
+export const parseIdentity = (identity: string): Buffer | null => {
+  const key = decodeBech32("age-secret-key-", identity.trim());
+  return key !== null && key.length === 32 ? key : null;
+};
+
+/**
+ * Build a key object from a raw X25519 private key.
+ *
+ * @param raw The 32 bytes of the key.
+ * @returns The key object.
+ */
+const privateKeyOf = (raw: Buffer): KeyObject =>
+  createPrivateKey({
+    key: Buffer.concat([PRIVATE_KEY_PREFIX, raw]),
+    format: "der",
+    type: "pkcs8",
+  });
+
+/**
+ * Build a key object from a raw X25519 public key.
+ *
+ * @param raw The 32 bytes of the key.
+ * @returns The key object.
+ */
+const publicKeyOf = (raw: Buffer): KeyObject =>
+  createPublicKey({
+    key: Buffer.concat([PUBLIC_KEY_PREFIX, raw]),
+    format: "der",
+    type: "spki",
+  });
+
+/**
+ * Get the raw bytes of a public key object.
+ *
+ * @param key The key object.
+ * @returns The 32 bytes of the key.
+ */
+const rawPublicKey = (key: KeyObject): Buffer =>
+  key
+    .export({ format: "der", type: "spki" })
+    .subarray(PUBLIC_KEY_PREFIX.length);
+
+/**
+ * Compute the X25519 shared secret of a private key and a raw public
+ * key. Low-order public keys produce an all-zero secret regardless of
+ * the private key, which age requires to be rejected.
+ *
+ * @param privateKey The private key object.
+ * @param publicKey The 32 bytes of the public key.
+ * @returns The shared secret, or null if the public key is a
+ * low-order point.
+ */
+const sharedSecret = (
+  privateKey: KeyObject,
+  publicKey: Buffer
+): Buffer | null => {
+  const publicKeyObject = publicKeyOf(publicKey);
+  let shared: Buffer;
+  try {
+    shared = diffieHellman({ privateKey, publicKey: publicKeyObject });
+  } catch (err) {
+    // OpenSSL refuses to derive all-zero secrets on its own.
+    return null;
+  }
+  return shared.every((byte) => byte === 0) ? null : shared;
+};
+
+/**
+ * Generate a new age identity and its recipient.
+ *
+ * @returns The identity and the recipient, encoded as age-keygen
+ * does.
+ */
+export const generateIdentity = (): {
+  identity: string;
+  recipient: string;
+} => {
+  const { privateKey, publicKey } = generateKeyPairSync("x25519");
+  const raw = privateKey
+    .export({ format: "der", type: "pkcs8" })
+    .subarray(PRIVATE_KEY_PREFIX.length);
+  return {
+    identity: encodeBech32("age-secret-key-", raw).toUpperCase(),
+    recipient: encodeBech32("age", rawPublicKey(publicKey)),
+  };
+};
+
+/**
+ * Derive a 32-byte key with HKDF-SHA-256.
+ *
+ * @param ikm The input key material.
+ * @param salt The salt.
+ * @param info The context of the key.
+ * @returns The derived key.
+ */
+const hkdf = (ikm: Buffer, salt: Buffer, info: string): Buffer =>
+  Buffer.from(hkdfSync("sha256", ikm, salt, info, 32));
+
+/**
+ * Seal data with ChaCha20-Poly1305.
+ *
+ * @param key The 32-byte key.
+ * @param nonce The 12-byte nonce.
+ * @param data The plaintext to seal.
+ * @returns The ciphertext, followed by its authentication tag.
+ */
+const seal = (key: Buffer, nonce: Buffer, data: Buffer): Buffer => {
+  const cipher = createCipheriv("chacha20-poly1305", key, nonce, {
+    authTagLength: TAG_SIZE,
+  });
+  return Buffer.concat([
+    cipher.update(data),
+    cipher.final(),
+    cipher.getAuthTag(),
+  ]);
+};
+
+/**
+ * Open data sealed with ChaCha20-Poly1305.
+ *
+ * @param key The 32-byte key.
+ * @param nonce The 12-byte nonce.
+ * @param data The ciphertext, followed by its authentication tag.
+ * @returns The plaintext. Throws an error if the data was tampered
+ * with or sealed with another key.
+ */
+const open = (key: Buffer, nonce: Buffer, data: Buffer): Buffer => {
+  if (data.length < TAG_SIZE) {
+    throw new Error("truncated ciphertext");
+  }
+  const decipher = createDecipheriv("chacha20-poly1305", key, nonce, {
+    authTagLength: TAG_SIZE,
+  });
+  decipher.setAuthTag(data.subarray(data.length - TAG_SIZE));
+  return Buffer.concat([
+    decipher.update(data.subarray(0, data.length - TAG_SIZE)),
+    decipher.final(),
+  ]);
+};
+
+/**
+ * Encode bytes as unpadded base64, as used in age headers.
+ *
+ * @param bytes The bytes to encode.
+ * @returns The base64 text.
+ */
+const toBase64 = (bytes: Buffer): string =>
+  bytes.toString("base64").replace(/=+$/, "");
+
+/**
+ * Decode unpadded base64, as used in age headers.
+ *
+ * @param text The base64 text.
+ * @returns The decoded bytes. Throws an error if the text isn't
+ * canonical unpadded base64.
+ */
+const fromBase64 = (text: string): Buffer => {
+  const bytes = Buffer.from(text, "base64");
+  if (!/^[A-Za-z0-9+/]*$/.test(text) || toBase64(bytes) !== text) {
+    throw new Error("invalid base64 in header");
+  }
+  return bytes;
+};
+
+/**
+ * The nonce of a payload chunk: its counter and whether it's the
+ * last one.
+ *
+ * @param counter The index of the chunk.
+ * @param last Whether it's the last chunk.
+ * @returns The 12-byte nonce.
+ */
+const chunkNonce = (counter: number, last: boolean): Buffer => {
+  const nonce = Buffer.alloc(12);
+  nonce.writeUIntBE(counter, 5, 6);
+  nonce[11] = last ? 1 : 0;
+  return nonce;
+};
+
+/**
+ * Encrypt data to the given recipients, producing a binary age file
+ * that age itself (or any compatible tool) can decrypt. The payload
+ * is split in 64 KiB chunks, each encrypted and authenticated on its
+ * own, so that large files may be decrypted as a stream.
+ *
+ * @param plaintext The data to encrypt.
+ * @param recipients The raw public keys of the recipients.
+ * @returns The encrypted file.
+ */
+export const encrypt = (plaintext: Buffer, recipients: Buffer[]): Buffer => {
+  const fileKey = randomBytes(16);
+  const stanzas = recipients.map((recipient) => {
+    const { privateKey, publicKey } = generateKeyPairSync("x25519");
+    const share = rawPublicKey(publicKey);
+    const shared = sharedSecret(privateKey, recipient);
+    if (shared === null) {
+      throw new Error("invalid X25519 recipient (low-order point)");
+    }
+    const wrapKey = hkdf(
+      shared,
+      Buffer.concat([share, recipient]),
+      X25519_LABEL
+    );
+    const body = toBase64(seal(wrapKey, Buffer.alloc(12), fileKey));
+    // Bodies are wrapped at 64 columns, ending with a shorter line.
+    const lines = body.match(/.{1,64}/g) ?? [];
+    if ((lines[lines.length - 1] ?? "").length === 64) {
+      lines.push("");
+    }
+    return `-> X25519 ${toBase64(share)}\n${lines.join("\n")}\n`;
+  });
+  const header = `${VERSION_LINE}\n${stanzas.join("")}---`;
+  const mac = createHmac("sha256", hkdf(fileKey, Buffer.alloc(0), "header"))
+    .update(header)
+    .digest();
+  const nonce = randomBytes(16);
+  const payloadKey = hkdf(fileKey, nonce, "payload");
+  const chunks: Buffer[] = [
+    Buffer.from(`${header} ${toBase64(mac)}\n`),
+    nonce,
+  ];
+  const count = Math.max(1, Math.ceil(plaintext.length / CHUNK_SIZE));
+  for (let counter = 0; counter < count; counter++) {
+    chunks.push(
+      seal(
+        payloadKey,
+        chunkNonce(counter, counter === count - 1),
+        plaintext.subarray(counter * CHUNK_SIZE, (counter + 1) * CHUNK_SIZE)
+      )
+    );
+  }
+  return Buffer.concat(chunks);
+};
+
+/**
+ * Unwrap the file key of an X25519 stanza with an identity.
+ *
+ * @param share The ephemeral share of the stanza.
+ * @param body The wrapped file key.
+ * @param identity The raw private key of the identity.
+ * @returns The file key, or null if the stanza isn't for the
+ * identity.
+ */
+const unwrap = (
+  share: Buffer,
+  body: Buffer,
+  identity: Buffer
+): Buffer | null => {
+  const privateKey = privateKeyOf(identity);
+  const shared = sharedSecret(privateKey, share);
+  if (shared === null) {
+    throw new Error("invalid X25519 share");
+  }
+  const recipient = rawPublicKey(createPublicKey(privateKey));
+  const wrapKey = hkdf(shared, Buffer.concat([share, recipient]), X25519_LABEL);
+  try {
+    return open(wrapKey, Buffer.alloc(12), body);
+  } catch (err) {
+    return null;
+  }
+};
+
+/**
+ * Decrypt a binary age file with any of the given identities.
+ *
+ * @param file The encrypted file.
+ * @param identities The raw private keys of the identities.
+ * @returns The decrypted data. Throws an error if the file is
+ * malformed, tampered with, or not encrypted to any of the
+ * identities.
+ */
+export const decrypt = (file: Buffer, identities: Buffer[]): Buffer => {
+  const macMarker = file.indexOf("\n--- ");
+  const headerEnd = macMarker < 0 ? -1 : file.indexOf("\n", macMarker + 1);
+  if (headerEnd < 0) {
+    throw new Error("not an age file (header not found)");
+  }
+  const header = file.toString("latin1", 0, macMarker + 4);
+  const lines = header.split("\n");
+  if (lines[0] !== VERSION_LINE) {
+    throw new Error("not an age file (unknown version)");
+  }
+  let fileKey: Buffer | null = null;
+  for (let index = 1; index < lines.length - 1; index++) {
+    const args = lines[index].split(" ");
+    if (args[0] !== "->" || args.length < 2) {
+      throw new Error("malformed age header");
+    }
+    const bodyLines: string[] = [];
+    while (index + 1 < lines.length - 1) {
+      const line = lines[++index];
+      bodyLines.push(line);
+      if (line.length < 64) {
+        break;
+      }
+    }
+    if (args[1] !== "X25519" || fileKey !== null) {
+      continue;
+    }
+    const share = fromBase64(args[2] ?? "");
+    const body = fromBase64(bodyLines.join(""));
+    if (args.length !== 3 || share.length !== 32 || body.length !== 32) {
+      throw new Error("malformed X25519 stanza");
+    }
+    for (const identity of identities) {
+      fileKey = unwrap(share, body, identity);
+      if (fileKey !== null) {
+        break;
+      }
+    }
+  }
+  if (fileKey === null) {
+    throw new Error("no identity matched any of the file's recipients");
+  }
+  const mac = fromBase64(file.toString("latin1", macMarker + 5, headerEnd));
+  const expectedMac = createHmac(
+    "sha256",
+    hkdf(fileKey, Buffer.alloc(0), "header")
+  )
+    .update(header)
+    .digest();
+  if (mac.length !== expectedMac.length || !timingSafeEqual(mac, expectedMac)) {
+    throw new Error("the age header was tampered with");
+  }
+  const nonce = file.subarray(headerEnd + 1, headerEnd + 17);
+  if (nonce.length !== 16) {
+    throw new Error("truncated age payload");
+  }
+  const payloadKey = hkdf(fileKey, nonce, "payload");
+  const payload = file.subarray(headerEnd + 17);
+  const sealedSize = CHUNK_SIZE + TAG_SIZE;
+  const count = Math.max(1, Math.ceil(payload.length / sealedSize));
+  const chunks: Buffer[] = [];
+  for (let counter = 0; counter < count; counter++) {
+    const chunk = payload.subarray(
+      counter * sealedSize,
+      (counter + 1) * sealedSize
+    );
+    try {
+      chunks.push(
+        open(payloadKey, chunkNonce(counter, counter === count - 1), chunk)
+      );
+    } catch (err) {
+      throw new Error("the age payload was tampered with or truncated");
+    }
+    if (counter > 0 && counter === count - 1 && chunk.length === TAG_SIZE) {
+      throw new Error("the age payload ends with an empty chunk");
+    }
+  }
+  return Buffer.concat(chunks);
+};
@@ -0,0 +1,527 @@
+import { Reader } from "./binary";
+
+/**
+ * An Avro schema, compiled into a tree of types. Named types are
+ * resolved, so recursive records hold references to themselves.
+ */
+export type AvroType =
+  | {
+      type:
+        | "null"
+        | "boolean"
+        | "int"
+        | "long"
+        | "float"
+        | "double"
+        | "bytes"
+        | "string";
+    }
+  | {
+      type: "record";
+      name: string;
+      fields: { name: string; type: AvroType; default?: unknown }[];
+    }
+  | { type: "enum"; name: string; symbols: string[] }
+  | { type: "fixed"; name: string; size: number }
+  | { type: "array"; items: AvroType }
+  | { type: "map"; values: AvroType }
+  | { type: "union"; branches: AvroType[] };
+
+/**
+ * The names of primitive types.
+ */
+const PRIMITIVES = [
+  "null",
+  "boolean",
+  "int",
+  "long",
+  "float",
+  "double",
+  "bytes",
+  "string",
+];
+
+/**
+ * Compile an Avro schema, given as parsed JSON. Logical types are
+ * ignored, so values are read as their underlying types.
+ *
+ * @param schema The schema to compile.
+ * @returns The compiled schema.
+ */
+export const parseSchema = (schema: unknown): AvroType => {
+  const named = new Map<string, AvroType>();
+  const fullName = (name: string, namespace: string | undefined): string =>
+    name.includes(".") || !namespace ? name : `${namespace}.${name}`;
+  const compile = (s: unknown, namespace: string | undefined): AvroType => {
+    if (typeof s === "string") {
+      if (PRIMITIVES.includes(s)) {
+        return { type: s } as AvroType;
+      }
+      const type = named.get(fullName(s, namespace)) ?? named.get(s);
+      if (typeof type === "undefined") {
+        throw new Error(`undefined Avro type: ${s}`);
+      }
+      return type;
+    }
+    if (Array.isArray(s)) {
+      return {
+        type: "union",
+        branches: s.map((branch) => compile(branch, namespace)),
+      };
+    }
+    if (typeof s !== "object" || s === null) {
+      throw new Error(`invalid Avro schema: ${JSON.stringify(s)}`);
+    }
+    const definition = s as { [key: string]: unknown };
+    const declare = (): [string, string | undefined] => {
+      if (typeof definition.name !== "string") {
+        throw new Error(`Avro ${definition.type} types must have a name`);
+      }
+      const name = fullName(
+        definition.name,
+        typeof definition.namespace === "string"
+          ? definition.namespace
+          : namespace
+      );
+      const dot = name.lastIndexOf(".");
+      return [name, dot === -1 ? undefined : name.slice(0, dot)];
+    };
+    switch (definition.type) {
+      case "record":
+      case "error": {
+        const [name, innerNamespace] = declare();
+        const fields: { name: string; type: AvroType; default?: unknown }[] =
+          [];
+        const type: AvroType = { type: "record", name, fields };
+        named.set(name, type);
+        if (!Array.isArray(definition.fields)) {
+          throw new Error(`Avro record ${name} must have a list of fields`);
+        }
+        for (const field of definition.fields) {
+          if (typeof field?.name !== "string") {
+            throw new Error(`Avro record ${name} has a field without name`);
+          }
+          fields.push({
+            name: field.name,
+            type: compile(field.type, innerNamespace),
+            ...("default" in field ? { default: field.default } : {}),
+          });
+        }
+        return type;
+      }
+      case "enum": {
+        const [name] = declare();
+        if (
+          !Array.isArray(definition.symbols) ||
+          !definition.symbols.every((symbol) => typeof symbol === "string")
+        ) {
+          throw new Error(`Avro enum ${name} must have a list of symbols`);
+        }
+        const type: AvroType = {
+          type: "enum",
+          name,
+          symbols: definition.symbols,
+        };
+        named.set(name, type);
+        return type;
+      }
+      case "fixed": {
+        const [name] = declare();
+        if (!Number.isInteger(definition.size)) {
+          throw new Error(`Avro fixed ${name} must have a size`);
+        }
+        const type: AvroType = {
+          type: "fixed",
+          name,
+          size: definition.size as number,
+        };
+        named.set(name, type);
+        return type;
+      }
+      case "array":
+        return { type: "array", items: compile(definition.items, namespace) };
+      case "map":
+        return { type: "map", values: compile(definition.values, namespace) };
+      default:
+        // Primitive types may also be given as objects, possibly
+        // annotated with logical types.
+        return compile(definition.type, namespace);
+    }
+  };
+  return compile(schema, undefined);
+};
+
+/**
+ * A cursor over a buffer being decoded.
+ */
+class AvroReader extends Reader {
+  constructor(buffer: Buffer) {
+    super(buffer, "Avro");
+  }
+
+  /**
+   * Read a long, encoded as a zig-zag variable-length integer. Longs
+   * are read as JS numbers, which are precise up to 2^53.
+   *
+   * @returns The integer read.
+   */
+  long(): number {
+    let value = 0;
+    let shift = 1;
+    let byte: number;
+    do {
+      byte = this.take(1)[0];
+      value += (byte & 0x7f) * shift;
+      shift *= 128;
+    } while (byte & 0x80);
+    return value % 2 === 0 ? value / 2 : -(value + 1) / 2;
+  }
+}
+
+/**
+ * Read a value of the given type.
+ *
+ * @param type The type of the value.
+ * @param reader The cursor over the data.
+ * @returns The value.
+ */
+const read = (type: AvroType, reader: AvroReader): unknown => {
+  switch (type.type) {
+    case "null":
+      return null;
+    case "boolean":
+      return reader.take(1)[0] !== 0;
+    case "int":
+    case "long":
+      return reader.long();
+    case "float":
+      return reader.take(4).readFloatLE(0);
+    case "double":
+      return reader.take(8).readDoubleLE(0);
+    case "bytes":
+      return reader.take(reader.long()).toString("base64");
+    case "string":
+      return reader.take(reader.long()).toString("utf8");
+    case "record":
+      return Object.fromEntries(
+        type.fields.map((field) => [field.name, read(field.type, reader)])
+      );
+    case "enum": {
+      const symbol = type.symbols[reader.long()];
+      if (typeof symbol === "undefined") {
+        throw new Error(`invalid symbol index for Avro enum ${type.name}`);
+      }
+      return symbol;
+    }
+    case "fixed":
+      return reader.take(type.size).toString("base64");
+    case "array": {
+      const items: unknown[] = [];
+      readBlocks(reader, () => items.push(read(type.items, reader)));
+      return items;
+    }
+    case "map": {
+      const values: { [key: string]: unknown } = {};
+      readBlocks(reader, () => {
+        const key = reader.take(reader.long()).toString("utf8");
+        values[key] = read(type.values, reader);
+      });
+      return values;
+    }
+    case "union": {
+      const branch = type.branches[reader.long()];
+      if (typeof branch === "undefined") {
+        throw new Error("invalid branch index for Avro union");
+      }
+      return read(branch, reader);
+    }
+  }
+};
+
+/**
+ * Read the blocks of an array or map, which are preceded by their
+ * item count (and their size in bytes, if the count is negative).
+ *
+ * @param reader The cursor over the data.
+ * @param item A procedure that reads a single item.
+ */
+const readBlocks = (reader: AvroReader, item: () => void): void => {
+  for (let count = reader.long(); count !== 0; count = reader.long()) {
+    if (count < 0) {
+      count = -count;
+      reader.long();
+    }
+    for (let i = 0; i < count; i++) {
+      item();
+    }
+  }
+};
+
+/**
+ * Decode Avro binary data. Bytes and fixed values are given as base64
+ * strings, and union values aren't wrapped.
+ *
+ * @param type The type of the encoded value.
+ * @param data The encoded value.
+ * @returns The decoded value.
+ */
+export const decodeAvro = (type: AvroType, data: Buffer): unknown => {
+  const reader = new AvroReader(data);
+  const value = read(type, reader);
+  if (reader.position !== data.length) {
+    throw new Error("trailing bytes after Avro data");
+  }
+  return value;
+};
+
+/**
+ * Check whether a value may be encoded with the given type. Missing
+ * record fields are accepted if they have a default value.
+ *
+ * @param type The type to check against.
+ * @param value The value to check.
+ * @returns Whether the value matches the type.
+ */
+const matches = (type: AvroType, value: unknown): boolean => {
+  switch (type.type) {
+    case "null":
+      return value === null;
+    case "boolean":
+      return typeof value === "boolean";
+    case "int":
+      return (
+        Number.isInteger(value) &&
+        (value as number) >= -0x80000000 &&
+        (value as number) <= 0x7fffffff
+      );
+    case "long":
+      return Number.isInteger(value);
+    case "float":
+    case "double":
+      return typeof value === "number";
+    case "bytes":
+    case "string":
+      return typeof value === "string";
+    case "record":
+      return (
+        isObject(value) &&
+        type.fields.every((field) =>
+          typeof value[field.name] === "undefined"
+            ? "default" in field
+            : matches(field.type, value[field.name])
+        )
+      );
+    case "enum":
+      return typeof value === "string" && type.symbols.includes(value);
+    case "fixed":
+      return (
+        typeof value === "string" &&
+        Buffer.from(value, "base64").length === type.size
+      );
+    case "array":
+      return (
+        Array.isArray(value) && value.every((item) => matches(type.items, item))
+      );
+    case "map":
+      return (
+        isObject(value) &&
+        Object.values(value).every((item) => matches(type.values, item))
+      );
+    case "union":
+      return type.branches.some((branch) => matches(branch, value));
+  }
+};
+
+/**
+ * Check whether a value is a plain object.
+ *
+ * @param value The value to check.
+ * @returns Whether it's an object.
+ */
+const isObject = (value: unknown): value is { [key: string]: unknown } =>
+  typeof value === "object" && value !== null && !Array.isArray(value);
+
+/**
+ * Encode a long as a zig-zag variable-length integer.
+ *
+ * @param value The integer.
+ * @param chunks The encoded chunks.
+ */
+const writeLong = (value: number, chunks: Buffer[]): void => {
+  let n = value >= 0 ? value * 2 : -value * 2 - 1;
+  const bytes: number[] = [];
+  while (n >= 0x80) {
+    bytes.push((n % 0x80) | 0x80);
+    n = Math.floor(n / 0x80);
+  }
+  bytes.push(n);
+  chunks.push(Buffer.from(bytes));
+};
+
+/**
+ * Encode a length-prefixed sequence of bytes.
+ *
+ * @param bytes The bytes.
+ * @param chunks The encoded chunks.
+ */
+const writeBytes = (bytes: Buffer, chunks: Buffer[]): void => {
+  writeLong(bytes.length, chunks);
+  chunks.push(bytes);
+};
+
+/**
+ * Write a value of the given type, which must match it.
+ *
+ * @param type The type of the value.
+ * @param value The value.
+ * @param chunks The encoded chunks.
+ * @param path The path to the value, used for error messages.
+ */
+const write = (
+  type: AvroType,
+  value: unknown,
+  chunks: Buffer[],
+  path: string
+): void => {
+  // Records, arrays and maps only check their own shape here, so that
+  // errors point to the nested value that doesn't match.
+  const shapeMatches =
+    type.type === "record" || type.type === "map"
+      ? isObject(value)
+      : type.type === "array"
+      ? Array.isArray(value)
+      : matches(type, value);
+  if (!shapeMatches) {
+    throw new Error(
+      `the value at ${path} doesn't match the Avro type ` +
+        ("name" in type ? type.name : type.type)
+    );
+  }
+  switch (type.type) {
+    case "null":
+      return;
+    case "boolean":
+      chunks.push(Buffer.from([value ? 1 : 0]));
+      return;
+    case "int":
+    case "long":
+      writeLong(value as number, chunks);
+      return;
+    case "float": {
+      const bytes = Buffer.alloc(4);
+      bytes.writeFloatLE(value as number, 0);
+      chunks.push(bytes);
+      return;
+    }
+    case "double": {
+      const bytes = Buffer.alloc(8);
+      bytes.writeDoubleLE(value as number, 0);
+      chunks.push(bytes);
+      return;
+    }
+    case "bytes":
+      writeBytes(Buffer.from(value as string, "base64"), chunks);
+      return;
+    case "string":
+      writeBytes(Buffer.from(value as string, "utf8"), chunks);
+      return;
+    case "record":
+      for (const field of type.fields) {
+        const fieldValue = (value as { [key: string]: unknown })[field.name];
+        write(
+          field.type,
+          typeof fieldValue === "undefined" ? field.default : fieldValue,
+          chunks,
+          `${path}.${field.name}`
+        );
+      }
+      return;
+    case "enum":
+      writeLong(type.symbols.indexOf(value as string), chunks);
+      return;
+    case "fixed":
+      chunks.push(Buffer.from(value as string, "base64"));
+      return;
+    case "array": {
+      const items = value as unknown[];
+      if (items.length > 0) {
+        writeLong(items.length, chunks);
+        items.forEach((item, index) =>
+          write(type.items, item, chunks, `${path}[${index}]`)
+        );
+      }
+      writeLong(0, chunks);
+      return;
+    }
+    case "map": {
+      const entries = Object.entries(value as { [key: string]: unknown });
+      if (entries.length > 0) {
+        writeLong(entries.length, chunks);
+        for (const [key, item] of entries) {
+          writeBytes(Buffer.from(key, "utf8"), chunks);
+          write(type.values, item, chunks, `${path}.${key}`);
+        }
+      }
+      writeLong(0, chunks);
+      return;
+    }
+    case "union": {
+      // Values are written with the first branch they match.
+      const index = type.branches.findIndex((branch) =>
+        matches(branch, value)
+      );
+      writeLong(index, chunks);
+      write(type.branches[index], value, chunks, path);
+      return;
+    }
+  }
+};
+
+/**
+ * Encode a value as Avro binary data. Bytes and fixed values must be
+ * given as base64 strings, and union values are written with the
+ * first branch they match.
+ *
+ * @param type The type to encode the value with.
+ * @param value The value to encode.
+ * @returns The encoded value.
+ */
+export const encodeAvro = (type: AvroType, value: unknown): Buffer => {
+  const chunks: Buffer[] = [];
+  write(type, value, chunks, "$");
+  return Buffer.concat(chunks);
+};
+
+/**
+ * The first byte of data framed for the Confluent Schema Registry.
+ */
+const MAGIC_BYTE = 0;
+
+/**
+ * Split data framed for the Confluent Schema Registry, which starts
+ * with a magic byte and the schema's id as a 4-byte big-endian
+ * integer.
+ *
+ * @param data The framed data.
+ * @returns The schema's id and the encoded value.
+ */
+export const unframe = (data: Buffer): [number, Buffer] => {
+  if (data.length < 5 || data[0] !== MAGIC_BYTE) {
+    throw new Error("the data isn't framed for a schema registry");
+  }
+  return [data.readUInt32BE(1), data.subarray(5)];
+};
+
+/**
+ * Frame encoded data for the Confluent Schema Registry.
+ *
+ * @param id The schema's id.
+ * @param payload The encoded value.
+ * @returns The framed data.
+ */
+export const frame = (id: number, payload: Buffer): Buffer => {
+  const header = Buffer.alloc(5);
+  header[0] = MAGIC_BYTE;
+  header.writeUInt32BE(id, 1);
+  return Buffer.concat([header, payload]);
+};
@@ -0,0 +1,139 @@
+import { INPUT_MAX_DEPTH, JSON_NUMBERS } from "../conf";
+import { ExactNumber } from "../exact-number";
+import { inputRejectedValues } from "../metrics";
+import { InputLimitError } from "./limits";
+
+/**
+ * The smallest and greatest integers held by 64 bits, signed and
+ * unsigned respectively.
+ */
+const INT64_MIN = -(BigInt(2) ** BigInt(63));
+const UINT64_MAX = BigInt(2) ** BigInt(64) - BigInt(1);
+
+/**
+ * An integer literal.
+ */
+const INTEGER = /^-?(0|[1-9][0-9]*)$/;
+
+/**
+ * A value about to be encoded, as JSON.stringify would see it: the
+ * result of its toJSON method if it has one, and undefined for
+ * values JSON can't represent. ExactNumber instances are kept as
+ * they are.
+ *
+ * @param value The value to encode.
+ * @returns The value to encode in its place.
+ */
+export const encodable = (value: unknown): unknown => {
+  if (value instanceof ExactNumber) {
+    return value;
+  }
+  if (
+    typeof value === "object" &&
+    value !== null &&
+    typeof (value as { toJSON?: unknown }).toJSON === "function"
+  ) {
+    return (value as { toJSON: () => unknown }).toJSON();
+  }
+  if (
+    typeof value === "function" ||
+    typeof value === "symbol" ||
+    typeof value === "undefined"
+  ) {
+    return undefined;
+  }
+  return value;
+};
+
+/**
+ * The integer held by an exact number, if it's an integer that fits
+ * in 64 bits.
+ *
+ * @param value The exact number.
+ * @returns The integer, or null if it isn't one or doesn't fit.
+ */
+export const exactInteger = (value: ExactNumber): bigint | null => {
+  if (!INTEGER.test(value.source)) {
+    return null;
+  }
+  const integer = BigInt(value.source);
+  return integer >= INT64_MIN && integer <= UINT64_MAX ? integer : null;
+};
+
+/**
+ * The value given to a decoded integer: an ExactNumber instance if
+ * exact numbers are enabled and the closest javascript number would
+ * be written with other digits, or the closest number otherwise.
+ *
+ * @param integer The decoded integer.
+ * @returns The value of the integer.
+ */
+export const decodedInteger = (integer: bigint): number | ExactNumber => {
+  const value = Number(integer);
+  return JSON_NUMBERS === "exact" && String(value) !== integer.toString()
+    ? new ExactNumber(integer.toString())
+    : value;
+};
+
+/**
+ * Check that the nesting depth of a value being decoded is within the
+ * limit of input values.
+ *
+ * @param depth The depth of the value being decoded.
+ */
+export const checkDecodedDepth = (depth: number): void => {
+  if (depth > INPUT_MAX_DEPTH) {
+    inputRejectedValues.inc({ reason: "depth" });
+    throw new InputLimitError(
+      `the value's nesting depth exceeds the limit of ${INPUT_MAX_DEPTH}`
+    );
+  }
+};
+
+/**
+ * The key given to a decoded map key, since object keys are strings.
+ *
+ * @param key The decoded key.
+ * @returns The key as a string.
+ */
+export const decodedKey = (key: unknown): string => {
+  if (typeof key === "string") {
+    return key;
+  }
+  if (typeof key === "number" || key instanceof ExactNumber) {
+    return key.toString();
+  }
+  throw new Error("map keys must be strings or numbers");
+};
+
+/**
+ * A cursor over a buffer being decoded, extended by the decoder of
+ * each format.
+ */
+export class Reader {
+  /**
+   * The position of the next byte to read.
+   */
+  position = 0;
+
+  /**
+   * @param buffer The buffer being decoded.
+   * @param format The name of the format, used in error messages.
+   */
+  constructor(readonly buffer: Buffer, readonly format: string) {}
+
+  /**
+   * Read the given amount of bytes.
+   *
+   * @param length The amount of bytes to read.
+   * @returns The bytes read.
+   */
+  take(length: number): Buffer {
+    if (length < 0 || this.position + length > this.buffer.length) {
+      throw new Error(`truncated ${this.format} data`);
+    }
+    const bytes = this.buffer.subarray(this.position, this.position + length);
+    this.position += length;
+    return bytes;
+  }
+}
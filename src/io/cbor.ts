@@ -0,0 +1,368 @@
+import { ExactNumber } from "../exact-number";
+import {
+  checkDecodedDepth,
+  decodedInteger,
+  decodedKey,
+  encodable,
+  exactInteger,
+  Reader,
+} from "./binary";
+
+/**
+ * The major types of CBOR data items.
+ */
+const UNSIGNED = 0;
+const NEGATIVE = 1;
+const BYTES = 2;
+const TEXT = 3;
+const ARRAY = 4;
+const MAP = 5;
+const TAG = 6;
+const SIMPLE = 7;
+
+/**
+ * The additional information of items of indefinite length, and the
+ * byte that ends them.
+ */
+const INDEFINITE = 31;
+const BREAK = 0xff;
+
+/**
+ * Write the head of a data item, choosing the smallest form that
+ * holds its argument.
+ *
+ * @param major The major type of the item.
+ * @param argument The argument of the item, which must fit in 64
+ * bits.
+ * @param chunks The encoded chunks.
+ */
+const writeHead = (
+  major: number,
+  argument: bigint,
+  chunks: Buffer[]
+): void => {
+  const n = Number(argument);
+  const type = major << 5;
+  if (n < 24) {
+    chunks.push(Buffer.from([type | n]));
+  } else if (n <= 0xffffffff) {
+    const size = n <= 0xff ? 1 : n <= 0xffff ? 2 : 4;
+    const bytes = Buffer.alloc(1 + size);
+    bytes[0] = type | (size === 1 ? 24 : size === 2 ? 25 : 26);
+    bytes.writeUIntBE(n, 1, size);
+    chunks.push(bytes);
+  } else {
+    const bytes = Buffer.alloc(9);
+    bytes[0] = type | 27;
+    bytes.writeBigUInt64BE(argument, 1);
+    chunks.push(bytes);
+  }
+};
+
+/**
+ * Write an integer.
+ *
+ * @param value The integer, which must fit in 64 bits.
+ * @param chunks The encoded chunks.
+ */
+const writeInteger = (value: bigint, chunks: Buffer[]): void => {
+  if (value >= BigInt(0)) {
+    writeHead(UNSIGNED, value, chunks);
+  } else {
+    writeHead(NEGATIVE, -BigInt(1) - value, chunks);
+  }
+};
+
+/**
+ * Write a double precision float.
+ *
+ * @param value The number.
+ * @param chunks The encoded chunks.
+ */
+const writeFloat = (value: number, chunks: Buffer[]): void => {
+  const bytes = Buffer.alloc(9);
+  bytes[0] = (SIMPLE << 5) | 27;
+  bytes.writeDoubleBE(value, 1);
+  chunks.push(bytes);
+};
+
+/**
+ * Write a value, already prepared for encoding.
+ *
+ * @param value The value.
+ * @param chunks The encoded chunks.
+ */
+const write = (value: unknown, chunks: Buffer[]): void => {
+  if (value === null || typeof value === "undefined") {
+    chunks.push(Buffer.from([0xf6]));
+  } else if (typeof value === "boolean") {
+    chunks.push(Buffer.from([value ? 0xf5 : 0xf4]));
+  } else if (value instanceof ExactNumber) {
+    const integer = exactInteger(value);
+    if (integer === null) {
+      writeFloat(value.valueOf(), chunks);
+    } else {
+      writeInteger(integer, chunks);
+    }
+  } else if (typeof value === "number") {
+    if (Number.isSafeInteger(value)) {
+      writeInteger(BigInt(value), chunks);
+    } else if (Number.isFinite(value)) {
+      writeFloat(value, chunks);
+    } else {
+      // Like JSON, non-finite numbers are written as null.
+      chunks.push(Buffer.from([0xf6]));
+    }
+  } else if (typeof value === "string") {
+    const bytes = Buffer.from(value, "utf8");
+    writeHead(TEXT, BigInt(bytes.length), chunks);
+    chunks.push(bytes);
+  } else if (Array.isArray(value)) {
+    writeHead(ARRAY, BigInt(value.length), chunks);
+    value.forEach((item) => write(encodable(item), chunks));
+  } else {
+    const entries = Object.entries(value as object)
+      .map(([key, item]): [string, unknown] => [key, encodable(item)])
+      .filter(([, item]) => typeof item !== "undefined");
+    writeHead(MAP, BigInt(entries.length), chunks);
+    entries.forEach(([key, item]) => {
+      write(key, chunks);
+      write(item, chunks);
+    });
+  }
+};
+
+/**
+ * Encode a value as CBOR, the way it would be encoded as JSON.
+ * Integers held by ExactNumber instances keep all of their 64 bits.
+ *
+ * @param value The value to encode.
+ * @returns The encoded value.
+ */
+export const encode = (value: unknown): Buffer => {
+  const chunks: Buffer[] = [];
+  write(encodable(value), chunks);
+  return Buffer.concat(chunks);
+};
+
+/**
+ * Decode a half precision float.
+ *
+ * @param half The 16 bits of the float.
+ * @returns The number.
+ */
+const decodeHalf = (half: number): number => {
+  const exponent = (half >> 10) & 0x1f;
+  const mantissa = half & 0x3ff;
+  const magnitude =
+    exponent === 0
+      ? mantissa * 2 ** -24
+      : exponent === 0x1f
+      ? mantissa === 0
+        ? Infinity
+        : NaN
+      : (mantissa + 0x400) * 2 ** (exponent - 25);
+  return half & 0x8000 ? -magnitude : magnitude;
+};
+
+/**
+ * A cursor over a buffer being decoded.
+ */
+class CBORReader extends Reader {
+  constructor(buffer: Buffer) {
+    super(buffer, "CBOR");
+  }
+
+  /**
+   * Check whether the next byte ends an item of indefinite length,
+   * consuming it if it does.
+   *
+   * @returns Whether the item ended.
+   */
+  ended(): boolean {
+    if (this.take(1)[0] === BREAK) {
+      return true;
+    }
+    this.position--;
+    return false;
+  }
+
+  /**
+   * Read the argument of a data item.
+   *
+   * @param info The additional information of the item.
+   * @returns The argument, as a bigint only if it needs 64 bits.
+   */
+  argument(info: number): number | bigint {
+    if (info < 24) {
+      return info;
+    }
+    switch (info) {
+      case 24:
+        return this.take(1)[0];
+      case 25:
+        return this.take(2).readUInt16BE(0);
+      case 26:
+        return this.take(4).readUInt32BE(0);
+      case 27:
+        return this.take(8).readBigUInt64BE(0);
+      default:
+        throw new Error(`invalid CBOR additional information ${info}`);
+    }
+  }
+
+  /**
+   * Read the bytes of a byte or text string, which may be split in
+   * chunks if its length is indefinite.
+   *
+   * @param major The major type of the string.
+   * @param info The additional information of the string.
+   * @returns The bytes of the string.
+   */
+  string(major: number, info: number): Buffer {
+    if (info !== INDEFINITE) {
+      return this.take(Number(this.argument(info)));
+    }
+    const chunks: Buffer[] = [];
+    while (!this.ended()) {
+      const head = this.take(1)[0];
+      if (head >> 5 !== major || (head & 0x1f) === INDEFINITE) {
+        throw new Error("invalid chunk in CBOR string");
+      }
+      chunks.push(this.take(Number(this.argument(head & 0x1f))));
+    }
+    return Buffer.concat(chunks);
+  }
+
+  /**
+   * Read a data item, nested at the given depth.
+   *
+   * @param depth The nesting depth of the item.
+   * @returns The value read.
+   */
+  value(depth: number): unknown {
+    const head = this.take(1)[0];
+    const major = head >> 5;
+    const info = head & 0x1f;
+    switch (major) {
+      case UNSIGNED: {
+        const argument = this.argument(info);
+        return typeof argument === "bigint"
+          ? decodedInteger(argument)
+          : argument;
+      }
+      case NEGATIVE: {
+        const argument = this.argument(info);
+        return typeof argument === "bigint"
+          ? decodedInteger(-BigInt(1) - argument)
+          : -1 - argument;
+      }
+      case BYTES:
+        // Binary data is given as base64, like other binary values
+        // held in events.
+        return this.string(major, info).toString("base64");
+      case TEXT:
+        return this.string(major, info).toString("utf8");
+      case ARRAY: {
+        checkDecodedDepth(depth + 1);
+        const items: unknown[] = [];
+        const length =
+          info === INDEFINITE ? Infinity : Number(this.argument(info));
+        while (
+          items.length < length &&
+          !(length === Infinity && this.ended())
+        ) {
+          items.push(this.value(depth + 1));
+        }
+        return items;
+      }
+      case MAP: {
+        checkDecodedDepth(depth + 1);
+        const entries: [string, unknown][] = [];
+        const length =
+          info === INDEFINITE ? Infinity : Number(this.argument(info));
+        while (
+          entries.length < length &&
+          !(length === Infinity && this.ended())
+        ) {
+          const key = decodedKey(this.value(depth + 1));
+          entries.push([key, this.value(depth + 1)]);
+        }
+        // Object.fromEntries defines own properties, so keys such as
+        // `__proto__` are kept as regular keys.
+        return Object.fromEntries(entries);
+      }
+      case TAG:
+        return this.tagged(this.argument(info), depth);
+      default:
+        return this.simple(info);
+    }
+  }
+
+  /**
+   * Read the content of a tagged data item. Bignums become integers,
+   * and the tags of other items are ignored.
+   *
+   * @param tag The item's tag.
+   * @param depth The nesting depth of the item.
+   * @returns The value read.
+   */
+  tagged(tag: number | bigint, depth: number): unknown {
+    if (tag !== 2 && tag !== 3) {
+      return this.value(depth);
+    }
+    const head = this.take(1)[0];
+    if (head >> 5 !== BYTES) {
+      throw new Error("invalid CBOR bignum");
+    }
+    const bytes = this.string(BYTES, head & 0x1f);
+    const magnitude =
+      bytes.length === 0 ? BigInt(0) : BigInt(`0x${bytes.toString("hex")}`);
+    return decodedInteger(tag === 2 ? magnitude : -BigInt(1) - magnitude);
+  }
+
+  /**
+   * Read a simple value or a float.
+   *
+   * @param info The additional information of the item.
+   * @returns The value read.
+   */
+  simple(info: number): unknown {
+    switch (info) {
+      case 20:
+        return false;
+      case 21:
+        return true;
+      case 22:
+      case 23:
+        // Undefined has no JSON counterpart, and is read as null.
+        return null;
+      case 25:
+        return decodeHalf(this.take(2).readUInt16BE(0));
+      case 26:
+        return this.take(4).readFloatBE(0);
+      case 27:
+        return this.take(8).readDoubleBE(0);
+      case INDEFINITE:
+        throw new Error("unexpected CBOR break");
+      default:
+        throw new Error(`unsupported CBOR simple value ${info}`);
+    }
+  }
+}
+
+/**
+ * Decode a sequence of CBOR data items, found one after the other in
+ * the given data.
+ *
+ * @param data The encoded items.
+ * @returns The decoded values.
+ */
+export const decode = (data: Buffer): unknown[] => {
+  const reader = new CBORReader(data);
+  const values: unknown[] = [];
+  while (reader.position < data.length) {
+    values.push(reader.value(0));
+  }
+  return values;
+};
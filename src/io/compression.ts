@@ -0,0 +1,112 @@
+import { promisify } from "util";
+import { gzip, gunzip } from "zlib";
+import { Zstd, ZstdCodec } from "zstd-codec";
+
+/**
+ * The compression algorithms supported.
+ */
+export type CompressionAlgorithm = "gzip" | "zstd";
+
+/**
+ * The magic numbers at the start of compressed data, used to detect
+ * the algorithm that compressed it.
+ */
+const GZIP_MAGIC = Buffer.from([0x1f, 0x8b]);
+const ZSTD_MAGIC = Buffer.from([0x28, 0xb5, 0x2f, 0xfd]);
+
+/**
+ * Promisified versions of the gzip procedures.
+ */
+const gzipAsync = promisify(gzip);
+const gunzipAsync = promisify(gunzip);
+
+/**
+ * The zstd codec, which is loaded the first time it's needed.
+ */
+let zstdCodec: Promise<Zstd> | null = null;
+
+/**
+ * Get the zstd codec, loading it if needed.
+ *
+ * @returns A promise yielding the codec.
+ */
+const getZstd = (): Promise<Zstd> => {
+  if (zstdCodec === null) {
+    zstdCodec = new Promise((resolve) => ZstdCodec.run(resolve));
+  }
+  return zstdCodec;
+};
+
+/**
+ * Detect the algorithm that compressed the given data, by its magic
+ * number.
+ *
+ * @param data The compressed data.
+ * @returns The algorithm, or null if it couldn't be detected.
+ */
+export const detectAlgorithm = (data: Buffer): CompressionAlgorithm | null =>
+  data.subarray(0, GZIP_MAGIC.length).equals(GZIP_MAGIC)
+    ? "gzip"
+    : data.subarray(0, ZSTD_MAGIC.length).equals(ZSTD_MAGIC)
+    ? "zstd"
+    : null;
+
+/**
+ * Compress the given data.
+ *
+ * @param data The data to compress.
+ * @param algorithm The compression algorithm to use.
+ * @param level The compression level, or undefined to use the
+ * algorithm's default.
+ * @returns A promise yielding the compressed data.
+ */
+export const compress = async (
+  data: Buffer,
+  algorithm: CompressionAlgorithm,
+  level?: number
+): Promise<Buffer> => {
+  if (algorithm === "gzip") {
+    return gzipAsync(data, typeof level === "undefined" ? {} : { level });
+  }
+  const zstd = await getZstd();
+  const compressed = new zstd.Simple().compress(data, level);
+  if (compressed === null) {
+    throw new Error("zstd compression failed");
+  }
+  return Buffer.from(compressed);
+};
+
+/**
+ * Decompress the given data.
+ *
+ * @param data The data to decompress.
+ * @param algorithm The algorithm that compressed the data, or "auto"
+ * to detect it.
+ * @returns A promise yielding the decompressed data, which rejects if
+ * the data is corrupt.
+ */
+export const decompress = async (
+  data: Buffer,
+  algorithm: CompressionAlgorithm | "auto"
+): Promise<Buffer> => {
+  const detected = algorithm === "auto" ? detectAlgorithm(data) : algorithm;
+  if (detected === null) {
+    throw new Error("the compression algorithm couldn't be detected");
+  }
+  if (detected === "gzip") {
+    return gunzipAsync(data);
+  }
+  const zstd = await getZstd();
+  // The streaming decompressor handles frames that don't declare
+  // their decompressed size.
+  let decompressed: Uint8Array | null = null;
+  try {
+    decompressed = new zstd.Streaming().decompress(data);
+  } catch (err) {
+    throw new Error(`zstd decompression failed: ${err}`);
+  }
+  if (decompressed === null) {
+    throw new Error("zstd decompression failed");
+  }
+  return Buffer.from(decompressed);
+};
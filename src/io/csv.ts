@@ -0,0 +1,200 @@
+import { Readable } from "stream";
+import { StringDecoder } from "string_decoder";
+import { AsyncQueue } from "../async-queue";
+import { makeLogger } from "../log";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("io/csv");
+
+/**
+ * The states of the CSV parser, which reads one character at a time.
+ */
+type ParserState =
+  | "field-start"
+  | "unquoted"
+  | "quoted"
+  | "quote-in-quoted";
+
+/**
+ * An incremental CSV parser, following RFC 4180. Records may span
+ * several chunks of input, and quoted fields may hold delimiters,
+ * line breaks and escaped (doubled) quotes. Both CRLF and LF line
+ * breaks are accepted, and empty lines are skipped. Malformed quoting
+ * is tolerated rather than rejected.
+ */
+export class CSVParser {
+  private state: ParserState = "field-start";
+  private field = "";
+  private record: string[] = [];
+  private recordStarted = false;
+  private afterCR = false;
+
+  constructor(readonly delimiter: string = ",") {}
+
+  /**
+   * Parse a chunk of text.
+   *
+   * @param text The chunk to parse.
+   * @returns The records completed by the chunk.
+   */
+  feed(text: string): string[][] {
+    const records: string[][] = [];
+    for (const c of text) {
+      if (this.afterCR) {
+        this.afterCR = false;
+        if (c === "\n") {
+          continue;
+        }
+      }
+      switch (this.state) {
+        case "quoted":
+          if (c === '"') {
+            this.state = "quote-in-quoted";
+          } else {
+            this.field += c;
+          }
+          break;
+        case "quote-in-quoted":
+          if (c === '"') {
+            this.field += c;
+            this.state = "quoted";
+          } else {
+            this.readUnquoted(c, records);
+          }
+          break;
+        case "field-start":
+          if (c === '"') {
+            this.recordStarted = true;
+            this.state = "quoted";
+          } else {
+            this.readUnquoted(c, records);
+          }
+          break;
+        case "unquoted":
+          this.readUnquoted(c, records);
+          break;
+      }
+    }
+    return records;
+  }
+
+  /**
+   * Parse the last chunk of text, after which the input ends.
+   *
+   * @param text The chunk to parse.
+   * @returns The records completed by the chunk, including the last
+   * one, even if it lacks a line break.
+   */
+  end(text = ""): string[][] {
+    const records = this.feed(text);
+    if (this.state === "quoted") {
+      logger.warn("CSV input ended within a quoted field");
+    }
+    this.endRecord(records);
+    return records;
+  }
+
+  /**
+   * Handle a character outside of quotes.
+   *
+   * @param c The character.
+   * @param records The records completed so far.
+   */
+  private readUnquoted(c: string, records: string[][]): void {
+    if (c === this.delimiter) {
+      this.record.push(this.field);
+      this.field = "";
+      this.recordStarted = true;
+      this.state = "field-start";
+    } else if (c === "\r" || c === "\n") {
+      this.afterCR = c === "\r";
+      this.endRecord(records);
+    } else {
+      this.field += c;
+      this.recordStarted = true;
+      this.state = "unquoted";
+    }
+  }
+
+  /**
+   * Complete the current record, unless it's an empty line.
+   *
+   * @param records The records completed so far.
+   */
+  private endRecord(records: string[][]): void {
+    if (this.recordStarted) {
+      this.record.push(this.field);
+      records.push(this.record);
+    }
+    this.field = "";
+    this.record = [];
+    this.recordStarted = false;
+    this.state = "field-start";
+  }
+}
+
+/**
+ * Parse a readable stream as CSV records. It will produce results
+ * until the stream ends or is closed.
+ *
+ * @param stream The stream to read data from.
+ * @param delimiter The character that separates fields.
+ * @returns An async iterator of records, as lists of fields.
+ */
+export const parseCSV = (
+  stream: Readable,
+  delimiter = ","
+): AsyncGenerator<string[]> => {
+  const parser = new CSVParser(delimiter);
+  const decoder = new StringDecoder("utf8");
+  const queue = new AsyncQueue<string[]>("io.csv");
+  let done = false;
+  const finish = () => {
+    if (!done) {
+      done = true;
+      parser.end(decoder.end()).forEach((record) => queue.push(record));
+      queue.close();
+    }
+  };
+  stream.on("data", (data) => {
+    if (done) {
+      return;
+    }
+    parser
+      .feed(decoder.write(Buffer.isBuffer(data) ? data : Buffer.from(data)))
+      .forEach((record) => queue.push(record));
+  });
+  stream.on("end", finish);
+  stream.on("close", finish);
+  stream.on("error", (err) => {
+    logger.warn(`CSV stream reported error: ${err}`);
+    finish();
+  });
+  return queue.iterator();
+};
+
+/**
+ * Format a single CSV field, quoting it if it holds the delimiter,
+ * quotes or line breaks.
+ *
+ * @param field The field's value.
+ * @param delimiter The character that separates fields.
+ * @returns The formatted field.
+ */
+const formatField = (field: string, delimiter: string): string =>
+  field.includes(delimiter) || /["\r\n]/.test(field)
+    ? `"${field.replace(/"/g, '""')}"`
+    : field;
+
+/**
+ * Format a CSV record, following RFC 4180.
+ *
+ * @param fields The values of the record's fields.
+ * @param delimiter The character that separates fields.
+ * @returns The formatted record, ending with a CRLF line break.
+ */
+export const formatCSVRecord = (fields: string[], delimiter = ","): string =>
+  fields.map((field) => formatField(field, delimiter)).join(delimiter) +
+  "\r\n";
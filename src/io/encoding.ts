@@ -0,0 +1,89 @@
+import { encodeJson } from "../json";
+import * as cbor from "./cbor";
+import { checkSize } from "./limits";
+import * as msgpack from "./msgpack";
+
+/**
+ * The encodings of values sent to or received from external systems.
+ */
+export type Encoding = "json" | "msgpack" | "cbor";
+
+/**
+ * An ajv schema for the encoding option.
+ */
+export const encodingSchema = { enum: ["json", "msgpack", "cbor"] };
+
+/**
+ * The codecs of the binary encodings.
+ */
+const codecs = { msgpack, cbor };
+
+/**
+ * The media type of messages in a binary encoding.
+ *
+ * @param encoding The encoding of the messages.
+ * @param sequence Whether the messages may hold several values.
+ * @returns The media type.
+ */
+export const binaryContentType = (
+  encoding: Exclude<Encoding, "json">,
+  sequence = false
+): string =>
+  encoding === "msgpack"
+    ? "application/msgpack"
+    : sequence
+    ? "application/cbor-seq"
+    : "application/cbor";
+
+/**
+ * Encode a single value as a message. Strings are written as they
+ * are when using JSON, as with every output that accepts the results
+ * of jq or jsonnet expressions.
+ *
+ * @param value The value to encode.
+ * @param encoding The encoding to use.
+ * @returns The encoded message.
+ */
+export const encodeMessage = (
+  value: unknown,
+  encoding: Encoding
+): string | Buffer =>
+  encoding === "json"
+    ? typeof value === "string"
+      ? value
+      : encodeJson(value)
+    : codecs[encoding].encode(value);
+
+/**
+ * Encode several values as a single message. JSON values are written
+ * one per line, and values in binary encodings are written one after
+ * the other.
+ *
+ * @param values The values to encode.
+ * @param encoding The encoding to use.
+ * @returns The encoded message.
+ */
+export const encodeMessages = (
+  values: unknown[],
+  encoding: Encoding
+): string | Buffer =>
+  encoding === "json"
+    ? values.map((value) => encodeJson(value)).join("\n") + "\n"
+    : Buffer.concat(values.map((value) => codecs[encoding].encode(value)));
+
+/**
+ * Decode the values held by a message in a binary encoding, one after
+ * the other. Messages that exceed the limits of input values are
+ * rejected.
+ *
+ * @param data The message.
+ * @param encoding The encoding of the message.
+ * @returns The decoded values.
+ */
+export const decodeMessage = (
+  data: Buffer,
+  encoding: Exclude<Encoding, "json">
+): unknown[] => {
+  checkSize(data.length);
+  return codecs[encoding].decode(data);
+};
@@ -8,6 +8,7 @@ import {
   chooseParser,
   makeWrapper,
 } from "../event";
+import { decodeJson, encodeJson } from "../json";
 import { makeLogger } from "../log";
 import { resolveAfter, mergeHeaders } from "../utils";
 import { axiosInstance } from "./axios";
@@ -55,6 +56,35 @@ export const request = async (
   }
 };
 
+/**
+ * Delivers events to the specified HTTP target, and ignore the
+ * response contents.
+ *
+ * @param events The events to send away.
+ * @param target The fully qualified URI of the target.
+ * @param headers The headers to use with the request. Any
+ * content-type header will be overwritten with
+ * 'application/x-ndjson'.
+ * @returns A promise that resolves once the events are delivered, or
+ * rejects with an error.
+ */
+export const deliverEvents = async (
+  events: Event[],
+  target: string,
+  method: "POST" | "PUT" | "PATCH",
+  headers: { [key: string]: string | number | boolean }
+): Promise<void> => {
+  await request({
+    url: target,
+    method,
+    data: events,
+    transformRequest: [
+      (data: Event[]) => data.map((e) => encodeJson(e)).join("\n") + "\n",
+    ],
+    headers: mergeHeaders(headers, { "Content-Type": "application/x-ndjson" }),
+  });
+};
+
 /**
  * Sends events to the specified HTTP target, and ignore the response
  * contents. This is intended to be used as a 'fire and forget'
@@ -74,15 +104,7 @@ export const sendEvents = (
   method: "POST" | "PUT" | "PATCH",
   headers: { [key: string]: string | number | boolean }
 ): Promise<void> =>
-  request({
-    url: target,
-    method,
-    data: events,
-    transformRequest: [
-      (data: Event[]) => data.map((e) => JSON.stringify(e)).join("\n") + "\n",
-    ],
-    headers: mergeHeaders(headers, { "Content-Type": "application/x-ndjson" }),
-  }).then(
+  deliverEvents(events, target, method, headers).then(
     () =>
       logger.debug(
         "sendEvents successfully forwarded",
@@ -97,6 +119,33 @@ export const sendEvents = (
       )
   );
 
+/**
+ * Delivers a thing of unknown shape to the specified HTTP target, and
+ * ignore the response contents.
+ *
+ * @param thing The thing to send away.
+ * @param target The fully qualified URI of the target.
+ * @param headers The headers to use with the request.
+ * @returns A promise that resolves once the thing is delivered, or
+ * rejects with an error.
+ */
+export const deliverThing = async (
+  thing: unknown,
+  target: string,
+  method: "POST" | "PUT" | "PATCH",
+  headers: { [key: string]: string | number | boolean }
+): Promise<void> => {
+  await request({
+    url: target,
+    method,
+    data: thing,
+    transformRequest: [
+      (data) => (typeof data === "string" ? data : encodeJson(data)),
+    ],
+    headers: mergeHeaders(headers),
+  });
+};
+
 /**
  * Sends a thing of unknown shape to the specified HTTP target, and
  * ignore the response contents. This is intended to be used as a
@@ -114,15 +163,7 @@ export const sendThing = (
   method: "POST" | "PUT" | "PATCH",
   headers: { [key: string]: string | number | boolean }
 ): Promise<void> =>
-  request({
-    url: target,
-    method,
-    data: thing,
-    transformRequest: [
-      (data) => (typeof data === "string" ? data : JSON.stringify(data)),
-    ],
-    headers: mergeHeaders(headers),
-  }).then(
+  deliverThing(thing, target, method, headers).then(
     () => logger.debug("sendThing successfully forwarded its payload"),
     (err) => logger.warn(`sendThing couldn't forward its payload: ${err}`)
   );
@@ -143,6 +184,7 @@ export const sendThing = (
  * content-type header will be overwritten with
  * 'application/x-ndjson'.
  * @param wrap An optional wrapping directive for response data.
+ * @param signal An optional signal that aborts the request.
  * @returns A promise that resolves to the parsed events extracted
  * from the response, or an empty array if any error occurred.
  */
@@ -153,7 +195,8 @@ export const sendReceiveEvents = async (
   target: string,
   method: "POST" | "PUT" | "PATCH",
   headers: { [key: string]: string | number | boolean },
-  wrap?: WrapDirective
+  wrap?: WrapDirective,
+  signal?: AbortSignal
 ): Promise<Event[]> => {
   const oldEventParser = makeOldEventParser(pipelineName, pipelineSignature);
   const parse = chooseParser(wrap);
@@ -164,11 +207,12 @@ export const sendReceiveEvents = async (
       method,
       data: events,
       transformRequest: [
-        (data: Event[]) => data.map((e) => JSON.stringify(e)).join("\n") + "\n",
+        (data: Event[]) => data.map((e) => encodeJson(e)).join("\n") + "\n",
       ],
       headers: mergeHeaders(headers, {
         "Content-Type": "application/x-ndjson",
       }),
+      signal,
     });
     logger.debug(
       "sendReceiveEvents successfully forwarded",
@@ -215,6 +259,7 @@ export const sendReceiveEvents = async (
  * @param target The fully qualified URI of the target.
  * @param headers The headers to use with the request.
  * @param wrap An optional wrapping directive for response data.
+ * @param signal An optional signal that aborts the request.
  * @returns A promise that resolves to the parsed events extracted
  * from the response, or an empty array if any error occurred.
  */
@@ -225,7 +270,8 @@ export const sendReceiveThing = async (
   target: string,
   method: "POST" | "PUT" | "PATCH",
   headers: { [key: string]: string | number | boolean },
-  wrap?: WrapDirective
+  wrap?: WrapDirective,
+  signal?: AbortSignal
 ): Promise<Event[]> => {
   const oldEventParser = makeOldEventParser(pipelineName, pipelineSignature);
   const parse = chooseParser(wrap);
@@ -236,9 +282,10 @@ export const sendReceiveThing = async (
       method,
       data: thing,
       transformRequest: [
-        (data) => (typeof data === "string" ? data : JSON.stringify(data)),
+        (data) => (typeof data === "string" ? data : encodeJson(data)),
       ],
       headers: mergeHeaders(headers),
+      signal,
     });
     logger.debug("sendReceiveThing successfully forwarded its payload");
     const responseEvents = [];
@@ -262,3 +309,74 @@ export const sendReceiveThing = async (
     return [];
   }
 };
+
+/**
+ * Sends a request to the specified HTTP target, and interpret the
+ * response as a single JSON value. Unlike the other senders, this
+ * procedure rejects in case of errors, including responses with
+ * non-2xx status codes and responses that aren't JSON.
+ *
+ * @param target The fully qualified URI of the target.
+ * @param method The method to use for the request.
+ * @param headers The headers to use with the request.
+ * @param body An optional body to send, encoded as JSON.
+ * @param timeout An optional timeout for the request, in
+ * milliseconds.
+ * @returns A promise that resolves to the parsed response.
+ */
+export const fetchJSON = async (
+  target: string,
+  method: "GET" | "POST" | "PUT" | "PATCH",
+  headers: { [key: string]: string | number | boolean },
+  body?: unknown,
+  timeout?: number
+): Promise<unknown> => {
+  const response = await request({
+    url: target,
+    method,
+    ...(typeof body === "undefined"
+      ? {}
+      : {
+          data: body,
+          transformRequest: [(data: unknown) => encodeJson(data)],
+        }),
+    headers: mergeHeaders(
+      headers,
+      typeof body === "undefined" ? {} : { "Content-Type": "application/json" }
+    ),
+    ...(typeof timeout === "undefined" ? {} : { timeout }),
+  });
+  const chunks: Buffer[] = [];
+  for await (const chunk of response.data) {
+    chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
+  }
+  return decodeJson(Buffer.concat(chunks).toString("utf8"));
+};
+
+/**
+ * Check that an HTTP target is reachable, through a HEAD request that
+ * doesn't deliver anything. Any response counts as reachable, since
+ * targets may not support HEAD requests, except for server errors
+ * and responses that signal missing or invalid credentials.
+ *
+ * @param target The fully qualified URI of the target.
+ * @param headers The headers to use with the request.
+ * @param signal An optional signal that aborts the request.
+ * @returns A promise that resolves if the target is reachable, or
+ * rejects with an error.
+ */
+export const probeTarget = async (
+  target: string,
+  headers: { [key: string]: string | number | boolean },
+  signal?: AbortSignal
+): Promise<void> => {
+  const response = await axiosInstance.request({
+    url: target,
+    method: "HEAD",
+    headers: mergeHeaders(headers),
+    validateStatus: (status) =>
+      status < 500 && status !== 401 && status !== 403,
+    signal,
+  });
+  response.data?.destroy?.();
+};
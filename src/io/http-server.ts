@@ -27,11 +27,14 @@ interface HTTPServer {
  *
  * @param port The TCP port used to listen for requests.
  * @param handler The function to use when receiving requests.
+ * @param address The address to listen on. Defaults to the
+ * `HTTP_SERVER_LISTEN_ADDRESS` setting.
  * @returns An HTTP server instance.
  */
 export const makeHTTPServer = (
   port: number,
-  handler: (ctx: Koa.Context) => Promise<void>
+  handler: (ctx: Koa.Context) => Promise<void>,
+  address: string = HTTP_SERVER_LISTEN_ADDRESS
 ): HTTPServer => {
   const app = new Koa({ proxy: true });
   let notifyClosed: () => void;
@@ -40,22 +43,20 @@ export const makeHTTPServer = (
   });
   const server = app
     .use(handler)
-    .listen(
-      port,
-      HTTP_SERVER_LISTEN_ADDRESS,
-      HTTP_SERVER_LISTEN_BACKLOG,
-      () => {
-        logger.info(
-          "Started listening for requests at " +
-            `${HTTP_SERVER_LISTEN_ADDRESS}:${port}`
-        );
-      }
-    );
+    .listen(port, address, HTTP_SERVER_LISTEN_BACKLOG, () => {
+      logger.info(`Started listening for requests at ${address}:${port}`);
+    });
   return {
     app,
     server,
     close: async () => {
+      // In-flight requests are allowed to finish, but idle keep-alive
+      // connections would otherwise hold the server open. Closing
+      // them is only possible since node v18.2.
       server.close(() => notifyClosed());
+      (
+        server as Server & { closeIdleConnections?: () => void }
+      ).closeIdleConnections?.();
       await closed;
     },
     closed,
@@ -1,3 +1,4 @@
+import { spawnSync } from "child_process";
 import { Processor, ProcessorOptions } from "./json-processor";
 
 /**
@@ -22,3 +23,43 @@ export const processor = new Processor<JqOptions>("jq", (code, options) => [
   "--unbuffered",
   wrapJqCode(code, options?.prelude),
 ]);
+
+/**
+ * The outcome of each jq program checked so far: the compile errors
+ * reported by jq, or `null` if it compiled. Programs are checked only
+ * once.
+ */
+const checkedPrograms: Map<string, string | null> = new Map();
+
+/**
+ * Compile a jq expression without running it, so that its errors are
+ * found before any value reaches it. The expression is placed after
+ * `empty`, which makes jq compile it and exit without evaluating it.
+ *
+ * @param code The jq expression to check.
+ * @param prelude The jq prelude available to the expression.
+ * @throws Error with jq's compile errors, if any.
+ */
+export const checkProgram = (code: string, prelude?: string): void => {
+  const program = `${prelude ?? ""}\nempty | (\n${code}\n)`;
+  let errors = checkedPrograms.get(program);
+  if (typeof errors === "undefined") {
+    const path = processor.getPath();
+    if (path === null) {
+      throw new Error(
+        "jq executable couldn't be found; check your PATH variable"
+      );
+    }
+    const result = spawnSync(path, ["-n", program], { encoding: "utf-8" });
+    errors =
+      typeof result.error !== "undefined"
+        ? `${result.error}`
+        : result.status === 0
+        ? null
+        : result.stderr.trim() || `jq exited with status ${result.status}`;
+    checkedPrograms.set(program, errors);
+  }
+  if (errors !== null) {
+    throw new Error(errors);
+  }
+};
@@ -3,6 +3,7 @@ import { accessSync, constants, statSync } from "fs";
 import { Readable } from "stream";
 import { AsyncQueue, Channel } from "../async-queue";
 import { PATH } from "../conf";
+import { encodeJson } from "../json";
 import { makeFuse } from "../utils";
 import { parseJson } from "./read-stream";
 
@@ -155,6 +156,9 @@ export class Processor<Options extends ProcessorOptions = ProcessorOptions> {
       }
       notifyEnded();
     }
+    // The output may also end while results remain unread, as is the
+    // case for channels used to extract a value per vector.
+    child.stdout.once("close", () => notifyEnded());
     const receive = receiver();
     await precondition;
 
@@ -163,7 +167,7 @@ export class Processor<Options extends ProcessorOptions = ProcessorOptions> {
     ).asChannel();
     const feedEnded: Promise<void> = (async () => {
       for await (const value of bufferChannel.receive) {
-        const flushed = child.stdin.write(JSON.stringify(value) + "\n");
+        const flushed = child.stdin.write(encodeJson(value) + "\n");
         if (!flushed) {
           await closedIndependently.guard((resolve) =>
             child.stdin.once("drain", resolve)
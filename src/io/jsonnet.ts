@@ -1,3 +1,5 @@
+import { Jsonnet } from "@hanazuki/node-jsonnet";
+import { decodeJson, encodeJson } from "../json";
 import { Processor, ProcessorOptions } from "./json-processor";
 
 /**
@@ -25,3 +27,79 @@ export const processor = new Processor<JsonnetOptions>(
     assembleJsonnetCode(code, options?.prelude),
   ]
 );
+
+/**
+ * Options used to alter an in-process Jsonnet evaluator.
+ */
+interface JsonnetEvaluatorOptions {
+  prelude?: string;
+  stepName?: string;
+  size?: number;
+}
+
+/**
+ * Wraps a Jsonnet function so that it receives the `data` and `tag`
+ * top-level arguments, passing the tag only when the function
+ * declares a second parameter.
+ */
+const wrapJsonnetFunction = (code: string, prelude?: string): string =>
+  `function(data, tag) local f = (${assembleJsonnetCode(code, prelude)});\n` +
+  "if std.length(f) >= 2 then f(data, tag) else f(data)";
+
+/**
+ * Builds an evaluator that applies a Jsonnet function to values
+ * in-process, instead of through the stream-jsonnet subprocess. The
+ * code is checked once, and evaluations are spread over a pool of
+ * Jsonnet VMs, since a single VM can't evaluate concurrently.
+ *
+ * @param code The Jsonnet function code.
+ * @param options Options that alter the evaluator's behaviour.
+ * @returns A promise yielding a function that applies the Jsonnet
+ * function to a value and its tag.
+ */
+export const makeEvaluator = async (
+  code: string,
+  options?: JsonnetEvaluatorOptions
+): Promise<(data: unknown, tag: string) => Promise<unknown>> => {
+  const filename = options?.stepName ?? "<?>";
+  const idle: Jsonnet[] = Array.from(
+    { length: options?.size ?? 1 },
+    () => new Jsonnet()
+  );
+  const waiting: ((vm: Jsonnet) => void)[] = [];
+  const check = await idle[0].evaluateSnippet(
+    `std.isFunction(${assembleJsonnetCode(code, options?.prelude)})`,
+    filename
+  );
+  if (JSON.parse(check) !== true) {
+    throw new Error("the Jsonnet code is not a function");
+  }
+  const snippet = wrapJsonnetFunction(code, options?.prelude);
+  const acquire = (): Promise<Jsonnet> => {
+    const vm = idle.pop();
+    return typeof vm === "undefined"
+      ? new Promise((resolve) => waiting.push(resolve))
+      : Promise.resolve(vm);
+  };
+  const release = (vm: Jsonnet): void => {
+    const next = waiting.shift();
+    if (typeof next === "undefined") {
+      idle.push(vm);
+    } else {
+      next(vm);
+    }
+  };
+  return async (data: unknown, tag: string): Promise<unknown> => {
+    const vm = await acquire();
+    try {
+      return decodeJson(
+        await vm
+          .tlaCode("data", encodeJson(data) ?? "null")
+          .tlaString("tag", tag)
+          .evaluateSnippet(snippet, filename)
+      );
+    } finally {
+      release(vm);
+    }
+  };
+};
@@ -0,0 +1,98 @@
+import { INPUT_MAX_BYTES, INPUT_MAX_DEPTH } from "../conf";
+import { decodeJson } from "../json";
+import { inputRejectedValues } from "../metrics";
+
+/**
+ * The error thrown for values that exceed the limits of input forms.
+ */
+export class InputLimitError extends Error {
+  constructor(message: string) {
+    super(message);
+    this.name = "InputLimitError";
+  }
+}
+
+/**
+ * Byte values of the JSON characters that affect nesting.
+ */
+const QUOTE = 34;
+const BACKSLASH = 92;
+const OPENING = [91, 123];
+const CLOSING = [93, 125];
+
+/**
+ * Check that the size of a value received by an input form is within
+ * the limit.
+ *
+ * @param size The size of the value, in bytes.
+ * @param maxBytes The maximum size allowed.
+ */
+export const checkSize = (size: number, maxBytes = INPUT_MAX_BYTES): void => {
+  if (size > maxBytes) {
+    inputRejectedValues.inc({ reason: "size" });
+    throw new InputLimitError(
+      `the value's size of ${size} bytes exceeds the limit of ${maxBytes}`
+    );
+  }
+};
+
+/**
+ * Check that the nesting depth of a serialized JSON value is within
+ * the limit, by scanning it before it's parsed. The scan doesn't
+ * validate the value, so malformed values are left for the parser to
+ * reject.
+ *
+ * @param data The serialized JSON value.
+ * @param maxDepth The maximum nesting depth allowed.
+ */
+export const checkDepth = (
+  data: Buffer | string,
+  maxDepth = INPUT_MAX_DEPTH
+): void => {
+  // Every character that affects nesting is ASCII, so bytes and
+  // UTF-16 code units can be scanned alike.
+  const codeAt =
+    typeof data === "string"
+      ? (index: number) => data.charCodeAt(index)
+      : (index: number) => data[index];
+  let depth = 0;
+  let inString = false;
+  let escaped = false;
+  for (let index = 0; index < data.length; index++) {
+    const code = codeAt(index);
+    if (inString) {
+      if (escaped) {
+        escaped = false;
+      } else if (code === BACKSLASH) {
+        escaped = true;
+      } else if (code === QUOTE) {
+        inString = false;
+      }
+    } else if (code === QUOTE) {
+      inString = true;
+    } else if (OPENING.includes(code)) {
+      depth++;
+      if (depth > maxDepth) {
+        inputRejectedValues.inc({ reason: "depth" });
+        throw new InputLimitError(
+          `the value's nesting depth exceeds the limit of ${maxDepth}`
+        );
+      }
+    } else if (CLOSING.includes(code)) {
+      depth--;
+    }
+  }
+};
+
+/**
+ * Parse a serialized JSON value received by an input form, rejecting
+ * it before parsing if it exceeds the size or nesting depth limits.
+ *
+ * @param data The serialized JSON value.
+ * @returns The parsed value.
+ */
+export const parseLimitedJson = (data: Buffer | string): unknown => {
+  checkSize(typeof data === "string" ? Buffer.byteLength(data) : data.length);
+  checkDepth(data);
+  return decodeJson(data.toString());
+};
@@ -0,0 +1,59 @@
+import { spawnSync } from "child_process";
+import { Processor, ProcessorOptions } from "./json-processor";
+
+/**
+ * Options used to alter a Lua channel's behaviour.
+ */
+interface LuaOptions extends ProcessorOptions {
+  stepName?: string;
+  workers?: number;
+  timeLimit?: number;
+}
+
+/**
+ * The main access point for Lua interaction. Each value sent must be
+ * an object holding an event's name and data, and each one produces a
+ * single response: either the values returned by the script under
+ * `data`, or the error it raised under `error`.
+ */
+export const processor = new Processor<LuaOptions>(
+  "stream-lua",
+  (code, options) => [
+    "-workers",
+    `${options?.workers ?? 1}`,
+    "-timeout",
+    `${Math.ceil((options?.timeLimit ?? 1) * 1000)}ms`,
+    options?.stepName ?? "<?>",
+    code,
+  ]
+);
+
+/**
+ * Check the syntax of a Lua script without running it, so that its
+ * errors are found before any event reaches it.
+ *
+ * @param code The Lua script to check.
+ * @param stepName The name of the step the script belongs to, used in
+ * error messages.
+ * @throws Error with the syntax errors, if any.
+ */
+export const checkScript = (code: string, stepName?: string): void => {
+  const path = processor.getPath();
+  if (path === null) {
+    throw new Error(
+      "stream-lua executable couldn't be found; check your PATH variable"
+    );
+  }
+  const result = spawnSync(path, ["-check", stepName ?? "<?>", code], {
+    encoding: "utf-8",
+  });
+  if (typeof result.error !== "undefined") {
+    throw result.error;
+  }
+  if (result.status !== 0) {
+    throw new Error(
+      result.stderr.trim().replace(/^error: /, "") ||
+        `stream-lua exited with status ${result.status}`
+    );
+  }
+};
@@ -0,0 +1,313 @@
+import { isIP } from "net";
+import { decodedInteger } from "./binary";
+
+/**
+ * The marker that precedes the metadata section of a MaxMind DB file.
+ */
+const METADATA_MARKER = Buffer.from("abcdef4d61784d696e642e636f6d", "hex");
+
+/**
+ * The size of the separator placed between the search tree and the
+ * data section.
+ */
+const DATA_SECTION_SEPARATOR = 16;
+
+/**
+ * The first 12 bytes of IPv4-mapped IPv6 addresses.
+ */
+const IPV4_MAPPED_PREFIX = Buffer.from("00000000000000000000ffff", "hex");
+
+/**
+ * The data types of the MaxMind DB format, as numbered by the
+ * specification.
+ */
+const TYPE = {
+  POINTER: 1,
+  STRING: 2,
+  DOUBLE: 3,
+  BYTES: 4,
+  UINT16: 5,
+  UINT32: 6,
+  MAP: 7,
+  INT32: 8,
+  UINT64: 9,
+  UINT128: 10,
+  ARRAY: 11,
+  CONTAINER: 12,
+  END_MARKER: 13,
+  BOOLEAN: 14,
+  FLOAT: 15,
+};
+
+/**
+ * The metadata of a MaxMind DB file, as far as reading it goes.
+ */
+export type DatabaseMetadata = {
+  databaseType: string;
+  ipVersion: number;
+  nodeCount: number;
+  recordSize: number;
+};
+
+/**
+ * A read-only MaxMind DB database.
+ */
+export interface GeoDatabase {
+  /**
+   * The metadata of the database.
+   */
+  metadata: DatabaseMetadata;
+  /**
+   * Look up the record of the network holding an IP address.
+   *
+   * @param ip The IP address, in textual form.
+   * @returns The record, or null if the database holds none for the
+   * address. Throws an error if the address is invalid.
+   */
+  lookup(ip: string): unknown;
+}
+
+/**
+ * Parse an IP address into its bytes.
+ *
+ * @param ip The IP address, in textual form.
+ * @returns The 4 or 16 bytes of the address.
+ */
+export const parseIP = (ip: string): Buffer => {
+  const version = isIP(ip);
+  if (version === 4) {
+    return Buffer.from(ip.split(".").map((part) => parseInt(part, 10)));
+  }
+  if (version !== 6) {
+    throw new Error(`invalid IP address: ${JSON.stringify(ip)}`);
+  }
+  // Embedded IPv4 addresses are turned into their two groups, and
+  // zone indices are ignored.
+  const bare = ip.replace(/%.*$/, "");
+  const dotted = bare.match(/^(.*:)(\d+\.\d+\.\d+\.\d+)$/);
+  const normalized =
+    dotted === null
+      ? bare
+      : dotted[1] +
+        parseIP(dotted[2])
+          .toString("hex")
+          .replace(/^(.{4})/, "$1:");
+  const [head, tail] = normalized.split("::");
+  const groups = (part: string | undefined): string[] =>
+    typeof part === "undefined" || part === "" ? [] : part.split(":");
+  const headGroups = groups(head);
+  const tailGroups = groups(tail);
+  const filled =
+    typeof tail === "undefined"
+      ? headGroups
+      : [
+          ...headGroups,
+          ...Array(8 - headGroups.length - tailGroups.length).fill("0"),
+          ...tailGroups,
+        ];
+  return Buffer.from(
+    filled.map((group) => group.padStart(4, "0")).join(""),
+    "hex"
+  );
+};
+
+/**
+ * A decoder of the values held by the data section (or the metadata
+ * section) of a MaxMind DB file.
+ */
+class Decoder {
+  constructor(readonly buffer: Buffer, readonly base: number) {}
+
+  /**
+   * Read an unsigned integer of the given amount of bytes.
+   *
+   * @param offset The position of the integer.
+   * @param size The amount of bytes, up to 16.
+   * @returns The integer read.
+   */
+  uint(offset: number, size: number): bigint {
+    let value = BigInt(0);
+    for (let index = 0; index < size; index++) {
+      value = (value << BigInt(8)) | BigInt(this.buffer[offset + index]);
+    }
+    return value;
+  }
+
+  /**
+   * Read a value.
+   *
+   * @param offset The position of the value.
+   * @returns The value read, and the position that follows it.
+   */
+  value(offset: number): [unknown, number] {
+    if (offset >= this.buffer.length) {
+      throw new Error("truncated MaxMind DB data");
+    }
+    const control = this.buffer[offset++];
+    let type = control >> 5;
+    if (type === TYPE.POINTER) {
+      const size = (control >> 3) & 0x3;
+      const prefix = control & 0x7;
+      const pointer =
+        size === 3
+          ? this.buffer.readUInt32BE(offset)
+          : prefix * 2 ** (8 * (size + 1)) +
+            Number(this.uint(offset, size + 1)) +
+            [0, 2048, 526336][size];
+      const [value] = this.value(this.base + pointer);
+      return [value, offset + size + 1];
+    }
+    if (type === 0) {
+      type = 7 + this.buffer[offset++];
+    }
+    let size = control & 0x1f;
+    if (size >= 29) {
+      const extra = size - 28;
+      size = [29, 285, 65821][extra - 1] + Number(this.uint(offset, extra));
+      offset += extra;
+    }
+    switch (type) {
+      case TYPE.STRING:
+        return [
+          this.buffer.toString("utf8", offset, offset + size),
+          offset + size,
+        ];
+      case TYPE.DOUBLE:
+        return [this.buffer.readDoubleBE(offset), offset + 8];
+      case TYPE.FLOAT:
+        return [this.buffer.readFloatBE(offset), offset + 4];
+      case TYPE.BYTES:
+        // Binary data is given as base64, like other binary values
+        // held in events.
+        return [
+          this.buffer.toString("base64", offset, offset + size),
+          offset + size,
+        ];
+      case TYPE.UINT16:
+      case TYPE.UINT32:
+        return [Number(this.uint(offset, size)), offset + size];
+      case TYPE.UINT64:
+      case TYPE.UINT128:
+        return [decodedInteger(this.uint(offset, size)), offset + size];
+      case TYPE.INT32:
+        return [
+          size === 0 ? 0 : this.buffer.readIntBE(offset, size),
+          offset + size,
+        ];
+      case TYPE.BOOLEAN:
+        return [size !== 0, offset];
+      case TYPE.MAP: {
+        const entries: [string, unknown][] = [];
+        for (let index = 0; index < size; index++) {
+          const [key, afterKey] = this.value(offset);
+          const [value, afterValue] = this.value(afterKey);
+          entries.push([`${key}`, value]);
+          offset = afterValue;
+        }
+        return [Object.fromEntries(entries), offset];
+      }
+      case TYPE.ARRAY: {
+        const items: unknown[] = [];
+        for (let index = 0; index < size; index++) {
+          const [item, afterItem] = this.value(offset);
+          items.push(item);
+          offset = afterItem;
+        }
+        return [items, offset];
+      }
+      default:
+        throw new Error(`invalid MaxMind DB data type ${type}`);
+    }
+  }
+}
+
+/**
+ * Open a MaxMind DB database held by a buffer, such as the contents
+ * of a GeoLite2 or GeoIP2 `.mmdb` file. The buffer is only read, so
+ * the database may be shared by every lookup.
+ *
+ * @param buffer The contents of the database file.
+ * @returns The database.
+ */
+export const openDatabase = (buffer: Buffer): GeoDatabase => {
+  const markerPosition = buffer.lastIndexOf(METADATA_MARKER);
+  if (markerPosition < 0) {
+    throw new Error("not a MaxMind DB file (metadata marker not found)");
+  }
+  const metadataStart = markerPosition + METADATA_MARKER.length;
+  const [rawMetadata] = new Decoder(buffer, metadataStart).value(
+    metadataStart
+  );
+  const raw = rawMetadata as { [key: string]: unknown };
+  const metadata: DatabaseMetadata = {
+    databaseType: `${raw.database_type ?? "unknown"}`,
+    ipVersion: Number(raw.ip_version),
+    nodeCount: Number(raw.node_count),
+    recordSize: Number(raw.record_size),
+  };
+  if (![24, 28, 32].includes(metadata.recordSize)) {
+    throw new Error(
+      `unsupported MaxMind DB record size ${metadata.recordSize}`
+    );
+  }
+  const nodeSize = metadata.recordSize / 4;
+  const treeSize = nodeSize * metadata.nodeCount;
+  const dataSectionStart = treeSize + DATA_SECTION_SEPARATOR;
+  const decoder = new Decoder(buffer, dataSectionStart);
+  const record = (node: number, bit: number): number => {
+    const offset = node * nodeSize;
+    switch (metadata.recordSize) {
+      case 24:
+        return buffer.readUIntBE(offset + bit * 3, 3);
+      case 28:
+        return bit === 0
+          ? ((buffer[offset + 3] & 0xf0) << 20) | buffer.readUIntBE(offset, 3)
+          : ((buffer[offset + 3] & 0x0f) << 24) |
+              buffer.readUIntBE(offset + 4, 3);
+      default:
+        return buffer.readUInt32BE(offset + bit * 4);
+    }
+  };
+  // IPv4 addresses are looked up in IPv6 databases under ::/96, so the
+  // node reached after its 96 zeros is the start of every IPv4 lookup.
+  let ipv4Start = 0;
+  if (metadata.ipVersion === 6) {
+    for (let i = 0; i < 96 && ipv4Start < metadata.nodeCount; i++) {
+      ipv4Start = record(ipv4Start, 0);
+    }
+  }
+  return {
+    metadata,
+    lookup: (ip) => {
+      let address = parseIP(ip);
+      // IPv4-mapped addresses are looked up as the IPv4 addresses they
+      // map.
+      if (
+        address.length === 16 &&
+        address.subarray(0, 12).equals(IPV4_MAPPED_PREFIX)
+      ) {
+        address = address.subarray(12);
+      }
+      if (address.length === 16 && metadata.ipVersion === 4) {
+        return null;
+      }
+      let node = address.length === 4 ? ipv4Start : 0;
+      for (
+        let i = 0;
+        i < address.length * 8 && node < metadata.nodeCount;
+        i++
+      ) {
+        node = record(node, (address[i >> 3] >> (7 - (i & 7))) & 1);
+      }
+      if (node <= metadata.nodeCount) {
+        // The address was either not found, or the tree is exhausted
+        // without reaching a record.
+        return null;
+      }
+      const [value] = decoder.value(
+        dataSectionStart + node - metadata.nodeCount - DATA_SECTION_SEPARATOR
+      );
+      return value;
+    },
+  };
+};
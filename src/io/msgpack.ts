@@ -0,0 +1,304 @@
+import { ExactNumber } from "../exact-number";
+import {
+  checkDecodedDepth,
+  decodedInteger,
+  decodedKey,
+  encodable,
+  exactInteger,
+  Reader,
+} from "./binary";
+
+/**
+ * Write the header of a value whose length is given by a fixed-size
+ * prefix, choosing the smallest header that fits.
+ *
+ * @param length The length of the value.
+ * @param fixed The first byte of the short form, if the value has
+ * one.
+ * @param fixedLimit The length up to which the short form is used.
+ * @param codes The first byte of the forms with 8, 16 and 32 bit
+ * lengths, if the value has them.
+ * @param chunks The encoded chunks.
+ */
+const writeHeader = (
+  length: number,
+  fixed: number,
+  fixedLimit: number,
+  codes: [number | null, number, number],
+  chunks: Buffer[]
+): void => {
+  const [code8, code16, code32] = codes;
+  if (length < fixedLimit) {
+    chunks.push(Buffer.from([fixed | length]));
+  } else if (code8 !== null && length <= 0xff) {
+    chunks.push(Buffer.from([code8, length]));
+  } else if (length <= 0xffff) {
+    const header = Buffer.alloc(3);
+    header[0] = code16;
+    header.writeUInt16BE(length, 1);
+    chunks.push(header);
+  } else {
+    const header = Buffer.alloc(5);
+    header[0] = code32;
+    header.writeUInt32BE(length, 1);
+    chunks.push(header);
+  }
+};
+
+/**
+ * Write an integer, using the smallest form that holds it.
+ *
+ * @param value The integer, which must fit in 64 bits.
+ * @param chunks The encoded chunks.
+ */
+const writeInteger = (value: bigint, chunks: Buffer[]): void => {
+  const n = Number(value);
+  if (n >= 0 && n < 0x80) {
+    chunks.push(Buffer.from([n]));
+  } else if (n < 0 && n >= -0x20) {
+    chunks.push(Buffer.from([0x100 + n]));
+  } else if (n > 0 && n <= 0xffffffff) {
+    const size = n <= 0xff ? 1 : n <= 0xffff ? 2 : 4;
+    const bytes = Buffer.alloc(1 + size);
+    bytes[0] = size === 1 ? 0xcc : size === 2 ? 0xcd : 0xce;
+    bytes.writeUIntBE(n, 1, size);
+    chunks.push(bytes);
+  } else if (n < 0 && n >= -0x80000000) {
+    const size = n >= -0x80 ? 1 : n >= -0x8000 ? 2 : 4;
+    const bytes = Buffer.alloc(1 + size);
+    bytes[0] = size === 1 ? 0xd0 : size === 2 ? 0xd1 : 0xd2;
+    bytes.writeIntBE(n, 1, size);
+    chunks.push(bytes);
+  } else {
+    const bytes = Buffer.alloc(9);
+    if (value > BigInt(0)) {
+      bytes[0] = 0xcf;
+      bytes.writeBigUInt64BE(value, 1);
+    } else {
+      bytes[0] = 0xd3;
+      bytes.writeBigInt64BE(value, 1);
+    }
+    chunks.push(bytes);
+  }
+};
+
+/**
+ * Write a double precision float.
+ *
+ * @param value The number.
+ * @param chunks The encoded chunks.
+ */
+const writeFloat = (value: number, chunks: Buffer[]): void => {
+  const bytes = Buffer.alloc(9);
+  bytes[0] = 0xcb;
+  bytes.writeDoubleBE(value, 1);
+  chunks.push(bytes);
+};
+
+/**
+ * Write a value, already prepared for encoding.
+ *
+ * @param value The value.
+ * @param chunks The encoded chunks.
+ */
+const write = (value: unknown, chunks: Buffer[]): void => {
+  if (value === null || typeof value === "undefined") {
+    chunks.push(Buffer.from([0xc0]));
+  } else if (typeof value === "boolean") {
+    chunks.push(Buffer.from([value ? 0xc3 : 0xc2]));
+  } else if (value instanceof ExactNumber) {
+    const integer = exactInteger(value);
+    if (integer === null) {
+      writeFloat(value.valueOf(), chunks);
+    } else {
+      writeInteger(integer, chunks);
+    }
+  } else if (typeof value === "number") {
+    if (Number.isSafeInteger(value)) {
+      writeInteger(BigInt(value), chunks);
+    } else if (Number.isFinite(value)) {
+      writeFloat(value, chunks);
+    } else {
+      // Like JSON, non-finite numbers are written as null.
+      chunks.push(Buffer.from([0xc0]));
+    }
+  } else if (typeof value === "string") {
+    const bytes = Buffer.from(value, "utf8");
+    writeHeader(bytes.length, 0xa0, 0x20, [0xd9, 0xda, 0xdb], chunks);
+    chunks.push(bytes);
+  } else if (Array.isArray(value)) {
+    writeHeader(value.length, 0x90, 0x10, [null, 0xdc, 0xdd], chunks);
+    value.forEach((item) => write(encodable(item), chunks));
+  } else {
+    const entries = Object.entries(value as object)
+      .map(([key, item]): [string, unknown] => [key, encodable(item)])
+      .filter(([, item]) => typeof item !== "undefined");
+    writeHeader(entries.length, 0x80, 0x10, [null, 0xde, 0xdf], chunks);
+    entries.forEach(([key, item]) => {
+      write(key, chunks);
+      write(item, chunks);
+    });
+  }
+};
+
+/**
+ * Encode a value as MessagePack, the way it would be encoded as
+ * JSON. Integers held by ExactNumber instances keep all of their 64
+ * bits.
+ *
+ * @param value The value to encode.
+ * @returns The encoded value.
+ */
+export const encode = (value: unknown): Buffer => {
+  const chunks: Buffer[] = [];
+  write(encodable(value), chunks);
+  return Buffer.concat(chunks);
+};
+
+/**
+ * A cursor over a buffer being decoded.
+ */
+class MessagePackReader extends Reader {
+  constructor(buffer: Buffer) {
+    super(buffer, "MessagePack");
+  }
+
+  /**
+   * Read an unsigned integer of the given amount of bytes, up to 4.
+   *
+   * @param size The amount of bytes.
+   * @returns The integer read.
+   */
+  uint(size: number): number {
+    return this.take(size).readUIntBE(0, size);
+  }
+
+  /**
+   * Read a value, nested at the given depth.
+   *
+   * @param depth The nesting depth of the value.
+   * @returns The value read.
+   */
+  value(depth: number): unknown {
+    const code = this.uint(1);
+    if (code <= 0x7f) {
+      return code;
+    }
+    if (code >= 0xe0) {
+      return code - 0x100;
+    }
+    if (code <= 0x8f) {
+      return this.map(code & 0x0f, depth);
+    }
+    if (code <= 0x9f) {
+      return this.array(code & 0x0f, depth);
+    }
+    if (code <= 0xbf) {
+      return this.take(code & 0x1f).toString("utf8");
+    }
+    switch (code) {
+      case 0xc0:
+        return null;
+      case 0xc2:
+        return false;
+      case 0xc3:
+        return true;
+      case 0xc4:
+      case 0xc5:
+      case 0xc6:
+        // Binary data is given as base64, like other binary values
+        // held in events.
+        return this.take(this.uint(1 << (code - 0xc4))).toString("base64");
+      case 0xca:
+        return this.take(4).readFloatBE(0);
+      case 0xcb:
+        return this.take(8).readDoubleBE(0);
+      case 0xcc:
+      case 0xcd:
+      case 0xce:
+        return this.uint(1 << (code - 0xcc));
+      case 0xcf:
+        return decodedInteger(this.take(8).readBigUInt64BE(0));
+      case 0xd0:
+      case 0xd1:
+      case 0xd2: {
+        const size = 1 << (code - 0xd0);
+        return this.take(size).readIntBE(0, size);
+      }
+      case 0xd3:
+        return decodedInteger(this.take(8).readBigInt64BE(0));
+      case 0xd9:
+      case 0xda:
+      case 0xdb:
+        return this.take(this.uint(1 << (code - 0xd9))).toString("utf8");
+      case 0xdc:
+      case 0xdd:
+        return this.array(this.uint(code === 0xdc ? 2 : 4), depth);
+      case 0xde:
+      case 0xdf:
+        return this.map(this.uint(code === 0xde ? 2 : 4), depth);
+      case 0xc7:
+      case 0xc8:
+      case 0xc9:
+      case 0xd4:
+      case 0xd5:
+      case 0xd6:
+      case 0xd7:
+      case 0xd8:
+        throw new Error("MessagePack extension types are not supported");
+      default:
+        throw new Error(`invalid MessagePack type 0x${code.toString(16)}`);
+    }
+  }
+
+  /**
+   * Read the elements of an array.
+   *
+   * @param length The amount of elements.
+   * @param depth The nesting depth of the array.
+   * @returns The array.
+   */
+  array(length: number, depth: number): unknown[] {
+    checkDecodedDepth(depth + 1);
+    const items: unknown[] = [];
+    for (let index = 0; index < length; index++) {
+      items.push(this.value(depth + 1));
+    }
+    return items;
+  }
+
+  /**
+   * Read the entries of a map, as an object.
+   *
+   * @param length The amount of entries.
+   * @param depth The nesting depth of the map.
+   * @returns The object.
+   */
+  map(length: number, depth: number): { [key: string]: unknown } {
+    checkDecodedDepth(depth + 1);
+    const entries: [string, unknown][] = [];
+    for (let index = 0; index < length; index++) {
+      const key = decodedKey(this.value(depth + 1));
+      entries.push([key, this.value(depth + 1)]);
+    }
+    // Object.fromEntries defines own properties, so keys such as
+    // `__proto__` are kept as regular keys.
+    return Object.fromEntries(entries);
+  }
+}
+
+/**
+ * Decode a sequence of MessagePack values, found one after the other
+ * in the given data.
+ *
+ * @param data The encoded values.
+ * @returns The decoded values.
+ */
+export const decode = (data: Buffer): unknown[] => {
+  const reader = new MessagePackReader(data);
+  const values: unknown[] = [];
+  while (reader.position < data.length) {
+    values.push(reader.value(0));
+  }
+  return values;
+};
@@ -0,0 +1,831 @@
+import { Reader } from "./binary";
+
+/**
+ * A field of a protobuf message type.
+ */
+type ProtoField = {
+  name: string;
+  jsonName: string;
+  number: number;
+  type: number;
+  repeated: boolean;
+  typeName?: string;
+  oneof?: number;
+  // Fields without presence are omitted when holding their default
+  // value, as mandated by the proto3 JSON mapping.
+  implicitPresence: boolean;
+};
+
+/**
+ * A protobuf message type.
+ */
+type ProtoMessage = {
+  fields: ProtoField[];
+  mapEntry: boolean;
+};
+
+/**
+ * The message and enum types declared in a set of descriptors, by
+ * their fully qualified names (with a leading dot, as referenced by
+ * the descriptors themselves).
+ */
+export type DescriptorPool = {
+  messages: Map<string, ProtoMessage>;
+  enums: Map<string, Map<number, string>>;
+};
+
+/**
+ * The field types, as numbered by `FieldDescriptorProto.Type`.
+ */
+const TYPE = {
+  DOUBLE: 1,
+  FLOAT: 2,
+  INT64: 3,
+  UINT64: 4,
+  INT32: 5,
+  FIXED64: 6,
+  FIXED32: 7,
+  BOOL: 8,
+  STRING: 9,
+  GROUP: 10,
+  MESSAGE: 11,
+  BYTES: 12,
+  UINT32: 13,
+  ENUM: 14,
+  SFIXED32: 15,
+  SFIXED64: 16,
+  SINT32: 17,
+  SINT64: 18,
+};
+
+/**
+ * The repeated label, as numbered by `FieldDescriptorProto.Label`.
+ */
+const LABEL_REPEATED = 3;
+
+/**
+ * A field read from the wire: variable-length integers are given as
+ * bigints, and everything else as the bytes that hold it.
+ */
+export type WireField =
+  | { number: number; wireType: 0; value: bigint }
+  | { number: number; wireType: 1 | 2 | 5; value: Buffer };
+
+/**
+ * A cursor over a buffer being decoded.
+ */
+class ProtobufReader extends Reader {
+  constructor(buffer: Buffer) {
+    super(buffer, "protobuf");
+  }
+
+  /**
+   * Read an unsigned variable-length integer of up to 64 bits.
+   *
+   * @returns The integer read.
+   */
+  varint(): bigint {
+    let value = BigInt(0);
+    let shift = BigInt(0);
+    let byte: number;
+    do {
+      if (shift > BigInt(63)) {
+        throw new Error("invalid protobuf varint");
+      }
+      byte = this.take(1)[0];
+      value |= BigInt(byte & 0x7f) << shift;
+      shift += BigInt(7);
+    } while (byte & 0x80);
+    return BigInt.asUintN(64, value);
+  }
+
+  /**
+   * Read a single field of the given wire type, without processing
+   * its value. Groups are skipped.
+   *
+   * @param number The field's number.
+   * @param wireType The field's wire type.
+   * @returns The field, or null if it was a group.
+   */
+  field(number: number, wireType: number): WireField | null {
+    switch (wireType) {
+      case 0:
+        return { number, wireType: 0, value: this.varint() };
+      case 1:
+        return { number, wireType: 1, value: this.take(8) };
+      case 2:
+        return {
+          number,
+          wireType: 2,
+          value: this.take(Number(this.varint())),
+        };
+      case 5:
+        return { number, wireType: 5, value: this.take(4) };
+      case 3:
+        for (;;) {
+          const tag = Number(this.varint());
+          if (tag % 8 === 4) {
+            if (Math.floor(tag / 8) !== number) {
+              throw new Error("mismatched protobuf group");
+            }
+            return null;
+          }
+          this.field(Math.floor(tag / 8), tag % 8);
+        }
+      default:
+        throw new Error(`invalid protobuf wire type ${wireType}`);
+    }
+  }
+}
+
+/**
+ * Read the fields of an encoded message, in the order they appear.
+ *
+ * @param data The encoded message.
+ * @returns The fields.
+ */
+export const readFields = (data: Buffer): WireField[] => {
+  const reader = new ProtobufReader(data);
+  const fields: WireField[] = [];
+  while (reader.position < data.length) {
+    const tag = Number(reader.varint());
+    const number = Math.floor(tag / 8);
+    if (number === 0) {
+      throw new Error("invalid protobuf field number 0");
+    }
+    const field = reader.field(number, tag % 8);
+    if (field !== null) {
+      fields.push(field);
+    }
+  }
+  return fields;
+};
+
+/**
+ * Read the string fields with the given number.
+ *
+ * @param fields The fields of a message.
+ * @param number The number of the fields to read.
+ * @returns The strings.
+ */
+const strings = (fields: WireField[], number: number): string[] =>
+  fields
+    .filter((field) => field.number === number && field.wireType === 2)
+    .map((field) => (field.value as Buffer).toString("utf8"));
+
+/**
+ * Read the embedded messages with the given number.
+ *
+ * @param fields The fields of a message.
+ * @param number The number of the fields to read.
+ * @returns The fields of each embedded message.
+ */
+const messages = (fields: WireField[], number: number): WireField[][] =>
+  fields
+    .filter((field) => field.number === number && field.wireType === 2)
+    .map((field) => readFields(field.value as Buffer));
+
+/**
+ * Read the last integer field with the given number.
+ *
+ * @param fields The fields of a message.
+ * @param number The number of the field to read.
+ * @returns The integer, or undefined if it's missing.
+ */
+const integer = (fields: WireField[], number: number): number | undefined => {
+  const found = fields.filter(
+    (field) => field.number === number && field.wireType === 0
+  );
+  return found.length === 0
+    ? undefined
+    : Number(BigInt.asIntN(32, found[found.length - 1].value as bigint));
+};
+
+
+/**
+ * Compute the default JSON name of a field.
+ *
+ * @param name The field's name.
+ * @returns The field's JSON name.
+ */
+const lowerCamel = (name: string): string =>
+  name.replace(/_([a-z0-9])/g, (_, c: string) => c.toUpperCase());
+
+/**
+ * The fully qualified name of the enum whose values map to JSON null.
+ */
+const NULL_VALUE = ".google.protobuf.NullValue";
+
+/**
+ * Describe a well-known message type, so that it's available without
+ * loading its descriptor.
+ *
+ * @param name The type's name, within the `google.protobuf` package.
+ * @param fields The type's fields in numeric order, as tuples of name,
+ * type, the type name of message and enum fields, and whether the
+ * field is repeated or a member of the type's only oneof.
+ * @returns An entry of the pool's messages.
+ */
+const wellKnown = (
+  name: string,
+  fields: [string, number, string?, ("repeated" | "oneof")?][]
+): [string, ProtoMessage] => [
+  `.google.protobuf.${name}`,
+  {
+    mapEntry: name.endsWith("Entry"),
+    fields: fields.map(([fieldName, type, typeName, label], index) => ({
+      name: fieldName,
+      jsonName: lowerCamel(fieldName),
+      number: index + 1,
+      type,
+      repeated: label === "repeated",
+      ...(typeof typeName === "undefined"
+        ? {}
+        : { typeName: `.google.protobuf.${typeName}` }),
+      ...(label === "oneof" ? { oneof: 0 } : {}),
+      implicitPresence: type !== TYPE.MESSAGE && typeof label === "undefined",
+    })),
+  },
+];
+
+/**
+ * The well-known message types.
+ */
+const WELL_KNOWN_MESSAGES = [
+  wellKnown("Any", [
+    ["type_url", TYPE.STRING],
+    ["value", TYPE.BYTES],
+  ]),
+  wellKnown("Timestamp", [
+    ["seconds", TYPE.INT64],
+    ["nanos", TYPE.INT32],
+  ]),
+  wellKnown("Duration", [
+    ["seconds", TYPE.INT64],
+    ["nanos", TYPE.INT32],
+  ]),
+  wellKnown("Empty", []),
+  wellKnown("FieldMask", [["paths", TYPE.STRING, undefined, "repeated"]]),
+  wellKnown("Struct", [
+    ["fields", TYPE.MESSAGE, "Struct.FieldsEntry", "repeated"],
+  ]),
+  wellKnown("Struct.FieldsEntry", [
+    ["key", TYPE.STRING],
+    ["value", TYPE.MESSAGE, "Value"],
+  ]),
+  wellKnown("Value", [
+    ["null_value", TYPE.ENUM, "NullValue", "oneof"],
+    ["number_value", TYPE.DOUBLE, undefined, "oneof"],
+    ["string_value", TYPE.STRING, undefined, "oneof"],
+    ["bool_value", TYPE.BOOL, undefined, "oneof"],
+    ["struct_value", TYPE.MESSAGE, "Struct", "oneof"],
+    ["list_value", TYPE.MESSAGE, "ListValue", "oneof"],
+  ]),
+  wellKnown("ListValue", [["values", TYPE.MESSAGE, "Value", "repeated"]]),
+  wellKnown("DoubleValue", [["value", TYPE.DOUBLE]]),
+  wellKnown("FloatValue", [["value", TYPE.FLOAT]]),
+  wellKnown("Int64Value", [["value", TYPE.INT64]]),
+  wellKnown("UInt64Value", [["value", TYPE.UINT64]]),
+  wellKnown("Int32Value", [["value", TYPE.INT32]]),
+  wellKnown("UInt32Value", [["value", TYPE.UINT32]]),
+  wellKnown("BoolValue", [["value", TYPE.BOOL]]),
+  wellKnown("StringValue", [["value", TYPE.STRING]]),
+  wellKnown("BytesValue", [["value", TYPE.BYTES]]),
+];
+
+/**
+ * Load a `FileDescriptorSet`, as produced by `protoc
+ * --descriptor_set_out`. The well-known types are always available,
+ * even if the set doesn't include them.
+ *
+ * @param data The encoded descriptor set.
+ * @returns The types declared in the set.
+ */
+export const loadDescriptorSet = (data: Buffer): DescriptorPool => {
+  const pool: DescriptorPool = {
+    messages: new Map(WELL_KNOWN_MESSAGES),
+    enums: new Map([[NULL_VALUE, new Map([[0, "NULL_VALUE"]])]]),
+  };
+  const addEnum = (scope: string, descriptor: WireField[]): void => {
+    pool.enums.set(
+      `${scope}.${strings(descriptor, 1)[0]}`,
+      new Map(
+        messages(descriptor, 2).map((value): [number, string] => [
+          integer(value, 2) ?? 0,
+          strings(value, 1)[0] ?? "",
+        ])
+      )
+    );
+  };
+  const addMessage = (
+    scope: string,
+    descriptor: WireField[],
+    proto3: boolean
+  ): void => {
+    const name = `${scope}.${strings(descriptor, 1)[0]}`;
+    if (pool.messages.has(name)) {
+      // Well-known types keep their built-in description.
+      return;
+    }
+    const [options] = messages(descriptor, 7);
+    pool.messages.set(name, {
+      mapEntry: integer(options ?? [], 7) === 1,
+      fields: messages(descriptor, 2).map((field) => {
+        const [fieldName] = strings(field, 1);
+        const [jsonName] = strings(field, 10);
+        const [typeName] = strings(field, 6);
+        const type = integer(field, 5) ?? 0;
+        const repeated = integer(field, 4) === LABEL_REPEATED;
+        const oneof = integer(field, 9);
+        return {
+          name: fieldName,
+          jsonName: jsonName ?? lowerCamel(fieldName),
+          number: integer(field, 3) ?? 0,
+          type,
+          repeated,
+          ...(typeof typeName === "undefined"
+            ? {}
+            : {
+                typeName: typeName.startsWith(".")
+                  ? typeName
+                  : `.${typeName}`,
+              }),
+          ...(typeof oneof === "undefined" ? {} : { oneof }),
+          implicitPresence:
+            proto3 &&
+            !repeated &&
+            type !== TYPE.MESSAGE &&
+            typeof oneof === "undefined",
+        };
+      }),
+    });
+    messages(descriptor, 3).forEach((nested) =>
+      addMessage(name, nested, proto3)
+    );
+    messages(descriptor, 4).forEach((nested) => addEnum(name, nested));
+  };
+  for (const file of messages(readFields(data), 1)) {
+    const [packageName] = strings(file, 2);
+    const [syntax] = strings(file, 12);
+    const scope = typeof packageName === "undefined" ? "" : `.${packageName}`;
+    messages(file, 4).forEach((message) =>
+      addMessage(scope, message, syntax === "proto3")
+    );
+    messages(file, 5).forEach((enumType) => addEnum(scope, enumType));
+  }
+  return pool;
+};
+
+/**
+ * Get the wire type used for values of the given field type.
+ *
+ * @param type The field type.
+ * @returns The wire type.
+ */
+const wireTypeOf = (type: number): number =>
+  [TYPE.DOUBLE, TYPE.FIXED64, TYPE.SFIXED64].includes(type)
+    ? 1
+    : [TYPE.FLOAT, TYPE.FIXED32, TYPE.SFIXED32].includes(type)
+    ? 5
+    : [TYPE.STRING, TYPE.BYTES, TYPE.MESSAGE].includes(type)
+    ? 2
+    : 0;
+
+/**
+ * Split a packed repeated field into its values.
+ *
+ * @param field The field.
+ * @param data The packed values.
+ * @returns The values, as if read separately from the wire.
+ */
+const unpack = (field: ProtoField, data: Buffer): WireField[] => {
+  const reader = new ProtobufReader(data);
+  const values: WireField[] = [];
+  while (reader.position < data.length) {
+    values.push(
+      reader.field(field.number, wireTypeOf(field.type)) as WireField
+    );
+  }
+  return values;
+};
+
+/**
+ * Format a floating point number for JSON, which can't hold special
+ * values as numbers. Single precision numbers are given in their
+ * shortest form.
+ *
+ * @param value The number.
+ * @param single Whether the number has single precision.
+ * @returns The JSON value.
+ */
+const formatFloat = (value: number, single: boolean): number | string => {
+  if (Number.isNaN(value)) {
+    return "NaN";
+  }
+  if (!Number.isFinite(value)) {
+    return value > 0 ? "Infinity" : "-Infinity";
+  }
+  if (single) {
+    for (let precision = 1; precision < 9; precision++) {
+      const shorter = Number(value.toPrecision(precision));
+      if (Math.fround(shorter) === value) {
+        return shorter;
+      }
+    }
+  }
+  return value;
+};
+
+/**
+ * Convert a scalar value read from the wire to its JSON value. 64-bit
+ * integers are given as strings, bytes as base64 strings, and enum
+ * values by their name, if known.
+ *
+ * @param pool The known types.
+ * @param field The field the value belongs to.
+ * @param wire The value read from the wire.
+ * @returns The JSON value.
+ */
+const scalar = (
+  pool: DescriptorPool,
+  field: ProtoField,
+  wire: WireField
+): unknown => {
+  if (wire.wireType !== wireTypeOf(field.type)) {
+    throw new Error(`invalid wire type for protobuf field ${field.name}`);
+  }
+  const varint = wire.value as bigint;
+  const bytes = wire.value as Buffer;
+  const one = BigInt(1);
+  switch (field.type) {
+    case TYPE.DOUBLE:
+      return formatFloat(bytes.readDoubleLE(0), false);
+    case TYPE.FLOAT:
+      return formatFloat(bytes.readFloatLE(0), true);
+    case TYPE.INT64:
+      return BigInt.asIntN(64, varint).toString();
+    case TYPE.UINT64:
+      return varint.toString();
+    case TYPE.INT32:
+      return Number(BigInt.asIntN(32, varint));
+    case TYPE.FIXED64:
+      return bytes.readBigUInt64LE(0).toString();
+    case TYPE.FIXED32:
+      return bytes.readUInt32LE(0);
+    case TYPE.BOOL:
+      return varint !== BigInt(0);
+    case TYPE.STRING:
+      return bytes.toString("utf8");
+    case TYPE.BYTES:
+      return bytes.toString("base64");
+    case TYPE.UINT32:
+      return Number(BigInt.asUintN(32, varint));
+    case TYPE.ENUM: {
+      if (field.typeName === NULL_VALUE) {
+        return null;
+      }
+      const number = Number(BigInt.asIntN(32, varint));
+      return pool.enums.get(field.typeName ?? "")?.get(number) ?? number;
+    }
+    case TYPE.SFIXED32:
+      return bytes.readInt32LE(0);
+    case TYPE.SFIXED64:
+      return bytes.readBigInt64LE(0).toString();
+    case TYPE.SINT32:
+      return Number(BigInt.asIntN(32, (varint >> one) ^ -(varint & one)));
+    case TYPE.SINT64:
+      return BigInt.asIntN(64, (varint >> one) ^ -(varint & one)).toString();
+    default:
+      throw new Error(`unsupported type for protobuf field ${field.name}`);
+  }
+};
+
+/**
+ * Get the JSON value of a field that's missing from the wire.
+ *
+ * @param pool The known types.
+ * @param field The field.
+ * @returns The field's default JSON value.
+ */
+const defaultValue = (pool: DescriptorPool, field: ProtoField): unknown => {
+  switch (field.type) {
+    case TYPE.INT64:
+    case TYPE.UINT64:
+    case TYPE.FIXED64:
+    case TYPE.SFIXED64:
+    case TYPE.SINT64:
+      return "0";
+    case TYPE.BOOL:
+      return false;
+    case TYPE.STRING:
+    case TYPE.BYTES:
+      return "";
+    case TYPE.ENUM:
+      return field.typeName === NULL_VALUE
+        ? null
+        : pool.enums.get(field.typeName ?? "")?.get(0) ?? 0;
+    case TYPE.MESSAGE:
+      return decodeMessage(pool, field.typeName ?? "", Buffer.alloc(0));
+    default:
+      return 0;
+  }
+};
+
+/**
+ * Format the fractional part of a timestamp or duration, using 0, 3,
+ * 6 or 9 digits.
+ *
+ * @param nanos The nanoseconds.
+ * @returns The fractional part, including the leading dot.
+ */
+const formatNanos = (nanos: number): string =>
+  nanos === 0
+    ? ""
+    : nanos % 1000000 === 0
+    ? `.${String(nanos / 1000000).padStart(3, "0")}`
+    : nanos % 1000 === 0
+    ? `.${String(nanos / 1000).padStart(6, "0")}`
+    : `.${String(nanos).padStart(9, "0")}`;
+
+/**
+ * The JSON mapping of well-known types, applied to the JSON value
+ * they'd have as regular messages.
+ */
+const WELL_KNOWN_JSON: {
+  [name: string]: (
+    value: { [key: string]: unknown },
+    pool: DescriptorPool,
+    name: string
+  ) => unknown;
+} = {
+  ".google.protobuf.Any": ({ typeUrl, value }, pool) => {
+    if (typeof typeUrl !== "string") {
+      return {};
+    }
+    const name = `.${typeUrl.slice(typeUrl.lastIndexOf("/") + 1)}`;
+    const decoded = decodeMessage(
+      pool,
+      name,
+      Buffer.from((value as string | undefined) ?? "", "base64")
+    );
+    return name in WELL_KNOWN_JSON
+      ? { "@type": typeUrl, value: decoded }
+      : { "@type": typeUrl, ...(decoded as object) };
+  },
+  ".google.protobuf.Timestamp": ({ seconds, nanos }) => {
+    const s = Number(seconds ?? 0);
+    const n = Number(nanos ?? 0);
+    if (s < -62135596800 || s > 253402300799 || n < 0 || n > 999999999) {
+      throw new Error("protobuf timestamp out of range");
+    }
+    return `${new Date(s * 1000).toISOString().slice(0, 19)}${formatNanos(
+      n
+    )}Z`;
+  },
+  ".google.protobuf.Duration": ({ seconds, nanos }) => {
+    const s = String(seconds ?? "0");
+    const n = Number(nanos ?? 0);
+    const negative = s.startsWith("-") || n < 0;
+    return `${negative ? "-" : ""}${s.replace("-", "")}${formatNanos(
+      Math.abs(n)
+    )}s`;
+  },
+  ".google.protobuf.FieldMask": ({ paths }) =>
+    ((paths as string[] | undefined) ?? []).map(lowerCamel).join(","),
+  ".google.protobuf.Struct": ({ fields }) => fields ?? {},
+  ".google.protobuf.Value": (value) => {
+    const [kind] = Object.values(value);
+    return typeof kind === "undefined" ? null : kind;
+  },
+  ".google.protobuf.ListValue": ({ values }) => values ?? [],
+  ...Object.fromEntries(
+    [
+      "Double",
+      "Float",
+      "Int64",
+      "UInt64",
+      "Int32",
+      "UInt32",
+      "Bool",
+      "String",
+      "Bytes",
+    ].map((wrapped) => [
+      `.google.protobuf.${wrapped}Value`,
+      (
+        { value }: { [key: string]: unknown },
+        pool: DescriptorPool,
+        name: string
+      ) =>
+        value ??
+        defaultValue(pool, (pool.messages.get(name) as ProtoMessage).fields[0]),
+    ])
+  ),
+};
+
+/**
+ * Decode a message into its proto3 JSON mapping.
+ *
+ * @param pool The known types.
+ * @param typeName The fully qualified name of the message's type.
+ * @param data The encoded message.
+ * @returns The message's JSON value.
+ */
+const decodeMessage = (
+  pool: DescriptorPool,
+  typeName: string,
+  data: Buffer
+): unknown => {
+  const type = pool.messages.get(typeName);
+  if (typeof type === "undefined") {
+    throw new Error(`unknown protobuf message type ${typeName.slice(1)}`);
+  }
+  const byNumber = new Map(type.fields.map((field) => [field.number, field]));
+  // Singular embedded messages found more than once are merged, which
+  // is the same as decoding their concatenation.
+  const embedded = new Map<ProtoField, Buffer[]>();
+  const values = new Map<ProtoField, unknown[]>();
+  const set = (field: ProtoField, value: unknown[] | Buffer): void => {
+    if (typeof field.oneof !== "undefined") {
+      // Only the last member of a oneof found is kept.
+      for (const member of type.fields) {
+        if (member.oneof === field.oneof && member !== field) {
+          embedded.delete(member);
+          values.delete(member);
+        }
+      }
+    }
+    if (Buffer.isBuffer(value)) {
+      embedded.set(field, [...(embedded.get(field) ?? []), value]);
+    } else {
+      values.set(
+        field,
+        field.repeated ? [...(values.get(field) ?? []), ...value] : value
+      );
+    }
+  };
+  for (const wire of readFields(data)) {
+    const field = byNumber.get(wire.number);
+    if (typeof field === "undefined") {
+      continue;
+    }
+    if (field.type === TYPE.MESSAGE) {
+      if (wire.wireType !== 2) {
+        throw new Error(`invalid wire type for protobuf field ${field.name}`);
+      }
+      set(
+        field,
+        field.repeated
+          ? [decodeMessage(pool, field.typeName ?? "", wire.value)]
+          : wire.value
+      );
+    } else {
+      set(
+        field,
+        (wire.wireType === 2 && wireTypeOf(field.type) !== 2
+          ? unpack(field, wire.value)
+          : [wire]
+        ).map((item) => scalar(pool, field, item))
+      );
+    }
+  }
+  const result: { [key: string]: unknown } = {};
+  for (const field of type.fields) {
+    const chunks = embedded.get(field);
+    const found =
+      typeof chunks !== "undefined"
+        ? [decodeMessage(pool, field.typeName ?? "", Buffer.concat(chunks))]
+        : values.get(field);
+    if (typeof found === "undefined" || found.length === 0) {
+      continue;
+    }
+    const entryType =
+      field.type === TYPE.MESSAGE
+        ? pool.messages.get(field.typeName ?? "")
+        : undefined;
+    if (field.repeated && entryType?.mapEntry) {
+      const [keyField, valueField] = entryType.fields;
+      result[field.jsonName] = Object.fromEntries(
+        (found as { [key: string]: unknown }[]).map((entry) => [
+          String(entry[keyField.jsonName] ?? defaultValue(pool, keyField)),
+          entry[valueField.jsonName] ?? defaultValue(pool, valueField),
+        ])
+      );
+    } else if (field.repeated) {
+      result[field.jsonName] = found;
+    } else {
+      const value = found[found.length - 1];
+      if (!field.implicitPresence || value !== defaultValue(pool, field)) {
+        result[field.jsonName] = value;
+      }
+    }
+  }
+  const wellKnownJSON = WELL_KNOWN_JSON[typeName];
+  return typeof wellKnownJSON === "undefined"
+    ? result
+    : wellKnownJSON(result, pool, typeName);
+};
+
+/**
+ * Make a function that decodes messages of the given type into their
+ * proto3 JSON mapping. Unknown fields are ignored.
+ *
+ * @param pool The known types.
+ * @param typeName The fully qualified name of the messages' type.
+ * @returns A function that decodes messages.
+ */
+export const makeProtobufDecoder = (
+  pool: DescriptorPool,
+  typeName: string
+): ((data: Buffer) => unknown) => {
+  const qualified = typeName.startsWith(".") ? typeName : `.${typeName}`;
+  if (!pool.messages.has(qualified)) {
+    throw new Error(`unknown protobuf message type ${typeName}`);
+  }
+  return (data) => decodeMessage(pool, qualified, data);
+};
+
+/**
+ * A builder of encoded messages, which writes fields in the order
+ * they're given.
+ */
+export class Writer {
+  /**
+   * The encoded chunks written so far.
+   */
+  chunks: Buffer[] = [];
+
+  /**
+   * Write an unsigned variable-length integer of up to 64 bits.
+   *
+   * @param value The integer to write.
+   */
+  varint(value: bigint): void {
+    const bytes = [];
+    let rest = BigInt.asUintN(64, value);
+    while (rest >= BigInt(0x80)) {
+      bytes.push(Number(rest & BigInt(0x7f)) | 0x80);
+      rest >>= BigInt(7);
+    }
+    bytes.push(Number(rest));
+    this.chunks.push(Buffer.from(bytes));
+  }
+
+  /**
+   * Write an integer field, using the varint wire type. Negative
+   * integers take ten bytes, as for `int64` fields.
+   *
+   * @param number The field's number.
+   * @param value The field's value.
+   * @returns The writer.
+   */
+  integer(number: number, value: number | bigint): this {
+    this.varint(BigInt(number * 8));
+    this.varint(BigInt(value));
+    return this;
+  }
+
+  /**
+   * Write a `double` field.
+   *
+   * @param number The field's number.
+   * @param value The field's value.
+   * @returns The writer.
+   */
+  double(number: number, value: number): this {
+    this.varint(BigInt(number * 8 + 1));
+    const bytes = Buffer.alloc(8);
+    bytes.writeDoubleLE(value);
+    this.chunks.push(bytes);
+    return this;
+  }
+
+  /**
+   * Write a length-delimited field: a string, bytes, or an embedded
+   * message.
+   *
+   * @param number The field's number.
+   * @param value The field's value.
+   * @returns The writer.
+   */
+  bytes(number: number, value: string | Buffer | Writer): this {
+    const bytes =
+      value instanceof Writer
+        ? value.finish()
+        : typeof value === "string"
+        ? Buffer.from(value, "utf8")
+        : value;
+    this.varint(BigInt(number * 8 + 2));
+    this.varint(BigInt(bytes.length));
+    this.chunks.push(bytes);
+    return this;
+  }
+
+  /**
+   * Get the encoded message.
+   *
+   * @returns The fields written, encoded.
+   */
+  finish(): Buffer {
+    return Buffer.concat(this.chunks);
+  }
+}
@@ -0,0 +1,78 @@
+import { PubSub } from "@google-cloud/pubsub";
+
+/**
+ * Options to connect to Pub/Sub, shared by the input form and the
+ * output function.
+ */
+export interface PubSubConnectionOptions {
+  "project-id"?: string;
+  "key-file"?: string;
+  endpoint?: string;
+}
+
+/**
+ * An ajv schema for the connection options, to be merged with the
+ * schema of each module's options.
+ */
+export const connectionOptionsSchema = {
+  "project-id": { type: "string", minLength: 1 },
+  "key-file": { type: "string", minLength: 1 },
+  endpoint: { type: "string", minLength: 1 },
+};
+
+/**
+ * Build a Pub/Sub client. Credentials are taken from the key file if
+ * given, or found by the client library otherwise (e.g. through the
+ * `GOOGLE_APPLICATION_CREDENTIALS` variable).
+ *
+ * @param options The connection options.
+ * @returns A Pub/Sub client.
+ */
+export const makeClient = (options: PubSubConnectionOptions): PubSub =>
+  new PubSub({
+    ...(typeof options["project-id"] === "string"
+      ? { projectId: options["project-id"] }
+      : {}),
+    ...(typeof options["key-file"] === "string"
+      ? { keyFilename: options["key-file"] }
+      : {}),
+    ...(typeof options.endpoint === "string"
+      ? { apiEndpoint: options.endpoint }
+      : {}),
+  });
+
+/**
+ * The placeholders allowed in the templates of the output function.
+ */
+const PLACEHOLDER = /\{([^{}]*)\}/g;
+const PLACEHOLDERS = ["name"];
+
+/**
+ * The placeholders of a template that aren't allowed.
+ *
+ * @param template The template to check.
+ * @returns The invalid placeholders found in the template.
+ */
+export const invalidPlaceholders = (template: string): string[] =>
+  Array.from(template.matchAll(PLACEHOLDER))
+    .map(([, placeholder]) => placeholder)
+    .filter((placeholder) => !PLACEHOLDERS.includes(placeholder));
+
+/**
+ * Render a template by replacing its placeholders with an event's
+ * properties.
+ *
+ * @param template The template to render.
+ * @param event The event being published.
+ * @returns The rendered template.
+ */
+export const renderTemplate = (
+  template: string,
+  event: { name: string }
+): string => {
+  const values: { [placeholder: string]: string } = { name: event.name };
+  return template.replace(
+    PLACEHOLDER,
+    (_, placeholder: string) => values[placeholder] ?? ""
+  );
+};
@@ -1,7 +1,9 @@
 import { Readable } from "stream";
 import { AsyncQueue } from "../async-queue";
-import { PARSE_BUFFER_SIZE } from "../conf";
+import { INPUT_MAX_BYTES, PARSE_BUFFER_SIZE } from "../conf";
+import { decodeJson } from "../json";
 import { makeLogger } from "../log";
+import { checkSize, parseLimitedJson } from "./limits";
 
 /**
  * A logger instance namespaced to this module.
@@ -43,7 +45,7 @@ const extractLinesIntoQueue = <T>(
           const value = fn(buffer.subarray(previousPosition, position + 1));
           queue.push(value);
         } catch (err) {
-          logger.warn("Couldn't parse input line while parsing stream");
+          logger.warn(`Couldn't parse input line while parsing stream: ${err}`);
         }
       }
       previousPosition = position + 1;
@@ -54,7 +56,7 @@ const extractLinesIntoQueue = <T>(
       const value = fn(buffer.subarray(previousPosition));
       queue.push(value);
     } catch (err) {
-      logger.warn("Couldn't parse trailing data while parsing stream");
+      logger.warn(`Couldn't parse trailing data while parsing stream: ${err}`);
     }
   }
   return trailingData ? Buffer.alloc(0) : buffer.subarray(previousPosition);
@@ -70,17 +72,23 @@ const extractLinesIntoQueue = <T>(
  * @param fn An parsing function for each selected chunk.
  * @param stream The stream to read data from.
  * @param limit An optional limit to the number of bytes to read.
+ * @param maxLineBytes An optional limit to the size of each line.
+ * Lines that grow beyond it are discarded while they're read, without
+ * being accumulated.
  * @returns An async iterator of parsed values.
  */
 export const mapParse = <T>(
   fn: (data: Buffer) => T,
   stream: Readable,
-  limit?: number
+  limit?: number,
+  maxLineBytes?: number
 ): AsyncGenerator<T> => {
   const chunks: Buffer[] = [];
   const readLimit = limit ?? null;
   let totalRead = 0;
   let done = false;
+  // Whether the rest of the current line is being discarded.
+  let discarding = false;
   const queue = new AsyncQueue<T>("io.stream");
   // Accumulate chunks, attempting to parse linebreak-delimited data.
   stream.on("data", (data) => {
@@ -95,10 +103,27 @@ export const mapParse = <T>(
         : rawData.length;
     logger.debug("Parsed stream received data:", bytesRead, "bytes");
     totalRead += bytesRead;
-    chunks.push(rawData.subarray(0, bytesRead));
+    let received = rawData.subarray(0, bytesRead);
+    if (discarding) {
+      const lineEnd = received.findIndex((byte) => lineBreaks.includes(byte));
+      discarding = lineEnd === -1;
+      received = discarding ? Buffer.alloc(0) : received.subarray(lineEnd + 1);
+    }
+    chunks.push(received);
     const input = Buffer.concat(chunks);
     const remainder = extractLinesIntoQueue(fn, input, queue, false);
     if (
+      typeof maxLineBytes !== "undefined" &&
+      remainder.length > maxLineBytes
+    ) {
+      try {
+        checkSize(remainder.length, maxLineBytes);
+      } catch (err) {
+        logger.warn(`Discarding input line while parsing stream: ${err}`);
+      }
+      chunks.splice(0);
+      discarding = true;
+    } else if (
       input.length >= PARSE_BUFFER_SIZE &&
       remainder.length === input.length
     ) {
@@ -121,7 +146,9 @@ export const mapParse = <T>(
   stream.on("end", () => {
     if (!done) {
       done = true;
-      extractLinesIntoQueue(fn, Buffer.concat(chunks), queue, true);
+      if (!discarding) {
+        extractLinesIntoQueue(fn, Buffer.concat(chunks), queue, true);
+      }
       queue.close();
       logger.debug(
         "Parsed stream ended. Queue has",
@@ -134,7 +161,9 @@ export const mapParse = <T>(
   stream.on("error", (err) => {
     logger.warn(`Parsed stream reported error: ${err}`);
     done = true;
-    extractLinesIntoQueue(fn, Buffer.concat(chunks), queue, true);
+    if (!discarding) {
+      extractLinesIntoQueue(fn, Buffer.concat(chunks), queue, true);
+    }
     queue.close();
     logger.debug(
       "Parsed stream ended with error. Queue has",
@@ -175,4 +204,41 @@ export const parseJson = (
   stream: Readable,
   limit?: number
 ): AsyncGenerator<unknown> =>
-  mapParse((data: Buffer) => JSON.parse(data.toString()), stream, limit);
+  mapParse((data: Buffer) => decodeJson(data.toString()), stream, limit);
+
+/**
+ * Parse a readable stream received by an input form as UTF-8 lines,
+ * rejecting lines that exceed the size limit of input values.
+ *
+ * @param stream The stream to read data from.
+ * @param limit An optional limit to the number of bytes to read.
+ * @returns An async iterator of parsed values.
+ */
+export const parseInputLines = (
+  stream: Readable,
+  limit?: number
+): AsyncGenerator<string> =>
+  mapParse(
+    (data: Buffer) => {
+      checkSize(data.length);
+      return data.toString();
+    },
+    stream,
+    limit,
+    INPUT_MAX_BYTES
+  );
+
+/**
+ * Parse a readable stream received by an input form as NDJSON,
+ * rejecting values that exceed the size or nesting depth limits of
+ * input values before parsing them.
+ *
+ * @param stream The stream to read data from.
+ * @param limit An optional limit to the number of bytes to read.
+ * @returns An async iterator of parsed values.
+ */
+export const parseInputJson = (
+  stream: Readable,
+  limit?: number
+): AsyncGenerator<unknown> =>
+  mapParse(parseLimitedJson, stream, limit, INPUT_MAX_BYTES);
@@ -0,0 +1,104 @@
+import { readFields, WireField, Writer } from "./protobuf";
+import { compress, decompress } from "./snappy";
+
+/**
+ * A sample of a time series: its value, and its timestamp in
+ * milliseconds since the Unix epoch.
+ */
+export type Sample = { value: number; timestamp: number };
+
+/**
+ * A time series, identified by its labels (including `__name__`)
+ * sorted by name.
+ */
+export type TimeSeries = { labels: [string, string][]; samples: Sample[] };
+
+/**
+ * Encode the body of a remote-write request: a `WriteRequest`
+ * message, compressed with the Snappy block format.
+ *
+ * @param series The time series to write.
+ * @returns The body of the request.
+ */
+export const encodeWriteRequest = (series: TimeSeries[]): Buffer => {
+  const request = new Writer();
+  for (const { labels, samples } of series) {
+    const message = new Writer();
+    for (const [name, value] of labels) {
+      message.bytes(1, new Writer().bytes(1, name).bytes(2, value));
+    }
+    for (const { value, timestamp } of samples) {
+      message.bytes(2, new Writer().double(1, value).integer(2, timestamp));
+    }
+    request.bytes(1, message);
+  }
+  return compress(request.finish());
+};
+
+/**
+ * Read the embedded messages with the given number.
+ *
+ * @param fields The fields of a message.
+ * @param number The number of the fields to read.
+ * @returns The fields of each embedded message.
+ */
+const messages = (fields: WireField[], number: number): WireField[][] =>
+  fields
+    .filter((field) => field.number === number && field.wireType === 2)
+    .map((field) => readFields(field.value as Buffer));
+
+/**
+ * Read the last field with the given number and wire type.
+ *
+ * @param fields The fields of a message.
+ * @param number The number of the field to read.
+ * @param wireType The wire type of the field.
+ * @returns The field, or undefined if it's missing.
+ */
+const last = (
+  fields: WireField[],
+  number: number,
+  wireType: number
+): WireField | undefined =>
+  fields
+    .filter((field) => field.number === number && field.wireType === wireType)
+    .pop();
+
+/**
+ * Decode a `Label` message.
+ *
+ * @param fields The fields of the message.
+ * @returns The label's name and value.
+ */
+const decodeLabel = (fields: WireField[]): [string, string] => [
+  (last(fields, 1, 2)?.value as Buffer | undefined)?.toString("utf8") ?? "",
+  (last(fields, 2, 2)?.value as Buffer | undefined)?.toString("utf8") ?? "",
+];
+
+/**
+ * Decode a `Sample` message.
+ *
+ * @param fields The fields of the message.
+ * @returns The sample.
+ */
+const decodeSample = (fields: WireField[]): Sample => {
+  const value = last(fields, 1, 1)?.value as Buffer | undefined;
+  const timestamp = last(fields, 2, 0)?.value as bigint | undefined;
+  return {
+    value: value?.readDoubleLE() ?? 0,
+    timestamp: Number(BigInt.asIntN(64, timestamp ?? BigInt(0))),
+  };
+};
+
+/**
+ * Decode the body of a remote-write request, as a receiver would.
+ *
+ * @param body The body of the request.
+ * @returns The time series written. Throws an error if the body is
+ * malformed.
+ */
+export const decodeWriteRequest = (body: Buffer): TimeSeries[] =>
+  messages(readFields(decompress(body)), 1).map((series) => ({
+    labels: messages(series, 1).map(decodeLabel),
+    samples: messages(series, 2).map(decodeSample),
+  }));
@@ -0,0 +1,191 @@
+import { createHash, createHmac } from "crypto";
+import { request } from "./http-client";
+
+/**
+ * Options to connect to an S3-compatible object storage service.
+ */
+export interface S3ConnectionOptions {
+  /**
+   * The base URL of the service. Defaults to the AWS endpoint of the
+   * region.
+   */
+  endpoint?: string;
+  region: string;
+  bucket: string;
+  /**
+   * Whether the bucket is addressed in the path of URLs rather than
+   * in their host, as most S3-compatible services require.
+   */
+  pathStyle: boolean;
+  accessKeyId: string;
+  secretAccessKey: string;
+  sessionToken?: string;
+}
+
+/**
+ * Compute the hex-encoded SHA-256 digest of the given data.
+ *
+ * @param data The data to digest.
+ * @returns The digest.
+ */
+const sha256 = (data: string | Buffer): string =>
+  createHash("sha256").update(data).digest("hex");
+
+/**
+ * Compute the HMAC-SHA256 of the given data.
+ *
+ * @param key The key.
+ * @param data The data to authenticate.
+ * @returns The raw HMAC.
+ */
+const hmac = (key: string | Buffer, data: string): Buffer =>
+  createHmac("sha256", key).update(data).digest();
+
+/**
+ * Encode a URI path as required by the AWS signature, which encodes
+ * every character except the unreserved ones and slashes.
+ *
+ * @param path The path to encode.
+ * @returns The encoded path.
+ */
+const encodePath = (path: string): string =>
+  path
+    .split("/")
+    .map((segment) =>
+      encodeURIComponent(segment).replace(
+        /[!'()*]/g,
+        (c) => `%${c.charCodeAt(0).toString(16).toUpperCase()}`
+      )
+    )
+    .join("/");
+
+/**
+ * Compute the headers that authenticate a request with the AWS
+ * signature version 4. Every header given is signed.
+ *
+ * @param options The connection options, holding the credentials.
+ * @param method The request's method.
+ * @param url The request's URL, without a query string.
+ * @param headers The headers to sign, which must include the host.
+ * @param payloadHash The hex-encoded SHA-256 of the request's body.
+ * @param date The time of the request.
+ * @param service The AWS service the request is sent to.
+ * @returns The headers to add to the request.
+ */
+export const signRequest = (
+  options: Pick<
+    S3ConnectionOptions,
+    "region" | "accessKeyId" | "secretAccessKey" | "sessionToken"
+  >,
+  method: string,
+  url: URL,
+  headers: { [key: string]: string },
+  payloadHash: string,
+  date: Date,
+  service = "s3"
+): { [key: string]: string } => {
+  const amzDate = date.toISOString().replace(/[-:]|\.\d+/g, "");
+  const dateStamp = amzDate.slice(0, 8);
+  const signedHeaders: { [key: string]: string } = {
+    ...Object.fromEntries(
+      Object.entries(headers).map(([k, v]) => [k.toLowerCase(), v.trim()])
+    ),
+    "x-amz-content-sha256": payloadHash,
+    "x-amz-date": amzDate,
+    ...(typeof options.sessionToken === "string"
+      ? { "x-amz-security-token": options.sessionToken }
+      : {}),
+  };
+  const names = Object.keys(signedHeaders).sort();
+  const canonicalRequest = [
+    method,
+    encodePath(decodeURIComponent(url.pathname)),
+    "",
+    ...names.map((name) => `${name}:${signedHeaders[name]}`),
+    "",
+    names.join(";"),
+    payloadHash,
+  ].join("\n");
+  const scope = `${dateStamp}/${options.region}/${service}/aws4_request`;
+  const stringToSign = [
+    "AWS4-HMAC-SHA256",
+    amzDate,
+    scope,
+    sha256(canonicalRequest),
+  ].join("\n");
+  const signingKey = [service, "aws4_request"].reduce(
+    hmac,
+    hmac(hmac(`AWS4${options.secretAccessKey}`, dateStamp), options.region)
+  );
+  const signature = createHmac("sha256", signingKey)
+    .update(stringToSign)
+    .digest("hex");
+  return {
+    ...signedHeaders,
+    authorization:
+      `AWS4-HMAC-SHA256 Credential=${options.accessKeyId}/${scope}, ` +
+      `SignedHeaders=${names.join(";")}, Signature=${signature}`,
+  };
+};
+
+/**
+ * Build the URL of an object.
+ *
+ * @param options The connection options.
+ * @param key The object's key.
+ * @returns The object's URL.
+ */
+export const objectURL = (options: S3ConnectionOptions, key: string): URL => {
+  const endpoint = new URL(
+    options.endpoint ?? `https://s3.${options.region}.amazonaws.com`
+  );
+  if (!options.pathStyle) {
+    endpoint.hostname = `${options.bucket}.${endpoint.hostname}`;
+  }
+  const base = endpoint.pathname.replace(/\/+$/, "");
+  endpoint.pathname = options.pathStyle
+    ? `${base}/${options.bucket}/${encodePath(key)}`
+    : `${base}/${encodePath(key)}`;
+  return endpoint;
+};
+
+/**
+ * Upload an object in a single request, which makes it visible to
+ * readers only once it's complete.
+ *
+ * @param options The connection options.
+ * @param key The object's key.
+ * @param body The object's contents.
+ * @param contentType The object's content type.
+ * @returns A promise that resolves once the object is stored, or
+ * rejects with an error.
+ */
+export const putObject = async (
+  options: S3ConnectionOptions,
+  key: string,
+  body: Buffer,
+  contentType: string
+): Promise<void> => {
+  const url = objectURL(options, key);
+  const headers = signRequest(
+    options,
+    "PUT",
+    url,
+    { host: url.host },
+    sha256(body),
+    new Date()
+  );
+  // The host header is set by the client itself.
+  delete headers.host;
+  await request({
+    url: url.toString(),
+    method: "PUT",
+    data: body,
+    transformRequest: [(data) => data],
+    headers: {
+      ...headers,
+      "content-type": contentType,
+      "content-length": body.length.toString(),
+    },
+  });
+};
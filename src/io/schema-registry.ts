@@ -0,0 +1,110 @@
+import { AvroType, parseSchema } from "./avro";
+import { fetchJSON } from "./http-client";
+
+/**
+ * A client of a Confluent Schema Registry, which caches the schemas
+ * it fetches.
+ */
+export interface SchemaRegistry {
+  /**
+   * Get the schema with the given id.
+   *
+   * @param id The schema's id.
+   * @returns A promise yielding the compiled schema.
+   */
+  schemaById: (id: number) => Promise<AvroType>;
+  /**
+   * Get a version of the schema registered under a subject.
+   *
+   * @param subject The subject.
+   * @param version The version, or `"latest"`.
+   * @returns A promise yielding the schema's id and the compiled
+   * schema.
+   */
+  schemaBySubject: (
+    subject: string,
+    version: number | "latest"
+  ) => Promise<[number, AvroType]>;
+}
+
+/**
+ * Compile a schema as given by the registry, which only holds Avro
+ * schemas if their type is absent or explicitly `AVRO`.
+ *
+ * @param response The registry's response.
+ * @returns The compiled schema.
+ */
+const compileResponse = (response: unknown): AvroType => {
+  const { schema, schemaType } = (response ?? {}) as {
+    schema?: unknown;
+    schemaType?: unknown;
+  };
+  if (typeof schemaType !== "undefined" && schemaType !== "AVRO") {
+    throw new Error(`the schema isn't an Avro schema: ${schemaType}`);
+  }
+  if (typeof schema !== "string") {
+    throw new Error("the registry's response doesn't hold a schema");
+  }
+  return parseSchema(JSON.parse(schema));
+};
+
+/**
+ * Create a client of a schema registry. Schemas are cached by id for
+ * the lifetime of the client, since registered schemas are immutable.
+ * Failed lookups aren't cached, so they're attempted again when
+ * requested.
+ *
+ * @param url The base URL of the registry.
+ * @param headers The headers sent with each request, such as
+ * credentials.
+ * @returns The registry's client.
+ */
+export const makeSchemaRegistry = (
+  url: string,
+  headers: { [key: string]: string | number | boolean } = {}
+): SchemaRegistry => {
+  const base = url.replace(/\/+$/, "");
+  const requestHeaders = {
+    Accept: "application/vnd.schemaregistry.v1+json, application/json",
+    ...headers,
+  };
+  const schemas = new Map<number, Promise<AvroType>>();
+  const subjects = new Map<string, Promise<[number, AvroType]>>();
+  const cached = <K, V>(
+    cache: Map<K, Promise<V>>,
+    key: K,
+    fetch: () => Promise<V>
+  ): Promise<V> => {
+    const existing = cache.get(key);
+    if (typeof existing !== "undefined") {
+      return existing;
+    }
+    const fetching = fetch();
+    cache.set(key, fetching);
+    fetching.catch(() => cache.delete(key));
+    return fetching;
+  };
+  return {
+    schemaById: (id) =>
+      cached(schemas, id, async () =>
+        compileResponse(
+          await fetchJSON(`${base}/schemas/ids/${id}`, "GET", requestHeaders)
+        )
+      ),
+    schemaBySubject: (subject, version) =>
+      cached(subjects, `${subject}/${version}`, async () => {
+        const response = await fetchJSON(
+          `${base}/subjects/${encodeURIComponent(subject)}/versions/${version}`,
+          "GET",
+          requestHeaders
+        );
+        const { id } = (response ?? {}) as { id?: unknown };
+        if (typeof id !== "number") {
+          throw new Error("the registry's response doesn't hold an id");
+        }
+        const type = compileResponse(response);
+        schemas.set(id, Promise.resolve(type));
+        return [id, type];
+      }),
+  };
+};
@@ -0,0 +1,195 @@
+/**
+ * The size of the blocks the input is split in when compressing,
+ * which keeps every copy's offset within two bytes.
+ */
+const BLOCK_SIZE = 65536;
+
+/**
+ * The amount of bits of the hash table used to find matches.
+ */
+const HASH_BITS = 14;
+
+/**
+ * Encode an unsigned variable-length integer, as used in the preamble
+ * holding the uncompressed length.
+ *
+ * @param value The integer to encode.
+ * @returns The encoded integer.
+ */
+const varint = (value: number): Buffer => {
+  const bytes = [];
+  while (value >= 0x80) {
+    bytes.push((value % 0x80) | 0x80);
+    value = Math.floor(value / 0x80);
+  }
+  bytes.push(value);
+  return Buffer.from(bytes);
+};
+
+/**
+ * Write a literal element holding the given bytes.
+ *
+ * @param bytes The bytes of the literal.
+ * @param chunks The compressed chunks.
+ */
+const writeLiteral = (bytes: Buffer, chunks: Buffer[]): void => {
+  if (bytes.length === 0) {
+    return;
+  }
+  const n = bytes.length - 1;
+  if (n < 60) {
+    chunks.push(Buffer.from([n << 2]));
+  } else {
+    const size = n < 0x100 ? 1 : n < 0x10000 ? 2 : n < 0x1000000 ? 3 : 4;
+    const head = Buffer.alloc(1 + size);
+    head[0] = (59 + size) << 2;
+    head.writeUIntLE(n, 1, size);
+    chunks.push(head);
+  }
+  chunks.push(bytes);
+};
+
+/**
+ * Write copy elements that repeat the given amount of bytes found at
+ * the given offset back. Copies with two-byte offsets hold at most 64
+ * bytes each, so longer ones are split.
+ *
+ * @param offset The distance back to the repeated bytes.
+ * @param length The amount of bytes repeated, at least 4.
+ * @param chunks The compressed chunks.
+ */
+const writeCopy = (offset: number, length: number, chunks: Buffer[]): void => {
+  const copy = (n: number) =>
+    chunks.push(Buffer.from([((n - 1) << 2) | 2, offset & 0xff, offset >> 8]));
+  // Splits never leave less than 4 bytes for the last copy.
+  while (length >= 68) {
+    copy(64);
+    length -= 64;
+  }
+  if (length > 64) {
+    copy(60);
+    length -= 60;
+  }
+  copy(length);
+};
+
+/**
+ * Compress a block, finding repeated sequences of at least 4 bytes
+ * with a hash table of their last positions.
+ *
+ * @param block The block to compress.
+ * @param chunks The compressed chunks.
+ */
+const compressBlock = (block: Buffer, chunks: Buffer[]): void => {
+  const table = new Int32Array(1 << HASH_BITS).fill(-1);
+  let literalStart = 0;
+  let position = 0;
+  while (position + 4 <= block.length) {
+    const word = block.readUInt32LE(position);
+    const hash = Math.imul(word, 0x1e35a7bd) >>> (32 - HASH_BITS);
+    const candidate = table[hash];
+    table[hash] = position;
+    if (candidate < 0 || block.readUInt32LE(candidate) !== word) {
+      position++;
+      continue;
+    }
+    let length = 4;
+    while (
+      position + length < block.length &&
+      block[candidate + length] === block[position + length]
+    ) {
+      length++;
+    }
+    writeLiteral(block.subarray(literalStart, position), chunks);
+    writeCopy(position - candidate, length, chunks);
+    position += length;
+    literalStart = position;
+  }
+  writeLiteral(block.subarray(literalStart), chunks);
+};
+
+/**
+ * Compress data with the Snappy block format, without the framing
+ * used for Snappy streams. This is the format expected by Prometheus
+ * remote-write receivers, among others.
+ *
+ * @param data The data to compress.
+ * @returns The compressed data.
+ */
+export const compress = (data: Buffer): Buffer => {
+  const chunks = [varint(data.length)];
+  for (let start = 0; start < data.length; start += BLOCK_SIZE) {
+    compressBlock(data.subarray(start, start + BLOCK_SIZE), chunks);
+  }
+  return Buffer.concat(chunks);
+};
+
+/**
+ * Decompress data given in the Snappy block format.
+ *
+ * @param data The compressed data.
+ * @returns The decompressed data. Throws an error if the data is
+ * malformed.
+ */
+export const decompress = (data: Buffer): Buffer => {
+  let position = 0;
+  const take = (length: number): number => {
+    if (position + length > data.length) {
+      throw new Error("truncated snappy data");
+    }
+    const value = data.readUIntLE(position, length);
+    position += length;
+    return value;
+  };
+  let length = 0;
+  for (let shift = 0, byte = 0x80; byte & 0x80; shift += 7) {
+    if (shift > 28) {
+      throw new Error("invalid snappy preamble");
+    }
+    byte = take(1);
+    length += (byte & 0x7f) * 2 ** shift;
+  }
+  const output = Buffer.alloc(length);
+  let written = 0;
+  while (position < data.length) {
+    const tag = take(1);
+    let size: number;
+    let offset: number;
+    switch (tag & 3) {
+      case 0: {
+        const n = tag >> 2;
+        size = (n < 60 ? n : take(n - 59)) + 1;
+        if (position + size > data.length || written + size > length) {
+          throw new Error("invalid snappy literal");
+        }
+        data.copy(output, written, position, position + size);
+        position += size;
+        written += size;
+        continue;
+      }
+      case 1:
+        size = 4 + ((tag >> 2) & 7);
+        offset = ((tag >> 5) << 8) | take(1);
+        break;
+      case 2:
+        size = (tag >> 2) + 1;
+        offset = take(2);
+        break;
+      default:
+        size = (tag >> 2) + 1;
+        offset = take(4);
+    }
+    if (offset === 0 || offset > written || written + size > length) {
+      throw new Error("invalid snappy copy");
+    }
+    // Copies may overlap the bytes they produce, so they're made one
+    // byte at a time.
+    for (let i = 0; i < size; i++, written++) {
+      output[written] = output[written - offset];
+    }
+  }
+  if (written !== length) {
+    throw new Error("truncated snappy data");
+  }
+  return output;
+};
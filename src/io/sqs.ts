@@ -0,0 +1,129 @@
+import { createHash } from "crypto";
+import { request } from "./http-client";
+import { signRequest } from "./s3";
+
+/**
+ * Options to connect to an SQS queue.
+ */
+export interface SQSConnectionOptions {
+  queueUrl: string;
+  /**
+   * The base URL of the service. Defaults to the origin of the
+   * queue's URL.
+   */
+  endpoint?: string;
+  region: string;
+  accessKeyId: string;
+  secretAccessKey: string;
+  sessionToken?: string;
+}
+
+/**
+ * A message attribute, as given by SQS.
+ */
+export interface SQSMessageAttribute {
+  DataType: string;
+  StringValue?: string;
+  BinaryValue?: string;
+}
+
+/**
+ * A message received from an SQS queue.
+ */
+export interface SQSMessage {
+  MessageId: string;
+  ReceiptHandle: string;
+  Body: string;
+  MessageAttributes?: { [name: string]: SQSMessageAttribute };
+}
+
+/**
+ * An entry of a batch request that couldn't be fulfilled.
+ */
+export interface SQSBatchFailure {
+  Id: string;
+  Code: string;
+  Message?: string;
+  SenderFault: boolean;
+}
+
+/**
+ * The region of an SQS queue, if it can be inferred from its URL.
+ *
+ * @param queueUrl The URL of the queue.
+ * @returns The region of the queue, or undefined.
+ */
+export const regionFromURL = (queueUrl: string): string | undefined => {
+  const found = new URL(queueUrl).hostname.match(
+    /^sqs\.([a-z0-9-]+)\.amazonaws\.com$/
+  );
+  return found === null ? undefined : found[1];
+};
+
+/**
+ * Whether the queue is a FIFO queue, according to its name.
+ *
+ * @param queueUrl The URL of the queue.
+ * @returns Whether the queue is a FIFO queue.
+ */
+export const isFIFO = (queueUrl: string): boolean =>
+  queueUrl.replace(/\/+$/, "").endsWith(".fifo");
+
+/**
+ * Call an action of the SQS API, using the JSON protocol.
+ *
+ * @param options The connection options.
+ * @param action The name of the action (e.g. `ReceiveMessage`).
+ * @param body The action's parameters, besides the queue's URL.
+ * @param signal An optional signal used to abort the request.
+ * @returns A promise yielding the action's response.
+ */
+export const callSQS = async <T>(
+  options: SQSConnectionOptions,
+  action: string,
+  body: { [key: string]: unknown },
+  signal?: AbortSignal
+): Promise<T> => {
+  const url = new URL(options.endpoint ?? new URL(options.queueUrl).origin);
+  const payload = JSON.stringify({ QueueUrl: options.queueUrl, ...body });
+  const headers = signRequest(
+    options,
+    "POST",
+    url,
+    {
+      host: url.host,
+      "content-type": "application/x-amz-json-1.0",
+      "x-amz-target": `AmazonSQS.${action}`,
+    },
+    createHash("sha256").update(payload).digest("hex"),
+    new Date(),
+    "sqs"
+  );
+  // The host header is set by the client itself.
+  delete headers.host;
+  const response = await request({
+    url: url.toString(),
+    method: "POST",
+    data: payload,
+    transformRequest: [(data) => data],
+    headers,
+    signal,
+  });
+  return response.data as T;
+};
+
+/**
+ * Describe the entries of a batch request that couldn't be
+ * fulfilled.
+ *
+ * @param failures The failed entries.
+ * @returns A description of the failures.
+ */
+export const describeFailures = (failures: SQSBatchFailure[]): string =>
+  failures
+    .map(
+      (failure) =>
+        `${failure.Code}${failure.Message ? ` (${failure.Message})` : ""}`
+    )
+    .filter((description, index, all) => all.indexOf(description) === index)
+    .join(", ");
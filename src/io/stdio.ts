@@ -9,3 +9,8 @@ export const getSTDIN = (): Readable => process.stdin;
  * Wrap process.stdout into a getter to provide mocking options.
  */
 export const getSTDOUT = (): Writable => process.stdout;
+
+/**
+ * Wrap process.stderr into a getter to provide mocking options.
+ */
+export const getSTDERR = (): Writable => process.stderr;
@@ -0,0 +1,216 @@
+import { IncomingMessage } from "http";
+import { Duplex } from "stream";
+import WebSocket, { WebSocketServer } from "ws";
+import { makeHTTPServer } from "./http-server";
+import { makeLogger } from "../log";
+import { resolveAfter } from "../utils";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("io/websocket");
+
+/**
+ * Time in milliseconds between pings sent to peers. Peers that don't
+ * answer a ping with a pong before the next one is due are
+ * disconnected.
+ */
+const PING_INTERVAL = 30000;
+
+/**
+ * Bounds for the delay between reconnection attempts, in
+ * milliseconds. The delay doubles after each failed attempt.
+ */
+const MIN_RECONNECT_PERIOD = 1000;
+const MAX_RECONNECT_PERIOD = 60000;
+
+/**
+ * Keep a connection alive by pinging the peer periodically, and
+ * terminate it if the peer stops answering.
+ *
+ * @param socket The connection to keep alive.
+ * @param interval The time in milliseconds between pings.
+ */
+const keepAlive = (socket: WebSocket, interval: number): void => {
+  let alive = true;
+  socket.on("pong", () => {
+    alive = true;
+  });
+  const timer = setInterval(() => {
+    if (!alive) {
+      logger.info("WebSocket peer didn't answer a ping; terminating");
+      socket.terminate();
+      return;
+    }
+    alive = false;
+    socket.ping();
+  }, interval);
+  socket.on("close", () => clearInterval(timer));
+};
+
+/**
+ * A WebSocket server, which accepts connections at a single path.
+ */
+interface WebSocketServerHandle {
+  close: () => Promise<void>;
+  closed: Promise<void>;
+}
+
+/**
+ * Start a WebSocket server listening at the given port, which accepts
+ * connections for the given path and hands them over to the given
+ * handler. Regular HTTP requests are answered with 404 responses.
+ *
+ * @param port The TCP port to listen on.
+ * @param path The URL path clients connect to.
+ * @param onConnection The function that receives each new connection.
+ * @param address The address to listen on.
+ * @param pingInterval The time in milliseconds between pings sent to
+ * each client.
+ * @returns A handle to the server.
+ */
+export const makeWebSocketServer = (
+  port: number,
+  path: string,
+  onConnection: (socket: WebSocket, request: IncomingMessage) => void,
+  address?: string,
+  pingInterval: number = PING_INTERVAL
+): WebSocketServerHandle => {
+  const wss = new WebSocketServer({ noServer: true });
+  const http = makeHTTPServer(
+    port,
+    async (ctx) => {
+      logger.info(
+        "Received unrecognized request:",
+        ctx.request.method,
+        ctx.request.path
+      );
+      ctx.status = 404;
+    },
+    address
+  );
+  http.server.on(
+    "upgrade",
+    (request: IncomingMessage, stream: Duplex, head: Buffer) => {
+      const requestPath = new URL(request.url ?? "/", "http://localhost")
+        .pathname;
+      if (requestPath !== path) {
+        logger.info("Rejected WebSocket connection to", requestPath);
+        stream.end("HTTP/1.1 404 Not Found\r\nConnection: close\r\n\r\n");
+        return;
+      }
+      wss.handleUpgrade(request, stream, head, (socket) => {
+        logger.debug("Accepted WebSocket connection");
+        keepAlive(socket, pingInterval);
+        onConnection(socket, request);
+      });
+    }
+  );
+  return {
+    close: async () => {
+      // Connections are closed gracefully, which lets the peers
+      // receive the frames already sent.
+      await Promise.all(
+        Array.from(wss.clients).map(
+          (socket) =>
+            new Promise<void>((resolve) => {
+              if (socket.readyState === WebSocket.CLOSED) {
+                resolve();
+                return;
+              }
+              socket.once("close", () => resolve());
+              socket.close(1001);
+            })
+        )
+      );
+      wss.close();
+      await http.close();
+    },
+    closed: http.closed,
+  };
+};
+
+/**
+ * A WebSocket client connection, which is re-established whenever
+ * it's lost.
+ */
+interface ReconnectingClient {
+  current: () => WebSocket | null;
+  close: () => Promise<void>;
+  closed: Promise<void>;
+}
+
+/**
+ * Connect to a WebSocket server, reconnecting after the connection is
+ * lost or can't be established. The delay between attempts doubles
+ * after each failed one, up to a minute, and is reset once connected.
+ *
+ * @param url The URL of the server.
+ * @param onConnection The function that receives each established
+ * connection.
+ * @param pingInterval The time in milliseconds between pings sent to
+ * the server.
+ * @param reconnectPeriod The initial delay in milliseconds between
+ * reconnection attempts.
+ * @returns A handle to the connection.
+ */
+export const connectWithBackoff = (
+  url: string,
+  onConnection: (socket: WebSocket) => void,
+  pingInterval: number = PING_INTERVAL,
+  reconnectPeriod: number = MIN_RECONNECT_PERIOD
+): ReconnectingClient => {
+  let closing = false;
+  let socket: WebSocket | null = null;
+  let connected: WebSocket | null = null;
+  let period = reconnectPeriod;
+  let notifyClosed: () => void;
+  const closed: Promise<void> = new Promise((resolve) => {
+    notifyClosed = resolve;
+  });
+
+  const connect = () => {
+    const attempt = new WebSocket(url);
+    socket = attempt;
+    attempt.on("open", () => {
+      logger.debug("WebSocket client connected successfully");
+      period = reconnectPeriod;
+      connected = attempt;
+      keepAlive(attempt, pingInterval);
+      onConnection(attempt);
+    });
+    attempt.on("error", (err) => {
+      logger.error(`WebSocket client notified an error: ${err}`);
+    });
+    attempt.on("close", async () => {
+      connected = null;
+      if (closing) {
+        notifyClosed();
+        return;
+      }
+      logger.info(
+        `WebSocket client attempting to reconnect after ${period} ms`
+      );
+      await resolveAfter(period);
+      period = Math.min(period * 2, MAX_RECONNECT_PERIOD);
+      if (closing) {
+        notifyClosed();
+      } else {
+        connect();
+      }
+    });
+  };
+  connect();
+
+  return {
+    current: () => connected,
+    close: async () => {
+      closing = true;
+      if (socket !== null && socket.readyState !== WebSocket.CLOSED) {
+        socket.close(1000);
+      }
+      await closed;
+    },
+    closed,
+  };
+};
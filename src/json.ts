@@ -0,0 +1,122 @@
+import { randomBytes } from "crypto";
+import { JSON_NUMBERS } from "./conf";
+import { ExactNumber } from "./exact-number";
+
+export { ExactNumber };
+
+/**
+ * The prefix of the strings that stand in for exact numbers while
+ * values are handled by the standard JSON functions. It's unique to
+ * the process, so that it can't be found in the data received.
+ */
+const MARKER = `\u0000${randomBytes(8).toString("hex")}:`;
+
+/**
+ * A marker, as found in serialized values.
+ */
+const SERIALIZED_MARKER = new RegExp(
+  `"\\\\u0000${MARKER.slice(1, -1)}:([^"]*)"`,
+  "g"
+);
+
+/**
+ * String literals, which are skipped, and number literals of
+ * serialized JSON values.
+ */
+const LITERAL = /"(?:[^"\\]|\\.)*"|-?[0-9]+(?:\.[0-9]+)?(?:[eE][+-]?[0-9]+)?/g;
+
+/**
+ * The parts of a number literal.
+ */
+const NUMBER = /^-?([0-9]+)(?:\.([0-9]+))?(?:[eE]([+-]?[0-9]+))?$/;
+
+/**
+ * Normalize a number literal into its significant digits and the
+ * position of the decimal point, so that literals of the same number
+ * are equal.
+ *
+ * @param literal The number literal.
+ * @returns The normalized number.
+ */
+const normalize = (literal: string): string => {
+  const [, integer, fraction, exponent] = literal.match(NUMBER) ?? [];
+  const digits = `${integer ?? ""}${fraction ?? ""}`;
+  const leading = digits.length - digits.replace(/^0+/, "").length;
+  const significant = digits.replace(/^0+/, "").replace(/0+$/, "");
+  if (significant.length === 0) {
+    return "0";
+  }
+  const point =
+    (integer ?? "").length - leading + parseInt(exponent ?? "0", 10);
+  return `${literal.startsWith("-") ? "-" : ""}${significant}e${point}`;
+};
+
+/**
+ * Check whether a number literal is represented exactly by a
+ * javascript number.
+ *
+ * @param literal The number literal.
+ * @returns Whether the number is kept exactly.
+ */
+const isExact = (literal: string): boolean => {
+  const value = Number(literal);
+  return (
+    Number.isFinite(value) && normalize(String(value)) === normalize(literal)
+  );
+};
+
+/**
+ * Parse a serialized JSON value. If exact numbers are enabled,
+ * numbers that can't be represented exactly are parsed as
+ * ExactNumber instances.
+ *
+ * @param text The serialized JSON value.
+ * @returns The parsed value.
+ */
+export const decodeJson = (text: string): unknown => {
+  if (JSON_NUMBERS !== "exact") {
+    return JSON.parse(text);
+  }
+  let marked = false;
+  const replaced = text.replace(LITERAL, (literal) => {
+    if (literal.startsWith('"') || isExact(literal)) {
+      return literal;
+    }
+    marked = true;
+    return JSON.stringify(`${MARKER}${literal}`);
+  });
+  return marked
+    ? JSON.parse(replaced, (_, value) =>
+        typeof value === "string" && value.startsWith(MARKER)
+          ? new ExactNumber(value.slice(MARKER.length))
+          : value
+      )
+    : JSON.parse(text);
+};
+
+/**
+ * Serialize a value as JSON, writing ExactNumber instances as they
+ * were received.
+ *
+ * @param value The value to serialize.
+ * @param space The indentation, as given to JSON.stringify.
+ * @returns The serialized value.
+ */
+export const encodeJson = (value: unknown, space?: number): string => {
+  let marked = false;
+  const serialized = JSON.stringify(
+    value,
+    function (this: Record<string, unknown>, key: string, item: unknown) {
+      // The replacer receives values after their toJSON method is
+      // called, so the original is taken from the holder.
+      const original = this[key];
+      if (original instanceof ExactNumber) {
+        marked = true;
+        return `${MARKER}${original.source}`;
+      }
+      return item;
+    },
+    space
+  );
+  return marked ? serialized.replace(SERIALIZED_MARKER, "$1") : serialized;
+};
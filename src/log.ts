@@ -1,4 +1,11 @@
-import { LOG_LEVEL } from "./conf";
+import { format as formatMessage } from "util";
+import { LOG_LEVEL, LOG_FORMAT, LOG_PAYLOAD_MAX_LENGTH } from "./conf";
+
+/**
+ * Fields that annotate log messages, such as the step or input that
+ * emits them, or the event they refer to.
+ */
+export type LogFields = { [key: string]: unknown };
 
 /**
  * The shape of a logger.
@@ -8,6 +15,11 @@ export interface Logger {
   info: (...args: unknown[]) => void;
   warn: (...args: unknown[]) => void;
   error: (...args: unknown[]) => void;
+  /**
+   * Derive a logger that annotates every message with the given
+   * fields, besides the ones of this logger.
+   */
+  with: (fields: LogFields) => Logger;
 }
 
 /**
@@ -18,17 +30,71 @@ const nullLogger: Logger = {
   info: () => null,
   warn: () => null,
   error: () => null,
+  with: () => nullLogger,
 };
 
+/**
+ * Log levels, in ascending order of severity.
+ */
+const levels = ["debug", "info", "warn", "error"];
+
+/**
+ * Emit a log message in plain text, with the fields appended as
+ * key=value pairs.
+ *
+ * @param prefix The prefix of the message.
+ * @param fields The fields annotating the message.
+ * @param args The message's parts.
+ */
+const emitText = (prefix: string, fields: LogFields, args: unknown[]) =>
+  console.error(
+    prefix,
+    ...args,
+    ...Object.entries(fields).map(
+      ([key, value]) => `${key}=${JSON.stringify(value)}`
+    )
+  );
+
+/**
+ * Emit a log message as a single line of JSON, with the fields as
+ * properties of the logged object.
+ *
+ * @param ns The logger's namespace.
+ * @param level The level of the message.
+ * @param fields The fields annotating the message.
+ * @param args The message's parts.
+ */
+const emitJSON = (
+  ns: string,
+  level: string,
+  fields: LogFields,
+  args: unknown[]
+) =>
+  console.error(
+    JSON.stringify({
+      ...fields,
+      time: new Date().toISOString(),
+      level,
+      ns,
+      msg: formatMessage(...args),
+    })
+  );
+
 /**
  * Creates a simple logger with the specified namespace, which emits
- * messages with a namespace-specific prefix.
+ * messages with a namespace-specific prefix, or as JSON objects
+ * holding the namespace.
  *
  * @param ns The logger's namespace.
+ * @param format The format of the emitted messages.
+ * @param fields The fields annotating every message.
  * @returns The logger instance.
  */
-export const makeLogger = (ns: string): Logger => {
-  const levels = ["debug", "info", "warn", "error"];
+export const makeLogger = (
+  ns: string,
+  format: "text" | "json" = LOG_FORMAT,
+  fields: LogFields = {}
+): Logger => {
   if (!levels.includes(LOG_LEVEL)) {
     return nullLogger;
   }
@@ -44,12 +110,34 @@ export const makeLogger = (ns: string): Logger => {
     ...Object.fromEntries(
       levels.slice(currentLevelIndex).map((level) => [
         level,
-        (
-          (p) =>
-          (...args: unknown[]) =>
-            console.error(p, ...args)
-        )(prefix.get(level)),
+        format === "json"
+          ? (...args: unknown[]) => emitJSON(ns, level, fields, args)
+          : (
+              (p) =>
+              (...args: unknown[]) =>
+                emitText(p, fields, args)
+            )(prefix.get(level) as string),
       ])
     ),
+    with: (moreFields: LogFields) =>
+      makeLogger(ns, format, { ...fields, ...moreFields }),
   };
 };
+
+/**
+ * Serialize a payload to be included in log messages, truncating it
+ * if it's too long.
+ *
+ * @param payload The payload to include.
+ * @param maxLength The maximum length of the serialized payload.
+ * @returns The serialized and possibly truncated payload.
+ */
+export const truncatePayload = (
+  payload: unknown,
+  maxLength: number = LOG_PAYLOAD_MAX_LENGTH
+): string => {
+  const serialized = JSON.stringify(payload) ?? String(payload);
+  return serialized.length > maxLength
+    ? `${serialized.slice(0, maxLength)}...`
+    : serialized;
+};
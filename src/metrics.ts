@@ -2,8 +2,9 @@ import { EventEmitter } from "events";
 import Koa from "koa";
 import client from "prom-client";
 import { match, P } from "ts-pattern";
-import { activeQueues } from "./async-queue";
+import { activeQueues, isCongested } from "./async-queue";
 import {
+  METRICS_EXPOSITION_LISTEN_ADDRESS,
   METRICS_EXPOSITION_PORT,
   METRICS_EXPOSITION_PATH,
   METRICS_NAME_PREFIX,
@@ -34,7 +35,32 @@ export const pipelineEvents = new client.Counter({
 });
 
 /**
- * Tracks the count of events entering and leaving a pipeline step.
+ * Tracks the count of events received by the pipeline's input.
+ */
+export const inputEvents = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}input_events_total`,
+  help: "The count of events received by a pipeline input.",
+  labelNames: ["input"] as const,
+});
+
+/**
+ * Tracks the count of values received by the pipeline's input that
+ * were rejected for exceeding a limit, labeled by the limit exceeded
+ * (`size` or `depth`).
+ */
+export const inputRejectedValues = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}input_rejected_values_total`,
+  help: "The count of input values rejected for exceeding a limit.",
+  labelNames: ["reason"] as const,
+});
+
+/**
+ * Tracks the count of events entering and leaving a pipeline step,
+ * along with the ones that couldn't be forwarded (the `dead` flow),
+ * the ones the step failed to process (the `failed` flow), the ones
+ * discarded by the step's full buffer (the `dropped` flow) and the
+ * ones the step's function didn't process in time (the `timed-out`
+ * flow).
  */
 export const stepEvents = new client.Counter({
   name: `${METRICS_NAME_PREFIX}step_events_total`,
@@ -42,6 +68,36 @@ export const stepEvents = new client.Counter({
   labelNames: ["step", "flow"] as const,
 });
 
+/**
+ * Tracks the time elapsed since the arrival to the pipeline of the
+ * events emitted by each step, labeled by the first word of the
+ * events' names.
+ */
+export const stepLatency = new client.Histogram({
+  name: `${METRICS_NAME_PREFIX}step_latency_seconds`,
+  help: "The time since arrival of the events emitted by a step.",
+  labelNames: ["step", "prefix"] as const,
+  buckets: [0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60],
+});
+
+/**
+ * Tracks the count of events waiting in the buffer of each step,
+ * labeled by the buffer's overflow policy.
+ */
+export const stepBufferDepth = new client.Gauge({
+  name: `${METRICS_NAME_PREFIX}step_buffer_depth`,
+  help: "The count of events waiting in a step's buffer.",
+  labelNames: ["step", "policy"] as const,
+});
+
+/**
+ * Get the prefix of an event name used to label latency metrics.
+ *
+ * @param name The event name.
+ * @returns The first word of the name.
+ */
+export const namePrefix = (name: string): string => name.split(".")[0];
+
 /**
  * Get a total count of queued events, in all queues.
  *
@@ -64,6 +120,51 @@ export const queuedEvents = new client.Gauge({
   },
 });
 
+/**
+ * The count of queued events in a lane of a partitioned step.
+ */
+type LaneDepth = { step: string; lane: string; depth: number };
+
+/**
+ * Get the count of queued events in each lane of the partitioned
+ * steps.
+ *
+ * @returns The count of queued events of each step and lane.
+ */
+const getQueuedInLanes = (): LaneDepth[] => {
+  const depths: Map<string, LaneDepth> = new Map();
+  for (const queue of activeQueues) {
+    if (typeof queue.lane !== "undefined") {
+      const key = JSON.stringify([queue.lane.step, queue.lane.lane]);
+      const entry = depths.get(key) ?? {
+        step: queue.lane.step,
+        lane: `${queue.lane.lane}`,
+        depth: 0,
+      };
+      entry.depth += queue.data.length;
+      depths.set(key, entry);
+    }
+  }
+  return Array.from(depths.values());
+};
+
+/**
+ * Tracks the count of queued events in each lane of a partitioned
+ * step.
+ */
+export const stepLaneDepth = new client.Gauge({
+  name: `${METRICS_NAME_PREFIX}step_lane_depth`,
+  help: "The count of events queued in a lane of a partitioned step.",
+  labelNames: ["step", "lane"] as const,
+  collect() {
+    // Lanes of steps that were closed are forgotten.
+    this.reset();
+    for (const { step, lane, depth } of getQueuedInLanes()) {
+      this.set({ step, lane }, depth);
+    }
+  },
+});
+
 /**
  * Tracks the count of dead events accumulated during a pipeline
  * operation.
@@ -73,6 +174,115 @@ export const deadEvents = new client.Gauge({
   help: "The count of dead events in a pipeline.",
 });
 
+/**
+ * Tracks the count of events dropped by the `expose-sse` step
+ * function, because of clients too slow to receive them.
+ */
+export const sseDroppedEvents = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}sse_dropped_events_total`,
+  help: "The count of events not delivered to slow SSE clients.",
+  labelNames: ["step"] as const,
+});
+
+/**
+ * Tracks the count of events dropped by the `send-websocket` step
+ * function, because of peers too slow to receive them.
+ */
+export const websocketDroppedEvents = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}websocket_dropped_events_total`,
+  help: "The count of events not delivered to slow WebSocket peers.",
+  labelNames: ["step"] as const,
+});
+
+/**
+ * Tracks the count of datagrams dropped by the `udp` input form,
+ * because they arrived while the pipeline signaled backpressure.
+ */
+export const udpDroppedDatagrams = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}udp_dropped_datagrams_total`,
+  help: "The count of UDP datagrams dropped under backpressure.",
+});
+
+/**
+ * A counter of events removed as duplicates by the deduplicate
+ * function.
+ */
+export const deduplicatedEvents = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}deduplicated_events_total`,
+  help: "The count of events removed as duplicates.",
+  labelNames: ["step"] as const,
+});
+
+/**
+ * A counter of events not delivered by outputs, for having been
+ * delivered already.
+ */
+export const idempotentSkippedEvents = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}idempotent_skipped_events_total`,
+  help: "The count of events skipped for having been delivered already.",
+  labelNames: ["step"] as const,
+});
+
+/**
+ * A counter of events dropped by the throttle function, for exceeding
+ * the configured rate.
+ */
+export const throttledEvents = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}throttled_events_total`,
+  help: "The count of events dropped for exceeding a rate limit.",
+  labelNames: ["step"] as const,
+});
+
+/**
+ * Tracks the state of the circuit breaker of each step, with a value
+ * of 1 for the current state and 0 for the others.
+ */
+export const circuitBreakerState = new client.Gauge({
+  name: `${METRICS_NAME_PREFIX}circuit_breaker_state`,
+  help: "The state of a step's circuit breaker (1 for the current one).",
+  labelNames: ["step", "state"] as const,
+});
+
+/**
+ * Tracks the messages received by the amqp input that haven't been
+ * acknowledged yet, labeled by queue.
+ */
+export const amqpUnackedMessages = new client.Gauge({
+  name: `${METRICS_NAME_PREFIX}amqp_unacked_messages`,
+  help: "The count of amqp messages received but not yet acknowledged.",
+  labelNames: ["queue"] as const,
+});
+
+/**
+ * Tracks the fraction of the amqp input's prefetch limit taken by
+ * unacknowledged messages, labeled by queue.
+ */
+export const amqpPrefetchUtilization = new client.Gauge({
+  name: `${METRICS_NAME_PREFIX}amqp_prefetch_utilization`,
+  help: "The fraction of the amqp prefetch limit currently in use.",
+  labelNames: ["queue"] as const,
+});
+
+/**
+ * Tracks the count of amqp messages returned to their queue, labeled
+ * by queue and reason (`nack` for failed deliveries, `backpressure`
+ * for messages recovered after backpressure).
+ */
+export const amqpRequeuedMessages = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}amqp_requeued_messages_total`,
+  help: "The count of amqp messages returned to their queue.",
+  labelNames: ["queue", "reason"] as const,
+});
+
+/**
+ * Tracks the count of amqp connections or channels closed by the
+ * broker or the network, rather than by the input.
+ */
+export const amqpConnectionLosses = new client.Counter({
+  name: `${METRICS_NAME_PREFIX}amqp_connection_losses_total`,
+  help: "The count of amqp connections or channels lost by the input.",
+});
+
 /**
  * Boxed boolean that emits 'on' events when switching from `false` to
  * `true`, and 'off' events for the `true` to `false` transition.
@@ -170,6 +380,9 @@ const watchBackpressure = sequenceWatchers([
   BACKPRESSURE_QUEUED_EVENTS !== null
     ? () => getQueuedEvents() >= (BACKPRESSURE_QUEUED_EVENTS ?? 0)
     : () => false,
+  // Full buffers with the block policy propagate their slowness to
+  // the input.
+  isCongested,
 ]);
 
 /**
@@ -182,21 +395,29 @@ const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4";
  * Watch and expose metrics using an HTTP server. Also watch for
  * backpressure events and notify them.
  *
+ * @param port The port to expose metrics at.
+ * @param host The address to bind the HTTP server to.
+ * @param path The path that exposes metrics, or the empty string to
+ * disable exposition.
  * @returns A procedure that finishes exposition.
  */
-export const startExposingMetrics = (): (() => Promise<void>) => {
+export const startExposingMetrics = (
+  port: number = METRICS_EXPOSITION_PORT,
+  host: string = METRICS_EXPOSITION_LISTEN_ADDRESS,
+  path: string = METRICS_EXPOSITION_PATH
+): (() => Promise<void>) => {
   const backpressureMeasurements = setInterval(
     watchBackpressure,
     BACKPRESSURE_INTERVAL * 1000
   );
-  if (METRICS_EXPOSITION_PATH.length === 0) {
+  if (path.length === 0) {
     return async () => clearInterval(backpressureMeasurements);
   }
   const server = new Koa()
     .use(async (ctx) => {
       if (
         ctx.request.method === "GET" &&
-        ctx.request.path === METRICS_EXPOSITION_PATH
+        ctx.request.path === path
       ) {
         logger.debug("Generating metrics snapshot");
         ctx.body = await client.register.metrics();
@@ -210,10 +431,9 @@ export const startExposingMetrics = (): (() => Promise<void>) => {
         ctx.status = 404;
       }
     })
-    .listen(METRICS_EXPOSITION_PORT, "0.0.0.0", () => {
+    .listen(port, host, () => {
       logger.info(
-        "Started exposing metrics at " +
-          `port ${METRICS_EXPOSITION_PORT} and path ${METRICS_EXPOSITION_PATH}`
+        `Started exposing metrics at ${host}, port ${port} and path ${path}`
       );
     });
   return () => {
@@ -28,12 +28,24 @@ const singleWordWildCard = "*";
  */
 const multipleWordWildCard = "#";
 
+/**
+ * Alternation delimiters. A word enclosed in braces holds alternative
+ * words separated by commas, and matches exactly one word equal to
+ * any of them.
+ */
+const alternationStart = "{";
+const alternationEnd = "}";
+const alternationSeparator = ",";
+
 /**
  * The valid symbols that can be contained within a string pattern.
  */
 const patternCharSet = new Set(eventNameCharSet)
   .add(singleWordWildCard)
-  .add(multipleWordWildCard);
+  .add(multipleWordWildCard)
+  .add(alternationStart)
+  .add(alternationEnd)
+  .add(alternationSeparator);
 
 /**
  * Identifies a valid event name. A valid name is comprised of
@@ -47,38 +59,68 @@ export const isValidEventName = (name: string): boolean =>
   Array.from(name).every((symbol) => eventNameCharSet.has(symbol)) &&
   name.split(wordSeparator).every((word) => word.length > 0);
 
+/**
+ * Checks whether the given pattern word is an alternation.
+ *
+ * @param word The pattern word to test.
+ * @returns Whether the word is an alternation.
+ */
+const isAlternation = (word: string): boolean =>
+  word.startsWith(alternationStart) && word.endsWith(alternationEnd);
+
+/**
+ * Extracts the alternative words of an alternation.
+ *
+ * @param word The alternation pattern word.
+ * @returns The alternative words.
+ */
+const alternatives = (word: string): string[] =>
+  word.slice(1, -1).split(alternationSeparator);
+
+/**
+ * Identifies a valid pattern word, which is either an event name
+ * word, a single wildcard symbol, or an alternation of event name
+ * words.
+ *
+ * @param word The pattern word to test.
+ * @returns Whether the given pattern word is valid.
+ */
+const isValidPatternWord = (word: string): boolean =>
+  word === singleWordWildCard ||
+  word === multipleWordWildCard ||
+  (isAlternation(word)
+    ? word.length > 2 && alternatives(word).every(isValidEventName)
+    : isValidEventName(word));
+
 /**
  * Identifies a valid string pattern. A valid string pattern is
  * comprised of recognized symbols and contains 'words' of at least
  * one symbol in length. A word may also be a single wildcard symbol,
  * which can be used to match against one event name word (using the
  * '*' wildcard), or many sequential event name words (using the '#'
- * wildcard).
+ * wildcard). A word may also be an alternation such as '{foo,bar}',
+ * which matches one event name word equal to any of the alternatives.
  *
  * @param pattern The pattern string to test.
  * @returns Whether the given pattern string is valid.
  */
 const isValidPatternString = (pattern: string): boolean =>
   Array.from(pattern).every((symbol) => patternCharSet.has(symbol)) &&
-  pattern
-    .split(wordSeparator)
-    .every(
-      (word) =>
-        word.length > 0 &&
-        (word.length === 1 ||
-          (word.indexOf(singleWordWildCard) === -1 &&
-            word.indexOf(multipleWordWildCard) === -1))
-    );
+  pattern.split(wordSeparator).every(isValidPatternWord);
 
 /**
  * A pattern can be built from others using basic 'and', 'or' and
- * 'not' combinators.
+ * 'not' combinators, or with 'include' and 'exclude' lists. An
+ * 'ignore-case' pattern matches regardless of the casing of both
+ * itself and event names.
  */
 export type Pattern =
   | string
   | { and: Pattern[] }
   | { or: Pattern[] }
-  | { not: Pattern };
+  | { not: Pattern }
+  | { include: Pattern | Pattern[]; exclude: Pattern | Pattern[] }
+  | { "ignore-case": Pattern };
 
 /**
  * Provide the type definition as a JSON schema.
@@ -104,9 +146,39 @@ export const patternSchema = {
       additionalProperties: false,
       required: ["not"],
     },
+    {
+      type: "object",
+      properties: {
+        include: {
+          anyOf: [{ type: "string" }, { type: "object" }, { type: "array" }],
+        },
+        exclude: {
+          anyOf: [{ type: "string" }, { type: "object" }, { type: "array" }],
+        },
+      },
+      additionalProperties: false,
+      required: ["include", "exclude"],
+    },
+    {
+      type: "object",
+      properties: {
+        "ignore-case": { anyOf: [{ type: "string" }, { type: "object" }] },
+      },
+      additionalProperties: false,
+      required: ["ignore-case"],
+    },
   ],
 };
 
+/**
+ * Normalizes a pattern or list of patterns to a list of patterns.
+ *
+ * @param p The pattern or list of patterns.
+ * @returns The list of patterns.
+ */
+const asPatternList = (p: Pattern | Pattern[]): Pattern[] =>
+  Array.isArray(p) ? p : [p];
+
 /**
  * Validate a pattern non-strictly, using only the schema.
  */
@@ -131,6 +203,13 @@ export const isValidPattern = (thing: unknown): boolean => {
     return pattern.or.every(isValidPattern);
   } else if ("not" in pattern) {
     return isValidPattern(pattern.not);
+  } else if ("include" in pattern) {
+    return (
+      asPatternList(pattern.include).every(isValidPattern) &&
+      asPatternList(pattern.exclude).every(isValidPattern)
+    );
+  } else if ("ignore-case" in pattern) {
+    return isValidPattern(pattern["ignore-case"]);
   } else {
     return false;
   }
@@ -160,6 +239,11 @@ const wordsMatchPatternWords = (
     );
   } else if (pWord === singleWordWildCard) {
     return wordsMatchPatternWords(sRest, pRest);
+  } else if (isAlternation(pWord)) {
+    return (
+      alternatives(pWord).includes(sWord) &&
+      wordsMatchPatternWords(sRest, pRest)
+    );
   } else {
     return sWord === pWord && wordsMatchPatternWords(sRest, pRest);
   }
@@ -171,17 +255,38 @@ const wordsMatchPatternWords = (
  *
  * @param sWords The word sequence to check.
  * @param p The pattern to check against.
+ * @param ignoreCase Whether to lowercase string patterns before
+ * matching (the word sequence is expected to be lowercased already).
  * @returns Whether the words match the pattern.
  */
-const wordsMatchPattern = (sWords: string[], p: Pattern): boolean => {
+const wordsMatchPattern = (
+  sWords: string[],
+  p: Pattern,
+  ignoreCase = false
+): boolean => {
+  const recur = (subP: Pattern) => wordsMatchPattern(sWords, subP, ignoreCase);
   if (typeof p === "string") {
-    return wordsMatchPatternWords(sWords, p.split(wordSeparator));
+    return wordsMatchPatternWords(
+      sWords,
+      (ignoreCase ? p.toLowerCase() : p).split(wordSeparator)
+    );
   } else if ("and" in p) {
-    return p.and.every((subP) => wordsMatchPattern(sWords, subP));
+    return p.and.every(recur);
   } else if ("or" in p) {
-    return p.or.some((subP) => wordsMatchPattern(sWords, subP));
+    return p.or.some(recur);
   } else if ("not" in p) {
-    return !wordsMatchPattern(sWords, p.not);
+    return !recur(p.not);
+  } else if ("include" in p) {
+    return (
+      asPatternList(p.include).some(recur) &&
+      !asPatternList(p.exclude).some(recur)
+    );
+  } else if ("ignore-case" in p) {
+    return wordsMatchPattern(
+      sWords.map((word) => word.toLowerCase()),
+      p["ignore-case"],
+      true
+    );
   } else {
     return false;
   }
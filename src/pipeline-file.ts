@@ -0,0 +1,115 @@
+import fs from "fs";
+import path from "path";
+import YAML from "yaml";
+
+/**
+ * Check whether the given thing is a plain object.
+ *
+ * @param thing The thing to check.
+ * @returns Whether the thing is an object, and not an array.
+ */
+const isObject = (thing: unknown): thing is Record<string, unknown> =>
+  typeof thing === "object" && thing !== null && !Array.isArray(thing);
+
+/**
+ * Parse every YAML document in a file, skipping empty ones.
+ *
+ * @param file The path to the file.
+ * @returns The parsed documents.
+ */
+const parseDocuments = (file: string): unknown[] =>
+  YAML.parseAllDocuments(fs.readFileSync(file, "utf-8"))
+    .map((document) => {
+      if (document.errors.length > 0) {
+        throw new Error(`${file}: ${document.errors[0].message}`);
+      }
+      return document.toJSON();
+    })
+    .filter((contents) => contents !== null && contents !== undefined);
+
+/**
+ * Read a pipeline file, merging the documents it holds and the
+ * fragments it includes into a single raw structure. The files listed
+ * under a document's `include` key, relative to the file that lists
+ * them, are merged before the document itself, in the order given.
+ * Documents are merged in order too, and a file included more than
+ * once is only merged the first time. Merging fails if a step or any
+ * other top-level key is defined more than once, or if the includes
+ * form a cycle. The result is neither interpolated nor checked.
+ *
+ * @param file The path to the pipeline file.
+ * @returns The raw structure, to be given to makePipelineTemplate.
+ */
+export const readPipelineFile = (file: string): unknown => {
+  const merged: Record<string, unknown> = {};
+  const steps: Record<string, unknown> = {};
+  // The file in which each step and top-level key was defined.
+  const origins: Map<string, string> = new Map();
+  const visited: Set<string> = new Set();
+  const define = (key: string, origin: string): void => {
+    const previous = origins.get(key);
+    if (typeof previous !== "undefined") {
+      throw new Error(
+        previous === origin
+          ? `${key} is defined more than once in ${origin}`
+          : `${key} is defined in both ${previous} and ${origin}`
+      );
+    }
+    origins.set(key, origin);
+  };
+  const mergeFile = (current: string, chain: string[]): void => {
+    const resolved = path.resolve(current);
+    if (chain.includes(resolved)) {
+      throw new Error(
+        `include cycle: ${[...chain, resolved]
+          .slice(chain.indexOf(resolved))
+          .join(" -> ")}`
+      );
+    }
+    if (visited.has(resolved)) {
+      return;
+    }
+    visited.add(resolved);
+    for (const document of parseDocuments(current)) {
+      if (!isObject(document)) {
+        throw new Error(`${current}: documents must be YAML mappings`);
+      }
+      const { include, ...contents } = document;
+      const includes =
+        typeof include === "undefined" || include === null
+          ? []
+          : typeof include === "string"
+          ? [include]
+          : include;
+      if (
+        !Array.isArray(includes) ||
+        !includes.every((item) => typeof item === "string")
+      ) {
+        throw new Error(
+          `${current}: include must be a file path or a list of them`
+        );
+      }
+      for (const item of includes) {
+        mergeFile(path.resolve(path.dirname(resolved), item), [
+          ...chain,
+          resolved,
+        ]);
+      }
+      for (const [key, value] of Object.entries(contents)) {
+        if (key !== "steps") {
+          define(`'${key}'`, current);
+          merged[key] = value;
+        } else if (isObject(value)) {
+          for (const [name, step] of Object.entries(value)) {
+            define(`step '${name}'`, current);
+            steps[name] = step;
+          }
+        } else if (value !== null) {
+          throw new Error(`${current}: steps must be a YAML mapping`);
+        }
+      }
+    }
+  };
+  mergeFile(file, []);
+  return Object.keys(steps).length > 0 ? { ...merged, steps } : merged;
+};
@@ -1,9 +1,26 @@
-import { AsyncQueue, Channel } from "./async-queue";
+import { SpanContext } from "@opentelemetry/api";
+import {
+  AsyncQueue,
+  Channel,
+  QueueLoad,
+  inStep,
+  isSettled,
+  untilSettled,
+  unwatchQueues,
+  watchQueues,
+} from "./async-queue";
 import * as deadLetter from "./dead-letter";
+import { combineIn, hold, holdIn, release, releaseIn } from "./delivery";
 import { Event } from "./event";
 import { makeLogger } from "./log";
-import { stepEvents, deadEvents as deadEventsMetric } from "./metrics";
-import { Step, StepFactory } from "./step";
+import {
+  stepEvents,
+  stepLatency,
+  namePrefix,
+  deadEvents as deadEventsMetric,
+} from "./metrics";
+import { Step, StepFactory, heldWorkOf } from "./step";
+import { isTracing, recordSpan } from "./tracing";
 import { resolveAfter } from "./utils";
 
 /**
@@ -13,12 +30,15 @@ const logger = makeLogger("pipeline");
 
 /**
  * A step definition for the purposes of pipeline execution. Step
- * creation nuances are obscured by the factory procedure.
+ * creation nuances are obscured by the factory procedure. Steps with
+ * a signature are kept running when the pipeline is reconfigured with
+ * a step of the same name and signature.
  */
 export interface StepDefinition {
   name: string;
   after: string[];
   factory: StepFactory;
+  signature?: string;
 }
 
 /**
@@ -30,6 +50,14 @@ export interface Pipeline {
   steps: StepDefinition[];
 }
 
+/**
+ * A running pipeline: a channel in which events flow, that can be
+ * reconfigured with a different set of steps without stopping.
+ */
+export interface RunningPipeline extends Channel<Event, Event> {
+  reconfigure: (pipeline: Pipeline) => Promise<void>;
+}
+
 /**
  * An alias for the input pseudo-step, so that other steps can declare
  * it as an explicit dependency.
@@ -99,90 +127,214 @@ export const validate = (pipeline: Pipeline): void => {
 };
 
 /**
- * Runs a pipeline. Returns a channel in which events flow. If the
- * pipeline contains an improper DAG (e.g. with cycles or dangling
- * references), this procedure throws an error.
+ * The index of the input pseudo-step, within the nodes of a running
+ * pipeline.
+ */
+const INPUT_NODE_INDEX = -1;
+
+/**
+ * Build the edges of a pipeline's DAG, given the indices assigned to
+ * each step.
  *
- * @param pipeline The pipeline to run.
- * @returns A promise yielding a channel of events.
+ * @param pipeline The pipeline.
+ * @param indices The index of each step, by name.
+ * @returns A pair of maps: the first one indexes the nodes that
+ * follow each node, and the second one the steps that each step
+ * depends on (excluding the input).
  */
-export const run = async (
-  pipeline: Pipeline
-): Promise<Channel<Event, Event>> => {
-  // Ensure the pipeline is proper.
-  validate(pipeline);
-  // Translate steps into integers for lighter event annotations.
-  const inputNodeIndex = -1;
-  const stepTranslation = new Map(
-    pipeline.steps.map(({ name }, index) => [name, index])
-  );
-  stepTranslation.set(INPUT_ALIAS, inputNodeIndex);
+const buildEdges = (
+  pipeline: Pipeline,
+  indices: Map<string, number>
+): [Map<number, number[]>, Map<number, number[]>] => {
+  const translate = (name: string): number =>
+    name === INPUT_ALIAS ? INPUT_NODE_INDEX : (indices.get(name) as number);
   // Edges in the DAG are built indexing the source node. Thus the
   // pipeline structure needs to be inverted.
   const edges: Map<number, number[]> = new Map(
-    pipeline.steps.map((_, index) => [index, []])
+    pipeline.steps.map(({ name }) => [translate(name), []])
   );
-  edges.set(inputNodeIndex, []);
+  edges.set(INPUT_NODE_INDEX, []);
   for (const step of pipeline.steps) {
-    const stepIndex = stepTranslation.get(step.name) as number;
-    for (const previousNodeIndex of step.after.map((name) =>
-      stepTranslation.get(name)
-    )) {
-      (edges.get(previousNodeIndex as number) as number[]).push(stepIndex);
+    const stepIndex = translate(step.name);
+    for (const previousNodeIndex of step.after.map(translate)) {
+      (edges.get(previousNodeIndex) as number[]).push(stepIndex);
     }
     // Not declaring dependencies is the same as depending on the
     // input.
     if (step.after.length === 0) {
-      (edges.get(inputNodeIndex) as number[]).push(stepIndex);
+      (edges.get(INPUT_NODE_INDEX) as number[]).push(stepIndex);
     }
   }
   // The original structure which indexes target nodes is also
   // required for closing up all queues in the least destructive
   // manner possible.
   const reverseEdges: Map<number, number[]> = new Map(
-    pipeline.steps.map(({ after }, index) => [
-      index,
-      after
-        .map((name) => stepTranslation.get(name) as number)
-        .filter((index) => index !== inputNodeIndex),
+    pipeline.steps.map(({ name, after }) => [
+      translate(name),
+      after.map(translate).filter((index) => index !== INPUT_NODE_INDEX),
+    ])
+  );
+  return [edges, reverseEdges];
+};
+
+/**
+ * Runs a pipeline. Returns a channel in which events flow. If the
+ * pipeline contains an improper DAG (e.g. with cycles or dangling
+ * references), this procedure throws an error.
+ *
+ * The pipeline may be reconfigured while it runs. Steps kept in the
+ * new configuration (with the same name and signature) continue
+ * running, steps removed or changed are closed after they drain, and
+ * new steps are started. If the new configuration is improper, or a
+ * new step can't be started, the procedure throws an error and the
+ * running pipeline is left untouched.
+ *
+ * @param pipeline The pipeline to run.
+ * @returns A promise yielding a channel of events.
+ */
+export const run = async (pipeline: Pipeline): Promise<RunningPipeline> => {
+  // Ensure the pipeline is proper.
+  validate(pipeline);
+  // Translate steps into integers for lighter event annotations.
+  // Indices aren't reused, so that events emitted by steps being
+  // removed are never mistaken for events of their replacements.
+  let nextIndex = 0;
+  let stepIndices: Map<string, number> = new Map(
+    pipeline.steps.map(({ name }) => [name, nextIndex++])
+  );
+  const names: Map<number, string> = new Map(
+    Array.from(stepIndices.entries()).map(([name, index]) => [index, name])
+  );
+  const signatures: Map<number, string | undefined> = new Map(
+    pipeline.steps.map(({ name, signature }) => [
+      stepIndices.get(name) as number,
+      signature,
     ])
   );
+  let [edges, reverseEdges] = buildEdges(pipeline, stepIndices);
   // Initiate the central bus queue, a dead event list, and all the
   // steps.
   const busQueue = new AsyncQueue<[number, Event]>("bus");
   const deadEvents: Event[] = [];
+  // When tracing, the time each traced event entered each step is
+  // kept to start the step's spans, along with the last traced event
+  // that entered each step. The latter is the parent of spans of
+  // events that were rebuilt from external processes, and thus lost
+  // their trace context.
+  const entryTimes: WeakMap<SpanContext, Map<number, number>> = new WeakMap();
+  const lastEntered: Map<number, SpanContext> = new Map();
+  const traceEmitted = (index: number, event: Event): Event => {
+    const parent = event.spanContext ?? lastEntered.get(index);
+    const now = new Date().getTime();
+    const start =
+      typeof parent === "undefined"
+        ? now
+        : entryTimes.get(parent)?.get(index) ?? now;
+    // Emitted events are copied, since the same event may be
+    // emitted by several steps at once.
+    const emitted = new Event(
+      event.name,
+      event.data,
+      event.trace,
+      event.timestamp,
+      event.id
+    );
+    emitted.receipt = event.receipt;
+    emitted.spanContext = recordSpan(
+      names.get(index) as string,
+      event.name,
+      parent,
+      start
+    );
+    return emitted;
+  };
+  const traceEntered = (index: number, event: Event) => {
+    if (typeof event.spanContext === "undefined") {
+      return;
+    }
+    const times =
+      entryTimes.get(event.spanContext) ?? new Map<number, number>();
+    times.set(index, new Date().getTime());
+    entryTimes.set(event.spanContext, times);
+    lastEntered.set(index, event.spanContext);
+  };
   const makeSender =
     (index: number) =>
-    (...events: Event[]) => {
+    (...sentEvents: Event[]) => {
+      const step = names.get(index) as string;
+      const events = isTracing()
+        ? sentEvents.map((event) => traceEmitted(index, event))
+        : sentEvents;
       // Increase out-flow metrics of step.
-      stepEvents.inc(
-        {
-          step: pipeline.steps[index].name,
-          flow: "out",
-        },
-        events.length
+      stepEvents.inc({ step, flow: "out" }, events.length);
+      const now = new Date().getTime() / 1000;
+      // Events rebuilt by the step, which lost their receipts, keep
+      // the messages the step is working on from being acknowledged
+      // until they're delivered.
+      const rebuilt = events.filter(
+        (event) => typeof event.receipt === "undefined"
       );
-      // Send the event to the bus queue.
-      return events.forEach((event) => {
+      const combined = rebuilt.length > 0 ? combineIn(step) : undefined;
+      rebuilt.forEach((event) => {
+        event.receipt = combined;
+      });
+      // Send the event to the bus queue, which references the
+      // receipt of the message it came from while it's there.
+      events.forEach((event) => {
+        stepLatency.observe(
+          { step, prefix: namePrefix(event.name) },
+          Math.max(now - event.timestamp, 0)
+        );
+        hold(event.receipt);
         if (!busQueue.push([index, event])) {
-          logger.debug("Couldn't catch event", event.id, "in bus queue");
+          release(event.receipt);
+          logger
+            .with({ step, event: event.name })
+            .debug("Couldn't catch event", event.id, "in bus queue");
+          stepEvents.inc({ step, flow: "dead" });
           deadEvents.push(event);
           deadEventsMetric.set(deadEvents.length);
         }
       });
+      release(combined);
     };
+  // Steps are built within their own scope, so that the queues and
+  // work of their channels are accounted to them.
+  const buildStep = (step: StepDefinition, index: number): Promise<Step> =>
+    inStep(step.name, () => step.factory(makeSender(index)));
   const steps: Map<number, Step> = new Map(
     await Promise.all(
-      pipeline.steps.map(
-        async (step, index) =>
-          [index, await step.factory(makeSender(index))] as [number, Step]
-      )
+      pipeline.steps.map(async (step) => {
+        const index = stepIndices.get(step.name) as number;
+        return [index, await buildStep(step, index)] as [number, Step];
+      })
     )
   );
+  // Steps reference the receipts of the events they receive until
+  // they're idle, i.e. their queues are empty and they aren't working
+  // on anything, since by then every event derived from those was
+  // either emitted (and referenced again by the bus queue) or
+  // dropped.
+  const stepLoads: Map<string, QueueLoad> = new Map();
+  const releaseWhenIdle = async (step: string) => {
+    let load = stepLoads.get(step);
+    if (typeof load === "undefined") {
+      load = watchQueues((queue) => queue.step === step);
+      stepLoads.set(step, load);
+    }
+    const owners = [step, heldWorkOf(step)];
+    do {
+      await untilSettled(load, owners);
+    } while (!isSettled(load, owners));
+    releaseIn(step);
+  };
   // Prepare the main async generator.
   async function* digestEvents() {
     for await (const [sourceNodeIndex, event] of busQueue.iterator()) {
-      const nextNodeIndices = edges.get(sourceNodeIndex) ?? [];
+      // Steps that were removed don't receive events anymore.
+      const nextNodeIndices = (edges.get(sourceNodeIndex) ?? []).filter(
+        (nodeIndex) => steps.has(nodeIndex)
+      );
       logger.debug(
         "Got event",
         event.id,
@@ -194,13 +346,30 @@ export const run = async (
       // Increase in-flow metrics of next steps.
       nextNodeIndices.forEach((nodeIndex) =>
         stepEvents.inc({
-          step: pipeline.steps[nodeIndex].name,
+          step: names.get(nodeIndex) as string,
           flow: "in",
         })
       );
       // Send the events to the next steps.
       const sent = nextNodeIndices
-        .map((nodeIndex) => (steps.get(nodeIndex) as Step).send(event))
+        .map((nodeIndex) => {
+          if (isTracing()) {
+            traceEntered(nodeIndex, event);
+          }
+          const name = names.get(nodeIndex) as string;
+          const first = holdIn(name, event);
+          const s = (steps.get(nodeIndex) as Step).send(event);
+          if (first) {
+            releaseWhenIdle(name);
+          }
+          if (!s) {
+            stepEvents.inc({
+              step: names.get(nodeIndex) as string,
+              flow: "dead",
+            });
+          }
+          return s;
+        })
         .every((s) => s);
       if (!sent) {
         logger.debug(
@@ -212,6 +381,9 @@ export const run = async (
         deadEvents.push(event);
         deadEventsMetric.set(deadEvents.length);
       }
+      // The bus queue's reference is given up once the event was
+      // handed to the next steps.
+      release(event.receipt);
       if (nextNodeIndices.length === 0) {
         yield event;
       }
@@ -222,14 +394,13 @@ export const run = async (
       await deadLetter.handler(deadEvents);
     }
   }
-  // Prepare the closing procedure.
-  const close = async () => {
-    // Sort steps in ascending order of dependency levels, and close
-    // the queues in that order.
-    const pool: Set<number> = new Set(steps.keys());
+  // Sort the given steps in ascending order of dependency levels, and
+  // close their queues in that order.
+  const closeSteps = async (indices: number[]) => {
+    const pool: Set<number> = new Set(indices);
     while (pool.size > 0) {
       const toRemove = Array.from(pool).filter((stepIndex) =>
-        (reverseEdges.get(stepIndex) as number[]).every((i) => !pool.has(i))
+        (reverseEdges.get(stepIndex) ?? []).every((i) => !pool.has(i))
       );
       await Promise.all(toRemove.map((i) => (steps.get(i) as Step).close()));
       for (const i of toRemove) {
@@ -239,16 +410,133 @@ export const run = async (
       // propagate.
       await resolveAfter(0);
     }
+  };
+  // Prepare the reconfiguration procedure.
+  let closing = false;
+  const applyConfiguration = async (next: Pipeline) => {
+    if (closing) {
+      throw new Error("the pipeline is shutting down");
+    }
+    validate(next);
+    const nextIndices: Map<string, number> = new Map();
+    const added: StepDefinition[] = [];
+    for (const step of next.steps) {
+      const current = stepIndices.get(step.name);
+      if (
+        typeof current !== "undefined" &&
+        typeof step.signature !== "undefined" &&
+        signatures.get(current) === step.signature
+      ) {
+        nextIndices.set(step.name, current);
+      } else {
+        nextIndices.set(step.name, nextIndex++);
+        added.push(step);
+      }
+    }
+    // New steps are started before modifying the topology, so that a
+    // failure leaves the running pipeline untouched.
+    const started: [number, Step][] = [];
+    try {
+      for (const step of added) {
+        const index = nextIndices.get(step.name) as number;
+        names.set(index, step.name);
+        started.push([index, await buildStep(step, index)]);
+      }
+    } catch (err) {
+      await Promise.all(started.map(([, step]) => step.close()));
+      added.forEach((step) =>
+        names.delete(nextIndices.get(step.name) as number)
+      );
+      throw err;
+    }
+    const kept = new Set(nextIndices.values());
+    const removed = Array.from(stepIndices.values()).filter(
+      (index) => !kept.has(index)
+    );
+    const [nextEdges, nextReverseEdges] = buildEdges(next, nextIndices);
+    // Removed steps keep their edges while they drain, so that their
+    // pending events reach the steps that follow them, if those are
+    // still running.
+    for (const index of removed) {
+      nextEdges.set(index, edges.get(index) ?? []);
+      nextReverseEdges.set(index, reverseEdges.get(index) ?? []);
+    }
+    for (const [index, step] of started) {
+      steps.set(index, step);
+    }
+    added.forEach((step) =>
+      signatures.set(nextIndices.get(step.name) as number, step.signature)
+    );
+    edges = nextEdges;
+    reverseEdges = nextReverseEdges;
+    stepIndices = nextIndices;
+    logger.info(
+      "Reconfigured pipeline:",
+      added.length,
+      "step(s) started,",
+      removed.length,
+      "step(s) being removed"
+    );
+    await closeSteps(removed);
+    for (const index of removed) {
+      steps.delete(index);
+      names.delete(index);
+      signatures.delete(index);
+      edges.delete(index);
+      reverseEdges.delete(index);
+      lastEntered.delete(index);
+    }
+    for (const [step, load] of stepLoads.entries()) {
+      if (!stepIndices.has(step)) {
+        stepLoads.delete(step);
+        unwatchQueues(load);
+      }
+    }
+  };
+  // Reconfigurations are applied one at a time.
+  let reconfiguring: Promise<void> = Promise.resolve();
+  const reconfigure = (next: Pipeline): Promise<void> => {
+    const applied = reconfiguring.then(() => applyConfiguration(next));
+    reconfiguring = applied.catch(() => undefined);
+    return applied;
+  };
+  // Prepare the closing procedure.
+  const close = async () => {
+    closing = true;
+    await reconfiguring;
+    await closeSteps(Array.from(steps.keys()));
     // Close the bus queue and drain it.
     busQueue.close();
     await busQueue.drain;
+    stepLoads.forEach(unwatchQueues);
+    stepLoads.clear();
   };
   return {
     send: (...events: Event[]) =>
       events
-        .map((event) => busQueue.push([inputNodeIndex, event]))
+        .map((event) => {
+          if (isTracing()) {
+            // The input's span starts at the event's arrival, and is
+            // the child of any trace context propagated to it.
+            event.spanContext = recordSpan(
+              INPUT_ALIAS,
+              event.name,
+              event.spanContext,
+              event.timestamp * 1000
+            );
+          }
+          // Events sent by the input already reference the receipt
+          // of the message they came in, which the bus queue takes
+          // over.
+          const sent = busQueue.push([INPUT_NODE_INDEX, event]);
+          if (!sent) {
+            release(event.receipt);
+          }
+          return sent;
+        })
         .every((sent) => sent),
     receive: digestEvents(),
     close,
+    reconfigure,
   };
 };
@@ -0,0 +1,278 @@
+import { match, P } from "ts-pattern";
+import {
+  CircuitBreakerOptions,
+  OpenCircuitError,
+  makeCircuitBreaker,
+} from "./circuit-breaker";
+import { FailureReporter } from "./dead-letter";
+import { DeliveryMode, failDelivery } from "./delivery";
+import { Event } from "./event";
+import { makeLogger } from "./log";
+import { check } from "./utils";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("retry");
+
+/**
+ * Options for retrying the delivery of events to external systems.
+ */
+export type RetryOptions = {
+  attempts?: number | string;
+  delay?: number | string;
+  multiplier?: number | string;
+  "max-delay"?: number | string;
+  jitter?: number | string;
+  "on-exhausted"?: "drop" | "dead-letter";
+};
+
+/**
+ * Schema for a non-negative amount.
+ */
+const amountSchema = {
+  anyOf: [
+    { type: "number", minimum: 0 },
+    { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+  ],
+};
+
+/**
+ * An ajv schema for the retry options.
+ */
+export const retryOptionsSchema = {
+  type: "object",
+  properties: {
+    attempts: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    delay: amountSchema,
+    multiplier: {
+      anyOf: [
+        { type: "number", minimum: 1 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    "max-delay": amountSchema,
+    jitter: {
+      anyOf: [
+        { type: "number", minimum: 0, maximum: 1 },
+        { type: "string", pattern: "^(0(\\.[0-9]+)?|1(\\.0+)?)$" },
+      ],
+    },
+    "on-exhausted": { enum: ["drop", "dead-letter"] },
+  },
+  additionalProperties: false,
+};
+
+/**
+ * Parse an amount given as an option.
+ *
+ * @param value The option's value.
+ * @returns The amount.
+ */
+const parseAmount = (value: number | string): number =>
+  typeof value === "string" ? parseFloat(value) : value;
+
+/**
+ * Validate retry options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step the options belong to.
+ * @param prefix The path of the options within the step function,
+ * used for error messages.
+ * @param options The options to validate.
+ */
+export const validateRetryOptions = (
+  name: string,
+  prefix: string,
+  options: RetryOptions
+): void => {
+  check(
+    match(options).with(
+      { multiplier: P.select(P.string) },
+      (multiplier) => parseFloat(multiplier) >= 1
+    ),
+    `step '${name}' uses an invalid ${prefix}.multiplier value (must be >= 1)`
+  );
+};
+
+/**
+ * Default total amount of attempts made for each delivery.
+ */
+const DEFAULT_ATTEMPTS = 3;
+
+/**
+ * Default amount of seconds waited before the first retry.
+ */
+const DEFAULT_DELAY = 1;
+
+/**
+ * Default factor applied to the delay after each retry.
+ */
+const DEFAULT_MULTIPLIER = 2;
+
+/**
+ * Default maximum amount of seconds waited between attempts.
+ */
+const DEFAULT_MAX_DELAY = 30;
+
+/**
+ * A procedure that retries deliveries, and that can be stopped to cut
+ * pending delays short.
+ */
+export interface Retrier {
+  /**
+   * Attempt a delivery until it succeeds or attempts are exhausted,
+   * in which case the events are dead-lettered or dropped. The
+   * returned promise never rejects.
+   *
+   * @param events The events being delivered, which are the ones
+   * dead-lettered if every attempt fails. Deliveries of processed
+   * payloads give no events, and are dropped instead.
+   * @param attempt The procedure that makes a single attempt.
+   */
+  run: (events: Event[], attempt: () => Promise<void>) => Promise<void>;
+  /**
+   * Stop waiting between attempts. Pending and further deliveries
+   * are given up after their current attempt fails.
+   */
+  stop: () => void;
+}
+
+/**
+ * Compute the amount of milliseconds to wait before the given retry,
+ * using exponential backoff. Jitter shortens the wait by a random
+ * fraction, so that the result never exceeds the maximum delay.
+ *
+ * @param retry The number of the retry, starting from 1.
+ * @param delay The delay before the first retry, in milliseconds.
+ * @param multiplier The factor applied to the delay on each retry.
+ * @param maxDelay The maximum delay, in milliseconds.
+ * @param jitter The maximum fraction by which the delay is shortened.
+ * @returns The amount of milliseconds to wait.
+ */
+export const backoff = (
+  retry: number,
+  delay: number,
+  multiplier: number,
+  maxDelay: number,
+  jitter: number
+): number =>
+  Math.min(delay * multiplier ** (retry - 1), maxDelay) *
+  (1 - jitter * Math.random());
+
+/**
+ * Build a retrier for the deliveries of a step.
+ *
+ * @param stepName The name of the step making deliveries.
+ * @param options The options that indicate how to retry deliveries,
+ * or undefined to make a single attempt for each one.
+ * @param reportFailure The procedure that dead-letters events, if the
+ * step has a dead-letter name.
+ * @param delivery The delivery mode of the step. Deliveries given up
+ * in at-least-once mode without being dead-lettered fail the
+ * acknowledgement of the messages the events came from.
+ * @param breakerOptions The options of the circuit breaker guarding
+ * the attempts, if any. Deliveries rejected by an open circuit are
+ * given up immediately, and their events are dead-lettered if the
+ * step has a dead-letter name.
+ * @returns The retrier.
+ */
+export const makeRetrier = (
+  stepName: string,
+  options?: RetryOptions,
+  reportFailure?: FailureReporter,
+  delivery?: DeliveryMode,
+  breakerOptions?: CircuitBreakerOptions
+): Retrier => {
+  const attempts =
+    typeof options === "undefined"
+      ? 1
+      : parseAmount(options.attempts ?? DEFAULT_ATTEMPTS);
+  const delay = parseAmount(options?.delay ?? DEFAULT_DELAY) * 1000;
+  const multiplier = parseAmount(options?.multiplier ?? DEFAULT_MULTIPLIER);
+  const maxDelay =
+    parseAmount(options?.["max-delay"] ?? DEFAULT_MAX_DELAY) * 1000;
+  const jitter = parseAmount(options?.jitter ?? 0);
+  const deadLetter = options?.["on-exhausted"] === "dead-letter";
+  if (deadLetter && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${stepName}' doesn't have a dead-letter name; ` +
+        "undelivered events will be dropped"
+    );
+  }
+  const breaker =
+    typeof breakerOptions === "undefined"
+      ? undefined
+      : makeCircuitBreaker(stepName, breakerOptions);
+  let stopped = false;
+  // Pending waits, which are resolved early when the retrier stops.
+  const waits = new Map<ReturnType<typeof setTimeout>, () => void>();
+  const wait = (t: number): Promise<void> =>
+    new Promise((resolve) => {
+      const timer = setTimeout(() => {
+        waits.delete(timer);
+        resolve();
+      }, t);
+      waits.set(timer, resolve);
+    });
+
+  return {
+    run: async (events, attempt) => {
+      const guarded =
+        typeof breaker === "undefined" ? attempt : () => breaker.call(attempt);
+      let error: unknown = null;
+      for (let n = 1; n <= attempts; n++) {
+        try {
+          await guarded();
+          return;
+        } catch (err) {
+          error = err;
+        }
+        if (n === attempts || stopped || error instanceof OpenCircuitError) {
+          break;
+        }
+        const t = backoff(n, delay, multiplier, maxDelay, jitter);
+        logger.info(
+          `Delivery failed in step '${stepName}': ${error}; ` +
+            `retrying in ${(t / 1000).toFixed(3)} seconds...`
+        );
+        await wait(t);
+        if (stopped) {
+          break;
+        }
+      }
+      // Deliveries rejected by an open circuit are short-circuited to
+      // the dead-letter path.
+      const shortCircuited = error instanceof OpenCircuitError;
+      if (
+        (deadLetter || shortCircuited) &&
+        typeof reportFailure !== "undefined" &&
+        events.length > 0
+      ) {
+        await reportFailure(events, error);
+      } else {
+        if (shortCircuited) {
+          logger.debug(`Step '${stepName}' gave up on a delivery: ${error}`);
+        } else {
+          logger.warn(`Step '${stepName}' gave up on a delivery: ${error}`);
+        }
+        if (delivery === "at-least-once") {
+          failDelivery(events);
+        }
+      }
+    },
+    stop: () => {
+      stopped = true;
+      for (const [timer, resolve] of waits.entries()) {
+        clearTimeout(timer);
+        resolve();
+      }
+      waits.clear();
+    },
+  };
+};
@@ -0,0 +1,348 @@
+import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
+import { Channel, AsyncQueue } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * An aggregation computed for each key: a count of events, or an
+ * operation over a numeric value extracted from each event with a jq
+ * expression.
+ */
+type Aggregation =
+  | "count"
+  | { sum: string }
+  | { min: string }
+  | { max: string }
+  | { avg: string };
+
+/**
+ * Options for this function.
+ */
+export type AggregateFunctionOptions = {
+  interval: number | string;
+  aggregations: { [field: string]: Aggregation };
+  "key-jq-expr"?: string;
+  mode?: "tumbling" | "cumulative";
+  ttl?: number | string;
+  suffix?: string;
+};
+
+/**
+ * Schema for a positive amount of seconds.
+ */
+const secondsSchema = {
+  anyOf: [
+    { type: "number", exclusiveMinimum: 0 },
+    { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+  ],
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    interval: secondsSchema,
+    aggregations: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [
+          { enum: ["count"] },
+          ...["sum", "min", "max", "avg"].map((operation) => ({
+            type: "object",
+            properties: {
+              [operation]: { type: "string", minLength: 1 },
+            },
+            additionalProperties: false,
+            required: [operation],
+          })),
+        ],
+      },
+      minProperties: 1,
+    },
+    "key-jq-expr": { type: "string", minLength: 1 },
+    mode: { enum: ["tumbling", "cumulative"] },
+    ttl: secondsSchema,
+    suffix: { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["interval", "aggregations"],
+};
+
+/**
+ * Parse an amount of seconds given as an option.
+ *
+ * @param value The option's value.
+ * @returns The amount of seconds.
+ */
+const parseSeconds = (value: number | string): number =>
+  typeof value === "string" ? parseFloat(value) : value;
+
+/**
+ * Validate aggregate options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: AggregateFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { interval: P.select() },
+      (interval) => parseSeconds(interval) > 0
+    ),
+    `step '${name}' uses an invalid aggregate.interval value (must be > 0)`
+  );
+  check(
+    matchOptions.with(
+      { ttl: P.select(P.string) },
+      (ttl) => parseFloat(ttl) > 0
+    ),
+    `step '${name}' uses an invalid aggregate.ttl value (must be > 0)`
+  );
+  check(
+    matchOptions
+      .with({ ttl: P._, mode: "cumulative" }, () => true)
+      .with({ ttl: P._ }, () => false),
+    `step '${name}' can use aggregate.ttl only when aggregate.mode is 'cumulative'`
+  );
+  check(
+    matchOptions.with({ suffix: P.select(P.string) }, isValidEventName),
+    `step '${name}' uses an invalid aggregate.suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default suffix appended to the name of the aggregated events.
+ */
+const DEFAULT_SUFFIX = "aggregate";
+
+/**
+ * Default amount of seconds after which idle keys are forgotten, in
+ * the cumulative mode.
+ */
+const DEFAULT_TTL = 3600;
+
+/**
+ * The accumulated state of a single numeric aggregation.
+ */
+interface Accumulator {
+  n: number;
+  sum: number;
+  min: number;
+  max: number;
+}
+
+/**
+ * The accumulated state of the events of a single name and key.
+ */
+interface Group {
+  name: string;
+  key: unknown;
+  start: number;
+  lastSeen: number;
+  last: Event;
+  count: number;
+  accumulators: Accumulator[];
+}
+
+/**
+ * Computes the final value of an aggregation.
+ *
+ * @param aggregation The aggregation.
+ * @param group The group holding the accumulated state.
+ * @param accumulator The accumulated state of the aggregation.
+ * @returns The aggregated value.
+ */
+const finish = (
+  aggregation: Aggregation,
+  group: Group,
+  accumulator: Accumulator
+): number | null =>
+  match(aggregation)
+    .with("count", () => group.count)
+    .with({ sum: P._ }, () => accumulator.sum)
+    .with({ min: P._ }, () => (accumulator.n > 0 ? accumulator.min : null))
+    .with({ max: P._ }, () => (accumulator.n > 0 ? accumulator.max : null))
+    .with({ avg: P._ }, () =>
+      accumulator.n > 0 ? accumulator.sum / accumulator.n : null
+    )
+    .exhaustive();
+
+/**
+ * The names of the events aggregate may emit, given the names of the
+ * events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: AggregateFunctionOptions,
+  names: EventNames
+): EventNames =>
+  names?.map((name) => `${name}.${options.suffix ?? DEFAULT_SUFFIX}`) ??
+  null;
+
+/**
+ * Function that accumulates aggregations over the events of each name
+ * and key, and periodically emits an event for each one holding the
+ * aggregated values. In the tumbling mode, aggregations start over
+ * after each emission; in the cumulative mode they're kept until the
+ * key is idle for too long.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to aggregate events.
+ * @returns A channel that aggregates events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: AggregateFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const interval = parseSeconds(options.interval) * 1000;
+  const cumulative = options.mode === "cumulative";
+  const ttl = parseSeconds(options.ttl ?? DEFAULT_TTL) * 1000;
+  const suffix = options.suffix ?? DEFAULT_SUFFIX;
+  const fields = Object.entries(options.aggregations);
+  // The key and every aggregated value are extracted with a single
+  // jq program for each vector.
+  const extractor = await jqProcessor.makeChannel<Event[]>(
+    makeExtractionProgram(
+      options["key-jq-expr"],
+      ...fields.map(([, aggregation]) =>
+        match(aggregation)
+          .with("count", () => undefined)
+          .with({ sum: P.select() }, (expr) => expr)
+          .with({ min: P.select() }, (expr) => expr)
+          .with({ max: P.select() }, (expr) => expr)
+          .with({ avg: P.select() }, (expr) => expr)
+          .exhaustive()
+      )
+    ),
+    { prelude: params["jq-prelude"] }
+  );
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.aggregate.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.aggregate.output`
+  );
+  const groups = new Map<string, Group>();
+  // Aggregates are emitted in order, even though building the events
+  // is asynchronous.
+  let emitting: Promise<void> = Promise.resolve();
+  // The moment of the latest emission, which starts the current
+  // interval.
+  let emittedAt = new Date().getTime();
+
+  const emitAll = () => {
+    const now = new Date().getTime();
+    const intervalStart = emittedAt;
+    emittedAt = now;
+    const emitted = Array.from(groups.entries());
+    for (const [groupKey, group] of emitted) {
+      if (!cumulative || now - group.lastSeen >= ttl) {
+        groups.delete(groupKey);
+      }
+    }
+    emitting = emitting.then(async () => {
+      for (const [, group] of emitted) {
+        outputQueue.push(
+          await makeFrom(group.last, {
+            name: `${group.name}.${suffix}`,
+            data: {
+              key: group.key,
+              start: (cumulative ? group.start : intervalStart) / 1000,
+              end: now / 1000,
+              aggregates: Object.fromEntries(
+                fields.map(([field, aggregation], index) => [
+                  field,
+                  finish(aggregation, group, group.accumulators[index]),
+                ])
+              ),
+            },
+          })
+        );
+      }
+    });
+  };
+  const timer = setInterval(emitAll, interval);
+
+  const accumulate = (event: Event, [key, ...values]: unknown[]) => {
+    const now = new Date().getTime();
+    const groupKey = encodeJson([event.name, key ?? null]);
+    let group = groups.get(groupKey);
+    if (typeof group === "undefined") {
+      group = {
+        name: event.name,
+        key: key ?? null,
+        start: now,
+        lastSeen: now,
+        last: event,
+        count: 0,
+        accumulators: fields.map(() => ({
+          n: 0,
+          sum: 0,
+          min: Infinity,
+          max: -Infinity,
+        })),
+      };
+      groups.set(groupKey, group);
+    }
+    group.lastSeen = now;
+    group.last = event;
+    group.count++;
+    group.accumulators.forEach((accumulator, index) => {
+      const value = values[index];
+      // Values that aren't numbers are left out of aggregations.
+      if (typeof value === "number" && isFinite(value)) {
+        accumulator.n++;
+        accumulator.sum += value;
+        accumulator.min = Math.min(accumulator.min, value);
+        accumulator.max = Math.max(accumulator.max, value);
+      }
+    });
+  };
+
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      const extracted: unknown[][] =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+      events.forEach((event, index) =>
+        accumulate(event, extracted[index] ?? [null])
+      );
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      await inputChannel.close();
+      await processing;
+      clearInterval(timer);
+      // Every group is flushed on shutdown.
+      if (groups.size > 0) {
+        emitAll();
+      }
+      await emitting;
+      await extractor.close();
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
@@ -0,0 +1,167 @@
+import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
+import { Channel, AsyncQueue } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * Options for this function.
+ */
+export type BatchFunctionOptions = {
+  size: number | string;
+  "max-age"?: number | string;
+  name?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    size: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "max-age": {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    name: { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["size"],
+};
+
+/**
+ * Validate batch options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: BatchFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { "max-age": P.select(P.string) },
+      (maxAge) => parseFloat(maxAge) > 0
+    ),
+    `step '${name}' uses an invalid batch.max-age value (must be > 0)`
+  );
+  check(
+    matchOptions.with({ name: P.select(P.string) }, isValidEventName),
+    `step '${name}' uses an invalid batch.name value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default name given to the batch events.
+ */
+const DEFAULT_NAME = "batch";
+
+/**
+ * The names of the events batch may emit, which is always the same
+ * regardless of the events it receives.
+ *
+ * @param options The function's options.
+ * @returns The names of the events emitted.
+ */
+export const emits = (options: BatchFunctionOptions): EventNames => [
+  options.name ?? DEFAULT_NAME,
+];
+
+/**
+ * Function that accumulates events and emits them as a single event
+ * once the batch reaches its size, or its first event reaches the
+ * maximum age, whichever comes first. The emitted event's data is the
+ * array of the batched events' data.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to build batches.
+ * @returns A channel that groups events in batches.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: BatchFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const size =
+    typeof options.size === "string"
+      ? parseInt(options.size, 10)
+      : options.size;
+  const maxAge =
+    typeof options["max-age"] === "string"
+      ? parseFloat(options["max-age"]) * 1000
+      : typeof options["max-age"] === "number"
+      ? options["max-age"] * 1000
+      : null;
+  const name = options.name ?? DEFAULT_NAME;
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.batch.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.batch.output`
+  );
+  let batch: Event[] = [];
+  let timeout: ReturnType<typeof setTimeout> | null = null;
+  // Batches are emitted in order, even though building the events is
+  // asynchronous.
+  let emitting: Promise<void> = Promise.resolve();
+
+  const flush = () => {
+    if (timeout !== null) {
+      clearTimeout(timeout);
+      timeout = null;
+    }
+    if (batch.length === 0) {
+      return;
+    }
+    const events = batch;
+    batch = [];
+    emitting = emitting.then(async () => {
+      const event = await makeFrom(events[events.length - 1], {
+        name,
+        data: events.map((e) => e.data),
+      });
+      outputQueue.push(event);
+    });
+  };
+
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      for (const event of events) {
+        batch.push(event);
+        if (batch.length >= size) {
+          flush();
+        } else if (timeout === null && maxAge !== null) {
+          // The timer starts with the first event of each batch.
+          timeout = setTimeout(flush, maxAge);
+        }
+      }
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      await inputChannel.close();
+      await processing;
+      // The partial batch is flushed on shutdown.
+      flush();
+      await emitting;
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
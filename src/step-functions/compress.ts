@@ -0,0 +1,147 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { CompressionAlgorithm, compress } from "../io/compression";
+import { encodeJson } from "../json";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/compress");
+
+/**
+ * Options for this function.
+ */
+export type CompressFunctionOptions = {
+  algorithm?: CompressionAlgorithm;
+  level?: number | string;
+  encoding?: "base64" | "raw";
+  "on-error"?: "drop" | "dead-letter";
+} | null;
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    {
+      type: "object",
+      properties: {
+        algorithm: { enum: ["gzip", "zstd"] },
+        level: {
+          anyOf: [
+            { type: "integer", minimum: 1, maximum: 22 },
+            { type: "string", pattern: "^[0-9]+$" },
+          ],
+        },
+        encoding: { enum: ["base64", "raw"] },
+        "on-error": { enum: ["drop", "dead-letter"] },
+      },
+      additionalProperties: false,
+      required: [],
+    },
+    { type: "null" },
+  ],
+};
+
+/**
+ * Parse the compression level given as an option.
+ *
+ * @param value The option's value.
+ * @returns The compression level.
+ */
+const parseLevel = (value: number | string): number =>
+  typeof value === "string" ? parseInt(value, 10) : value;
+
+/**
+ * Validate compress options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: CompressFunctionOptions
+): void => {
+  if (options === null || typeof options.level === "undefined") {
+    return;
+  }
+  const level = parseLevel(options.level);
+  const maxLevel = (options.algorithm ?? "gzip") === "gzip" ? 9 : 22;
+  if (level < 1 || level > maxLevel) {
+    throw new Error(
+      `step '${name}' uses an invalid compress.level value ` +
+        `(must be between 1 and ${maxLevel})`
+    );
+  }
+};
+
+/**
+ * Each event's data is compressed on its own.
+ */
+export const stateless = true;
+
+/**
+ * Function that compresses each event's data, serialized as JSON, and
+ * replaces it with a string holding the compressed bytes. Events that
+ * can't be compressed are dropped, or re-emitted as dead-letter
+ * events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to compress and
+ * encode the data.
+ * @returns A channel that compresses events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: CompressFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const algorithm = options?.algorithm ?? "gzip";
+  const level =
+    typeof options?.level === "undefined"
+      ? undefined
+      : parseLevel(options.level);
+  const encoding = options?.encoding === "raw" ? "latin1" : "base64";
+  const onError = options?.["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be compressed will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const deflate = async (event: Event): Promise<Event | null> => {
+    try {
+      const compressed = await compress(
+        Buffer.from(encodeJson(event.data)),
+        algorithm,
+        level
+      );
+      return await makeFrom(event, { data: compressed.toString(encoding) });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't compress event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.compress`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(deflate))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
@@ -0,0 +1,144 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { decodeJson } from "../json";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/debatch");
+
+/**
+ * Options for this function.
+ */
+export type DebatchFunctionOptions = {
+  index?: boolean | "true" | "false";
+  "on-error"?: "drop" | "dead-letter";
+} | null;
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    {
+      type: "object",
+      properties: {
+        index: {
+          anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+        },
+        "on-error": { enum: ["drop", "dead-letter"] },
+      },
+      additionalProperties: false,
+      required: [],
+    },
+    { type: "null" },
+  ],
+};
+
+/**
+ * Validate debatch options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Split the data of an event in the records it holds: the elements
+ * of an array, or the values in each non-blank line of an NDJSON
+ * string. Throws an error if the data is neither of those.
+ *
+ * @param data The data of an event.
+ * @returns The records found in the data.
+ */
+export const splitRecords = (data: unknown): unknown[] => {
+  if (Array.isArray(data)) {
+    return data;
+  }
+  if (typeof data === "string") {
+    return data
+      .split("\n")
+      .filter((line) => line.trim().length > 0)
+      .map((line, index) => {
+        try {
+          return decodeJson(line);
+        } catch (err) {
+          throw new Error(`record ${index + 1} isn't valid JSON: ${err}`);
+        }
+      });
+  }
+  throw new Error("the event's data is neither an array nor a string");
+};
+
+/**
+ * Each event is split on its own.
+ */
+export const stateless = true;
+
+/**
+ * Function that splits each event it receives in one event per
+ * record contained in its data, which must be an array or an NDJSON
+ * string. It reverts the batch function. The emitted events keep the
+ * name and trace of the event they come from, and their data may be
+ * wrapped along with the record's position. Events that hold no
+ * records produce nothing, and events that can't be split are
+ * dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how records are emitted.
+ * @returns A channel that splits events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: DebatchFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const index =
+    typeof options?.index === "string"
+      ? options.index === "true"
+      : options?.index ?? false;
+  const onError = options?.["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be split will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const split = async (event: Event): Promise<Event[]> => {
+    let records;
+    try {
+      records = splitRecords(event.data);
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't split event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return [];
+    }
+    return Promise.all(
+      records.map((record, position) =>
+        makeFrom(event, {
+          data: index ? { index: position, value: record } : record,
+        })
+      )
+    );
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.debatch`);
+  return flatMap(
+    async (events: Event[]) => (await Promise.all(events.map(split))).flat(),
+    queue.asChannel()
+  );
+};
@@ -0,0 +1,132 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { decodeAvro, unframe } from "../io/avro";
+import { makeSchemaRegistry } from "../io/schema-registry";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/decode-avro");
+
+/**
+ * Options for this function.
+ */
+export type DecodeAvroFunctionOptions =
+  | string
+  | {
+      registry: string;
+      headers?: { [key: string]: string | number | boolean };
+      encoding?: "base64" | "raw";
+      "on-error"?: "drop" | "dead-letter";
+    };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        registry: { type: "string", minLength: 1 },
+        headers: {
+          type: "object",
+          properties: {},
+          additionalProperties: {
+            anyOf: [
+              { type: "string" },
+              { type: "number" },
+              { type: "boolean" },
+            ],
+          },
+        },
+        encoding: { enum: ["base64", "raw"] },
+        "on-error": { enum: ["drop", "dead-letter"] },
+      },
+      additionalProperties: false,
+      required: ["registry"],
+    },
+  ],
+};
+
+/**
+ * Validate decode-avro options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Decoding depends on each event alone (fetched schemas are only
+ * cached).
+ */
+export const stateless = true;
+
+/**
+ * Function that decodes each event's data, which must be a string
+ * holding Avro binary data framed for the Confluent Schema Registry,
+ * and replaces it with the decoded value. The schema is fetched from
+ * the registry by the id found in the frame, and cached. Events that
+ * can't be decoded are dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate where the registry is and
+ * how the data is encoded.
+ * @returns A channel that decodes events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: DecodeAvroFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const { registry: url, ...rest } =
+    typeof options === "string" ? { registry: options } : options;
+  const registry = makeSchemaRegistry(url, rest.headers);
+  const encoding = rest.encoding === "raw" ? "latin1" : "base64";
+  const onError = rest["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be decoded will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const decode = async (event: Event): Promise<Event | null> => {
+    try {
+      if (typeof event.data !== "string") {
+        throw new Error("the event's data is not a string");
+      }
+      const [id, payload] = unframe(Buffer.from(event.data, encoding));
+      const type = await registry.schemaById(id);
+      return await makeFrom(event, { data: decodeAvro(type, payload) });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't decode event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.decode-avro`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(decode))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
@@ -0,0 +1,124 @@
+import { promises as fs } from "fs";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { loadDescriptorSet, makeProtobufDecoder } from "../io/protobuf";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/decode-protobuf");
+
+/**
+ * Options for this function.
+ */
+export type DecodeProtobufFunctionOptions = {
+  "descriptor-set": string;
+  "message-type": string;
+  "raw-bytes-as-base64"?: boolean | "true" | "false";
+  "on-error"?: "drop" | "dead-letter";
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    "descriptor-set": { type: "string", minLength: 1 },
+    "message-type": { type: "string", minLength: 1 },
+    "raw-bytes-as-base64": {
+      anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+    },
+    "on-error": { enum: ["drop", "dead-letter"] },
+  },
+  additionalProperties: false,
+  required: ["descriptor-set", "message-type"],
+};
+
+/**
+ * Validate decode-protobuf options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Decoding depends on each event alone.
+ */
+export const stateless = true;
+
+/**
+ * Function that decodes each event's data, which must be a string
+ * holding an encoded protobuf message of the configured type, and
+ * replaces it with the message's proto3 JSON mapping. The message
+ * type is taken from a compiled descriptor set. Events that can't be
+ * decoded are dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the message type and how
+ * the data is encoded.
+ * @returns A channel that decodes events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: DecodeProtobufFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const decodeMessage = makeProtobufDecoder(
+    loadDescriptorSet(await fs.readFile(options["descriptor-set"])),
+    options["message-type"]
+  );
+  const base64 =
+    typeof options["raw-bytes-as-base64"] === "string"
+      ? options["raw-bytes-as-base64"] === "true"
+      : options["raw-bytes-as-base64"] ?? true;
+  const onError = options["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be decoded will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const decode = async (event: Event): Promise<Event | null> => {
+    try {
+      if (typeof event.data !== "string") {
+        throw new Error("the event's data is not a string");
+      }
+      return await makeFrom(event, {
+        data: decodeMessage(
+          Buffer.from(event.data, base64 ? "base64" : "latin1")
+        ),
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't decode event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.decode-protobuf`
+  );
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(decode))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
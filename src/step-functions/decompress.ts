@@ -0,0 +1,118 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { CompressionAlgorithm, decompress } from "../io/compression";
+import { decodeJson } from "../json";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/decompress");
+
+/**
+ * Options for this function.
+ */
+export type DecompressFunctionOptions = {
+  algorithm?: CompressionAlgorithm | "auto";
+  encoding?: "base64" | "raw";
+  "on-error"?: "drop" | "dead-letter";
+} | null;
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    {
+      type: "object",
+      properties: {
+        algorithm: { enum: ["auto", "gzip", "zstd"] },
+        encoding: { enum: ["base64", "raw"] },
+        "on-error": { enum: ["drop", "dead-letter"] },
+      },
+      additionalProperties: false,
+      required: [],
+    },
+    { type: "null" },
+  ],
+};
+
+/**
+ * Validate decompress options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Each event's data is decompressed on its own.
+ */
+export const stateless = true;
+
+/**
+ * Function that decompresses each event's data, which must be a
+ * string holding the compressed bytes, and replaces it with the JSON
+ * value it decompresses to. Events that can't be decompressed are
+ * dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how the data is
+ * compressed and encoded.
+ * @returns A channel that decompresses events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: DecompressFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const algorithm = options?.algorithm ?? "auto";
+  const encoding = options?.encoding === "raw" ? "latin1" : "base64";
+  const onError = options?.["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be decompressed will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const inflate = async (event: Event): Promise<Event | null> => {
+    try {
+      if (typeof event.data !== "string") {
+        throw new Error("the event's data is not a string");
+      }
+      const decompressed = await decompress(
+        Buffer.from(event.data, encoding),
+        algorithm
+      );
+      return await makeFrom(event, {
+        data: decodeJson(decompressed.toString()),
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't decompress event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.decompress`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(inflate))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
@@ -0,0 +1,127 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { decrypt, parseIdentity } from "../io/age";
+import { decodeJson } from "../json";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/decrypt");
+
+/**
+ * Options for this function.
+ */
+export type DecryptFunctionOptions = {
+  identities: string[];
+  "on-error"?: "drop" | "dead-letter";
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    identities: {
+      type: "array",
+      items: { type: "string", minLength: 1 },
+      minItems: 1,
+    },
+    "on-error": { enum: ["drop", "dead-letter"] },
+  },
+  additionalProperties: false,
+  required: ["identities"],
+};
+
+/**
+ * Validate decrypt options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: DecryptFunctionOptions
+): void => {
+  options.identities.forEach((identity, index) => {
+    // Identities are secret, so they're left out of the message.
+    if (parseIdentity(identity) === null) {
+      throw new Error(
+        `step '${name}' uses an invalid identity in decrypt.identities ` +
+          `(item #${index + 1} must be an age X25519 identity)`
+      );
+    }
+  });
+};
+
+/**
+ * Decryption depends on each event alone.
+ */
+export const stateless = true;
+
+/**
+ * Function that decrypts each event's data, which must be a string
+ * holding a base64-encoded age file, such as those produced by the
+ * encrypt function, and replaces it with the JSON value it holds.
+ * Several identities may be given, so that keys can be rotated
+ * without losing access to data encrypted to the previous one. Events
+ * that can't be decrypted are re-emitted as dead-letter events, or
+ * dropped.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the identities and how to
+ * handle events that can't be decrypted.
+ * @returns A channel that decrypts events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: DecryptFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const identities = options.identities.map(
+    (identity) => parseIdentity(identity) as Buffer
+  );
+  const onError = options["on-error"] ?? "dead-letter";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be decrypted will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const open = async (event: Event): Promise<Event | null> => {
+    try {
+      if (typeof event.data !== "string") {
+        throw new Error("the event's data is not a string");
+      }
+      const decrypted = decrypt(Buffer.from(event.data, "base64"), identities);
+      return await makeFrom(event, {
+        data: decodeJson(decrypted.toString()),
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't decrypt event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.decrypt`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(open))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
@@ -1,7 +1,11 @@
+import { match, P } from "ts-pattern";
 import { Channel, AsyncQueue, flatMap } from "../async-queue";
-import { getSignature } from "../utils";
+import { encodeJson } from "../json";
+import { check, getSignature } from "../utils";
 import { Event } from "../event";
-import { PipelineStepFunctionParameters } from ".";
+import { processor as jqProcessor } from "../io/jq";
+import { deduplicatedEvents } from "../metrics";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
 
 /**
  * Options for this function.
@@ -10,6 +14,9 @@ export type DeduplicateFunctionOptions = {
   ["consider-name"]?: boolean;
   ["consider-data"]?: boolean;
   ["consider-trace"]?: boolean;
+  ["key-jq-expr"]?: string;
+  ttl?: number | string;
+  ["max-keys"]?: number | string;
 } | null;
 
 /**
@@ -23,6 +30,19 @@ export const optionsSchema = {
         "consider-name": { type: "boolean" },
         "consider-data": { type: "boolean" },
         "consider-trace": { type: "boolean" },
+        "key-jq-expr": { type: "string", minLength: 1 },
+        ttl: {
+          anyOf: [
+            { type: "number", exclusiveMinimum: 0 },
+            { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+          ],
+        },
+        "max-keys": {
+          anyOf: [
+            { type: "integer", minimum: 1 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
       },
       additionalProperties: false,
       required: [],
@@ -38,41 +58,103 @@ export const optionsSchema = {
  * @param name The name of the step this function belongs to.
  * @param options The options to validate.
  */
-export const validate = (): void => {
-  // Nothing needs to be validated.
+export const validate = (
+  name: string,
+  options: DeduplicateFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions
+      .with({ "key-jq-expr": P._, "consider-name": P._ }, () => false)
+      .with({ "key-jq-expr": P._, "consider-data": P._ }, () => false)
+      .with({ "key-jq-expr": P._, "consider-trace": P._ }, () => false),
+    `step '${name}' can't use deduplicate.key-jq-expr ` +
+      "along with the deduplicate.consider-* options"
+  );
+  check(
+    matchOptions.with(
+      { ttl: P.select(P.string) },
+      (ttl) => parseFloat(ttl) > 0
+    ),
+    `step '${name}' uses an invalid deduplicate.ttl value (must be > 0)`
+  );
+  check(
+    matchOptions
+      .with({ "max-keys": P._, ttl: P._ }, () => true)
+      .with({ "max-keys": P._ }, () => false),
+    `step '${name}' can use deduplicate.max-keys only along with deduplicate.ttl`
+  );
 };
 
+/**
+ * Default maximum amount of keys remembered when deduplicating with a
+ * TTL.
+ */
+const DEFAULT_MAX_KEYS = 100000;
+
+/**
+ * A bounded map of keys to expiry times, evicting the least recently
+ * seen keys once full.
+ */
+export class ExpiringKeys {
+  /**
+   * Expiry times in milliseconds, in least-recently-seen order.
+   */
+  expiries: Map<string, number> = new Map();
+
+  constructor(readonly ttl: number, readonly maxKeys: number) {}
+
+  /**
+   * Check whether the given key was seen and it's still live. Live
+   * keys are marked as recently seen, without extending their
+   * expiry, and unseen or expired keys are registered anew.
+   *
+   * @param key The key to check.
+   * @param now The current time in milliseconds.
+   * @returns Whether the key is live.
+   */
+  seen(key: string, now: number): boolean {
+    const expiry = this.expiries.get(key);
+    this.expiries.delete(key);
+    if (typeof expiry !== "undefined" && expiry > now) {
+      this.expiries.set(key, expiry);
+      return true;
+    }
+    this.expiries.set(key, now + this.ttl);
+    if (this.expiries.size > this.maxKeys) {
+      // Maps iterate in insertion order, so the first key is the
+      // least recently seen.
+      const [oldest] = this.expiries.keys();
+      this.expiries.delete(oldest);
+    }
+    return false;
+  }
+}
+
 /**
  * Remove duplicate events from the given vector. The duplicate events
  * removed are never the first ones encountered for each event
  * identity.
  *
- * @param keyFn Async function that produces event identities for
- * deduplication.
+ * @param keys The event identities for deduplication, one for each
+ * event.
  * @param events Vector of events to remove duplicates from.
- * @returns A promise that resolves to a new vector of events.
+ * @returns A new vector of events.
  */
-const deduplicate = async (
-  keyFn: (e: Event) => Promise<string>,
-  events: Event[]
-): Promise<Event[]> => {
+const deduplicate = (keys: string[], events: Event[]): Event[] => {
   const signatures = new Set<string>();
-  const signed = await Promise.all(
-    events.map((e) => keyFn(e).then((signature) => ({ e, signature })))
-  );
-  return signed
-    .filter(({ signature }) => {
-      if (signatures.has(signature)) {
-        return false;
-      }
-      signatures.add(signature);
-      return true;
-    })
-    .map(({ e }) => e);
+  return events.filter((_, index) => {
+    if (signatures.has(keys[index])) {
+      return false;
+    }
+    signatures.add(keys[index]);
+    return true;
+  });
 };
 
 /**
- * Function that removes event duplicates in each batch.
+ * Function that removes event duplicates in each batch, or across
+ * batches for a period of time if a TTL is given.
  *
  * @param params Configuration parameters acquired from the pipeline.
  * @param options The options that indicate how to deduplicate
@@ -117,8 +199,60 @@ export const make = async (
       keyFn = (e: Event) => getSignature(e.name, e.data, e.trace);
       break;
   }
-  return flatMap(
-    (events: Event[]) => deduplicate(keyFn, events),
-    queue.asChannel()
-  );
+  // Keys may be extracted with jq instead, for each vector at once.
+  const extractor =
+    typeof options?.["key-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["key-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const vectorKeysFn = async (events: Event[]): Promise<string[]> => {
+    if (extractor === null) {
+      return Promise.all(events.map(keyFn));
+    }
+    extractor.send(events);
+    const result = await extractor.receive.next();
+    const extracted: unknown[][] =
+      !result.done && Array.isArray(result.value) ? result.value : [];
+    return events.map((_, index) =>
+      encodeJson((extracted[index] ?? [null])[0] ?? null)
+    );
+  };
+  const expiringKeys =
+    typeof options?.ttl === "undefined"
+      ? null
+      : new ExpiringKeys(
+          (typeof options.ttl === "string"
+            ? parseFloat(options.ttl)
+            : options.ttl) * 1000,
+          typeof options["max-keys"] === "string"
+            ? parseInt(options["max-keys"], 10)
+            : options["max-keys"] ?? DEFAULT_MAX_KEYS
+        );
+  deduplicatedEvents.inc({ step: params.stepName }, 0);
+  const channel = flatMap(async (events: Event[]) => {
+    const keys = await vectorKeysFn(events);
+    const kept =
+      expiringKeys === null
+        ? deduplicate(keys, events)
+        : ((now) =>
+            events.filter((_, index) => !expiringKeys.seen(keys[index], now)))(
+            new Date().getTime()
+          );
+    deduplicatedEvents.inc(
+      { step: params.stepName },
+      events.length - kept.length
+    );
+    return kept;
+  }, queue.asChannel());
+  return {
+    ...channel,
+    close: async () => {
+      await channel.close();
+      if (extractor !== null) {
+        await extractor.close();
+      }
+    },
+  };
 };
@@ -0,0 +1,341 @@
+import { match, P } from "ts-pattern";
+import { Channel, AsyncQueue } from "../async-queue";
+import {
+  CheckpointOptions,
+  checkpointOptionsSchema,
+  makeCheckpointer,
+} from "../checkpoint";
+import { Event, makeOldEventParser } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { makeLogger } from "../log";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/delay");
+
+/**
+ * Options for this function.
+ */
+export type DelayFunctionOptions = {
+  duration?: number | string;
+  "time-jq-expr"?: string;
+  "max-size"?: number | string;
+  overflow?: "drop" | "error";
+  store?: CheckpointOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    duration: {
+      anyOf: [
+        { type: "number", minimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    "time-jq-expr": { type: "string", minLength: 1 },
+    "max-size": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    overflow: { enum: ["drop", "error"] },
+    store: checkpointOptionsSchema,
+  },
+  additionalProperties: false,
+};
+
+/**
+ * Validate delay options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: DelayFunctionOptions
+): void => {
+  check(
+    match(options)
+      .with({ duration: P._, "time-jq-expr": P.string }, () => false)
+      .with({ duration: P._ }, () => true)
+      .with({ "time-jq-expr": P.string }, () => true)
+      .with({}, () => false),
+    `step '${name}' must use exactly one of delay.duration ` +
+      "or delay.time-jq-expr"
+  );
+};
+
+/**
+ * Default maximum amount of events held at once.
+ */
+const DEFAULT_MAX_SIZE = 10000;
+
+/**
+ * The longest wait supported by timers, in milliseconds. Events due
+ * later than that are checked again after it.
+ */
+const MAX_TIMEOUT = 2 ** 31 - 1;
+
+/**
+ * An event held by the step, until it's due at the given time in
+ * milliseconds.
+ */
+interface Entry {
+  event: Event;
+  due: number;
+}
+
+/**
+ * Inserts an entry in an array of entries sorted by due time, after
+ * any other entries due at the same time, so that ties keep their
+ * arrival order.
+ *
+ * @param entries The sorted entries.
+ * @param entry The entry to insert.
+ */
+const insertSorted = (entries: Entry[], entry: Entry): void => {
+  let low = 0;
+  let high = entries.length;
+  while (low < high) {
+    const middle = (low + high) >>> 1;
+    if (entries[middle].due <= entry.due) {
+      low = middle + 1;
+    } else {
+      high = middle;
+    }
+  }
+  entries.splice(low, 0, entry);
+};
+
+/**
+ * Function that holds each event it receives until it's due, either
+ * after a fixed duration or at a timestamp extracted from the event,
+ * and then emits it. Held events are emitted in the order they're
+ * due. If the step has a store, held events are persisted in it, so
+ * that they're still emitted after a restart; otherwise, they're
+ * flushed when the pipeline shuts down.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to delay events.
+ * @returns A channel that delays events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: DelayFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const duration =
+    typeof options.duration === "undefined"
+      ? null
+      : (typeof options.duration === "string"
+          ? parseFloat(options.duration)
+          : options.duration) * 1000;
+  const maxSize =
+    typeof options["max-size"] === "string"
+      ? parseInt(options["max-size"], 10)
+      : options["max-size"] ?? DEFAULT_MAX_SIZE;
+  const overflow = options.overflow ?? "drop";
+  const extractor =
+    typeof options["time-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["time-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  // Held events are saved under the step's name, so that several
+  // steps may share a file store.
+  const store =
+    typeof options.store === "undefined"
+      ? null
+      : makeCheckpointer(options.store, `cdp:${params.pipelineName}:delay:`);
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.delay.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.delay.output`
+  );
+  const stepLogger = logger.with({ step: params.stepName });
+  // Held events, sorted by due time, and in arrival order.
+  const pending: Entry[] = [];
+  let timer: ReturnType<typeof setTimeout> | null = null;
+  let closing = false;
+
+  // Saves are chained, and those requested while another one waits
+  // are merged into it, since each one saves every held event.
+  let saving: Promise<void> = Promise.resolve();
+  let saveQueued = false;
+  const persist = (): Promise<void> => {
+    if (store === null || saveQueued) {
+      return saving;
+    }
+    saveQueued = true;
+    saving = saving.then(async () => {
+      saveQueued = false;
+      try {
+        await store.save(
+          params.stepName,
+          pending.map(({ event, due }) => ({ event, due }))
+        );
+      } catch (err) {
+        stepLogger.warn(`Couldn't persist the held events: ${err}`);
+      }
+    });
+    return saving;
+  };
+  const restore = async () => {
+    if (store === null) {
+      return;
+    }
+    let saved: unknown;
+    try {
+      saved = await store.load(params.stepName);
+    } catch (err) {
+      stepLogger.warn(`Couldn't restore the held events: ${err}`);
+      return;
+    }
+    if (typeof saved === "undefined") {
+      return;
+    }
+    if (!Array.isArray(saved)) {
+      stepLogger.warn("Ignored the persisted held events for being malformed");
+      return;
+    }
+    const parse = makeOldEventParser(
+      params.pipelineName,
+      params.pipelineSignature
+    );
+    for (const entry of saved) {
+      const due = (entry as { due?: unknown })?.due;
+      try {
+        if (typeof due !== "number" || !isFinite(due)) {
+          throw new Error("the due time is not a number");
+        }
+        insertSorted(pending, {
+          event: await parse((entry as { event?: unknown }).event),
+          due,
+        });
+      } catch (err) {
+        stepLogger.warn(`Dropped a malformed persisted event: ${err}`);
+      }
+    }
+  };
+
+  // Computes the due time of each event, or null for events without
+  // a numeric timestamp.
+  const dueTimes = async (events: Event[]): Promise<(number | null)[]> => {
+    if (extractor === null) {
+      const now = new Date().getTime();
+      return events.map(() => now + (duration ?? 0));
+    }
+    extractor.send(events);
+    const result = await extractor.receive.next();
+    const extracted: unknown[][] =
+      !result.done && Array.isArray(result.value) ? result.value : [];
+    return events.map((_, index) => {
+      const [time] = extracted[index] ?? [null];
+      return typeof time === "number" && isFinite(time) ? time * 1000 : null;
+    });
+  };
+  const release = () => {
+    const now = new Date().getTime();
+    let released = 0;
+    while (pending.length > 0 && pending[0].due <= now) {
+      outputQueue.push((pending.shift() as Entry).event);
+      released++;
+    }
+    if (released > 0) {
+      persist();
+    }
+  };
+  const schedule = () => {
+    if (timer !== null) {
+      clearTimeout(timer);
+      timer = null;
+    }
+    if (closing || pending.length === 0) {
+      return;
+    }
+    const wait = Math.max(pending[0].due - new Date().getTime(), 0);
+    timer = setTimeout(() => {
+      timer = null;
+      release();
+      schedule();
+    }, Math.min(wait, MAX_TIMEOUT));
+  };
+  const rejectOverflow = async (events: Event[]) => {
+    const reason = `the step holds ${maxSize} events already`;
+    if (overflow === "drop") {
+      stepLogger.warn(`Dropped ${events.length} events: ${reason}`);
+      return;
+    }
+    stepLogger.error(`Couldn't hold ${events.length} events: ${reason}`);
+    await params.reportFailure?.(events, reason);
+  };
+
+  await restore();
+  release();
+  schedule();
+
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      const dues = await dueTimes(events);
+      const overflowed: Event[] = [];
+      events.forEach((event, index) => {
+        const due = dues[index];
+        if (due === null) {
+          stepLogger
+            .with({ event: event.name })
+            .warn("Event emitted right away for lacking a numeric timestamp");
+          outputQueue.push(event);
+        } else if (pending.length >= maxSize) {
+          overflowed.push(event);
+        } else {
+          insertSorted(pending, { event, due });
+        }
+      });
+      if (overflowed.length > 0) {
+        await rejectOverflow(overflowed);
+      }
+      persist();
+      release();
+      schedule();
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      await inputChannel.close();
+      await processing;
+      closing = true;
+      if (timer !== null) {
+        clearTimeout(timer);
+      }
+      release();
+      if (store === null) {
+        // Without a store, held events would be lost, so they're
+        // flushed on shutdown.
+        for (const { event } of pending.splice(0)) {
+          outputQueue.push(event);
+        }
+      } else {
+        await persist();
+        await store.close();
+      }
+      if (extractor !== null) {
+        await extractor.close();
+      }
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
@@ -0,0 +1,163 @@
+import { match, P } from "ts-pattern";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { AvroType, encodeAvro, frame } from "../io/avro";
+import { makeSchemaRegistry } from "../io/schema-registry";
+import { makeLogger, truncatePayload } from "../log";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/encode-avro");
+
+/**
+ * Options for this function.
+ */
+export type EncodeAvroFunctionOptions = {
+  registry: string;
+  headers?: { [key: string]: string | number | boolean };
+  "schema-id"?: number | string;
+  subject?: string;
+  version?: number | string;
+  encoding?: "base64" | "raw";
+  "on-error"?: "drop" | "dead-letter";
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    registry: { type: "string", minLength: 1 },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    "schema-id": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    subject: { type: "string", minLength: 1 },
+    version: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^([0-9]*[1-9][0-9]*|latest)$" },
+      ],
+    },
+    encoding: { enum: ["base64", "raw"] },
+    "on-error": { enum: ["drop", "dead-letter"] },
+  },
+  additionalProperties: false,
+  required: ["registry"],
+};
+
+/**
+ * Validate encode-avro options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: EncodeAvroFunctionOptions
+): void => {
+  check(
+    match(options)
+      .with({ "schema-id": P._, subject: P._ }, () => false)
+      .with({ "schema-id": P._, version: P._ }, () => false)
+      .with({ "schema-id": P._ }, () => true)
+      .with({ subject: P._ }, () => true)
+      .with({}, () => false),
+    `step '${name}' must use either encode-avro.schema-id, or ` +
+      "encode-avro.subject with an optional encode-avro.version"
+  );
+};
+
+/**
+ * Encoding depends on each event alone (fetched schemas are only
+ * cached).
+ */
+export const stateless = true;
+
+/**
+ * Function that encodes each event's data as Avro binary data framed
+ * for the Confluent Schema Registry, and replaces it with a string
+ * holding the encoded bytes. The schema is fetched from the registry
+ * once, by its id or by subject. Events that can't be encoded with
+ * the schema are dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate where the registry is,
+ * which schema to use and how to encode the data.
+ * @returns A channel that encodes events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: EncodeAvroFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const registry = makeSchemaRegistry(options.registry, options.headers);
+  const schemaId =
+    typeof options["schema-id"] === "string"
+      ? parseInt(options["schema-id"], 10)
+      : options["schema-id"];
+  const version =
+    typeof options.version === "undefined" || options.version === "latest"
+      ? "latest"
+      : typeof options.version === "string"
+      ? parseInt(options.version, 10)
+      : options.version;
+  const lookup = (): Promise<[number, AvroType]> =>
+    typeof schemaId === "number"
+      ? registry
+          .schemaById(schemaId)
+          .then((type): [number, AvroType] => [schemaId, type])
+      : registry.schemaBySubject(options.subject as string, version);
+  const encoding = options.encoding === "raw" ? "latin1" : "base64";
+  const onError = options["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be encoded will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const encode = async (event: Event): Promise<Event | null> => {
+    try {
+      const [id, type] = await lookup();
+      return await makeFrom(event, {
+        data: frame(id, encodeAvro(type, event.data)).toString(encoding),
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't encode event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.encode-avro`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(encode))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
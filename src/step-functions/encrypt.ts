@@ -0,0 +1,88 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { encrypt, parseRecipient } from "../io/age";
+import { encodeJson } from "../json";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * Options for this function.
+ */
+export type EncryptFunctionOptions = {
+  recipients: string[];
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    recipients: {
+      type: "array",
+      items: { type: "string", minLength: 1 },
+      minItems: 1,
+    },
+  },
+  additionalProperties: false,
+  required: ["recipients"],
+};
+
+/**
+ * Validate encrypt options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: EncryptFunctionOptions
+): void => {
+  for (const recipient of options.recipients) {
+    if (parseRecipient(recipient) === null) {
+      throw new Error(
+        `step '${name}' uses an invalid recipient in encrypt.recipients: ` +
+          `${recipient} (must be an age X25519 recipient)`
+      );
+    }
+  }
+};
+
+/**
+ * Encryption depends on each event alone.
+ */
+export const stateless = true;
+
+/**
+ * Function that encrypts each event's data, serialized as JSON, to
+ * the given age recipients, and replaces it with a string holding the
+ * base64-encoded age file. Only holders of a matching identity can
+ * decrypt the data, with the decrypt function or with age itself.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the recipients.
+ * @returns A channel that encrypts events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: EncryptFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const recipients = options.recipients.map(
+    (recipient) => parseRecipient(recipient) as Buffer
+  );
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.encrypt`);
+  return flatMap(
+    (events: Event[]) =>
+      Promise.all(
+        events.map((event) =>
+          makeFrom(event, {
+            data: encrypt(
+              Buffer.from(encodeJson(event.data)),
+              recipients
+            ).toString("base64"),
+          })
+        )
+      ),
+    queue.asChannel()
+  );
+};
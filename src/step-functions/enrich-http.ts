@@ -0,0 +1,391 @@
+import { match, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { fetchJSON } from "../io/http-client";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { makeLogger, truncatePayload } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/enrich-http");
+
+/**
+ * Options for this function.
+ */
+export type EnrichHTTPFunctionOptions = {
+  "url-jq-expr": string;
+  "body-jq-expr"?: string;
+  "key-jq-expr"?: string;
+  method?: "GET" | "POST" | "PUT" | "PATCH";
+  headers?: { [key: string]: string | number | boolean };
+  field?: string;
+  concurrency?: number | string;
+  timeout?: number | string;
+  "cache-ttl"?: number | string;
+  "cache-max-keys"?: number | string;
+  "on-error"?: "pass" | "drop" | "rename" | "dead-letter";
+  "error-suffix"?: string;
+};
+
+/**
+ * Schema for a positive amount of seconds.
+ */
+const secondsSchema = {
+  anyOf: [
+    { type: "number", exclusiveMinimum: 0 },
+    { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+  ],
+};
+
+/**
+ * Schema for a positive integer.
+ */
+const positiveIntegerSchema = {
+  anyOf: [
+    { type: "integer", minimum: 1 },
+    { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+  ],
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    "url-jq-expr": { type: "string", minLength: 1 },
+    "body-jq-expr": { type: "string", minLength: 1 },
+    "key-jq-expr": { type: "string", minLength: 1 },
+    method: { enum: ["GET", "POST", "PUT", "PATCH"] },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    field: { type: "string", minLength: 1 },
+    concurrency: positiveIntegerSchema,
+    timeout: secondsSchema,
+    "cache-ttl": secondsSchema,
+    "cache-max-keys": positiveIntegerSchema,
+    "on-error": { enum: ["pass", "drop", "rename", "dead-letter"] },
+    "error-suffix": { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["url-jq-expr"],
+};
+
+/**
+ * Parse an amount of seconds given as an option.
+ *
+ * @param value The option's value.
+ * @returns The amount of seconds.
+ */
+const parseSeconds = (value: number | string): number =>
+  typeof value === "string" ? parseFloat(value) : value;
+
+/**
+ * Parse an integer given as an option.
+ *
+ * @param value The option's value.
+ * @returns The integer.
+ */
+const parseInteger = (value: number | string): number =>
+  typeof value === "string" ? parseInt(value, 10) : value;
+
+/**
+ * Validate enrich-http options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: EnrichHTTPFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ method: "GET", "body-jq-expr": P._ }, () => false),
+    `step '${name}' can't use enrich-http.body-jq-expr with the GET method`
+  );
+  check(
+    matchOptions.with(
+      { timeout: P.select(P.string) },
+      (timeout) => parseFloat(timeout) > 0
+    ),
+    `step '${name}' uses an invalid enrich-http.timeout value (must be > 0)`
+  );
+  check(
+    matchOptions.with(
+      { "cache-ttl": P.select(P.string) },
+      (ttl) => parseFloat(ttl) > 0
+    ),
+    `step '${name}' uses an invalid enrich-http.cache-ttl value (must be > 0)`
+  );
+  check(
+    matchOptions
+      .with({ "cache-max-keys": P._, "cache-ttl": P._ }, () => true)
+      .with({ "cache-max-keys": P._ }, () => false),
+    `step '${name}' can use enrich-http.cache-max-keys only along with enrich-http.cache-ttl`
+  );
+  check(
+    matchOptions
+      .with({ "error-suffix": P._, "on-error": "rename" }, () => true)
+      .with({ "error-suffix": P._ }, () => false),
+    `step '${name}' can use enrich-http.error-suffix only when enrich-http.on-error is 'rename'`
+  );
+  check(
+    matchOptions.with({ "error-suffix": P.select(P.string) }, isValidEventName),
+    `step '${name}' uses an invalid enrich-http.error-suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default data field that holds the responses.
+ */
+const DEFAULT_FIELD = "enrichment";
+
+/**
+ * Default maximum amount of responses cached.
+ */
+const DEFAULT_CACHE_MAX_KEYS = 10000;
+
+/**
+ * Default suffix appended to the name of the events that couldn't be
+ * enriched, when renaming them.
+ */
+const DEFAULT_ERROR_SUFFIX = "error";
+
+/**
+ * A bounded cache of responses, each one expiring after a fixed
+ * time, and evicting the least recently used responses once full.
+ */
+export class ResponseCache {
+  /**
+   * Cached responses with their expiry times in milliseconds, in
+   * least-recently-used order. Responses are kept as promises, so
+   * that concurrent lookups of the same key share a single request.
+   */
+  entries: Map<string, { expiry: number; response: Promise<unknown> }> =
+    new Map();
+
+  constructor(readonly ttl: number, readonly maxKeys: number) {}
+
+  /**
+   * Get the response for the given key, fetching it if it's not
+   * cached or it expired. Failed fetches aren't cached.
+   *
+   * @param key The key of the response.
+   * @param fetch The procedure that fetches the response.
+   * @returns A promise that resolves to the response.
+   */
+  get(key: string, fetch: () => Promise<unknown>): Promise<unknown> {
+    const now = new Date().getTime();
+    const entry = this.entries.get(key);
+    this.entries.delete(key);
+    if (typeof entry !== "undefined" && entry.expiry > now) {
+      this.entries.set(key, entry);
+      return entry.response;
+    }
+    const response = fetch();
+    const fresh = { expiry: now + this.ttl, response };
+    this.entries.set(key, fresh);
+    response.catch(() => {
+      if (this.entries.get(key) === fresh) {
+        this.entries.delete(key);
+      }
+    });
+    if (this.entries.size > this.maxKeys) {
+      // Maps iterate in insertion order, so the first key is the
+      // least recently used.
+      const [oldest] = this.entries.keys();
+      this.entries.delete(oldest);
+    }
+    return response;
+  }
+}
+
+/**
+ * The names of the events enrich-http may emit, given the names of
+ * the events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: EnrichHTTPFunctionOptions,
+  names: EventNames
+): EventNames =>
+  options["on-error"] === "rename"
+    ? union(
+        names,
+        names?.map(
+          (name) =>
+            `${name}.${options["error-suffix"] ?? DEFAULT_ERROR_SUFFIX}`
+        ) ?? null
+      )
+    : names;
+
+/**
+ * Function that enriches events with the responses of requests made
+ * to a remote HTTP endpoint, one for each event. Requests are made
+ * concurrently, and events are forwarded in the order they were
+ * received.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to build requests,
+ * and how to enrich events with their responses.
+ * @returns A channel that enriches events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: EnrichHTTPFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const method =
+    options.method ??
+    (typeof options["body-jq-expr"] === "string" ? "POST" : "GET");
+  const headers = options.headers ?? {};
+  const field = options.field ?? DEFAULT_FIELD;
+  const concurrency =
+    typeof options.concurrency === "undefined"
+      ? 1
+      : parseInteger(options.concurrency);
+  const timeout =
+    typeof options.timeout === "undefined"
+      ? undefined
+      : parseSeconds(options.timeout) * 1000;
+  const cache =
+    typeof options["cache-ttl"] === "undefined"
+      ? null
+      : new ResponseCache(
+          parseSeconds(options["cache-ttl"]) * 1000,
+          typeof options["cache-max-keys"] === "undefined"
+            ? DEFAULT_CACHE_MAX_KEYS
+            : parseInteger(options["cache-max-keys"])
+        );
+  const onError = options["on-error"] ?? "pass";
+  const errorSuffix = options["error-suffix"] ?? DEFAULT_ERROR_SUFFIX;
+  const extractor = await jqProcessor.makeChannel<Event[]>(
+    makeExtractionProgram(
+      options["url-jq-expr"],
+      options["body-jq-expr"],
+      options["key-jq-expr"]
+    ),
+    { prelude: params["jq-prelude"] }
+  );
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.enrich-http.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.enrich-http.output`
+  );
+
+  const stepLogger = logger.with({ step: params.stepName });
+  const fail = async (
+    event: Event,
+    reason: string
+  ): Promise<Event | null> => {
+    stepLogger
+      .with({ event: event.name, reason, payload: truncatePayload(event.data) })
+      .warn("Couldn't enrich event");
+    switch (onError) {
+      case "drop":
+        return null;
+      case "rename":
+        return makeFrom(event, { name: `${event.name}.${errorSuffix}` });
+      case "dead-letter":
+        // Without a dead-letter name for the step the event is
+        // dropped, since there's nowhere to route it to.
+        await params.reportFailure?.([event], reason);
+        return null;
+      case "pass":
+      default:
+        return event;
+    }
+  };
+  const enrich = async (
+    event: Event,
+    [url, body, key]: unknown[]
+  ): Promise<Event | null> => {
+    if (typeof url !== "string") {
+      return fail(event, "the URL expression didn't produce a string");
+    }
+    if (
+      typeof event.data !== "object" ||
+      event.data === null ||
+      Array.isArray(event.data)
+    ) {
+      return fail(event, "the event's data is not an object");
+    }
+    const requestBody =
+      typeof options["body-jq-expr"] === "string" ? body : undefined;
+    const fetch = () => fetchJSON(url, method, headers, requestBody, timeout);
+    try {
+      const response = await (cache === null
+        ? fetch()
+        : cache.get(
+            typeof options["key-jq-expr"] === "string"
+              ? encodeJson(key)
+              : encodeJson([url, requestBody ?? null]),
+            fetch
+          ));
+      return makeFrom(event, { data: { ...event.data, [field]: response } });
+    } catch (err) {
+      return fail(event, `${err}`);
+    }
+  };
+
+  // Enriched events are forwarded in order, even though requests are
+  // resolved concurrently.
+  let forwarding: Promise<void> = Promise.resolve();
+  const inFlight = new Set<Promise<unknown>>();
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      const extracted: unknown[][] =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+      for (let index = 0; index < events.length; index++) {
+        while (inFlight.size >= concurrency) {
+          await Promise.race(inFlight);
+        }
+        const enriched = enrich(
+          events[index],
+          extracted[index] ?? [null, null, null]
+        );
+        inFlight.add(enriched);
+        enriched.finally(() => inFlight.delete(enriched));
+        forwarding = forwarding
+          .then(() => enriched)
+          .then((event) => {
+            if (event !== null) {
+              outputQueue.push(event);
+            }
+          });
+      }
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      await inputChannel.close();
+      await processing;
+      await forwarding;
+      await extractor.close();
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
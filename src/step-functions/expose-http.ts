@@ -2,6 +2,7 @@ import Koa from "koa";
 import { match, P } from "ts-pattern";
 import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
 import { Event } from "../event";
+import { encodeJson } from "../json";
 import { makeLogger } from "../log";
 import { check, getSignature, mergeHeaders } from "../utils";
 import { makeHTTPServer } from "../io/http-server";
@@ -126,8 +127,7 @@ interface Response {
 const makeEventWindowResponse = async (
   eventWindow: Event[]
 ): Promise<[string, Response]> => {
-  const body =
-    eventWindow.map((event) => JSON.stringify(event)).join("\n") + "\n";
+  const body = eventWindow.map((event) => encodeJson(event)).join("\n") + "\n";
   const signature = await getSignature(body);
   return [signature, { body, type: "application/x-ndjson" }];
 };
@@ -147,7 +147,7 @@ const makeGenericResponse = async (
   if (typeof thing === "string") {
     body = thing;
   } else {
-    body = JSON.stringify(thing);
+    body = encodeJson(thing);
   }
   const signature = await getSignature(body);
   return [signature, { body, type: null }];
@@ -0,0 +1,227 @@
+import { PassThrough } from "stream";
+import { match as matchOptions, P } from "ts-pattern";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event } from "../event";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import { sseDroppedEvents } from "../metrics";
+import { isValidPattern, match, Pattern } from "../pattern";
+import { check } from "../utils";
+import { makeHTTPServer } from "../io/http-server";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/expose-sse");
+
+/**
+ * Options for this function.
+ */
+export type ExposeSSEFunctionOptions = {
+  endpoint: string;
+  port: number | string;
+  buffer?: number | string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    endpoint: { type: "string", minLength: 1, pattern: "^/.*$" },
+    port: {
+      anyOf: [
+        { type: "integer", minimum: 1, maximum: 65535 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    buffer: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+  },
+  additionalProperties: false,
+  required: ["endpoint", "port"],
+};
+
+/**
+ * Validate expose-sse options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: ExposeSSEFunctionOptions
+): void => {
+  check(
+    matchOptions(options).with({ port: P.select(P.string) }, (rawPort) =>
+      ((port) => port >= 1 && port <= 65535)(parseInt(rawPort, 10))
+    ),
+    `step '${name}' uses an invalid expose-sse.port value ` +
+      "(must be between 1 and 65535, inclusive)"
+  );
+};
+
+/**
+ * Default amount of events buffered for each client.
+ */
+const DEFAULT_BUFFER = 100;
+
+/**
+ * Time in milliseconds between comments sent to idle clients, to
+ * prevent intermediaries from closing the connection.
+ */
+const HEARTBEAT_INTERVAL = 15000;
+
+/**
+ * A connected client, which receives the events matching its
+ * pattern.
+ */
+interface Client {
+  pattern: Pattern;
+  stream: PassThrough;
+  frames: string[];
+  waiting: boolean;
+}
+
+/**
+ * Write as many buffered frames as the client's stream accepts,
+ * resuming once the stream is drained.
+ *
+ * @param client The client to write frames to.
+ */
+const flush = (client: Client): void => {
+  while (
+    client.frames.length > 0 &&
+    !client.waiting &&
+    !client.stream.writableEnded
+  ) {
+    const frame = client.frames.shift() as string;
+    if (!client.stream.write(frame)) {
+      client.waiting = true;
+      client.stream.once("drain", () => {
+        client.waiting = false;
+        flush(client);
+      });
+    }
+  }
+};
+
+/**
+ * Function that exposes events as a stream of server-sent events,
+ * and forwards the events to the pipeline. Each client receives the
+ * events matching the pattern given in its request, and slow clients
+ * lose their oldest events instead of holding the pipeline back.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to expose events.
+ * @returns A channel that exposes events via SSE.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: ExposeSSEFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const endpoint =
+    options.endpoint.length > 1 && options.endpoint.endsWith("/")
+      ? options.endpoint.slice(0, -1)
+      : options.endpoint;
+  const port =
+    typeof options.port === "string"
+      ? parseInt(options.port, 10)
+      : options.port;
+  const bufferSize =
+    typeof options.buffer === "string"
+      ? parseInt(options.buffer, 10)
+      : options.buffer ?? DEFAULT_BUFFER;
+  const clients = new Set<Client>();
+  sseDroppedEvents.inc({ step: params.stepName }, 0);
+
+  const broadcast = (event: Event) => {
+    for (const client of clients) {
+      if (!match(event.name, client.pattern)) {
+        continue;
+      }
+      if (client.frames.length >= bufferSize) {
+        client.frames.shift();
+        sseDroppedEvents.inc({ step: params.stepName }, 1);
+      }
+      client.frames.push(
+        `event: ${event.name}\ndata: ${encodeJson(event)}\n\n`
+      );
+      flush(client);
+    }
+  };
+  const heartbeat = setInterval(() => {
+    for (const client of clients) {
+      if (client.frames.length === 0 && !client.waiting) {
+        client.stream.write(": heartbeat\n\n");
+      }
+    }
+  }, HEARTBEAT_INTERVAL);
+
+  const server = makeHTTPServer(port, async (ctx) => {
+    logger.debug("Received request:", ctx.request.method, ctx.request.path);
+    if (ctx.request.method !== "GET" || ctx.request.path !== endpoint) {
+      logger.info(
+        "Received unrecognized request:",
+        ctx.request.method,
+        ctx.request.path
+      );
+      ctx.status = 404;
+      return;
+    }
+    const rawPattern = ctx.request.query.match ?? "#";
+    if (typeof rawPattern !== "string" || !isValidPattern(rawPattern)) {
+      ctx.status = 400;
+      ctx.body = { error: "invalid match pattern" };
+      return;
+    }
+    const client: Client = {
+      pattern: rawPattern,
+      stream: new PassThrough(),
+      frames: [],
+      waiting: false,
+    };
+    clients.add(client);
+    logger.debug("Client subscribed with pattern", rawPattern);
+    ctx.res.on("close", () => {
+      clients.delete(client);
+      client.stream.end();
+      logger.debug("Client unsubscribed with pattern", rawPattern);
+    });
+    ctx.req.socket.setTimeout(0);
+    ctx.req.socket.setNoDelay(true);
+    ctx.set({
+      "Content-Type": "text/event-stream",
+      "Cache-Control": "no-cache",
+      Connection: "keep-alive",
+    });
+    ctx.status = 200;
+    ctx.body = client.stream;
+  });
+
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    events.forEach(broadcast);
+    return events;
+  }, new AsyncQueue<Event[]>(`step.${params.stepName}.expose-sse.forward`).asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      await forwardingChannel.close();
+      clearInterval(heartbeat);
+      // Ending the streams lets the open responses finish, which is
+      // required for the server to close.
+      for (const client of clients) {
+        client.stream.end();
+      }
+      clients.clear();
+      await server.close();
+    },
+  };
+};
@@ -0,0 +1,168 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/flatten");
+
+/**
+ * Options for this function.
+ */
+export type FlattenFunctionOptions = {
+  separator?: string;
+  arrays?: "index" | "keep";
+  "on-error"?: "drop" | "dead-letter";
+} | null;
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    {
+      type: "object",
+      properties: {
+        separator: { type: "string", minLength: 1 },
+        arrays: { enum: ["index", "keep"] },
+        "on-error": { enum: ["drop", "dead-letter"] },
+      },
+      additionalProperties: false,
+      required: [],
+    },
+    { type: "null" },
+  ],
+};
+
+/**
+ * Validate flatten options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Default values for the flattening of objects.
+ */
+export const DEFAULT_SEPARATOR = ".";
+export const DEFAULT_ARRAYS = "index";
+
+/**
+ * Check whether a value is an object that's not an array.
+ *
+ * @param value The value to check.
+ * @returns Whether the value is a plain object.
+ */
+export const isPlainObject = (
+  value: unknown
+): value is { [key: string]: unknown } =>
+  typeof value === "object" && value !== null && !Array.isArray(value);
+
+/**
+ * Flatten a nested object into an object with a single level of
+ * keys, each one joining the keys of the path to a value with the
+ * separator. Arrays are flattened using their indices as keys, unless
+ * they're kept as values. Empty objects and arrays are kept as
+ * values, so that they aren't lost. Throws an error if two paths
+ * produce the same key.
+ *
+ * @param value The object to flatten.
+ * @param separator The string joining keys.
+ * @param arrays Whether arrays are flattened by index, or kept.
+ * @returns The flat object.
+ */
+export const flattenObject = (
+  value: { [key: string]: unknown },
+  separator: string,
+  arrays: "index" | "keep"
+): { [key: string]: unknown } => {
+  const entries: Map<string, unknown> = new Map();
+  const visit = (prefix: string | null, current: unknown) => {
+    const nested =
+      isPlainObject(current) || (arrays === "index" && Array.isArray(current));
+    const children = nested ? Object.entries(current as object) : [];
+    if (prefix !== null && children.length === 0) {
+      if (entries.has(prefix)) {
+        throw new Error(`the key '${prefix}' is produced more than once`);
+      }
+      entries.set(prefix, current);
+      return;
+    }
+    for (const [key, child] of children) {
+      visit(prefix === null ? key : prefix + separator + key, child);
+    }
+  };
+  visit(null, value);
+  // Object.fromEntries defines own properties, so keys such as
+  // `__proto__` are kept as regular keys.
+  return Object.fromEntries(entries);
+};
+
+/**
+ * Each event's data is flattened on its own.
+ */
+export const stateless = true;
+
+/**
+ * Function that flattens the data of each event it receives, which
+ * must be an object, into an object with a single level of keys.
+ * Events that can't be flattened are dropped, or re-emitted as
+ * dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how keys are joined.
+ * @returns A channel that flattens events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: FlattenFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const separator = options?.separator ?? DEFAULT_SEPARATOR;
+  const arrays = options?.arrays ?? DEFAULT_ARRAYS;
+  const onError = options?.["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be flattened will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const flatten = async (event: Event): Promise<Event | null> => {
+    try {
+      if (!isPlainObject(event.data)) {
+        throw new Error("the event's data is not an object");
+      }
+      return await makeFrom(event, {
+        data: flattenObject(event.data, separator, arrays),
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't flatten event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.flatten`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(flatten))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
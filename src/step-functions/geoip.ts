@@ -0,0 +1,234 @@
+import { promises as fs } from "fs";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { GeoDatabase, openDatabase } from "../io/mmdb";
+import { makeLogger } from "../log";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/geoip");
+
+/**
+ * Options for this function.
+ */
+export type GeoIPFunctionOptions = {
+  database: string;
+  "ip-jq-expr": string;
+  target?: string;
+  "miss-key"?: string;
+  language?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    database: { type: "string", minLength: 1 },
+    "ip-jq-expr": { type: "string", minLength: 1 },
+    target: { type: "string", minLength: 1 },
+    "miss-key": { type: "string", minLength: 1 },
+    language: { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["database", "ip-jq-expr"],
+};
+
+/**
+ * Validate geoip options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Lookups depend on each event alone, and the database is only read.
+ */
+export const stateless = true;
+
+/**
+ * Databases loaded, by path, along with the amount of channels using
+ * each of them. Concurrent instances of a step share the database
+ * instead of loading it once each.
+ */
+const databases: Map<
+  string,
+  { database: Promise<GeoDatabase>; users: number }
+> = new Map();
+
+/**
+ * Get the database held by a file, loading it if it isn't loaded
+ * already.
+ *
+ * @param path The path to the database file.
+ * @returns A promise yielding the database.
+ */
+const acquireDatabase = (path: string): Promise<GeoDatabase> => {
+  let entry = databases.get(path);
+  if (typeof entry === "undefined") {
+    const database = fs.readFile(path).then(openDatabase);
+    entry = { database, users: 0 };
+    databases.set(path, entry);
+    // A database that fails to load isn't kept, so that it may be
+    // loaded again later.
+    database.catch(() => databases.delete(path));
+  }
+  entry.users++;
+  return entry.database;
+};
+
+/**
+ * Stop using a database, forgetting it if nothing else uses it.
+ *
+ * @param path The path to the database file.
+ */
+const releaseDatabase = (path: string): void => {
+  const entry = databases.get(path);
+  if (typeof entry !== "undefined" && --entry.users <= 0) {
+    databases.delete(path);
+  }
+};
+
+/**
+ * Pick the name in the given language, or in English, out of a
+ * record's entry.
+ *
+ * @param entry The record's entry (e.g. the country).
+ * @param language The language of the name.
+ * @returns The name, if any.
+ */
+const nameOf = (entry: unknown, language: string): unknown => {
+  const names = (entry as { names?: { [language: string]: unknown } })?.names;
+  return names?.[language] ?? names?.en;
+};
+
+/**
+ * Summarize a record of a GeoIP2, GeoLite2 or ASN database into its
+ * most used fields, leaving out those the record doesn't hold.
+ *
+ * @param record The record found.
+ * @param language The language of the names picked.
+ * @returns The compact geo information.
+ */
+const summarize = (
+  record: unknown,
+  language: string
+): { [key: string]: unknown } => {
+  /* eslint-disable-next-line @typescript-eslint/no-explicit-any */
+  const r = (record ?? {}) as any;
+  const fields: { [key: string]: unknown } = {
+    country: r.country?.iso_code ?? r.registered_country?.iso_code,
+    "country-name": nameOf(r.country ?? r.registered_country, language),
+    city: nameOf(r.city, language),
+    region: nameOf(r.subdivisions?.[0], language),
+    continent: r.continent?.code,
+    "postal-code": r.postal?.code,
+    "time-zone": r.location?.time_zone,
+    location:
+      typeof r.location?.latitude === "number" &&
+      typeof r.location?.longitude === "number"
+        ? { latitude: r.location.latitude, longitude: r.location.longitude }
+        : undefined,
+    asn: r.autonomous_system_number,
+    organization: r.autonomous_system_organization,
+  };
+  return Object.fromEntries(
+    Object.entries(fields).filter(([, value]) => typeof value !== "undefined")
+  );
+};
+
+/**
+ * Function that looks up the IP address given by a jq expression on
+ * each event in a MaxMind database (e.g. GeoLite2 City), and merges
+ * what it finds into the event's data under a key. Events that can't
+ * be enriched, because the address is missing, invalid, or not in the
+ * database (as is the case for private addresses), are forwarded
+ * unmodified, or flagged with the reason under another key.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the database and where
+ * the IP addresses are.
+ * @returns A channel that enriches events with geo information.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: GeoIPFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const path = options.database;
+  const database = await acquireDatabase(path);
+  const extractor = await jqProcessor.makeChannel<Event[]>(
+    makeExtractionProgram(options["ip-jq-expr"]),
+    { prelude: params["jq-prelude"] }
+  );
+  const target = options.target ?? "geo";
+  const missKey = options["miss-key"];
+  const language = options.language ?? "en";
+  const stepLogger = logger.with({ step: params.stepName });
+
+  const lookup = (
+    ip: unknown
+  ): [{ [key: string]: unknown } | null, string] => {
+    if (ip === null || typeof ip === "undefined") {
+      return [null, "missing"];
+    }
+    if (typeof ip !== "string") {
+      return [null, "invalid"];
+    }
+    let record: unknown;
+    try {
+      record = database.lookup(ip.trim());
+    } catch (err) {
+      return [null, "invalid"];
+    }
+    return record === null
+      ? [null, "not-found"]
+      : [summarize(record, language), ""];
+  };
+
+  const enrich = async (events: Event[]): Promise<Event[]> => {
+    extractor.send(events);
+    const result = await extractor.receive.next();
+    const extracted: unknown[][] =
+      !result.done && Array.isArray(result.value) ? result.value : [];
+    return Promise.all(
+      events.map((event, index) => {
+        const data = event.data;
+        if (typeof data !== "object" || data === null || Array.isArray(data)) {
+          stepLogger
+            .with({ event: event.name })
+            .debug("Event not enriched, since its data is not an object");
+          return event;
+        }
+        const [geo, reason] = lookup((extracted[index] ?? [null])[0]);
+        if (geo !== null) {
+          return makeFrom(event, { data: { ...data, [target]: geo } });
+        }
+        stepLogger
+          .with({ event: event.name, reason })
+          .debug("Event not enriched");
+        return typeof missKey === "string"
+          ? makeFrom(event, { data: { ...data, [missKey]: reason } })
+          : event;
+      })
+    );
+  };
+
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.geoip`);
+  const channel = flatMap(enrich, queue.asChannel());
+  return {
+    ...channel,
+    close: async () => {
+      await channel.close();
+      await extractor.close();
+      releaseDatabase(path);
+    },
+  };
+};
@@ -1,6 +1,16 @@
 import { Channel } from "../async-queue";
+import { EventNames } from "../analysis";
+import { FailureReporter } from "../dead-letter";
 import { processor as jqProcessor } from "../io/jq";
 import { processor as jsonnetProcessor } from "../io/jsonnet";
+import { Event } from "../event";
+import { makeLogger } from "../log";
+import { stepEvents } from "../metrics";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions");
 
 /**
  * Parameters given to each step-function initializer.
@@ -11,6 +21,73 @@ export interface PipelineStepFunctionParameters {
   stepName: string;
   "jq-prelude"?: string;
   "jsonnet-prelude"?: string;
+  reportFailure?: FailureReporter;
+  timeout?: number;
+}
+
+/**
+ * The contract a step function fulfills, either provided or
+ * registered as an extension. Outputs are step functions too.
+ */
+/* eslint-disable-next-line @typescript-eslint/no-explicit-any */
+export interface StepFunctionModule<Options = any> {
+  /**
+   * An ajv schema for the function's options.
+   */
+  optionsSchema: object;
+  /**
+   * Validate the function's options, after they've been checked by
+   * the ajv schema. Throws an error if they're invalid.
+   *
+   * @param name The name of the step this function belongs to.
+   * @param options The options to validate.
+   */
+  validate(name: string, options: Options): void;
+  /**
+   * Analyze the names of the events the function emits, given the
+   * names of the events it receives. Functions that don't rename
+   * events may omit it.
+   *
+   * @param options The function's options.
+   * @param names The names of the events received.
+   * @returns The names of the events emitted, or null if they're
+   * unknown.
+   */
+  emits?(options: Options, names: EventNames): EventNames;
+  /**
+   * Check that the endpoints the function delivers to are reachable,
+   * without sending anything. Functions that don't connect to
+   * anything may omit it.
+   *
+   * @param options The function's options.
+   * @param signal A signal that's aborted once the check times out.
+   * @returns A promise that resolves if the endpoints are reachable,
+   * or rejects with the reason they aren't, or null if the options
+   * leave nothing to check.
+   */
+  probe?(options: Options, signal: AbortSignal): Promise<void> | null;
+  /**
+   * Whether the function honors the step's timeout.
+   */
+  supportsTimeout?: boolean;
+  /**
+   * Whether the function keeps no state across vectors, and is done
+   * with each vector once its channel is idle, so that concurrent
+   * instances of it may process the vectors of a step.
+   */
+  stateless?: boolean;
+  /**
+   * Build the function's channel.
+   *
+   * @param params Configuration parameters acquired from the pipeline.
+   * @param options The function's options.
+   * @returns A promise yielding the channel that processes vectors of
+   * events.
+   */
+  make(
+    params: PipelineStepFunctionParameters,
+    options: Options
+  ): Promise<Channel<Event[], Event>>;
 }
 
 /**
@@ -46,3 +123,92 @@ export const makeProcessorChannel = <T>(
         stepName: params.stepName,
       })
     : Promise.reject(new Error("neither jq nor jsonnet are configured"));
+
+/**
+ * Builds a jq program that applies each of the given expressions to
+ * every event of a vector, producing a single array of results for
+ * the whole vector: one array for each event, holding the first value
+ * produced by each expression. Expressions that fail or produce
+ * nothing result in `null`, so that the program's output can always
+ * be matched to its input. Absent expressions always result in
+ * `null`.
+ *
+ * @param exprs The jq expressions to apply.
+ * @returns The jq program.
+ */
+export const makeExtractionProgram = (
+  ...exprs: (string | undefined)[]
+): string =>
+  "map([" +
+  exprs
+    .map((expr) =>
+      typeof expr === "undefined"
+        ? "null"
+        : `(try ([first(${expr})] | .[0]) catch null)`
+    )
+    .join(", ") +
+  "])";
+
+/**
+ * A procedure that runs an operation over some events, giving up on
+ * it if it doesn't finish within the step's timeout.
+ */
+export type TimeoutGuard = <T>(
+  events: Event[],
+  operation: (signal: AbortSignal) => Promise<T[]>
+) => Promise<T[]>;
+
+/**
+ * Builds a guard that enforces the step's timeout, if any, over
+ * operations made by its function. Operations that time out are
+ * signalled to abort, and their events are routed as dead-letter
+ * events, or dropped if the step doesn't have a dead-letter name.
+ * Their eventual results are discarded. Operations that can't be
+ * aborted (e.g. CPU-bound evaluations) keep running until they
+ * finish, but the step moves on regardless.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @returns The timeout guard.
+ */
+export const makeTimeoutGuard = (
+  params: PipelineStepFunctionParameters
+): TimeoutGuard => {
+  const timeout = params.timeout;
+  const stepLogger = logger.with({ step: params.stepName });
+  return async <T>(
+    events: Event[],
+    operation: (signal: AbortSignal) => Promise<T[]>
+  ): Promise<T[]> => {
+    const controller = new AbortController();
+    if (typeof timeout === "undefined") {
+      return operation(controller.signal);
+    }
+    let timer: ReturnType<typeof setTimeout> | null = null;
+    const timedOut: Promise<null> = new Promise((resolve) => {
+      timer = setTimeout(() => resolve(null), timeout * 1000);
+    });
+    const pending = operation(controller.signal);
+    let result: T[] | null;
+    try {
+      result = await Promise.race([pending, timedOut]);
+    } finally {
+      if (timer !== null) {
+        clearTimeout(timer);
+      }
+    }
+    if (result !== null) {
+      return result;
+    }
+    controller.abort();
+    // The operation's late outcome is of no use anymore.
+    pending.catch(() => null);
+    stepEvents.inc({ step: params.stepName, flow: "timed-out" }, events.length);
+    const reason = `the operation timed out after ${timeout} seconds`;
+    if (typeof params.reportFailure === "undefined") {
+      stepLogger.warn(`Dropped ${events.length} events: ${reason}`);
+    } else {
+      await params.reportFailure(events, reason);
+    }
+    return [];
+  };
+};
@@ -0,0 +1,128 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, make as makeEvent } from "../event";
+import { makeEvaluator } from "../io/jsonnet";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters, makeTimeoutGuard } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/jsonnet");
+
+/**
+ * Options for this function.
+ */
+export type JsonnetFunctionOptions =
+  | string
+  | {
+      "jsonnet-expr": string;
+      concurrency?: number | string;
+    };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        "jsonnet-expr": { type: "string", minLength: 1 },
+        concurrency: {
+          anyOf: [
+            { type: "integer", minimum: 1 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+      },
+      additionalProperties: false,
+      required: ["jsonnet-expr"],
+    },
+  ],
+};
+
+/**
+ * Validate jsonnet options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * The jsonnet function honors the step's timeout, even though
+ * evaluations can't be interrupted once started.
+ */
+export const supportsTimeout = true;
+
+/**
+ * Evaluations don't share state across vectors.
+ */
+export const stateless = true;
+
+/**
+ * Function that transforms the data of each event with a Jsonnet
+ * function, evaluated in-process. The function receives the event's
+ * data, and optionally its name as a second argument, and its result
+ * replaces the event's data. Events that fail evaluation are dropped,
+ * or re-emitted as dead-letter events if the step has a dead-letter
+ * name.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The Jsonnet function that transforms events.
+ * @returns A channel that transforms events via Jsonnet.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: JsonnetFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const code = typeof options === "string" ? options : options["jsonnet-expr"];
+  const concurrency =
+    typeof options === "string"
+      ? 1
+      : typeof options.concurrency === "string"
+      ? parseInt(options.concurrency, 10)
+      : options.concurrency ?? 1;
+  const evaluate = await makeEvaluator(code, {
+    prelude: params["jsonnet-prelude"],
+    stepName: params.stepName,
+    size: concurrency,
+  });
+  const guard = makeTimeoutGuard(params);
+  const stepLogger = logger.with({ step: params.stepName });
+  const transform = async (event: Event): Promise<Event[]> => {
+    try {
+      return await guard([event], async () => {
+        const derived = await makeEvent(
+          event.name,
+          await evaluate(event.data, event.name),
+          event.trace
+        );
+        derived.spanContext = event.spanContext;
+        derived.receipt = event.receipt;
+        return [derived];
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't evaluate jsonnet function");
+      await params.reportFailure?.([event], reason);
+      return [];
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.jsonnet`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(transform))).flat(),
+    queue.asChannel()
+  );
+};
@@ -32,6 +32,11 @@ export const validate = (
   }
 };
 
+/**
+ * Events are kept by their own data alone.
+ */
+export const stateless = true;
+
 /**
  * Function that selects events according to a schema that is compared
  * with each event's data. Event's that don't match the schema are
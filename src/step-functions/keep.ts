@@ -67,6 +67,11 @@ export const validate = (): void => {
 const toInteger = (v: number | string): number =>
   typeof v === "string" ? parseInt(v, 10) : v;
 
+/**
+ * Each vector is truncated on its own.
+ */
+export const stateless = true;
+
 /**
  * Function that selects a fixed number of events from each batch, and
  * drops the rest.
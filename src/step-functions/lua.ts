@@ -0,0 +1,155 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { checkScript, processor } from "../io/lua";
+import { makeLogger, truncatePayload } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/lua");
+
+/**
+ * Options for this function.
+ */
+export type LuaFunctionOptions =
+  | string
+  | {
+      "lua-script": string;
+      concurrency?: number | string;
+      "time-limit"?: number;
+    };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        "lua-script": { type: "string", minLength: 1 },
+        concurrency: {
+          anyOf: [
+            { type: "integer", minimum: 1 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+        "time-limit": { type: "number", exclusiveMinimum: 0 },
+      },
+      additionalProperties: false,
+      required: ["lua-script"],
+    },
+  ],
+};
+
+/**
+ * Validate lua options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (name: string, options: LuaFunctionOptions): void => {
+  try {
+    checkScript(
+      typeof options === "string" ? options : options["lua-script"],
+      name
+    );
+  } catch (err) {
+    throw new Error(
+      `step '${name}' uses an invalid lua script: ${(err as Error).message}`
+    );
+  }
+};
+
+/**
+ * Scripts run in a fresh environment for each event.
+ */
+export const stateless = true;
+
+/**
+ * The response given by stream-lua for each event sent.
+ */
+type LuaResponse = { data: unknown[] } | { error: string };
+
+/**
+ * Function that transforms the data of each event with a Lua script,
+ * run by the stream-lua program in a sandbox without access to the
+ * filesystem, the network or other processes. The script sees the
+ * event's data and name as the globals `data` and `name`, and what it
+ * returns replaces the event's data: `nil` drops the event, and an
+ * array gives the data of several events. Events that fail evaluation
+ * are dropped, or re-emitted as dead-letter events if the step has a
+ * dead-letter name.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The Lua script that transforms events.
+ * @returns A channel that transforms events via Lua.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: LuaFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const code = typeof options === "string" ? options : options["lua-script"];
+  const concurrency =
+    typeof options === "string"
+      ? 1
+      : typeof options.concurrency === "string"
+      ? parseInt(options.concurrency, 10)
+      : options.concurrency ?? 1;
+  const timeLimit =
+    typeof options === "string" ? undefined : options["time-limit"];
+  const lua = await processor.makeChannel<{ name: string; data: unknown }>(
+    code,
+    { stepName: params.stepName, workers: concurrency, timeLimit }
+  );
+  // stream-lua responds to each event in the order they were sent, so
+  // responses are matched with the events waiting for them in that
+  // same order.
+  const waiting: ((response: LuaResponse) => void)[] = [];
+  const responded = (async () => {
+    for await (const response of lua.receive) {
+      waiting.shift()?.(response as LuaResponse);
+    }
+    for (const resolve of waiting.splice(0)) {
+      resolve({ error: "the stream-lua process ended" });
+    }
+  })();
+  const evaluate = (event: Event): Promise<LuaResponse> =>
+    new Promise((resolve) => {
+      waiting.push(resolve);
+      lua.send({ name: event.name, data: event.data });
+    });
+  const stepLogger = logger.with({ step: params.stepName });
+  const transform = async (event: Event): Promise<Event[]> => {
+    const response = await evaluate(event);
+    if ("error" in response) {
+      stepLogger
+        .with({
+          event: event.name,
+          reason: response.error,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't evaluate lua script");
+      await params.reportFailure?.([event], response.error);
+      return [];
+    }
+    return Promise.all(response.data.map((data) => makeFrom(event, { data })));
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.lua`);
+  const channel = flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(transform))).flat(),
+    queue.asChannel()
+  );
+  return {
+    ...channel,
+    close: async () => {
+      await channel.close();
+      await lua.close();
+      await responded;
+    },
+  };
+};
@@ -0,0 +1,138 @@
+import { match as matchOptions, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import {
+  Pattern,
+  patternSchema,
+  isValidPattern,
+  isValidEventName,
+  match,
+} from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * Options for this function.
+ */
+export type MergeFunctionOptions = {
+  sources: Pattern[];
+  name: string;
+  "stamp-source"?: boolean | "true" | "false";
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    sources: { type: "array", items: patternSchema, minItems: 1 },
+    name: { type: "string", minLength: 1 },
+    "stamp-source": {
+      anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+    },
+  },
+  additionalProperties: false,
+  required: ["sources", "name"],
+};
+
+/**
+ * Validate merge options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: MergeFunctionOptions
+): void => {
+  const matchMergeOptions = matchOptions(options);
+  check(
+    matchMergeOptions.with({ sources: P.select() }, (sources) =>
+      sources.every(isValidPattern)
+    ),
+    `step '${name}' uses an invalid pattern in merge.sources`
+  );
+  check(
+    matchMergeOptions.with({ name: P.select(P.string) }, isValidEventName),
+    `step '${name}' uses an invalid merge.name value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * The data field that holds the original name of merged events, when
+ * stamping it.
+ */
+const SOURCE_FIELD = "__source_tag";
+
+/**
+ * The names of the events merge may emit, given the names of the
+ * events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: MergeFunctionOptions,
+  names: EventNames
+): EventNames => {
+  if (names === null) {
+    return null;
+  }
+  const merged = names.filter((name) =>
+    options.sources.some((source) => match(name, source))
+  );
+  return union(
+    names.filter((name) => !merged.includes(name)),
+    merged.length > 0 ? [options.name] : []
+  );
+};
+
+/**
+ * Each event is merged on its own.
+ */
+export const stateless = true;
+
+/**
+ * Function that merges events from several sources into a single
+ * stream, renaming the events that match any of the source patterns
+ * with a common name. Events from other sources are forwarded
+ * unchanged. The order of events is preserved.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the sources to merge and
+ * the name given to their events.
+ * @returns A channel that merges events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: MergeFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const stampSource =
+    typeof options["stamp-source"] === "string"
+      ? options["stamp-source"] === "true"
+      : options["stamp-source"] ?? false;
+  const merge = (event: Event): Promise<Event> | Event => {
+    if (!options.sources.some((source) => match(event.name, source))) {
+      return event;
+    }
+    // The original name can only be stamped into object data.
+    const data =
+      stampSource &&
+      typeof event.data === "object" &&
+      event.data !== null &&
+      !Array.isArray(event.data)
+        ? { ...event.data, [SOURCE_FIELD]: event.name }
+        : event.data;
+    return makeFrom(event, { name: options.name, data });
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.merge`);
+  return flatMap(
+    (events: Event[]) => Promise.all(events.map(merge)),
+    queue.asChannel()
+  );
+};
@@ -0,0 +1,267 @@
+import { match as matchOptions, P } from "ts-pattern";
+import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { sendEvents } from "../io/http-client";
+import { makeLogger } from "../log";
+import {
+  Pattern,
+  patternSchema,
+  isValidPattern,
+  isValidEventName,
+  match,
+} from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+import { makeRandom } from "./sample";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/mirror");
+
+/**
+ * Options for this function.
+ */
+export type MirrorFunctionOptions = {
+  target: string;
+  method?: "POST" | "PUT" | "PATCH";
+  headers?: { [key: string]: string | number | boolean };
+  match?: Pattern;
+  sample?: number | string;
+  seed?: number | string;
+  remap?: { [from: string]: string };
+  "max-pending"?: number | string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    target: { type: "string", minLength: 1 },
+    method: { enum: ["POST", "PUT", "PATCH"] },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    match: patternSchema,
+    sample: {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0, maximum: 1 },
+        { type: "string", pattern: "^(0?\\.[0-9]+|1(\\.0*)?)$" },
+      ],
+    },
+    seed: {
+      anyOf: [
+        { type: "integer", minimum: 0 },
+        { type: "string", pattern: "^[0-9]+$" },
+      ],
+    },
+    remap: {
+      type: "object",
+      properties: {},
+      additionalProperties: { type: "string", minLength: 1 },
+    },
+    "max-pending": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+  },
+  additionalProperties: false,
+  required: ["target"],
+};
+
+/**
+ * A rule that renames mirrored events, either those with an exact
+ * name, or those under a name prefix (or every event, if the prefix
+ * is null). Events under a prefix keep the words that follow it if
+ * the rule's replacement is a prefix too.
+ */
+type RemapRule = {
+  from: string | null;
+  fromPrefix: boolean;
+  to: string;
+  toPrefix: boolean;
+};
+
+/**
+ * Parse a remapping rule, such as `orders.#` to `canary.orders.#`.
+ *
+ * @param from The name or name prefix of the events renamed.
+ * @param to The replacement name or name prefix.
+ * @returns The rule, or null if it's invalid.
+ */
+const parseRule = (from: string, to: string): RemapRule | null => {
+  const fromPrefix = from === "#" || from.endsWith(".#");
+  const toPrefix = to.endsWith(".#");
+  const fromName = fromPrefix ? from.slice(0, -2) : from;
+  const toName = toPrefix ? to.slice(0, -2) : to;
+  if (
+    (from !== "#" && !isValidEventName(fromName)) ||
+    !isValidEventName(toName) ||
+    (toPrefix && !fromPrefix)
+  ) {
+    return null;
+  }
+  return {
+    from: from === "#" ? null : fromName,
+    fromPrefix,
+    to: toName,
+    toPrefix,
+  };
+};
+
+/**
+ * Rename an event according to the first rule that applies to it.
+ *
+ * @param rules The remapping rules.
+ * @param name The name of the event.
+ * @returns The new name, which is the same if no rule applies.
+ */
+const remapName = (rules: RemapRule[], name: string): string => {
+  for (const rule of rules) {
+    if (!rule.fromPrefix) {
+      if (name === rule.from) {
+        return rule.to;
+      }
+      continue;
+    }
+    if (rule.from === null) {
+      return rule.toPrefix ? `${rule.to}.${name}` : rule.to;
+    }
+    if (name === rule.from || name.startsWith(`${rule.from}.`)) {
+      return rule.toPrefix ? rule.to + name.slice(rule.from.length) : rule.to;
+    }
+  }
+  return name;
+};
+
+/**
+ * Validate mirror options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: MirrorFunctionOptions
+): void => {
+  const matchMirror = matchOptions(options);
+  check(
+    matchMirror.with({ match: P.select() }, isValidPattern),
+    `step '${name}' uses an invalid pattern for mirror.match`
+  );
+  check(
+    matchMirror.with(
+      { sample: P.select(P.string) },
+      (rate) => parseFloat(rate) > 0
+    ),
+    `step '${name}' uses an invalid mirror.sample value (must be > 0)`
+  );
+  for (const [from, to] of Object.entries(options.remap ?? {})) {
+    if (parseRule(from, to) === null) {
+      throw new Error(
+        `step '${name}' uses an invalid mirror.remap rule ` +
+          `(from '${from}' to '${to}')`
+      );
+    }
+  }
+};
+
+/**
+ * Default maximum amount of mirrored events waiting to be sent.
+ */
+const DEFAULT_MAX_PENDING = 10000;
+
+/**
+ * Function that forwards the events it receives unmodified, and
+ * sends a copy of some of them to a secondary HTTP target, such as
+ * the `http` input of a canary pipeline. Copies are selected by a
+ * pattern and sampled, and may be renamed so that they don't collide
+ * with the target's own events. Mirroring never holds back the
+ * forwarded events: copies are sent in the background, failed sends
+ * are only logged, and copies are dropped while too many of them are
+ * waiting to be sent.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate which events to mirror,
+ * and where to.
+ * @returns A channel that mirrors the events it forwards.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: MirrorFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const method = options.method ?? "POST";
+  const headers = options.headers ?? {};
+  const rate =
+    typeof options.sample === "string"
+      ? parseFloat(options.sample)
+      : options.sample ?? 1;
+  const random = makeRandom(
+    typeof options.seed === "string"
+      ? parseInt(options.seed, 10)
+      : options.seed ?? Math.floor(Math.random() * 4294967296)
+  );
+  const pattern = options.match;
+  const selected = (event: Event): boolean =>
+    (typeof pattern === "undefined" || match(event.name, pattern)) &&
+    (rate >= 1 || random() < rate);
+  const rules = Object.entries(options.remap ?? {})
+    .map(([from, to]) => parseRule(from, to))
+    .filter((rule): rule is RemapRule => rule !== null);
+  const maxPending =
+    typeof options["max-pending"] === "string"
+      ? parseInt(options["max-pending"], 10)
+      : options["max-pending"] ?? DEFAULT_MAX_PENDING;
+  const stepLogger = logger.with({ step: params.stepName });
+  let pending = 0;
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.mirror.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      try {
+        const copies = await Promise.all(
+          events.map((event) => {
+            const name = remapName(rules, event.name);
+            return name === event.name ? event : makeFrom(event, { name });
+          })
+        );
+        await sendEvents(copies, options.target, method, headers);
+      } finally {
+        pending -= events.length;
+      }
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.mirror.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    const mirrored = events.filter(selected);
+    if (mirrored.length > 0 && pending + mirrored.length > maxPending) {
+      stepLogger.warn(
+        `Dropped ${mirrored.length} mirrored events: ` +
+          `${pending} are waiting to be sent already`
+      );
+    } else if (mirrored.length > 0) {
+      pending += mirrored.length;
+      passThroughChannel.send(mirrored);
+    }
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+    },
+  };
+};
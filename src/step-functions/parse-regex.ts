@@ -0,0 +1,279 @@
+import { match, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { makeLogger, truncatePayload } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/parse-regex");
+
+/**
+ * The types captured values may be coerced to.
+ */
+type CaptureType = "string" | "number" | "integer" | "boolean";
+
+/**
+ * Options for this function.
+ */
+export type ParseRegexFunctionOptions = {
+  pattern: string;
+  types?: { [group: string]: CaptureType };
+  "on-mismatch"?: "rename" | "drop" | "dead-letter";
+  "mismatch-suffix"?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    pattern: { type: "string", minLength: 1 },
+    types: {
+      type: "object",
+      additionalProperties: {
+        enum: ["string", "number", "integer", "boolean"],
+      },
+    },
+    "on-mismatch": { enum: ["rename", "drop", "dead-letter"] },
+    "mismatch-suffix": { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["pattern"],
+};
+
+/**
+ * Compile a pattern written with RE2 (Go) syntax, as far as
+ * javascript regular expressions share it. Named groups may be
+ * written as `(?P<name>...)` or `(?<name>...)`, and leading flags as
+ * in `(?i)`. As in Go, patterns may match anywhere in the text unless
+ * they're anchored.
+ *
+ * @param pattern The pattern to compile.
+ * @returns The compiled regular expression. Throws an error if the
+ * pattern is invalid.
+ */
+const compilePattern = (pattern: string): RegExp => {
+  const flags = pattern.match(/^\(\?([ims]+)\)/);
+  const source = flags === null ? pattern : pattern.slice(flags[0].length);
+  return new RegExp(source.replace(/\(\?P</g, "(?<"), flags?.[1] ?? "");
+};
+
+/**
+ * Get the names of the groups of a compiled pattern.
+ *
+ * @param regex The compiled pattern.
+ * @returns The names of its named groups.
+ */
+const groupNames = (regex: RegExp): string[] =>
+  // An empty alternative makes the pattern match anything, which
+  // gives every group, captured or not.
+  Object.keys(
+    new RegExp(`(?:${regex.source})|`, regex.flags).exec("")?.groups ?? {}
+  );
+
+/**
+ * Validate parse-regex options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: ParseRegexFunctionOptions
+): void => {
+  let regex: RegExp;
+  try {
+    regex = compilePattern(options.pattern);
+  } catch (err) {
+    throw new Error(
+      `step '${name}' uses an invalid parse-regex.pattern value: ${err}`
+    );
+  }
+  const groups = groupNames(regex);
+  if (groups.length === 0) {
+    throw new Error(
+      `step '${name}' uses a parse-regex.pattern value without named groups`
+    );
+  }
+  for (const group of Object.keys(options.types ?? {})) {
+    if (!groups.includes(group)) {
+      throw new Error(
+        `step '${name}' gives a type to parse-regex group ${group}, ` +
+          "which isn't in the pattern"
+      );
+    }
+  }
+  const matchOptions = match(options);
+  check(
+    matchOptions
+      .with({ "mismatch-suffix": P._, "on-mismatch": "drop" }, () => false)
+      .with(
+        { "mismatch-suffix": P._, "on-mismatch": "dead-letter" },
+        () => false
+      ),
+    `step '${name}' can use parse-regex.mismatch-suffix only when ` +
+      "parse-regex.on-mismatch is 'rename'"
+  );
+  check(
+    matchOptions.with(
+      { "mismatch-suffix": P.select(P.string) },
+      isValidEventName
+    ),
+    `step '${name}' uses an invalid parse-regex.mismatch-suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default suffix appended to the name of events that don't match the
+ * pattern, when renaming them.
+ */
+const DEFAULT_MISMATCH_SUFFIX = "unparsed";
+
+/**
+ * The names of the events parse-regex may emit, given the names of
+ * the events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: ParseRegexFunctionOptions,
+  names: EventNames
+): EventNames =>
+  (options["on-mismatch"] ?? "rename") === "rename"
+    ? union(
+        names,
+        names?.map(
+          (name) =>
+            `${name}.${
+              options["mismatch-suffix"] ?? DEFAULT_MISMATCH_SUFFIX
+            }`
+        ) ?? null
+      )
+    : names;
+
+/**
+ * Parsing depends on each event alone.
+ */
+export const stateless = true;
+
+/**
+ * Coerce a captured value to the given type.
+ *
+ * @param value The captured value.
+ * @param type The type to coerce it to.
+ * @returns The coerced value. Throws an error if the value can't be
+ * coerced.
+ */
+const coerce = (value: string, type: CaptureType): unknown => {
+  switch (type) {
+    case "number": {
+      const number = Number(value);
+      if (value.trim() === "" || !isFinite(number)) {
+        throw new Error(`${JSON.stringify(value)} is not a number`);
+      }
+      return number;
+    }
+    case "integer":
+      if (!/^[-+]?\d+$/.test(value.trim())) {
+        throw new Error(`${JSON.stringify(value)} is not an integer`);
+      }
+      return parseInt(value, 10);
+    case "boolean":
+      if (!/^(true|false)$/i.test(value.trim())) {
+        throw new Error(`${JSON.stringify(value)} is not a boolean`);
+      }
+      return value.trim().toLowerCase() === "true";
+    default:
+      return value;
+  }
+};
+
+/**
+ * Function that parses each event's data, which must be a string such
+ * as a log line, with a pattern holding named groups, and replaces it
+ * with an object mapping each group's name to the text it captured,
+ * coerced to the group's type if one is given. Groups that don't
+ * participate in the match are mapped to `null`. Events that don't
+ * match the pattern, or whose captures can't be coerced, are renamed,
+ * dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the pattern and how to
+ * handle events that don't match it.
+ * @returns A channel that parses events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: ParseRegexFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const regex = compilePattern(options.pattern);
+  const types = options.types ?? {};
+  const onMismatch = options["on-mismatch"] ?? "rename";
+  const suffix = options["mismatch-suffix"] ?? DEFAULT_MISMATCH_SUFFIX;
+  const reportFailure = params.reportFailure;
+  if (onMismatch === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be parsed will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const parse = (data: unknown): unknown => {
+    if (typeof data !== "string") {
+      throw new Error("the event's data is not a string");
+    }
+    const groups = regex.exec(data.replace(/\r?\n$/, ""))?.groups;
+    if (typeof groups === "undefined") {
+      throw new Error("the event's data doesn't match the pattern");
+    }
+    return Object.fromEntries(
+      Object.entries(groups).map(([group, value]) => [
+        group,
+        typeof value === "undefined"
+          ? null
+          : coerce(value, types[group] ?? "string"),
+      ])
+    );
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.parse-regex`);
+  return flatMap(async (events: Event[]) => {
+    const forwarded = [];
+    for (const event of events) {
+      let parsed: unknown;
+      try {
+        parsed = parse(event.data);
+      } catch (err) {
+        const reason = `${err}`;
+        // Lines that don't match are commonplace in logs, so they're
+        // only reported when debugging.
+        stepLogger
+          .with({
+            event: event.name,
+            reason,
+            payload: truncatePayload(event.data),
+          })
+          .debug("Couldn't parse event");
+        if (onMismatch === "rename") {
+          forwarded.push(
+            await makeFrom(event, { name: `${event.name}.${suffix}` })
+          );
+        } else if (onMismatch === "dead-letter") {
+          await reportFailure?.([event], reason);
+        }
+        continue;
+      }
+      forwarded.push(await makeFrom(event, { data: parsed }));
+    }
+    return forwarded;
+  }, queue.asChannel());
+};
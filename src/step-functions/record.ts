@@ -0,0 +1,100 @@
+import { appendFile as appendFileCallback } from "fs";
+import { performance } from "perf_hooks";
+import { promisify } from "util";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event } from "../event";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * Use fs.appendFile as an async function.
+ */
+const appendFile: (path: string, data: string) => Promise<void> =
+  promisify(appendFileCallback);
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/record");
+
+/**
+ * Options for this function.
+ */
+export type RecordFunctionOptions = string | { path: string };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        path: { type: "string", minLength: 1 },
+      },
+      additionalProperties: false,
+      required: ["path"],
+    },
+  ],
+};
+
+/**
+ * Validate record options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Function that records events in a file, so that they can be
+ * replayed later with the replay input form, and forwards them to the
+ * pipeline. Each event is appended as a line holding the event and
+ * the moment it was received, in seconds since the first event was
+ * received, as measured by a monotonic clock.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the file to record events
+ * in.
+ * @returns A channel that records events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: RecordFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const path = typeof options === "string" ? options : options.path;
+  let start: number | null = null;
+  const queue = new AsyncQueue<[number, Event[]]>(
+    `step.${params.stepName}.record`
+  );
+  const channel = flatMap(async ([offset, events]: [number, Event[]]) => {
+    const output =
+      events.map((event) => encodeJson({ offset, event })).join("\n") + "\n";
+    try {
+      await appendFile(path, output);
+    } catch (err) {
+      logger.error(`Couldn't append to file ${path}: ${err}`);
+    }
+    return events;
+  }, queue.asChannel());
+  return {
+    ...channel,
+    // Events are stamped as they're received, so that the time spent
+    // writing to the file doesn't alter the recorded pace.
+    send: (...batches: Event[][]) => {
+      const now = performance.now();
+      if (start === null) {
+        start = now;
+      }
+      const offset = (now - start) / 1000;
+      return channel.send(
+        ...batches.map((events): [number, Event[]] => [offset, events])
+      );
+    },
+  };
+};
@@ -0,0 +1,297 @@
+import { createHmac } from "crypto";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { canonicalize } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * Options for this function.
+ */
+export type RedactFunctionOptions = {
+  paths?: string[];
+  "key-pattern"?: string;
+  mode?: "mask" | "hash" | "partial";
+  mask?: string;
+  salt?: string;
+  reveal?: number | string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    paths: {
+      type: "array",
+      items: { type: "string", minLength: 1 },
+      minItems: 1,
+    },
+    "key-pattern": { type: "string", minLength: 1 },
+    mode: { enum: ["mask", "hash", "partial"] },
+    mask: { type: "string" },
+    salt: { type: "string", minLength: 1 },
+    reveal: {
+      anyOf: [
+        { type: "integer", minimum: 0 },
+        { type: "string", pattern: "^[0-9]+$" },
+      ],
+    },
+  },
+  additionalProperties: false,
+  required: [],
+};
+
+/**
+ * A segment of a path into an event's data: an object key, an array
+ * index, or every element of an array.
+ */
+type Segment = { key: string } | { index: number } | { each: true };
+
+/**
+ * A single segment of a path, as written in jq: `.key`, `[0]`, `[]`
+ * or `["quoted key"]`, optionally preceded by a dot in the last three
+ * cases.
+ */
+const SEGMENT = /\.([A-Za-z_][\w-]*)|\.?\[(?:(0|[1-9][0-9]*)|("(?:[^"\\]|\\.)*"))?\]/y;
+
+/**
+ * Parse a path into an event's data, written as a jq path expression
+ * such as `.user.email` or `.cards[].number`.
+ *
+ * @param path The path to parse.
+ * @returns The segments of the path, or null if it's not valid.
+ */
+export const parsePath = (path: string): Segment[] | null => {
+  if (path === ".") {
+    return [];
+  }
+  if (!path.startsWith(".")) {
+    return null;
+  }
+  const segments: Segment[] = [];
+  let position = 0;
+  while (position < path.length) {
+    SEGMENT.lastIndex = position;
+    const found = SEGMENT.exec(path);
+    if (found === null) {
+      return null;
+    }
+    const [whole, key, index, quoted] = found;
+    if (typeof key !== "undefined") {
+      segments.push({ key });
+    } else if (typeof index !== "undefined") {
+      segments.push({ index: parseInt(index, 10) });
+    } else if (typeof quoted !== "undefined") {
+      segments.push({ key: JSON.parse(quoted) });
+    } else {
+      segments.push({ each: true });
+    }
+    position += whole.length;
+  }
+  return segments;
+};
+
+/**
+ * Validate redact options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: RedactFunctionOptions
+): void => {
+  if (
+    typeof options.paths === "undefined" &&
+    typeof options["key-pattern"] === "undefined"
+  ) {
+    throw new Error(
+      `step '${name}' must specify either redact.paths or redact.key-pattern`
+    );
+  }
+  for (const path of options.paths ?? []) {
+    if (parsePath(path) === null) {
+      throw new Error(
+        `step '${name}' uses an invalid path in redact.paths: ${path}`
+      );
+    }
+  }
+  if (typeof options["key-pattern"] !== "undefined") {
+    try {
+      new RegExp(options["key-pattern"]);
+    } catch (err) {
+      throw new Error(
+        `step '${name}' uses an invalid redact.key-pattern: ${err}`
+      );
+    }
+  }
+  if (options.mode === "hash" && typeof options.salt === "undefined") {
+    throw new Error(`step '${name}' must specify redact.salt to hash values`);
+  }
+};
+
+/**
+ * Default values for the replacement of values.
+ */
+const DEFAULT_MASK = "***";
+const DEFAULT_REVEAL = 4;
+
+/**
+ * Check whether a value is an object that's not an array.
+ *
+ * @param value The value to check.
+ * @returns Whether the value is a plain object.
+ */
+const isPlainObject = (value: unknown): value is Record<string, unknown> =>
+  typeof value === "object" && value !== null && !Array.isArray(value);
+
+/**
+ * Build the procedure that replaces a redacted value.
+ *
+ * @param options The function's options.
+ * @returns The procedure that replaces values.
+ */
+const makeReplacer = (
+  options: RedactFunctionOptions
+): ((value: unknown) => unknown) => {
+  const asString = (value: unknown): string =>
+    typeof value === "string" ? value : canonicalize(value);
+  if (options.mode === "hash") {
+    // The salt is required by the validation.
+    const salt = options.salt as string;
+    return (value) =>
+      createHmac("sha256", salt).update(asString(value)).digest("hex");
+  }
+  if (options.mode === "partial") {
+    const reveal =
+      typeof options.reveal === "string"
+        ? parseInt(options.reveal, 10)
+        : options.reveal ?? DEFAULT_REVEAL;
+    return (value) => {
+      const chars = Array.from(asString(value));
+      // Values too short to hide anything are masked entirely.
+      const revealed = chars.length > reveal ? reveal : 0;
+      return (
+        "*".repeat(chars.length - revealed) +
+        chars.slice(chars.length - revealed).join("")
+      );
+    };
+  }
+  const mask = options.mask ?? DEFAULT_MASK;
+  return () => mask;
+};
+
+/**
+ * Replace the values found at a path, copying only the objects and
+ * arrays along the path.
+ *
+ * @param value The value to redact.
+ * @param path The path to the values to replace.
+ * @param replace The procedure that replaces values.
+ * @returns The redacted value.
+ */
+const redactPath = (
+  value: unknown,
+  path: Segment[],
+  replace: (value: unknown) => unknown
+): unknown => {
+  if (path.length === 0) {
+    return replace(value);
+  }
+  const [head, ...rest] = path;
+  if ("key" in head) {
+    if (
+      !isPlainObject(value) ||
+      !Object.prototype.hasOwnProperty.call(value, head.key)
+    ) {
+      return value;
+    }
+    return { ...value, [head.key]: redactPath(value[head.key], rest, replace) };
+  }
+  if (!Array.isArray(value)) {
+    return value;
+  }
+  if ("index" in head) {
+    if (head.index >= value.length) {
+      return value;
+    }
+    const copy = value.slice();
+    copy[head.index] = redactPath(value[head.index], rest, replace);
+    return copy;
+  }
+  return value.map((item) => redactPath(item, rest, replace));
+};
+
+/**
+ * Replace the values of every key matching a pattern, at any depth,
+ * building copies of the objects and arrays traversed.
+ *
+ * @param value The value to redact.
+ * @param pattern The pattern keys are matched against.
+ * @param replace The procedure that replaces values.
+ * @returns The redacted value.
+ */
+const redactKeys = (
+  value: unknown,
+  pattern: RegExp,
+  replace: (value: unknown) => unknown
+): unknown =>
+  Array.isArray(value)
+    ? value.map((item) => redactKeys(item, pattern, replace))
+    : isPlainObject(value)
+    ? Object.fromEntries(
+        Object.entries(value).map(([key, item]) => [
+          key,
+          pattern.test(key)
+            ? replace(item)
+            : redactKeys(item, pattern, replace),
+        ])
+      )
+    : value;
+
+/**
+ * Redactions apply to each event independently.
+ */
+export const stateless = true;
+
+/**
+ * Function that redacts sensitive values from each event's data,
+ * found at the given paths or under keys matching a pattern. Values
+ * are replaced with a mask, a salted hash or a partial reveal. The
+ * received events aren't modified, since they may be shared with
+ * other steps; redacted copies are forwarded instead.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate which values to redact,
+ * and how.
+ * @returns A channel that redacts events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: RedactFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  // Paths are checked by the validation.
+  const paths = (options.paths ?? []).map((path) => parsePath(path) ?? []);
+  const pattern =
+    typeof options["key-pattern"] === "string"
+      ? new RegExp(options["key-pattern"])
+      : null;
+  const replace = makeReplacer(options);
+  const redact = (event: Event): Promise<Event> => {
+    let data = paths.reduce(
+      (redacted, path) => redactPath(redacted, path, replace),
+      event.data
+    );
+    if (pattern !== null) {
+      data = redactKeys(data, pattern, replace);
+    }
+    return makeFrom(event, { data });
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.redact`);
+  return flatMap(
+    (events: Event[]) => Promise.all(events.map(redact)),
+    queue.asChannel()
+  );
+};
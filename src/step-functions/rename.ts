@@ -1,4 +1,5 @@
 import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
 import { Channel, AsyncQueue, flatMap } from "../async-queue";
 import { Event, makeFrom } from "../event";
 import { isValidEventName } from "../pattern";
@@ -79,6 +80,29 @@ export const validate = (
   );
 };
 
+/**
+ * The names of the events rename may emit, given the names of the
+ * events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: RenameFunctionOptions,
+  names: EventNames
+): EventNames =>
+  "replace" in options
+    ? [options.replace]
+    : names?.map(
+        (name) => (options.prepend ?? "") + name + (options.append ?? "")
+      ) ?? null;
+
+/**
+ * Renaming depends on each event alone.
+ */
+export const stateless = true;
+
 /**
  * Function that renames events according to the specified options.
  *
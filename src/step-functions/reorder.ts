@@ -0,0 +1,243 @@
+import { match, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/reorder");
+
+/**
+ * Options for this function.
+ */
+export type ReorderFunctionOptions = {
+  "time-jq-expr": string;
+  delay: number | string;
+  "late-suffix"?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    "time-jq-expr": { type: "string", minLength: 1 },
+    delay: {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    "late-suffix": { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["time-jq-expr", "delay"],
+};
+
+/**
+ * Validate reorder options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: ReorderFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { delay: P.select(P.string) },
+      (delay) => parseFloat(delay) > 0
+    ),
+    `step '${name}' uses an invalid reorder.delay value (must be > 0)`
+  );
+  check(
+    matchOptions.with({ "late-suffix": P.select(P.string) }, isValidEventName),
+    `step '${name}' uses an invalid reorder.late-suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * An event held by the step, until it's released in order.
+ */
+interface Entry {
+  event: Event;
+  time: number;
+  expiry: number;
+  released: boolean;
+}
+
+/**
+ * Inserts an entry in an array of entries sorted by time, after any
+ * other entries with the same time, so that ties keep their arrival
+ * order.
+ *
+ * @param entries The sorted entries.
+ * @param entry The entry to insert.
+ */
+const insertSorted = (entries: Entry[], entry: Entry): void => {
+  let low = 0;
+  let high = entries.length;
+  while (low < high) {
+    const middle = (low + high) >>> 1;
+    if (entries[middle].time <= entry.time) {
+      low = middle + 1;
+    } else {
+      high = middle;
+    }
+  }
+  entries.splice(low, 0, entry);
+};
+
+/**
+ * The names of the events reorder may emit, given the names of the
+ * events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: ReorderFunctionOptions,
+  names: EventNames
+): EventNames =>
+  typeof options["late-suffix"] === "string"
+    ? union(
+        names,
+        names?.map((name) => `${name}.${options["late-suffix"]}`) ?? null
+      )
+    : names;
+
+/**
+ * Function that holds each event it receives for a delay, and emits
+ * the events it holds sorted by a timestamp extracted from each one.
+ * Events that arrive after others with a later timestamp were
+ * emitted are late, and are emitted right away.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to reorder events.
+ * @returns A channel that reorders events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: ReorderFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const delay =
+    (typeof options.delay === "string"
+      ? parseFloat(options.delay)
+      : options.delay) * 1000;
+  const lateSuffix = options["late-suffix"];
+  const extractor = await jqProcessor.makeChannel<Event[]>(
+    makeExtractionProgram(options["time-jq-expr"]),
+    { prelude: params["jq-prelude"] }
+  );
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.reorder.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.reorder.output`
+  );
+  const stepLogger = logger.with({ step: params.stepName });
+  // Held events, sorted by time, and in arrival order.
+  const sorted: Entry[] = [];
+  const arrivals: Entry[] = [];
+  // The latest time of the released events, which determines whether
+  // an event is late.
+  let horizon = -Infinity;
+  let timer: ReturnType<typeof setTimeout> | null = null;
+  // Events are emitted in order, even though renaming late ones is
+  // asynchronous.
+  let emitting: Promise<void> = Promise.resolve();
+
+  const emit = (event: Event, late: boolean) => {
+    emitting = emitting.then(async () => {
+      outputQueue.push(
+        late && typeof lateSuffix === "string"
+          ? await makeFrom(event, { name: `${event.name}.${lateSuffix}` })
+          : event
+      );
+    });
+  };
+  // Releases every held event with a time up to the given one.
+  const releaseUpTo = (time: number) => {
+    while (sorted.length > 0 && sorted[0].time <= time) {
+      const entry = sorted.shift() as Entry;
+      entry.released = true;
+      horizon = Math.max(horizon, entry.time);
+      emit(entry.event, false);
+    }
+  };
+  const schedule = () => {
+    while (arrivals.length > 0 && arrivals[0].released) {
+      arrivals.shift();
+    }
+    if (timer !== null || arrivals.length === 0) {
+      return;
+    }
+    timer = setTimeout(() => {
+      timer = null;
+      const now = new Date().getTime();
+      while (arrivals.length > 0 && arrivals[0].expiry <= now) {
+        const entry = arrivals.shift() as Entry;
+        if (!entry.released) {
+          releaseUpTo(entry.time);
+        }
+      }
+      schedule();
+    }, Math.max(arrivals[0].expiry - new Date().getTime(), 0));
+  };
+
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      const extracted: unknown[][] =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+      const now = new Date().getTime();
+      events.forEach((event, index) => {
+        const [time] = extracted[index] ?? [null];
+        if (typeof time !== "number" || !isFinite(time)) {
+          stepLogger
+            .with({ event: event.name })
+            .warn("Event emitted unordered for lacking a numeric timestamp");
+          emit(event, false);
+        } else if (time < horizon) {
+          emit(event, true);
+        } else {
+          const entry = { event, time, expiry: now + delay, released: false };
+          insertSorted(sorted, entry);
+          arrivals.push(entry);
+        }
+      });
+      schedule();
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      await inputChannel.close();
+      await processing;
+      if (timer !== null) {
+        clearTimeout(timer);
+      }
+      // Every held event is flushed on shutdown.
+      releaseUpTo(Infinity);
+      await emitting;
+      await extractor.close();
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
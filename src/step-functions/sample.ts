@@ -0,0 +1,154 @@
+import { createHash } from "crypto";
+import { match, P } from "ts-pattern";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * Options for this function.
+ */
+export type SampleFunctionOptions = {
+  rate: number | string;
+  "key-jq-expr"?: string;
+  seed?: number | string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    rate: {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0, maximum: 1 },
+        { type: "string", pattern: "^(0?\\.[0-9]+|1(\\.0*)?)$" },
+      ],
+    },
+    "key-jq-expr": { type: "string", minLength: 1 },
+    seed: {
+      anyOf: [
+        { type: "integer", minimum: 0 },
+        { type: "string", pattern: "^[0-9]+$" },
+      ],
+    },
+  },
+  additionalProperties: false,
+  required: ["rate"],
+};
+
+/**
+ * Validate sample options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SampleFunctionOptions
+): void => {
+  check(
+    match(options).with(
+      { rate: P.select(P.string) },
+      (rate) => parseFloat(rate) > 0
+    ),
+    `step '${name}' uses an invalid sample.rate value (must be > 0)`
+  );
+};
+
+/**
+ * Builds a pseudo-random number generator from a seed, using the
+ * mulberry32 algorithm. It's not suitable for cryptographic purposes,
+ * but it's fast and reproducible.
+ *
+ * @param seed The seed of the generator.
+ * @returns A function that produces numbers in the [0, 1) range.
+ */
+export const makeRandom = (seed: number): (() => number) => {
+  let state = seed >>> 0;
+  return () => {
+    state = (state + 0x6d2b79f5) >>> 0;
+    let t = state;
+    t = Math.imul(t ^ (t >>> 15), t | 1);
+    t ^= t + Math.imul(t ^ (t >>> 7), t | 61);
+    return ((t ^ (t >>> 14)) >>> 0) / 4294967296;
+  };
+};
+
+/**
+ * Maps a key to a number in the [0, 1) range, consistently for the
+ * same key and seed.
+ *
+ * @param key The key to map.
+ * @param seed The seed that alters the mapping.
+ * @returns The number the key is mapped to.
+ */
+export const hashKey = (key: string, seed: number): number =>
+  createHash("sha1").update(`${seed}:${key}`).digest().readUInt32BE(0) /
+  4294967296;
+
+/**
+ * Function that keeps a fraction of the events it receives, and
+ * drops the rest. Events are kept at random by default, or according
+ * to a key extracted from each one, in which case events with the
+ * same key are either all kept or all dropped.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to sample events.
+ * @returns A channel that samples events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SampleFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const rate =
+    typeof options.rate === "string" ? parseFloat(options.rate) : options.rate;
+  const keyed = typeof options["key-jq-expr"] === "string";
+  const seed =
+    typeof options.seed === "string"
+      ? parseInt(options.seed, 10)
+      : options.seed ??
+        // Without a seed, random sampling is different on each run,
+        // while keyed sampling is always the same.
+        (keyed ? 0 : Math.floor(Math.random() * 4294967296));
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.sample`);
+  // Keys are extracted with jq for each vector at once, when
+  // sampling by key.
+  const extractor =
+    typeof options["key-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["key-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const random = makeRandom(seed);
+  const channel = flatMap(async (events: Event[]) => {
+    if (extractor === null) {
+      return events.filter(() => random() < rate);
+    }
+    extractor.send(events);
+    const result = await extractor.receive.next();
+    const extracted: unknown[][] =
+      !result.done && Array.isArray(result.value) ? result.value : [];
+    return events.filter(
+      (_, index) =>
+        hashKey(
+          encodeJson((extracted[index] ?? [null])[0] ?? null),
+          seed
+        ) < rate
+    );
+  }, queue.asChannel());
+  return {
+    ...channel,
+    close: async () => {
+      await channel.close();
+      if (extractor !== null) {
+        await extractor.close();
+      }
+    },
+  };
+};
@@ -1,10 +1,38 @@
-import { connect } from "amqplib";
+import { connect, Channel as AMQPChannel, ConfirmChannel } from "amqplib";
 import { match, P } from "ts-pattern";
 import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  DeliveryMode,
+  deliveryModeSchema,
+  requireAcknowledgements,
+} from "../delivery";
 import { Event } from "../event";
+import {
+  Encoding,
+  encodingSchema,
+  binaryContentType,
+  encodeMessage,
+  encodeMessages,
+} from "../io/encoding";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
 import { makeLogger } from "../log";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
 import { check, makeFuse } from "../utils";
-import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
+import {
+  PipelineStepFunctionParameters,
+  makeExtractionProgram,
+  makeProcessorChannel,
+} from ".";
 
 /**
  * A logger instance namespaced to this module.
@@ -23,11 +51,23 @@ interface ExtendedSendAMQPFunctionOptions {
     "auto-delete"?: boolean | "true" | "false";
   };
   "routing-key"?: string;
+  "routing-key-jq-expr"?: string;
+  headers?: { [key: string]: string | number | boolean };
+  properties?: {
+    "message-id"?: string;
+    "correlation-id"?: string;
+    type?: string;
+    "app-id"?: string;
+  };
   expiration?: number | string;
   priority?: number | string;
   persistent?: boolean | "true" | "false";
   "jq-expr"?: string;
   "jsonnet-expr"?: string;
+  encoding?: Encoding;
+  delivery?: DeliveryMode;
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
 }
 
 /**
@@ -56,6 +96,24 @@ export const optionsSchema = {
       required: ["name", "type"],
     },
     "routing-key": { type: "string" },
+    "routing-key-jq-expr": { type: "string", minLength: 1 },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    properties: {
+      type: "object",
+      properties: {
+        "message-id": { type: "string", minLength: 1 },
+        "correlation-id": { type: "string", minLength: 1 },
+        type: { type: "string", minLength: 1 },
+        "app-id": { type: "string", minLength: 1 },
+      },
+      additionalProperties: false,
+    },
     expiration: {
       anyOf: [
         { type: "integer", minimum: 1, maximum: 4294967295 },
@@ -71,11 +129,22 @@ export const optionsSchema = {
     persistent: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
     "jq-expr": { type: "string", minLength: 1 },
     "jsonnet-expr": { type: "string", minLength: 1 },
+    encoding: encodingSchema,
+    delivery: deliveryModeSchema,
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
   },
   additionalProperties: false,
   required: ["url", "exchange"],
 };
 
+/**
+ * The placeholders allowed in routing key, header and property
+ * templates: the event's name, or its timestamp in whole seconds.
+ */
+const PLACEHOLDER = /\{([^{}]*)\}/g;
+const PLACEHOLDERS = ["name", "timestamp"];
+
 /**
  * Validate send-amqp options, after they've been checked by the ajv
  * schema.
@@ -107,6 +176,61 @@ export const validate = (
     ),
     `step '${name}' can't use both jq and jsonnet expressions simultaneously`
   );
+  check(
+    matchOptions.with(
+      { "routing-key": P.select(P.string) },
+      (routingKey) => !routingKey.includes("*") && !routingKey.includes("#")
+    ),
+    `step '${name}' can't use wildcards in send-amqp.routing-key`
+  );
+  const templates = [
+    ["routing-key", options["routing-key"]],
+    ...Object.entries(options.headers ?? {}).map(([key, value]) => [
+      `headers.${key}`,
+      value,
+    ]),
+    ...Object.entries(options.properties ?? {}).map(([key, value]) => [
+      `properties.${key}`,
+      value,
+    ]),
+  ];
+  for (const [option, template] of templates) {
+    if (typeof template !== "string") {
+      continue;
+    }
+    for (const [, placeholder] of template.matchAll(PLACEHOLDER)) {
+      if (!PLACEHOLDERS.includes(placeholder)) {
+        throw new Error(
+          `step '${name}' uses an invalid placeholder in ` +
+            `send-amqp.${option}: {${placeholder}}`
+        );
+      }
+      if (
+        typeof options["jq-expr"] === "string" ||
+        typeof options["jsonnet-expr"] === "string"
+      ) {
+        throw new Error(
+          `step '${name}' can't use placeholders in send-amqp.${option} ` +
+            "when using jq or jsonnet expressions"
+        );
+      }
+    }
+  }
+  check(
+    matchOptions
+      .with(
+        { "routing-key-jq-expr": P.string, "jq-expr": P.string },
+        () => false
+      )
+      .with(
+        { "routing-key-jq-expr": P.string, "jsonnet-expr": P.string },
+        () => false
+      ),
+    `step '${name}' can't use send-amqp.routing-key-jq-expr when using jq or jsonnet expressions`
+  );
+  if (typeof options !== "string" && typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-amqp.retry", options.retry);
+  }
 };
 
 /**
@@ -115,9 +239,129 @@ export const validate = (
 const DEFAULT_EXCHANGE_NAME = "cdp";
 const DEFAULT_EXCHANGE_TYPE = "topic";
 
+/**
+ * The maximum length in bytes of a routing key.
+ */
+const MAX_ROUTING_KEY_BYTES = 255;
+
+/**
+ * The AMQP message properties that can be set from templates.
+ */
+const PROPERTY_NAMES = {
+  "message-id": "messageId",
+  "correlation-id": "correlationId",
+  type: "type",
+  "app-id": "appId",
+} as const;
+
+/**
+ * Render a routing key, header or property template by replacing its
+ * placeholders with the event's properties.
+ *
+ * @param template The template to render.
+ * @param event The event being published.
+ * @returns The rendered template.
+ */
+export const renderTemplate = (template: string, event: Event): string =>
+  template.replace(PLACEHOLDER, (_, placeholder: string) =>
+    placeholder === "name"
+      ? event.name
+      : placeholder === "timestamp"
+      ? Math.trunc(event.timestamp).toString()
+      : ""
+  );
+
+/**
+ * A message to be published, holding the events that share the same
+ * routing key, headers and properties.
+ */
+export interface EventsMessage {
+  routingKey: string;
+  headers: { [key: string]: string | number | boolean };
+  properties: { [property: string]: string };
+  events: Event[];
+}
+
+/**
+ * Group events in messages, so that each message holds the events
+ * that share the same routing key, headers and properties. Messages
+ * are given in the order of the first event of each.
+ *
+ * @param events The events to group.
+ * @param routingKeys The routing key of each event.
+ * @param headers The header templates.
+ * @param properties The property templates.
+ * @returns The messages to publish.
+ */
+export const groupMessages = (
+  events: Event[],
+  routingKeys: string[],
+  headers: ExtendedSendAMQPFunctionOptions["headers"] = {},
+  properties: ExtendedSendAMQPFunctionOptions["properties"] = {}
+): EventsMessage[] => {
+  const messages = new Map<string, EventsMessage>();
+  events.forEach((event, index) => {
+    const message = {
+      routingKey: routingKeys[index],
+      headers: Object.fromEntries(
+        Object.entries(headers).map(([key, value]) => [
+          key,
+          typeof value === "string" ? renderTemplate(value, event) : value,
+        ])
+      ),
+      properties: Object.fromEntries(
+        Object.entries(properties).map(([key, value]) => [
+          PROPERTY_NAMES[key as keyof typeof PROPERTY_NAMES],
+          renderTemplate(value as string, event),
+        ])
+      ),
+    };
+    const groupKey = encodeJson(message);
+    const group = messages.get(groupKey);
+    if (typeof group === "undefined") {
+      messages.set(groupKey, { ...message, events: [event] });
+    } else {
+      group.events.push(event);
+    }
+  });
+  return Array.from(messages.values());
+};
+
+/**
+ * Whether a routing key computed with jq can be used to publish a
+ * message. Wildcards are rejected, since they would be taken
+ * literally instead of matching words.
+ *
+ * @param routingKey The computed routing key.
+ * @returns Whether the routing key is valid.
+ */
+const isValidRoutingKey = (routingKey: unknown): routingKey is string =>
+  typeof routingKey === "string" &&
+  !routingKey.includes("*") &&
+  !routingKey.includes("#") &&
+  Buffer.byteLength(routingKey) <= MAX_ROUTING_KEY_BYTES;
+
+/**
+ * Check that the AMQP broker is reachable and accepts the
+ * credentials, by connecting to it.
+ *
+ * @param options The options that indicate the broker's URL.
+ * @returns A promise that resolves if the broker is reachable.
+ */
+export const probe = async (
+  options: SendAMQPFunctionOptions
+): Promise<void> => {
+  const conn = await connect(
+    typeof options === "string" ? options : options.url
+  );
+  await conn.close();
+};
+
 /**
  * Function that sends events to an AMQP broker, and forwards the same
- * events to the rest of the pipeline unmodified.
+ * events to the rest of the pipeline unmodified. In at-least-once
+ * delivery mode, the channel is put in confirm mode, and writes are
+ * confirmed by the broker's publisher confirms.
  *
  * @param params Configuration parameters acquired from the pipeline.
  * @param variantOptions The options that indicate how to connect and
@@ -132,7 +376,8 @@ export const make = async (
     typeof variantOptions === "string"
       ? { url: variantOptions }
       : variantOptions;
-  const routingKey =
+  const encoding = options.encoding ?? "json";
+  const routingKeyTemplate =
     options["routing-key"] ??
     { direct: "cdp", fanout: "", topic: "cdp" }[
       options.exchange?.type ?? DEFAULT_EXCHANGE_TYPE
@@ -163,9 +408,12 @@ export const make = async (
         }
       : {}),
   };
+  const atLeastOnce = options.delivery === "at-least-once";
   const conn = await connect(options.url);
   conn.on("error", (err) => logger.error(`Error on AMQP connection: ${err}`));
-  const ch = await conn.createChannel();
+  const ch: AMQPChannel = atLeastOnce
+    ? await conn.createConfirmChannel()
+    : await conn.createChannel();
   ch.on("error", (err) => logger.error(`Error on AMQP channel: ${err}`));
   const closed = makeFuse();
   ch.on("close", () => closed.trigger());
@@ -183,6 +431,63 @@ export const make = async (
           : options.exchange?.["auto-delete"] ?? false,
     }
   );
+  // Routing keys may be extracted with jq instead, for each vector
+  // at once.
+  const keyExtractor =
+    typeof options["routing-key-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["routing-key-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const makeRoutingKeys = async (events: Event[]): Promise<string[]> => {
+    const fallback = events.map((event) =>
+      renderTemplate(routingKeyTemplate, event)
+    );
+    if (keyExtractor === null) {
+      return fallback;
+    }
+    keyExtractor.send(events);
+    const result = await keyExtractor.receive.next();
+    const keys =
+      !result.done && Array.isArray(result.value) ? result.value : [];
+    return events.map((event, index) => {
+      const key = keys[index]?.[0];
+      if (isValidRoutingKey(key)) {
+        return key;
+      }
+      if (key !== null && typeof key !== "undefined") {
+        logger.warn(
+          "Computed routing key",
+          encodeJson(key),
+          "is invalid; using",
+          encodeJson(fallback[index]),
+          "instead"
+        );
+      }
+      return fallback[index];
+    });
+  };
+  const releaseAcknowledgements = atLeastOnce
+    ? requireAcknowledgements()
+    : () => {
+        // Nothing to release.
+      };
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    options.delivery,
+    options["circuit-breaker"]
+  );
+  // Wait for the broker to confirm the messages published so far.
+  // Messages not confirmed make the attempt fail, so that they're
+  // published again.
+  const confirm = async (): Promise<void> => {
+    if (atLeastOnce) {
+      await (ch as ConfirmChannel).waitForConfirms();
+    }
+  };
   let passThroughChannel: Channel<Event[], never>;
   if (
     typeof options["jq-expr"] === "string" ||
@@ -190,30 +495,46 @@ export const make = async (
   ) {
     passThroughChannel = drain(
       await makeProcessorChannel(params, options),
-      async (message: unknown) => {
-        const flushed = ch.publish(
-          exchange,
-          routingKey,
-          Buffer.from(
-            typeof message === "string" ? message : JSON.stringify(message)
-          ),
-          {
-            contentType:
-              typeof message === "string" ? "text/plain" : "application/json",
-            timestamp: Math.trunc(new Date().getTime() / 1000),
-            ...publishOptions,
+      // Processed payloads can't be traced back to their events.
+      (message: unknown) =>
+        retrier.run([], async () => {
+          // Templates don't have placeholders in this case, as checked
+          // by the validation.
+          const flushed = ch.publish(
+            exchange,
+            routingKeyTemplate,
+            Buffer.from(encodeMessage(message, encoding)),
+            {
+              contentType:
+                encoding !== "json"
+                  ? binaryContentType(encoding)
+                  : typeof message === "string"
+                  ? "text/plain"
+                  : "application/json",
+              timestamp: Math.trunc(new Date().getTime() / 1000),
+              ...(typeof options.headers !== "undefined"
+                ? { headers: options.headers }
+                : {}),
+              ...Object.fromEntries(
+                Object.entries(options.properties ?? {}).map(([key, value]) => [
+                  PROPERTY_NAMES[key as keyof typeof PROPERTY_NAMES],
+                  value,
+                ])
+              ),
+              ...publishOptions,
+            }
+          );
+          logger.debug(
+            "Published payload to AMQP exchange",
+            exchange,
+            "with routing key",
+            routingKeyTemplate
+          );
+          if (!flushed) {
+            await closed.guard((resolve) => ch.once("drain", resolve));
           }
-        );
-        logger.debug(
-          "Published payload to AMQP exchange",
-          exchange,
-          "with routing key",
-          routingKey
-        );
-        if (!flushed) {
-          await closed.guard((resolve) => ch.once("drain", resolve));
-        }
-      }
+          await confirm();
+        })
     );
   } else {
     passThroughChannel = drain(
@@ -221,27 +542,45 @@ export const make = async (
         `step.${params.stepName}.send-amqp.pass-through`
       ).asChannel(),
       async (events: Event[]) => {
-        const flushed = ch.publish(
-          exchange,
-          routingKey,
-          Buffer.from(events.map((e) => JSON.stringify(e)).join("\n") + "\n"),
-          {
-            contentType: "application/x-ndjson",
-            timestamp: events
-              .map((e) => Math.trunc(e.timestamp))
-              .reduce((max, t) => (t > max ? t : max)),
-            ...publishOptions,
-          }
-        );
-        logger.debug(
-          "Published events to AMQP exchange",
-          exchange,
-          "with routing key",
-          routingKey
+        const messages = groupMessages(
+          events,
+          await makeRoutingKeys(events),
+          options.headers,
+          options.properties
         );
-        if (!flushed) {
-          await closed.guard((resolve) => ch.once("drain", resolve));
-        }
+        await retrier.run(events, async () => {
+          for (const message of messages) {
+            const flushed = ch.publish(
+              exchange,
+              message.routingKey,
+              Buffer.from(encodeMessages(message.events, encoding)),
+              {
+                contentType:
+                  encoding === "json"
+                    ? "application/x-ndjson"
+                    : binaryContentType(encoding, true),
+                timestamp: message.events
+                  .map((e) => Math.trunc(e.timestamp))
+                  .reduce((max, t) => (t > max ? t : max)),
+                ...(typeof options.headers !== "undefined"
+                  ? { headers: message.headers }
+                  : {}),
+                ...message.properties,
+                ...publishOptions,
+              }
+            );
+            logger.debug(
+              "Published events to AMQP exchange",
+              exchange,
+              "with routing key",
+              message.routingKey
+            );
+            if (!flushed) {
+              await closed.guard((resolve) => ch.once("drain", resolve));
+            }
+          }
+          await confirm();
+        });
       }
     );
   }
@@ -255,10 +594,15 @@ export const make = async (
   return {
     ...forwardingChannel,
     close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
       await forwardingChannel.close();
       await passThroughChannel.close();
+      await keyExtractor?.close();
       await ch.close();
       await conn.close();
+      releaseAcknowledgements();
     },
   };
 };
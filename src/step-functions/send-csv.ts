@@ -0,0 +1,185 @@
+import { appendFile as appendFileCallback, promises as fs } from "fs";
+import { promisify } from "util";
+import { match, P } from "ts-pattern";
+import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import { formatCSVRecord } from "../io/csv";
+import { getSTDOUT } from "../io/stdio";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import { check, makeFuse } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * Use fs.appendFile as an async function.
+ */
+const appendFile: (path: string, data: string) => Promise<void> =
+  promisify(appendFileCallback);
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-csv");
+
+/**
+ * Options for this function.
+ */
+export type SendCSVFunctionOptions = {
+  columns: string[];
+  path?: string;
+  header?: boolean | "true" | "false";
+  delimiter?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    columns: {
+      type: "array",
+      items: { type: "string", minLength: 1 },
+      minItems: 1,
+    },
+    path: { type: "string", minLength: 1 },
+    header: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    delimiter: { type: "string", minLength: 1, maxLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["columns"],
+};
+
+/**
+ * Validate send-csv options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendCSVFunctionOptions
+): void => {
+  check(
+    match(options).with(
+      { delimiter: P.select(P.string) },
+      (delimiter) => !['"', "\r", "\n"].includes(delimiter)
+    ),
+    `step '${name}' has an invalid value for send-csv.delimiter: ` +
+      "it can't be a quote or a line break"
+  );
+};
+
+/**
+ * Format a value of an event as a CSV field. Strings are kept as
+ * they are, missing values are left empty, and everything else is
+ * encoded as JSON.
+ *
+ * @param value The value to format.
+ * @returns The field.
+ */
+const formatValue = (value: unknown): string =>
+  typeof value === "string"
+    ? value
+    : typeof value === "undefined" || value === null
+    ? ""
+    : encodeJson(value);
+
+/**
+ * Function that always sends forward the events in the vectors it
+ * receives, unmodified. It also writes the events as CSV rows, to a
+ * file or to STDOUT, holding the values of the configured fields of
+ * their data. The header row is written once, before the first row,
+ * unless the file already holds data.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to write CSV rows.
+ * @returns A channel that writes events as CSV rows.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendCSVFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const delimiter = options.delimiter ?? ",";
+  const path = options.path ?? null;
+  let write: (output: string) => Promise<void>;
+  if (path === null) {
+    const stdout = getSTDOUT();
+    const closed = makeFuse();
+    stdout.on("close", () => closed.trigger());
+    write = async (output) => {
+      if (!stdout.write(output)) {
+        await closed.guard((resolve) => stdout.once("drain", resolve));
+      }
+    };
+  } else {
+    write = async (output) => {
+      try {
+        await appendFile(path, output);
+      } catch (err) {
+        logger.error(`Couldn't append to file ${path}: ${err}`);
+      }
+    };
+  }
+  const header =
+    typeof options.header === "string"
+      ? options.header === "true"
+      : options.header ?? true;
+  let headerPending =
+    header &&
+    (path === null ||
+      (await fs.stat(path).then(
+        (stats) => stats.size === 0,
+        () => true
+      )));
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-csv.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      const rows: string[] = [];
+      for (const event of events) {
+        if (
+          typeof event.data !== "object" ||
+          event.data === null ||
+          Array.isArray(event.data)
+        ) {
+          logger
+            .with({ step: params.stepName, event: event.name })
+            .warn("Couldn't write event as a CSV row: data isn't an object");
+          continue;
+        }
+        const data = event.data as { [key: string]: unknown };
+        rows.push(
+          formatCSVRecord(
+            options.columns.map((column) => formatValue(data[column])),
+            delimiter
+          )
+        );
+      }
+      if (rows.length === 0) {
+        return;
+      }
+      if (headerPending) {
+        headerPending = false;
+        rows.unshift(formatCSVRecord(options.columns, delimiter));
+      }
+      await write(rows.join(""));
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-csv.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+    },
+  };
+};
@@ -0,0 +1,361 @@
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import { request } from "../io/http-client";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { mergeHeaders } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-elasticsearch");
+
+/**
+ * Options for this function.
+ */
+export type SendElasticsearchFunctionOptions = {
+  target: string;
+  index: string;
+  "id-jq-expr"?: string;
+  "flush-size"?: number | string;
+  "flush-interval"?: number | string;
+  headers?: { [key: string]: string | number | boolean };
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    target: { type: "string", minLength: 1 },
+    index: { type: "string", minLength: 1 },
+    "id-jq-expr": { type: "string", minLength: 1 },
+    "flush-size": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "flush-interval": {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: ["target", "index"],
+};
+
+/**
+ * The placeholders allowed in index templates: the event's name, the
+ * date of its arrival, or a path into its data.
+ */
+const PLACEHOLDER = /\{([^{}]*)\}/g;
+const DATA_PATH = /^(\.[A-Za-z_][\w-]*)+$/;
+
+/**
+ * Validate send-elasticsearch options, after they've been checked by
+ * the ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendElasticsearchFunctionOptions
+): void => {
+  for (const [, placeholder] of options.index.matchAll(PLACEHOLDER)) {
+    if (
+      placeholder !== "name" &&
+      placeholder !== "date" &&
+      !DATA_PATH.test(placeholder)
+    ) {
+      throw new Error(
+        `step '${name}' uses an invalid placeholder in ` +
+          `send-elasticsearch.index: {${placeholder}}`
+      );
+    }
+  }
+  if (
+    typeof options["flush-interval"] === "string" &&
+    parseFloat(options["flush-interval"]) <= 0
+  ) {
+    throw new Error(
+      `step '${name}' uses an invalid send-elasticsearch.flush-interval ` +
+        "value (must be > 0)"
+    );
+  }
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-elasticsearch.retry", options.retry);
+  }
+};
+
+/**
+ * Default maximum amount of documents sent in a single bulk request.
+ */
+const DEFAULT_FLUSH_SIZE = 500;
+
+/**
+ * Default amount of seconds documents are held before being sent.
+ */
+const DEFAULT_FLUSH_INTERVAL = 5;
+
+/**
+ * Build the name of the index an event is sent to from the index
+ * template, by replacing its placeholders.
+ *
+ * @param template The index template.
+ * @param event The event being sent.
+ * @returns The name of the index.
+ */
+export const makeIndexName = (template: string, event: Event): string =>
+  template.replace(PLACEHOLDER, (_, placeholder: string) => {
+    if (placeholder === "name") {
+      return event.name;
+    }
+    if (placeholder === "date") {
+      return new Date(event.timestamp * 1000)
+        .toISOString()
+        .slice(0, 10)
+        .replace(/-/g, ".");
+    }
+    const value = placeholder
+      .slice(1)
+      .split(".")
+      .reduce(
+        (current: unknown, key) =>
+          typeof current === "object" && current !== null
+            ? (current as Record<string, unknown>)[key]
+            : undefined,
+        event.data
+      );
+    return typeof value === "string" ||
+      typeof value === "number" ||
+      typeof value === "boolean"
+      ? value.toString()
+      : "";
+  });
+
+/**
+ * A document waiting to be sent, along with the event it was built
+ * from.
+ */
+type BulkItem = {
+  event: Event;
+  action: string;
+  document: string;
+};
+
+/**
+ * Build the bulk item for an event. The indexed document is the
+ * event's data, wrapped in an object if it's not one.
+ *
+ * @param event The event being sent.
+ * @param template The index template.
+ * @param id The document's id, if any.
+ * @returns The bulk item.
+ */
+const makeBulkItem = (
+  event: Event,
+  template: string,
+  id: unknown
+): BulkItem => ({
+  event,
+  action: encodeJson({
+    index: {
+      _index: makeIndexName(template, event),
+      ...(typeof id === "string" || typeof id === "number"
+        ? { _id: id.toString() }
+        : {}),
+    },
+  }),
+  document: encodeJson(
+    typeof event.data === "object" &&
+      event.data !== null &&
+      !Array.isArray(event.data)
+      ? event.data
+      : { data: event.data }
+  ),
+});
+
+/**
+ * The relevant part of a bulk API response.
+ */
+type BulkResponse = {
+  errors?: boolean;
+  items?: { [action: string]: { status?: number; error?: unknown } }[];
+};
+
+/**
+ * Function that sends events to an Elasticsearch or OpenSearch
+ * cluster using the bulk API, and forwards the same events to the
+ * rest of the pipeline unmodified. Documents are buffered and sent
+ * once enough of them accumulate, or periodically. Documents rejected
+ * by the cluster are retried on their own, without resending the
+ * whole request.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to build and send
+ * documents to the cluster.
+ * @returns A channel that forwards events to a search cluster.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendElasticsearchFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const target = `${options.target.replace(/\/+$/, "")}/_bulk`;
+  const headers = mergeHeaders(options.headers ?? {}, {
+    "Content-Type": "application/x-ndjson",
+  });
+  const flushSize =
+    typeof options["flush-size"] === "string"
+      ? parseInt(options["flush-size"], 10)
+      : options["flush-size"] ?? DEFAULT_FLUSH_SIZE;
+  const flushInterval =
+    (typeof options["flush-interval"] === "string"
+      ? parseFloat(options["flush-interval"])
+      : options["flush-interval"] ?? DEFAULT_FLUSH_INTERVAL) * 1000;
+  const extractor =
+    typeof options["id-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["id-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+
+  // Sends the given items in a single bulk request. Items that fail
+  // are kept in the given arrays, along with their events, and an
+  // error is thrown so that the retrier attempts them again, or
+  // dead-letters their events.
+  const attempt = async (items: BulkItem[], events: Event[]): Promise<void> => {
+    const response = await request({
+      url: target,
+      method: "POST",
+      data: items
+        .map(({ action, document }) => `${action}\n${document}\n`)
+        .join(""),
+      transformRequest: [(data) => data],
+      headers,
+    });
+    const chunks: Buffer[] = [];
+    for await (const chunk of response.data) {
+      chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
+    }
+    const body = JSON.parse(
+      Buffer.concat(chunks).toString("utf8")
+    ) as BulkResponse;
+    if (!body?.errors) {
+      logger.debug("Sent", items.length, "documents to", target);
+      return;
+    }
+    const results = body.items ?? [];
+    let reason: unknown = null;
+    const failed = items.filter((_, index) => {
+      const result = Object.values(results[index] ?? {})[0];
+      const status = result?.status ?? 0;
+      if (status < 200 || status >= 300) {
+        reason = reason ?? result?.error ?? `status ${status}`;
+        return true;
+      }
+      return false;
+    });
+    if (failed.length === 0) {
+      return;
+    }
+    items.splice(0, items.length, ...failed);
+    events.splice(0, events.length, ...failed.map(({ event }) => event));
+    throw new Error(
+      `${failed.length} documents were rejected: ${JSON.stringify(reason)}`
+    );
+  };
+
+  // Buffered items are flushed one request at a time.
+  const buffer: BulkItem[] = [];
+  let flushing: Promise<void> = Promise.resolve();
+  const flush = (): Promise<void> => {
+    while (buffer.length > 0) {
+      const items = buffer.splice(0, flushSize);
+      const events = items.map(({ event }) => event);
+      flushing = flushing.then(() =>
+        retrier.run(events, () => attempt(items, events))
+      );
+    }
+    return flushing;
+  };
+  const timer = setInterval(flush, flushInterval);
+
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-elasticsearch.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      let ids: unknown[][] = [];
+      if (extractor !== null) {
+        extractor.send(events);
+        const result = await extractor.receive.next();
+        ids = !result.done && Array.isArray(result.value) ? result.value : [];
+      }
+      events.forEach((event, index) =>
+        buffer.push(makeBulkItem(event, options.index, ids[index]?.[0]))
+      );
+      if (buffer.length >= flushSize) {
+        await flush();
+      }
+    },
+    async () => {
+      clearInterval(timer);
+      await flush();
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-elasticsearch.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // The retrier isn't stopped, since buffered documents are only
+      // sent once the channel closes, and their retries are the last
+      // chance to deliver them. The shutdown timeout still bounds the
+      // wait.
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+      await extractor?.close();
+    },
+  };
+};
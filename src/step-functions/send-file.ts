@@ -3,6 +3,7 @@ import { promisify } from "util";
 import { match, P } from "ts-pattern";
 import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
 import { Event } from "../event";
+import { encodeJson } from "../json";
 import { makeLogger } from "../log";
 import { check } from "../utils";
 import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
@@ -94,8 +95,7 @@ export const make = async (
         try {
           await appendFile(
             path,
-            (typeof result === "string" ? result : JSON.stringify(result)) +
-              "\n"
+            (typeof result === "string" ? result : encodeJson(result)) + "\n"
           );
         } catch (err) {
           logger.error(`Couldn't append to file ${path}: ${err}`);
@@ -109,7 +109,7 @@ export const make = async (
       ).asChannel(),
       async (events: Event[]) => {
         const output =
-          events.map((event) => JSON.stringify(event)).join("\n") + "\n";
+          events.map((event) => encodeJson(event)).join("\n") + "\n";
         try {
           await appendFile(path, output);
         } catch (err) {
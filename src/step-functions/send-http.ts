@@ -1,9 +1,43 @@
 import { match, P } from "ts-pattern";
-import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
+import {
+  Channel,
+  AsyncQueue,
+  flatMap,
+  drain,
+  currentStep,
+  startWork,
+} from "../async-queue";
 import { HTTP_CLIENT_DEFAULT_CONCURRENCY } from "../conf";
+import {
+  DeliveryMode,
+  deliveryModeSchema,
+  requireAcknowledgements,
+} from "../delivery";
 import { Event } from "../event";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import {
+  IdempotencyOptions,
+  idempotencyOptionsSchema,
+  validateIdempotencyOptions,
+  makeIdempotencyGuard,
+} from "../idempotency";
 import { check } from "../utils";
-import { sendEvents, sendThing } from "../io/http-client";
+import {
+  deliverEvents,
+  deliverThing,
+  probeTarget,
+  sendEvents,
+  sendThing,
+} from "../io/http-client";
 import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
 
 /**
@@ -18,6 +52,10 @@ export type SendHTTPFunctionOptions =
       "jsonnet-expr"?: string;
       headers?: { [key: string]: string | number | boolean };
       concurrent?: number | string;
+      retry?: RetryOptions;
+      "circuit-breaker"?: CircuitBreakerOptions;
+      delivery?: DeliveryMode;
+      idempotency?: IdempotencyOptions;
     };
 
 /**
@@ -49,6 +87,10 @@ export const optionsSchema = {
             { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
           ],
         },
+        retry: retryOptionsSchema,
+        "circuit-breaker": circuitBreakerOptionsSchema,
+        delivery: deliveryModeSchema,
+        idempotency: idempotencyOptionsSchema,
       },
       additionalProperties: false,
       required: ["target"],
@@ -74,11 +116,52 @@ export const validate = (
     ),
     `step '${name}' can't use both jq and jsonnet expressions simultaneously`
   );
+  if (typeof options !== "string" && typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-http.retry", options.retry);
+  }
+  check(
+    match(options).with(
+      { idempotency: P._ },
+      (opts) =>
+        typeof opts["jq-expr"] === "undefined" &&
+        typeof opts["jsonnet-expr"] === "undefined"
+    ),
+    `step '${name}' can't use send-http.idempotency with processed payloads`
+  );
+  if (
+    typeof options !== "string" &&
+    typeof options.idempotency !== "undefined"
+  ) {
+    validateIdempotencyOptions(
+      name,
+      "send-http.idempotency",
+      options.idempotency
+    );
+  }
 };
 
+/**
+ * Check that the remote HTTP endpoint is reachable.
+ *
+ * @param options The options that indicate the remote endpoint.
+ * @param signal A signal that aborts the check.
+ * @returns A promise that resolves if the endpoint is reachable.
+ */
+export const probe = (
+  options: SendHTTPFunctionOptions,
+  signal: AbortSignal
+): Promise<void> =>
+  typeof options === "string"
+    ? probeTarget(options, {}, signal)
+    : probeTarget(options.target, options.headers ?? {}, signal);
+
 /**
  * Function that sends events to a remote HTTP endpoint, ignores the
- * response and forwards the events to the pipeline.
+ * response and forwards the events to the pipeline. Failed requests
+ * may be retried with exponential backoff. In at-least-once delivery
+ * mode, only 2xx responses count as confirmed writes. With
+ * idempotency options, events already delivered are skipped, and
+ * events are recorded as delivered once confirmed.
  *
  * @param params Configuration parameters acquired from the pipeline.
  * @param options The options that indicate how to send events to the
@@ -99,6 +182,69 @@ export const make = async (
       : typeof options.concurrent === "string"
       ? parseInt(options.concurrent, 10)
       : options.concurrent ?? 10;
+  const retry = typeof options === "string" ? undefined : options.retry;
+  const breaker =
+    typeof options === "string" ? undefined : options["circuit-breaker"];
+  const delivery =
+    typeof options === "string" ? "best-effort" : options.delivery;
+  const retrier = makeRetrier(
+    params.stepName,
+    retry,
+    params.reportFailure,
+    delivery,
+    breaker
+  );
+  const guard =
+    typeof options === "string" || typeof options.idempotency === "undefined"
+      ? null
+      : await makeIdempotencyGuard(params, options.idempotency);
+  // Failed requests are noticed by the retrier, so it's used for
+  // every request in at-least-once mode, guarded by a circuit
+  // breaker, or recorded as delivered.
+  const confirmed =
+    typeof retry !== "undefined" ||
+    typeof breaker !== "undefined" ||
+    delivery === "at-least-once" ||
+    guard !== null;
+  const releaseAcknowledgements =
+    delivery === "at-least-once"
+      ? requireAcknowledgements()
+      : () => {
+          // Nothing to release.
+        };
+  const sendOne = confirmed
+    ? (...args: Parameters<typeof deliverThing>) =>
+        retrier.run([], () => deliverThing(...args))
+    : sendThing;
+  const deliverMany = async (
+    ...args: Parameters<typeof deliverEvents>
+  ): Promise<boolean> => {
+    let delivered = false;
+    await retrier.run(args[0], async () => {
+      await deliverEvents(...args);
+      delivered = true;
+    });
+    return delivered;
+  };
+  const sendMany: (...args: Parameters<typeof deliverEvents>) => Promise<void> =
+    guard !== null
+      ? async (events, ...rest) => {
+          const pending = await guard.pending(events);
+          if (pending.length > 0) {
+            await guard.settle(pending, await deliverMany(pending, ...rest));
+          }
+        }
+      : confirmed
+      ? async (...args) => {
+          await deliverMany(...args);
+        }
+      : sendEvents;
+  // Concurrent requests count as work of the step until they finish.
+  const owner = currentStep();
+  const inFlight = (request: Promise<void>): Promise<void> => {
+    const finishWork = startWork(owner);
+    return request.finally(finishWork);
+  };
   let passThroughChannel: Channel<Event[], never>;
   const requests = new Array<Promise<void>>(concurrent);
   let i = 0;
@@ -110,7 +256,7 @@ export const make = async (
     passThroughChannel = drain(
       await makeProcessorChannel(params, options),
       async (response: unknown) => {
-        requests[i++] = sendThing(response, target, method, headers);
+        requests[i++] = inFlight(sendOne(response, target, method, headers));
         if (i === concurrent) {
           await Promise.all(requests);
           i = 0;
@@ -126,7 +272,7 @@ export const make = async (
         `step.${params.stepName}.send-http.accumulating`
       ).asChannel(),
       async (events: Event[]) => {
-        requests[i++] = sendEvents(events, target, method, headers);
+        requests[i++] = inFlight(sendMany(events, target, method, headers));
         if (i === concurrent) {
           await Promise.all(requests);
           i = 0;
@@ -147,8 +293,13 @@ export const make = async (
   return {
     ...forwardingChannel,
     close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
       await forwardingChannel.close();
       await passThroughChannel.close();
+      await guard?.close();
+      releaseAcknowledgements();
     },
   };
 };
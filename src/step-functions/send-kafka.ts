@@ -0,0 +1,290 @@
+import { Kafka, logLevel } from "kafkajs";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import {
+  DeliveryMode,
+  deliveryModeSchema,
+  requireAcknowledgements,
+} from "../delivery";
+import { Event } from "../event";
+import { Encoding, encodeMessage } from "../io/encoding";
+import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-kafka");
+
+/**
+ * Options for this function.
+ */
+export type SendKafkaFunctionOptions = {
+  brokers: string | string[];
+  topic: string;
+  key?: string;
+  "client-id"?: string;
+  "jq-expr"?: string;
+  "jsonnet-expr"?: string;
+  encoding?: "utf8" | "base64" | "msgpack" | "cbor";
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+  delivery?: DeliveryMode;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    brokers: {
+      anyOf: [
+        { type: "string", minLength: 1 },
+        {
+          type: "array",
+          items: { type: "string", minLength: 1 },
+          minItems: 1,
+        },
+      ],
+    },
+    topic: { type: "string", minLength: 1 },
+    key: { type: "string" },
+    "client-id": { type: "string", minLength: 1 },
+    "jq-expr": { type: "string", minLength: 1 },
+    "jsonnet-expr": { type: "string", minLength: 1 },
+    encoding: { enum: ["utf8", "base64", "msgpack", "cbor"] },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+    delivery: deliveryModeSchema,
+  },
+  additionalProperties: false,
+  required: ["brokers", "topic"],
+};
+
+/**
+ * Validate send-kafka options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendKafkaFunctionOptions
+): void => {
+  check(
+    match(options).with(
+      { "jq-expr": P.string, "jsonnet-expr": P.string },
+      () => false
+    ),
+    `step '${name}' can't use both jq and jsonnet expressions simultaneously`
+  );
+  check(
+    match(options)
+      .with({ encoding: "base64", "jq-expr": P.string }, () => true)
+      .with({ encoding: "base64", "jsonnet-expr": P.string }, () => true)
+      .with({ encoding: "base64" }, () => false),
+    `step '${name}' can only use base64 encoding along with ` +
+      "a jq or jsonnet expression"
+  );
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-kafka.retry", options.retry);
+  }
+};
+
+/**
+ * Default values for the kafka producer.
+ */
+const DEFAULT_CLIENT_ID = "cdp";
+const DEFAULT_KEY = "{name}";
+
+/**
+ * Build the partitioning key of an event from the key template, by
+ * replacing the `{name}` placeholder with the event's name.
+ *
+ * @param template The key template.
+ * @param event The event being sent.
+ * @returns The key for the event's message.
+ */
+const makeKey = (template: string, event: Event): string =>
+  template.replace(/\{name\}/g, event.name);
+
+/**
+ * Check that the kafka brokers are reachable, by fetching the
+ * cluster's metadata. The topic isn't checked, since brokers may
+ * create it on the first write.
+ *
+ * @param options The options that indicate how to connect to kafka.
+ * @returns A promise that resolves if the brokers are reachable.
+ */
+export const probe = async (
+  options: SendKafkaFunctionOptions
+): Promise<void> => {
+  const admin = new Kafka({
+    clientId: options["client-id"] ?? DEFAULT_CLIENT_ID,
+    brokers:
+      typeof options.brokers === "string" ? [options.brokers] : options.brokers,
+    logLevel: logLevel.NOTHING,
+    retry: { retries: 0 },
+  }).admin();
+  await admin.connect();
+  try {
+    await admin.describeCluster();
+  } finally {
+    await admin.disconnect();
+  }
+};
+
+/**
+ * Function that sends events to a kafka topic, and forwards the same
+ * events to the rest of the pipeline unmodified. In at-least-once
+ * delivery mode, writes are confirmed once every in-sync replica
+ * acknowledged them.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to connect and send
+ * events to kafka.
+ * @returns A channel that forwards events to a kafka topic.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendKafkaFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const brokers =
+    typeof options.brokers === "string" ? [options.brokers] : options.brokers;
+  const keyTemplate = options.key ?? DEFAULT_KEY;
+  // The utf8 and base64 encodings write JSON values, and processed
+  // strings as they are.
+  const encoding: Encoding =
+    options.encoding === "msgpack" || options.encoding === "cbor"
+      ? options.encoding
+      : "json";
+  const kafka = new Kafka({
+    clientId: options["client-id"] ?? DEFAULT_CLIENT_ID,
+    brokers,
+    logLevel: logLevel.ERROR,
+  });
+  const producer = kafka.producer();
+  await producer.connect();
+  const atLeastOnce = options.delivery === "at-least-once";
+  const acks = atLeastOnce ? { acks: -1 } : {};
+  const releaseAcknowledgements = atLeastOnce
+    ? requireAcknowledgements()
+    : () => {
+        // Nothing to release.
+      };
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    options.delivery,
+    options["circuit-breaker"]
+  );
+  const send = async (
+    events: Event[],
+    attempt: () => Promise<void>
+  ): Promise<void> => {
+    // Failed writes are noticed by the retrier, so it's used for
+    // every write in at-least-once mode, or guarded by a circuit
+    // breaker.
+    if (
+      typeof options.retry !== "undefined" ||
+      typeof options["circuit-breaker"] !== "undefined" ||
+      atLeastOnce
+    ) {
+      return retrier.run(events, attempt);
+    }
+    try {
+      await attempt();
+    } catch (err) {
+      logger.warn(`Kafka producer notified an error: ${err}`);
+    }
+  };
+
+  let passThroughChannel: Channel<Event[], never>;
+  if (
+    typeof options["jq-expr"] === "string" ||
+    typeof options["jsonnet-expr"] === "string"
+  ) {
+    passThroughChannel = drain(
+      await makeProcessorChannel(params, options),
+      async (message: unknown) => {
+        await send([], async () => {
+          await producer.send({
+            topic: options.topic,
+            ...acks,
+            messages: [
+              {
+                // Processed messages have no event to derive the key
+                // from, so only fixed keys apply.
+                key: keyTemplate.includes("{name}") ? null : keyTemplate,
+                // Strings may hold the base64 encoding of binary
+                // messages, such as Avro data.
+                value:
+                  typeof message !== "string" || encoding !== "json"
+                    ? encodeMessage(message, encoding)
+                    : options.encoding === "base64"
+                    ? Buffer.from(message, "base64")
+                    : message,
+              },
+            ],
+          });
+          logger.debug("Published payload to kafka topic", options.topic);
+        });
+      }
+    );
+  } else {
+    passThroughChannel = drain(
+      new AsyncQueue<Event[]>(
+        `step.${params.stepName}.send-kafka.pass-through`
+      ).asChannel(),
+      async (events: Event[]) => {
+        await send(events, async () => {
+          await producer.send({
+            topic: options.topic,
+            ...acks,
+            messages: events.map((event) => ({
+              key: makeKey(keyTemplate, event),
+              value: encodeMessage(event, encoding),
+              timestamp: Math.trunc(event.timestamp * 1000).toString(),
+            })),
+          });
+          logger.debug("Published events to kafka topic", options.topic);
+        });
+      }
+    );
+  }
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-kafka.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+      // Every pending message was awaited by the pass-through
+      // channel, so the producer can be disconnected safely.
+      await producer.disconnect();
+      releaseAcknowledgements();
+    },
+  };
+};
@@ -2,7 +2,24 @@ import { IClientOptions, connect } from "mqtt";
 import { match, P } from "ts-pattern";
 import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
 import { Event } from "../event";
+import {
+  Encoding,
+  encodingSchema,
+  binaryContentType,
+  encodeMessage,
+  encodeMessages,
+} from "../io/encoding";
 import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
 import { check } from "../utils";
 import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
 
@@ -23,6 +40,9 @@ export type SendMQTTFunctionOptions =
       qos?: 0 | 1 | 2;
       "jq-expr"?: string;
       "jsonnet-expr"?: string;
+      encoding?: Encoding;
+      retry?: RetryOptions;
+      "circuit-breaker"?: CircuitBreakerOptions;
     };
 
 /**
@@ -40,6 +60,9 @@ export const optionsSchema = {
         qos: { enum: [0, 1, 2] },
         "jq-expr": { type: "string", minLength: 1 },
         "jsonnet-expr": { type: "string", minLength: 1 },
+        encoding: encodingSchema,
+        retry: retryOptionsSchema,
+        "circuit-breaker": circuitBreakerOptionsSchema,
       },
       additionalProperties: false,
       required: ["url"],
@@ -66,6 +89,9 @@ export const validate = (
     ),
     `step '${name}' can't use both jq and jsonnet expressions simultaneously`
   );
+  if (typeof options !== "string" && typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-mqtt.retry", options.retry);
+  }
 };
 
 /**
@@ -96,6 +122,8 @@ export const make = async (
     typeof options === "string" || typeof options.qos === "undefined"
       ? 0
       : options.qos;
+  const encoding =
+    typeof options === "string" ? "json" : options.encoding ?? "json";
   const client =
     typeof options === "string" || typeof options.options === "undefined"
       ? connect(url, {})
@@ -103,6 +131,25 @@ export const make = async (
   client.on("error", (err) =>
     logger.error(`MQTT client notified an error: ${err}`)
   );
+  const retrier = makeRetrier(
+    params.stepName,
+    typeof options === "string" ? undefined : options.retry,
+    params.reportFailure,
+    "best-effort",
+    typeof options === "string" ? undefined : options["circuit-breaker"]
+  );
+  const publish = (
+    payload: string | Buffer,
+    contentType: string
+  ): Promise<void> =>
+    new Promise((resolve, reject) =>
+      client.publish(
+        topic,
+        payload,
+        { qos, properties: { contentType } },
+        (err) => (err ? reject(err) : resolve())
+      )
+    );
 
   let passThroughChannel: Channel<Event[], never>;
   if (
@@ -112,57 +159,33 @@ export const make = async (
   ) {
     passThroughChannel = drain(
       await makeProcessorChannel(params, options),
-      async (message: unknown) => {
-        await (new Promise((resolve) =>
-          client.publish(
-            topic,
-            typeof message === "string" ? message : JSON.stringify(message),
-            {
-              qos,
-              properties: {
-                contentType:
-                  typeof message === "string"
-                    ? "text/plain"
-                    : "application/json",
-              },
-            },
-            (err) => {
-              if (err) {
-                logger.warn(
-                  `MQTT client notified an error while publishing: ${err}`
-                );
-              }
-              resolve();
-            }
+      // Processed payloads can't be traced back to their events.
+      (message: unknown) =>
+        retrier.run([], () =>
+          publish(
+            encodeMessage(message, encoding),
+            encoding !== "json"
+              ? binaryContentType(encoding)
+              : typeof message === "string"
+              ? "text/plain"
+              : "application/json"
           )
-        ) as Promise<void>);
-      }
+        )
     );
   } else {
     passThroughChannel = drain(
       new AsyncQueue<Event[]>(
         `step.${params.stepName}.send-mqtt.pass-through`
       ).asChannel(),
-      async (events: Event[]) => {
-        await (new Promise((resolve) =>
-          client.publish(
-            topic,
-            events.map((e) => JSON.stringify(e)).join("\n") + "\n",
-            {
-              qos,
-              properties: { contentType: "application/x-ndjson" },
-            },
-            (err) => {
-              if (err) {
-                logger.warn(
-                  `MQTT client notified an error while publishing: ${err}`
-                );
-              }
-              resolve();
-            }
+      (events: Event[]) =>
+        retrier.run(events, () =>
+          publish(
+            encodeMessages(events, encoding),
+            encoding === "json"
+              ? "application/x-ndjson"
+              : binaryContentType(encoding, true)
           )
-        ) as Promise<void>);
-      }
+        )
     );
   }
   const queue = new AsyncQueue<Event[]>(
@@ -175,6 +198,9 @@ export const make = async (
   return {
     ...forwardingChannel,
     close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
       await forwardingChannel.close();
       await passThroughChannel.close();
       await (new Promise((resolve) =>
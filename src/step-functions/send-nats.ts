@@ -0,0 +1,202 @@
+import { connect, StringCodec } from "nats";
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import { Encoding, encodingSchema, encodeMessage } from "../io/encoding";
+import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-nats");
+
+/**
+ * Options for this function.
+ */
+export type SendNATSFunctionOptions = {
+  url: string | string[];
+  subject?: string;
+  jetstream?: boolean | "true" | "false";
+  "jq-expr"?: string;
+  "jsonnet-expr"?: string;
+  encoding?: Encoding;
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    url: {
+      anyOf: [
+        { type: "string", minLength: 1 },
+        {
+          type: "array",
+          items: { type: "string", minLength: 1 },
+          minItems: 1,
+        },
+      ],
+    },
+    subject: { type: "string", minLength: 1 },
+    jetstream: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    "jq-expr": { type: "string", minLength: 1 },
+    "jsonnet-expr": { type: "string", minLength: 1 },
+    encoding: encodingSchema,
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: ["url"],
+};
+
+/**
+ * Validate send-nats options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendNATSFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { "jq-expr": P.string, "jsonnet-expr": P.string },
+      () => false
+    ),
+    `step '${name}' can't use both jq and jsonnet expressions simultaneously`
+  );
+  check(
+    matchOptions
+      .with({ subject: P.string }, () => true)
+      .with({ "jq-expr": P.string }, () => false)
+      .with({ "jsonnet-expr": P.string }, () => false),
+    `step '${name}' must specify send-nats.subject when using jq or jsonnet expressions`
+  );
+  check(
+    matchOptions.with(
+      { subject: P.select(P.string) },
+      (subject) => !subject.includes("*") && !subject.includes(">")
+    ),
+    `step '${name}' can't use wildcards in send-nats.subject`
+  );
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-nats.retry", options.retry);
+  }
+};
+
+/**
+ * Check that the NATS server is reachable, by connecting to it.
+ *
+ * @param options The options that indicate the server's URL.
+ * @returns A promise that resolves if the server is reachable.
+ */
+export const probe = async (
+  options: SendNATSFunctionOptions
+): Promise<void> => {
+  const nc = await connect({ servers: options.url });
+  await nc.close();
+};
+
+/**
+ * Function that sends events to a NATS server, and forwards the same
+ * events to the rest of the pipeline unmodified. Unless a subject is
+ * given, each event is published to the subject matching its name.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to connect and send
+ * events to the NATS server.
+ * @returns A channel that forwards events to a NATS server.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendNATSFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const useJetStream =
+    typeof options.jetstream === "string"
+      ? options.jetstream === "true"
+      : options.jetstream ?? false;
+  const encoding = options.encoding ?? "json";
+  const codec = StringCodec();
+  const nc = await connect({ servers: options.url });
+  const js = nc.jetstream();
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+  const publish = async (subject: string, message: unknown): Promise<void> => {
+    const payload = encodeMessage(message, encoding);
+    const data = typeof payload === "string" ? codec.encode(payload) : payload;
+    if (useJetStream) {
+      await js.publish(subject, data);
+    } else {
+      nc.publish(subject, data);
+    }
+    logger.debug("Published payload to NATS subject", subject);
+  };
+
+  let passThroughChannel: Channel<Event[], never>;
+  if (
+    typeof options["jq-expr"] === "string" ||
+    typeof options["jsonnet-expr"] === "string"
+  ) {
+    passThroughChannel = drain(
+      await makeProcessorChannel(params, options),
+      // Processed payloads can't be traced back to their events.
+      (message: unknown) =>
+        retrier.run([], () => publish(options.subject as string, message))
+    );
+  } else {
+    passThroughChannel = drain(
+      new AsyncQueue<Event[]>(
+        `step.${params.stepName}.send-nats.pass-through`
+      ).asChannel(),
+      async (events: Event[]) => {
+        for (const event of events) {
+          await retrier.run([event], () =>
+            publish(options.subject ?? event.name, event)
+          );
+        }
+      }
+    );
+  }
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-nats.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+      // Draining flushes every message published so far.
+      await nc.drain();
+    },
+  };
+};
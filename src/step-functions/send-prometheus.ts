@@ -0,0 +1,408 @@
+import { AxiosError } from "axios";
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import { request } from "../io/http-client";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeWriteRequest, TimeSeries } from "../io/remote-write";
+import { makeLogger, truncatePayload } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { mergeHeaders } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-prometheus");
+
+/**
+ * Options for this function.
+ */
+export type SendPrometheusFunctionOptions = {
+  target: string;
+  "name-jq-expr"?: string;
+  "labels-jq-expr"?: string;
+  "value-jq-expr"?: string;
+  "time-jq-expr"?: string;
+  "flush-size"?: number | string;
+  "flush-interval"?: number | string;
+  headers?: { [key: string]: string | number | boolean };
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    target: { type: "string", minLength: 1 },
+    "name-jq-expr": { type: "string", minLength: 1 },
+    "labels-jq-expr": { type: "string", minLength: 1 },
+    "value-jq-expr": { type: "string", minLength: 1 },
+    "time-jq-expr": { type: "string", minLength: 1 },
+    "flush-size": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "flush-interval": {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: ["target"],
+};
+
+/**
+ * Validate send-prometheus options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendPrometheusFunctionOptions
+): void => {
+  if (
+    typeof options["flush-interval"] === "string" &&
+    parseFloat(options["flush-interval"]) <= 0
+  ) {
+    throw new Error(
+      `step '${name}' uses an invalid send-prometheus.flush-interval ` +
+        "value (must be > 0)"
+    );
+  }
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-prometheus.retry", options.retry);
+  }
+};
+
+/**
+ * Default maximum amount of samples sent in a single request.
+ */
+const DEFAULT_FLUSH_SIZE = 500;
+
+/**
+ * Default amount of seconds samples are held before being sent.
+ */
+const DEFAULT_FLUSH_INTERVAL = 5;
+
+/**
+ * Default jq expressions used to extract the parts of each sample.
+ */
+const DEFAULT_NAME_JQ_EXPR = ".d.name";
+const DEFAULT_LABELS_JQ_EXPR = ".d.labels";
+const DEFAULT_VALUE_JQ_EXPR = ".d.value";
+
+/**
+ * The syntax of metric and label names, as required by Prometheus.
+ */
+const METRIC_NAME = /^[a-zA-Z_:][a-zA-Z0-9_:]*$/;
+const LABEL_NAME = /^[a-zA-Z_][a-zA-Z0-9_]*$/;
+
+/**
+ * The values given as strings that Prometheus understands as special
+ * floating point values.
+ */
+const SPECIAL_VALUES: { [value: string]: number } = {
+  NaN: NaN,
+  Inf: Infinity,
+  "+Inf": Infinity,
+  "-Inf": -Infinity,
+};
+
+/**
+ * A sample waiting to be sent, along with the event it was built
+ * from.
+ */
+type PendingSample = {
+  event: Event;
+  labels: [string, string][];
+  value: number;
+  timestamp: number;
+};
+
+/**
+ * Build a sample from the parts extracted from an event.
+ *
+ * @param event The event the sample is built from.
+ * @param name The extracted metric name.
+ * @param labels The extracted labels.
+ * @param value The extracted value.
+ * @param time The extracted timestamp, in seconds, or undefined to use
+ * the event's arrival time.
+ * @returns The sample. Throws an error if any of the parts is
+ * malformed.
+ */
+const makeSample = (
+  event: Event,
+  name: unknown,
+  labels: unknown,
+  value: unknown,
+  time?: unknown
+): PendingSample => {
+  if (typeof name !== "string" || !METRIC_NAME.test(name)) {
+    throw new Error(`invalid metric name ${JSON.stringify(name) ?? "(none)"}`);
+  }
+  if (
+    typeof labels !== "undefined" &&
+    labels !== null &&
+    (typeof labels !== "object" || Array.isArray(labels))
+  ) {
+    throw new Error("the labels are not an object");
+  }
+  const pairs: [string, string][] = [["__name__", name]];
+  for (const [label, labelValue] of Object.entries(labels ?? {})) {
+    if (!LABEL_NAME.test(label) || label.startsWith("__")) {
+      throw new Error(`invalid label name ${JSON.stringify(label)}`);
+    }
+    if (
+      typeof labelValue !== "string" &&
+      typeof labelValue !== "number" &&
+      typeof labelValue !== "boolean"
+    ) {
+      throw new Error(`the value of label ${label} is not a scalar`);
+    }
+    // Empty label values are the same as absent labels.
+    if (labelValue !== "") {
+      pairs.push([label, labelValue.toString()]);
+    }
+  }
+  pairs.sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0));
+  const number =
+    typeof value === "number"
+      ? value
+      : typeof value === "string" && value in SPECIAL_VALUES
+      ? SPECIAL_VALUES[value]
+      : typeof value === "string" && value.trim() !== ""
+      ? Number(value)
+      : NaN;
+  if (isNaN(number) && value !== "NaN") {
+    throw new Error(`invalid sample value ${JSON.stringify(value)}`);
+  }
+  const seconds = typeof time === "undefined" ? event.timestamp : time;
+  if (typeof seconds !== "number" || !isFinite(seconds)) {
+    throw new Error(`invalid sample timestamp ${JSON.stringify(time)}`);
+  }
+  return {
+    event,
+    labels: pairs,
+    value: number,
+    timestamp: Math.round(seconds * 1000),
+  };
+};
+
+/**
+ * Group samples by their labels into time series, each one holding
+ * its samples in chronological order.
+ *
+ * @param samples The samples to group.
+ * @returns The time series.
+ */
+const groupSeries = (samples: PendingSample[]): TimeSeries[] => {
+  const series = new Map<string, TimeSeries>();
+  for (const { labels, value, timestamp } of samples) {
+    const key = JSON.stringify(labels);
+    const current = series.get(key) ?? { labels, samples: [] };
+    current.samples.push({ value, timestamp });
+    series.set(key, current);
+  }
+  return Array.from(series.values()).map(({ labels, samples }) => ({
+    labels,
+    samples: samples.sort((a, b) => a.timestamp - b.timestamp),
+  }));
+};
+
+/**
+ * Read the body of an error response, which holds the receiver's
+ * explanation.
+ *
+ * @param err The error of the request.
+ * @returns The body of the response, or an empty string.
+ */
+const readErrorBody = async (err: AxiosError): Promise<string> => {
+  const chunks: Buffer[] = [];
+  try {
+    for await (const chunk of err.response?.data ?? []) {
+      chunks.push(typeof chunk === "string" ? Buffer.from(chunk) : chunk);
+    }
+  } catch (_) {
+    // The explanation is optional.
+  }
+  return Buffer.concat(chunks).toString("utf8").trim();
+};
+
+/**
+ * Function that sends metric samples to a Prometheus-compatible
+ * storage using the remote-write protocol, and forwards the same
+ * events to the rest of the pipeline unmodified. Each event is a
+ * sample, whose metric name, labels, value and timestamp are
+ * extracted with jq expressions. Samples are buffered and sent once
+ * enough of them accumulate, or periodically. Malformed samples, and
+ * those rejected by the receiver with a 4xx status, aren't retried:
+ * their events are dead-lettered if the step has a dead-letter name.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to build and send
+ * samples.
+ * @returns A channel that forwards events to a remote-write receiver.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendPrometheusFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const headers = mergeHeaders(options.headers ?? {}, {
+    "Content-Encoding": "snappy",
+    "Content-Type": "application/x-protobuf",
+    "X-Prometheus-Remote-Write-Version": "0.1.0",
+  });
+  const flushSize =
+    typeof options["flush-size"] === "string"
+      ? parseInt(options["flush-size"], 10)
+      : options["flush-size"] ?? DEFAULT_FLUSH_SIZE;
+  const flushInterval =
+    (typeof options["flush-interval"] === "string"
+      ? parseFloat(options["flush-interval"])
+      : options["flush-interval"] ?? DEFAULT_FLUSH_INTERVAL) * 1000;
+  const hasTime = typeof options["time-jq-expr"] === "string";
+  const extractor = await jqProcessor.makeChannel<Event[]>(
+    makeExtractionProgram(
+      options["name-jq-expr"] ?? DEFAULT_NAME_JQ_EXPR,
+      options["labels-jq-expr"] ?? DEFAULT_LABELS_JQ_EXPR,
+      options["value-jq-expr"] ?? DEFAULT_VALUE_JQ_EXPR,
+      options["time-jq-expr"]
+    ),
+    { prelude: params["jq-prelude"] }
+  );
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+  const stepLogger = logger.with({ step: params.stepName });
+  const reportFailure = params.reportFailure;
+
+  // Sends the given samples in a single request. Requests that fail
+  // with 5xx statuses are retried by the HTTP client, and then by the
+  // retrier. Samples rejected with other 4xx statuses than 429 won't
+  // be accepted on a retry, so they're dead-lettered right away.
+  const attempt = async (samples: PendingSample[]): Promise<void> => {
+    try {
+      await request({
+        url: options.target,
+        method: "POST",
+        data: encodeWriteRequest(groupSeries(samples)),
+        transformRequest: [(data) => data],
+        headers,
+      });
+      stepLogger.debug("Sent", samples.length, "samples to", options.target);
+    } catch (err) {
+      const status = (err as AxiosError).response?.status ?? 0;
+      if (status < 400 || status >= 500 || status === 429) {
+        throw err;
+      }
+      const body = await readErrorBody(err as AxiosError);
+      const reason =
+        `the receiver rejected ${samples.length} samples ` +
+        `with status ${status}${body === "" ? "" : `: ${body}`}`;
+      stepLogger.warn(reason);
+      await reportFailure?.(samples.map(({ event }) => event), reason);
+    }
+  };
+
+  // Buffered samples are flushed one request at a time.
+  const buffer: PendingSample[] = [];
+  let flushing: Promise<void> = Promise.resolve();
+  const flush = (): Promise<void> => {
+    while (buffer.length > 0) {
+      const samples = buffer.splice(0, flushSize);
+      const events = samples.map(({ event }) => event);
+      flushing = flushing.then(() =>
+        retrier.run(events, () => attempt(samples))
+      );
+    }
+    return flushing;
+  };
+  const timer = setInterval(flush, flushInterval);
+
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-prometheus.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      const extracted: unknown[][] =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+      for (const [index, event] of events.entries()) {
+        const [name, labels, value, time] = extracted[index] ?? [];
+        try {
+          buffer.push(
+            makeSample(event, name, labels, value, hasTime ? time : undefined)
+          );
+        } catch (err) {
+          const reason = `${err}`;
+          stepLogger
+            .with({
+              event: event.name,
+              reason,
+              payload: truncatePayload(event.data),
+            })
+            .warn("Couldn't build a sample from event");
+          await reportFailure?.([event], reason);
+        }
+      }
+      if (buffer.length >= flushSize) {
+        await flush();
+      }
+    },
+    async () => {
+      clearInterval(timer);
+      await flush();
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-prometheus.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // As with send-elasticsearch, the retrier isn't stopped, so
+      // that buffered samples get their retries once the channel
+      // closes, bounded by the shutdown timeout.
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+      await extractor.close();
+    },
+  };
+};
@@ -0,0 +1,198 @@
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import {
+  PubSubConnectionOptions,
+  connectionOptionsSchema,
+  invalidPlaceholders,
+  makeClient,
+  renderTemplate,
+} from "../io/pubsub";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-pubsub");
+
+/**
+ * Options for this function.
+ */
+export type SendPubSubFunctionOptions = PubSubConnectionOptions & {
+  topic: string;
+  "ordering-key"?: string;
+  attributes?: { [key: string]: string };
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    topic: { type: "string", minLength: 1 },
+    ...connectionOptionsSchema,
+    "ordering-key": { type: "string", minLength: 1 },
+    attributes: {
+      type: "object",
+      additionalProperties: { type: "string" },
+    },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: ["topic"],
+};
+
+/**
+ * Validate send-pubsub options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendPubSubFunctionOptions
+): void => {
+  const templates = Object.entries(options.attributes ?? {}).map(
+    ([key, template]) => [`send-pubsub.attributes.${key}`, template]
+  );
+  if (typeof options["ordering-key"] === "string") {
+    templates.push(["send-pubsub.ordering-key", options["ordering-key"]]);
+  }
+  for (const [option, template] of templates) {
+    for (const placeholder of invalidPlaceholders(template)) {
+      throw new Error(
+        `step '${name}' uses an invalid placeholder in ${option}: ` +
+          `{${placeholder}}`
+      );
+    }
+  }
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-pubsub.retry", options.retry);
+  }
+};
+
+/**
+ * Function that always sends forward the events in the vectors it
+ * receives, unmodified. It also publishes those events to a Pub/Sub
+ * topic, one message per event, with attributes and an optional
+ * ordering key built from templates.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to connect to the
+ * topic and how to build messages.
+ * @returns A channel that forwards events to a Pub/Sub topic.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendPubSubFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const orderingTemplate = options["ordering-key"];
+  const attributeTemplates = Object.entries(options.attributes ?? {});
+  const client = makeClient(options);
+  const topic = client.topic(options.topic, {
+    messageOrdering: typeof orderingTemplate === "string",
+  });
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+
+  const publish = async (event: Event): Promise<void> => {
+    const orderingKey =
+      typeof orderingTemplate === "string"
+        ? renderTemplate(orderingTemplate, event)
+        : undefined;
+    try {
+      await topic.publishMessage({
+        data: Buffer.from(encodeJson(event)),
+        attributes: Object.fromEntries(
+          attributeTemplates.map(([key, template]) => [
+            key,
+            renderTemplate(template, event),
+          ])
+        ),
+        ...(typeof orderingKey === "string" && orderingKey.length > 0
+          ? { orderingKey }
+          : {}),
+      });
+    } catch (err) {
+      // Publishing for an ordering key is paused by the client after
+      // a failure, until it's explicitly resumed.
+      if (typeof orderingKey === "string" && orderingKey.length > 0) {
+        topic.resumePublishing(orderingKey);
+      }
+      throw err;
+    }
+  };
+
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-pubsub.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      // Only the events that failed are published again. The pending
+      // events are the ones dead-lettered if every attempt fails.
+      const pending = events.slice();
+      await retrier.run(pending, async () => {
+        const results = await Promise.allSettled(pending.map(publish));
+        const remaining = pending.filter(
+          (_, index) => results[index].status === "rejected"
+        );
+        logger.debug(
+          "Published",
+          pending.length - remaining.length,
+          "messages to Pub/Sub topic"
+        );
+        const failure = results.find(
+          (result): result is PromiseRejectedResult =>
+            result.status === "rejected"
+        );
+        pending.splice(0, pending.length, ...remaining);
+        if (typeof failure !== "undefined") {
+          throw new Error(
+            `couldn't publish ${remaining.length} messages: ` +
+              `${failure.reason}`
+          );
+        }
+      });
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-pubsub.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+      await topic.flush();
+      await client.close();
+    },
+  };
+};
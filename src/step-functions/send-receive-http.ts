@@ -1,4 +1,5 @@
 import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
 import { Channel, AsyncQueue, flatMap } from "../async-queue";
 import {
   Event,
@@ -8,7 +9,11 @@ import {
 } from "../event";
 import { check } from "../utils";
 import { sendReceiveEvents, sendReceiveThing } from "../io/http-client";
-import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
+import {
+  PipelineStepFunctionParameters,
+  makeProcessorChannel,
+  makeTimeoutGuard,
+} from ".";
 
 /**
  * Options for this function.
@@ -82,6 +87,25 @@ export const validate = (
   );
 };
 
+/**
+ * The names of the events send-receive-http may emit, which can't be
+ * known in advance since they're given by the remote endpoint.
+ *
+ * @returns Unknown names.
+ */
+export const emits = (): EventNames => null;
+
+/**
+ * The send-receive-http function honors the step's timeout, aborting
+ * requests that take too long.
+ */
+export const supportsTimeout = true;
+
+/**
+ * Each request is independent from the others.
+ */
+export const stateless = true;
+
 /**
  * Function that sends events to a remote HTTP endpoint, parses the
  * response and interprets it as transformed events, and forwards
@@ -102,6 +126,7 @@ export const make = async (
     typeof options === "string" ? "POST" : options.method ?? "POST";
   const headers = typeof options === "string" ? {} : options.headers ?? {};
   const wrap = typeof options === "string" ? undefined : options.wrap;
+  const guard = makeTimeoutGuard(params);
   if (
     typeof options !== "string" &&
     (typeof options["jq-expr"] === "string" ||
@@ -109,16 +134,21 @@ export const make = async (
   ) {
     const processingChannel: Channel<Event[], unknown> =
       await makeProcessorChannel(params, options);
+    // Processed payloads aren't events, so there's nothing to
+    // dead-letter when their requests time out.
     return flatMap(
       (thing: unknown) =>
-        sendReceiveThing(
-          thing,
-          params.pipelineName,
-          params.pipelineSignature,
-          target,
-          method,
-          headers,
-          wrap
+        guard([], (signal) =>
+          sendReceiveThing(
+            thing,
+            params.pipelineName,
+            params.pipelineSignature,
+            target,
+            method,
+            headers,
+            wrap,
+            signal
+          )
         ),
       processingChannel
     );
@@ -128,14 +158,17 @@ export const make = async (
     );
     return flatMap(
       (events: Event[]) =>
-        sendReceiveEvents(
-          events,
-          params.pipelineName,
-          params.pipelineSignature,
-          target,
-          method,
-          headers,
-          wrap
+        guard(events, (signal) =>
+          sendReceiveEvents(
+            events,
+            params.pipelineName,
+            params.pipelineSignature,
+            target,
+            method,
+            headers,
+            wrap,
+            signal
+          )
         ),
       queue.asChannel()
     );
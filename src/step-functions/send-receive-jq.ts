@@ -1,13 +1,16 @@
 import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
 import { Channel, flatMap } from "../async-queue";
 import {
   Event,
   makeOldEventParser,
   parseChannel,
+  parseVector,
   WrapDirective,
   wrapDirectiveSchema,
   chooseParser,
   makeWrapper,
+  SerializedEvent,
   validateWrap,
 } from "../event";
 import { check } from "../utils";
@@ -22,6 +25,7 @@ export type SendReceiveJqFunctionOptions =
   | {
       "jq-expr": string;
       wrap?: WrapDirective;
+      "tag-metadata"?: boolean | "true" | "false";
     };
 
 /**
@@ -35,6 +39,9 @@ export const optionsSchema = {
       properties: {
         "jq-expr": { type: "string", minLength: 1 },
         wrap: wrapDirectiveSchema,
+        "tag-metadata": {
+          anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+        },
       },
       additionalProperties: false,
       required: ["jq-expr"],
@@ -60,6 +67,88 @@ export const validate = (
   );
 };
 
+/**
+ * The field of wrapped output values that may hold the name of the
+ * event, when using tag metadata.
+ */
+const TAG_FIELD = "__tag";
+
+/**
+ * Binds the `$tag` variable for the given jq program, to the name of
+ * the first event in the input vector.
+ *
+ * @param program The jq program.
+ * @returns The jq program with the binding.
+ */
+const bindTag = (program: string): string =>
+  `(.[0].n? // null) as $tag | (${program})`;
+
+/**
+ * The field of jq output values that signals a failure of the
+ * program, when reporting failures.
+ */
+const FAILURE_FIELD = "__cdp_failure";
+
+/**
+ * Wraps the given jq program so that errors produce a failure value
+ * holding the error and the input vector, instead of being ignored.
+ *
+ * @param program The jq program.
+ * @returns The jq program that produces failure values.
+ */
+const catchFailures = (program: string): string =>
+  `. as $__cdp_input | try (${program}) ` +
+  `catch {${FAILURE_FIELD}: {error: ., input: $__cdp_input}}`;
+
+/**
+ * Extracts the failure details from a jq output value, if it's a
+ * failure value.
+ *
+ * @param d The jq output value.
+ * @returns The failure details, or null if it's not a failure.
+ */
+const asFailure = (d: unknown): { error: unknown; input: unknown } | null =>
+  typeof d === "object" &&
+  d !== null &&
+  !Array.isArray(d) &&
+  Object.keys(d).length === 1 &&
+  typeof (d as Record<string, unknown>)[FAILURE_FIELD] === "object"
+    ? ((d as Record<string, unknown>)[FAILURE_FIELD] as {
+        error: unknown;
+        input: unknown;
+      })
+    : null;
+
+/**
+ * Builds a wrapper for jq output which takes the name of the event
+ * from the value's tag field, if present.
+ *
+ * @param wrapper The wrapper to use for values without a tag field.
+ * @returns A wrapper that honors the tag field.
+ */
+const makeTagWrapper =
+  (wrapper: (d: unknown) => SerializedEvent) =>
+  (d: unknown): SerializedEvent => {
+    if (
+      typeof d === "object" &&
+      d !== null &&
+      !Array.isArray(d) &&
+      typeof (d as Record<string, unknown>)[TAG_FIELD] === "string"
+    ) {
+      const { [TAG_FIELD]: n, ...rest } = d as Record<string, unknown>;
+      return { ...wrapper(rest), n: n as string };
+    }
+    return wrapper(d);
+  };
+
+/**
+ * The names of the events send-receive-jq may emit, which can't be
+ * known in advance since they're given by the jq program.
+ *
+ * @returns Unknown names.
+ */
+export const emits = (): EventNames => null;
+
 /**
  * Function that transforms events using jq.
  *
@@ -71,11 +160,26 @@ export const make = async (
   params: PipelineStepFunctionParameters,
   options: SendReceiveJqFunctionOptions
 ): Promise<Channel<Event[], Event>> => {
-  const program = typeof options === "string" ? options : options["jq-expr"];
-  const parse = chooseParser((typeof options === "string" ? {} : options).wrap);
-  const wrapper = makeWrapper(
-    (typeof options === "string" ? {} : options).wrap
-  );
+  const tagMetadata =
+    typeof options === "string"
+      ? false
+      : typeof options["tag-metadata"] === "string"
+      ? options["tag-metadata"] === "true"
+      : options["tag-metadata"] ?? false;
+  const rawProgram =
+    typeof options === "string" ? options : options["jq-expr"];
+  const reportFailure = params.reportFailure;
+  const taggedProgram = tagMetadata ? bindTag(rawProgram) : rawProgram;
+  const program =
+    typeof reportFailure === "undefined"
+      ? taggedProgram
+      : catchFailures(taggedProgram);
+  const wrap = (typeof options === "string" ? {} : options).wrap;
+  const parse = chooseParser(wrap);
+  const wrapper =
+    tagMetadata && typeof wrap !== "undefined"
+      ? makeTagWrapper(makeWrapper(wrap))
+      : makeWrapper(wrap);
   const parser = makeOldEventParser(
     params.pipelineName,
     params.pipelineSignature
@@ -88,7 +192,19 @@ export const make = async (
     }
   );
   return parseChannel(
-    flatMap(async (d) => [wrapper(d)], channel),
+    flatMap(async (d) => {
+      const failure = asFailure(d);
+      if (failure !== null && typeof reportFailure !== "undefined") {
+        await reportFailure(
+          await parseVector(failure.input, parser, "parsing jq input"),
+          typeof failure.error === "string"
+            ? failure.error
+            : JSON.stringify(failure.error)
+        );
+        return [];
+      }
+      return [wrapper(d)];
+    }, channel),
     parser,
     "parsing jq output"
   );
@@ -1,4 +1,5 @@
 import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
 import { Channel, flatMap } from "../async-queue";
 import {
   Event,
@@ -60,6 +61,14 @@ export const validate = (
   );
 };
 
+/**
+ * The names of the events send-receive-jsonnet may emit, which can't
+ * be known in advance since they're given by the jsonnet program.
+ *
+ * @returns Unknown names.
+ */
+export const emits = (): EventNames => null;
+
 /**
  * Function that transforms events using jsonnet.
  *
@@ -1,8 +1,19 @@
 import { match, P } from "ts-pattern";
 import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
 import { Event } from "../event";
+import { encodeJson } from "../json";
 import { makeLogger } from "../log";
 import { check } from "../utils";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
 import {
   connect,
   RedisConnectionOptions,
@@ -26,6 +37,8 @@ export interface SendRedisFunctionOptions extends RedisConnectionOptions {
   lpush?: string;
   "jq-expr"?: string;
   "jsonnet-expr"?: string;
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
 }
 
 /**
@@ -49,6 +62,8 @@ const buildSchema = (
     },
     "jq-expr": { type: "string", minLength: 1 },
     "jsonnet-expr": { type: "string", minLength: 1 },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
   },
   additionalProperties: false,
   required: [baseKey, key],
@@ -86,55 +101,41 @@ export const validate = (
     ),
     `step '${name}' can't use both jq and jsonnet expressions simultaneously`
   );
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-redis.retry", options.retry);
+  }
 };
 
 /**
- * Sends a message to redis according to the given options.
+ * Sends messages to redis according to the given options. Messages
+ * published one at a time are counted as they're sent, so that a
+ * retry of the same messages doesn't publish them again.
  *
  * @param client The redis connection.
  * @param options The sending options.
- * @returns A function that will send any JSON-encodable thing to the
- * redis instance or cluster.
+ * @returns A function that will send any JSON-encodable things to
+ * the redis instance or cluster, failing if they couldn't be sent.
  */
-const sendMessage =
+const sendMessages =
   (client: RedisConnection, options: SendRedisFunctionOptions) =>
-  async (...messages: unknown[]): Promise<void> => {
-    if (typeof options.publish !== "undefined") {
-      try {
-        for (const message of messages) {
-          await client.publish(
-            options.publish,
-            typeof message === "string" ? message : JSON.stringify(message)
-          );
+  (messages: unknown[]): (() => Promise<void>) => {
+    const payloads = messages.map((message) =>
+      typeof message === "string" ? message : encodeJson(message)
+    );
+    let published = 0;
+    return async () => {
+      if (typeof options.publish !== "undefined") {
+        for (; published < payloads.length; published++) {
+          await client.publish(options.publish, payloads[published]);
         }
-      } catch (err) {
-        logger.warn(`Couldn't publish payload to redis: ${err}`);
+      } else if (typeof options.rpush !== "undefined") {
+        await client.rpush(options.rpush, ...payloads);
+      } else if (typeof options.lpush !== "undefined") {
+        await client.lpush(options.lpush, ...payloads);
+      } else {
+        logger.error("Misconfigured send-redis step function");
       }
-    } else if (typeof options.rpush !== "undefined") {
-      try {
-        await client.rpush(
-          options.rpush,
-          ...messages.map((message) =>
-            typeof message === "string" ? message : JSON.stringify(message)
-          )
-        );
-      } catch (err) {
-        logger.warn(`Couldn't rpush payload to redis: ${err}`);
-      }
-    } else if (typeof options.lpush !== "undefined") {
-      try {
-        await client.lpush(
-          options.lpush,
-          ...messages.map((message) =>
-            typeof message === "string" ? message : JSON.stringify(message)
-          )
-        );
-      } catch (err) {
-        logger.warn(`Couldn't lpush payload to redis: ${err}`);
-      }
-    } else {
-      logger.error("Misconfigured send-redis step function");
-    }
+    };
   };
 
 /**
@@ -151,6 +152,14 @@ export const make = async (
   options: SendRedisFunctionOptions
 ): Promise<Channel<Event[], Event>> => {
   const client: RedisConnection = connect(options);
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+  const send = sendMessages(client, options);
   let passThroughChannel: Channel<Event[], never>;
   if (
     typeof options["jq-expr"] === "string" ||
@@ -158,19 +167,16 @@ export const make = async (
   ) {
     passThroughChannel = drain(
       await makeProcessorChannel(params, options),
-      sendMessage(client, options)
+      // Processed payloads can't be traced back to their events.
+      (message: unknown) => retrier.run([], send([message]))
     );
   } else {
     passThroughChannel = drain(
       new AsyncQueue<Event[]>(
         `step.${params.stepName}.send-redis.pass-through`
       ).asChannel(),
-      async (events: Event[]) => {
-        await sendMessage(
-          client,
-          options
-        )(...events.map((event) => event.toJSON()));
-      }
+      (events: Event[]) =>
+        retrier.run(events, send(events.map((event) => event.toJSON())))
     );
   }
   const queue = new AsyncQueue<Event[]>(
@@ -183,6 +189,9 @@ export const make = async (
   return {
     ...forwardingChannel,
     close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
       await forwardingChannel.close();
       await passThroughChannel.close();
       await client.quit();
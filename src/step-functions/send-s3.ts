@@ -0,0 +1,330 @@
+import { randomBytes } from "crypto";
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import { compress } from "../io/compression";
+import { S3ConnectionOptions, putObject } from "../io/s3";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-s3");
+
+/**
+ * Options for this function.
+ */
+export type SendS3FunctionOptions = {
+  bucket: string;
+  endpoint?: string;
+  region?: string;
+  "path-style"?: boolean | "true" | "false";
+  "access-key-id": string;
+  "secret-access-key": string;
+  "session-token"?: string;
+  key?: string;
+  gzip?: boolean | "true" | "false";
+  "max-size"?: number | string;
+  "max-age"?: number | string;
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    bucket: { type: "string", minLength: 1 },
+    endpoint: { type: "string", minLength: 1 },
+    region: { type: "string", minLength: 1 },
+    "path-style": {
+      anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+    },
+    "access-key-id": { type: "string", minLength: 1 },
+    "secret-access-key": { type: "string", minLength: 1 },
+    "session-token": { type: "string", minLength: 1 },
+    key: { type: "string", minLength: 1 },
+    gzip: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    "max-size": {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "max-age": {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: ["bucket", "access-key-id", "secret-access-key"],
+};
+
+/**
+ * The placeholders allowed in key templates.
+ */
+const PLACEHOLDER = /\{([^{}]*)\}/g;
+const PLACEHOLDERS = ["year", "month", "day", "hour", "minute", "name", "part"];
+
+/**
+ * Validate send-s3 options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendS3FunctionOptions
+): void => {
+  for (const [, placeholder] of (options.key ?? "").matchAll(PLACEHOLDER)) {
+    if (!PLACEHOLDERS.includes(placeholder)) {
+      throw new Error(
+        `step '${name}' uses an invalid placeholder in send-s3.key: ` +
+          `{${placeholder}}`
+      );
+    }
+  }
+  if (
+    typeof options["max-age"] === "string" &&
+    parseFloat(options["max-age"]) <= 0
+  ) {
+    throw new Error(
+      `step '${name}' uses an invalid send-s3.max-age value (must be > 0)`
+    );
+  }
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-s3.retry", options.retry);
+  }
+};
+
+/**
+ * Default values for the objects uploaded.
+ */
+const DEFAULT_REGION = "us-east-1";
+const DEFAULT_KEY = "{year}/{month}/{day}/{hour}/{name}.ndjson";
+const DEFAULT_MAX_SIZE = 8 * 1024 * 1024;
+const DEFAULT_MAX_AGE = 60;
+
+/**
+ * Parse a boolean given as an option.
+ *
+ * @param value The option's value.
+ * @param defaultValue The value used if the option is absent.
+ * @returns The boolean.
+ */
+const parseBoolean = (
+  value: boolean | "true" | "false" | undefined,
+  defaultValue: boolean
+): boolean =>
+  typeof value === "string" ? value === "true" : value ?? defaultValue;
+
+/**
+ * Make sure the key template holds the `{part}` placeholder, which is
+ * replaced with a unique value for each object uploaded. If it lacks
+ * it, it's inserted before the extension of the object's name.
+ *
+ * @param template The key template.
+ * @returns The key template, with the `{part}` placeholder.
+ */
+const withPart = (template: string): string => {
+  if (template.includes("{part}")) {
+    return template;
+  }
+  // The extension starts after the last placeholder, since event
+  // names may hold dots too.
+  const start = Math.max(
+    template.lastIndexOf("/") + 1,
+    template.lastIndexOf("}") + 1
+  );
+  const dot = template.indexOf(".", start);
+  return dot === -1
+    ? `${template}-{part}`
+    : `${template.slice(0, dot)}-{part}${template.slice(dot)}`;
+};
+
+/**
+ * Build the key of the object an event is stored in from the key
+ * template, by replacing its placeholders with the event's name and
+ * the time of its arrival to the pipeline, in UTC. The `{part}`
+ * placeholder is left in place, since it's only replaced when the
+ * object is uploaded.
+ *
+ * @param template The key template.
+ * @param event The event being stored.
+ * @returns The key of the object, with the `{part}` placeholder.
+ */
+export const makePartitionKey = (template: string, event: Event): string => {
+  const time = new Date(event.timestamp * 1000).toISOString();
+  const values: { [placeholder: string]: string } = {
+    year: time.slice(0, 4),
+    month: time.slice(5, 7),
+    day: time.slice(8, 10),
+    hour: time.slice(11, 13),
+    minute: time.slice(14, 16),
+    name: event.name,
+    part: "{part}",
+  };
+  return withPart(template).replace(
+    PLACEHOLDER,
+    (_, placeholder: string) => values[placeholder] ?? ""
+  );
+};
+
+/**
+ * An object being filled with events, before it's uploaded.
+ */
+type OpenObject = {
+  events: Event[];
+  lines: string[];
+  size: number;
+  timer: ReturnType<typeof setTimeout>;
+};
+
+/**
+ * Function that always sends forward the events in the vectors it
+ * receives, unmodified. It also stores those events in objects of an
+ * S3-compatible storage service, as lines of JSON partitioned by
+ * their name and time of arrival. Each object is uploaded in a single
+ * request once it grows too large or too old, so readers only ever
+ * see complete objects.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to connect to the
+ * storage service and how to build objects.
+ * @returns A channel that forwards events to object storage.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendS3FunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const connection: S3ConnectionOptions = {
+    endpoint: options.endpoint,
+    region: options.region ?? DEFAULT_REGION,
+    bucket: options.bucket,
+    pathStyle: parseBoolean(
+      options["path-style"],
+      typeof options.endpoint === "string"
+    ),
+    accessKeyId: options["access-key-id"],
+    secretAccessKey: options["secret-access-key"],
+    sessionToken: options["session-token"],
+  };
+  const gzip = parseBoolean(options.gzip, false);
+  const template = options.key ?? (gzip ? `${DEFAULT_KEY}.gz` : DEFAULT_KEY);
+  const contentType = gzip ? "application/gzip" : "application/x-ndjson";
+  const maxSize =
+    typeof options["max-size"] === "string"
+      ? parseInt(options["max-size"], 10)
+      : options["max-size"] ?? DEFAULT_MAX_SIZE;
+  const maxAge =
+    (typeof options["max-age"] === "string"
+      ? parseFloat(options["max-age"])
+      : options["max-age"] ?? DEFAULT_MAX_AGE) * 1000;
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+
+  // Objects are uploaded one at a time, in the order they're closed.
+  const objects = new Map<string, OpenObject>();
+  let uploading: Promise<void> = Promise.resolve();
+  const upload = (partitionKey: string): Promise<void> => {
+    const object = objects.get(partitionKey);
+    if (typeof object === "undefined") {
+      return uploading;
+    }
+    objects.delete(partitionKey);
+    clearTimeout(object.timer);
+    // The key is fixed before any attempt, so that retries of an
+    // upload replace the same object.
+    const key = partitionKey.replace(
+      /\{part\}/g,
+      `${Date.now()}-${randomBytes(4).toString("hex")}`
+    );
+    let body: Buffer | null = null;
+    uploading = uploading.then(() =>
+      retrier.run(object.events, async () => {
+        if (body === null) {
+          const contents = Buffer.from(object.lines.join(""));
+          body = gzip ? await compress(contents, "gzip") : contents;
+        }
+        await putObject(connection, key, body, contentType);
+        logger.debug("Uploaded", object.events.length, "events to", key);
+      })
+    );
+    return uploading;
+  };
+
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-s3.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      for (const event of events) {
+        const partitionKey = makePartitionKey(template, event);
+        let object = objects.get(partitionKey);
+        if (typeof object === "undefined") {
+          object = {
+            events: [],
+            lines: [],
+            size: 0,
+            timer: setTimeout(() => upload(partitionKey), maxAge),
+          };
+          objects.set(partitionKey, object);
+        }
+        const line = encodeJson(event) + "\n";
+        object.events.push(event);
+        object.lines.push(line);
+        object.size += Buffer.byteLength(line);
+        if (object.size >= maxSize) {
+          upload(partitionKey);
+        }
+      }
+    },
+    async () => {
+      for (const partitionKey of [...objects.keys()]) {
+        upload(partitionKey);
+      }
+      await uploading;
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-s3.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // The retrier isn't stopped, since every open object is only
+      // uploaded once the channel closes, and their retries are the
+      // last chance to store them. The shutdown timeout still bounds
+      // the wait.
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+    },
+  };
+};
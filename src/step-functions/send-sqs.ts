@@ -0,0 +1,294 @@
+import { randomBytes } from "crypto";
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import {
+  SQSConnectionOptions,
+  SQSBatchFailure,
+  callSQS,
+  describeFailures,
+  isFIFO,
+  regionFromURL,
+} from "../io/sqs";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-sqs");
+
+/**
+ * Options for this function.
+ */
+export type SendSQSFunctionOptions = {
+  "queue-url": string;
+  endpoint?: string;
+  region?: string;
+  "access-key-id": string;
+  "secret-access-key": string;
+  "session-token"?: string;
+  "group-id"?: string;
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    "queue-url": { type: "string", minLength: 1 },
+    endpoint: { type: "string", minLength: 1 },
+    region: { type: "string", minLength: 1 },
+    "access-key-id": { type: "string", minLength: 1 },
+    "secret-access-key": { type: "string", minLength: 1 },
+    "session-token": { type: "string", minLength: 1 },
+    "group-id": { type: "string", minLength: 1 },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: ["queue-url", "access-key-id", "secret-access-key"],
+};
+
+/**
+ * The placeholders allowed in group id templates.
+ */
+const PLACEHOLDER = /\{([^{}]*)\}/g;
+const PLACEHOLDERS = ["name"];
+
+/**
+ * Validate send-sqs options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendSQSFunctionOptions
+): void => {
+  if (
+    typeof options["group-id"] !== "undefined" &&
+    !isFIFO(options["queue-url"])
+  ) {
+    throw new Error(
+      `step '${name}' can use send-sqs.group-id only with FIFO queues`
+    );
+  }
+  for (const [, placeholder] of (options["group-id"] ?? "").matchAll(
+    PLACEHOLDER
+  )) {
+    if (!PLACEHOLDERS.includes(placeholder)) {
+      throw new Error(
+        `step '${name}' uses an invalid placeholder in send-sqs.group-id: ` +
+          `{${placeholder}}`
+      );
+    }
+  }
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-sqs.retry", options.retry);
+  }
+};
+
+/**
+ * Default values for the messages sent.
+ */
+const DEFAULT_REGION = "us-east-1";
+const DEFAULT_GROUP_ID = "{name}";
+
+/**
+ * Limits of a single SendMessageBatch request.
+ */
+const MAX_BATCH_SIZE = 10;
+const MAX_BATCH_BYTES = 256 * 1024;
+
+/**
+ * Build the group id of the message an event is sent in, by
+ * replacing the placeholders of the template with the event's
+ * properties.
+ *
+ * @param template The group id template.
+ * @param event The event being sent.
+ * @returns The group id.
+ */
+export const makeGroupId = (template: string, event: Event): string => {
+  const values: { [placeholder: string]: string } = { name: event.name };
+  return template.replace(
+    PLACEHOLDER,
+    (_, placeholder: string) => values[placeholder] ?? ""
+  );
+};
+
+/**
+ * An entry of a SendMessageBatch request.
+ */
+interface Entry {
+  event: Event;
+  body: string;
+  groupId?: string;
+  deduplicationId?: string;
+}
+
+/**
+ * Split entries in batches that don't exceed the limits of a single
+ * SendMessageBatch request.
+ *
+ * @param entries The entries to split.
+ * @returns The batches.
+ */
+const makeBatches = (entries: Entry[]): Entry[][] => {
+  const batches: Entry[][] = [];
+  let current: Entry[] = [];
+  let size = 0;
+  for (const entry of entries) {
+    const entrySize = Buffer.byteLength(entry.body);
+    if (
+      current.length >= MAX_BATCH_SIZE ||
+      (current.length > 0 && size + entrySize > MAX_BATCH_BYTES)
+    ) {
+      batches.push(current);
+      current = [];
+      size = 0;
+    }
+    current.push(entry);
+    size += entrySize;
+  }
+  if (current.length > 0) {
+    batches.push(current);
+  }
+  return batches;
+};
+
+/**
+ * Function that always sends forward the events in the vectors it
+ * receives, unmodified. It also sends those events to an SQS queue,
+ * one message per event, in batches of up to ten messages. Messages
+ * sent to FIFO queues are given a group id built from a template,
+ * and a deduplication id that's kept across retries.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to connect to the
+ * queue and how to build messages.
+ * @returns A channel that forwards events to an SQS queue.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendSQSFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const connection: SQSConnectionOptions = {
+    queueUrl: options["queue-url"],
+    endpoint: options.endpoint,
+    region:
+      options.region ?? regionFromURL(options["queue-url"]) ?? DEFAULT_REGION,
+    accessKeyId: options["access-key-id"],
+    secretAccessKey: options["secret-access-key"],
+    sessionToken: options["session-token"],
+  };
+  const fifo = isFIFO(options["queue-url"]);
+  const groupTemplate = options["group-id"] ?? DEFAULT_GROUP_ID;
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+
+  const send = async (batch: Entry[]) => {
+    // Only the entries that failed are attempted again. The pending
+    // events are the ones dead-lettered if every attempt fails.
+    const pending = batch.slice();
+    const pendingEvents = pending.map((entry) => entry.event);
+    await retrier.run(pendingEvents, async () => {
+      const result = await callSQS<{ Failed?: SQSBatchFailure[] }>(
+        connection,
+        "SendMessageBatch",
+        {
+          Entries: pending.map((entry, index) => ({
+            Id: `${index}`,
+            MessageBody: entry.body,
+            ...(fifo
+              ? {
+                  MessageGroupId: entry.groupId,
+                  MessageDeduplicationId: entry.deduplicationId,
+                }
+              : {}),
+          })),
+        }
+      );
+      const failures = result.Failed ?? [];
+      const failed = new Set(failures.map((failure) => failure.Id));
+      const remaining = pending.filter((_, index) => failed.has(`${index}`));
+      pending.splice(0, pending.length, ...remaining);
+      pendingEvents.splice(
+        0,
+        pendingEvents.length,
+        ...remaining.map((entry) => entry.event)
+      );
+      logger.debug(
+        "Sent",
+        batch.length - remaining.length,
+        "messages to SQS queue"
+      );
+      if (failures.length > 0) {
+        throw new Error(
+          `couldn't send ${failures.length} messages: ` +
+            describeFailures(failures)
+        );
+      }
+    });
+  };
+
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-sqs.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      const entries = events.map((event) => ({
+        event,
+        body: encodeJson(event),
+        // The deduplication id is fixed before any attempt, so that
+        // retries of a message aren't delivered twice.
+        ...(fifo
+          ? {
+              groupId: makeGroupId(groupTemplate, event),
+              deduplicationId: randomBytes(16).toString("hex"),
+            }
+          : {}),
+      }));
+      for (const batch of makeBatches(entries)) {
+        await send(batch);
+      }
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-sqs.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+    },
+  };
+};
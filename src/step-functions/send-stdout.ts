@@ -1,6 +1,7 @@
 import { match, P } from "ts-pattern";
 import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
 import { Event } from "../event";
+import { encodeJson } from "../json";
 import { check, makeFuse } from "../utils";
 import { getSTDOUT } from "../io/stdio";
 import { PipelineStepFunctionParameters, makeProcessorChannel } from ".";
@@ -74,7 +75,7 @@ export const make = async (
       await makeProcessorChannel(params, options),
       async (result: unknown) => {
         const flushed = stdout.write(
-          (typeof result === "string" ? result : JSON.stringify(result)) + "\n"
+          (typeof result === "string" ? result : encodeJson(result)) + "\n"
         );
         if (!flushed) {
           await closed.guard((resolve) => stdout.once("drain", resolve));
@@ -88,7 +89,7 @@ export const make = async (
       ).asChannel(),
       async (events: Event[]) => {
         for (const event of events) {
-          const flushed = stdout.write(JSON.stringify(event) + "\n");
+          const flushed = stdout.write(encodeJson(event) + "\n");
           if (!flushed) {
             await closed.guard((resolve) => stdout.once("drain", resolve));
           }
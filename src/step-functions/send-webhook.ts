@@ -0,0 +1,313 @@
+import { match, P } from "ts-pattern";
+import { AsyncQueue, Channel, flatMap, drain } from "../async-queue";
+import { HTTP_CLIENT_DEFAULT_CONCURRENCY } from "../conf";
+import { Event } from "../event";
+import { compress } from "../io/compression";
+import { probeTarget, request } from "../io/http-client";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { makeLogger, truncatePayload } from "../log";
+import {
+  CircuitBreakerOptions,
+  circuitBreakerOptionsSchema,
+} from "../circuit-breaker";
+import {
+  RetryOptions,
+  retryOptionsSchema,
+  validateRetryOptions,
+  makeRetrier,
+} from "../retry";
+import { check, mergeHeaders } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-webhook");
+
+/**
+ * Options for this function.
+ */
+export type SendWebhookFunctionOptions = {
+  url?: string;
+  "url-jq-expr"?: string;
+  method?: "POST" | "PUT" | "PATCH";
+  headers?: { [key: string]: string | number | boolean };
+  "headers-jq-expr"?: string;
+  "body-jq-expr"?: string;
+  batch?: boolean | "true" | "false";
+  gzip?: boolean | "true" | "false";
+  concurrency?: number | string;
+  retry?: RetryOptions;
+  "circuit-breaker"?: CircuitBreakerOptions;
+};
+
+/**
+ * Schema for boolean flags.
+ */
+const flagSchema = {
+  anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }],
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    url: { type: "string", minLength: 1 },
+    "url-jq-expr": { type: "string", minLength: 1 },
+    method: { enum: ["POST", "PUT", "PATCH"] },
+    headers: {
+      type: "object",
+      properties: {},
+      additionalProperties: {
+        anyOf: [{ type: "string" }, { type: "number" }, { type: "boolean" }],
+      },
+    },
+    "headers-jq-expr": { type: "string", minLength: 1 },
+    "body-jq-expr": { type: "string", minLength: 1 },
+    batch: flagSchema,
+    gzip: flagSchema,
+    concurrency: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    retry: retryOptionsSchema,
+    "circuit-breaker": circuitBreakerOptionsSchema,
+  },
+  additionalProperties: false,
+  required: [],
+};
+
+/**
+ * Validate send-webhook options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendWebhookFunctionOptions
+): void => {
+  check(
+    match(options)
+      .with({ url: P.string, "url-jq-expr": P.string }, () => false)
+      .with({ url: P.string }, () => true)
+      .with({ "url-jq-expr": P.string }, () => true)
+      .with({}, () => false),
+    `step '${name}' must use exactly one of send-webhook.url ` +
+      "or send-webhook.url-jq-expr"
+  );
+  if (typeof options.retry !== "undefined") {
+    validateRetryOptions(name, "send-webhook.retry", options.retry);
+  }
+};
+
+/**
+ * Parse a boolean flag given as an option.
+ *
+ * @param value The option's value.
+ * @returns The boolean.
+ */
+const parseFlag = (value: boolean | "true" | "false" | undefined): boolean =>
+  typeof value === "string" ? value === "true" : value ?? false;
+
+/**
+ * A request to be made, along with the events it delivers.
+ */
+type WebhookRequest = {
+  url: string;
+  headers: { [key: string]: string | number | boolean };
+  bodies: unknown[];
+  events: Event[];
+};
+
+/**
+ * Pick the headers from a value produced by a template, which must be
+ * an object. Header values that aren't scalars are ignored.
+ *
+ * @param value The value produced by the template.
+ * @returns The headers.
+ */
+const pickHeaders = (
+  value: unknown
+): { [key: string]: string | number | boolean } =>
+  typeof value === "object" && value !== null && !Array.isArray(value)
+    ? Object.fromEntries(
+        Object.entries(value).filter(([, v]) =>
+          ["string", "number", "boolean"].includes(typeof v)
+        )
+      )
+    : {};
+
+/**
+ * Check that the webhook is reachable. Webhooks whose URL depends on
+ * each event can't be checked in advance.
+ *
+ * @param options The options that indicate the webhook's URL.
+ * @param signal A signal that aborts the check.
+ * @returns A promise that resolves if the webhook is reachable, or
+ * null if its URL isn't fixed.
+ */
+export const probe = (
+  options: SendWebhookFunctionOptions,
+  signal: AbortSignal
+): Promise<void> | null =>
+  typeof options.url === "string"
+    ? probeTarget(options.url, options.headers ?? {}, signal)
+    : null;
+
+/**
+ * Function that always sends forward the events in the vectors it
+ * receives, unmodified. It also delivers those events to a webhook,
+ * in requests built from templates applied to each event, so that
+ * the URL, the headers and the body may depend on the event. Events
+ * may be delivered one per request, or batched.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to build and send
+ * requests.
+ * @returns A channel that forwards events to a webhook.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendWebhookFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const method = options.method ?? "POST";
+  const batch = parseFlag(options.batch);
+  const gzip = parseFlag(options.gzip);
+  const concurrency =
+    typeof options.concurrency === "string"
+      ? parseInt(options.concurrency, 10)
+      : options.concurrency ?? HTTP_CLIENT_DEFAULT_CONCURRENCY;
+  const exprs = [
+    options["url-jq-expr"],
+    options["headers-jq-expr"],
+    options["body-jq-expr"],
+  ];
+  const extractor = exprs.some((expr) => typeof expr === "string")
+    ? await jqProcessor.makeChannel<Event[]>(makeExtractionProgram(...exprs), {
+        prelude: params["jq-prelude"],
+      })
+    : null;
+  const retrier = makeRetrier(
+    params.stepName,
+    options.retry,
+    params.reportFailure,
+    "best-effort",
+    options["circuit-breaker"]
+  );
+  const stepLogger = logger.with({ step: params.stepName });
+
+  // Builds the requests that deliver the given events. When batching,
+  // events with the same URL and headers share a request.
+  const makeRequests = async (events: Event[]): Promise<WebhookRequest[]> => {
+    let extracted: unknown[][] = [];
+    if (extractor !== null) {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      extracted =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+    }
+    const requests = new Map<string, WebhookRequest>();
+    events.forEach((event, index) => {
+      const [url, headers, body] = extracted[index] ?? [null, null, null];
+      const target = options.url ?? url;
+      if (typeof target !== "string") {
+        stepLogger
+          .with({
+            event: event.name,
+            reason: "the URL template didn't produce a string",
+            payload: truncatePayload(event.data),
+          })
+          .warn("Couldn't deliver event");
+        return;
+      }
+      const request = {
+        url: target,
+        headers: mergeHeaders(options.headers ?? {}, pickHeaders(headers)),
+        bodies: [
+          typeof options["body-jq-expr"] === "string" ? body : event,
+        ],
+        events: [event],
+      };
+      const key = batch
+        ? JSON.stringify([request.url, request.headers])
+        : `${index}`;
+      const existing = requests.get(key);
+      if (typeof existing === "undefined") {
+        requests.set(key, request);
+      } else {
+        existing.bodies.push(...request.bodies);
+        existing.events.push(event);
+      }
+    });
+    return [...requests.values()];
+  };
+
+  const deliver = async ({
+    url,
+    headers,
+    bodies,
+    events,
+  }: WebhookRequest): Promise<void> => {
+    const json = Buffer.from(encodeJson(batch ? bodies : bodies[0]));
+    const data = gzip ? await compress(json, "gzip") : json;
+    await retrier.run(events, async () => {
+      await request({
+        url,
+        method,
+        data,
+        transformRequest: [(d) => d],
+        headers: mergeHeaders(headers, {
+          "Content-Type": "application/json",
+          ...(gzip ? { "Content-Encoding": "gzip" } : {}),
+        }),
+      });
+      stepLogger.debug("Delivered", events.length, "events to", url);
+    });
+  };
+
+  // Requests are made concurrently, up to the concurrency limit.
+  const inFlight = new Set<Promise<void>>();
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.send-webhook.pass-through`
+    ).asChannel(),
+    async (events: Event[]) => {
+      for (const webhookRequest of await makeRequests(events)) {
+        while (inFlight.size >= concurrency) {
+          await Promise.race(inFlight);
+        }
+        const delivery = deliver(webhookRequest);
+        inFlight.add(delivery);
+        delivery.finally(() => inFlight.delete(delivery));
+      }
+    },
+    async () => {
+      await Promise.all(inFlight);
+    }
+  );
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.send-webhook.forward`
+  );
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    passThroughChannel.send(events);
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      // Pending retries are given up, so that the shutdown isn't held
+      // back by backoff delays.
+      retrier.stop();
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+      await extractor?.close();
+    },
+  };
+};
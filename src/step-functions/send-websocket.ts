@@ -0,0 +1,249 @@
+import { match as matchOptions, P } from "ts-pattern";
+import WebSocket from "ws";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event } from "../event";
+import { connectWithBackoff, makeWebSocketServer } from "../io/websocket";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import { websocketDroppedEvents } from "../metrics";
+import { isValidPattern, match, Pattern } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/send-websocket");
+
+/**
+ * Options for this function.
+ */
+export type SendWebSocketFunctionOptions =
+  | string
+  | {
+      url?: string;
+      port?: number | string;
+      endpoint?: string;
+      buffer?: number | string;
+    };
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "string", minLength: 1 },
+    {
+      type: "object",
+      properties: {
+        url: { type: "string", minLength: 1 },
+        port: {
+          anyOf: [
+            { type: "integer", minimum: 1, maximum: 65535 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+        endpoint: { type: "string", minLength: 1, pattern: "^/.*$" },
+        buffer: {
+          anyOf: [
+            { type: "integer", minimum: 1 },
+            { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+          ],
+        },
+      },
+      additionalProperties: false,
+    },
+  ],
+};
+
+/**
+ * Validate send-websocket options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SendWebSocketFunctionOptions
+): void => {
+  const m = matchOptions(options);
+  check(
+    m
+      .with(P.string, () => true)
+      .with({ url: P._, port: P._ }, () => false)
+      .with({ url: P._ }, () => true)
+      .with({ port: P._ }, () => true)
+      .with(P._, () => false),
+    `step '${name}' must use exactly one of send-websocket.url ` +
+      "or send-websocket.port"
+  );
+  check(
+    m.with({ url: P._, endpoint: P._ }, () => false),
+    `step '${name}' can use send-websocket.endpoint only along with ` +
+      "send-websocket.port"
+  );
+  check(
+    m.with({ port: P.select(P.string) }, (rawPort) =>
+      ((port) => port >= 1 && port <= 65535)(parseInt(rawPort, 10))
+    ),
+    `step '${name}' uses an invalid send-websocket.port value ` +
+      "(must be between 1 and 65535, inclusive)"
+  );
+};
+
+/**
+ * Default path clients connect to, in server mode.
+ */
+const DEFAULT_ENDPOINT = "/";
+
+/**
+ * Default amount of events buffered for each peer.
+ */
+const DEFAULT_BUFFER = 100;
+
+/**
+ * A peer connection, which receives the events matching its pattern.
+ */
+interface Peer {
+  pattern: Pattern;
+  socket: WebSocket | null;
+  frames: string[];
+  waiting: boolean;
+}
+
+/**
+ * Send buffered frames to the peer one at a time, each once the
+ * previous one was written out.
+ *
+ * @param peer The peer to send frames to.
+ */
+const flush = (peer: Peer): void => {
+  const socket = peer.socket;
+  if (
+    peer.frames.length === 0 ||
+    peer.waiting ||
+    socket === null ||
+    socket.readyState !== WebSocket.OPEN
+  ) {
+    return;
+  }
+  const frame = peer.frames.shift() as string;
+  peer.waiting = true;
+  socket.send(frame, (err) => {
+    peer.waiting = false;
+    if (err) {
+      logger.warn(`Couldn't send frame to WebSocket peer: ${err}`);
+      return;
+    }
+    flush(peer);
+  });
+};
+
+/**
+ * Function that sends events as frames through WebSocket connections,
+ * either established with a server (client mode) or accepted from
+ * clients (server mode), and forwards the same events to the rest of
+ * the pipeline unmodified. Slow peers lose their oldest events instead
+ * of holding the pipeline back.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to send events.
+ * @returns A channel that forwards events through WebSocket
+ * connections.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SendWebSocketFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const extendedOptions =
+    typeof options === "string" ? { url: options } : options;
+  const bufferSize =
+    typeof extendedOptions.buffer === "string"
+      ? parseInt(extendedOptions.buffer, 10)
+      : extendedOptions.buffer ?? DEFAULT_BUFFER;
+  const peers = new Set<Peer>();
+  websocketDroppedEvents.inc({ step: params.stepName }, 0);
+
+  let connection: { close: () => Promise<void> };
+  if (typeof extendedOptions.url === "string") {
+    // The upstream server is a single peer, which keeps its buffer
+    // across reconnections.
+    const upstream: Peer = {
+      pattern: "#",
+      socket: null,
+      frames: [],
+      waiting: false,
+    };
+    peers.add(upstream);
+    connection = connectWithBackoff(extendedOptions.url, (socket) => {
+      upstream.socket = socket;
+      upstream.waiting = false;
+      flush(upstream);
+    });
+  } else {
+    const rawPort = extendedOptions.port as number | string;
+    connection = makeWebSocketServer(
+      typeof rawPort === "string" ? parseInt(rawPort, 10) : rawPort,
+      extendedOptions.endpoint ?? DEFAULT_ENDPOINT,
+      (socket, request) => {
+        const rawPattern =
+          new URL(request.url ?? "/", "http://localhost").searchParams.get(
+            "match"
+          ) ?? "#";
+        if (!isValidPattern(rawPattern)) {
+          logger.info("Rejected WebSocket client with an invalid pattern");
+          socket.close(1008, "invalid match pattern");
+          return;
+        }
+        const peer: Peer = {
+          pattern: rawPattern,
+          socket,
+          frames: [],
+          waiting: false,
+        };
+        peers.add(peer);
+        logger.debug("Client subscribed with pattern", rawPattern);
+        socket.on("close", () => {
+          peers.delete(peer);
+          logger.debug("Client unsubscribed with pattern", rawPattern);
+        });
+      }
+    );
+  }
+
+  const broadcast = (event: Event) => {
+    for (const peer of peers) {
+      if (!match(event.name, peer.pattern)) {
+        continue;
+      }
+      if (peer.frames.length >= bufferSize) {
+        peer.frames.shift();
+        websocketDroppedEvents.inc({ step: params.stepName }, 1);
+      }
+      peer.frames.push(encodeJson(event));
+      flush(peer);
+    }
+  };
+
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    events.forEach(broadcast);
+    return events;
+  }, new AsyncQueue<Event[]>(`step.${params.stepName}.send-websocket.forward`).asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      await forwardingChannel.close();
+      // Frames still buffered are handed over to the connections
+      // before closing them.
+      for (const peer of peers) {
+        const socket = peer.socket;
+        if (socket !== null && socket.readyState === WebSocket.OPEN) {
+          peer.frames.forEach((frame) => socket.send(frame));
+        }
+        peer.frames = [];
+      }
+      await connection.close();
+    },
+  };
+};
@@ -0,0 +1,115 @@
+import { createHmac } from "crypto";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { makeLogger } from "../log";
+import { canonicalize } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/sign");
+
+/**
+ * Options for this function.
+ */
+export type SignFunctionOptions = {
+  key: string;
+  field?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    key: { type: "string", minLength: 1 },
+    field: { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["key"],
+};
+
+/**
+ * Validate sign options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Default data field that holds signatures.
+ */
+export const DEFAULT_SIGNATURE_FIELD = "__signature";
+
+/**
+ * Compute the signature of an event's data, which is the hex-encoded
+ * HMAC-SHA256 of its canonical serialization, leaving out the
+ * signature field itself.
+ *
+ * @param data The event's data, which must be an object.
+ * @param field The data field that holds the signature.
+ * @param key The signing key.
+ * @returns The signature.
+ */
+export const computeSignature = (
+  data: Record<string, unknown>,
+  field: string,
+  key: string
+): string => {
+  const signed = Object.fromEntries(
+    Object.entries(data).filter(([k]) => k !== field)
+  );
+  return createHmac("sha256", key).update(canonicalize(signed)).digest("hex");
+};
+
+/**
+ * Signatures depend on each event alone.
+ */
+export const stateless = true;
+
+/**
+ * Function that signs each event's data with an HMAC, so that a
+ * receiving pipeline can verify it wasn't tampered with. The
+ * signature is attached to the data in a dedicated field, so only
+ * data that is an object can be signed; other events are forwarded
+ * unsigned.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the signing key and the
+ * field that holds signatures.
+ * @returns A channel that signs events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SignFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const field = options.field ?? DEFAULT_SIGNATURE_FIELD;
+  const stepLogger = logger.with({ step: params.stepName });
+  const sign = (event: Event): Promise<Event> | Event => {
+    if (
+      typeof event.data !== "object" ||
+      event.data === null ||
+      Array.isArray(event.data)
+    ) {
+      stepLogger
+        .with({ event: event.name })
+        .warn("Couldn't sign event, since its data is not an object");
+      return event;
+    }
+    const data = event.data as Record<string, unknown>;
+    return makeFrom(event, {
+      data: { ...data, [field]: computeSignature(data, field, options.key) },
+    });
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.sign`);
+  return flatMap(
+    (events: Event[]) => Promise.all(events.map(sign)),
+    queue.asChannel()
+  );
+};
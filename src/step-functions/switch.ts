@@ -0,0 +1,211 @@
+import { match as matchOptions, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import {
+  Pattern,
+  patternSchema,
+  isValidPattern,
+  isValidEventName,
+  match,
+} from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A single case of the function, which renames the events it
+ * selects.
+ */
+type SwitchCase = {
+  match?: Pattern;
+  "jq-expr"?: string;
+  name: string;
+};
+
+/**
+ * Options for this function.
+ */
+export type SwitchFunctionOptions = {
+  cases: SwitchCase[];
+  default?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    cases: {
+      type: "array",
+      items: {
+        type: "object",
+        properties: {
+          match: patternSchema,
+          "jq-expr": { type: "string", minLength: 1 },
+          name: { type: "string", minLength: 1 },
+        },
+        additionalProperties: false,
+        required: ["name"],
+      },
+      minItems: 1,
+    },
+    default: { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["cases"],
+};
+
+/**
+ * Validate switch options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: SwitchFunctionOptions
+): void => {
+  options.cases.forEach((switchCase, index) => {
+    const matchCase = matchOptions(switchCase);
+    check(
+      matchCase
+        .with({ match: P._ }, () => true)
+        .with({ "jq-expr": P._ }, () => true)
+        .with({}, () => false),
+      `step '${name}' has a switch case without match or jq-expr ` +
+        `(case #${index + 1})`
+    );
+    check(
+      matchCase.with({ match: P.select() }, isValidPattern),
+      `step '${name}' has a switch case with an invalid pattern ` +
+        `(case #${index + 1})`
+    );
+    check(
+      matchCase.with({ name: P.select(P.string) }, isValidEventName),
+      `step '${name}' has a switch case with an invalid name ` +
+        `(case #${index + 1}; must be a valid event name)`
+    );
+  });
+  check(
+    matchOptions(options).with(
+      { default: P.select(P.string) },
+      isValidEventName
+    ),
+    `step '${name}' uses an invalid switch.default value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Check whether a value produced by jq counts as true. Following jq
+ * semantics, only `false` and `null` are false.
+ *
+ * @param value The value produced by jq.
+ * @returns Whether the value is true.
+ */
+const isTruthy = (value: unknown): boolean =>
+  value !== false && value !== null && typeof value !== "undefined";
+
+/**
+ * The names of the events switch may emit, given the names of the
+ * events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: SwitchFunctionOptions,
+  names: EventNames
+): EventNames => {
+  if (names === null) {
+    return null;
+  }
+  return union(
+    ...names.map((name) => {
+      const emitted: string[] = [];
+      for (const switchCase of options.cases) {
+        if (
+          typeof switchCase.match === "undefined" ||
+          match(name, switchCase.match)
+        ) {
+          emitted.push(switchCase.name);
+          // Cases without a jq expression always select the events
+          // they match.
+          if (typeof switchCase["jq-expr"] === "undefined") {
+            return emitted;
+          }
+        }
+      }
+      return [...emitted, options.default ?? name];
+    })
+  );
+};
+
+/**
+ * Events are routed by their own name and data alone.
+ */
+export const stateless = true;
+
+/**
+ * Function that renames each event after the first case that selects
+ * it. Cases select events by their name, with a pattern, or by a jq
+ * expression applied to them, or both. Events not selected by any
+ * case are renamed with the default name, or forwarded unchanged if
+ * there's none.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the cases to check.
+ * @returns A channel that routes events by renaming them.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: SwitchFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const exprs = options.cases.map((switchCase) => switchCase["jq-expr"]);
+  // The jq expressions of all cases are applied at once to each
+  // vector, and only if there's any.
+  const extractor = exprs.some((expr) => typeof expr === "string")
+    ? await jqProcessor.makeChannel<Event[]>(makeExtractionProgram(...exprs), {
+        prelude: params["jq-prelude"],
+      })
+    : null;
+  const selects = (
+    switchCase: SwitchCase,
+    event: Event,
+    result: unknown
+  ): boolean =>
+    (typeof switchCase.match === "undefined" ||
+      match(event.name, switchCase.match)) &&
+    (typeof switchCase["jq-expr"] === "undefined" || isTruthy(result));
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.switch`);
+  const channel = flatMap(async (events: Event[]) => {
+    let extracted: unknown[][] = [];
+    if (extractor !== null) {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      extracted =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+    }
+    return Promise.all(
+      events.map((event, index) => {
+        const results = extracted[index] ?? [];
+        const selected = options.cases.find((switchCase, caseIndex) =>
+          selects(switchCase, event, results[caseIndex])
+        );
+        const name = selected?.name ?? options.default;
+        return typeof name === "undefined" ? event : makeFrom(event, { name });
+      })
+    );
+  }, queue.asChannel());
+  return {
+    ...channel,
+    close: async () => {
+      await channel.close();
+      await extractor?.close();
+    },
+  };
+};
@@ -0,0 +1,170 @@
+import { appendFile as appendFileCallback } from "fs";
+import { promisify } from "util";
+import { match as matchOptions, P } from "ts-pattern";
+import { Channel, AsyncQueue, flatMap, drain } from "../async-queue";
+import { Event } from "../event";
+import { getSTDERR } from "../io/stdio";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import { Pattern, patternSchema, isValidPattern, match } from "../pattern";
+import { check, makeFuse } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+import { makeRandom } from "./sample";
+
+/**
+ * Use fs.appendFile as an async function.
+ */
+const appendFile: (path: string, data: string) => Promise<void> =
+  promisify(appendFileCallback);
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/tap");
+
+/**
+ * Options for this function.
+ */
+export type TapFunctionOptions = null | {
+  destination?: "stderr" | "log";
+  path?: string;
+  match?: Pattern;
+  sample?: number | string;
+  seed?: number | string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    { type: "null" },
+    {
+      type: "object",
+      properties: {
+        destination: { enum: ["stderr", "log"] },
+        path: { type: "string", minLength: 1 },
+        match: patternSchema,
+        sample: {
+          anyOf: [
+            { type: "number", exclusiveMinimum: 0, maximum: 1 },
+            { type: "string", pattern: "^(0?\\.[0-9]+|1(\\.0*)?)$" },
+          ],
+        },
+        seed: {
+          anyOf: [
+            { type: "integer", minimum: 0 },
+            { type: "string", pattern: "^[0-9]+$" },
+          ],
+        },
+      },
+      additionalProperties: false,
+      required: [],
+    },
+  ],
+};
+
+/**
+ * Validate tap options, after they've been checked by the ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (name: string, options: TapFunctionOptions): void => {
+  const matchTap = matchOptions(options);
+  check(
+    matchTap.with({ destination: P._, path: P._ }, () => false),
+    `step '${name}' can't use both tap.destination and tap.path`
+  );
+  check(
+    matchTap.with({ match: P.select() }, isValidPattern),
+    `step '${name}' uses an invalid pattern for tap.match`
+  );
+  check(
+    matchTap.with(
+      { sample: P.select(P.string) },
+      (rate) => parseFloat(rate) > 0
+    ),
+    `step '${name}' uses an invalid tap.sample value (must be > 0)`
+  );
+};
+
+/**
+ * Function that forwards the events it receives unmodified, and
+ * writes a compact copy of some of them (their name and data) to
+ * STDERR, a file, or the log, so that they can be inspected without
+ * altering the pipeline.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate which events to copy, and
+ * where to.
+ * @returns A channel that taps into the events it forwards.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: TapFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const rate =
+    typeof options?.sample === "string"
+      ? parseFloat(options.sample)
+      : options?.sample ?? 1;
+  const random = makeRandom(
+    typeof options?.seed === "string"
+      ? parseInt(options.seed, 10)
+      : options?.seed ?? Math.floor(Math.random() * 4294967296)
+  );
+  const pattern = options?.match;
+  const selected = (event: Event): boolean =>
+    (typeof pattern === "undefined" || match(event.name, pattern)) &&
+    (rate >= 1 || random() < rate);
+  const compact = (event: Event): string =>
+    encodeJson({ n: event.name, d: event.data });
+  let write: (events: Event[]) => Promise<void>;
+  if (typeof options?.path === "string") {
+    const path = options.path;
+    write = async (events) => {
+      try {
+        await appendFile(path, events.map(compact).join("\n") + "\n");
+      } catch (err) {
+        logger.error(`Couldn't append to file ${path}: ${err}`);
+      }
+    };
+  } else if (options?.destination === "log") {
+    const stepLogger = logger.with({ step: params.stepName });
+    write = async (events) =>
+      events.forEach((event) => stepLogger.info("Tapped", compact(event)));
+  } else {
+    const stderr = getSTDERR();
+    const closed = makeFuse();
+    stderr.on("close", () => closed.trigger());
+    write = async (events) => {
+      for (const event of events) {
+        const flushed = stderr.write(compact(event) + "\n");
+        if (!flushed) {
+          await closed.guard((resolve) => stderr.once("drain", resolve));
+        }
+      }
+    };
+  }
+  const passThroughChannel = drain(
+    new AsyncQueue<Event[]>(
+      `step.${params.stepName}.tap.pass-through`
+    ).asChannel(),
+    write
+  );
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.tap.forward`);
+  const forwardingChannel = flatMap(async (events: Event[]) => {
+    const tapped = events.filter(selected);
+    if (tapped.length > 0) {
+      passThroughChannel.send(tapped);
+    }
+    return events;
+  }, queue.asChannel());
+  return {
+    ...forwardingChannel,
+    close: async () => {
+      await forwardingChannel.close();
+      await passThroughChannel.close();
+    },
+  };
+};
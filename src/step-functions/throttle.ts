@@ -0,0 +1,213 @@
+import { match, P } from "ts-pattern";
+import { Channel, AsyncQueue } from "../async-queue";
+import { Event } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { throttledEvents } from "../metrics";
+import { check, makeFuse } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * Options for this function.
+ */
+export type ThrottleFunctionOptions = {
+  rate: number | string;
+  interval?: number | string;
+  burst?: number | string;
+  "key-jq-expr"?: string;
+  overflow?: "drop" | "delay";
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    rate: {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    interval: {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    burst: {
+      anyOf: [
+        { type: "integer", minimum: 1 },
+        { type: "string", pattern: "^[0-9]*[1-9][0-9]*$" },
+      ],
+    },
+    "key-jq-expr": { type: "string", minLength: 1 },
+    overflow: { enum: ["drop", "delay"] },
+  },
+  additionalProperties: false,
+  required: ["rate"],
+};
+
+/**
+ * Parse a positive amount given as an option.
+ *
+ * @param value The option's value.
+ * @returns The amount.
+ */
+const parseAmount = (value: number | string): number =>
+  typeof value === "string" ? parseFloat(value) : value;
+
+/**
+ * Validate throttle options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: ThrottleFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ rate: P.select() }, (rate) => parseAmount(rate) > 0),
+    `step '${name}' uses an invalid throttle.rate value (must be > 0)`
+  );
+  check(
+    matchOptions.with(
+      { interval: P.select(P.string) },
+      (interval) => parseFloat(interval) > 0
+    ),
+    `step '${name}' uses an invalid throttle.interval value (must be > 0)`
+  );
+};
+
+/**
+ * Default amount of seconds over which the rate is measured.
+ */
+const DEFAULT_INTERVAL = 1;
+
+/**
+ * A token bucket, holding a fractional amount of tokens as of the
+ * given time in milliseconds.
+ */
+interface Bucket {
+  tokens: number;
+  time: number;
+}
+
+/**
+ * Function that limits the rate at which events pass through, using
+ * a token bucket for all events or one for each key. Events exceeding
+ * the rate are either dropped or delayed until a token is available.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to limit the rate.
+ * @returns A channel that throttles events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: ThrottleFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const interval = parseAmount(options.interval ?? DEFAULT_INTERVAL) * 1000;
+  // The refill rate, in tokens per millisecond.
+  const refill = parseAmount(options.rate) / interval;
+  const burst =
+    typeof options.burst === "undefined"
+      ? Math.max(Math.ceil(parseAmount(options.rate)), 1)
+      : parseAmount(options.burst);
+  const delay = (options.overflow ?? "delay") === "delay";
+  const extractor =
+    typeof options["key-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["key-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.throttle.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.throttle.output`
+  );
+  const buckets = new Map<string, Bucket>();
+  // Buckets that refilled completely are the same as absent ones, so
+  // they're removed periodically to keep memory bounded.
+  let lastSweep = new Date().getTime();
+  const sweep = (now: number) => {
+    if (now - lastSweep < interval) {
+      return;
+    }
+    lastSweep = now;
+    for (const [key, bucket] of buckets.entries()) {
+      if (bucket.tokens + (now - bucket.time) * refill >= burst) {
+        buckets.delete(key);
+      }
+    }
+  };
+  const refilled = (key: string, now: number): Bucket => {
+    const bucket = buckets.get(key) ?? { tokens: burst, time: now };
+    bucket.tokens = Math.min(
+      burst,
+      bucket.tokens + (now - bucket.time) * refill
+    );
+    bucket.time = now;
+    buckets.set(key, bucket);
+    return bucket;
+  };
+  // Delays are cut short when the step is closed, so that the
+  // pipeline's shutdown isn't held back.
+  const done = makeFuse();
+  throttledEvents.inc({ step: params.stepName }, 0);
+
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      let keys: string[] = events.map(() => "null");
+      if (extractor !== null) {
+        extractor.send(events);
+        const result = await extractor.receive.next();
+        const extracted: unknown[][] =
+          !result.done && Array.isArray(result.value) ? result.value : [];
+        keys = events.map((_, index) =>
+          encodeJson((extracted[index] ?? [null])[0] ?? null)
+        );
+      }
+      for (let index = 0; index < events.length; index++) {
+        const now = new Date().getTime();
+        sweep(now);
+        let bucket = refilled(keys[index], now);
+        while (bucket.tokens < 1 && delay && !done.value()) {
+          const wait = Math.ceil((1 - bucket.tokens) / refill);
+          await done.guard((resolve) => setTimeout(resolve, wait));
+          bucket = refilled(keys[index], new Date().getTime());
+        }
+        if (bucket.tokens >= 1) {
+          bucket.tokens -= 1;
+          outputQueue.push(events[index]);
+        } else if (delay) {
+          // The step is closing, so the event is let through without
+          // waiting any longer.
+          outputQueue.push(events[index]);
+        } else {
+          throttledEvents.inc({ step: params.stepName }, 1);
+        }
+      }
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      done.trigger();
+      await inputChannel.close();
+      await processing;
+      if (extractor !== null) {
+        await extractor.close();
+      }
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
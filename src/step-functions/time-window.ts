@@ -0,0 +1,292 @@
+import { match, P } from "ts-pattern";
+import { EventNames } from "../analysis";
+import { Channel, AsyncQueue } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { encodeJson } from "../json";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/time-window");
+
+/**
+ * Options for this function.
+ */
+export type TimeWindowFunctionOptions = {
+  size: number | string;
+  slide?: number | string;
+  "key-jq-expr"?: string;
+  "time-jq-expr"?: string;
+  grace?: number | string;
+  suffix?: string;
+};
+
+/**
+ * Schema for a positive amount of seconds.
+ */
+const secondsSchema = {
+  anyOf: [
+    { type: "number", exclusiveMinimum: 0 },
+    { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+  ],
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    size: secondsSchema,
+    slide: secondsSchema,
+    "key-jq-expr": { type: "string", minLength: 1 },
+    "time-jq-expr": { type: "string", minLength: 1 },
+    grace: {
+      anyOf: [
+        { type: "number", minimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    suffix: { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["size"],
+};
+
+/**
+ * Parse an amount of seconds given as an option.
+ *
+ * @param value The option's value.
+ * @returns The amount of seconds.
+ */
+const parseSeconds = (value: number | string): number =>
+  typeof value === "string" ? parseFloat(value) : value;
+
+/**
+ * Validate time-window options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: TimeWindowFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with({ slide: P._ }, ({ size, slide }) => {
+      const slideSeconds = parseSeconds(slide as number | string);
+      return slideSeconds > 0 && slideSeconds <= parseSeconds(size);
+    }),
+    `step '${name}' uses an invalid time-window.slide value ` +
+      "(must be > 0 and not exceed time-window.size)"
+  );
+  check(
+    matchOptions.with({ size: P.select() }, (size) => parseSeconds(size) > 0),
+    `step '${name}' uses an invalid time-window.size value (must be > 0)`
+  );
+  check(
+    matchOptions
+      .with({ grace: P._, "time-jq-expr": P._ }, () => true)
+      .with({ grace: P._ }, () => false),
+    `step '${name}' can use time-window.grace only along with time-window.time-jq-expr`
+  );
+  check(
+    matchOptions.with({ suffix: P.select(P.string) }, isValidEventName),
+    `step '${name}' uses an invalid time-window.suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default suffix appended to the name of the windowed events.
+ */
+const DEFAULT_SUFFIX = "window";
+
+/**
+ * An open window, collecting the events of a single name and key.
+ */
+interface Window {
+  name: string;
+  end: number;
+  events: Event[];
+  timeout: ReturnType<typeof setTimeout> | null;
+}
+
+/**
+ * The names of the events time-window may emit, given the names of
+ * the events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: TimeWindowFunctionOptions,
+  names: EventNames
+): EventNames =>
+  names?.map((name) => `${name}.${options.suffix ?? DEFAULT_SUFFIX}`) ??
+  null;
+
+/**
+ * Function that groups events in time windows, and emits a single
+ * event for each window once it closes. The emitted event is named
+ * after the grouped events (with a suffix appended), and its data is
+ * the array of the grouped events' data.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how to build windows.
+ * @returns A channel that groups events in time windows.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: TimeWindowFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const size = parseSeconds(options.size);
+  const slide =
+    typeof options.slide === "undefined" ? size : parseSeconds(options.slide);
+  const grace =
+    typeof options.grace === "undefined" ? 0 : parseSeconds(options.grace);
+  const suffix = options.suffix ?? DEFAULT_SUFFIX;
+  const eventTime = typeof options["time-jq-expr"] === "string";
+  const extractor =
+    typeof options["key-jq-expr"] === "string" || eventTime
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(
+            options["key-jq-expr"],
+            options["time-jq-expr"]
+          ),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const inputChannel = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.time-window.input`
+  ).asChannel();
+  const outputQueue = new AsyncQueue<Event>(
+    `step.${params.stepName}.time-window.output`
+  );
+  const stepLogger = logger.with({ step: params.stepName });
+  const windows = new Map<string, Window>();
+  // Windows are emitted in order, even though building the events is
+  // asynchronous.
+  let emitting: Promise<void> = Promise.resolve();
+  // The greatest event time seen, which determines the closing of
+  // windows when using event time.
+  let maxTime = -Infinity;
+
+  const emit = (windowKey: string) => {
+    const window = windows.get(windowKey);
+    if (typeof window === "undefined") {
+      return;
+    }
+    windows.delete(windowKey);
+    if (window.timeout !== null) {
+      clearTimeout(window.timeout);
+    }
+    emitting = emitting.then(async () => {
+      const event = await makeFrom(window.events[window.events.length - 1], {
+        name: `${window.name}.${suffix}`,
+        data: window.events.map((e) => e.data),
+      });
+      outputQueue.push(event);
+    });
+  };
+  const emitUpTo = (watermark: number) =>
+    Array.from(windows.entries())
+      .filter(([, window]) => window.end <= watermark)
+      .sort(([, a], [, b]) => a.end - b.end)
+      .forEach(([windowKey]) => emit(windowKey));
+
+  const assign = (event: Event, key: unknown, time: number) => {
+    const watermark = maxTime - grace;
+    let assigned = false;
+    // Window starts are aligned to multiples of the slide; tumbling
+    // windows have a slide equal to their size.
+    for (
+      let start = Math.floor(time / slide) * slide;
+      start > time - size;
+      start -= slide
+    ) {
+      const end = start + size;
+      if (eventTime && end <= watermark) {
+        continue;
+      }
+      assigned = true;
+      const windowKey = encodeJson([event.name, key, start]);
+      const window = windows.get(windowKey);
+      if (typeof window !== "undefined") {
+        window.events.push(event);
+        continue;
+      }
+      windows.set(windowKey, {
+        name: event.name,
+        end,
+        events: [event],
+        timeout: eventTime
+          ? null
+          : setTimeout(
+              () => emit(windowKey),
+              Math.max(end * 1000 - new Date().getTime(), 0)
+            ),
+      });
+    }
+    if (!assigned) {
+      stepLogger
+        .with({ event: event.name })
+        .warn("Event dropped for arriving after its windows were closed");
+    }
+  };
+
+  const processing = (async () => {
+    for await (const events of inputChannel.receive) {
+      let extracted: unknown[][] = events.map(() => [null, null]);
+      if (extractor !== null) {
+        extractor.send(events);
+        const result = await extractor.receive.next();
+        if (!result.done && Array.isArray(result.value)) {
+          extracted = result.value;
+        }
+      }
+      const now = new Date().getTime() / 1000;
+      events.forEach((event, index) => {
+        const [key, rawTime] = extracted[index] ?? [null, null];
+        if (!eventTime) {
+          assign(event, key, now);
+        } else if (typeof rawTime === "number" && isFinite(rawTime)) {
+          assign(event, key, rawTime);
+          maxTime = Math.max(maxTime, rawTime);
+        } else {
+          stepLogger
+            .with({ event: event.name })
+            .warn("Event dropped for lacking a numeric timestamp");
+        }
+      });
+      if (eventTime) {
+        emitUpTo(maxTime - grace);
+      }
+    }
+  })();
+
+  return {
+    send: inputChannel.send,
+    receive: outputQueue.iterator(),
+    close: async () => {
+      await inputChannel.close();
+      await processing;
+      // Every open window is flushed on shutdown.
+      emitUpTo(Infinity);
+      await emitting;
+      if (extractor !== null) {
+        await extractor.close();
+      }
+      outputQueue.close();
+      await outputQueue.drain;
+    },
+  };
+};
@@ -0,0 +1,167 @@
+import { match, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { processor as jqProcessor } from "../io/jq";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters, makeExtractionProgram } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/ttl");
+
+/**
+ * Options for this function.
+ */
+export type TTLFunctionOptions = {
+  "max-age": number | string;
+  "time-jq-expr"?: string;
+  "expired-suffix"?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    "max-age": {
+      anyOf: [
+        { type: "number", exclusiveMinimum: 0 },
+        { type: "string", pattern: "^[0-9]+(\\.[0-9]+)?$" },
+      ],
+    },
+    "time-jq-expr": { type: "string", minLength: 1 },
+    "expired-suffix": { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["max-age"],
+};
+
+/**
+ * Validate ttl options, after they've been checked by the ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (name: string, options: TTLFunctionOptions): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions.with(
+      { "max-age": P.select(P.string) },
+      (maxAge) => parseFloat(maxAge) > 0
+    ),
+    `step '${name}' uses an invalid ttl.max-age value (must be > 0)`
+  );
+  check(
+    matchOptions.with(
+      { "expired-suffix": P.select(P.string) },
+      isValidEventName
+    ),
+    `step '${name}' uses an invalid ttl.expired-suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * The names of the events ttl may emit, given the names of the events
+ * it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: TTLFunctionOptions,
+  names: EventNames
+): EventNames =>
+  typeof options["expired-suffix"] === "string"
+    ? union(
+        names,
+        names?.map((name) => `${name}.${options["expired-suffix"]}`) ?? null
+      )
+    : names;
+
+/**
+ * The current time, as a unix timestamp in seconds.
+ */
+const currentTime = (): number => new Date().getTime() / 1000;
+
+/**
+ * Function that forwards only the events it receives that are younger
+ * than a maximum age. The age of an event is measured since its
+ * arrival to the pipeline, or since a timestamp extracted from each
+ * event. Expired events are dropped, or renamed with a suffix and
+ * forwarded.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how old events can be.
+ * @param now The clock giving the current time, as a unix timestamp
+ * in seconds.
+ * @returns A channel that filters out expired events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: TTLFunctionOptions,
+  now: () => number = currentTime
+): Promise<Channel<Event[], Event>> => {
+  const maxAge =
+    typeof options["max-age"] === "string"
+      ? parseFloat(options["max-age"])
+      : options["max-age"];
+  const expiredSuffix = options["expired-suffix"];
+  const extractor =
+    typeof options["time-jq-expr"] === "string"
+      ? await jqProcessor.makeChannel<Event[]>(
+          makeExtractionProgram(options["time-jq-expr"]),
+          { prelude: params["jq-prelude"] }
+        )
+      : null;
+  const stepLogger = logger.with({ step: params.stepName });
+  const expire = (event: Event): Promise<Event> | null =>
+    typeof expiredSuffix === "string"
+      ? makeFrom(event, { name: `${event.name}.${expiredSuffix}` })
+      : null;
+
+  const filter = async (events: Event[]): Promise<Event[]> => {
+    let times: unknown[] = events.map((event) => event.timestamp);
+    if (extractor !== null) {
+      extractor.send(events);
+      const result = await extractor.receive.next();
+      const extracted: unknown[][] =
+        !result.done && Array.isArray(result.value) ? result.value : [];
+      times = events.map((_, index) => (extracted[index] ?? [null])[0]);
+    }
+    const limit = now() - maxAge;
+    const kept = await Promise.all(
+      events.map((event, index) => {
+        const time = times[index];
+        if (typeof time !== "number" || !isFinite(time)) {
+          // Events that can't be dated are treated as expired, since
+          // they may be stale.
+          stepLogger
+            .with({ event: event.name })
+            .warn("Event expired for lacking a numeric timestamp");
+          return expire(event);
+        }
+        return time < limit ? expire(event) : event;
+      })
+    );
+    return kept.filter((event): event is Event => event !== null);
+  };
+
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.ttl`);
+  const channel = flatMap(filter, queue.asChannel());
+  return {
+    ...channel,
+    close: async () => {
+      await channel.close();
+      if (extractor !== null) {
+        await extractor.close();
+      }
+    },
+  };
+};
@@ -0,0 +1,195 @@
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { makeLogger, truncatePayload } from "../log";
+import { DEFAULT_ARRAYS, DEFAULT_SEPARATOR, isPlainObject } from "./flatten";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/unflatten");
+
+/**
+ * Options for this function.
+ */
+export type UnflattenFunctionOptions = {
+  separator?: string;
+  arrays?: "index" | "keep";
+  "on-error"?: "drop" | "dead-letter";
+} | null;
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  anyOf: [
+    {
+      type: "object",
+      properties: {
+        separator: { type: "string", minLength: 1 },
+        arrays: { enum: ["index", "keep"] },
+        "on-error": { enum: ["drop", "dead-letter"] },
+      },
+      additionalProperties: false,
+      required: [],
+    },
+    { type: "null" },
+  ],
+};
+
+/**
+ * Validate unflatten options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (): void => {
+  // Nothing needs to be validated.
+};
+
+/**
+ * Internal type used to refer to a nested object in the making,
+ * along with the flat key that first required it.
+ */
+type Branch = {
+  children: Map<string, Branch | { value: unknown }>;
+  source: string;
+};
+
+/**
+ * Array indices, as found in keys.
+ */
+const INDEX = /^(0|[1-9][0-9]*)$/;
+
+/**
+ * Rebuild a nested object from an object with a single level of
+ * keys, splitting each key with the separator. Objects whose keys are
+ * exactly the indices of an array are rebuilt as arrays, unless
+ * arrays are kept as values. Throws an error if a key is both a value
+ * and the prefix of another key.
+ *
+ * @param flat The flat object.
+ * @param separator The string that splits keys.
+ * @param arrays Whether arrays are rebuilt from indices, or kept.
+ * @returns The nested object.
+ */
+export const unflattenObject = (
+  flat: { [key: string]: unknown },
+  separator: string,
+  arrays: "index" | "keep"
+): { [key: string]: unknown } => {
+  const root: Branch = { children: new Map(), source: "" };
+  for (const [key, value] of Object.entries(flat)) {
+    const path = key.split(separator);
+    let branch = root;
+    path.forEach((segment, index) => {
+      const existing = branch.children.get(segment);
+      if (index === path.length - 1) {
+        if (typeof existing !== "undefined") {
+          const other = "children" in existing ? existing.source : key;
+          throw new Error(`the key '${key}' conflicts with the key '${other}'`);
+        }
+        branch.children.set(segment, { value });
+      } else if (typeof existing === "undefined") {
+        const child: Branch = { children: new Map(), source: key };
+        branch.children.set(segment, child);
+        branch = child;
+      } else if ("children" in existing) {
+        branch = existing;
+      } else {
+        const prefix = path.slice(0, index + 1).join(separator);
+        throw new Error(`the key '${prefix}' conflicts with the key '${key}'`);
+      }
+    });
+  }
+  // The root is always an object, even if its keys are indices.
+  const build = (branch: Branch, isRoot = false): unknown => {
+    const entries = Array.from(branch.children).map(
+      ([key, child]): [string, unknown] => [
+        key,
+        "children" in child ? build(child) : child.value,
+      ]
+    );
+    if (
+      !isRoot &&
+      arrays === "index" &&
+      entries.every(
+        ([key]) => INDEX.test(key) && Number(key) < entries.length
+      )
+    ) {
+      const rebuilt = new Array(entries.length);
+      entries.forEach(([key, value]) => {
+        rebuilt[Number(key)] = value;
+      });
+      return rebuilt;
+    }
+    // Object.fromEntries defines own properties, so keys such as
+    // `__proto__` are kept as regular keys.
+    return Object.fromEntries(entries);
+  };
+  return build(root, true) as { [key: string]: unknown };
+};
+
+/**
+ * Each event's data is unflattened on its own.
+ */
+export const stateless = true;
+
+/**
+ * Function that rebuilds nested objects from the data of each event
+ * it receives, which must be an object with keys joined by a
+ * separator. It reverts the flatten function. Events that can't be
+ * unflattened are dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate how keys are split.
+ * @returns A channel that unflattens events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: UnflattenFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const separator = options?.separator ?? DEFAULT_SEPARATOR;
+  const arrays = options?.arrays ?? DEFAULT_ARRAYS;
+  const onError = options?.["on-error"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onError === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that can't be unflattened will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const unflatten = async (event: Event): Promise<Event | null> => {
+    try {
+      if (!isPlainObject(event.data)) {
+        throw new Error("the event's data is not an object");
+      }
+      return await makeFrom(event, {
+        data: unflattenObject(event.data, separator, arrays),
+      });
+    } catch (err) {
+      const reason = `${err}`;
+      stepLogger
+        .with({
+          event: event.name,
+          reason,
+          payload: truncatePayload(event.data),
+        })
+        .warn("Couldn't unflatten event");
+      if (onError === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+      return null;
+    }
+  };
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.unflatten`);
+  return flatMap(
+    async (events: Event[]) =>
+      (await Promise.all(events.map(unflatten))).filter(
+        (event): event is Event => event !== null
+      ),
+    queue.asChannel()
+  );
+};
@@ -0,0 +1,204 @@
+import { ErrorObject } from "ajv";
+import Ajv2020 from "ajv/dist/2020";
+import { match, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { JSON_NUMBERS } from "../conf";
+import { Event, makeFrom } from "../event";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/validate-schema");
+
+/**
+ * Options for this function.
+ */
+export type ValidateSchemaFunctionOptions = {
+  schema: object | boolean;
+  coerce?: boolean | "true" | "false";
+  "on-invalid"?: "drop" | "rename" | "dead-letter";
+  "invalid-suffix"?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    schema: { anyOf: [{ type: "object" }, { type: "boolean" }] },
+    coerce: { anyOf: [{ type: "boolean" }, { enum: ["true", "false"] }] },
+    "on-invalid": { enum: ["drop", "rename", "dead-letter"] },
+    "invalid-suffix": { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["schema"],
+};
+
+/**
+ * Ajv instances for draft 2020-12 schemas, one of which coerces the
+ * types of validated data.
+ */
+const strictAjv = new Ajv2020({ allErrors: true });
+const coercingAjv = new Ajv2020({ allErrors: true, coerceTypes: true });
+
+/**
+ * Validate validate-schema options, after they've been checked by the
+ * ajv schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: ValidateSchemaFunctionOptions
+): void => {
+  try {
+    strictAjv.compile(options.schema);
+  } catch (err) {
+    throw new Error(
+      `step '${name}' uses an invalid schema in validate-schema: ${
+        (err as Error).message
+      }`
+    );
+  }
+  const matchOptions = match(options);
+  check(
+    matchOptions
+      .with({ "invalid-suffix": P._, "on-invalid": "rename" }, () => true)
+      .with({ "invalid-suffix": P._ }, () => false),
+    `step '${name}' can use validate-schema.invalid-suffix only when validate-schema.on-invalid is 'rename'`
+  );
+  check(
+    matchOptions.with(
+      { "invalid-suffix": P.select(P.string) },
+      isValidEventName
+    ),
+    `step '${name}' uses an invalid validate-schema.invalid-suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default suffix appended to the name of invalid events, when
+ * renaming them.
+ */
+const DEFAULT_INVALID_SUFFIX = "invalid";
+
+/**
+ * Summarize validation errors as they're attached to invalid events.
+ *
+ * @param errors The errors produced by ajv.
+ * @returns The summarized errors.
+ */
+const summarizeErrors = (
+  errors: ErrorObject[] | null | undefined
+): { path: string; message: string }[] =>
+  (errors ?? []).map((error) => ({
+    path: error.instancePath,
+    message: error.message ?? error.keyword,
+  }));
+
+/**
+ * The names of the events validate-schema may emit, given the names
+ * of the events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: ValidateSchemaFunctionOptions,
+  names: EventNames
+): EventNames =>
+  options["on-invalid"] === "rename"
+    ? union(
+        names,
+        names?.map(
+          (name) =>
+            `${name}.${options["invalid-suffix"] ?? DEFAULT_INVALID_SUFFIX}`
+        ) ?? null
+      )
+    : names;
+
+/**
+ * Events are validated one by one, independently.
+ */
+export const stateless = true;
+
+/**
+ * Function that validates each event's data against a schema, and
+ * forwards only valid events. Invalid events are dropped, renamed and
+ * forwarded along with the validation errors found, or re-emitted as
+ * dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the schema to use and how
+ * to handle invalid events.
+ * @returns A channel that validates events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: ValidateSchemaFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const coerce =
+    typeof options.coerce === "string"
+      ? options.coerce === "true"
+      : options.coerce ?? false;
+  const validateData = (coerce ? coercingAjv : strictAjv).compile(
+    options.schema
+  );
+  const onInvalid = options["on-invalid"] ?? "drop";
+  const reportFailure = params.reportFailure;
+  if (onInvalid === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "invalid events will be dropped"
+    );
+  }
+  const suffix = options["invalid-suffix"] ?? DEFAULT_INVALID_SUFFIX;
+  const queue = new AsyncQueue<Event[]>(
+    `step.${params.stepName}.validate-schema`
+  );
+  return flatMap(async (events: Event[]) => {
+    const forwarded = [];
+    for (const event of events) {
+      // Coercion modifies the data in place, so it's applied over a
+      // copy of it. Exact numbers are copied as javascript numbers, so
+      // that the schema sees them as numbers.
+      const data =
+        coerce || JSON_NUMBERS === "exact"
+          ? JSON.parse(JSON.stringify(event.data))
+          : event.data;
+      if (validateData(data)) {
+        forwarded.push(coerce ? await makeFrom(event, { data }) : event);
+      } else if (onInvalid === "rename") {
+        forwarded.push(
+          await makeFrom(event, {
+            name: `${event.name}.${suffix}`,
+            data: {
+              data: event.data,
+              errors: summarizeErrors(validateData.errors),
+            },
+          })
+        );
+      } else if (
+        onInvalid === "dead-letter" &&
+        typeof reportFailure !== "undefined"
+      ) {
+        await reportFailure(
+          [event],
+          summarizeErrors(validateData.errors)
+            .map(({ path, message }) => `${path || "/"} ${message}`)
+            .join(", ")
+        );
+      }
+    }
+    return forwarded;
+  }, queue.asChannel());
+};
@@ -0,0 +1,194 @@
+import { timingSafeEqual } from "crypto";
+import { match, P } from "ts-pattern";
+import { EventNames, union } from "../analysis";
+import { Channel, AsyncQueue, flatMap } from "../async-queue";
+import { Event, makeFrom } from "../event";
+import { makeLogger } from "../log";
+import { isValidEventName } from "../pattern";
+import { check } from "../utils";
+import { PipelineStepFunctionParameters } from ".";
+import { DEFAULT_SIGNATURE_FIELD, computeSignature } from "./sign";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("step-functions/verify");
+
+/**
+ * Options for this function.
+ */
+export type VerifyFunctionOptions = {
+  keys: string[];
+  field?: string;
+  "on-invalid"?: "drop" | "rename" | "dead-letter";
+  "invalid-suffix"?: string;
+};
+
+/**
+ * An ajv schema for the options.
+ */
+export const optionsSchema = {
+  type: "object",
+  properties: {
+    keys: {
+      type: "array",
+      items: { type: "string", minLength: 1 },
+      minItems: 1,
+    },
+    field: { type: "string", minLength: 1 },
+    "on-invalid": { enum: ["drop", "rename", "dead-letter"] },
+    "invalid-suffix": { type: "string", minLength: 1 },
+  },
+  additionalProperties: false,
+  required: ["keys"],
+};
+
+/**
+ * Validate verify options, after they've been checked by the ajv
+ * schema.
+ *
+ * @param name The name of the step this function belongs to.
+ * @param options The options to validate.
+ */
+export const validate = (
+  name: string,
+  options: VerifyFunctionOptions
+): void => {
+  const matchOptions = match(options);
+  check(
+    matchOptions
+      .with({ "invalid-suffix": P._, "on-invalid": "drop" }, () => false)
+      .with(
+        { "invalid-suffix": P._, "on-invalid": "dead-letter" },
+        () => false
+      ),
+    `step '${name}' can use verify.invalid-suffix only when verify.on-invalid is 'rename'`
+  );
+  check(
+    matchOptions.with(
+      { "invalid-suffix": P.select(P.string) },
+      isValidEventName
+    ),
+    `step '${name}' uses an invalid verify.invalid-suffix value ` +
+      "(must be a valid event name)"
+  );
+};
+
+/**
+ * Default suffix appended to the name of events that fail
+ * verification, when renaming them.
+ */
+const DEFAULT_INVALID_SUFFIX = "invalid";
+
+/**
+ * Check the signature of an event's data against every given key.
+ *
+ * @param data The event's data.
+ * @param field The data field that holds the signature.
+ * @param keys The keys the data may be signed with.
+ * @returns The reason the event failed verification, or null if it
+ * passed it.
+ */
+const checkSignature = (
+  data: unknown,
+  field: string,
+  keys: string[]
+): string | null => {
+  if (typeof data !== "object" || data === null || Array.isArray(data)) {
+    return "the event's data is not an object";
+  }
+  const record = data as Record<string, unknown>;
+  const signature = record[field];
+  if (typeof signature !== "string") {
+    return "the event is not signed";
+  }
+  const received = Buffer.from(signature);
+  // Signatures are compared in constant time, so that comparisons
+  // don't leak how much of a forged signature is correct.
+  const valid = keys.some((key) => {
+    const expected = Buffer.from(computeSignature(record, field, key));
+    return (
+      expected.length === received.length &&
+      timingSafeEqual(expected, received)
+    );
+  });
+  return valid ? null : "the event's signature doesn't match";
+};
+
+/**
+ * The names of the events verify may emit, given the names of the
+ * events it receives.
+ *
+ * @param options The function's options.
+ * @param names The names of the events received.
+ * @returns The names of the events emitted.
+ */
+export const emits = (
+  options: VerifyFunctionOptions,
+  names: EventNames
+): EventNames =>
+  (options["on-invalid"] ?? "rename") === "rename"
+    ? union(
+        names,
+        names?.map(
+          (name) =>
+            `${name}.${options["invalid-suffix"] ?? DEFAULT_INVALID_SUFFIX}`
+        ) ?? null
+      )
+    : names;
+
+/**
+ * Verification depends on each event alone.
+ */
+export const stateless = true;
+
+/**
+ * Function that verifies the HMAC signature attached to each event's
+ * data, and forwards only events with a valid signature. Several keys
+ * may be given, so that keys can be rotated without rejecting events
+ * signed with the previous one. Events that are unsigned or tampered
+ * with are renamed, dropped, or re-emitted as dead-letter events.
+ *
+ * @param params Configuration parameters acquired from the pipeline.
+ * @param options The options that indicate the verification keys and
+ * how to handle events that fail verification.
+ * @returns A channel that verifies events.
+ */
+export const make = async (
+  params: PipelineStepFunctionParameters,
+  options: VerifyFunctionOptions
+): Promise<Channel<Event[], Event>> => {
+  const field = options.field ?? DEFAULT_SIGNATURE_FIELD;
+  const onInvalid = options["on-invalid"] ?? "rename";
+  const suffix = options["invalid-suffix"] ?? DEFAULT_INVALID_SUFFIX;
+  const reportFailure = params.reportFailure;
+  if (onInvalid === "dead-letter" && typeof reportFailure === "undefined") {
+    logger.warn(
+      `Step '${params.stepName}' doesn't have a dead-letter name; ` +
+        "events that fail verification will be dropped"
+    );
+  }
+  const stepLogger = logger.with({ step: params.stepName });
+  const queue = new AsyncQueue<Event[]>(`step.${params.stepName}.verify`);
+  return flatMap(async (events: Event[]) => {
+    const forwarded = [];
+    for (const event of events) {
+      const reason = checkSignature(event.data, field, options.keys);
+      if (reason === null) {
+        forwarded.push(event);
+        continue;
+      }
+      stepLogger
+        .with({ event: event.name, reason })
+        .warn("Event failed verification");
+      if (onInvalid === "rename") {
+        forwarded.push(
+          await makeFrom(event, { name: `${event.name}.${suffix}` })
+        );
+      } else if (onInvalid === "dead-letter") {
+        await reportFailure?.([event], reason);
+      }
+    }
+    return forwarded;
+  }, queue.asChannel());
+};
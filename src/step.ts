@@ -1,7 +1,23 @@
-import { AsyncQueue, Channel, compose, drain } from "./async-queue";
+import { createHash } from "crypto";
+import {
+  AsyncQueue,
+  Channel,
+  OverflowPolicy,
+  QueueLoad,
+  compose,
+  drain,
+  inLane,
+  inStep,
+  startWork,
+  unwatchQueues,
+  untilSettled,
+  watchQueues,
+} from "./async-queue";
 import { Event } from "./event";
 import { makeLogger } from "./log";
+import { stepEvents, stepBufferDepth } from "./metrics";
 import { Pattern, match } from "./pattern";
+import { canonicalize } from "./utils";
 
 /**
  * A logger instance namespaced to this module.
@@ -27,36 +43,103 @@ export type StepOptions = {
 };
 
 /**
- * Build a matching procedure that determines whether an event is
- * desired according to the given step options, and also forwards it
- * if it's not desired but required to flow elsewhere.
+ * Get the owner of the work that a step holds on to without
+ * processing it: events in incomplete windows, and events waiting at
+ * the step's entry or buffer to be let through. The step's entry
+ * doesn't wait for that work to finish, but the step isn't idle
+ * until it does.
+ *
+ * @param name The name of the step.
+ * @returns The owner of the work.
+ */
+export const heldWorkOf = (name: string): string => `${name}#held`;
+
+/**
+ * Watch the queues of a step that hold the events it's processing. The
+ * queues at the step's entry and in its buffer hold events received
+ * later, so they're not watched.
+ *
+ * @param name The name of the step.
+ * @returns The load of the step's queues.
+ */
+const watchStepQueues = (name: string): QueueLoad =>
+  watchQueues(
+    (queue) =>
+      (queue.step === name || queue.name.startsWith(`step.${name}.`)) &&
+      queue.name !== `step.${name}.entry` &&
+      queue.name !== `buffer.${name}`
+  );
+
+/**
+ * Build the entry of a step, which determines whether each event is
+ * desired according to the step's pattern, sending it to the step's
+ * channel if it is. Undesired events are forwarded if the pattern
+ * mode requires them to flow elsewhere, but only after the step
+ * processed every event received before them, so that they don't
+ * overtake the events emitted for those. Events received while a
+ * forwarded event waits are held back as well, to keep their order.
  *
  * @param options The step options that determine the predicate.
+ * @param channel The step's channel.
  * @param forward The forwarding function.
- * @returns A predicate for events that also forwards the non-passing
- * events if it's appropriate.
+ * @returns The step, with its entry in front of the channel.
  */
-const makeMatcher = (
+const makeEntry = (
   options: StepOptions,
+  channel: Channel<Event, never>,
   forward: (...events: Event[]) => void
-): ((event: Event) => boolean) => {
-  const sendForward =
-    options.patternMode === "pass"
-      ? (e: Event) => {
-          forward(e);
-          return false;
+): Step => {
+  const pattern = options.pattern;
+  if (typeof pattern === "undefined") {
+    return channel;
+  }
+  if (options.patternMode === "drop") {
+    return {
+      ...channel,
+      send: (...events: Event[]) =>
+        channel.send(...events.filter((event) => match(event.name, pattern))),
+    };
+  }
+  const queue = new AsyncQueue<Event>(`step.${options.name}.entry`);
+  const load = watchStepQueues(options.name);
+  const sequencing = (async () => {
+    for await (const event of queue.iterator()) {
+      if (match(event.name, pattern)) {
+        if (!channel.send(event)) {
+          stepEvents.inc({ step: options.name, flow: "dead" });
         }
-      : () => false;
-  return typeof options.pattern === "undefined"
-    ? () => true
-    : (event: Event) =>
-        match(event.name, options.pattern ?? "#") ? true : sendForward(event);
+      } else {
+        // The event is accounted as work held by the step while it
+        // waits, but not as the step's own work, since the step waits
+        // for the latter to finish.
+        const finishWork = startWork(heldWorkOf(options.name));
+        await untilSettled(load, [options.name]);
+        forward(event);
+        finishWork();
+      }
+    }
+  })();
+  return {
+    ...channel,
+    send: (...events: Event[]) =>
+      events.map((event) => queue.push(event)).every((pushed) => pushed),
+    close: async () => {
+      queue.close();
+      await sequencing;
+      await channel.close();
+      unwatchQueues(load);
+    },
+  };
 };
 
 /**
  * Internal type used to refer to a window in the making.
  */
-type Group = { events: Event[]; timeout: ReturnType<typeof setTimeout> | null };
+type Group = {
+  events: Event[];
+  timeout: ReturnType<typeof setTimeout> | null;
+  finishWork: () => void;
+};
 
 /**
  * Build a windowing channel that accumulates events in windows of the
@@ -88,18 +171,22 @@ export const makeWindowingChannel = (
   const sendOne = (event: Event): boolean => {
     const newGroup = !currentGroups.has(currentGroupIndex);
     if (newGroup) {
+      // Events held in incomplete windows count as work in
+      // progress.
       const group: Group = {
         events: [],
         timeout: null,
+        finishWork: startWork(heldWorkOf(options.name)),
       };
       currentGroups.set(currentGroupIndex, group);
       if (timeWindow >= 0) {
         const timeout = setTimeout(
           (index) => {
             if (currentGroups.has(index)) {
-              const timedOutGroup = (currentGroups.get(index) as Group).events;
+              const timedOutGroup = currentGroups.get(index) as Group;
               currentGroups.delete(index);
-              queue.push(timedOutGroup);
+              queue.push(timedOutGroup.events);
+              timedOutGroup.finishWork();
             }
           },
           timeWindow,
@@ -123,7 +210,9 @@ export const makeWindowingChannel = (
             clearTimeout(group.timeout);
           }
           currentGroups.delete(index);
-          return queue.push(group.events);
+          const pushed = queue.push(group.events);
+          group.finishWork();
+          return pushed;
         }
         return true;
       })
@@ -142,6 +231,7 @@ export const makeWindowingChannel = (
           }
           currentGroups.delete(index);
           queue.push(group.events);
+          group.finishWork();
         });
       // Then close the queue.
       queue.close();
@@ -171,18 +261,14 @@ export const makeWindowed = (
   const windowingChannel = makeWindowingChannel(options);
   const channel = compose(fn, windowingChannel);
   return async (send) => {
-    const filterOrPass = makeMatcher(options, send);
     const masked = drain(
       channel,
       async (event: Event) => send(event),
       async () => {
-        logger.info(`Step '${options.name}' finished operation`);
+        logger.with({ step: options.name }).info("Step finished operation");
       }
     );
-    return {
-      ...masked,
-      send: (...events: Event[]) => masked.send(...events.filter(filterOrPass)),
-    };
+    return makeEntry(options, masked, send);
   };
 };
 
@@ -197,16 +283,311 @@ export const makeWindowed = (
 export const makeStreamlined =
   (options: StepOptions, fn: Channel<Event, Event>): StepFactory =>
   async (send) => {
-    const filterOrPass = makeMatcher(options, send);
     const masked = drain(
       fn,
       async (event: Event) => send(event),
       async () => {
-        logger.info(`Step '${options.name}' finished operation`);
+        logger.with({ step: options.name }).info("Step finished operation");
       }
     );
+    return makeEntry(options, masked, send);
+  };
+
+/**
+ * Options for the buffer placed in front of a step.
+ */
+export type BufferOptions = {
+  size: number;
+  policy: OverflowPolicy;
+};
+
+/**
+ * Wraps a step factory with a bounded buffer, which holds events
+ * while the step has as many queued events as the buffer's size. The
+ * buffer's overflow policy decides what happens to events received
+ * once it's full.
+ *
+ * @param name The name of the step.
+ * @param options The buffer's size and overflow policy.
+ * @param factory The step factory to wrap.
+ * @returns A step factory.
+ */
+export const makeBuffered =
+  (name: string, options: BufferOptions, factory: StepFactory): StepFactory =>
+  async (send) => {
+    const step = await factory(send);
+    const stepLogger = logger.with({ step: name });
+    const labels = { step: name, policy: options.policy };
+    const queue = new AsyncQueue<Event>(`buffer.${name}`, {
+      ...options,
+      onDrop: (event) => {
+        stepEvents.inc({ step: name, flow: "dropped" });
+        stepLogger
+          .with({ event: event.name })
+          .debug("Dropped event", event.id, "from the step's full buffer");
+      },
+    });
+    stepBufferDepth.set(labels, 0);
+    // The events queued within the step, in any of the queues used by
+    // its windows and its function.
+    const load = watchQueues((queue) => queue.name.startsWith(`step.${name}.`));
+    const forwarding = (async () => {
+      for await (const event of queue.iterator()) {
+        const finishWork = startWork(heldWorkOf(name));
+        stepBufferDepth.set(labels, queue.data.length);
+        // Events taken from one of the step's queues may be on their
+        // way to another one, so the load is checked again once
+        // pending hand-overs are done.
+        while (load.count >= options.size) {
+          await load.decreased();
+          await new Promise((resolve) => setImmediate(resolve));
+        }
+        if (!step.send(event)) {
+          stepEvents.inc({ step: name, flow: "dead" });
+          stepLogger.warn("Couldn't forward event", event.id, "from buffer");
+        }
+        finishWork();
+      }
+    })();
     return {
-      ...masked,
-      send: (...events: Event[]) => masked.send(...events.filter(filterOrPass)),
+      ...step,
+      send: (...events: Event[]) => {
+        const pushed = events
+          .map((event) => queue.push(event))
+          .every((result) => result);
+        stepBufferDepth.set(labels, queue.data.length);
+        return pushed;
+      },
+      close: async () => {
+        queue.close();
+        await forwarding;
+        await step.close();
+        unwatchQueues(load);
+      },
     };
   };
+
+/**
+ * Options for the partitioning of a step in lanes.
+ */
+export type PartitionOptions = {
+  lanes: number;
+  /**
+   * A channel that receives vectors of events, and produces for each
+   * vector an array holding, for each event, an array with its key
+   * as first element (i.e. the output of an extraction program).
+   */
+  extractor: Channel<Event[], unknown>;
+};
+
+/**
+ * Get the lane that events with the given key are routed to. Keys
+ * are compared by their canonical JSON representation, so that
+ * objects with the same keys in different orders share a lane.
+ *
+ * @param key The key of the events.
+ * @param lanes The count of lanes.
+ * @returns The index of the lane.
+ */
+export const laneOf = (key: unknown, lanes: number): number =>
+  createHash("sha1").update(canonicalize(key)).digest().readUInt32BE(0) %
+  lanes;
+
+/**
+ * Builds a step made of parallel lanes, each one an independent
+ * instance of the step, and routes each received event to the lane
+ * given by its key. Events with the same key are always routed to the
+ * same lane in the order they're received, so the order of their
+ * processing is kept, while events with different keys may be
+ * processed concurrently in different lanes. Events without a key
+ * share a lane.
+ *
+ * @param name The name of the step.
+ * @param options The count of lanes and the extractor of keys.
+ * @param makeLane The procedure that builds each lane.
+ * @returns A step factory.
+ */
+export const makePartitioned =
+  (
+    name: string,
+    options: PartitionOptions,
+    makeLane: (lane: number) => Promise<StepFactory>
+  ): StepFactory =>
+  async (send) => {
+    const stepLogger = logger.with({ step: name });
+    // Lanes are built one at a time, so that the queues each one
+    // creates are accounted to it.
+    const lanes: Step[] = [];
+    for (let lane = 0; lane < options.lanes; lane++) {
+      lanes.push(
+        await inLane({ step: name, lane }, async () =>
+          (await makeLane(lane))(send)
+        )
+      );
+    }
+    const routing = drain(
+      new AsyncQueue<Event[]>(`step.${name}.partition`).asChannel(),
+      async (events: Event[]) => {
+        options.extractor.send(events);
+        const result = await options.extractor.receive.next();
+        const extracted: unknown[][] =
+          !result.done && Array.isArray(result.value) ? result.value : [];
+        events.forEach((event, index) => {
+          const [key] = extracted[index] ?? [null];
+          if (!lanes[laneOf(key ?? null, lanes.length)].send(event)) {
+            stepEvents.inc({ step: name, flow: "dead" });
+            stepLogger.warn("Couldn't route event", event.id, "to its lane");
+          }
+        });
+      }
+    );
+    return {
+      ...routing,
+      send: (...events: Event[]) => routing.send(events),
+      close: async () => {
+        await routing.close();
+        await Promise.all(lanes.map((lane) => lane.close()));
+        await options.extractor.close();
+      },
+    };
+  };
+
+/**
+ * Options for running concurrent instances of a step's function.
+ */
+export type ConcurrencyOptions = {
+  instances: number;
+  ordered: boolean;
+};
+
+/**
+ * A vector of events handed to an instance, and the events emitted
+ * for it that are held back until the vectors before it are done.
+ */
+type Slot = {
+  held: Event[];
+  done: boolean;
+};
+
+/**
+ * Builds a channel that hands each received vector of events to one
+ * of several instances of a function, so that vectors are processed
+ * concurrently. An instance is handed a vector only once it's done
+ * with the previous one, which it is when every queue and channel it
+ * built is idle. When ordered, the events emitted for each vector are
+ * held back until the instances are done with every vector received
+ * before it, so that the order of a single instance is kept. When
+ * not ordered, events are emitted as soon as instances emit them.
+ *
+ * @param name The name of the step.
+ * @param options The count of instances and whether to keep order.
+ * @param makeInstance The procedure that builds each instance.
+ * @returns A channel that processes vectors of events.
+ */
+export const makeConcurrent = async (
+  name: string,
+  options: ConcurrencyOptions,
+  makeInstance: (instance: number) => Promise<Channel<Event[], Event>>
+): Promise<Channel<Event[], Event>> => {
+  // Instances are built one at a time, each one owning the queues it
+  // creates and the work it does, so that it's known when each one
+  // is idle.
+  const owners: string[] = [];
+  const instances: Channel<Event[], Event>[] = [];
+  for (let instance = 0; instance < options.instances; instance++) {
+    const owner = `${name}#${instance}`;
+    owners.push(owner);
+    instances.push(await inStep(owner, () => makeInstance(instance)));
+  }
+  const loads = owners.map((owner) =>
+    watchQueues((queue) => queue.step === owner)
+  );
+  const output = new AsyncQueue<Event>(`step.${name}.concurrency.output`);
+  // The slots of vectors not yet emitted in full, in the order they
+  // were received, which is only kept when ordered.
+  const sequence: Slot[] = [];
+  const current: (Slot | null)[] = instances.map(() => null);
+  const emit = (slot: Slot, event: Event): void => {
+    if (!options.ordered || sequence[0] === slot) {
+      output.push(event);
+    } else {
+      slot.held.push(event);
+    }
+  };
+  const complete = (slot: Slot): void => {
+    slot.done = true;
+    if (!options.ordered) {
+      return;
+    }
+    while (sequence.length > 0 && sequence[0].done) {
+      sequence.shift();
+      // The next vector in sequence emits directly from now on.
+      const head = sequence[0];
+      if (typeof head !== "undefined") {
+        head.held.splice(0).forEach((event) => output.push(event));
+      }
+    }
+  };
+  const reading = instances.map(async (instance, index) => {
+    for await (const event of instance.receive) {
+      const slot = current[index];
+      if (slot === null) {
+        // Events emitted while idle (e.g. on close) aren't held.
+        output.push(event);
+      } else {
+        emit(slot, event);
+      }
+    }
+  });
+  // Instances that are idle, and the dispatches waiting for one.
+  const idle: number[] = instances.map((_, index) => index);
+  const waiting: ((index: number) => void)[] = [];
+  const acquire = (): Promise<number> =>
+    idle.length > 0
+      ? Promise.resolve(idle.shift() as number)
+      : new Promise((resolve) => waiting.push(resolve));
+  const release = (index: number): void => {
+    const next = waiting.shift();
+    if (typeof next === "undefined") {
+      idle.push(index);
+    } else {
+      next(index);
+    }
+  };
+  const processing: Set<Promise<void>> = new Set();
+  const dispatching = drain(
+    new AsyncQueue<Event[]>(`step.${name}.concurrency`).asChannel(),
+    async (events: Event[]) => {
+      const index = await acquire();
+      const slot: Slot = { held: [], done: false };
+      if (options.ordered) {
+        sequence.push(slot);
+      }
+      current[index] = slot;
+      // The vector counts as the step's work until its instance is
+      // done with it.
+      const finishWork = startWork(name);
+      instances[index].send(events);
+      const processed = untilSettled(loads[index], [owners[index]]).then(() => {
+        current[index] = null;
+        complete(slot);
+        finishWork();
+        processing.delete(processed);
+        release(index);
+      });
+      processing.add(processed);
+    }
+  );
+  return {
+    send: dispatching.send,
+    receive: output.iterator(),
+    close: async () => {
+      await dispatching.close();
+      await Promise.all(Array.from(processing));
+      await Promise.all(instances.map((instance) => instance.close()));
+      await Promise.all(reading);
+      output.close();
+      loads.forEach(unwatchQueues);
+    },
+  };
+};
@@ -0,0 +1,180 @@
+import {
+  ROOT_CONTEXT,
+  SpanContext,
+  SpanKind,
+  Tracer,
+  defaultTextMapGetter,
+  isSpanContextValid,
+  trace,
+} from "@opentelemetry/api";
+import { W3CTraceContextPropagator } from "@opentelemetry/core";
+import { OTLPTraceExporter } from "@opentelemetry/exporter-trace-otlp-http";
+import { Resource } from "@opentelemetry/resources";
+import {
+  BasicTracerProvider,
+  BatchSpanProcessor,
+  ParentBasedSampler,
+  SpanProcessor,
+  TraceIdRatioBasedSampler,
+} from "@opentelemetry/sdk-trace-base";
+import { SemanticResourceAttributes } from "@opentelemetry/semantic-conventions";
+import {
+  TRACING_OTLP_ENDPOINT,
+  TRACING_SAMPLE_RATIO,
+  TRACING_SERVICE_NAME,
+} from "./conf";
+import { makeLogger } from "./log";
+
+/**
+ * A logger instance namespaced to this module.
+ */
+const logger = makeLogger("tracing");
+
+/**
+ * The tracer used to record spans, which is set only while tracing
+ * is enabled.
+ */
+let tracer: Tracer | null = null;
+
+/**
+ * Check whether spans are being recorded.
+ *
+ * @returns Whether tracing is enabled.
+ */
+export const isTracing = (): boolean => tracer !== null;
+
+/**
+ * Start recording spans with the given processor, or with an OTLP
+ * exporter if the endpoint is configured.
+ *
+ * @param processor The span processor to use, which overrides the
+ * configured exporter.
+ * @param ratio The ratio of traces sampled, for traces started by
+ * the pipeline. Traces propagated from elsewhere follow the sampling
+ * decision of their parents.
+ * @returns A procedure that flushes pending spans and stops tracing.
+ */
+export const startTracing = (
+  processor?: SpanProcessor,
+  ratio: number = TRACING_SAMPLE_RATIO
+): (() => Promise<void>) => {
+  const spanProcessor =
+    processor ??
+    (TRACING_OTLP_ENDPOINT === null
+      ? null
+      : new BatchSpanProcessor(
+          new OTLPTraceExporter({ url: TRACING_OTLP_ENDPOINT })
+        ));
+  if (spanProcessor === null) {
+    return async () => undefined;
+  }
+  const provider = new BasicTracerProvider({
+    resource: new Resource({
+      [SemanticResourceAttributes.SERVICE_NAME]: TRACING_SERVICE_NAME,
+    }),
+    sampler: new ParentBasedSampler({
+      root: new TraceIdRatioBasedSampler(ratio),
+    }),
+  });
+  provider.addSpanProcessor(spanProcessor);
+  tracer = provider.getTracer("cdp");
+  logger.info("Started recording trace spans");
+  return async () => {
+    tracer = null;
+    await provider.shutdown();
+    logger.info("Finished recording trace spans");
+  };
+};
+
+/**
+ * The propagator used to read trace contexts from headers, following
+ * the W3C trace context format.
+ */
+const propagator = new W3CTraceContextPropagator();
+
+/**
+ * Trace contexts propagated from elsewhere, indexed by the raw values
+ * received by input forms.
+ */
+const remoteContexts: WeakMap<object, SpanContext> = new WeakMap();
+
+/**
+ * Associate a raw value received by an input form with the trace
+ * context found in the headers it was received with, if any. The
+ * context is given to the event parsed from the value.
+ *
+ * @param thing The raw value received.
+ * @param headers The headers that accompanied the value.
+ */
+export const attachRemoteContext = (
+  thing: unknown,
+  headers: { [key: string]: unknown } | undefined
+): void => {
+  if (
+    tracer === null ||
+    typeof thing !== "object" ||
+    thing === null ||
+    typeof headers === "undefined"
+  ) {
+    return;
+  }
+  const carrier = Object.fromEntries(
+    Object.entries(headers).map(([key, value]) => [
+      key.toLowerCase(),
+      Buffer.isBuffer(value) ? value.toString() : value,
+    ])
+  );
+  const spanContext = trace.getSpanContext(
+    propagator.extract(ROOT_CONTEXT, carrier, defaultTextMapGetter)
+  );
+  if (typeof spanContext !== "undefined" && isSpanContextValid(spanContext)) {
+    remoteContexts.set(thing, spanContext);
+  }
+};
+
+/**
+ * Get the trace context associated with a raw value received by an
+ * input form.
+ *
+ * @param thing The raw value received.
+ * @returns The trace context, if any.
+ */
+export const remoteContextOf = (thing: unknown): SpanContext | undefined =>
+  typeof thing === "object" && thing !== null
+    ? remoteContexts.get(thing)
+    : undefined;
+
+/**
+ * Record a finished span for an event handled by the pipeline.
+ *
+ * @param name The name of the span, which is the name of the step
+ * that handled the event.
+ * @param eventName The name of the event, recorded as an attribute.
+ * @param parent The trace context of the parent span, if any.
+ * @param startTime The time the span started, in milliseconds.
+ * @returns The trace context of the recorded span, to be given to
+ * the event, or undefined if tracing is disabled.
+ */
+export const recordSpan = (
+  name: string,
+  eventName: string,
+  parent: SpanContext | undefined,
+  startTime: number
+): SpanContext | undefined => {
+  if (tracer === null) {
+    return undefined;
+  }
+  const span = tracer.startSpan(
+    name,
+    {
+      kind: SpanKind.INTERNAL,
+      startTime,
+      attributes: { "cdp.event.name": eventName },
+    },
+    typeof parent === "undefined"
+      ? ROOT_CONTEXT
+      : trace.setSpanContext(ROOT_CONTEXT, parent)
+  );
+  span.end();
+  return span.spanContext();
+};
@@ -1,6 +1,8 @@
 import { createHash } from "crypto";
+import { readFileSync } from "fs";
 import Ajv from "ajv";
 import { match } from "ts-pattern";
+import { ExactNumber } from "./exact-number";
 
 /**
  * Central Ajv instance for the whole application.
@@ -83,6 +85,34 @@ export const getSignature = (...args: unknown[]): Promise<string> =>
     }
   });
 
+/**
+ * Serialize a JSON-encodable value in a canonical form, which is
+ * JSON with object keys sorted, so that equal values always produce
+ * the same serialization regardless of the order in which their keys
+ * were inserted.
+ *
+ * @param value The value to serialize.
+ * @returns The canonical serialization.
+ */
+export const canonicalize = (value: unknown): string => {
+  if (value instanceof ExactNumber) {
+    return value.source;
+  }
+  if (Array.isArray(value)) {
+    // Undefined items are serialized as null, as JSON.stringify does.
+    return `[${value.map((item) => canonicalize(item)).join(",")}]`;
+  }
+  if (typeof value === "object" && value !== null) {
+    const record = value as Record<string, unknown>;
+    return `{${Object.keys(record)
+      .filter((key) => typeof record[key] !== "undefined")
+      .sort()
+      .map((key) => `${JSON.stringify(key)}:${canonicalize(record[key])}`)
+      .join(",")}}`;
+  }
+  return JSON.stringify(value) ?? "null";
+};
+
 /**
  * Creates a promise that resolves after the specified number of
  * milliseconds.
@@ -119,6 +149,137 @@ export const envsubst = (thing: unknown): unknown => {
   }
 };
 
+/**
+ * Keys of the pipeline whose values hold jq, jsonnet or lua code, or
+ * regular expressions, where `$` is meaningful. Placeholders are left
+ * untouched in those values.
+ */
+const SNIPPET_KEY =
+  /^(send-receive-(jq|jsonnet)|(.+-)?(jq|jsonnet)-(expr|prelude)|lua-script|(.+-)?pattern)$/;
+
+/**
+ * Keys of the pipeline whose values hold code when given as strings,
+ * as the shorthands of the `jsonnet` and `lua` functions do.
+ */
+const SNIPPET_SHORTHAND_KEY = /^(jsonnet|lua)$/;
+
+/**
+ * Keys of the pipeline whose values are secret keys, which must be
+ * given through placeholders instead of being written in the file.
+ */
+const SECRET_KEY = /^identities$/;
+
+/**
+ * A placeholder that gives a whole value, without a default.
+ */
+const WHOLE_PLACEHOLDER = /^\$\{(?:(?:env:)?[A-Za-z_]\w*|file:[^}]+)\}$/;
+
+/**
+ * The placeholders replaced by interpolation: an escaped `$${`, a
+ * reference to an environment variable with an optional default, or
+ * a reference to a file.
+ */
+const PLACEHOLDER =
+  /\$\$\{|\$\{(?:env:)?([A-Za-z_]\w*)(?::-([^}]*))?\}|\$\{file:([^}]+)\}/g;
+
+/**
+ * Replace placeholders in the string values of the given thing, with
+ * the values of environment variables (`${NAME}` or `${env:NAME}`,
+ * optionally with a default as in `${env:NAME:-default}`) or the
+ * contents of files (`${file:/path}`), without a trailing newline.
+ * Values holding code or regular expressions aren't interpolated,
+ * and `$${` may be used to write a literal `${`. Unlike envsubst,
+ * this fails if a variable is unset and has no default, or a file
+ * can't be read.
+ *
+ * @param thing The thing to replace placeholders in.
+ * @param path The path to the thing, used for error messages.
+ * @returns A replaced thing, that has the same shape as the given
+ * thing but with placeholders replaced.
+ */
+export const interpolate = (thing: unknown, path = ""): unknown => {
+  if (typeof thing === "string") {
+    return thing.replace(
+      PLACEHOLDER,
+      (_, name?: string, fallback?: string, file?: string) => {
+        if (typeof name !== "undefined") {
+          const value = process.env[name];
+          if (typeof fallback !== "undefined" && !value) {
+            return fallback;
+          }
+          if (typeof value === "undefined") {
+            throw new Error(
+              `the pipeline's ${path || "value"} references the ` +
+                `environment variable ${name}, which is unset`
+            );
+          }
+          return value;
+        }
+        if (typeof file !== "undefined") {
+          try {
+            return readFileSync(file, "utf-8").replace(/\r?\n$/, "");
+          } catch (err) {
+            throw new Error(
+              `the pipeline's ${path || "value"} references the file ` +
+                `${file}, which couldn't be read: ${err}`
+            );
+          }
+        }
+        return "${";
+      }
+    );
+  } else if (Array.isArray(thing)) {
+    return thing.map((item, index) => interpolate(item, `${path}[${index}]`));
+  } else if (typeof thing === "object" && thing !== null) {
+    return Object.fromEntries(
+      Object.entries(thing).map(([k, v]) => [
+        k,
+        SNIPPET_KEY.test(k) ||
+        (SNIPPET_SHORTHAND_KEY.test(k) && typeof v === "string")
+          ? v
+          : interpolate(v, path ? `${path}.${k}` : k),
+      ])
+    );
+  } else {
+    return thing;
+  }
+};
+
+/**
+ * Check that the secret keys held by the given thing, such as the
+ * identities used for decryption, are each given by a placeholder
+ * (e.g. `${file:/run/secrets/key}`) instead of being written in the
+ * pipeline file, where they would leak to anyone able to read it.
+ *
+ * @param thing The raw pipeline, before interpolation.
+ * @param path The path to the thing, used for error messages.
+ */
+export const checkSecretPlaceholders = (thing: unknown, path = ""): void => {
+  if (Array.isArray(thing)) {
+    thing.forEach((item, index) =>
+      checkSecretPlaceholders(item, `${path}[${index}]`)
+    );
+  } else if (typeof thing === "object" && thing !== null) {
+    Object.entries(thing).forEach(([k, v]) => {
+      const keyPath = path ? `${path}.${k}` : k;
+      if (!SECRET_KEY.test(k)) {
+        checkSecretPlaceholders(v, keyPath);
+        return;
+      }
+      (Array.isArray(v) ? v : [v]).forEach((secret, index) => {
+        const secretPath = Array.isArray(v) ? `${keyPath}[${index}]` : keyPath;
+        if (typeof secret === "string" && !WHOLE_PLACEHOLDER.test(secret)) {
+          throw new Error(
+            `the pipeline's ${secretPath} ` +
+              "must be given through a placeholder, such as ${file:/path}, " +
+              "instead of being written in the pipeline file"
+          );
+        }
+      });
+    });
+  }
+};
+
 /**
  * Merges HTTP headers as given, preserving the last ones in case of
  * collision. This procedure ignores capitalization in header keys,
@@ -4,67 +4,666 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
 	"io"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-// This program receives a snippet of Jsonnet code and applies it
-// continuously to all stdin lines, feeding each line as a top-level
-// argument. The output is compacted and written to stdout, in one
-// line for evaluation result. Errors found during Jsonnet execution
-// produce no output.
-func main() {
-	if len(os.Args) > 4 || len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "Usage: stream-jsonnet [tag [input]] <code>")
-		os.Exit(1)
+// identifierPattern matches syntactically valid Jsonnet identifiers.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedWords can't be used as Jsonnet identifiers.
+var reservedWords = map[string]bool{
+	"assert": true, "else": true, "error": true, "false": true,
+	"for": true, "function": true, "if": true, "import": true,
+	"importstr": true, "importbin": true, "in": true, "local": true,
+	"null": true, "tailstrict": true, "then": true, "self": true,
+	"super": true, "true": true,
+}
+
+// isValidIdentifier checks whether the given name can be bound as a
+// top-level argument and referred to by the Jsonnet program.
+func isValidIdentifier(name string) bool {
+	return identifierPattern.MatchString(name) && !reservedWords[name]
+}
+
+// parameterNames lists the parameters of the top-level function of
+// the program, if it is one.
+func parameterNames(node ast.Node) map[string]bool {
+	for {
+		local, ok := node.(*ast.Local)
+		if !ok {
+			break
+		}
+		node = local.Body
 	}
-	jsonnetProgram := os.Args[len(os.Args)-1]
-	tag := "stream.jsonnet"
-	if len(os.Args) > 2 {
-		tag = os.Args[1]
+	names := make(map[string]bool)
+	if function, ok := node.(*ast.Function); ok {
+		for _, parameter := range function.Parameters {
+			names[string(parameter.Name)] = true
+		}
 	}
-	input := "input"
-	if len(os.Args) > 3 {
-		input = os.Args[2]
+	return names
+}
+
+// repeatedFlag collects every value given to a flag that may be
+// specified several times.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseAssignments interprets each of the given `name=value` or
+// `name` strings, the latter taking the value from the environment
+// variable of the same name, like the `jsonnet` CLI does.
+func parseAssignments(assignments []string) (map[string]string, error) {
+	values := make(map[string]string, len(assignments))
+	for _, assignment := range assignments {
+		name, value, found := strings.Cut(assignment, "=")
+		if !found {
+			value, found = os.LookupEnv(name)
+			if !found {
+				return nil, fmt.Errorf("environment variable %q is not defined", name)
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("missing variable name in %q", assignment)
+		}
+		values[name] = value
 	}
+	return values, nil
+}
 
-	// Check the syntactic correctness of the jsonnet program.
-	ast, err := jsonnet.SnippetToAST(tag, jsonnetProgram)
+// program holds the parsed Jsonnet program and the settings used to
+// evaluate it.
+type program struct {
+	ast   ast.Node
+	input string
+	// rawInput binds each line as a string, rather than as Jsonnet
+	// code.
+	rawInput bool
+	// lineNumberVar and tagVar are the names of the optional
+	// top-level arguments, or empty when they aren't bound.
+	lineNumberVar string
+	tagVar        string
+	tag           string
+	extVars       map[string]string
+	extCode       map[string]string
+	indent        int
+	explode       bool
+	enableNow     bool
+	jpaths        []string
+	// resetEvery is the amount of lines after which each VM is
+	// replaced, or 0 to keep it for the whole run.
+	resetEvery int
+}
+
+// evaluator is a Jsonnet VM together with the state of the line
+// being evaluated.
+type evaluator struct {
+	vm *jsonnet.VM
+	// now is the time captured when starting to evaluate the
+	// current line.
+	now time.Time
+	// evaluated is the amount of lines evaluated by the current VM.
+	evaluated int
+}
+
+// newEvaluator creates a Jsonnet VM ready to evaluate the
+// program. VMs are not safe for concurrent use, so each worker gets
+// its own.
+func (p *program) newEvaluator() *evaluator {
+	e := &evaluator{}
+	e.vm = p.makeVM(e)
+	return e
+}
+
+// makeVM creates a Jsonnet VM configured for the program, with its
+// own empty caches. The native functions read the state of the given
+// evaluator.
+func (p *program) makeVM(e *evaluator) *jsonnet.VM {
+	vm := jsonnet.MakeVM()
+	// The importer caches the contents of imported files, as does
+	// the VM, so files are read at most once per VM rather than once
+	// per line.
+	vm.Importer(&jsonnet.FileImporter{JPaths: p.jpaths})
+	if p.enableNow {
+		// The time is captured once per line, so that all references
+		// within a single evaluation agree.
+		vm.NativeFunction(&jsonnet.NativeFunction{
+			Name:   "now",
+			Params: ast.Identifiers{},
+			Func: func([]interface{}) (interface{}, error) {
+				return e.now.Format(time.RFC3339Nano), nil
+			},
+		})
+		vm.NativeFunction(&jsonnet.NativeFunction{
+			Name:   "nowUnixMillis",
+			Params: ast.Identifiers{},
+			Func: func([]interface{}) (interface{}, error) {
+				return float64(e.now.UnixMilli()), nil
+			},
+		})
+	}
+	if p.tagVar != "" {
+		vm.TLAVar(p.tagVar, p.tag)
+	}
+	for name, value := range p.extVars {
+		vm.ExtVar(name, value)
+	}
+	for name, code := range p.extCode {
+		vm.ExtCode(name, code)
+	}
+	return vm
+}
+
+// result is the outcome of evaluating the program against a single
+// line: either some output or an error.
+type result struct {
+	index  int
+	line   string
+	output []byte
+	err    error
+}
+
+// evaluate applies the program to a single line of input, the
+// index-th one read.
+func (p *program) evaluate(e *evaluator, index int, line string) result {
+	// The VM caches imports and external variables across
+	// evaluations, so it's replaced periodically to bound that
+	// growth. The parsed program is kept.
+	if p.resetEvery > 0 && e.evaluated >= p.resetEvery {
+		e.vm = p.makeVM(e)
+		e.evaluated = 0
+	}
+	e.evaluated++
+	if p.rawInput {
+		e.vm.TLAVar(p.input, strings.TrimSuffix(line, "\n"))
+	} else {
+		e.vm.TLACode(p.input, line)
+	}
+	if p.lineNumberVar != "" {
+		e.vm.TLACode(p.lineNumberVar, strconv.Itoa(index))
+	}
+	if p.enableNow {
+		e.now = time.Now()
+	}
+	output, err := e.vm.Evaluate(p.ast)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error:", err)
-		os.Exit(1)
+		return result{index: index, line: line, err: err}
 	}
+	return result{index: index, line: line, output: p.format(output)}
+}
 
-	// Process each line as input.
-	jsonnetVM := jsonnet.MakeVM()
-	reader := bufio.NewReader(os.Stdin)
+// format serializes an evaluation output as a record, either
+// compacted to a single line or indented, and always followed by a
+// single newline. When exploding, a top-level array is serialized as
+// one record per element instead.
+func (p *program) format(output string) []byte {
+	var formatted bytes.Buffer
+	value := bytes.TrimSpace([]byte(output))
+	var elements []json.RawMessage
+	if p.explode && len(value) > 0 && value[0] == '[' && json.Unmarshal(value, &elements) == nil {
+		for _, element := range elements {
+			p.writeRecord(&formatted, element)
+		}
+	} else {
+		p.writeRecord(&formatted, value)
+	}
+	return formatted.Bytes()
+}
+
+// writeRecord writes a single JSON value as a record.
+func (p *program) writeRecord(buffer *bytes.Buffer, value []byte) {
+	if p.indent > 0 {
+		json.Indent(buffer, value, "", strings.Repeat(" ", p.indent))
+	} else {
+		json.Compact(buffer, value)
+	}
+	buffer.Write([]byte("\n"))
+}
+
+// errorRecord is the structured form of an evaluation error.
+type errorRecord struct {
+	Input string `json:"input"`
+	Error string `json:"error"`
+	Line  int    `json:"line"`
+}
+
+// sink holds the destinations of evaluation results.
+type sink struct {
+	stdout io.Writer
+	stderr io.Writer
+	// errors receives structured evaluation errors, if not nil.
+	errors io.Writer
+	// succeeded and failed count the evaluations emitted so far.
+	succeeded int
+	failed    int
+}
+
+// summary is the structured form of the statistics of a run.
+type summary struct {
+	Processed int `json:"processed"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// summary reports the evaluations emitted so far.
+func (s *sink) summary() summary {
+	return summary{Processed: s.succeeded + s.failed, Succeeded: s.succeeded, Failed: s.failed}
+}
+
+// emit writes the result of an evaluation to the proper output. Each
+// record is written with a single call, so that records can't be
+// interleaved even when several outputs share a file.
+func (s *sink) emit(r result) {
+	if r.err == nil {
+		s.succeeded++
+		s.stdout.Write(r.output)
+		return
+	}
+	s.failed++
+	// Since the Jsonnet program was deemed syntactically correct,
+	// an error here is assumed to be an error in the input or the
+	// execution. Skipping this input is thus compatible with the
+	// `try` expression applied to jq filters.
+	if s.errors == nil {
+		fmt.Fprintln(s.stderr, r.err)
+		return
+	}
+	record, _ := json.Marshal(errorRecord{
+		Input: strings.TrimSuffix(r.line, "\n"),
+		Error: r.err.Error(),
+		Line:  r.index,
+	})
+	s.errors.Write(append(record, '\n'))
+}
+
+// recordReader yields successive input records, and io.EOF once the
+// input is exhausted.
+type recordReader func() (string, error)
+
+// lineLimit bounds the length of input lines, and tells how to
+// handle the lines that exceed it: skip, truncate or error.
+type lineLimit struct {
+	maxBytes   int
+	onOversize string
+	stderr     io.Writer
+}
+
+// readLine reads a line, including its newline, keeping in memory at
+// most maxBytes of its content when maxBytes is positive. The rest of
+// a longer line is read and discarded, and its whole size is
+// returned.
+func readLine(reader *bufio.Reader, maxBytes int) ([]byte, int, error) {
+	var line []byte
+	size := 0
 	for {
-		switch line, err := reader.ReadString('\n'); err {
-		case nil:
-			jsonnetVM.TLACode(input, line)
-			output, err := jsonnetVM.Evaluate(ast)
-			if err != nil {
-				// Since the Jsonnet program was deemed syntactically
-				// correct, an error here is assumed to be an error in
-				// the input or the execution. Skipping this input is
-				// thus compatible with the `try` expression applied
-				// to jq filters.
-				fmt.Fprintln(os.Stderr, err)
-			} else {
-				var compacted bytes.Buffer
-				json.Compact(&compacted, []byte(output))
-				compacted.Write([]byte("\n"))
-				compacted.WriteTo(os.Stdout)
+		chunk, err := reader.ReadSlice('\n')
+		size += len(chunk)
+		// One more byte than the limit is kept, which is room for
+		// the newline.
+		if room := maxBytes + 1 - len(line); maxBytes <= 0 || room >= len(chunk) {
+			line = append(line, chunk...)
+		} else if room > 0 {
+			line = append(line, chunk[:room]...)
+		}
+		if err != bufio.ErrBufferFull {
+			if bytes.HasSuffix(chunk, []byte("\n")) {
+				size--
 			}
+			return line, size, err
+		}
+	}
+}
+
+// truncate cuts a line to at most maxBytes bytes, without splitting
+// a UTF-8 encoded character.
+func truncate(line []byte, maxBytes int) []byte {
+	if len(line) <= maxBytes {
+		return line
+	}
+	end := maxBytes
+	for end > 0 && !utf8.RuneStart(line[end]) {
+		end--
+	}
+	return line[:end]
+}
+
+// lineReader splits the input in lines, each one being a record. A
+// last line without a trailing newline is a record too. Lines longer
+// than the limit are skipped, truncated or reported as an error,
+// depending on the limit's policy.
+func lineReader(input io.Reader, limit lineLimit) recordReader {
+	reader := bufio.NewReader(input)
+	count := 0
+	return func() (string, error) {
+		for {
+			line, size, err := readLine(reader, limit.maxBytes)
+			if err == io.EOF && size == 0 {
+				return "", io.EOF
+			}
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			// The end of the input is reported by the next read.
+			count++
+			if limit.maxBytes <= 0 || size <= limit.maxBytes {
+				return string(line), nil
+			}
+			switch limit.onOversize {
+			case "truncate":
+				return string(truncate(line, limit.maxBytes)), nil
+			case "error":
+				return "", fmt.Errorf("line %d exceeds the limit of %d bytes", count, limit.maxBytes)
+			default:
+				fmt.Fprintf(limit.stderr, "line %d exceeds the limit of %d bytes; skipping it\n", count, limit.maxBytes)
+			}
+		}
+	}
+}
+
+// jsonReader reads complete JSON values from the input, regardless
+// of the newlines embedded in them. Each value is compacted before
+// being yielded as a record.
+func jsonReader(input io.Reader) recordReader {
+	decoder := json.NewDecoder(input)
+	return func() (string, error) {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return "", err
+		}
+		var compacted bytes.Buffer
+		json.Compact(&compacted, value)
+		return compacted.String(), nil
+	}
+}
+
+// processSerially evaluates each line in turn, using a single VM.
+func processSerially(p *program, reader recordReader, out *sink) error {
+	e := p.newEvaluator()
+	index := 0
+	for {
+		switch line, err := reader(); err {
+		case nil:
+			index++
+			out.emit(p.evaluate(e, index, line))
 
 		case io.EOF:
-			os.Exit(0)
+			return nil
 
 		default:
-			fmt.Fprintln(os.Stderr, "error:", err)
-			os.Exit(1)
+			return err
+		}
+	}
+}
+
+// job is a line to be evaluated by a worker, paired with the channel
+// where the result is expected.
+type job struct {
+	index  int
+	line   string
+	result chan result
+}
+
+// processConcurrently evaluates lines using a pool of workers, each
+// with its own VM. Results are written in the same order as the
+// input lines were read: each line gets a result channel, and those
+// channels are queued in reading order so that the output for line k
+// is written only after the output for line k-1.
+func processConcurrently(p *program, workers int, reader recordReader, out *sink) error {
+	jobs := make(chan job, workers)
+	pending := make(chan chan result, 2*workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			e := p.newEvaluator()
+			for j := range jobs {
+				j.result <- p.evaluate(e, j.index, j.line)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		for r := range pending {
+			out.emit(<-r)
+		}
+		close(done)
+	}()
+
+	var readErr error
+	for index := 1; readErr == nil; index++ {
+		line, err := reader()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
 		}
+		r := make(chan result, 1)
+		pending <- r
+		jobs <- job{index: index, line: line, result: r}
+	}
+	close(jobs)
+	close(pending)
+	<-done
+	return readErr
+}
+
+// openErrorsTarget interprets the -errors-to option, which is either
+// a file descriptor number or a file path. The returned function
+// releases the target.
+func openErrorsTarget(target string, stdout io.Writer, stderr io.Writer) (io.Writer, func(), error) {
+	noop := func() {}
+	if fd, err := strconv.Atoi(target); err == nil {
+		switch fd {
+		case 1:
+			return stdout, noop, nil
+		case 2:
+			return stderr, noop, nil
+		}
+		if fd < 0 {
+			return nil, noop, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+		if file == nil {
+			return nil, noop, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		return file, noop, nil
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, noop, err
+	}
+	return file, func() { file.Close() }, nil
+}
+
+// run applies the Jsonnet program given in args to each line read
+// from stdin, and returns the exit code of the program.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("stream-jsonnet", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: stream-jsonnet [options] [tag [input]] <code>")
+		flags.PrintDefaults()
+	}
+	workers := flags.Int("workers", 1, "number of lines evaluated concurrently")
+	indent := flags.Int("indent", 0, "number of spaces used to indent output, or 0 to compact it")
+	explode := flags.Bool("explode", false, "write each element of a top-level array result as its own record")
+	framing := flags.String("framing", "line", "how input records are delimited: line or json")
+	inputMode := flags.String("input-mode", "json", "how input records are bound: json, as Jsonnet code, or string, as raw text")
+	lineNumberVar := flags.String("linenum-var", "lineNumber", "name of the top-level argument holding the 1-based input line number, or empty to skip it")
+	tagVar := flags.String("tag-var", "tag", "name of the top-level argument holding the tag, or empty to skip it")
+	enableNow := flags.Bool("enable-now", false, "register the native functions now and nowUnixMillis")
+	errorsTo := flags.String("errors-to", "", "file descriptor or file path receiving evaluation errors as JSON objects")
+	maxLineBytes := flags.Int("max-line-bytes", 0, "maximum length of input lines in bytes, or 0 for no limit")
+	onOversize := flags.String("on-oversize", "skip", "how lines exceeding -max-line-bytes are handled: skip, truncate or error")
+	resetEvery := flags.Int("reset-every", 0, "number of lines after which each Jsonnet VM is recreated, or 0 to never recreate it")
+	stats := flags.Bool("stats", false, "write a JSON summary of processed, succeeded and failed lines to stderr at the end of the input")
+	failOverRate := flags.Float64("fail-over-rate", 1, "exit with code 2 if the rate of failed lines exceeds this value, between 0 and 1")
+	var extVarFlags, extCodeFlags, jpathFlags repeatedFlag
+	flags.Var(&jpathFlags, "J", "library search `dir`; may be given several times")
+	flags.Var(&extVarFlags, "V", "external variable as `name=value`, or `name` to read it from the environment")
+	flags.Var(&extCodeFlags, "ext-code", "external variable as `name=<jsonnet>`, or `name` to read it from the environment")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	args = flags.Args()
+	if len(args) > 3 || len(args) < 1 {
+		flags.Usage()
+		return 1
+	}
+	if *framing != "line" && *framing != "json" {
+		fmt.Fprintf(stderr, "error: invalid framing %q; must be line or json\n", *framing)
+		return 1
+	}
+	if *inputMode != "json" && *inputMode != "string" {
+		fmt.Fprintf(stderr, "error: invalid input mode %q; must be json or string\n", *inputMode)
+		return 1
+	}
+	if *maxLineBytes < 0 {
+		fmt.Fprintln(stderr, "error: the maximum line length must not be negative")
+		return 1
+	}
+	if *onOversize != "skip" && *onOversize != "truncate" && *onOversize != "error" {
+		fmt.Fprintf(stderr, "error: invalid oversize policy %q; must be skip, truncate or error\n", *onOversize)
+		return 1
+	}
+	if *maxLineBytes > 0 && *framing != "line" {
+		fmt.Fprintln(stderr, "error: the maximum line length requires line framing")
+		return 1
+	}
+	if *failOverRate < 0 || *failOverRate > 1 {
+		fmt.Fprintln(stderr, "error: the failure rate must be between 0 and 1")
+		return 1
+	}
+	if *indent < 0 {
+		fmt.Fprintln(stderr, "error: the indentation must not be negative")
+		return 1
+	}
+	if *resetEvery < 0 {
+		fmt.Fprintln(stderr, "error: the reset interval must not be negative")
+		return 1
 	}
+	if *workers < 1 {
+		fmt.Fprintln(stderr, "error: the number of workers must be at least 1")
+		return 1
+	}
+	jsonnetProgram := args[len(args)-1]
+	tag := "stream.jsonnet"
+	if len(args) > 1 {
+		tag = args[0]
+	}
+	input := "input"
+	if len(args) > 2 {
+		input = args[1]
+	}
+	if !isValidIdentifier(input) {
+		fmt.Fprintf(stderr, "error: input name %q is not a valid Jsonnet identifier\n", input)
+		return 1
+	}
+	for _, name := range []string{*lineNumberVar, *tagVar} {
+		if name != "" && !isValidIdentifier(name) {
+			fmt.Fprintf(stderr, "error: argument name %q is not a valid Jsonnet identifier\n", name)
+			return 1
+		}
+	}
+	if input == *lineNumberVar || input == *tagVar || (*tagVar != "" && *tagVar == *lineNumberVar) {
+		fmt.Fprintln(stderr, "error: the input, line number and tag names must be different")
+		return 1
+	}
+
+	extVars, err := parseAssignments(extVarFlags)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	extCode, err := parseAssignments(extCodeFlags)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	for name, code := range extCode {
+		if _, err := jsonnet.SnippetToAST("<extvar:"+name+">", code); err != nil {
+			fmt.Fprintf(stderr, "error: invalid code for external variable %q: %s\n", name, err)
+			return 1
+		}
+	}
+
+	// Check the syntactic correctness of the jsonnet program.
+	node, err := jsonnet.SnippetToAST(tag, jsonnetProgram)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	// The additional top-level arguments are bound only if the
+	// program expects them, since Jsonnet rejects unknown arguments.
+	parameters := parameterNames(node)
+	if !parameters[*lineNumberVar] {
+		*lineNumberVar = ""
+	}
+	if !parameters[*tagVar] {
+		*tagVar = ""
+	}
+	p := &program{ast: node, input: input, rawInput: *inputMode == "string", lineNumberVar: *lineNumberVar, tagVar: *tagVar, tag: tag, extVars: extVars, extCode: extCode, indent: *indent, explode: *explode, enableNow: *enableNow, jpaths: jpathFlags, resetEvery: *resetEvery}
+
+	out := &sink{stdout: stdout, stderr: stderr}
+	if *errorsTo != "" {
+		errors, release, err := openErrorsTarget(*errorsTo, stdout, stderr)
+		if err != nil {
+			fmt.Fprintln(stderr, "error:", err)
+			return 1
+		}
+		defer release()
+		out.errors = errors
+	}
+
+	// Process each line as input.
+	var reader recordReader
+	if *framing == "json" {
+		reader = jsonReader(stdin)
+	} else {
+		reader = lineReader(stdin, lineLimit{maxBytes: *maxLineBytes, onOversize: *onOversize, stderr: stderr})
+	}
+	if *workers == 1 {
+		err = processSerially(p, reader, out)
+	} else {
+		err = processConcurrently(p, *workers, reader, out)
+	}
+	outcome := out.summary()
+	if *stats {
+		record, _ := json.Marshal(outcome)
+		fmt.Fprintln(stderr, string(record))
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	if outcome.Processed > 0 && float64(outcome.Failed)/float64(outcome.Processed) > *failOverRate {
+		fmt.Fprintf(stderr, "error: %d of %d lines failed, exceeding the rate of %g\n", outcome.Failed, outcome.Processed, *failOverRate)
+		return 2
+	}
+	return 0
+}
+
+// This program receives a snippet of Jsonnet code and applies it
+// continuously to all stdin lines, feeding each line as a top-level
+// argument. The output is compacted and written to stdout, in one
+// line for evaluation result. Errors found during Jsonnet execution
+// produce no output.
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
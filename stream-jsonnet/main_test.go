@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-jsonnet"
+)
+
+// TestMain runs the program instead of the tests when the test binary
+// is re-executed by BenchmarkSubprocess, so that the benchmark spawns
+// a real stream-jsonnet process without building it first.
+func TestMain(m *testing.M) {
+	if os.Getenv("STREAM_JSONNET_RUN_MAIN") == "1" {
+		os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	os.Exit(m.Run())
+}
+
+// runWith executes the program with the given arguments and stdin,
+// returning the exit code, stdout and stderr.
+func runWith(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestDefaultInputName(t *testing.T) {
+	code, stdout, stderr := runWith(t, "\"world\"\n", "function(input) {hello: input}")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "{\"hello\":\"world\"}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestCustomInputName(t *testing.T) {
+	code, stdout, stderr := runWith(
+		t,
+		"1\n2\n",
+		"mytag", "payload", "function(payload) {doubled: payload * 2}",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stderr != "" {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+	if stdout != "{\"doubled\":2}\n{\"doubled\":4}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestInvalidInputName(t *testing.T) {
+	for _, name := range []string{"", "1abc", "with-dash", "local", "self"} {
+		code, stdout, stderr := runWith(t, "1\n", "tag", name, "function(x) x")
+		if code != 1 {
+			t.Errorf("expected exit code 1 for %q, got %d", name, code)
+		}
+		if stdout != "" {
+			t.Errorf("unexpected output for %q: %q", name, stdout)
+		}
+		if !strings.Contains(stderr, "not a valid Jsonnet identifier") {
+			t.Errorf("unexpected errors for %q: %q", name, stderr)
+		}
+	}
+}
+
+func TestWorkersPreserveOrder(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&input, "%d\n", i)
+	}
+	input.WriteString("\"not a number\"\n")
+	snippet := "function(input) {n: input, square: input * input}"
+	_, expected, expectedErrors := runWith(t, input.String(), snippet)
+	for _, workers := range []string{"2", "4", "16"} {
+		code, stdout, stderr := runWith(t, input.String(), "-workers", workers, snippet)
+		if code != 0 {
+			t.Fatalf("expected exit code 0 with %s workers, got %d", workers, code)
+		}
+		if stdout != expected {
+			t.Errorf("output with %s workers differs from the serial output", workers)
+		}
+		if stderr != expectedErrors {
+			t.Errorf("errors with %s workers differ from the serial errors: %q", workers, stderr)
+		}
+	}
+}
+
+func TestInvalidWorkers(t *testing.T) {
+	code, _, _ := runWith(t, "1\n", "-workers", "0", "function(input) input")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+}
+
+func BenchmarkWorkers(b *testing.B) {
+	snippet := "function(input) std.foldl(function(acc, x) acc + x % 7, std.range(0, 500), input)"
+	var input strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&input, "%d\n", i)
+	}
+	lines := input.String()
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			args := []string{"-workers", fmt.Sprint(workers), snippet}
+			for i := 0; i < b.N; i++ {
+				if code := run(args, strings.NewReader(lines), io.Discard, io.Discard); code != 0 {
+					b.Fatalf("unexpected exit code %d", code)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSubprocess compares evaluating lines in-process, with a
+// VM and a program parsed once as the jsonnet step does, against
+// spawning stream-jsonnet and piping the same lines through it. The
+// light snippet shows the overhead of the subprocess, which the heavy
+// one hides.
+func BenchmarkSubprocess(b *testing.B) {
+	snippets := []struct{ name, code string }{
+		{"light", "function(input) {n: input}"},
+		{"heavy", "function(input) std.foldl(function(acc, x) acc + x % 7, std.range(0, 500), input)"},
+	}
+	var input strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&input, "%d\n", i)
+	}
+	lines := input.String()
+	for _, snippet := range snippets {
+		b.Run(fmt.Sprintf("%s/in-process", snippet.name), func(b *testing.B) {
+			node, err := jsonnet.SnippetToAST("<benchmark>", snippet.code)
+			if err != nil {
+				b.Fatalf("unexpected error %v", err)
+			}
+			vm := jsonnet.MakeVM()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 20; j++ {
+					vm.TLACode("input", strconv.Itoa(j))
+					if _, err := vm.Evaluate(node); err != nil {
+						b.Fatalf("unexpected error %v", err)
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%s/subprocess", snippet.name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cmd := exec.Command(os.Args[0], snippet.code)
+				cmd.Env = append(os.Environ(), "STREAM_JSONNET_RUN_MAIN=1")
+				cmd.Stdin = strings.NewReader(lines)
+				cmd.Stdout = io.Discard
+				if err := cmd.Run(); err != nil {
+					b.Fatalf("unexpected error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestExternalVariables(t *testing.T) {
+	t.Setenv("STREAM_JSONNET_TEST_ENV", "production")
+	code, stdout, stderr := runWith(
+		t,
+		"1\n",
+		"-V", "threshold=10",
+		"-V", "STREAM_JSONNET_TEST_ENV",
+		"--ext-code", "table={a: 1, b: [2, 3]}",
+		"function(input) {input: input, threshold: std.extVar('threshold'), env: std.extVar('STREAM_JSONNET_TEST_ENV'), table: std.extVar('table')}",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	expected := "{\"env\":\"production\",\"input\":1,\"table\":{\"a\":1,\"b\":[2,3]},\"threshold\":\"10\"}\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestInvalidExternalCode(t *testing.T) {
+	code, stdout, stderr := runWith(t, "1\n", "--ext-code", "broken={a:", "function(input) input")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if stdout != "" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	if !strings.Contains(stderr, "invalid code for external variable \"broken\"") {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+}
+
+func TestUndefinedEnvironmentVariable(t *testing.T) {
+	code, _, stderr := runWith(t, "1\n", "-V", "STREAM_JSONNET_TEST_UNDEFINED", "function(input) input")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr, "is not defined") {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+}
+
+func TestErrorsTo(t *testing.T) {
+	errorsFile := filepath.Join(t.TempDir(), "errors.jsonl")
+	code, stdout, stderr := runWith(
+		t,
+		"2\n0\n",
+		"-errors-to", errorsFile, "function(input) {result: 10 / input}",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "{\"result\":5}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	if stderr != "" {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+	contents, err := os.ReadFile(errorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected exactly one error record, got %q", contents)
+	}
+	var record errorRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Input != "0" || record.Line != 2 || !strings.Contains(record.Error, "Division by zero") {
+		t.Errorf("unexpected error record %+v", record)
+	}
+}
+
+func TestErrorsToFileDescriptor(t *testing.T) {
+	code, stdout, stderr := runWith(
+		t,
+		"0\n2\n",
+		"-errors-to", "2", "-workers", "2", "function(input) {result: 10 / input}",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "{\"result\":5}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	if !strings.HasPrefix(stderr, "{\"input\":\"0\",") || strings.Count(stderr, "\n") != 1 {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+}
+
+var update = flag.Bool("update", false, "update golden files")
+
+// checkGolden compares the output against the named golden file,
+// rewriting it instead when the -update flag is given.
+func checkGolden(t *testing.T, name string, output string) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(golden, []byte(output), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != string(expected) {
+		t.Errorf("output doesn't match %s:\n%s", golden, output)
+	}
+}
+
+func TestGoldenOutput(t *testing.T) {
+	input, err := os.ReadFile(filepath.Join("testdata", "records.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		golden string
+		args   []string
+	}{
+		{"records.compact.golden", nil},
+		{"records.compact.golden", []string{"-indent", "0"}},
+		{"records.indent.golden", []string{"-indent", "2"}},
+	} {
+		args := append(tc.args, "function(input) {input: input}")
+		code, stdout, stderr := runWith(t, string(input), args...)
+		if code != 0 {
+			t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+		}
+		checkGolden(t, tc.golden, stdout)
+	}
+}
+
+func TestExplode(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"array", "[1, {\"a\": [2, 3]}, \"x\"]\n", "1\n{\"a\":[2,3]}\n\"x\"\n"},
+		{"scalar", "7\n", "7\n"},
+		{"object", "{\"a\": [1, 2]}\n", "{\"a\":[1,2]}\n"},
+		{"empty array", "[]\n", ""},
+	} {
+		code, stdout, stderr := runWith(t, tc.input, "-explode", "function(input) input")
+		if code != 0 {
+			t.Fatalf("%s: expected exit code 0, got %d (stderr: %s)", tc.name, code, stderr)
+		}
+		if stdout != tc.expected {
+			t.Errorf("%s: unexpected output %q", tc.name, stdout)
+		}
+	}
+}
+
+func TestWithoutExplode(t *testing.T) {
+	code, stdout, _ := runWith(t, "[1, 2]\n[]\n", "function(input) input")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if stdout != "[1,2]\n[]\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestLastLineWithoutNewline(t *testing.T) {
+	for _, workers := range []string{"1", "4"} {
+		code, stdout, stderr := runWith(t, "{\"a\": 1}", "-workers", workers, "function(input) {a: input.a}")
+		if code != 0 {
+			t.Fatalf("expected exit code 0 with %s workers, got %d (stderr: %s)", workers, code, stderr)
+		}
+		if stdout != "{\"a\":1}\n" {
+			t.Errorf("unexpected output with %s workers %q", workers, stdout)
+		}
+	}
+}
+
+func TestOversizedLines(t *testing.T) {
+	input := "1\n" + strings.Repeat("2", 10000) + "\n3\n"
+	for _, tc := range []struct {
+		policy   string
+		code     int
+		expected string
+		errors   string
+	}{
+		{"skip", 0, "1\n3\n", "line 2 exceeds the limit of 16 bytes; skipping it\n"},
+		{"truncate", 0, "1\n2222222222222222\n3\n", ""},
+		{"error", 1, "1\n", "error: line 2 exceeds the limit of 16 bytes\n"},
+	} {
+		code, stdout, stderr := runWith(t, input, "-max-line-bytes", "16", "-on-oversize", tc.policy, "function(input) input")
+		if code != tc.code {
+			t.Errorf("%s: expected exit code %d, got %d (stderr: %s)", tc.policy, tc.code, code, stderr)
+		}
+		if stdout != tc.expected {
+			t.Errorf("%s: unexpected output %q", tc.policy, stdout)
+		}
+		if stderr != tc.errors {
+			t.Errorf("%s: unexpected errors %q", tc.policy, stderr)
+		}
+	}
+}
+
+func TestLinesWithinLimit(t *testing.T) {
+	code, stdout, stderr := runWith(t, "1234\n12345", "-max-line-bytes", "5", "-on-oversize", "error", "function(input) input")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "1234\n12345\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestTruncateKeepsCharacters(t *testing.T) {
+	if truncated := string(truncate([]byte("\"aé\""), 3)); truncated != "\"a" {
+		t.Errorf("unexpected truncation %q", truncated)
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, workers := range []string{"1", "4"} {
+		code, stdout, stderr := runWith(t, "1\n2\n\"x\"\n4\n", "-workers", workers, "-stats", "function(input) input * 2")
+		if code != 0 {
+			t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+		}
+		if stdout != "2\n4\n8\n" {
+			t.Errorf("unexpected output %q", stdout)
+		}
+		if !strings.HasSuffix(stderr, "{\"processed\":4,\"succeeded\":3,\"failed\":1}\n") {
+			t.Errorf("unexpected summary in %q", stderr)
+		}
+	}
+}
+
+func TestFailOverRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate string
+		code int
+	}{
+		{"0", 2},
+		{"0.2", 2},
+		{"0.25", 0},
+		{"1", 0},
+	} {
+		code, _, stderr := runWith(t, "1\n2\n\"x\"\n4\n", "-fail-over-rate", tc.rate, "function(input) input * 2")
+		if code != tc.code {
+			t.Errorf("rate %s: expected exit code %d, got %d (stderr: %s)", tc.rate, tc.code, code, stderr)
+		}
+		if tc.code == 2 && !strings.Contains(stderr, "error: 1 of 4 lines failed, exceeding the rate of "+tc.rate) {
+			t.Errorf("rate %s: unexpected errors %q", tc.rate, stderr)
+		}
+	}
+}
+
+func TestFailOverRateWithoutInput(t *testing.T) {
+	code, _, stderr := runWith(t, "", "-fail-over-rate", "0", "-stats", "function(input) input")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stderr != "{\"processed\":0,\"succeeded\":0,\"failed\":0}\n" {
+		t.Errorf("unexpected summary %q", stderr)
+	}
+}
+
+func TestInvalidFailOverRate(t *testing.T) {
+	code, _, stderr := runWith(t, "", "-fail-over-rate", "1.5", "function(input) input")
+	if code != 1 || !strings.Contains(stderr, "error: the failure rate must be between 0 and 1") {
+		t.Errorf("unexpected exit code %d (stderr: %s)", code, stderr)
+	}
+}
+
+func TestInputModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		input    string
+		code     string
+		expected string
+	}{
+		{"json", "{\"a\":1}\n", "function(input) input.a", "1\n"},
+		{"string", "{\"a\":1}\n", "function(input) input", "\"{\\\"a\\\":1}\"\n"},
+		{"string", "GET /index.html 200\nPOST /login 401", "function(input) std.split(input, ' ')", "[\"GET\",\"/index.html\",\"200\"]\n[\"POST\",\"/login\",\"401\"]\n"},
+	} {
+		code, stdout, stderr := runWith(t, tc.input, "-input-mode", tc.mode, tc.code)
+		if code != 0 {
+			t.Fatalf("%s: expected exit code 0, got %d (stderr: %s)", tc.mode, code, stderr)
+		}
+		if stdout != tc.expected {
+			t.Errorf("%s: unexpected output %q", tc.mode, stdout)
+		}
+	}
+}
+
+func TestJSONModeRejectsText(t *testing.T) {
+	code, stdout, stderr := runWith(t, "not json\n", "function(input) input")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "" || stderr == "" {
+		t.Errorf("expected an evaluation error, got output %q", stdout)
+	}
+}
+
+func TestInvalidInputMode(t *testing.T) {
+	code, _, stderr := runWith(t, "", "-input-mode", "yaml", "function(input) input")
+	if code != 1 || !strings.Contains(stderr, "error: invalid input mode \"yaml\"") {
+		t.Errorf("unexpected exit code %d (stderr: %s)", code, stderr)
+	}
+}
+
+func TestJSONFraming(t *testing.T) {
+	input := "{\n  \"a\": 1,\n  \"b\": \"multi\\nline\"\n}\n{\"a\":\n2}"
+	code, stdout, stderr := runWith(t, input, "-framing", "json", "function(input) {a: input.a}")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestJSONFramingTruncated(t *testing.T) {
+	input := "{\"a\": 1}\n{\n  \"a\": "
+	code, stdout, stderr := runWith(t, input, "-framing", "json", "function(input) {a: input.a}")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if stdout != "{\"a\":1}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	if !strings.Contains(stderr, "unexpected EOF") {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+}
+
+func TestLineNumberAndTag(t *testing.T) {
+	code, stdout, _ := runWith(
+		t,
+		"\"a\"\n\n\"c\"\n",
+		"source.jsonnet", "input", "function(input, lineNumber, tag) {input: input, line: lineNumber, tag: tag}",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	expected := "{\"input\":\"a\",\"line\":1,\"tag\":\"source.jsonnet\"}\n" +
+		"{\"input\":\"c\",\"line\":3,\"tag\":\"source.jsonnet\"}\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestCustomLineNumberAndTagNames(t *testing.T) {
+	code, stdout, stderr := runWith(
+		t,
+		"1\n2\n",
+		"-linenum-var", "n", "-tag-var", "", "-workers", "2",
+		"function(input, n, tag='none') [n, tag]",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	if stdout != "[1,\"none\"]\n[2,\"none\"]\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestInvalidLineNumberName(t *testing.T) {
+	code, _, stderr := runWith(t, "1\n", "-linenum-var", "line number", "function(input) input")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr, "not a valid Jsonnet identifier") {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+}
+
+func TestNow(t *testing.T) {
+	code, stdout, stderr := runWith(
+		t,
+		"1\n2\n",
+		"-enable-now",
+		"function(input) local now = std.native('now'); [now(), now(), std.native('nowUnixMillis')()]",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(stdout, "\n"), "\n") {
+		var values []interface{}
+		if err := json.Unmarshal([]byte(line), &values); err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 3 || values[0] != values[1] {
+			t.Fatalf("expected identical timestamps, got %q", line)
+		}
+		timestamp, err := time.Parse(time.RFC3339Nano, values[0].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if float64(timestamp.UnixMilli()) != values[2] {
+			t.Errorf("expected timestamps to agree, got %q", line)
+		}
+	}
+}
+
+func TestNowDisabled(t *testing.T) {
+	_, stdout, stderr := runWith(t, "1\n", "function(input) std.native('now')()")
+	if stdout != "" || stderr == "" {
+		t.Errorf("expected an evaluation error, got output %q", stdout)
+	}
+}
+
+// removingReader yields the given lines one per read, calling the
+// callback before yielding every line but the first.
+type removingReader struct {
+	lines    []string
+	callback func()
+	read     int
+}
+
+func (r *removingReader) Read(p []byte) (int, error) {
+	if r.read >= len(r.lines) {
+		return 0, io.EOF
+	}
+	if r.read > 0 {
+		r.callback()
+	}
+	n := copy(p, r.lines[r.read])
+	r.read++
+	return n, nil
+}
+
+func TestImports(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	library := filepath.Join(dir, "lib", "util.libsonnet")
+	if err := os.WriteFile(library, []byte("{double(x): x * 2}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdin := &removingReader{
+		lines: []string{"1\n", "2\n"},
+		// The library is removed after the first line is evaluated,
+		// so the second line works only if the import was cached.
+		callback: func() { os.Remove(library) },
+	}
+	var stdout, stderr bytes.Buffer
+	code := run(
+		[]string{"-J", dir, "local util = import 'lib/util.libsonnet'; function(input) util.double(input)"},
+		stdin, &stdout, &stderr,
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if stdout.String() != "2\n4\n" {
+		t.Errorf("unexpected output %q (stderr: %s)", stdout.String(), stderr.String())
+	}
+}
+
+func TestResetEvery(t *testing.T) {
+	code, stdout, stderr := runWith(
+		t,
+		"1\n2\n3\n4\n5\n",
+		"-reset-every", "2", "-V", "suffix=!", "--ext-code", "factor=10",
+		"function(input, lineNumber) [lineNumber, input * std.extVar('factor'), std.extVar('suffix')]",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	expected := "[1,10,\"!\"]\n[2,20,\"!\"]\n[3,30,\"!\"]\n[4,40,\"!\"]\n[5,50,\"!\"]\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestResetEveryReloadsImports(t *testing.T) {
+	dir := t.TempDir()
+	library := filepath.Join(dir, "util.libsonnet")
+	if err := os.WriteFile(library, []byte("{scale(x): x * 2}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdin := &removingReader{
+		lines: []string{"1\n", "2\n"},
+		// The library changes after the first line is evaluated, so
+		// the second line sees the change only if the VM was reset.
+		callback: func() { os.WriteFile(library, []byte("{scale(x): x * 3}"), 0644) },
+	}
+	var stdout, stderr bytes.Buffer
+	code := run(
+		[]string{"-J", dir, "-reset-every", "1", "local util = import 'util.libsonnet'; function(input) util.scale(input)"},
+		stdin, &stdout, &stderr,
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr.String())
+	}
+	if stdout.String() != "2\n6\n" {
+		t.Errorf("unexpected output %q (stderr: %s)", stdout.String(), stderr.String())
+	}
+}
+
+func TestInvalidResetEvery(t *testing.T) {
+	code, _, stderr := runWith(t, "", "-reset-every", "-1", "function(input) input")
+	if code != 1 || !strings.Contains(stderr, "error: the reset interval must not be negative") {
+		t.Errorf("unexpected exit code %d (stderr: %s)", code, stderr)
+	}
+}
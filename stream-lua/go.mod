@@ -0,0 +1,5 @@
+module github.com/kklingenberg/cdp/stream-lua
+
+go 1.18
+
+require github.com/yuin/gopher-lua v1.1.1
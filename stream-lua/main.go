@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxDepth bounds the nesting of the values returned by scripts,
+// which also rejects tables that contain themselves.
+const maxDepth = 128
+
+// library is a standard Lua library made available to scripts.
+type library struct {
+	name string
+	open lua.LGFunction
+}
+
+// libraries lists the standard libraries opened in each Lua
+// state. The os, io, package and debug libraries are left out, so
+// that scripts can't reach the filesystem, the network or other
+// processes.
+var libraries = []library{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// safeGlobals are the base functions scripts may refer to. Those
+// that load code or reach outside the Lua state (dofile, loadfile,
+// load, loadstring, require, getfenv, setfenv, ...) aren't among
+// them. The other libraries are given to each evaluation apart.
+var safeGlobals = []string{
+	"assert", "error", "getmetatable", "ipairs", "next", "pairs",
+	"pcall", "rawequal", "rawget", "rawset", "select", "setmetatable",
+	"tonumber", "tostring", "type", "unpack", "xpcall", "_VERSION",
+}
+
+// compile checks the syntax of the script and compiles it, once for
+// every Lua state.
+func compile(chunkName string, code string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), chunkName)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, chunkName)
+}
+
+// program holds the compiled script and the settings used to
+// evaluate it.
+type program struct {
+	proto *lua.FunctionProto
+	// timeout bounds the time spent in a single evaluation, or is 0
+	// to leave evaluations unbounded.
+	timeout time.Duration
+	// stderr receives the output of the script's print calls.
+	stderr io.Writer
+}
+
+// worker is a Lua state together with the sandbox its evaluations
+// see as their globals.
+type worker struct {
+	state *lua.LState
+	// globals is the metatable of each evaluation's environment,
+	// which gives read access to the sandboxed globals.
+	globals *lua.LTable
+	// libraries are the tables of the libraries that follow the base
+	// one, which each evaluation gets a copy of.
+	libraries map[string]*lua.LTable
+	// broken tells whether the state was interrupted, in which case
+	// it's replaced before the next evaluation.
+	broken bool
+}
+
+// newWorker creates a Lua state ready to evaluate the script. Lua
+// states are not safe for concurrent use, so each worker gets its
+// own.
+func (p *program) newWorker() *worker {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, library := range libraries {
+		L.Push(L.NewFunction(library.open))
+		L.Push(lua.LString(library.name))
+		L.Call(1, 0)
+	}
+	libraryTables := make(map[string]*lua.LTable)
+	for _, library := range libraries[1:] {
+		libraryTables[library.name] = L.GetGlobal(library.name).(*lua.LTable)
+	}
+	// Strings index the string library through their metatable,
+	// which is hidden from getmetatable so that scripts can't modify
+	// the library through it.
+	stringMeta := L.NewTable()
+	stringMeta.RawSetString("__index", libraryTables[lua.StringLibName])
+	stringMeta.RawSetString("__metatable", lua.LFalse)
+	L.SetMetatable(lua.LString(""), stringMeta)
+	sandbox := L.NewTable()
+	for _, name := range safeGlobals {
+		sandbox.RawSetString(name, L.GetGlobal(name))
+	}
+	// The standard print writes to stdout, where it would be mixed
+	// with the responses.
+	sandbox.RawSetString("print", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		fmt.Fprintln(p.stderr, strings.Join(parts, "\t"))
+		return 0
+	}))
+	globals := L.NewTable()
+	globals.RawSetString("__index", sandbox)
+	return &worker{state: L, globals: globals, libraries: libraryTables}
+}
+
+// copyTable makes a shallow copy of a library's table, in which
+// references to the table itself refer to the copy.
+func copyTable(L *lua.LState, table *lua.LTable) *lua.LTable {
+	copied := L.NewTable()
+	table.ForEach(func(key, value lua.LValue) {
+		if value == table {
+			value = copied
+		}
+		copied.RawSet(key, value)
+	})
+	return copied
+}
+
+// record is the form of each input line: an event's name and data.
+type record struct {
+	Name string      `json:"name"`
+	Data interface{} `json:"data"`
+}
+
+// toLua converts a decoded JSON value to a Lua value. Arrays become
+// sequences starting at 1, and nulls become nil.
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for i, element := range v {
+			table.RawSetInt(i+1, toLua(L, element))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, element := range v {
+			table.RawSetString(key, toLua(L, element))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// arrayLength tells whether the table is an array, which is the
+// case when it's not empty and its keys are all positive integers,
+// and gives the array's length.
+func arrayLength(table *lua.LTable) (int, bool) {
+	length, keys, isArray := 0, 0, true
+	table.ForEach(func(key, _ lua.LValue) {
+		keys++
+		index, ok := key.(lua.LNumber)
+		if !ok || index < 1 || index > math.MaxInt32 || float64(index) != math.Trunc(float64(index)) {
+			isArray = false
+		} else if int(index) > length {
+			length = int(index)
+		}
+	})
+	return length, isArray && keys > 0
+}
+
+// fromLua converts a Lua value to a JSON-encodable value. Arrays
+// with holes are filled with nulls, and empty tables become empty
+// objects.
+func fromLua(value lua.LValue, depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("the value is nested too deeply, or it contains itself")
+	}
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, fmt.Errorf("the number %v can't be encoded as JSON", v)
+		}
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		return fromTable(v, depth)
+	}
+	return nil, fmt.Errorf("a %s value can't be encoded as JSON", value.Type())
+}
+
+// fromTable converts a Lua table to either a JSON array or a JSON
+// object.
+func fromTable(table *lua.LTable, depth int) (interface{}, error) {
+	if length, ok := arrayLength(table); ok {
+		count := 0
+		table.ForEach(func(_, _ lua.LValue) { count++ })
+		if length > 2*count {
+			return nil, errors.New("the array has too many holes to be encoded as JSON")
+		}
+		elements := make([]interface{}, length)
+		for i := range elements {
+			element, err := fromLua(table.RawGetInt(i+1), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = element
+		}
+		return elements, nil
+	}
+	object := make(map[string]interface{})
+	var err error
+	table.ForEach(func(key, element lua.LValue) {
+		if err != nil {
+			return
+		}
+		name, ok := key.(lua.LString)
+		if !ok {
+			err = fmt.Errorf("a table with a %s key that isn't an array can't be encoded as JSON", key.Type())
+			return
+		}
+		object[string(name)], err = fromLua(element, depth+1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// evaluate applies the script to a single input line. The script's
+// result is the new data of the event; nil drops the event, and an
+// array gives the data of several events.
+func (p *program) evaluate(w *worker, line []byte) ([]interface{}, error) {
+	var input record
+	if err := json.Unmarshal(line, &input); err != nil {
+		return nil, fmt.Errorf("invalid input record: %w", err)
+	}
+	L := w.state
+	// Each evaluation gets a fresh environment, so that the globals
+	// assigned by the script don't leak into the next one. The same
+	// goes for the libraries' tables, which are copied.
+	env := L.NewTable()
+	L.SetMetatable(env, w.globals)
+	for name, table := range w.libraries {
+		env.RawSetString(name, copyTable(L, table))
+	}
+	env.RawSetString("data", toLua(L, input.Data))
+	env.RawSetString("name", lua.LString(input.Name))
+	fn := L.NewFunctionFromProto(p.proto)
+	fn.Env = env
+	var ctx context.Context
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), p.timeout)
+		defer cancel()
+		L.SetContext(ctx)
+		defer L.RemoveContext()
+	}
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		if ctx != nil && ctx.Err() != nil {
+			w.broken = true
+			return nil, fmt.Errorf("the script exceeded the time limit of %s", p.timeout)
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return nil, errors.New(apiErr.Object.String())
+		}
+		return nil, err
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+	if result == lua.LNil {
+		return []interface{}{}, nil
+	}
+	if table, ok := result.(*lua.LTable); ok {
+		if _, isArray := arrayLength(table); isArray {
+			elements, err := fromTable(table, 0)
+			if err != nil {
+				return nil, err
+			}
+			return elements.([]interface{}), nil
+		}
+	}
+	value, err := fromLua(result, 0)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{value}, nil
+}
+
+// respond serializes the outcome of an evaluation as a single line:
+// an object with either the produced values under "data", or the
+// error message under "error".
+func respond(values []interface{}, err error) []byte {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err == nil {
+		if err = encoder.Encode(map[string]interface{}{"data": values}); err == nil {
+			return buffer.Bytes()
+		}
+		buffer.Reset()
+	}
+	encoder.Encode(map[string]string{"error": err.Error()})
+	return buffer.Bytes()
+}
+
+// process evaluates a line with the given worker, replacing the
+// worker's Lua state if the evaluation interrupted it.
+func (p *program) process(w *worker, line []byte) []byte {
+	if w.broken {
+		w.state.Close()
+		*w = *p.newWorker()
+	}
+	return respond(p.evaluate(w, line))
+}
+
+// lineReader yields the non-blank lines of the input, and io.EOF
+// once the input is exhausted. A last line without a trailing
+// newline is read too.
+func lineReader(input io.Reader) func() ([]byte, error) {
+	reader := bufio.NewReader(input)
+	return func() ([]byte, error) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				return line, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// processSerially evaluates each line in turn, using a single Lua
+// state.
+func processSerially(p *program, next func() ([]byte, error), stdout io.Writer) error {
+	w := p.newWorker()
+	defer func() { w.state.Close() }()
+	for {
+		switch line, err := next(); err {
+		case nil:
+			stdout.Write(p.process(w, line))
+
+		case io.EOF:
+			return nil
+
+		default:
+			return err
+		}
+	}
+}
+
+// job is a line to be evaluated by a worker, paired with the channel
+// where the response is expected.
+type job struct {
+	line     []byte
+	response chan []byte
+}
+
+// processConcurrently evaluates lines using a pool of workers, each
+// with its own Lua state. Responses are written in the same order as
+// the input lines were read, so that each one can be matched with
+// its line.
+func processConcurrently(p *program, workers int, next func() ([]byte, error), stdout io.Writer) error {
+	jobs := make(chan job, workers)
+	pending := make(chan chan []byte, 2*workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			w := p.newWorker()
+			defer func() { w.state.Close() }()
+			for j := range jobs {
+				j.response <- p.process(w, j.line)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		for response := range pending {
+			stdout.Write(<-response)
+		}
+		close(done)
+	}()
+
+	var readErr error
+	for {
+		line, err := next()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+		response := make(chan []byte, 1)
+		pending <- response
+		jobs <- job{line: line, response: response}
+	}
+	close(jobs)
+	close(pending)
+	<-done
+	return readErr
+}
+
+// run applies the Lua script given in args to each record read from
+// stdin, and returns the exit code of the program.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("stream-lua", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: stream-lua [options] [chunkname] <code>")
+		flags.PrintDefaults()
+	}
+	workers := flags.Int("workers", 1, "number of records evaluated concurrently, each by its own Lua state")
+	timeout := flags.Duration("timeout", time.Second, "maximum duration of a single evaluation, or 0 for no limit")
+	checkOnly := flags.Bool("check", false, "check the script's syntax and exit, without reading stdin")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	args = flags.Args()
+	if len(args) > 2 || len(args) < 1 {
+		flags.Usage()
+		return 1
+	}
+	if *workers < 1 {
+		fmt.Fprintln(stderr, "error: the number of workers must be at least 1")
+		return 1
+	}
+	if *timeout < 0 {
+		fmt.Fprintln(stderr, "error: the timeout must not be negative")
+		return 1
+	}
+	chunkName := "stream.lua"
+	if len(args) > 1 {
+		chunkName = args[0]
+	}
+	proto, err := compile(chunkName, args[len(args)-1])
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	if *checkOnly {
+		return 0
+	}
+	p := &program{proto: proto, timeout: *timeout, stderr: stderr}
+
+	next := lineReader(stdin)
+	if *workers == 1 {
+		err = processSerially(p, next, stdout)
+	} else {
+		err = processConcurrently(p, *workers, next, stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// This program receives a Lua script and applies it to every record
+// read from stdin, each one an object holding an event's name and
+// data. It writes a single line for each record, holding either the
+// values produced by the script or the error it raised.
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// runWith executes the program with the given arguments and stdin,
+// returning the exit code, stdout and stderr.
+func runWith(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestTransform(t *testing.T) {
+	code, stdout, stderr := runWith(
+		t,
+		"{\"name\":\"reading\",\"data\":{\"celsius\":100,\"tags\":[\"a\",\"b\"]}}\n",
+		"data.fahrenheit = data.celsius * 9 / 5 + 32\n"+
+			"data.source = name\n"+
+			"table.insert(data.tags, string.upper(\"c\"))\n"+
+			"return data",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d (stderr: %s)", code, stderr)
+	}
+	expected := "{\"data\":[{\"celsius\":100,\"fahrenheit\":212,\"source\":\"reading\",\"tags\":[\"a\",\"b\",\"C\"]}]}\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestScalarsAndEmptyTables(t *testing.T) {
+	code, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":\"<b>&\"}\n{\"name\":\"a\",\"data\":[]}\n{\"name\":\"a\"}\n",
+		"if type(data) == 'string' then return data .. '!' end\n"+
+			"if data == nil then return false end\n"+
+			"return data",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	expected := "{\"data\":[\"<b>&!\"]}\n{\"data\":[{}]}\n{\"data\":[false]}\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestDrop(t *testing.T) {
+	code, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":1}\n{\"name\":\"a\",\"data\":2}\n",
+		"if data % 2 == 1 then return nil end\nreturn data",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if stdout != "{\"data\":[]}\n{\"data\":[2]}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	code, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":{\"items\":[1,2,3]}}\n",
+		"local out = {}\n"+
+			"for i, item in ipairs(data.items) do out[i] = {item = item} end\n"+
+			"out[5] = {item = 5}\n"+
+			"return out",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	expected := "{\"data\":[{\"item\":1},{\"item\":2},{\"item\":3},null,{\"item\":5}]}\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	// A single array is given by wrapping it.
+	_, stdout, _ = runWith(t, "{\"name\":\"a\",\"data\":[1,2]}\n", "return {data}")
+	if stdout != "{\"data\":[[1,2]]}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	code, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":{}}\nnot json\n{\"name\":\"a\",\"data\":1}\n",
+		"step",
+		"if type(data) == 'table' then error('not a number') end\n"+
+			"return {x = print}",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a response per line, got %q", stdout)
+	}
+	for i, expected := range []string{
+		"{\"error\":\"step:1: not a number\"}",
+		"{\"error\":\"invalid input record:",
+		"{\"error\":\"a function value can't be encoded as JSON\"}",
+	} {
+		if !strings.HasPrefix(lines[i], expected) {
+			t.Errorf("unexpected response %q for line %d", lines[i], i+1)
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	for _, script := range []string{
+		"return os.getenv('HOME')",
+		"return io.open('/etc/passwd'):read('*a')",
+		"return require('os')",
+		"return dofile('/etc/passwd')",
+		"return loadstring('return 1')()",
+		"return debug.getinfo(1)",
+		"return getfenv(print)",
+	} {
+		code, stdout, _ := runWith(t, "{\"name\":\"a\",\"data\":1}\n", script)
+		if code != 0 {
+			t.Fatalf("expected exit code 0 for %q, got %d", script, code)
+		}
+		if !strings.HasPrefix(stdout, "{\"error\":") {
+			t.Errorf("expected %q to fail, got %q", script, stdout)
+		}
+	}
+}
+
+func TestGlobalsDontLeak(t *testing.T) {
+	_, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":1}\n{\"name\":\"a\",\"data\":2}\n",
+		"local previous = seen\nseen = data\nreturn previous or 0",
+	)
+	if stdout != "{\"data\":[0]}\n{\"data\":[0]}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestLibrariesDontLeak(t *testing.T) {
+	_, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":1}\n{\"name\":\"a\",\"data\":2}\n",
+		"local result = {('a'):upper(), string.upper('b'), math.pi, #table}\n"+
+			"string.upper = nil\nmath.pi = 3\nrawset(table, 'insert', nil)\n"+
+			"local meta = getmetatable('')\n"+
+			"if meta then meta.__index.upper = nil end\n"+
+			"return result",
+	)
+	expected := "{\"data\":[\"A\",\"B\",3.141592653589793,0]}\n"
+	if stdout != expected+expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestPrintWritesToStderr(t *testing.T) {
+	_, stdout, stderr := runWith(t, "{\"name\":\"a\",\"data\":1}\n", "print('got', data)\nreturn data")
+	if stdout != "{\"data\":[1]}\n" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	if stderr != "got\t1\n" {
+		t.Errorf("unexpected errors %q", stderr)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	code, stdout, _ := runWith(
+		t,
+		"{\"name\":\"a\",\"data\":1}\n{\"name\":\"a\",\"data\":2}\n",
+		"-timeout", "50ms",
+		"if data == 1 then while true do end end\nreturn data",
+	)
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	expected := "{\"error\":\"the script exceeded the time limit of 50ms\"}\n" +
+		"{\"data\":[2]}\n"
+	if stdout != expected {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestWorkersKeepOrder(t *testing.T) {
+	var input strings.Builder
+	var expected strings.Builder
+	for i := 1; i <= 200; i++ {
+		fmt.Fprintf(&input, "{\"name\":\"a\",\"data\":%d}\n", i)
+		fmt.Fprintf(&expected, "{\"data\":[%d]}\n", i*i)
+	}
+	code, stdout, _ := runWith(t, input.String(), "-workers", "4", "return data * data")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if stdout != expected.String() {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestInvalidArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"a", "b", "return 1"},
+		{"-workers", "0", "return 1"},
+		{"-timeout", "-1s", "return 1"},
+		{"return ("},
+	} {
+		code, stdout, _ := runWith(t, "{\"name\":\"a\",\"data\":1}\n", args...)
+		if code != 1 {
+			t.Errorf("expected exit code 1 for %q, got %d", args, code)
+		}
+		if stdout != "" {
+			t.Errorf("unexpected output for %q: %q", args, stdout)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if code, _, _ := runWith(t, "", "-check", "return data"); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	code, _, stderr := runWith(t, "", "-check", "step", "return (")
+	if code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+	if !strings.Contains(stderr, "step") {
+		t.Errorf("expected the chunk name in the error, got %q", stderr)
+	}
+}
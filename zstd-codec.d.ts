@@ -0,0 +1,24 @@
+// Type definitions for zstd-codec 0.1.4
+// Project: cdp
+// Definitions by: Kai Klingenberg
+
+declare module "zstd-codec" {
+  interface Simple {
+    compress(data: Uint8Array, level?: number): Uint8Array | null;
+    decompress(data: Uint8Array): Uint8Array | null;
+  }
+
+  interface Streaming {
+    compress(data: Uint8Array, level?: number): Uint8Array | null;
+    decompress(data: Uint8Array, sizeHint?: number): Uint8Array | null;
+  }
+
+  export interface Zstd {
+    Simple: { new (): Simple };
+    Streaming: { new (): Streaming };
+  }
+
+  export const ZstdCodec: {
+    run(callback: (zstd: Zstd) => void): void;
+  };
+}